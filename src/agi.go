@@ -4,6 +4,7 @@ import (
 	"net/http"
 
 	agi "imuslab.com/arozos/mod/agi"
+	permission "imuslab.com/arozos/mod/permission"
 	prout "imuslab.com/arozos/mod/prouter"
 	"imuslab.com/arozos/mod/utils"
 )
@@ -28,6 +29,9 @@ func AGIInit() {
 		ShareManager:         shareManager,
 		NightlyManager:       nightlyManager,
 		TempFolderPath:       *tmp_directory,
+		DefaultEngine:        *agi_engine,
+		ExecutionObserver:    systemMetricsObserveAGI,
+		AuditLogger:          fileAuditLogger,
 	})
 	if err != nil {
 		systemWideLogger.PrintAndLog("AGI", "AGI Gateway Initialization Failed", err)
@@ -88,5 +92,19 @@ func AGIInit() {
 	externalAGIRouter.HandleFunc("/api/ajgi/addExt", gw.AddExternalEndPoint)
 	externalAGIRouter.HandleFunc("/api/ajgi/rmExt", gw.RemoveExternalEndPoint)
 
+	//AGI script policy management, admin only
+	agiPolicyRouter := prout.NewModuleRouter(prout.RouterOption{
+		ModuleName:  "System Setting",
+		AdminOnly:   true,
+		Capability:  permission.CapSecuritySettings,
+		UserHandler: userHandler,
+		DeniedHandler: func(w http.ResponseWriter, r *http.Request) {
+			errorHandlePermissionDenied(w, r)
+		},
+	})
+	agiPolicyRouter.HandleFunc("/system/ajgi/policy/list", gw.HandleListPolicy)
+	agiPolicyRouter.HandleFunc("/system/ajgi/policy/set", gw.HandleSetPolicy)
+	agiPolicyRouter.HandleFunc("/system/ajgi/policy/reset", gw.HandleResetPolicy)
+
 	AGIGateway = gw
 }
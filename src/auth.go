@@ -6,6 +6,7 @@ import (
 	"net/http"
 
 	auth "imuslab.com/arozos/mod/auth"
+	permission "imuslab.com/arozos/mod/permission"
 	prout "imuslab.com/arozos/mod/prouter"
 	"imuslab.com/arozos/mod/utils"
 )
@@ -51,11 +52,15 @@ func AuthInit() {
 	http.HandleFunc("/system/auth/checkLogin", authAgent.CheckLogin)
 	http.HandleFunc("/api/auth/login", authAgent.HandleAutologinTokenLogin)
 
+	//Session (device) management of the current user
+	http.HandleFunc("/system/auth/sessions/list", authAgent.HandleListSessions)
+	http.HandleFunc("/system/auth/sessions/revoke", authAgent.HandleRevokeSession)
+
 	authAgent.LoadAutologinTokenFromDB()
 }
 
 func AuthSettingsInit() {
-	//Authentication related settings
+	//Authentication related settings. Batch operations can create or remove admins, require full admin
 	adminRouter := prout.NewModuleRouter(prout.RouterOption{
 		ModuleName:  "System Setting",
 		AdminOnly:   true,
@@ -69,6 +74,19 @@ func AuthSettingsInit() {
 	adminRouter.HandleFunc("/system/auth/csvimport", authAgent.HandleCreateUserAccountsFromCSV)
 	adminRouter.HandleFunc("/system/auth/groupdel", authAgent.HandleUserDeleteByGroup)
 
+	//Session management of all users
+	sessionRouter := prout.NewModuleRouter(prout.RouterOption{
+		ModuleName:  "System Setting",
+		AdminOnly:   true,
+		Capability:  permission.CapUserManagement,
+		UserHandler: userHandler,
+		DeniedHandler: func(w http.ResponseWriter, r *http.Request) {
+			utils.SendErrorResponse(w, "Permission Denied")
+		},
+	})
+	sessionRouter.HandleFunc("/system/auth/sessions/admin/list", authAgent.HandleAdminListSessions)
+	sessionRouter.HandleFunc("/system/auth/sessions/admin/revoke", authAgent.HandleAdminRevokeSession)
+
 	//System for logging and displaying login user information
 	registerSetting(settingModule{
 		Name:         "Connection Log",
@@ -77,10 +95,20 @@ func AuthSettingsInit() {
 		Group:        "Security",
 		StartDir:     "SystemAO/security/connlog.html",
 		RequireAdmin: true,
+		Capability:   permission.CapLogViewing,
 	})
 
-	adminRouter.HandleFunc("/system/auth/logger/index", authAgent.Logger.HandleIndexListing)
-	adminRouter.HandleFunc("/system/auth/logger/list", authAgent.Logger.HandleTableListing)
+	logRouter := prout.NewModuleRouter(prout.RouterOption{
+		ModuleName:  "System Setting",
+		AdminOnly:   true,
+		Capability:  permission.CapLogViewing,
+		UserHandler: userHandler,
+		DeniedHandler: func(w http.ResponseWriter, r *http.Request) {
+			utils.SendErrorResponse(w, "Permission Denied")
+		},
+	})
+	logRouter.HandleFunc("/system/auth/logger/index", authAgent.Logger.HandleIndexListing)
+	logRouter.HandleFunc("/system/auth/logger/list", authAgent.Logger.HandleTableListing)
 
 	//Blacklist Management
 	registerSetting(settingModule{
@@ -90,19 +118,37 @@ func AuthSettingsInit() {
 		Group:        "Security",
 		StartDir:     "SystemAO/security/accesscontrol.html",
 		RequireAdmin: true,
+		Capability:   permission.CapSecuritySettings,
+	})
+
+	securityRouter := prout.NewModuleRouter(prout.RouterOption{
+		ModuleName:  "System Setting",
+		AdminOnly:   true,
+		Capability:  permission.CapSecuritySettings,
+		UserHandler: userHandler,
+		DeniedHandler: func(w http.ResponseWriter, r *http.Request) {
+			utils.SendErrorResponse(w, "Permission Denied")
+		},
 	})
 
 	//Whitelist API
-	adminRouter.HandleFunc("/system/auth/whitelist/enable", authAgent.WhitelistManager.HandleSetWhitelistEnable)
-	adminRouter.HandleFunc("/system/auth/whitelist/list", authAgent.WhitelistManager.HandleListWhitelistedIPs)
-	adminRouter.HandleFunc("/system/auth/whitelist/set", authAgent.WhitelistManager.HandleAddWhitelistedIP)
-	adminRouter.HandleFunc("/system/auth/whitelist/unset", authAgent.WhitelistManager.HandleRemoveWhitelistedIP)
+	securityRouter.HandleFunc("/system/auth/whitelist/enable", authAgent.WhitelistManager.HandleSetWhitelistEnable)
+	securityRouter.HandleFunc("/system/auth/whitelist/list", authAgent.WhitelistManager.HandleListWhitelistedIPs)
+	securityRouter.HandleFunc("/system/auth/whitelist/set", authAgent.WhitelistManager.HandleAddWhitelistedIP)
+	securityRouter.HandleFunc("/system/auth/whitelist/unset", authAgent.WhitelistManager.HandleRemoveWhitelistedIP)
 
 	//Blacklist API
-	adminRouter.HandleFunc("/system/auth/blacklist/enable", authAgent.BlacklistManager.HandleSetBlacklistEnable)
-	adminRouter.HandleFunc("/system/auth/blacklist/list", authAgent.BlacklistManager.HandleListBannedIPs)
-	adminRouter.HandleFunc("/system/auth/blacklist/ban", authAgent.BlacklistManager.HandleAddBannedIP)
-	adminRouter.HandleFunc("/system/auth/blacklist/unban", authAgent.BlacklistManager.HandleRemoveBannedIP)
+	securityRouter.HandleFunc("/system/auth/blacklist/enable", authAgent.BlacklistManager.HandleSetBlacklistEnable)
+	securityRouter.HandleFunc("/system/auth/blacklist/list", authAgent.BlacklistManager.HandleListBannedIPs)
+	securityRouter.HandleFunc("/system/auth/blacklist/ban", authAgent.BlacklistManager.HandleAddBannedIP)
+	securityRouter.HandleFunc("/system/auth/blacklist/unban", authAgent.BlacklistManager.HandleRemoveBannedIP)
+
+	//Auto Ban API
+	securityRouter.HandleFunc("/system/auth/autoban/config", authAgent.AutoBanManager.HandleConfig)
+	securityRouter.HandleFunc("/system/auth/autoban/bans", authAgent.AutoBanManager.HandleListBans)
+	securityRouter.HandleFunc("/system/auth/autoban/strikes", authAgent.AutoBanManager.HandleListStrikes)
+	securityRouter.HandleFunc("/system/auth/autoban/unban", authAgent.AutoBanManager.HandleUnban)
+	securityRouter.HandleFunc("/system/auth/autoban/reset", authAgent.AutoBanManager.HandleResetStrikes)
 
 	//Register nightly task for clearup all user retry counter
 	nightlyManager.RegisterNightlyTask(authAgent.ExpDelayHandler.ResetAllUserRetryCounter)
@@ -149,9 +195,9 @@ func AuthSettingsInit() {
 }
 
 // Validate secure request that use authreq.html
-// Require POST: password and admin permission
+// Require POST: password and the given admin capability (empty for no admin requirement)
 // return true if authentication passed
-func AuthValidateSecureRequest(w http.ResponseWriter, r *http.Request, requireAdmin bool) bool {
+func AuthValidateSecureRequest(w http.ResponseWriter, r *http.Request, requireCapability string) bool {
 	userinfo, err := userHandler.GetUserInfoFromRequest(w, r)
 	if err != nil {
 		w.WriteHeader(http.StatusUnauthorized)
@@ -159,8 +205,8 @@ func AuthValidateSecureRequest(w http.ResponseWriter, r *http.Request, requireAd
 		return false
 	}
 
-	if requireAdmin {
-		if !userinfo.IsAdmin() {
+	if requireCapability != "" {
+		if !userinfo.HasCapability(requireCapability) {
 			w.WriteHeader(http.StatusForbidden)
 			w.Write([]byte("403 Forbidden"))
 			return false
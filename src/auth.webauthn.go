@@ -0,0 +1,83 @@
+package main
+
+import (
+	"net/http"
+
+	"imuslab.com/arozos/mod/auth/webauthn"
+	permission "imuslab.com/arozos/mod/permission"
+	prout "imuslab.com/arozos/mod/prouter"
+	"imuslab.com/arozos/mod/utils"
+)
+
+/*
+	WebAuthn / Passkey Login
+
+	Passwordless login and second factor with FIDO2
+	security keys or platform passkeys
+*/
+
+var webauthnManager *webauthn.Manager //nil if passkey login failed to start
+
+func AuthWebAuthnInit() {
+	var err error
+	webauthnManager, err = webauthn.NewManager(&webauthn.Options{
+		Database:  sysdb,
+		AuthAgent: authAgent,
+		RPName:    *host_name,
+		IsAdmin:   authWebAuthnIsAdmin,
+	})
+	if err != nil {
+		systemWideLogger.PrintAndLog("WebAuthn", "Unable to start passkey login", err)
+		return
+	}
+	authAgent.SecondFactorHandler = webauthnManager.SecondFactorHandler
+	authAgent.SecondFactorRequired = webauthnManager.SecondFactorRequired
+	authAgent.OnUserRemoved = webauthnManager.RemoveUser
+
+	//Login APIs, accessible without login
+	http.HandleFunc("/system/auth/webauthn/login/begin", webauthnManager.HandleLoginBegin)
+	http.HandleFunc("/system/auth/webauthn/login/finish", webauthnManager.HandleLoginFinish)
+
+	registerSetting(settingModule{
+		Name:         "Passkeys",
+		Desc:         "Login with security keys and passkeys",
+		IconPath:     "SystemAO/users/img/small_icon.png",
+		Group:        "Users",
+		StartDir:     "SystemAO/users/passkeys.html",
+		RequireAdmin: false,
+	})
+
+	//Passkey management of the current user
+	userRouter := prout.NewModuleRouter(prout.RouterOption{
+		AdminOnly:   false,
+		UserHandler: userHandler,
+		DeniedHandler: func(w http.ResponseWriter, r *http.Request) {
+			utils.SendErrorResponse(w, "Permission Denied")
+		},
+	})
+	userRouter.HandleFunc("/system/auth/webauthn/register/begin", webauthnManager.HandleRegisterBegin)
+	userRouter.HandleFunc("/system/auth/webauthn/register/finish", webauthnManager.HandleRegisterFinish)
+	userRouter.HandleFunc("/system/auth/webauthn/list", webauthnManager.HandleListCredentials)
+	userRouter.HandleFunc("/system/auth/webauthn/rename", webauthnManager.HandleRenameCredential)
+	userRouter.HandleFunc("/system/auth/webauthn/revoke", webauthnManager.HandleRevokeCredential)
+	userRouter.HandleFunc("/system/auth/webauthn/secondFactor", webauthnManager.HandleSetSecondFactor)
+
+	adminRouter := prout.NewModuleRouter(prout.RouterOption{
+		ModuleName:  "System Setting",
+		AdminOnly:   true,
+		Capability:  permission.CapSecuritySettings,
+		UserHandler: userHandler,
+		DeniedHandler: func(w http.ResponseWriter, r *http.Request) {
+			utils.SendErrorResponse(w, "Permission Denied")
+		},
+	})
+	adminRouter.HandleFunc("/system/auth/webauthn/policy", webauthnManager.HandlePolicy)
+}
+
+func authWebAuthnIsAdmin(username string) bool {
+	userinfo, err := userHandler.GetUserInfoFromUsername(username)
+	if err != nil {
+		return false
+	}
+	return userinfo.IsAdmin()
+}
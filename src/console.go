@@ -199,8 +199,13 @@ func consoleCommandHandler(input string) string {
 			//Disable blacklist
 			authAgent.BlacklistManager.SetBlacklistEnabled(false)
 			return "Blacklist Disabled"
+		} else if matchSubfix(chunk, []string{"access", "autoban", "clear"}, 3, "") {
+			//Lift all temporary bans created by the auto ban policy
+			authAgent.BlacklistManager.ClearTemporaryBans()
+			authAgent.AutoBanManager.ResetStrikes("")
+			return "Auto Bans Cleared"
 		} else {
-			return "[Whitelist / Blacklist Console Control API] \nUsage: access {whitelist/blacklist} {action} {data}"
+			return "[Whitelist / Blacklist Console Control API] \nUsage: access {whitelist/blacklist/autoban} {action} {data}"
 		}
 	} else if len(chunk) == 1 && chunk[0] == "stop" {
 		//Stopping the server
@@ -7,6 +7,7 @@ package main
 */
 
 import (
+	"html"
 	"net/http"
 
 	"imuslab.com/arozos/mod/disk/diskcapacity"
@@ -15,10 +16,13 @@ import (
 	"imuslab.com/arozos/mod/disk/raid"
 	smart "imuslab.com/arozos/mod/disk/smart"
 	sortfile "imuslab.com/arozos/mod/disk/sortfile"
+	permission "imuslab.com/arozos/mod/permission"
 	prout "imuslab.com/arozos/mod/prouter"
 	"imuslab.com/arozos/mod/utils"
 )
 
+var smartListener *smart.SMARTListener //Disk SMART listener, nil if hardware management is disabled or not supported
+
 func RAIDServiceInit() {
 	/*
 		RAID Management
@@ -111,6 +115,7 @@ func DiskServiceInit() {
 		adminRouter := prout.NewModuleRouter(prout.RouterOption{
 			ModuleName:  "System Setting",
 			AdminOnly:   true,
+			Capability:  permission.CapStorageManagement,
 			UserHandler: userHandler,
 			DeniedHandler: func(w http.ResponseWriter, r *http.Request) {
 				utils.SendErrorResponse(w, "Permission Denied")
@@ -124,12 +129,20 @@ func DiskServiceInit() {
 			See disk/SMART for more information
 		*/
 		if *allow_hardware_management {
-			smartListener, err := smart.NewSmartListener()
+			sl, err := smart.NewSmartListener()
 			if err != nil {
 				//Listener creation failed
 				systemWideLogger.PrintAndLog("Disk", "Failed to create SMART listener: "+err.Error(), err)
 			} else {
-				//Listener created. Register endpoints
+				//Listener created. Start polling and register endpoints
+				smartListener = sl
+				err = smartListener.StartMonitor(&smart.MonitorOptions{
+					Database: sysdb,
+					OnAlert:  diskSmartAlert,
+				})
+				if err != nil {
+					systemWideLogger.PrintAndLog("Disk", "Failed to start SMART monitor: "+err.Error(), err)
+				}
 				registerSetting(settingModule{
 					Name:         "Disk SMART",
 					Desc:         "HardDisk Health Checking",
@@ -137,15 +150,29 @@ func DiskServiceInit() {
 					Group:        "Disk",
 					StartDir:     "SystemAO/disk/smart/smart.html",
 					RequireAdmin: true,
+					Capability:   permission.CapStorageManagement,
 				})
 
 				authRouter.HandleFunc("/system/disk/smart/getSMART", smartListener.GetSMART)
+				adminRouter.HandleFunc("/system/disk/smart/refresh", smartListener.HandleRefresh)
+				adminRouter.HandleFunc("/system/disk/smart/history", smartListener.HandleHistory)
+				adminRouter.HandleFunc("/system/disk/smart/alerts", smartListener.HandleAlerts)
+				adminRouter.HandleFunc("/system/disk/smart/monitor", smartListener.HandleMonitorConfig)
 			}
 
 			/*
 				RAID Manager endpoints
 			*/
 			if raidManager != nil {
+				//Watch the arrays in background for degraded members and scheduled scrubs
+				err := raidManager.StartMonitor(&raid.MonitorOptions{
+					Database: sysdb,
+					OnAlert:  diskRAIDAlert,
+				})
+				if err != nil {
+					systemWideLogger.PrintAndLog("RAID", "Failed to start RAID monitor: "+err.Error(), err)
+				}
+
 				//Register endpoints and settings for this host
 				registerSetting(settingModule{
 					Name:         "RAID",
@@ -154,6 +181,7 @@ func DiskServiceInit() {
 					Group:        "Disk",
 					StartDir:     "SystemAO/disk/raid/index.html",
 					RequireAdmin: true,
+					Capability:   permission.CapStorageManagement,
 				})
 
 				/* RAID storage pool function */
@@ -161,13 +189,13 @@ func DiskServiceInit() {
 				adminRouter.HandleFunc("/system/disk/raid/list", raidManager.HandleListRaidDevices)
 				adminRouter.HandleFunc("/system/disk/raid/new", raidManager.HandleCreateRAIDDevice)
 				adminRouter.HandleFunc("/system/disk/raid/remove", func(w http.ResponseWriter, r *http.Request) {
-					if !AuthValidateSecureRequest(w, r, true) {
+					if !AuthValidateSecureRequest(w, r, permission.CapStorageManagement) {
 						return
 					}
 					raidManager.HandleRemoveRaideDevice(w, r)
 				})
 				adminRouter.HandleFunc("/system/disk/raid/assemble", func(w http.ResponseWriter, r *http.Request) {
-					if !AuthValidateSecureRequest(w, r, true) {
+					if !AuthValidateSecureRequest(w, r, permission.CapStorageManagement) {
 						return
 					}
 					raidManager.HandleForceAssembleReload(w, r)
@@ -179,6 +207,13 @@ func DiskServiceInit() {
 				adminRouter.HandleFunc("/system/disk/raid/addMemeber", raidManager.HandleAddDiskToRAIDVol)
 				adminRouter.HandleFunc("/system/disk/raid/removeMemeber", raidManager.HandleRemoveDiskFromRAIDVol)
 
+				/* RAID monitor functions */
+				adminRouter.HandleFunc("/system/disk/raid/health", raidManager.HandleMonitorStatus)
+				adminRouter.HandleFunc("/system/disk/raid/scrub", raidManager.HandleScrub)
+				adminRouter.HandleFunc("/system/disk/raid/scrubHistory", raidManager.HandleScrubHistory)
+				adminRouter.HandleFunc("/system/disk/raid/alerts", raidManager.HandleMonitorAlerts)
+				adminRouter.HandleFunc("/system/disk/raid/monitor", raidManager.HandleMonitorConfig)
+
 				/* Device Management functions */
 				adminRouter.HandleFunc("/system/disk/devices/list", raidManager.HandleListUsableDevices)
 				adminRouter.HandleFunc("/system/disk/devices/model", raidManager.HandleResolveDiskModelLabel)
@@ -229,3 +264,16 @@ func DiskServiceInit() {
 	}
 
 }
+
+// Notify all admin users about the SMART alert
+func diskSmartAlert(alert *smart.Alert) error {
+	title := "Disk " + alert.Device + " is " + alert.Level
+	message := html.EscapeString(alert.Message) + "<br>Model: " + html.EscapeString(alert.Model) + "<br>Serial: " + html.EscapeString(alert.Drive)
+	return notifyAdmins(title, message, "SMART Monitor")
+}
+
+// Notify all admin users about the RAID alert
+func diskRAIDAlert(alert *raid.Alert) error {
+	title := "RAID array " + alert.Array + " " + alert.Level + " alert"
+	return notifyAdmins(title, html.EscapeString(alert.Message), "RAID Monitor")
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	fs "imuslab.com/arozos/mod/filesystem"
+	"imuslab.com/arozos/mod/filesystem/arozfs"
+	"imuslab.com/arozos/mod/filesystem/fswatcher"
+	"imuslab.com/arozos/mod/iot"
+	"imuslab.com/arozos/mod/network/websocket"
+	"imuslab.com/arozos/mod/notification"
+	"imuslab.com/arozos/mod/time/scheduler"
+	"imuslab.com/arozos/mod/user"
+)
+
+/*
+	Event Bus
+	This script connect the system event sources to the websocket router at /system/ws
+
+	File changes are published by the file system handlers after each file operation.
+	For local drives, the subscribed folders are also watched with inotify, so changes
+	made outside of ArozOS (e.g. Samba, shell) are published as well.
+*/
+
+// A local folder watched for the subscribers of its file topic
+type fileEventWatch struct {
+	fsh         *fs.FileSystemHandler
+	subscribers int
+}
+
+var (
+	fileEventWatcher     *fswatcher.Watcher
+	fileEventWatchedDirs = map[string]*fileEventWatch{} //Watched real path -> watch, removed when the last subscriber unwatch
+	fileEventWatchMutex  sync.Mutex
+	fileEventRecent      sync.Map //Real path + event -> last published time, for merging duplicated events
+)
+
+func EventBusInit() {
+	WebSocketRouter = websocket.NewRouter(websocket.RouterOption{
+		UserHandler:   userHandler,
+		OnSubscribe:   eventBusWatchTopic,
+		OnUnsubscribe: eventBusUnwatchTopic,
+	})
+
+	watcher, err := fswatcher.NewWatcher(func(e fswatcher.Event) {
+		fileEventWatchMutex.Lock()
+		watch, ok := fileEventWatchedDirs[filepath.Clean(filepath.Dir(e.Path))]
+		if !ok {
+			//Event on the watched folder itself
+			watch, ok = fileEventWatchedDirs[filepath.Clean(e.Path)]
+		}
+		fileEventWatchMutex.Unlock()
+		if ok {
+			publishFileEvent(watch.fsh, e.Path, e.Op)
+		}
+	})
+	if err != nil {
+		systemWideLogger.PrintAndLog("Event", "File system watcher not available, only changes made through ArozOS will be published", err)
+	} else {
+		fileEventWatcher = watcher
+	}
+
+	//Clean up the merged event records
+	go func() {
+		for {
+			time.Sleep(time.Minute)
+			fileEventRecent.Range(func(key, value interface{}) bool {
+				if time.Since(value.(time.Time)) > time.Second {
+					fileEventRecent.Delete(key)
+				}
+				return true
+			})
+		}
+	}()
+
+	//Let AGI scripts publish to their user scoped topics
+	AGIGateway.Option.EventRouter = WebSocketRouter
+}
+
+// Resolve the real path of a local folder subscribed by the user
+func eventBusResolveLocalDir(u *user.User, topic string) (string, *fs.FileSystemHandler, bool) {
+	if u == nil || fileEventWatcher == nil {
+		return "", nil, false
+	}
+	topicType, vpath, _ := strings.Cut(topic, ":")
+	if topicType != websocket.TopicFile {
+		return "", nil, false
+	}
+	fsh, err := u.GetFileSystemHandlerFromVirtualPath(vpath)
+	if err != nil || !fsh.IsLocalDrive() {
+		return "", nil, false
+	}
+	rpath, err := fsh.FileSystemAbstraction.VirtualPathToRealPath(vpath, u.Username)
+	if err != nil {
+		return "", nil, false
+	}
+	return filepath.Clean(rpath), fsh, true
+}
+
+func eventBusWatchTopic(u *user.User, topic string) {
+	rpath, fsh, ok := eventBusResolveLocalDir(u, topic)
+	if !ok || !fsh.FileSystemAbstraction.IsDir(rpath) {
+		return
+	}
+	fileEventWatchMutex.Lock()
+	defer fileEventWatchMutex.Unlock()
+	if err := fileEventWatcher.Add(rpath); err != nil {
+		return
+	}
+	if watch, ok := fileEventWatchedDirs[rpath]; ok {
+		watch.subscribers++
+	} else {
+		fileEventWatchedDirs[rpath] = &fileEventWatch{fsh: fsh, subscribers: 1}
+	}
+}
+
+func eventBusUnwatchTopic(u *user.User, topic string) {
+	//The folder might be removed already, do not require it to exist
+	rpath, _, ok := eventBusResolveLocalDir(u, topic)
+	if !ok {
+		return
+	}
+	fileEventWatchMutex.Lock()
+	defer fileEventWatchMutex.Unlock()
+	watch, ok := fileEventWatchedDirs[rpath]
+	if !ok {
+		return
+	}
+	fileEventWatcher.Remove(rpath)
+	watch.subscribers--
+	if watch.subscribers <= 0 {
+		delete(fileEventWatchedDirs, rpath)
+	}
+}
+
+/*
+	Publishers
+*/
+
+// Publish the change of a file to all the users that can read it
+func publishFileEvent(fsh *fs.FileSystemHandler, rpath string, event string) {
+	if WebSocketRouter == nil || fsh == nil {
+		return
+	}
+
+	//Merge the duplicated events from file operations and inotify
+	eventKey := fsh.UUID + "|" + filepath.Clean(rpath) + "|" + event
+	if lastPublished, ok := fileEventRecent.Load(eventKey); ok && time.Since(lastPublished.(time.Time)) < time.Second {
+		return
+	}
+	fileEventRecent.Store(eventKey, time.Now())
+
+	fshAbs := fsh.FileSystemAbstraction
+	WebSocketRouter.PublishFileEvent(event, func(u *user.User) (string, bool) {
+		vpath, err := fshAbs.RealPathToVirtualPath(rpath, u.Username)
+		if err != nil {
+			return "", false
+		}
+
+		//Make sure the path resolve back to the same file for this user, e.g. not other users' home folder
+		resolvedRpath, err := fshAbs.VirtualPathToRealPath(vpath, u.Username)
+		if err != nil || arozfs.ToSlash(filepath.Clean(resolvedRpath)) != arozfs.ToSlash(filepath.Clean(rpath)) {
+			return "", false
+		}
+		userFsh, err := u.GetFileSystemHandlerFromVirtualPath(vpath)
+		if err != nil || userFsh.UUID != fsh.UUID || !u.CanRead(vpath) {
+			return "", false
+		}
+		return vpath, true
+	})
+}
+
+// Publish the progress of a file operation to its owner
+func publishFileOperationEvent(task *fileOperationTask, event string) {
+	if WebSocketRouter == nil || task == nil {
+		return
+	}
+	taskSnapshot := *task
+	WebSocketRouter.PublishToUser(task.Owner, websocket.TopicFileOpr, event, taskSnapshot)
+}
+
+// Publish a storage mount / unmount / reconnect event to all users
+func publishStorageEvent(fsh *fs.FileSystemHandler, event string) {
+	if WebSocketRouter == nil || fsh == nil {
+		return
+	}
+	WebSocketRouter.Publish(websocket.TopicStorage, event, map[string]interface{}{
+		"uuid":       fsh.UUID,
+		"name":       fsh.Name,
+		"filesystem": fsh.Filesystem,
+		"closed":     fsh.Closed,
+	})
+}
+
+// Publish a storage quota soft limit warning to the user
+func publishQuotaWarningEvent(username string, warning string) {
+	if WebSocketRouter == nil {
+		return
+	}
+	WebSocketRouter.PublishToUser(username, websocket.TopicStorage, "quota-warning", map[string]interface{}{
+		"message": warning,
+	})
+}
+
+// Publish a notification to the receiver
+func publishNotificationEvent(username string, payload *notification.NotificationPayload) {
+	if WebSocketRouter == nil {
+		return
+	}
+	WebSocketRouter.PublishToUser(username, websocket.TopicNotification, "notification", payload)
+}
+
+// Publish the result of a scheduled job to its creator
+func publishSchedulerEvent(job scheduler.Job, output string, err error) {
+	if WebSocketRouter == nil {
+		return
+	}
+	result := map[string]interface{}{
+		"name":   job.Name,
+		"output": output,
+		"error":  "",
+	}
+	event := "success"
+	if err != nil {
+		result["error"] = err.Error()
+		event = "error"
+	}
+	WebSocketRouter.PublishToUser(job.Creator, websocket.TopicScheduler, event, result)
+}
+
+// Publish the IoT device status updates
+func publishIoTEvent(device *iot.Device, event string, data interface{}) {
+	if WebSocketRouter == nil {
+		return
+	}
+	payload := map[string]interface{}{
+		"data": data,
+	}
+	if device != nil {
+		payload["device"] = device.DeviceUUID
+		payload["name"] = device.Name
+	}
+	WebSocketRouter.Publish(websocket.TopicIoT, event, payload)
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"path"
+	"path/filepath"
+
+	"imuslab.com/arozos/mod/filesystem"
+	"imuslab.com/arozos/mod/filesystem/arozfs"
+	"imuslab.com/arozos/mod/filesystem/fileaudit"
+	"imuslab.com/arozos/mod/filesystem/fswatcher"
+	prout "imuslab.com/arozos/mod/prouter"
+	"imuslab.com/arozos/mod/utils"
+)
+
+/*
+	Archive Browsing
+	This script handle browsing and single entry extraction of archives
+
+	Supported formats are zip, tar, tar.gz, tar.zst, tar.xz and 7z.
+	Only archive extensions are associated with the viewer, as a bare .gz, .zst
+	or .xz file is not necessarily a tar archive
+	Extracting the whole archive is done with the unzip file operation
+*/
+
+func FileArchiveInit() {
+	router := prout.NewModuleRouter(prout.RouterOption{
+		ModuleName:  "File Manager",
+		AdminOnly:   false,
+		UserHandler: userHandler,
+		DeniedHandler: func(w http.ResponseWriter, r *http.Request) {
+			utils.SendErrorResponse(w, "Permission Denied")
+		},
+	})
+
+	router.HandleFunc("/system/file_system/archive/list", system_fs_handleArchiveList)
+	router.HandleFunc("/system/file_system/archive/extract", system_fs_handleArchiveExtract)
+}
+
+// List the entries inside an archive
+func system_fs_handleArchiveList(w http.ResponseWriter, r *http.Request) {
+	userinfo, err := userHandler.GetUserInfoFromRequest(w, r)
+	if err != nil {
+		utils.SendErrorResponse(w, err.Error())
+		return
+	}
+
+	vpath, err := utils.PostPara(r, "path")
+	if err != nil {
+		utils.SendErrorResponse(w, "Invalid path given")
+		return
+	}
+
+	if !userinfo.CanRead(vpath) {
+		utils.SendErrorResponse(w, "Permission Denied")
+		return
+	}
+
+	fsh, rpath, cleanup, err := resolveArchiveSource(userinfo.Username, vpath)
+	if err != nil {
+		utils.SendErrorResponse(w, err.Error())
+		return
+	}
+	defer cleanup()
+
+	entries, err := filesystem.ListArchive(fsh, rpath)
+	if err != nil {
+		utils.SendErrorResponse(w, "Unable to read archive: "+err.Error())
+		return
+	}
+
+	format := filesystem.GetArchiveFormat(vpath)
+	if format == "" {
+		format = filesystem.ArchiveFormatZip
+	}
+
+	js, _ := json.Marshal(struct {
+		Format  string
+		Entries []*filesystem.ArchiveEntry
+	}{
+		Format:  format,
+		Entries: entries,
+	})
+	utils.SendJSONResponse(w, string(js))
+}
+
+// Extract a single file or folder from an archive. Return the virtual path of the extracted item
+func system_fs_handleArchiveExtract(w http.ResponseWriter, r *http.Request) {
+	userinfo, err := userHandler.GetUserInfoFromRequest(w, r)
+	if err != nil {
+		utils.SendErrorResponse(w, err.Error())
+		return
+	}
+
+	vsrc, err := utils.PostPara(r, "src")
+	if err != nil {
+		utils.SendErrorResponse(w, "Invalid src given")
+		return
+	}
+
+	entry, err := utils.PostPara(r, "entry")
+	if err != nil {
+		utils.SendErrorResponse(w, "Invalid entry given")
+		return
+	}
+
+	//Extract next to the archive if dest is not given
+	vdest, _ := utils.PostPara(r, "dest")
+	if vdest == "" {
+		vdest = filepath.ToSlash(filepath.Dir(vsrc))
+	}
+	overwrite, _ := utils.PostPara(r, "overwrite")
+
+	if !userinfo.CanRead(vsrc) {
+		utils.SendErrorResponse(w, "Permission Denied")
+		return
+	}
+
+	if !userinfo.CanWrite(vdest) {
+		utils.SendErrorResponse(w, "Access Denied: No Write Permission")
+		return
+	}
+
+	destFsh, destSubpath, err := GetFSHandlerSubpathFromVpath(vdest)
+	if err != nil {
+		utils.SendErrorResponse(w, err.Error())
+		return
+	}
+	destFshAbs := destFsh.FileSystemAbstraction
+	rdest, err := destFshAbs.VirtualPathToRealPath(destSubpath, userinfo.Username)
+	if err != nil {
+		utils.SendErrorResponse(w, "Unable to translate virtual path")
+		return
+	}
+
+	targetName := path.Base(filepath.ToSlash(entry))
+	if destFshAbs.FileExists(filepath.Join(rdest, targetName)) && overwrite != "true" {
+		utils.SendErrorResponse(w, "Destination file already exists")
+		return
+	}
+
+	srcFsh, rsrc, cleanup, err := resolveArchiveSource(userinfo.Username, vsrc)
+	if err != nil {
+		utils.SendErrorResponse(w, err.Error())
+		return
+	}
+	defer cleanup()
+
+	//Check if the user have space for the extracted content
+	extractSize, err := filesystem.GetArchiveEntrySize(srcFsh, rsrc, entry)
+	if err != nil {
+		utils.SendErrorResponse(w, "Unable to read archive: "+err.Error())
+		return
+	}
+	if !userinfo.HaveSpaceOn(destFsh, extractSize) {
+		utils.SendErrorResponse(w, "Storage Quota Full")
+		return
+	}
+
+	err = filesystem.ExtractArchiveEntry(srcFsh, rsrc, entry, destFsh, rdest)
+	if err != nil {
+		utils.SendErrorResponse(w, err.Error())
+		return
+	}
+
+	//Set the ownership of the extracted item
+	vtarget := arozfs.ToSlash(filepath.Join(vdest, targetName))
+	userinfo.SetOwnerOfFile(destFsh, vtarget)
+	publishFileEvent(destFsh, filepath.Join(rdest, targetName), fswatcher.OpCreate)
+	fileAuditRecord(r, userinfo, fileaudit.ActionUnzip, vsrc, vtarget)
+	js, _ := json.Marshal(vtarget)
+	utils.SendJSONResponse(w, string(js))
+}
+
+// Resolve the archive virtual path into fsh and real path. Archives on
+// remote file systems are buffered to local disk, in which case fsh is nil
+func resolveArchiveSource(username string, vpath string) (*filesystem.FileSystemHandler, string, func(), error) {
+	fsh, subpath, err := GetFSHandlerSubpathFromVpath(vpath)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	fshAbs := fsh.FileSystemAbstraction
+	rpath, err := fshAbs.VirtualPathToRealPath(subpath, username)
+	if err != nil || !fshAbs.FileExists(rpath) || fshAbs.IsDir(rpath) {
+		return nil, "", nil, errors.New("File not exists")
+	}
+
+	if fsh.RequireBuffer {
+		localBufferFilepath, err := bufferRemoteFileToLocal(fsh, rpath, true)
+		if err != nil {
+			return nil, "", nil, err
+		}
+		return nil, localBufferFilepath, func() {
+			cleanFsBufferFileFromList([]string{localBufferFilepath})
+		}, nil
+	}
+	return fsh, rpath, func() {}, nil
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net/http"
+
+	"imuslab.com/arozos/mod/filesystem/fileaudit"
+	"imuslab.com/arozos/mod/permission"
+	prout "imuslab.com/arozos/mod/prouter"
+	"imuslab.com/arozos/mod/user"
+	"imuslab.com/arozos/mod/utils"
+)
+
+/*
+	File Audit Trail
+
+	Append-only log of file operations done by users through the web interface,
+	WebDAV, SFTP, FTP and share links. Stored in its own database so it survives
+	system database restores.
+*/
+
+var (
+	fileAuditLogger *fileaudit.Logger
+)
+
+func FileAuditInit() {
+	logger, err := fileaudit.NewLogger("./system/audit/fileaudit.db")
+	if err != nil {
+		systemWideLogger.PrintAndLog("File Audit", "Unable to create file audit trail, file operations will not be recorded", err)
+		return
+	}
+	fileAuditLogger = logger
+
+	logRouter := prout.NewModuleRouter(prout.RouterOption{
+		ModuleName:  "System Setting",
+		AdminOnly:   true,
+		Capability:  permission.CapLogViewing,
+		UserHandler: userHandler,
+		DeniedHandler: func(w http.ResponseWriter, r *http.Request) {
+			utils.SendErrorResponse(w, "Permission Denied")
+		},
+	})
+	logRouter.HandleFunc("/system/file_system/audit/query", fileAuditLogger.HandleQuery)
+
+	registerSetting(settingModule{
+		Name:         "File Audit",
+		Desc:         "Trace file operations done by users",
+		IconPath:     "SystemAO/updates/img/update.png",
+		Group:        "Advance",
+		StartDir:     "SystemAO/advance/fileaudit.html",
+		RequireAdmin: true,
+		Capability:   permission.CapLogViewing,
+	})
+}
+
+// Record a file operation done through the web interface
+func fileAuditRecord(r *http.Request, userinfo *user.User, action string, src string, dest string) {
+	fileAuditLogger.NewRecorderFromRequest(r, userinfo.Username, fileaudit.ChannelWeb).Record(action, src, dest)
+}
@@ -28,8 +28,10 @@ import (
 	"imuslab.com/arozos/mod/compatibility"
 	"imuslab.com/arozos/mod/filesystem"
 	"imuslab.com/arozos/mod/filesystem/arozfs"
+	"imuslab.com/arozos/mod/filesystem/fileaudit"
 	fsp "imuslab.com/arozos/mod/filesystem/fspermission"
 	"imuslab.com/arozos/mod/filesystem/fssort"
+	"imuslab.com/arozos/mod/filesystem/fswatcher"
 	"imuslab.com/arozos/mod/filesystem/fuzzy"
 	hidden "imuslab.com/arozos/mod/filesystem/hidden"
 	"imuslab.com/arozos/mod/filesystem/localversion"
@@ -152,7 +154,20 @@ func FileSystemInit() {
 		LaunchEmb:    "SystemAO/file_system/zip_extractor.html",
 		SupportEmb:   true,
 		InitEmbSize:  []int{260, 120},
-		SupportedExt: []string{".zip"},
+		SupportedExt: []string{".zip", ".7z", ".tar", ".tgz", ".tzst", ".txz"},
+	})
+
+	//Register the Archive Viewer module
+	moduleHandler.RegisterModule(module.ModuleInfo{
+		Name:         "Archive Viewer",
+		Group:        "System Tools",
+		IconPath:     "SystemAO/file_system/img/zip_extractor.png",
+		Version:      "1.0",
+		SupportFW:    true,
+		LaunchFWDir:  "SystemAO/file_system/archive_viewer.html",
+		InitFWSize:   []int{560, 480},
+		SupportEmb:   false,
+		SupportedExt: []string{".zip", ".7z", ".tar", ".tgz", ".tzst", ".txz"},
 	})
 
 	//Create user root if not exists
@@ -194,6 +209,7 @@ func FileSystemInit() {
 		UserHandler:     userHandler,
 		HostName:        *host_name,
 		TmpFolder:       *tmp_directory,
+		AuditLogger:     fileAuditLogger,
 	})
 
 	//Share related functions
@@ -214,6 +230,12 @@ func FileSystemInit() {
 	wsConnectionStore = sync.Map{}
 	router.HandleFunc("/system/file_system/ongoing", system_fs_HandleOnGoingTasks)
 
+	//Persistent background file operations, see file_system.jobs.go
+	FileOperationQueueInit()
+
+	//Archive browsing and single entry extraction, see file_system.archive.go
+	FileArchiveInit()
+
 	/*
 		Nighly Tasks
 
@@ -572,7 +594,7 @@ func system_fs_handleLowMemoryUpload(w http.ResponseWriter, r *http.Request) {
 					os.RemoveAll(uploadFolder)
 				}
 				return
-			} else if !userinfo.StorageQuota.HaveSpace(totalFileSize) {
+			} else if !userinfo.HaveSpaceOn(fsh, totalFileSize) {
 				//Quota exceeded
 				c.WriteMessage(1, []byte(`{\"error\":\"User Storage Quota Exceeded\"}`))
 
@@ -674,7 +696,7 @@ func system_fs_handleLowMemoryUpload(w http.ResponseWriter, r *http.Request) {
 		c.WriteMessage(1, []byte(`{\"error\":\"Failed to validate uploaded file\"}`))
 		return
 	}
-	if !userinfo.StorageQuota.HaveSpace(fi.Size()) {
+	if !userinfo.HaveSpaceOn(fsh, fi.Size()) {
 		c.WriteMessage(1, []byte(`{\"error\":\"User Storage Quota Exceeded\"}`))
 		if fsh.RequireBuffer {
 			os.RemoveAll(mergeFileLocation)
@@ -713,6 +735,9 @@ func system_fs_handleLowMemoryUpload(w http.ResponseWriter, r *http.Request) {
 
 	//Set owner of the new uploaded file
 	userinfo.SetOwnerOfFile(fsh, unescapedPath)
+	publishFileEvent(fsh, decodedUploadLocation, fswatcher.OpCreate)
+	uploadedVpath, _ := fshAbs.RealPathToVirtualPath(decodedUploadLocation, userinfo.Username)
+	fileAuditRecord(r, userinfo, fileaudit.ActionUpload, uploadedVpath, "")
 
 	//Return complete signal
 	c.WriteMessage(1, []byte("OK"))
@@ -830,7 +855,7 @@ func system_fs_handleUpload(w http.ResponseWriter, r *http.Request) {
 
 	//Check for storage quota
 	uploadFileSize := handler.Size
-	if !userinfo.StorageQuota.HaveSpace(uploadFileSize) {
+	if !userinfo.HaveSpaceOn(fsh, uploadFileSize) {
 		utils.SendErrorResponse(w, "User Storage Quota Exceeded")
 		return
 	}
@@ -858,6 +883,9 @@ func system_fs_handleUpload(w http.ResponseWriter, r *http.Request) {
 
 	//Set the ownership of file
 	userinfo.SetOwnerOfFile(fsh, uploadTarget)
+	publishFileEvent(fsh, destFilepath, fswatcher.OpCreate)
+	uploadedVpath, _ := targetFs.RealPathToVirtualPath(destFilepath, userinfo.Username)
+	fileAuditRecord(r, userinfo, fileaudit.ActionUpload, uploadedVpath, "")
 
 	//Finish up the upload
 	/*
@@ -1107,7 +1135,11 @@ func system_fs_restoreFile(w http.ResponseWriter, r *http.Request) {
 	restoreFolderRoot := filepath.Dir(filepath.Dir(filepath.Dir(realpath)))
 	targetPath := filepath.ToSlash(filepath.Join(restoreFolderRoot, originalFilename))
 	//systemWideLogger.PrintAndLog("File System", (targetPath)
-	fshAbs.Rename(realpath, targetPath)
+	err = fshAbs.Rename(realpath, targetPath)
+	if err == nil {
+		restoredVpath, _ := fshAbs.RealPathToVirtualPath(targetPath, userinfo.Username)
+		fileAuditRecord(r, userinfo, fileaudit.ActionRestore, targetTrashedFile, restoredVpath)
+	}
 
 	//Check if the parent dir has no more fileds. If yes, remove it
 	filescounter, _ := fshAbs.Glob(filepath.Dir(realpath) + "/*")
@@ -1136,13 +1168,12 @@ func system_fs_clearTrashBin(w http.ResponseWriter, r *http.Request) {
 	//Get list success. Remove each of them.
 	for c, file := range fileList {
 		fileVpath, _ := fshs[c].FileSystemAbstraction.RealPathToVirtualPath(file, u.Username)
-		isOwner := u.IsOwnerOfFile(fshs[c], fileVpath)
-		if isOwner {
-			//This user own this system. Remove this file from his quota
-			u.RemoveOwnershipFromFile(fshs[c], fileVpath)
-		}
+		//Remove this file from its owner's quota
+		u.RemoveOwnershipFromFile(fshs[c], fileVpath)
 		fshAbs := fshs[c].FileSystemAbstraction
-		fshAbs.RemoveAll(file)
+		if fshAbs.RemoveAll(file) == nil {
+			fileAuditRecord(r, u, fileaudit.ActionDelete, fileVpath, "")
+		}
 		//Check if its parent directory have no files. If yes, remove the dir itself as well.
 		filesInThisTrashBin, _ := fshAbs.Glob(filepath.Dir(file) + "/*")
 		if len(filesInThisTrashBin) == 0 {
@@ -1313,6 +1344,12 @@ func system_fs_handleNewObjects(w http.ResponseWriter, r *http.Request) {
 			}
 		}
 
+		publishFileEvent(fsh, newfilePath, fswatcher.OpCreate)
+		auditAction := fileaudit.ActionCreate
+		if fileType == "folder" {
+			auditAction = fileaudit.ActionMkdir
+		}
+		fileAuditRecord(r, userinfo, auditAction, arozfs.ToSlash(filepath.Join(vsrc, filename)), "")
 		utils.SendOK(w)
 	} else {
 		utils.SendErrorResponse(w, "Missing paramter(s).")
@@ -1428,11 +1465,17 @@ func system_fs_handleWebSocketOpr(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if operation == "zip" {
+		//Create a tar family archive instead if format is given
+		archiveFormat, _ := utils.GetPara(r, "format")
+		if !filesystem.IsTarArchiveFormat(archiveFormat) {
+			archiveFormat = filesystem.ArchiveFormatZip
+		}
+
 		//Zip files
-		outputFilename := filepath.Join(rdestFile, strings.ReplaceAll(filepath.Base(filepath.Dir(sourceFiles[0])+".zip"), ":", ""))
+		outputFilename := filepath.Join(rdestFile, strings.ReplaceAll(filepath.Base(filepath.Dir(sourceFiles[0])+"."+archiveFormat), ":", ""))
 		if len(sourceFiles) == 1 {
 			//Use the basename of the source file as zip file name
-			outputFilename = filepath.Join(rdestFile, filepath.Base(sourceFiles[0])) + ".zip"
+			outputFilename = filepath.Join(rdestFile, filepath.Base(sourceFiles[0])) + "." + archiveFormat
 		}
 
 		//Translate source Files into real paths
@@ -1482,7 +1525,7 @@ func system_fs_handleWebSocketOpr(w http.ResponseWriter, r *http.Request) {
 		}
 
 		//Create the zip file
-		err = filesystem.ArozZipFileWithProgress(sourceFileFsh, realSourceFiles, zipDestFsh, zipDestPath, false, func(currentFilename string, _ int, _ int, progress float64) int {
+		progressHandler := func(currentFilename string, _ int, _ int, progress float64) int {
 			sig, _ := UpdateOngoingFileOperation(oprId, currentFilename, math.Ceil(progress))
 			currentStatus := ProgressUpdate{
 				LatestFile: currentFilename,
@@ -1494,10 +1537,20 @@ func system_fs_handleWebSocketOpr(w http.ResponseWriter, r *http.Request) {
 			js, _ := json.Marshal(currentStatus)
 			c.WriteMessage(1, js)
 			return sig
-		})
+		}
+		if archiveFormat == filesystem.ArchiveFormatZip {
+			err = filesystem.ArozZipFileWithProgress(sourceFileFsh, realSourceFiles, zipDestFsh, zipDestPath, false, progressHandler)
+		} else {
+			err = filesystem.ArozTarFileWithProgress(sourceFileFsh, realSourceFiles, zipDestFsh, zipDestPath, archiveFormat, false, progressHandler)
+		}
 
 		if err != nil {
 			systemWideLogger.PrintAndLog("File System", "Zipping websocket request failed: "+err.Error(), err)
+		} else {
+			vzipFile, _ := destFshAbs.RealPathToVirtualPath(outputFilename, userinfo.Username)
+			for _, vsrcs := range sourceFiles {
+				fileAuditRecord(r, userinfo, fileaudit.ActionZip, vsrcs, vzipFile)
+			}
 		}
 
 		if destFsh.RequireBuffer {
@@ -1568,7 +1621,7 @@ func system_fs_handleWebSocketOpr(w http.ResponseWriter, r *http.Request) {
 				return
 			}
 			if thisSrcFsh.RequireBuffer {
-				localBufferFilepath, err := bufferRemoteFileToLocal(thisSrcFsh, rsrc, false)
+				localBufferFilepath, err := bufferRemoteFileToLocal(thisSrcFsh, rsrc, true)
 				if err != nil {
 					stopStatus := ProgressUpdate{
 						LatestFile: filepath.Base(rsrc),
@@ -1630,6 +1683,9 @@ func system_fs_handleWebSocketOpr(w http.ResponseWriter, r *http.Request) {
 		}
 
 		cleanFsBufferFileFromList(realSourceFiles)
+		for _, vsrcs := range sourceFiles {
+			fileAuditRecord(r, userinfo, fileaudit.ActionUnzip, vsrcs, vdestFile)
+		}
 
 	} else {
 		//Other operations that allow multiple source files to handle one by one
@@ -1709,6 +1765,8 @@ func system_fs_handleWebSocketOpr(w http.ResponseWriter, r *http.Request) {
 
 				//Remove the cache for the original file
 				metadata.RemoveCache(thisSrcFsh, rsrcFile)
+				publishFileEvent(thisSrcFsh, rsrcFile, fswatcher.OpDelete)
+				fileAuditRecord(r, userinfo, fileaudit.ActionMove, vsrcFile, vdestFile)
 
 			} else if operation == "copy" {
 				err := filesystem.FileCopy(thisSrcFsh, rsrcFile, destFsh, rdestFile, existsOpr, func(progress int, currentFile string) int {
@@ -1744,6 +1802,7 @@ func system_fs_handleWebSocketOpr(w http.ResponseWriter, r *http.Request) {
 					wsConnectionStore.Delete(oprId)
 					return
 				}
+				fileAuditRecord(r, userinfo, fileaudit.ActionCopy, vsrcFile, vdestFile)
 			}
 		}
 	}
@@ -1751,6 +1810,8 @@ func system_fs_handleWebSocketOpr(w http.ResponseWriter, r *http.Request) {
 	//Remove the task from ongoing tasks list
 	//TODO: REMOVE DEBUG
 	wsConnectionStore.Delete(oprId)
+	publishFileOperationEvent(&thisFileOperationTask, "done")
+	publishFileEvent(destFsh, rdestFile, fswatcher.OpModify)
 
 	//Close WebSocket connection after finished
 	time.Sleep(1 * time.Second)
@@ -1874,6 +1935,11 @@ func system_fs_handleOpr(w http.ResponseWriter, r *http.Request) {
 			os.Remove(zipFileTargetLocation)
 			cleanFsBufferFileFromList(rsrcFiles)
 		}
+		publishFileEvent(destFsh, zipFilename, fswatcher.OpCreate)
+		vzipFile, _ := destFshAbs.RealPathToVirtualPath(zipFilename, userinfo.Username)
+		for _, vsrcFile := range sourceFiles {
+			fileAuditRecord(r, userinfo, fileaudit.ActionZip, vsrcFile, vzipFile)
+		}
 
 	} else {
 		//For operations that is handled file by file
@@ -1940,6 +2006,9 @@ func system_fs_handleOpr(w http.ResponseWriter, r *http.Request) {
 
 				//Remove the cache for the original file
 				metadata.RemoveCache(srcFsh, rsrcFile)
+				publishFileEvent(srcFsh, rsrcFile, fswatcher.OpDelete)
+				publishFileEvent(srcFsh, targetNewName, fswatcher.OpCreate)
+				fileAuditRecord(r, userinfo, fileaudit.ActionRename, vsrcFile, arozfs.ToSlash(filepath.Join(filepath.Dir(vsrcFile), thisFilename)))
 
 			} else if operation == "move" {
 				//File move operation. Check if the source file / dir and target directory exists
@@ -2009,6 +2078,9 @@ func system_fs_handleOpr(w http.ResponseWriter, r *http.Request) {
 
 				//Remove cache for the original file
 				metadata.RemoveCache(srcFsh, rsrcFile)
+				publishFileEvent(srcFsh, rsrcFile, fswatcher.OpDelete)
+				publishFileEvent(destFsh, newfileRpath, fswatcher.OpCreate)
+				fileAuditRecord(r, userinfo, fileaudit.ActionMove, vsrcFile, newfileVpath)
 			} else if operation == "copy" {
 				//Copy file. See move example and change 'opr' to 'copy'
 				if !srcFshAbs.FileExists(rsrcFile) {
@@ -2035,7 +2107,8 @@ func system_fs_handleOpr(w http.ResponseWriter, r *http.Request) {
 				existsOpr, _ := utils.PostPara(r, "existsresp")
 
 				//Check if the user have space for the extra file
-				if !userinfo.StorageQuota.HaveSpace(filesystem.GetFileSize(rdestFile)) {
+				copySize, _ := srcFsh.GetDirctorySizeFromRealPath(rsrcFile, true)
+				if !userinfo.HaveSpaceOn(destFsh, copySize) {
 					utils.SendErrorResponse(w, "Storage Quota Full")
 					return
 				}
@@ -2050,6 +2123,8 @@ func system_fs_handleOpr(w http.ResponseWriter, r *http.Request) {
 				newfileRpath := filepath.ToSlash(filepath.Clean(rdestFile)) + "/" + filepath.Base(rsrcFile)
 				newfileVpath, _ := destFsh.FileSystemAbstraction.RealPathToVirtualPath(newfileRpath, userinfo.Username)
 				userinfo.SetOwnerOfFile(destFsh, newfileVpath)
+				publishFileEvent(destFsh, newfileRpath, fswatcher.OpCreate)
+				fileAuditRecord(r, userinfo, fileaudit.ActionCopy, vsrcFile, newfileVpath)
 
 			} else if operation == "delete" {
 				//Delete the file permanently
@@ -2065,12 +2140,8 @@ func system_fs_handleOpr(w http.ResponseWriter, r *http.Request) {
 					return
 				}
 
-				//Check if the user own this file
-				isOwner := userinfo.IsOwnerOfFile(srcFsh, vsrcFile)
-				if isOwner {
-					//This user own this system. Remove this file from his quota
-					userinfo.RemoveOwnershipFromFile(srcFsh, vsrcFile)
-				}
+				//Remove this file from its owner's quota
+				userinfo.RemoveOwnershipFromFile(srcFsh, vsrcFile)
 
 				//Check if this file has any cached files. If yes, remove it
 				metadata.RemoveCache(srcFsh, rsrcFile)
@@ -2087,6 +2158,8 @@ func system_fs_handleOpr(w http.ResponseWriter, r *http.Request) {
 					utils.SendErrorResponse(w, err.Error())
 					return
 				}
+				publishFileEvent(srcFsh, rsrcFile, fswatcher.OpDelete)
+				fileAuditRecord(r, userinfo, fileaudit.ActionDelete, vsrcFile, "")
 
 			} else if operation == "recycle" {
 				//Put it into a subfolder named trash and allow it to to be removed later
@@ -2127,6 +2200,8 @@ func system_fs_handleOpr(w http.ResponseWriter, r *http.Request) {
 					}
 					return
 				}
+				publishFileEvent(srcFsh, rsrcFile, fswatcher.OpDelete)
+				fileAuditRecord(r, userinfo, fileaudit.ActionRecycle, vsrcFile, "")
 			} else if operation == "unzip" {
 				//Unzip the file to destination
 
@@ -2186,6 +2261,8 @@ func system_fs_handleOpr(w http.ResponseWriter, r *http.Request) {
 
 					cleanFsBufferFileFromList([]string{unzipDest})
 				}
+				publishFileEvent(destFsh, rdestFile, fswatcher.OpModify)
+				fileAuditRecord(r, userinfo, fileaudit.ActionUnzip, vsrcFile, vdestFile)
 
 			} else {
 				utils.SendErrorResponse(w, "Unknown file opeartion given")
@@ -3342,6 +3419,7 @@ func system_fs_HandleOnGoingTasks(w http.ResponseWriter, r *http.Request) {
 	if statusFlag == "" {
 		//No flag defined. Print all operations
 		ongoingTasks := GetAllOngoingFileOperationForUser(userinfo.Username)
+		ongoingTasks = append(ongoingTasks, getBackgroundFileOperationsForUser(userinfo.Username)...)
 		js, _ := json.Marshal(ongoingTasks)
 		utils.SendJSONResponse(w, string(js))
 	} else if statusFlag != "" {
@@ -3353,7 +3431,13 @@ func system_fs_HandleOnGoingTasks(w http.ResponseWriter, r *http.Request) {
 		//Get the operation record
 		oprRecord, err := GetOngoingFileOperationByOprID(oprid)
 		if err != nil {
-			utils.SendErrorResponse(w, err.Error())
+			//Not a websocket operation, check the background jobs
+			err = controlBackgroundFileOperation(userinfo.Username, oprid, statusFlag)
+			if err != nil {
+				utils.SendErrorResponse(w, err.Error())
+				return
+			}
+			utils.SendOK(w)
 			return
 		}
 
@@ -3425,9 +3509,13 @@ func UpdateOngoingFileOperation(oprid string, currentFile string, progress float
 		return 0, err
 	}
 
+	changed := t.LatestFile != currentFile || t.Progress != progress
 	t.LatestFile = currentFile
 	t.Progress = progress
 
 	SetOngoingFileOperation(t)
+	if changed {
+		publishFileOperationEvent(t, "progress")
+	}
 	return t.FileOperationSignal, nil
 }
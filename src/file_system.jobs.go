@@ -0,0 +1,200 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"path/filepath"
+	"time"
+
+	"imuslab.com/arozos/mod/filesystem"
+	"imuslab.com/arozos/mod/filesystem/arozfs"
+	"imuslab.com/arozos/mod/filesystem/fileaudit"
+	"imuslab.com/arozos/mod/filesystem/fswatcher"
+	"imuslab.com/arozos/mod/filesystem/jobqueue"
+	"imuslab.com/arozos/mod/network/websocket"
+	prout "imuslab.com/arozos/mod/prouter"
+	"imuslab.com/arozos/mod/utils"
+)
+
+/*
+	Background File Operation Queue
+	This script handle the startup of the persistent file operation queue
+
+	Unlike the websocket file operations, jobs in this queue are stored in the
+	system database and continue in the background after the browser is
+	closed or the system restarted
+*/
+
+var fileOperationQueue *jobqueue.Queue
+
+func FileOperationQueueInit() {
+	var err error
+	fileOperationQueue, err = jobqueue.NewQueue(&jobqueue.Options{
+		Database:       sysdb,
+		UserHandler:    userHandler,
+		Resolve:        fileOperationQueueResolvePath,
+		MaxJobs:        *fileopr_max_jobs,
+		MaxJobsPerUser: *fileopr_max_jobs_per_user,
+		OnUpdate:       fileOperationQueueUpdated,
+		FinishedJobTTL: time.Duration(*fileopr_job_retention) * 24 * time.Hour,
+	})
+	if err != nil {
+		systemWideLogger.PrintAndLog("File System", "Unable to start background file operation queue", err)
+		return
+	}
+
+	router := prout.NewModuleRouter(prout.RouterOption{
+		ModuleName:  "File Manager",
+		AdminOnly:   false,
+		UserHandler: userHandler,
+		DeniedHandler: func(w http.ResponseWriter, r *http.Request) {
+			utils.SendErrorResponse(w, "Permission Denied")
+		},
+	})
+
+	router.HandleFunc("/system/file_system/jobs/add", fileOperationQueue.HandleAddJob)
+	router.HandleFunc("/system/file_system/jobs/list", fileOperationQueue.HandleListJobs)
+	router.HandleFunc("/system/file_system/jobs/control", fileOperationQueue.HandleJobControl)
+}
+
+// Resolve the virtual path of the job owner into its file system handler and real path
+func fileOperationQueueResolvePath(owner string, vpath string) (*filesystem.FileSystemHandler, string, error) {
+	userinfo, err := userHandler.GetUserInfoFromUsername(owner)
+	if err != nil {
+		return nil, "", err
+	}
+	fsh, err := userinfo.GetFileSystemHandlerFromVirtualPath(vpath)
+	if err != nil {
+		return nil, "", err
+	}
+	if fsh.Closed {
+		return nil, "", errors.New("storage " + fsh.Name + " is not mounted")
+	}
+	rpath, err := fsh.FileSystemAbstraction.VirtualPathToRealPath(vpath, owner)
+	if err != nil {
+		return nil, "", err
+	}
+	return fsh, rpath, nil
+}
+
+// Publish the job update to its owner and the file changes when the job ends
+func fileOperationQueueUpdated(job jobqueue.Job, event string) {
+	if WebSocketRouter != nil {
+		WebSocketRouter.PublishToUser(job.Owner, websocket.TopicFileOpr, event, job)
+	}
+
+	if event != "completed" && event != "cancelled" && event != "failed" {
+		return
+	}
+	if event == "completed" {
+		fileOperationQueueUpdateOwnership(job)
+
+		//Background jobs outlive the request, the client address is not available
+		audit := fileAuditLogger.NewRecorder(job.Owner, "", fileaudit.ChannelWeb)
+		for _, vsrc := range job.Sources {
+			audit.Record(job.Operation, vsrc, job.Dest)
+		}
+	}
+	if destFsh, rdest, err := fileOperationQueueResolvePath(job.Owner, job.Dest); err == nil {
+		publishFileEvent(destFsh, rdest, fswatcher.OpModify)
+	}
+	if job.Operation == jobqueue.OprMove {
+		for _, vsrc := range job.Sources {
+			if srcFsh, rsrc, err := fileOperationQueueResolvePath(job.Owner, vsrc); err == nil {
+				publishFileEvent(srcFsh, rsrc, fswatcher.OpDelete)
+			}
+		}
+	}
+}
+
+// Update the storage quota of the job owner after a background job completed
+func fileOperationQueueUpdateOwnership(job jobqueue.Job) {
+	userinfo, err := userHandler.GetUserInfoFromUsername(job.Owner)
+	if err != nil {
+		return
+	}
+	destFsh, _, err := fileOperationQueueResolvePath(job.Owner, job.Dest)
+	if err != nil {
+		return
+	}
+	for _, rtarget := range job.Targets {
+		if rtarget == "" {
+			//Skipped by conflict policy
+			continue
+		}
+		vtarget, err := destFsh.FileSystemAbstraction.RealPathToVirtualPath(rtarget, job.Owner)
+		if err == nil {
+			userinfo.SetOwnerOfFile(destFsh, vtarget)
+		}
+	}
+	if job.Operation == jobqueue.OprMove {
+		for _, vsrc := range job.Sources {
+			rtarget := job.Targets[vsrc]
+			if rtarget == "" {
+				//Not moved, the source is left untouched
+				continue
+			}
+			srcFsh, _, err := fileOperationQueueResolvePath(job.Owner, vsrc)
+			if err != nil {
+				continue
+			}
+			if srcFsh.Hierarchy == "user" {
+				//The moved content is now at the target, reclaim its size from the source
+				size, _ := destFsh.GetDirctorySizeFromRealPath(rtarget, true)
+				userinfo.StorageQuota.ReclaimSpaceOnFsh(srcFsh.UUID, size)
+			} else {
+				userinfo.RemoveOwnershipFromFile(srcFsh, vsrc)
+			}
+		}
+	}
+}
+
+// List the unfinished background jobs of the user in the format of the ongoing file operation tasks
+func getBackgroundFileOperationsForUser(username string) []*fileOperationTask {
+	results := []*fileOperationTask{}
+	if fileOperationQueue == nil {
+		return results
+	}
+	for _, job := range fileOperationQueue.ListJobs(username) {
+		signal := filesystem.FsOpr_Continue
+		if job.Status == jobqueue.StatusPaused {
+			signal = filesystem.FsOpr_Pause
+		} else if job.Status != jobqueue.StatusQueued && job.Status != jobqueue.StatusRunning {
+			continue
+		}
+		src := ""
+		if len(job.Sources) > 0 {
+			src = arozfs.ToSlash(filepath.Dir(job.Sources[0]))
+		}
+		results = append(results, &fileOperationTask{
+			ID:                  job.ID,
+			Owner:               job.Owner,
+			Src:                 src,
+			Dest:                job.Dest,
+			Progress:            job.Progress,
+			LatestFile:          job.LatestFile,
+			FileOperationSignal: signal,
+		})
+	}
+	return results
+}
+
+// Apply the continue / pause / cancel flag of the ongoing task API to a background job
+func controlBackgroundFileOperation(username string, oprid string, statusFlag string) error {
+	if fileOperationQueue == nil {
+		return errors.New("task not exists")
+	}
+	job, err := fileOperationQueue.GetJob(oprid)
+	if err != nil || job.Owner != username {
+		return errors.New("task not exists")
+	}
+	switch statusFlag {
+	case "continue":
+		return fileOperationQueue.ResumeJob(oprid)
+	case "pause":
+		return fileOperationQueue.PauseJob(oprid)
+	case "cancel":
+		return fileOperationQueue.CancelJob(oprid)
+	}
+	return errors.New("unsupported operation")
+}
@@ -6,6 +6,7 @@ import (
 	"os/exec"
 	"runtime"
 
+	permission "imuslab.com/arozos/mod/permission"
 	"imuslab.com/arozos/mod/utils"
 )
 
@@ -23,6 +24,7 @@ func HardwarePowerInit() {
 			Group:        "Info",
 			StartDir:     "SystemAO/boot/poweroff.html",
 			RequireAdmin: true,
+			Capability:   permission.CapSystemManagement,
 		})
 	}
 
@@ -39,7 +41,7 @@ func hardware_power_checkIfHardware(w http.ResponseWriter, r *http.Request) {
 
 func hardware_power_poweroff(w http.ResponseWriter, r *http.Request) {
 	//validate password using authreq.html
-	if !AuthValidateSecureRequest(w, r, true) {
+	if !AuthValidateSecureRequest(w, r, permission.CapSystemManagement) {
 		return
 	}
 
@@ -81,7 +83,7 @@ func hardware_power_poweroff(w http.ResponseWriter, r *http.Request) {
 
 func hardware_power_restart(w http.ResponseWriter, r *http.Request) {
 	//Validate password using authreq.html
-	if !AuthValidateSecureRequest(w, r, true) {
+	if !AuthValidateSecureRequest(w, r, permission.CapSystemManagement) {
 		return
 	}
 
@@ -1,13 +1,23 @@
 package main
 
 import (
+	"errors"
 	"net/http"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 
 	"imuslab.com/arozos/mod/iot"
+	"imuslab.com/arozos/mod/iot/automation"
 	"imuslab.com/arozos/mod/iot/hds"
 	"imuslab.com/arozos/mod/iot/hdsv2"
+	"imuslab.com/arozos/mod/iot/mqtt"
 	"imuslab.com/arozos/mod/iot/sonoff_s2x"
 	module "imuslab.com/arozos/mod/modules"
+	"imuslab.com/arozos/mod/notification"
+	permission "imuslab.com/arozos/mod/permission"
 	prout "imuslab.com/arozos/mod/prouter"
 	"imuslab.com/arozos/mod/utils"
 )
@@ -22,12 +32,21 @@ import (
 	IoT Panel: The panel for controlling the devices
 */
 
-var iotManager *iot.Manager
+var (
+	iotManager    *iot.Manager
+	iotAutomation *automation.Engine
+)
 
 func IoTHubInit() {
 	if *allow_iot && *allow_mdns && MDNS != nil {
 		//Create a new ioT Manager
 		iotManager = iot.NewIoTManager(sysdb)
+		iotManager.SetStatusListener(func(device *iot.Device, event string, data interface{}) {
+			publishIoTEvent(device, event, data)
+			if iotAutomation != nil {
+				iotAutomation.HandleDeviceEvent(device, event, data)
+			}
+		})
 
 		//Register IoT Hub Module
 		moduleHandler.RegisterModule(module.ModuleInfo{
@@ -64,6 +83,7 @@ func IoTHubInit() {
 		adminRouter := prout.NewModuleRouter(prout.RouterOption{
 			ModuleName:  "System Setting",
 			AdminOnly:   true,
+			Capability:  permission.CapNetworkSettings,
 			UserHandler: userHandler,
 			DeniedHandler: func(w http.ResponseWriter, r *http.Request) {
 				utils.SendErrorResponse(w, "Permission Denied")
@@ -95,7 +115,39 @@ func IoTHubInit() {
 		tasmotaSonoffS2x := sonoff_s2x.NewProtocolHandler(MDNS)
 		iotManager.RegisterHandler(tasmotaSonoffS2x)
 
+		//MQTT with Home Assistant discovery
+		mqttHandler := mqtt.NewProtocolHandler(sysdb)
+		mqttHandler.SetStatusListener(iotManager.UpdateDeviceStatus)
+		iotManager.RegisterHandler(mqttHandler)
+		adminRouter.HandleFunc("/system/iot/mqtt/config", mqttHandler.HandleConfig)
+
 		//Add more here if needed
+
+		//Automation rules and status history
+		engine, err := automation.NewEngine(&automation.Options{
+			Database:    sysdb,
+			IotManager:  iotManager,
+			UserHandler: userHandler,
+			Notify:      iotAutomationNotify,
+			RunScript:   iotAutomationRunScript,
+		})
+		if err != nil {
+			systemWideLogger.PrintAndLog("IoT", "Unable to start IoT automation engine", err)
+		} else {
+			iotAutomation = engine
+			iotAutomation.Start()
+			router.HandleFunc("/system/iot/automation/list", iotAutomation.HandleListRules)
+			router.HandleFunc("/system/iot/automation/save", iotAutomation.HandleSaveRule)
+			router.HandleFunc("/system/iot/automation/remove", iotAutomation.HandleRemoveRule)
+			router.HandleFunc("/system/iot/automation/run", iotAutomation.HandleRunRule)
+			router.HandleFunc("/system/iot/automation/log", iotAutomation.HandleRuleLog)
+			router.HandleFunc("/system/iot/history", iotAutomation.HandleHistory)
+			adminRouter.HandleFunc("/system/iot/automation/config", iotAutomation.HandleConfig)
+
+			//Webhook triggers are authenticated by the rule token instead of login
+			http.HandleFunc("/api/iot/webhook", iotAutomation.HandleWebhook)
+		}
+
 		//Start the initial scanning
 		go func() {
 			iotManager.ScanDevices()
@@ -107,3 +159,52 @@ func IoTHubInit() {
 	}
 
 }
+
+// Send the automation rule notification to its owner
+func iotAutomationNotify(username string, title string, message string) error {
+	if notificationQueue == nil {
+		return errors.New("notification service not started")
+	}
+	return notificationQueue.BroadcastNotification(&notification.NotificationPayload{
+		ID:            strconv.FormatInt(time.Now().UnixNano(), 10),
+		Title:         title,
+		Message:       message,
+		Receiver:      []string{username},
+		Sender:        "IoT Automation",
+		ReciverAgents: []string{"wsn", "smtpn"},
+	})
+}
+
+// Run the automation rule AGI script as its owner, the trigger context is given as POST paramters
+func iotAutomationRunScript(username string, scriptVpath string, context map[string]string) (string, error) {
+	targetUser, err := userHandler.GetUserInfoFromUsername(username)
+	if err != nil {
+		return "", errors.New("user " + username + " no longer exists")
+	}
+	fsh, err := targetUser.GetFileSystemHandlerFromVirtualPath(scriptVpath)
+	if err != nil {
+		return "", err
+	}
+	rpath, err := fsh.FileSystemAbstraction.VirtualPathToRealPath(scriptVpath, targetUser.Username)
+	if err != nil {
+		return "", err
+	}
+	if !fsh.FileSystemAbstraction.FileExists(rpath) {
+		return "", errors.New("script not exists")
+	}
+	ext := filepath.Ext(rpath)
+	if ext != ".js" && ext != ".agi" {
+		return "", errors.New("unsupported AGI interface script extension")
+	}
+
+	form := url.Values{}
+	for key, value := range context {
+		form.Set(key, value)
+	}
+	r, err := http.NewRequest(http.MethodPost, "/", strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return AGIGateway.ExecuteAGIScriptAsUser(fsh, rpath, targetUser, nil, r)
+}
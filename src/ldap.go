@@ -6,6 +6,7 @@ import (
 
 	ldap "imuslab.com/arozos/mod/auth/ldap"
 	fs "imuslab.com/arozos/mod/filesystem"
+	permission "imuslab.com/arozos/mod/permission"
 	prout "imuslab.com/arozos/mod/prouter"
 )
 
@@ -21,6 +22,7 @@ func ldapInit() {
 	adminRouter := prout.NewModuleRouter(prout.RouterOption{
 		ModuleName:  "System Setting",
 		AdminOnly:   true,
+		Capability:  permission.CapSecuritySettings,
 		UserHandler: userHandler,
 		DeniedHandler: func(w http.ResponseWriter, r *http.Request) {
 			errorHandlePermissionDenied(w, r)
@@ -33,6 +35,7 @@ func ldapInit() {
 		Group:        "Security",
 		StartDir:     "SystemAO/advance/ldap.html",
 		RequireAdmin: true,
+		Capability:   permission.CapSecuritySettings,
 	})
 
 	adminRouter.HandleFunc("/system/auth/ldap/config/read", ldapHandler.ReadConfig)
@@ -54,6 +54,7 @@ var listen_port = flag.Int("port", 8080, "Listening port for HTTP server")
 var tls_listen_port = flag.Int("tls_port", 8443, "Listening port for HTTPS server")
 var show_version = flag.Bool("version", false, "Show system build version")
 var host_name = flag.String("hostname", "My ArOZ", "Default name for this host")
+var public_url = flag.String("public_url", "", "Public URL of this host (e.g. https://aroz.example.com), required for links sent by e-mail like password reset")
 var system_uuid = flag.String("uuid", "", "System UUID for clustering and distributed computing. Only need to config once for first time startup. Leave empty for auto generation.")
 var disable_subservices = flag.Bool("disable_subservice", false, "Disable subservices completely")
 
@@ -62,6 +63,7 @@ var allow_upnp = flag.Bool("allow_upnp", false, "Enable uPNP service, recommende
 var allow_ssdp = flag.Bool("allow_ssdp", true, "Enable SSDP service, disable this if you do not want your device to be scanned by Windows's Network Neighborhood Page")
 var allow_mdns = flag.Bool("allow_mdns", true, "Enable MDNS service. Allow device to be scanned by nearby ArOZ Hosts")
 var force_mac = flag.String("force_mac", "", "Force MAC address to be used for discovery services. If not set, it will use the first NIC")
+var trusted_proxies = flag.String("trusted_proxies", "127.0.0.1/8,::1/128", "Comma separated IPs or CIDRs of reverse proxies that are trusted to report the client IP with X-Forwarded-For or X-Real-IP headers")
 var disable_ip_resolve_services = flag.Bool("disable_ip_resolver", false, "Disable IP resolving if the system is running under reverse proxy environment")
 var enable_gzip = flag.Bool("gzip", true, "Enable gzip compress on file server")
 
@@ -88,6 +90,9 @@ var root_directory = flag.String("root", "./files/", "User root directories")
 var file_opr_buff = flag.Int("iobuf", 1024, "Amount of buffer memory for IO operations")
 var enable_dir_listing = flag.Bool("dir_list", true, "Enable directory listing")
 var enable_asyncFileUpload = flag.Bool("upload_async", false, "Enable file upload buffering to run in async mode (Faster upload, require RAM >= 8GB)")
+var fileopr_max_jobs = flag.Int("fileopr_max_jobs", 4, "Maxmium number of background file operation jobs running at the same time")
+var fileopr_max_jobs_per_user = flag.Int("fileopr_max_jobs_per_user", 2, "Maxmium number of background file operation jobs running at the same time for each user")
+var fileopr_job_retention = flag.Int("fileopr_job_retention", 7, "Number of days to keep finished background file operation jobs in the job list, 0 to keep until removed by user")
 
 // Flags related to file system abstractions
 var bufferPoolSize = flag.Int("buffpool_size", 1024, "Maxmium buffer pool size (in MB) for buffer required file system abstractions")
@@ -98,6 +103,9 @@ var enable_buffering = flag.Bool("enable_buffpool", true, "Enable buffer pool fo
 var enable_beta_scanning_support = flag.Bool("beta_scan", false, "Allow compatibility to ArOZ Online Beta Clusters")
 var enable_console = flag.Bool("console", false, "Enable the debugging console.")
 var enable_logging = flag.Bool("logging", true, "Enable logging to file for debug purpose")
+var log_max_size = flag.Int("log_max_size", 10, "Rotate the system log when it grows beyond this size in MB, 0 to disable rotation")
+var log_max_age = flag.Int("log_max_age", 90, "Remove rotated system logs older than this number of days, 0 to keep forever. Legacy monthly logs are kept")
+var log_max_total = flag.Int("log_max_total", 0, "Remove the oldest rotated system logs when the log folder exceeds this size in MB, 0 for unlimited")
 
 // Flags related to running on Cloud Environment or public domain
 var allow_public_registry = flag.Bool("public_reg", false, "Enable public register interface for account creation")
@@ -109,6 +117,9 @@ var allow_homepage = flag.Bool("homepage", true, "Enable user homepage. Accessib
 var nightlyTaskRunTime = flag.Int("ntt", 3, "Nightly tasks execution time. Default 3 = 3 am in the morning")
 var maxTempFileKeepTime = flag.Int("tmp_time", 86400, "Time before tmp file will be deleted in seconds. Default 86400 seconds = 24 hours")
 
+// Flags related to AGI script runtime
+var agi_engine = flag.String("agi_engine", "otto", "Default JavaScript engine for AGI scripts, modules can override it in their registration. Supported engines: otto (ES5), goja (ES2020)")
+
 // Flags related to ArozOS Cluster services
 var allow_clustering = flag.Bool("allow_cluster", true, "Enable cluster operations within LAN. Require allow_mdns=true flag")
 var allow_iot = flag.Bool("allow_iot", true, "Enable IoT related APIs and scanner. Require MDNS enabled")
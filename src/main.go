@@ -9,10 +9,12 @@ import (
 	"os/signal"
 	"path/filepath"
 	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
 	console "imuslab.com/arozos/mod/console"
+	"imuslab.com/arozos/mod/network"
 )
 
 /*
@@ -41,10 +43,33 @@ func executeShutdownSequence() {
 	systemWideLogger.PrintAndLog("System", "<!> Shutting down auth gateway", nil)
 	authAgent.Close()
 
+	//Pause background file operations, they continue on next startup
+	if fileOperationQueue != nil {
+		systemWideLogger.PrintAndLog("System", "<!> Pausing background file operations", nil)
+		fileOperationQueue.Close()
+	}
+
+	//Stop SMART, RAID, certificate and proxy health polling before the database is closed
+	if smartListener != nil {
+		smartListener.Close()
+	}
+	if raidManager != nil {
+		raidManager.Close()
+	}
+	if certManager != nil {
+		certManager.Close()
+	}
+	if dynamicProxyRouter != nil {
+		dynamicProxyRouter.Close()
+	}
+
 	//Shutdown all storage pools
 	systemWideLogger.PrintAndLog("System", "<!> Shutting down storage pools", nil)
 	closeAllStoragePools()
 
+	//Shutdown file audit trail
+	fileAuditLogger.Close()
+
 	//Shutdown Logger
 	systemWideLogger.Close()
 
@@ -82,6 +107,10 @@ func main() {
 
 	//Handle flag assignments
 	max_upload_size = int64(*max_upload) << 20 //Parse the max upload size
+	if err := network.SetTrustedProxies(strings.Split(*trusted_proxies, ",")); err != nil {
+		log.Println("Unable to set trusted proxies: " + err.Error())
+		os.Exit(1)
+	}
 
 	//Clean up previous tmp files
 	final_tmp_directory := filepath.Clean(*tmp_directory) + "/tmp/"
@@ -108,6 +137,12 @@ func main() {
 	//Updates 2022-09-06: Gzip handler moved inside the master router
 	http.Handle("/", mrouter(fs))
 
+	//Record the latency of all handlers for the metrics exporter
+	rootHandler := systemMetrics.InstrumentHandler(http.DefaultServeMux)
+
+	//Proxy rules take over matching hosts and paths before the system handlers
+	rootHandler = networkProxyMiddleware(rootHandler)
+
 	//Setup handler for Ctrl +C
 	SetupCloseHandler()
 
@@ -118,19 +153,37 @@ func main() {
 				go func() {
 					address := fmt.Sprintf("%s:%d", *listen_host, *listen_port)
 					log.Println("Standard (HTTP) Web server listening at", address)
-					http.ListenAndServe(address, nil)
+					http.ListenAndServe(address, rootHandler)
 				}()
 			}
 			address := fmt.Sprintf("%s:%d", *listen_host, *tls_listen_port)
 			log.Println("Secure (HTTPS) Web server listening at", address)
-			http.ListenAndServeTLS(address, *tls_cert, *tls_key, nil)
+			if certManager != nil {
+				//Serve ACME certificates, fallback to the cert and key in flags for other hostnames
+				server := &http.Server{
+					Addr:      address,
+					Handler:   rootHandler,
+					TLSConfig: certManager.TLSConfig(),
+				}
+				server.ListenAndServeTLS("", "")
+			} else {
+				http.ListenAndServeTLS(address, *tls_cert, *tls_key, rootHandler)
+			}
 		} else {
 			address := fmt.Sprintf("%s:%d", *listen_host, *listen_port)
 			log.Println("Web server listening at", address)
-			http.ListenAndServe(address, nil)
+			http.ListenAndServe(address, rootHandler)
 		}
 	}()
 
+	//Confirm the pending update after the web server started
+	go SystemUpdateHealthCheck()
+
+	//Start obtaining and renewing certificates once the web server can answer the challenges
+	if certManager != nil {
+		certManager.Start()
+	}
+
 	if *enable_console {
 		//Startup interactive shell for debug and basic controls
 		Console := console.NewConsole(consoleCommandHandler)
@@ -31,6 +31,7 @@ func mediaServer_init() {
 		Authagent:           authAgent,
 		UserHandler:         userHandler,
 		Logger:              systemWideLogger,
+		AuditLogger:         fileAuditLogger,
 	})
 
 	//Setup the virtual path resolver
@@ -7,7 +7,7 @@ import (
 	"os"
 	"path/filepath"
 
-	"github.com/robertkrimen/otto"
+	"imuslab.com/arozos/mod/agi/jsvm"
 	"imuslab.com/arozos/mod/agi/static"
 	"imuslab.com/arozos/mod/filesystem"
 	"imuslab.com/arozos/mod/utils"
@@ -35,23 +35,23 @@ func (g *Gateway) AppdataLibRegister() {
 func (g *Gateway) injectAppdataLibFunctions(payload *static.AgiLibInjectionPayload) {
 	vm := payload.VM
 
-	vm.Set("_appdata_readfile", func(call otto.FunctionCall) otto.Value {
+	vm.Set("_appdata_readfile", func(call jsvm.FunctionCall) jsvm.Value {
 		relpath, err := call.Argument(0).ToString()
 		if err != nil {
 			g.RaiseError(err)
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 
 		//Check if this is path escape
 		escaped, err := static.CheckRootEscape(webRoot, filepath.Join(webRoot, relpath))
 		if err != nil {
 			g.RaiseError(err)
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 
 		if escaped {
 			g.RaiseError(errors.New("Path escape detected"))
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 
 		//Check if file exists
@@ -60,7 +60,7 @@ func (g *Gateway) injectAppdataLibFunctions(payload *static.AgiLibInjectionPaylo
 			content, err := os.ReadFile(targetFile)
 			if err != nil {
 				g.RaiseError(err)
-				return otto.FalseValue()
+				return jsvm.FalseValue()
 			}
 
 			//OK. Return the content of the file
@@ -68,31 +68,31 @@ func (g *Gateway) injectAppdataLibFunctions(payload *static.AgiLibInjectionPaylo
 			return result
 		} else if filesystem.IsDir(targetFile) {
 			g.RaiseError(errors.New("Cannot read from directory"))
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 
 		} else {
 			g.RaiseError(errors.New("File not exists"))
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 	})
 
-	vm.Set("_appdata_listdir", func(call otto.FunctionCall) otto.Value {
+	vm.Set("_appdata_listdir", func(call jsvm.FunctionCall) jsvm.Value {
 		relpath, err := call.Argument(0).ToString()
 		if err != nil {
 			g.RaiseError(err)
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 
 		//Check if this is path escape
 		escaped, err := static.CheckRootEscape(webRoot, filepath.Join(webRoot, relpath))
 		if err != nil {
 			g.RaiseError(err)
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 
 		if escaped {
 			g.RaiseError(errors.New("Path escape detected"))
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 
 		//Check if file exists
@@ -102,7 +102,7 @@ func (g *Gateway) injectAppdataLibFunctions(payload *static.AgiLibInjectionPaylo
 			files, err := filepath.Glob(filepath.ToSlash(filepath.Clean(targetFolder)) + "/*")
 			if err != nil {
 				g.RaiseError(err)
-				return otto.FalseValue()
+				return jsvm.FalseValue()
 			}
 
 			results := []string{}
@@ -120,7 +120,7 @@ func (g *Gateway) injectAppdataLibFunctions(payload *static.AgiLibInjectionPaylo
 
 		} else {
 			g.RaiseError(errors.New("Directory not exists"))
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 	})
 
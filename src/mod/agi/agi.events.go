@@ -0,0 +1,70 @@
+package agi
+
+import (
+	"log"
+	"regexp"
+
+	"imuslab.com/arozos/mod/agi/jsvm"
+	"imuslab.com/arozos/mod/agi/static"
+	"imuslab.com/arozos/mod/network/websocket"
+)
+
+/*
+	AGI Event Library
+
+	Allow AGI scripts to push events to the browser sessions of the user
+	running the script, via the agi:{channel} topic of the system websocket (/system/ws)
+*/
+
+var validEventChannel = regexp.MustCompile(`^[A-Za-z0-9_\-./]{1,128}$`)
+
+func (g *Gateway) EventsLibRegister() {
+	err := g.RegisterLib("events", g.injectEventsFunctions)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func (g *Gateway) injectEventsFunctions(payload *static.AgiLibInjectionPayload) {
+	vm := payload.VM
+	u := payload.User
+
+	//Publish data to the given channel of the current user
+	vm.Set("_events_publish", func(call jsvm.FunctionCall) jsvm.Value {
+		if g.Option.EventRouter == nil || u == nil {
+			return jsvm.FalseValue()
+		}
+
+		channel, err := call.Argument(0).ToString()
+		if err != nil || !validEventChannel.MatchString(channel) {
+			return vm.MakeCustomError("Invalid channel", "Channel name can only contain letters, digits and _-./")
+		}
+
+		eventName, err := call.Argument(2).ToString()
+		if err != nil || call.Argument(2).IsUndefined() {
+			eventName = "message"
+		}
+
+		var data interface{}
+		if call.Argument(1).IsDefined() {
+			data, err = call.Argument(1).Export()
+			if err != nil {
+				return vm.MakeCustomError("Invalid data", err.Error())
+			}
+		}
+
+		g.Option.EventRouter.PublishToUser(u.Username, websocket.AGITopic(channel), eventName, data)
+		return jsvm.TrueValue()
+	})
+
+	_, err := vm.Run(`
+		var events = {
+			"publish": function(channel, data, eventName){
+				return _events_publish(channel, data, eventName);
+			}
+		};
+	`)
+	if err != nil {
+		log.Println("[AGI] Events lib load failed: " + err.Error())
+	}
+}
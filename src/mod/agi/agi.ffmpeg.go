@@ -6,10 +6,11 @@ import (
 	"os"
 	"path/filepath"
 
-	"github.com/robertkrimen/otto"
 	uuid "github.com/satori/go.uuid"
+	"imuslab.com/arozos/mod/agi/jsvm"
 	"imuslab.com/arozos/mod/agi/static"
 	"imuslab.com/arozos/mod/agi/static/ffmpegutil"
+	"imuslab.com/arozos/mod/filesystem/fileaudit"
 	"imuslab.com/arozos/mod/utils"
 )
 
@@ -37,24 +38,24 @@ func (g *Gateway) injectFFmpegFunctions(payload *static.AgiLibInjectionPayload)
 	//scriptPath := payload.ScriptPath
 	//w := payload.Writer
 	//r := payload.Request
-	vm.Set("_ffmpeg_conv", func(call otto.FunctionCall) otto.Value {
+	vm.Set("_ffmpeg_conv", func(call jsvm.FunctionCall) jsvm.Value {
 		//Get the input and output filepath
 		vinput, err := call.Argument(0).ToString()
 		if err != nil {
 			g.RaiseError(err)
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 
 		voutput, err := call.Argument(1).ToString()
 		if err != nil {
 			g.RaiseError(err)
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 
 		if voutput == "" {
 			//Output filename not provided. Not sure what format to convert
 			g.RaiseError(err)
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 
 		compression, err := call.Argument(2).ToInteger()
@@ -71,14 +72,14 @@ func (g *Gateway) injectFFmpegFunctions(payload *static.AgiLibInjectionPayload)
 		fsh, rinput, err := static.VirtualPathToRealPath(vinput, u)
 		if err != nil {
 			g.RaiseError(err)
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 
 		//Translate the virtual path to realpath for the output file
 		fsh, routput, err := static.VirtualPathToRealPath(voutput, u)
 		if err != nil {
 			g.RaiseError(err)
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 
 		//Buffer the file to tmp
@@ -87,7 +88,7 @@ func (g *Gateway) injectFFmpegFunctions(payload *static.AgiLibInjectionPayload)
 		bufferedFilepath, err := fsh.BufferRemoteToLocal(rinput)
 		if err != nil {
 			g.RaiseError(err)
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 
 		//fmt.Println(rinput, routput, bufferedFilepath)
@@ -102,7 +103,7 @@ func (g *Gateway) injectFFmpegFunctions(payload *static.AgiLibInjectionPayload)
 
 			//Delete the buffered file
 			os.Remove(bufferedFilepath)
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 
 		if !utils.FileExists(outputBufferPath) {
@@ -110,7 +111,7 @@ func (g *Gateway) injectFFmpegFunctions(payload *static.AgiLibInjectionPayload)
 			g.RaiseError(errors.New("output file not found. Assume ffmpeg conversion failed"))
 			//Delete the buffered file
 			os.Remove(bufferedFilepath)
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 
 		//Conversion completed
@@ -124,7 +125,7 @@ func (g *Gateway) injectFFmpegFunctions(payload *static.AgiLibInjectionPayload)
 			g.RaiseError(err)
 			//Delete the output buffer if failed
 			os.Remove(outputBufferPath)
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 		defer src.Close()
 
@@ -133,12 +134,13 @@ func (g *Gateway) injectFFmpegFunctions(payload *static.AgiLibInjectionPayload)
 			g.RaiseError(err)
 			//Delete the output buffer if failed
 			os.Remove(outputBufferPath)
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 
 		//Upload completed. Remove the remaining buffer file
 		os.Remove(outputBufferPath)
-		return otto.TrueValue()
+		g.recordFileOperation(payload, fileaudit.ActionUpload, voutput, "")
+		return jsvm.TrueValue()
 	})
 
 	vm.Run(`
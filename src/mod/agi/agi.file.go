@@ -11,9 +11,9 @@ import (
 	"os"
 	"path/filepath"
 
-	"github.com/robertkrimen/otto"
-
+	"imuslab.com/arozos/mod/agi/jsvm"
 	"imuslab.com/arozos/mod/agi/static"
+	"imuslab.com/arozos/mod/filesystem/fileaudit"
 	"imuslab.com/arozos/mod/filesystem/fssort"
 	"imuslab.com/arozos/mod/filesystem/hidden"
 )
@@ -43,11 +43,11 @@ func (g *Gateway) injectFileLibFunctions(payload *static.AgiLibInjectionPayload)
 	//r := payload.Request
 
 	//writeFile(virtualFilepath, content) => return true/false when succeed / failed
-	vm.Set("_filelib_writeFile", func(call otto.FunctionCall) otto.Value {
+	vm.Set("_filelib_writeFile", func(call jsvm.FunctionCall) jsvm.Value {
 		vpath, err := call.Argument(0).ToString()
 		if err != nil {
 			g.RaiseError(err)
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 
 		//Rewrite the vpath if it is relative
@@ -61,21 +61,21 @@ func (g *Gateway) injectFileLibFunctions(payload *static.AgiLibInjectionPayload)
 		content, err := call.Argument(1).ToString()
 		if err != nil {
 			g.RaiseError(err)
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 
 		//Check if there is quota for the given length
 		if !u.StorageQuota.HaveSpace(int64(len(content))) {
 			//User have no remaining storage quota
 			g.RaiseError(errors.New("Storage Quota Fulled"))
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 
 		//Translate the virtual path to realpath
 		fsh, rpath, err := static.VirtualPathToRealPath(vpath, u)
 		if err != nil {
 			g.RaiseError(err)
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 
 		//Check if file already exists.
@@ -92,21 +92,22 @@ func (g *Gateway) injectFileLibFunctions(payload *static.AgiLibInjectionPayload)
 		err = fsh.FileSystemAbstraction.WriteFile(rpath, []byte(content), 0755)
 		if err != nil {
 			g.RaiseError(err)
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 
 		//Add the filesize to user quota
 		u.SetOwnerOfFile(fsh, vpath)
+		g.recordFileOperation(payload, fileaudit.ActionUpload, vpath, "")
 
 		reply, _ := vm.ToValue(true)
 		return reply
 	})
 
-	vm.Set("_filelib_deleteFile", func(call otto.FunctionCall) otto.Value {
+	vm.Set("_filelib_deleteFile", func(call jsvm.FunctionCall) jsvm.Value {
 		vpath, err := call.Argument(0).ToString()
 		if err != nil {
 			g.RaiseError(err)
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 
 		//Rewrite the vpath if it is relative
@@ -121,7 +122,7 @@ func (g *Gateway) injectFileLibFunctions(payload *static.AgiLibInjectionPayload)
 		fsh, rpath, err := static.VirtualPathToRealPath(vpath, u)
 		if err != nil {
 			g.RaiseError(err)
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 
 		//Check if file already exists.
@@ -134,22 +135,27 @@ func (g *Gateway) injectFileLibFunctions(payload *static.AgiLibInjectionPayload)
 			}
 		} else {
 			g.RaiseError(errors.New("File not exists"))
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 
 		//Remove the file
-		fsh.FileSystemAbstraction.Remove(rpath)
+		err = fsh.FileSystemAbstraction.Remove(rpath)
+		if err != nil {
+			g.RaiseError(err)
+			return jsvm.FalseValue()
+		}
+		g.recordFileOperation(payload, fileaudit.ActionDelete, vpath, "")
 
 		reply, _ := vm.ToValue(true)
 		return reply
 	})
 
 	//readFile(virtualFilepath) => return content in string
-	vm.Set("_filelib_readFile", func(call otto.FunctionCall) otto.Value {
+	vm.Set("_filelib_readFile", func(call jsvm.FunctionCall) jsvm.Value {
 		vpath, err := call.Argument(0).ToString()
 		if err != nil {
 			g.RaiseError(err)
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 
 		//Rewrite the vpath if it is relative
@@ -164,14 +170,14 @@ func (g *Gateway) injectFileLibFunctions(payload *static.AgiLibInjectionPayload)
 		fsh, rpath, err := static.VirtualPathToRealPath(vpath, u)
 		if err != nil {
 			g.RaiseError(err)
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 
 		//Create and write to file using ioUtil
 		content, err := fsh.FileSystemAbstraction.ReadFile(rpath)
 		if err != nil {
 			g.RaiseError(err)
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 		reply, _ := vm.ToValue(string(content))
 		return reply
@@ -181,11 +187,11 @@ func (g *Gateway) injectFileLibFunctions(payload *static.AgiLibInjectionPayload)
 	//filelib.walk("user:/") => list everything recursively
 	//filelib.walk("user:/", "folder") => list all folder recursively
 	//filelib.walk("user:/", "file") => list all files recursively
-	vm.Set("_filelib_walk", func(call otto.FunctionCall) otto.Value {
+	vm.Set("_filelib_walk", func(call jsvm.FunctionCall) jsvm.Value {
 		vpath, err := call.Argument(0).ToString()
 		if err != nil {
 			g.RaiseError(err)
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 		mode, err := call.Argument(1).ToString()
 		if err != nil {
@@ -198,7 +204,7 @@ func (g *Gateway) injectFileLibFunctions(payload *static.AgiLibInjectionPayload)
 		fsh, rpath, err := static.VirtualPathToRealPath(vpath, u)
 		if err != nil {
 			g.RaiseError(err)
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 		results := []string{}
 		fsh.FileSystemAbstraction.Walk(rpath, func(path string, info os.FileInfo, err error) error {
@@ -234,11 +240,11 @@ func (g *Gateway) injectFileLibFunctions(payload *static.AgiLibInjectionPayload)
 	//glob("/") => return a list of root directories
 	//glob("user:/Desktop/*", "mostRecent") => return fileList in mostRecent sorting mode
 	//glob("user:/Desktop/*", "user") => return fileList in array in user prefered sorting method
-	vm.Set("_filelib_glob", func(call otto.FunctionCall) otto.Value {
+	vm.Set("_filelib_glob", func(call jsvm.FunctionCall) jsvm.Value {
 		regex, err := call.Argument(0).ToString()
 		if err != nil {
 			g.RaiseError(err)
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 
 		userSortMode, err := call.Argument(1).ToString()
@@ -289,13 +295,13 @@ func (g *Gateway) injectFileLibFunctions(payload *static.AgiLibInjectionPayload)
 			fsh, rrootPath, err := static.VirtualPathToRealPath(vrootPath, u)
 			if err != nil {
 				g.RaiseError(err)
-				return otto.FalseValue()
+				return jsvm.FalseValue()
 			}
 
 			suitableFiles, err := fsh.FileSystemAbstraction.Glob(filepath.Join(rrootPath, regexFilename))
 			if err != nil {
 				g.RaiseError(err)
-				return otto.FalseValue()
+				return jsvm.FalseValue()
 			}
 
 			fileList := []string{}
@@ -328,11 +334,11 @@ func (g *Gateway) injectFileLibFunctions(payload *static.AgiLibInjectionPayload)
 	})
 
 	//Advance Glob using file system special Glob, cannot use to scan root dirs
-	vm.Set("_filelib_aglob", func(call otto.FunctionCall) otto.Value {
+	vm.Set("_filelib_aglob", func(call jsvm.FunctionCall) jsvm.Value {
 		regex, err := call.Argument(0).ToString()
 		if err != nil {
 			g.RaiseError(err)
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 
 		userSortMode, err := call.Argument(1).ToString()
@@ -367,14 +373,14 @@ func (g *Gateway) injectFileLibFunctions(payload *static.AgiLibInjectionPayload)
 		fsh, err := u.GetFileSystemHandlerFromVirtualPath(vrootPath)
 		if err != nil {
 			g.RaiseError(err)
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 		fshAbs := fsh.FileSystemAbstraction
 		rrootPath, _ := fshAbs.VirtualPathToRealPath(vrootPath, u.Username)
 		suitableFiles, err := fshAbs.Glob(filepath.Join(rrootPath, regexFilename))
 		if err != nil {
 			g.RaiseError(err)
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 
 		fileList := []string{}
@@ -405,11 +411,11 @@ func (g *Gateway) injectFileLibFunctions(payload *static.AgiLibInjectionPayload)
 		return reply
 	})
 
-	vm.Set("_filelib_readdir", func(call otto.FunctionCall) otto.Value {
+	vm.Set("_filelib_readdir", func(call jsvm.FunctionCall) jsvm.Value {
 		vpath, err := call.Argument(0).ToString()
 		if err != nil {
 			g.RaiseError(err)
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 
 		//Rewrite the vpath if it is relative
@@ -443,19 +449,19 @@ func (g *Gateway) injectFileLibFunctions(payload *static.AgiLibInjectionPayload)
 		fsh, err := u.GetFileSystemHandlerFromVirtualPath(vpath)
 		if err != nil {
 			g.RaiseError(err)
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 		fshAbs := fsh.FileSystemAbstraction
 		rpath, err := fshAbs.VirtualPathToRealPath(vpath, u.Username)
 		if err != nil {
 			g.RaiseError(err)
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 
 		dirEntry, err := fshAbs.ReadDir(rpath)
 		if err != nil {
 			g.RaiseError(err)
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 
 		type fileInfo struct {
@@ -501,11 +507,11 @@ func (g *Gateway) injectFileLibFunctions(payload *static.AgiLibInjectionPayload)
 	})
 
 	//filesize("user:/Desktop/test.txt")
-	vm.Set("_filelib_filesize", func(call otto.FunctionCall) otto.Value {
+	vm.Set("_filelib_filesize", func(call jsvm.FunctionCall) jsvm.Value {
 		vpath, err := call.Argument(0).ToString()
 		if err != nil {
 			g.RaiseError(err)
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 
 		//Rewrite the vpath if it is relative
@@ -519,20 +525,20 @@ func (g *Gateway) injectFileLibFunctions(payload *static.AgiLibInjectionPayload)
 		fsh, err := u.GetFileSystemHandlerFromVirtualPath(vpath)
 		if err != nil {
 			g.RaiseError(err)
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 		fshAbs := fsh.FileSystemAbstraction
 		rpath, err := fshAbs.VirtualPathToRealPath(vpath, u.Username)
 		if err != nil {
 			g.RaiseError(err)
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 
 		//Get filesize of file
 		rawsize := fshAbs.GetFileSize(rpath)
 		if err != nil {
 			g.RaiseError(err)
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 
 		reply, _ := vm.ToValue(rawsize)
@@ -540,11 +546,11 @@ func (g *Gateway) injectFileLibFunctions(payload *static.AgiLibInjectionPayload)
 	})
 
 	//fileExists("user:/Desktop/test.txt") => return true / false
-	vm.Set("_filelib_fileExists", func(call otto.FunctionCall) otto.Value {
+	vm.Set("_filelib_fileExists", func(call jsvm.FunctionCall) jsvm.Value {
 		vpath, err := call.Argument(0).ToString()
 		if err != nil {
 			g.RaiseError(err)
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 
 		//Rewrite the vpath if it is relative
@@ -558,28 +564,28 @@ func (g *Gateway) injectFileLibFunctions(payload *static.AgiLibInjectionPayload)
 		fsh, err := u.GetFileSystemHandlerFromVirtualPath(vpath)
 		if err != nil {
 			g.RaiseError(err)
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 		fshAbs := fsh.FileSystemAbstraction
 		rpath, err := fshAbs.VirtualPathToRealPath(vpath, u.Username)
 		if err != nil {
 			g.RaiseError(err)
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 
 		if fshAbs.FileExists(rpath) {
-			return otto.TrueValue()
+			return jsvm.TrueValue()
 		} else {
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 	})
 
 	//fileExists("user:/Desktop/test.txt") => return true / false
-	vm.Set("_filelib_isDir", func(call otto.FunctionCall) otto.Value {
+	vm.Set("_filelib_isDir", func(call jsvm.FunctionCall) jsvm.Value {
 		vpath, err := call.Argument(0).ToString()
 		if err != nil {
 			g.RaiseError(err)
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 
 		//Rewrite the vpath if it is relative
@@ -594,7 +600,7 @@ func (g *Gateway) injectFileLibFunctions(payload *static.AgiLibInjectionPayload)
 		fsh, rpath, err := static.VirtualPathToRealPath(vpath, u)
 		if err != nil {
 			g.RaiseError(err)
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 
 		if _, err := fsh.FileSystemAbstraction.Stat(rpath); os.IsNotExist(err) {
@@ -603,17 +609,17 @@ func (g *Gateway) injectFileLibFunctions(payload *static.AgiLibInjectionPayload)
 		}
 
 		if fsh.FileSystemAbstraction.IsDir(rpath) {
-			return otto.TrueValue()
+			return jsvm.TrueValue()
 		} else {
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 	})
 
 	//Make directory command
-	vm.Set("_filelib_mkdir", func(call otto.FunctionCall) otto.Value {
+	vm.Set("_filelib_mkdir", func(call jsvm.FunctionCall) jsvm.Value {
 		vdir, err := call.Argument(0).ToString()
 		if err != nil {
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 
 		//Check for permission
@@ -625,25 +631,26 @@ func (g *Gateway) injectFileLibFunctions(payload *static.AgiLibInjectionPayload)
 		fsh, rdir, err := static.VirtualPathToRealPath(vdir, u)
 		if err != nil {
 			log.Println(err.Error())
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 
 		//Create the directory at rdir location
 		err = fsh.FileSystemAbstraction.MkdirAll(rdir, 0755)
 		if err != nil {
 			log.Println(err.Error())
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
+		g.recordFileOperation(payload, fileaudit.ActionMkdir, vdir, "")
 
-		return otto.TrueValue()
+		return jsvm.TrueValue()
 	})
 
 	//Get MD5 of the given filepath, not implemented
-	vm.Set("_filelib_md5", func(call otto.FunctionCall) otto.Value {
+	vm.Set("_filelib_md5", func(call jsvm.FunctionCall) jsvm.Value {
 		vpath, err := call.Argument(0).ToString()
 		if err != nil {
 			g.RaiseError(err)
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 
 		//Rewrite the vpath if it is relative
@@ -657,26 +664,26 @@ func (g *Gateway) injectFileLibFunctions(payload *static.AgiLibInjectionPayload)
 		fsh, err := u.GetFileSystemHandlerFromVirtualPath(vpath)
 		if err != nil {
 			g.RaiseError(err)
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 		fshAbs := fsh.FileSystemAbstraction
 		rpath, err := fshAbs.VirtualPathToRealPath(vpath, u.Username)
 		if err != nil {
 			g.RaiseError(err)
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 
 		f, err := fshAbs.ReadStream(rpath)
 		if err != nil {
 			g.RaiseError(err)
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 
 		defer f.Close()
 		h := md5.New()
 		if _, err := io.Copy(h, f); err != nil {
 			g.RaiseError(err)
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 
 		md5Sum := hex.EncodeToString(h.Sum(nil))
@@ -685,12 +692,12 @@ func (g *Gateway) injectFileLibFunctions(payload *static.AgiLibInjectionPayload)
 	})
 
 	//Get the root name of the given virtual path root
-	vm.Set("_filelib_rname", func(call otto.FunctionCall) otto.Value {
+	vm.Set("_filelib_rname", func(call jsvm.FunctionCall) jsvm.Value {
 		//Get virtual path from the function input
 		vpath, err := call.Argument(0).ToString()
 		if err != nil {
 			g.RaiseError(err)
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 
 		//Rewrite the vpath if it is relative
@@ -700,7 +707,7 @@ func (g *Gateway) injectFileLibFunctions(payload *static.AgiLibInjectionPayload)
 		fsHandler, err := u.GetFileSystemHandlerFromVirtualPath(vpath)
 		if err != nil {
 			g.RaiseError(err)
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 
 		//Return the name of the fsHandler
@@ -709,11 +716,11 @@ func (g *Gateway) injectFileLibFunctions(payload *static.AgiLibInjectionPayload)
 
 	})
 
-	vm.Set("_filelib_mtime", func(call otto.FunctionCall) otto.Value {
+	vm.Set("_filelib_mtime", func(call jsvm.FunctionCall) jsvm.Value {
 		vpath, err := call.Argument(0).ToString()
 		if err != nil {
 			g.RaiseError(err)
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 
 		//Rewrite the vpath if it is relative
@@ -732,21 +739,21 @@ func (g *Gateway) injectFileLibFunctions(payload *static.AgiLibInjectionPayload)
 		fsh, rpath, err := static.VirtualPathToRealPath(vpath, u)
 		if err != nil {
 			log.Println(err.Error())
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 
 		info, err := fsh.FileSystemAbstraction.Stat(rpath)
 		if err != nil {
 			log.Println(err.Error())
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 
 		modTime := info.ModTime()
 		if parseToUnix {
-			result, _ := otto.ToValue(modTime.Unix())
+			result, _ := jsvm.ToValue(modTime.Unix())
 			return result
 		} else {
-			result, _ := otto.ToValue(modTime.Format("2006-01-02 15:04:05"))
+			result, _ := jsvm.ToValue(modTime.Format("2006-01-02 15:04:05"))
 			return result
 		}
 	})
@@ -755,11 +762,11 @@ func (g *Gateway) injectFileLibFunctions(payload *static.AgiLibInjectionPayload)
 	//Reading or writing from hex to target virtual filepath
 
 	//Write binary from hex string
-	vm.Set("_filelib_writeBinaryFile", func(call otto.FunctionCall) otto.Value {
+	vm.Set("_filelib_writeBinaryFile", func(call jsvm.FunctionCall) jsvm.Value {
 		vpath, err := call.Argument(0).ToString()
 		if err != nil {
 			g.RaiseError(err)
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 
 		//Rewrite the vpath if it is relative
@@ -773,40 +780,41 @@ func (g *Gateway) injectFileLibFunctions(payload *static.AgiLibInjectionPayload)
 		hexContent, err := call.Argument(1).ToString()
 		if err != nil {
 			g.RaiseError(err)
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 
 		//Get the target vpath
 		fsh, rpath, err := static.VirtualPathToRealPath(vpath, u)
 		if err != nil {
 			log.Println(err.Error())
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 
 		//Decode the hex content to bytes
 		hexContentInByte, err := hex.DecodeString(hexContent)
 		if err != nil {
 			g.RaiseError(err)
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 
 		//Write the file to target file
 		err = fsh.FileSystemAbstraction.WriteFile(rpath, hexContentInByte, 0775)
 		if err != nil {
 			g.RaiseError(err)
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
+		g.recordFileOperation(payload, fileaudit.ActionUpload, vpath, "")
 
-		return otto.TrueValue()
+		return jsvm.TrueValue()
 
 	})
 
 	//Read file from external fsh. Small file only
-	vm.Set("_filelib_readBinaryFile", func(call otto.FunctionCall) otto.Value {
+	vm.Set("_filelib_readBinaryFile", func(call jsvm.FunctionCall) jsvm.Value {
 		vpath, err := call.Argument(0).ToString()
 		if err != nil {
 			g.RaiseError(err)
-			return otto.NullValue()
+			return jsvm.NullValue()
 		}
 
 		//Rewrite the vpath if it is relative
@@ -821,19 +829,19 @@ func (g *Gateway) injectFileLibFunctions(payload *static.AgiLibInjectionPayload)
 		fsh, rpath, err := static.VirtualPathToRealPath(vpath, u)
 		if err != nil {
 			g.RaiseError(err)
-			return otto.NullValue()
+			return jsvm.NullValue()
 		}
 
 		if !fsh.FileSystemAbstraction.FileExists(rpath) {
 			//Check if the target file exists
 			g.RaiseError(err)
-			return otto.NullValue()
+			return jsvm.NullValue()
 		}
 
 		content, err := fsh.FileSystemAbstraction.ReadFile(rpath)
 		if err != nil {
 			g.RaiseError(err)
-			return otto.NullValue()
+			return jsvm.NullValue()
 		}
 
 		hexifiedContent := hex.EncodeToString(content)
@@ -9,17 +9,21 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
-	"github.com/robertkrimen/otto"
 	uuid "github.com/satori/go.uuid"
 
+	"imuslab.com/arozos/mod/agi/jsvm"
+	"imuslab.com/arozos/mod/agi/policy"
 	"imuslab.com/arozos/mod/agi/static"
 	apt "imuslab.com/arozos/mod/apt"
 	"imuslab.com/arozos/mod/filesystem"
 	"imuslab.com/arozos/mod/filesystem/arozfs"
+	"imuslab.com/arozos/mod/filesystem/fileaudit"
 	metadata "imuslab.com/arozos/mod/filesystem/metadata"
 	"imuslab.com/arozos/mod/iot"
+	"imuslab.com/arozos/mod/network/websocket"
 	"imuslab.com/arozos/mod/share"
 	"imuslab.com/arozos/mod/time/nightly"
 	user "imuslab.com/arozos/mod/user"
@@ -61,11 +65,17 @@ type AgiSysInfo struct {
 	IotManager           *iot.Manager
 	ShareManager         *share.Manager
 	NightlyManager       *nightly.TaskManager
+	EventRouter          *websocket.Router
+	AuditLogger          *fileaudit.Logger //Optional, record file writes and deletes done by scripts to the file audit trail
 
 	//Scanning Roots
 	StartupRoot    string
 	ActivateScope  []string
 	TempFolderPath string
+
+	//Runtime
+	DefaultEngine     string                                                    //JavaScript engine for modules that do not specify one, leave empty for otto
+	ExecutionObserver func(entry string, module string, duration time.Duration) //Called after each script execution with its run time, can be nil
 }
 
 type Gateway struct {
@@ -74,9 +84,26 @@ type Gateway struct {
 	//AllowAccessPkgs  map[string][]AgiPackage
 	LoadedAGILibrary map[string]AgiLibInjectionIntergface
 	Option           *AgiSysInfo
+
+	moduleEngines  sync.Map //Module root dir -> JavaScript engine name
+	modulePolicies sync.Map //Module name -> *policy.Policy declared by the module
 }
 
 func NewGateway(option AgiSysInfo) (*Gateway, error) {
+	if option.DefaultEngine == "" {
+		option.DefaultEngine = jsvm.DefaultEngine
+	}
+	if !jsvm.IsSupportedEngine(option.DefaultEngine) {
+		log.Println("[AGI] Unsupported AGI engine " + option.DefaultEngine + ". Using " + jsvm.DefaultEngine + " instead.")
+		option.DefaultEngine = jsvm.DefaultEngine
+	}
+
+	//Create the policy override table, which should not be accessible by scripts
+	option.UserHandler.GetDatabase().NewTable(policyTable)
+	if !utils.StringInArray(option.ReservedTables, policyTable) {
+		option.ReservedTables = append(option.ReservedTables, policyTable)
+	}
+
 	//Handle startup registration of ajgi modules
 	gatewayObject := Gateway{
 		ReservedTables: option.ReservedTables,
@@ -128,8 +155,8 @@ func (g *Gateway) InitiateAllWebAppModules() {
 		scriptContentByte, _ := os.ReadFile(script)
 		scriptContent := string(scriptContentByte)
 		log.Println("[AGI] Gateway script loaded (" + script + ")")
-		//Create a new vm for this request
-		vm := otto.New()
+		//Create a new vm for this request. Init scripts always run on the default engine
+		vm := g.newVM("", "")
 
 		//Only allow non user based operations
 		g.injectStandardLibs(vm, script, "./web/")
@@ -147,7 +174,7 @@ func (g *Gateway) InitiateAllWebAppModules() {
 
 func (g *Gateway) RunScript(script string) error {
 	//Create a new vm for this request
-	vm := otto.New()
+	vm := g.newVM("", "")
 
 	//Only allow non user based operations
 	g.injectStandardLibs(vm, "", "./web/")
@@ -167,6 +194,19 @@ func (g *Gateway) RaiseError(err error) {
 	//To be implemented
 }
 
+// Record a file operation done by the script to the file audit trail. Scripts
+// without a web request (e.g. scheduled tasks) are recorded without client IP
+func (g *Gateway) recordFileOperation(payload *static.AgiLibInjectionPayload, action string, src string, dest string) {
+	if g.Option.AuditLogger == nil || payload.User == nil {
+		return
+	}
+	if payload.Request != nil {
+		g.Option.AuditLogger.NewRecorderFromRequest(payload.Request, payload.User.Username, fileaudit.ChannelAGI).Record(action, src, dest)
+		return
+	}
+	g.Option.AuditLogger.NewRecorder(payload.User.Username, "", fileaudit.ChannelAGI).Record(action, src, dest)
+}
+
 // Check if this table is restricted table. Return true if the access is valid
 func (g *Gateway) filterDBTable(tablename string, existsCheck bool) bool {
 	//Check if table is restricted
@@ -276,8 +316,10 @@ w / r : Web request and response writer
 thisuser: userObject
 */
 func (g *Gateway) ExecuteAGIScript(scriptContent string, fsh *filesystem.FileSystemHandler, scriptFile string, scriptScope string, w http.ResponseWriter, r *http.Request, thisuser *user.User) {
+	defer g.observeExecution("webapp", scriptFile, scriptScope, time.Now())
+
 	//Create a new vm for this request
-	vm := otto.New()
+	vm := g.newVM(scriptFile, scriptScope)
 	//Inject standard libs into the vm
 	g.injectStandardLibs(vm, scriptFile, scriptScope)
 	g.injectUserFunctions(vm, fsh, scriptFile, scriptScope, thisuser, w, r)
@@ -306,6 +348,26 @@ func (g *Gateway) ExecuteAGIScript(scriptContent string, fsh *filesystem.FileSys
 		}
 	}
 
+	//Handle exit() call and policy violations from the script
+	defer func() {
+		if caught := recover(); caught != nil {
+			if caught == errExitcall {
+				writeVMResponse(w, vm)
+				return
+			} else if violation, ok := caught.(*policy.Violation); ok {
+				log.Println("[AGI] " + violation.Error() + ": " + scriptFile)
+				scriptpath, _ := filepath.Abs(scriptFile)
+				g.RenderErrorTemplate(w, violation.Error(), scriptpath)
+				return
+			}
+			panic(caught)
+		}
+	}()
+
+	//Apply the execution time limit and memory budget
+	stopWatchdog := vm.startWatchdog()
+	defer stopWatchdog()
+
 	_, err := vm.Run(scriptContent)
 	if err != nil {
 		scriptpath, _ := filepath.Abs(scriptFile)
@@ -313,13 +375,30 @@ func (g *Gateway) ExecuteAGIScript(scriptContent string, fsh *filesystem.FileSys
 		return
 	}
 
+	writeVMResponse(w, vm)
+}
+
+// Report the execution time to the observer if any. Scripts are reported by their module
+// instead of the script path, so the number of reported names is bounded
+func (g *Gateway) observeExecution(entry string, scriptFile string, scriptScope string, start time.Time) {
+	if g.Option.ExecutionObserver != nil {
+		moduleName := ""
+		if scriptFile != "" && scriptScope != "" {
+			moduleName = static.GetScriptRoot(scriptFile, scriptScope)
+		}
+		g.Option.ExecutionObserver(entry, moduleName, time.Since(start))
+	}
+}
+
+// Write the HTTP_RESP and HTTP_HEADER set by the script to the response writer
+func writeVMResponse(w http.ResponseWriter, vm jsvm.VM) {
 	//Get the return valu from the script
 	value, err := vm.Get("HTTP_RESP")
 	if err != nil {
 		utils.SendTextResponse(w, "")
 		return
 	}
-	valueString, err := value.ToString()
+	valueString, _ := value.ToString()
 
 	//Get respond header type from the vm
 	header, _ := vm.Get("HTTP_HEADER")
@@ -336,9 +415,11 @@ Execute AGI script with given user information
 scriptFile must be realpath resolved by fsa VirtualPathToRealPath function
 Pass in http.Request pointer to enable serverless GET / POST request
 */
-func (g *Gateway) ExecuteAGIScriptAsUser(fsh *filesystem.FileSystemHandler, scriptFile string, targetUser *user.User, w http.ResponseWriter, r *http.Request) (string, error) {
+func (g *Gateway) ExecuteAGIScriptAsUser(fsh *filesystem.FileSystemHandler, scriptFile string, targetUser *user.User, w http.ResponseWriter, r *http.Request) (result string, resultErr error) {
+	defer g.observeExecution("user", scriptFile, "", time.Now())
+
 	//Create a new vm for this request
-	vm := otto.New()
+	vm := g.newVM(scriptFile, "")
 	//Inject standard libs into the vm
 	g.injectStandardLibs(vm, scriptFile, "")
 	g.injectUserFunctions(vm, fsh, scriptFile, "", targetUser, w, r)
@@ -347,9 +428,6 @@ func (g *Gateway) ExecuteAGIScriptAsUser(fsh *filesystem.FileSystemHandler, scri
 		//Inject serverless script to enable access to GET / POST paramters
 		g.injectServerlessFunctions(vm, scriptFile, "", targetUser, r)
 	}
-	//Inject interrupt Channel
-	vm.Interrupt = make(chan func(), 1)
-
 	//Create a panic recovery logic
 	defer func() {
 		if caught := recover(); caught != nil {
@@ -359,23 +437,26 @@ func (g *Gateway) ExecuteAGIScriptAsUser(fsh *filesystem.FileSystemHandler, scri
 			} else if caught == errExitcall {
 				//Exit gracefully
 
+				return
+			} else if violation, ok := caught.(*policy.Violation); ok {
+				//Script stopped due to policy violation
+				log.Println("[AGI] " + violation.Error() + ": " + scriptFile)
+				resultErr = violation
 				return
 			} else {
 				//Something screwed. Return Internal Server Error
-				w.WriteHeader(http.StatusInternalServerError)
-				w.Write([]byte("500 - ECMA VM crashed due to unknown reason"))
+				if w != nil {
+					w.WriteHeader(http.StatusInternalServerError)
+					w.Write([]byte("500 - ECMA VM crashed due to unknown reason"))
+				}
 				//panic(caught)
 			}
 		}
 	}()
 
-	//Create a max runtime of 5 minutes
-	go func() {
-		time.Sleep(300 * time.Second) // Stop after 300 seconds
-		vm.Interrupt <- func() {
-			panic(errTimeout)
-		}
-	}()
+	//Apply the execution time limit and memory budget
+	stopWatchdog := vm.startWatchdog()
+	defer stopWatchdog()
 
 	//Try to read the script content
 	scriptContent, err := fsh.FileSystemAbstraction.ReadFile(scriptFile)
@@ -10,9 +10,13 @@ import (
 	"net/http"
 	"net/url"
 	"path/filepath"
+	"strings"
 
-	"github.com/robertkrimen/otto"
+	"imuslab.com/arozos/mod/agi/jsvm"
+	"imuslab.com/arozos/mod/agi/policy"
 	"imuslab.com/arozos/mod/agi/static"
+	"imuslab.com/arozos/mod/filesystem/arozfs"
+	"imuslab.com/arozos/mod/filesystem/fileaudit"
 )
 
 /*
@@ -24,6 +28,8 @@ import (
 	Author: tobychui
 */
 
+const httpUserAgent = "arozos-http-client/1.1"
+
 func (g *Gateway) HTTPLibRegister() {
 	err := g.RegisterLib("http", g.injectHTTPFunctions)
 	if err != nil {
@@ -38,37 +44,44 @@ func (g *Gateway) injectHTTPFunctions(payload *static.AgiLibInjectionPayload) {
 	//scriptPath := payload.ScriptPath
 	w := payload.Writer
 	//r := payload.Request
-	vm.Set("_http_get", func(call otto.FunctionCall) otto.Value {
+	scriptPolicy := payload.Policy
+	if scriptPolicy == nil {
+		scriptPolicy = policy.DefaultPolicy()
+	}
+
+	vm.Set("_http_get", func(call jsvm.FunctionCall) jsvm.Value {
 		//Get URL from function variable
 		url, err := call.Argument(0).ToString()
 		if err != nil {
-			return otto.NullValue()
+			return jsvm.NullValue()
 		}
 
 		//Get respond of the url
-		res, err := http.Get(url)
+		res, err := policyGet(vm, scriptPolicy, url)
 		if err != nil {
-			return otto.NullValue()
+			return jsvm.NullValue()
 		}
+		defer res.Body.Close()
 
-		bodyContent, err := io.ReadAll(res.Body)
+		bodyContent, err := scriptPolicy.ReadResponse(res)
 		if err != nil {
-			return otto.NullValue()
+			raiseIfViolation(vm, err)
+			return jsvm.NullValue()
 		}
 
 		returnValue, err := vm.ToValue(string(bodyContent))
 		if err != nil {
-			return otto.NullValue()
+			return jsvm.NullValue()
 		}
 
 		return returnValue
 	})
 
-	vm.Set("_http_post", func(call otto.FunctionCall) otto.Value {
+	vm.Set("_http_post", func(call jsvm.FunctionCall) jsvm.Value {
 		//Get URL from function paramter
 		url, err := call.Argument(0).ToString()
 		if err != nil {
-			return otto.NullValue()
+			return jsvm.NullValue()
 		}
 
 		//Get JSON content from 2nd paramter
@@ -82,26 +95,32 @@ func (g *Gateway) injectHTTPFunctions(payload *static.AgiLibInjectionPayload) {
 		//Create the request
 		var req *http.Request
 		if sendWithPayload {
-			req, _ = http.NewRequest("POST", url, bytes.NewBuffer([]byte(jsonContent)))
+			req, err = scriptPolicy.NewRequest("POST", url, bytes.NewBuffer([]byte(jsonContent)))
 		} else {
-			req, _ = http.NewRequest("POST", url, bytes.NewBuffer([]byte("")))
+			req, err = scriptPolicy.NewRequest("POST", url, bytes.NewBuffer([]byte("")))
+		}
+		if err != nil {
+			raiseIfViolation(vm, err)
+			return jsvm.NullValue()
 		}
 
 		req.Header.Set("Content-Type", "application/json")
-		req.Header.Set("User-Agent", "arozos-http-client/1.1")
+		req.Header.Set("User-Agent", httpUserAgent)
 
 		//Send the request
-		client := &http.Client{}
+		client := scriptPolicy.NewHTTPClient(false)
 		resp, err := client.Do(req)
 		if err != nil {
+			raiseIfViolation(vm, err)
 			log.Println(err)
-			return otto.NullValue()
+			return jsvm.NullValue()
 		}
 		defer resp.Body.Close()
 
-		bodyContent, err := io.ReadAll(resp.Body)
+		bodyContent, err := scriptPolicy.ReadResponse(resp)
 		if err != nil {
-			return otto.NullValue()
+			raiseIfViolation(vm, err)
+			return jsvm.NullValue()
 		}
 
 		returnValue, _ := vm.ToValue(string(bodyContent))
@@ -109,18 +128,19 @@ func (g *Gateway) injectHTTPFunctions(payload *static.AgiLibInjectionPayload) {
 		return returnValue
 	})
 
-	vm.Set("_http_head", func(call otto.FunctionCall) otto.Value {
+	vm.Set("_http_head", func(call jsvm.FunctionCall) jsvm.Value {
 		//Get URL from function paramter
 		url, err := call.Argument(0).ToString()
 		if err != nil {
-			return otto.NullValue()
+			return jsvm.NullValue()
 		}
 
 		//Request the url
-		resp, err := http.Get(url)
+		resp, err := policyGet(vm, scriptPolicy, url)
 		if err != nil {
-			return otto.NullValue()
+			return jsvm.NullValue()
 		}
+		resp.Body.Close()
 
 		headerKey, err := call.Argument(1).ToString()
 		if err != nil || headerKey == "undefined" {
@@ -139,21 +159,22 @@ func (g *Gateway) injectHTTPFunctions(payload *static.AgiLibInjectionPayload) {
 	})
 
 	//Get target status code for response
-	vm.Set("_http_code", func(call otto.FunctionCall) otto.Value {
+	vm.Set("_http_code", func(call jsvm.FunctionCall) jsvm.Value {
 		//Get URL from function paramter
 		url, err := call.Argument(0).ToString()
 		if err != nil {
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 
-		req, err := http.NewRequest("GET", url, nil)
+		req, err := scriptPolicy.NewRequest("GET", url, nil)
 		if err != nil {
+			raiseIfViolation(vm, err)
 			g.RaiseError(err)
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 
 		payload := ""
-		client := new(http.Client)
+		client := scriptPolicy.NewHTTPClient(false)
 		client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
 			//Redirection. Return the target location as well
 			dest, _ := req.Response.Location()
@@ -163,27 +184,29 @@ func (g *Gateway) injectHTTPFunctions(payload *static.AgiLibInjectionPayload) {
 
 		response, err := client.Do(req)
 		if err != nil {
-			return otto.FalseValue()
+			raiseIfViolation(vm, err)
+			return jsvm.FalseValue()
 		}
+		response.Body.Close()
 		defer client.CloseIdleConnections()
-		vm.Run(`var _location = "` + payload + `";`)
-		value, _ := otto.ToValue(response.StatusCode)
+		vm.Set("_location", payload)
+		value, _ := jsvm.ToValue(response.StatusCode)
 		return value
 
 	})
 
-	vm.Set("_http_download", func(call otto.FunctionCall) otto.Value {
+	vm.Set("_http_download", func(call jsvm.FunctionCall) jsvm.Value {
 		//Get URL from function paramter
 		downloadURL, err := call.Argument(0).ToString()
 		if err != nil {
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 		decodedURL, _ := url.QueryUnescape(downloadURL)
 
 		//Get download desintation from paramter
 		vpath, err := call.Argument(1).ToString()
 		if err != nil {
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 
 		//Optional: filename paramter
@@ -196,70 +219,84 @@ func (g *Gateway) injectHTTPFunctions(payload *static.AgiLibInjectionPayload) {
 		//Check user acess permission
 		if !u.CanWrite(vpath) {
 			g.RaiseError(errors.New("Permission Denied"))
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 
 		//Convert the vpath to realpath. Check if it exists
 		fsh, rpath, err := static.VirtualPathToRealPath(vpath, u)
 		if err != nil {
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 
 		if !fsh.FileSystemAbstraction.FileExists(rpath) || !fsh.FileSystemAbstraction.IsDir(rpath) {
 			g.RaiseError(errors.New(vpath + " is a file not a directory."))
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 
 		downloadDest := filepath.Join(rpath, filename)
 
 		//Ok. Download the file
-		resp, err := http.Get(decodedURL)
+		req, err := scriptPolicy.NewRequest("GET", decodedURL, nil)
+		if err != nil {
+			raiseIfViolation(vm, err)
+			return jsvm.FalseValue()
+		}
+		resp, err := scriptPolicy.NewHTTPClient(true).Do(req)
 		if err != nil {
-			return otto.FalseValue()
+			raiseIfViolation(vm, err)
+			return jsvm.FalseValue()
 		}
 		defer resp.Body.Close()
 
 		// Create the file
-		err = fsh.FileSystemAbstraction.WriteStream(downloadDest, resp.Body, 0775)
+		err = fsh.FileSystemAbstraction.WriteStream(downloadDest, scriptPolicy.LimitReader(resp.Body, scriptPolicy.MaxDownloadSize), 0775)
 		if err != nil {
-			return otto.FalseValue()
+			if _, ok := policy.AsViolation(err); ok {
+				//Remove the incomplete download
+				fsh.FileSystemAbstraction.Remove(downloadDest)
+				raiseIfViolation(vm, err)
+			}
+			return jsvm.FalseValue()
 		}
-		return otto.TrueValue()
+		g.recordFileOperation(payload, fileaudit.ActionUpload, arozfs.ToSlash(filepath.Join(vpath, filename)), "")
+		return jsvm.TrueValue()
 	})
 
-	vm.Set("_http_getb64", func(call otto.FunctionCall) otto.Value {
+	vm.Set("_http_getb64", func(call jsvm.FunctionCall) jsvm.Value {
 		//Get URL from function variable and return bytes as base64
 		url, err := call.Argument(0).ToString()
 		if err != nil {
-			return otto.NullValue()
+			return jsvm.NullValue()
 		}
 
 		//Get respond of the url
-		res, err := http.Get(url)
+		res, err := policyGet(vm, scriptPolicy, url)
 		if err != nil {
-			return otto.NullValue()
+			return jsvm.NullValue()
 		}
+		defer res.Body.Close()
 
-		bodyContent, err := io.ReadAll(res.Body)
+		bodyContent, err := scriptPolicy.ReadResponse(res)
 		if err != nil {
-			return otto.NullValue()
+			raiseIfViolation(vm, err)
+			return jsvm.NullValue()
 		}
 
 		sEnc := base64.StdEncoding.EncodeToString(bodyContent)
 
-		r, err := otto.ToValue(string(sEnc))
+		r, err := jsvm.ToValue(string(sEnc))
 		if err != nil {
 			log.Println(err.Error())
-			return otto.NullValue()
+			return jsvm.NullValue()
 		}
 		return r
 	})
 
-	vm.Set("_http_redirect", func(call otto.FunctionCall) otto.Value {
+	vm.Set("_http_redirect", func(call jsvm.FunctionCall) jsvm.Value {
 		//Redirect the current request to another url
 		targetUrl, err := call.Argument(0).ToString()
 		if err != nil {
-			return otto.NullValue()
+			return jsvm.NullValue()
 		}
 
 		statusCode, err := call.Argument(1).ToInteger()
@@ -270,7 +307,79 @@ func (g *Gateway) injectHTTPFunctions(payload *static.AgiLibInjectionPayload) {
 
 		w.Header().Set("Location", targetUrl)
 		w.WriteHeader(int(statusCode))
-		return otto.TrueValue()
+		return jsvm.TrueValue()
+	})
+
+	//Send request with custom method, body and headers. Return the status code, headers and body
+	vm.Set("_http_request", func(call jsvm.FunctionCall) jsvm.Value {
+		method, err := call.Argument(0).ToString()
+		if err != nil {
+			return jsvm.NullValue()
+		}
+		method = strings.ToUpper(method)
+
+		url, err := call.Argument(1).ToString()
+		if err != nil {
+			return jsvm.NullValue()
+		}
+
+		var body io.Reader
+		if call.Argument(2).IsDefined() && !call.Argument(2).IsNull() {
+			bodyContent, _ := call.Argument(2).ToString()
+			body = bytes.NewBuffer([]byte(bodyContent))
+		}
+
+		req, err := scriptPolicy.NewRequest(method, url, body)
+		if err != nil {
+			raiseIfViolation(vm, err)
+			g.RaiseError(err)
+			return jsvm.NullValue()
+		}
+		req.Header.Set("User-Agent", httpUserAgent)
+
+		//Custom headers in JSON object
+		if call.Argument(3).IsDefined() && !call.Argument(3).IsNull() {
+			headersJSON, _ := call.Argument(3).ToString()
+			headers := map[string]string{}
+			err = json.Unmarshal([]byte(headersJSON), &headers)
+			if err != nil {
+				g.RaiseError(errors.New("invalid request headers: " + err.Error()))
+				return jsvm.NullValue()
+			}
+			for key, value := range headers {
+				if err := scriptPolicy.CheckHeader(key); err != nil {
+					raiseIfViolation(vm, err)
+					return jsvm.NullValue()
+				}
+				req.Header.Set(key, value)
+			}
+		}
+
+		resp, err := scriptPolicy.NewHTTPClient(false).Do(req)
+		if err != nil {
+			raiseIfViolation(vm, err)
+			g.RaiseError(err)
+			return jsvm.NullValue()
+		}
+		defer resp.Body.Close()
+
+		bodyContent, err := scriptPolicy.ReadResponse(resp)
+		if err != nil {
+			raiseIfViolation(vm, err)
+			return jsvm.NullValue()
+		}
+
+		respHeaders := map[string]string{}
+		for key := range resp.Header {
+			respHeaders[key] = resp.Header.Get(key)
+		}
+		js, _ := json.Marshal(map[string]interface{}{
+			"status":  resp.StatusCode,
+			"headers": respHeaders,
+			"body":    string(bodyContent),
+		})
+		returnValue, _ := vm.ToValue(string(js))
+		return returnValue
 	})
 
 	//Wrap all the native code function into an imagelib class
@@ -282,6 +391,19 @@ func (g *Gateway) injectHTTPFunctions(payload *static.AgiLibInjectionPayload) {
 		http.download = _http_download;
 		http.getb64 = _http_getb64;
 		http.getCode = _http_code;
+		http.request = function(method, url, body, headers){
+			if (typeof(body) == "object" && body !== null){
+				body = JSON.stringify(body);
+			}
+			if (typeof(headers) == "undefined" || headers === null){
+				headers = {};
+			}
+			var resp = _http_request(method, url, body, JSON.stringify(headers));
+			if (resp === null){
+				return null;
+			}
+			return JSON.parse(resp);
+		};
 		http.redirect = function(t, c){
 			if (typeof(c) == "undefined"){
 				c = 307;
@@ -291,3 +413,18 @@ func (g *Gateway) injectHTTPFunctions(payload *static.AgiLibInjectionPayload) {
 	`)
 
 }
+
+// Send a GET request to the url under the script policy
+func policyGet(vm jsvm.VM, scriptPolicy *policy.Policy, url string) (*http.Response, error) {
+	req, err := scriptPolicy.NewRequest("GET", url, nil)
+	if err != nil {
+		raiseIfViolation(vm, err)
+		return nil, err
+	}
+	resp, err := scriptPolicy.NewHTTPClient(false).Do(req)
+	if err != nil {
+		raiseIfViolation(vm, err)
+		return nil, err
+	}
+	return resp, nil
+}
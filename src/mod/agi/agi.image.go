@@ -19,11 +19,12 @@ import (
 
 	"github.com/disintegration/imaging"
 	"github.com/oliamb/cutter"
-	"github.com/robertkrimen/otto"
 	"github.com/rwcarlsen/goexif/exif"
 
+	"imuslab.com/arozos/mod/agi/jsvm"
 	"imuslab.com/arozos/mod/agi/static"
 	"imuslab.com/arozos/mod/filesystem/arozfs"
+	"imuslab.com/arozos/mod/filesystem/fileaudit"
 	"imuslab.com/arozos/mod/utils"
 )
 
@@ -49,22 +50,22 @@ func (g *Gateway) injectImageLibFunctions(payload *static.AgiLibInjectionPayload
 	//w := payload.Writer
 	//r := payload.Request
 	//Get image dimension, requires filepath (virtual)
-	vm.Set("_imagelib_getImageDimension", func(call otto.FunctionCall) otto.Value {
+	vm.Set("_imagelib_getImageDimension", func(call jsvm.FunctionCall) jsvm.Value {
 		imageFileVpath, err := call.Argument(0).ToString()
 		if err != nil {
 			g.RaiseError(err)
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 
 		fsh, imagePath, err := static.VirtualPathToRealPath(imageFileVpath, u)
 		if err != nil {
 			g.RaiseError(err)
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 
 		if !fsh.FileSystemAbstraction.FileExists(imagePath) {
 			g.RaiseError(errors.New("File not exists! Given " + imagePath))
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 
 		openingPath := imagePath
@@ -77,7 +78,7 @@ func (g *Gateway) injectImageLibFunctions(payload *static.AgiLibInjectionPayload
 			c, err := fsh.FileSystemAbstraction.ReadFile(imagePath)
 			if err != nil {
 				g.RaiseError(errors.New("Read from file system failed: " + err.Error()))
-				return otto.FalseValue()
+				return jsvm.FalseValue()
 			}
 			os.WriteFile(bufferPath, c, 0775)
 			openingPath = bufferPath
@@ -85,20 +86,20 @@ func (g *Gateway) injectImageLibFunctions(payload *static.AgiLibInjectionPayload
 			file, err = os.Open(openingPath)
 			if err != nil {
 				g.RaiseError(err)
-				return otto.FalseValue()
+				return jsvm.FalseValue()
 			}
 		} else {
 			file, err = fsh.FileSystemAbstraction.Open(openingPath)
 			if err != nil {
 				g.RaiseError(err)
-				return otto.FalseValue()
+				return jsvm.FalseValue()
 			}
 		}
 
 		image, _, err := image.DecodeConfig(file)
 		if err != nil {
 			g.RaiseError(err)
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 		file.Close()
 		rawResults := []int{image.Width, image.Height}
@@ -107,54 +108,54 @@ func (g *Gateway) injectImageLibFunctions(payload *static.AgiLibInjectionPayload
 	})
 
 	//Resize image, require (filepath, outputpath, width, height)
-	vm.Set("_imagelib_resizeImage", func(call otto.FunctionCall) otto.Value {
+	vm.Set("_imagelib_resizeImage", func(call jsvm.FunctionCall) jsvm.Value {
 		vsrc, err := call.Argument(0).ToString()
 		if err != nil {
 			g.RaiseError(err)
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 
 		vdest, err := call.Argument(1).ToString()
 		if err != nil {
 			g.RaiseError(err)
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 
 		width, err := call.Argument(2).ToInteger()
 		if err != nil {
 			g.RaiseError(err)
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 
 		height, err := call.Argument(3).ToInteger()
 		if err != nil {
 			g.RaiseError(err)
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 
 		//Convert the virtual paths to real paths
 		srcfsh, rsrc, err := static.VirtualPathToRealPath(vsrc, u)
 		if err != nil {
 			g.RaiseError(err)
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 		destfsh, rdest, err := static.VirtualPathToRealPath(vdest, u)
 		if err != nil {
 			g.RaiseError(err)
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 
 		ext := strings.ToLower(filepath.Ext(rdest))
 		if !utils.StringInArray([]string{".jpg", ".jpeg", ".png"}, ext) {
 			g.RaiseError(errors.New("File extension not supported. Only support .jpg and .png"))
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 
 		if destfsh.FileSystemAbstraction.FileExists(rdest) {
 			err := destfsh.FileSystemAbstraction.Remove(rdest)
 			if err != nil {
 				g.RaiseError(err)
-				return otto.FalseValue()
+				return jsvm.FalseValue()
 			}
 		}
 
@@ -166,19 +167,19 @@ func (g *Gateway) injectImageLibFunctions(payload *static.AgiLibInjectionPayload
 			resizeOpeningFile, _, err = g.bufferRemoteResourcesToLocal(srcfsh, u, rsrc)
 			if err != nil {
 				g.RaiseError(err)
-				return otto.FalseValue()
+				return jsvm.FalseValue()
 			}
 
 			srcFile, err = os.Open(resizeOpeningFile)
 			if err != nil {
 				g.RaiseError(err)
-				return otto.FalseValue()
+				return jsvm.FalseValue()
 			}
 		} else {
 			srcFile, err = srcfsh.FileSystemAbstraction.Open(resizeOpeningFile)
 			if err != nil {
 				g.RaiseError(err)
-				return otto.FalseValue()
+				return jsvm.FalseValue()
 			}
 		}
 		defer srcFile.Close()
@@ -187,19 +188,19 @@ func (g *Gateway) injectImageLibFunctions(payload *static.AgiLibInjectionPayload
 			resizeWritingFile, _, err = g.bufferRemoteResourcesToLocal(destfsh, u, rdest)
 			if err != nil {
 				g.RaiseError(err)
-				return otto.FalseValue()
+				return jsvm.FalseValue()
 			}
 
 			destFile, err = os.OpenFile(resizeWritingFile, os.O_CREATE|os.O_WRONLY, 0775)
 			if err != nil {
 				g.RaiseError(err)
-				return otto.FalseValue()
+				return jsvm.FalseValue()
 			}
 		} else {
 			destFile, err = destfsh.FileSystemAbstraction.OpenFile(resizeWritingFile, os.O_CREATE|os.O_WRONLY, 0775)
 			if err != nil {
 				g.RaiseError(err)
-				return otto.FalseValue()
+				return jsvm.FalseValue()
 			}
 		}
 		defer destFile.Close()
@@ -210,48 +211,49 @@ func (g *Gateway) injectImageLibFunctions(payload *static.AgiLibInjectionPayload
 		if err != nil {
 			//Opening failed
 			g.RaiseError(err)
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 		src = imaging.Resize(src, int(width), int(height), imaging.Lanczos)
 		//err = imaging.Save(src, resizeWritingFile)
 		f, err := imaging.FormatFromFilename(resizeWritingFile)
 		if err != nil {
 			g.RaiseError(err)
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 
 		err = imaging.Encode(destFile, src, f)
 		if err != nil {
 			g.RaiseError(err)
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 
 		if destfsh.RequireBuffer {
 			c, _ := os.ReadFile(resizeWritingFile)
 			destfsh.FileSystemAbstraction.WriteFile(rdest, c, 0775)
 		}
+		g.recordFileOperation(payload, fileaudit.ActionUpload, vdest, "")
 
-		return otto.TrueValue()
+		return jsvm.TrueValue()
 	})
 
 	//Resize image and return as base64 data URL, require (filepath, width, height, format)
-	vm.Set("_imagelib_resizeImageBase64", func(call otto.FunctionCall) otto.Value {
+	vm.Set("_imagelib_resizeImageBase64", func(call jsvm.FunctionCall) jsvm.Value {
 		vsrc, err := call.Argument(0).ToString()
 		if err != nil {
 			g.RaiseError(err)
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 
 		width, err := call.Argument(1).ToInteger()
 		if err != nil {
 			g.RaiseError(err)
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 
 		height, err := call.Argument(2).ToInteger()
 		if err != nil {
 			g.RaiseError(err)
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 
 		format := "jpeg"
@@ -266,7 +268,7 @@ func (g *Gateway) injectImageLibFunctions(payload *static.AgiLibInjectionPayload
 		srcfsh, rsrc, err := static.VirtualPathToRealPath(vsrc, u)
 		if err != nil {
 			g.RaiseError(err)
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 
 		resizeOpeningFile := rsrc
@@ -275,19 +277,19 @@ func (g *Gateway) injectImageLibFunctions(payload *static.AgiLibInjectionPayload
 			resizeOpeningFile, _, err = g.bufferRemoteResourcesToLocal(srcfsh, u, rsrc)
 			if err != nil {
 				g.RaiseError(err)
-				return otto.FalseValue()
+				return jsvm.FalseValue()
 			}
 
 			srcFile, err = os.Open(resizeOpeningFile)
 			if err != nil {
 				g.RaiseError(err)
-				return otto.FalseValue()
+				return jsvm.FalseValue()
 			}
 		} else {
 			srcFile, err = srcfsh.FileSystemAbstraction.Open(resizeOpeningFile)
 			if err != nil {
 				g.RaiseError(err)
-				return otto.FalseValue()
+				return jsvm.FalseValue()
 			}
 		}
 		defer srcFile.Close()
@@ -296,7 +298,7 @@ func (g *Gateway) injectImageLibFunctions(payload *static.AgiLibInjectionPayload
 		src, err := imaging.Decode(srcFile)
 		if err != nil {
 			g.RaiseError(err)
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 		src = imaging.Resize(src, int(width), int(height), imaging.Lanczos)
 
@@ -309,7 +311,7 @@ func (g *Gateway) injectImageLibFunctions(payload *static.AgiLibInjectionPayload
 		}
 		if err != nil {
 			g.RaiseError(err)
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 
 		//Convert to base64
@@ -321,17 +323,17 @@ func (g *Gateway) injectImageLibFunctions(payload *static.AgiLibInjectionPayload
 	})
 
 	//Crop the given image, require (input, output, posx, posy, width, height)
-	vm.Set("_imagelib_cropImage", func(call otto.FunctionCall) otto.Value {
+	vm.Set("_imagelib_cropImage", func(call jsvm.FunctionCall) jsvm.Value {
 		vsrc, err := call.Argument(0).ToString()
 		if err != nil {
 			g.RaiseError(err)
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 
 		vdest, err := call.Argument(1).ToString()
 		if err != nil {
 			g.RaiseError(err)
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 
 		posx, err := call.Argument(2).ToInteger()
@@ -347,13 +349,13 @@ func (g *Gateway) injectImageLibFunctions(payload *static.AgiLibInjectionPayload
 		width, err := call.Argument(4).ToInteger()
 		if err != nil {
 			g.RaiseError(errors.New("Image width not defined"))
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 
 		height, err := call.Argument(5).ToInteger()
 		if err != nil {
 			g.RaiseError(errors.New("Image height not defined"))
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 
 		//Convert the virtual paths to realpaths
@@ -361,13 +363,13 @@ func (g *Gateway) injectImageLibFunctions(payload *static.AgiLibInjectionPayload
 		srcFsh, rsrc, err := static.VirtualPathToRealPath(vsrc, u)
 		if err != nil {
 			g.RaiseError(err)
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 		srcFshAbs := srcFsh.FileSystemAbstraction
 		destFsh, rdest, err := static.VirtualPathToRealPath(vdest, u)
 		if err != nil {
 			g.RaiseError(err)
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 
 		//Try to read the source image
@@ -375,13 +377,13 @@ func (g *Gateway) injectImageLibFunctions(payload *static.AgiLibInjectionPayload
 		if err != nil {
 			fmt.Println(err)
 			g.RaiseError(err)
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 
 		img, _, err := image.Decode(bytes.NewReader(imageBytes))
 		if err != nil {
 			g.RaiseError(err)
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 
 		//Crop the image
@@ -402,7 +404,7 @@ func (g *Gateway) injectImageLibFunctions(payload *static.AgiLibInjectionPayload
 			out, err = os.Create(destWritePath)
 			if err != nil {
 				g.RaiseError(err)
-				return otto.FalseValue()
+				return jsvm.FalseValue()
 			}
 			defer out.Close()
 
@@ -411,7 +413,7 @@ func (g *Gateway) injectImageLibFunctions(payload *static.AgiLibInjectionPayload
 			out, err = destFsh.FileSystemAbstraction.Create(rdest)
 			if err != nil {
 				g.RaiseError(err)
-				return otto.FalseValue()
+				return jsvm.FalseValue()
 			}
 			defer out.Close()
 		}
@@ -422,7 +424,7 @@ func (g *Gateway) injectImageLibFunctions(payload *static.AgiLibInjectionPayload
 			jpeg.Encode(out, croppedImg, nil)
 		} else {
 			g.RaiseError(errors.New("Not supported format: Only support jpg or png"))
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 		out.Close()
 
@@ -433,29 +435,30 @@ func (g *Gateway) injectImageLibFunctions(payload *static.AgiLibInjectionPayload
 				fmt.Println(">", err.Error())
 			}
 		}
+		g.recordFileOperation(payload, fileaudit.ActionUpload, vdest, "")
 
-		return otto.TrueValue()
+		return jsvm.TrueValue()
 	})
 
 	//Get the given file's thumbnail in base64
-	vm.Set("_imagelib_loadThumbString", func(call otto.FunctionCall) otto.Value {
+	vm.Set("_imagelib_loadThumbString", func(call jsvm.FunctionCall) jsvm.Value {
 		vsrc, err := call.Argument(0).ToString()
 		if err != nil {
 			g.RaiseError(err)
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 
 		fsh, err := u.GetFileSystemHandlerFromVirtualPath(vsrc)
 		if err != nil {
 			g.RaiseError(err)
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 		rpath, _ := fsh.FileSystemAbstraction.VirtualPathToRealPath(vsrc, u.Username)
 
 		//Get the files' thumb base64 string
 		base64String, err := g.Option.FileSystemRender.LoadCache(fsh, rpath, false)
 		if err != nil {
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		} else {
 			value, _ := vm.ToValue(base64String)
 			return value
@@ -463,22 +466,22 @@ func (g *Gateway) injectImageLibFunctions(payload *static.AgiLibInjectionPayload
 	})
 
 	//Check if image has EXIF
-	vm.Set("_imagelib_hasExif", func(call otto.FunctionCall) otto.Value {
+	vm.Set("_imagelib_hasExif", func(call jsvm.FunctionCall) jsvm.Value {
 		imageFileVpath, err := call.Argument(0).ToString()
 		if err != nil {
 			g.RaiseError(err)
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 
 		fsh, imagePath, err := static.VirtualPathToRealPath(imageFileVpath, u)
 		if err != nil {
 			g.RaiseError(err)
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 
 		if !fsh.FileSystemAbstraction.FileExists(imagePath) {
 			g.RaiseError(errors.New("File not exists! Given " + imagePath))
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 
 		openingPath := imagePath
@@ -490,7 +493,7 @@ func (g *Gateway) injectImageLibFunctions(payload *static.AgiLibInjectionPayload
 			c, err := fsh.FileSystemAbstraction.ReadFile(imagePath)
 			if err != nil {
 				g.RaiseError(errors.New("Read from file system failed: " + err.Error()))
-				return otto.FalseValue()
+				return jsvm.FalseValue()
 			}
 			os.WriteFile(bufferPath, c, 0775)
 			openingPath = bufferPath
@@ -501,42 +504,42 @@ func (g *Gateway) injectImageLibFunctions(payload *static.AgiLibInjectionPayload
 		if fsh.RequireBuffer {
 			file, err := os.Open(openingPath)
 			if err != nil {
-				return otto.FalseValue()
+				return jsvm.FalseValue()
 			}
 			defer file.Close()
 			reader = file
 		} else {
 			file, err := fsh.FileSystemAbstraction.Open(openingPath)
 			if err != nil {
-				return otto.FalseValue()
+				return jsvm.FalseValue()
 			}
 			defer file.Close()
 			reader = file
 		}
 		_, err = exif.Decode(reader)
 		if err != nil {
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
-		return otto.TrueValue()
+		return jsvm.TrueValue()
 	})
 
 	//Get EXIF data as JSON
-	vm.Set("_imagelib_getExif", func(call otto.FunctionCall) otto.Value {
+	vm.Set("_imagelib_getExif", func(call jsvm.FunctionCall) jsvm.Value {
 		imageFileVpath, err := call.Argument(0).ToString()
 		if err != nil {
 			g.RaiseError(err)
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 
 		fsh, imagePath, err := static.VirtualPathToRealPath(imageFileVpath, u)
 		if err != nil {
 			g.RaiseError(err)
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 
 		if !fsh.FileSystemAbstraction.FileExists(imagePath) {
 			g.RaiseError(errors.New("File not exists! Given " + imagePath))
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 
 		openingPath := imagePath
@@ -548,7 +551,7 @@ func (g *Gateway) injectImageLibFunctions(payload *static.AgiLibInjectionPayload
 			c, err := fsh.FileSystemAbstraction.ReadFile(imagePath)
 			if err != nil {
 				g.RaiseError(errors.New("Read from file system failed: " + err.Error()))
-				return otto.FalseValue()
+				return jsvm.FalseValue()
 			}
 			os.WriteFile(bufferPath, c, 0775)
 			openingPath = bufferPath
@@ -560,7 +563,7 @@ func (g *Gateway) injectImageLibFunctions(payload *static.AgiLibInjectionPayload
 			file, err := os.Open(openingPath)
 			if err != nil {
 				g.RaiseError(err)
-				return otto.FalseValue()
+				return jsvm.FalseValue()
 			}
 			defer file.Close()
 			reader = file
@@ -568,7 +571,7 @@ func (g *Gateway) injectImageLibFunctions(payload *static.AgiLibInjectionPayload
 			file, err := fsh.FileSystemAbstraction.Open(openingPath)
 			if err != nil {
 				g.RaiseError(err)
-				return otto.FalseValue()
+				return jsvm.FalseValue()
 			}
 			defer file.Close()
 			reader = file
@@ -576,7 +579,7 @@ func (g *Gateway) injectImageLibFunctions(payload *static.AgiLibInjectionPayload
 		x, err := exif.Decode(reader)
 		if err != nil {
 			g.RaiseError(err)
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 		exifInfo := make(map[string]interface{})
 		exifString := x.String()
@@ -592,7 +595,7 @@ func (g *Gateway) injectImageLibFunctions(payload *static.AgiLibInjectionPayload
 		jsonBytes, err := json.Marshal(exifInfo)
 		if err != nil {
 			g.RaiseError(err)
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 		result, _ := vm.ToValue(string(jsonBytes))
 		return result
@@ -4,7 +4,7 @@ import (
 	"encoding/json"
 	"log"
 
-	"github.com/robertkrimen/otto"
+	"imuslab.com/arozos/mod/agi/jsvm"
 	"imuslab.com/arozos/mod/agi/static"
 	"imuslab.com/arozos/mod/iot"
 )
@@ -33,33 +33,33 @@ func (g *Gateway) injectIoTFunctions(payload *static.AgiLibInjectionPayload) {
 	//w := payload.Writer
 	//r := payload.Request
 	//Scan and return the latest iot device list
-	vm.Set("_iot_scan", func(call otto.FunctionCall) otto.Value {
+	vm.Set("_iot_scan", func(call jsvm.FunctionCall) jsvm.Value {
 		scannedDevices := g.Option.IotManager.ScanDevices()
 		js, _ := json.Marshal(scannedDevices)
 		devList, err := vm.ToValue(string(js))
 		if err != nil {
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 		return devList
 	})
 
 	//List the current scanned device list from cache
-	vm.Set("_iot_list", func(call otto.FunctionCall) otto.Value {
+	vm.Set("_iot_list", func(call jsvm.FunctionCall) jsvm.Value {
 		devices := g.Option.IotManager.GetCachedDeviceList()
 		js, _ := json.Marshal(devices)
 		devList, err := vm.ToValue(string(js))
 		if err != nil {
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 		return devList
 	})
 
 	//Conenct an iot device. Return true if the device is connected or the device do not require connection before command exec
-	vm.Set("_iot_connect", func(call otto.FunctionCall) otto.Value {
+	vm.Set("_iot_connect", func(call jsvm.FunctionCall) jsvm.Value {
 		//Get device ID from paratmer
 		devID, err := call.Argument(0).ToString()
 		if err != nil {
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 
 		//Get the auth info from paramters
@@ -82,7 +82,7 @@ func (g *Gateway) injectIoTFunctions(payload *static.AgiLibInjectionPayload) {
 		dev := g.Option.IotManager.GetDeviceByID(devID)
 		if dev == nil {
 			//No device with that ID found
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 
 		if dev.RequireConnect == true {
@@ -98,29 +98,29 @@ func (g *Gateway) injectIoTFunctions(payload *static.AgiLibInjectionPayload) {
 		}
 
 		//Return true
-		return otto.TrueValue()
+		return jsvm.TrueValue()
 	})
 
 	//Get the status of the given device
-	vm.Set("_iot_status", func(call otto.FunctionCall) otto.Value {
+	vm.Set("_iot_status", func(call jsvm.FunctionCall) jsvm.Value {
 		//Get device ID from paratmer
 		devID, err := call.Argument(0).ToString()
 		if err != nil {
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 
 		dev := g.Option.IotManager.GetDeviceByID(devID)
 
 		if dev == nil {
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 
 		//We have no idea what is the structure of the dev status.
 		//Just leave it to the front end to handle :P
-		devStatus, err := dev.Handler.Status(dev)
+		devStatus, err := g.Option.IotManager.GetDeviceStatus(dev)
 		if err != nil {
 			log.Println("*AGI IoT* " + err.Error())
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 
 		js, _ := json.Marshal(devStatus)
@@ -128,17 +128,17 @@ func (g *Gateway) injectIoTFunctions(payload *static.AgiLibInjectionPayload) {
 		return results
 	})
 
-	vm.Set("_iot_exec", func(call otto.FunctionCall) otto.Value {
+	vm.Set("_iot_exec", func(call jsvm.FunctionCall) jsvm.Value {
 		//Get device ID from paratmer
 		devID, err := call.Argument(0).ToString()
 		if err != nil {
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 
 		//Get endpoint name
 		epname, err := call.Argument(1).ToString()
 		if err != nil {
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 
 		//Get payload if any
@@ -152,7 +152,7 @@ func (g *Gateway) injectIoTFunctions(payload *static.AgiLibInjectionPayload) {
 		if dev == nil {
 			//Device not found
 			log.Println("*AGI IoT* Given device ID do not match any IoT devices")
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 
 		//Get the endpoint from name
@@ -169,7 +169,7 @@ func (g *Gateway) injectIoTFunctions(payload *static.AgiLibInjectionPayload) {
 		if targetEp == nil {
 			//Endpoint not found
 			log.Println("*AGI IoT* Failed to get endpoint by name in this device")
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 
 		var results interface{}
@@ -181,20 +181,20 @@ func (g *Gateway) injectIoTFunctions(payload *static.AgiLibInjectionPayload) {
 			err = json.Unmarshal([]byte(payload), &payloadMap)
 			if err != nil {
 				log.Println("*AGI IoT* Failed to parse input payload: " + err.Error())
-				return otto.FalseValue()
+				return jsvm.FalseValue()
 			}
 
 			//Execute the request
-			results, err = dev.Handler.Execute(dev, targetEp, payloadMap)
+			results, err = g.Option.IotManager.ExecuteEndpoint(dev, targetEp, payloadMap)
 
 		} else {
 			//Execute the request without payload
-			results, err = dev.Handler.Execute(dev, targetEp, nil)
+			results, err = g.Option.IotManager.ExecuteEndpoint(dev, targetEp, nil)
 		}
 
 		if err != nil {
 			log.Println("*AGI IoT* Failed to execute request to device: " + err.Error())
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 
 		js, _ := json.Marshal(results)
@@ -203,41 +203,41 @@ func (g *Gateway) injectIoTFunctions(payload *static.AgiLibInjectionPayload) {
 	})
 
 	//Disconnect a given iot device using the device UUID
-	vm.Set("_iot_disconnect", func(call otto.FunctionCall) otto.Value {
+	vm.Set("_iot_disconnect", func(call jsvm.FunctionCall) jsvm.Value {
 		//Get device ID from paratmer
 		devID, err := call.Argument(0).ToString()
 		if err != nil {
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 
 		dev := g.Option.IotManager.GetDeviceByID(devID)
 
 		if dev == nil {
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 
 		if dev.RequireConnect == true {
 			err = dev.Handler.Disconnect(dev)
 			if err != nil {
-				return otto.FalseValue()
+				return jsvm.FalseValue()
 			}
 		}
 
-		return otto.TrueValue()
+		return jsvm.TrueValue()
 	})
 
 	//Return the icon tag for this device
-	vm.Set("_iot_iconTag", func(call otto.FunctionCall) otto.Value {
+	vm.Set("_iot_iconTag", func(call jsvm.FunctionCall) jsvm.Value {
 		//Get device ID from paratmer
 		devID, err := call.Argument(0).ToString()
 		if err != nil {
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 
 		dev := g.Option.IotManager.GetDeviceByID(devID)
 		if dev == nil {
 			//device not found
-			return otto.NullValue()
+			return jsvm.NullValue()
 		}
 
 		deviceIconTag := dev.Handler.Icon(dev)
@@ -246,11 +246,11 @@ func (g *Gateway) injectIoTFunctions(payload *static.AgiLibInjectionPayload) {
 		return it
 	})
 
-	vm.Set("_iot_ready", func(call otto.FunctionCall) otto.Value {
+	vm.Set("_iot_ready", func(call jsvm.FunctionCall) jsvm.Value {
 		if g.Option.IotManager == nil {
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		} else {
-			return otto.TrueValue()
+			return jsvm.TrueValue()
 		}
 	})
 
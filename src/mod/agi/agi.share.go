@@ -4,7 +4,7 @@ import (
 	"log"
 	"time"
 
-	"github.com/robertkrimen/otto"
+	"imuslab.com/arozos/mod/agi/jsvm"
 	"imuslab.com/arozos/mod/agi/static"
 )
 
@@ -22,11 +22,11 @@ func (g *Gateway) injectShareFunctions(payload *static.AgiLibInjectionPayload) {
 	//scriptPath := payload.ScriptPath
 	//w := payload.Writer
 	//r := payload.Request
-	vm.Set("_share_file", func(call otto.FunctionCall) otto.Value {
+	vm.Set("_share_file", func(call jsvm.FunctionCall) jsvm.Value {
 		//Get the vpath of file to share
 		vpath, err := call.Argument(0).ToString()
 		if err != nil {
-			return otto.New().MakeCustomError("Unable to decode filepath", "No given filepath for sharing")
+			return vm.MakeCustomError("Unable to decode filepath", "No given filepath for sharing")
 		}
 
 		//Get the timeout from the 2nd parameter for how long this share will exists
@@ -41,7 +41,7 @@ func (g *Gateway) injectShareFunctions(payload *static.AgiLibInjectionPayload) {
 		shareID, err := g.Option.ShareManager.CreateNewShare(u, vpathSourceFsh, vpath)
 		if err != nil {
 			log.Println("[AGI] Create Share Failed: " + err.Error())
-			return otto.New().MakeCustomError("Share failed", err.Error())
+			return vm.MakeCustomError("Share failed", err.Error())
 		}
 
 		if timeout > 0 {
@@ -52,75 +52,75 @@ func (g *Gateway) injectShareFunctions(payload *static.AgiLibInjectionPayload) {
 			}(int(timeout))
 		}
 
-		r, _ := otto.ToValue(shareID.UUID)
+		r, _ := jsvm.ToValue(shareID.UUID)
 		return r
 	})
 
-	vm.Set("_share_removeShare", func(call otto.FunctionCall) otto.Value {
+	vm.Set("_share_removeShare", func(call jsvm.FunctionCall) jsvm.Value {
 		shareUUID, err := call.Argument(0).ToString()
 		if err != nil {
-			return otto.New().MakeCustomError("Failed to remove share", "No share UUID given")
+			return vm.MakeCustomError("Failed to remove share", "No share UUID given")
 		}
 		err = g.Option.ShareManager.RemoveShareByUUID(u, shareUUID)
 		if err != nil {
 			log.Println("[AGI] Share remove failed: " + err.Error())
-			return otto.New().MakeCustomError("Failed to remove share", err.Error())
+			return vm.MakeCustomError("Failed to remove share", err.Error())
 		}
 
-		return otto.TrueValue()
+		return jsvm.TrueValue()
 	})
 
-	vm.Set("_share_getShareUUID", func(call otto.FunctionCall) otto.Value {
+	vm.Set("_share_getShareUUID", func(call jsvm.FunctionCall) jsvm.Value {
 		vpath, err := call.Argument(0).ToString()
 		if err != nil {
 			log.Println("[AGI] Failed to get share UUID: filepath not given")
-			return otto.NullValue()
+			return jsvm.NullValue()
 		}
 
 		shareObject := g.Option.ShareManager.GetShareObjectFromUserAndVpath(u, vpath)
 		if shareObject == nil {
 			log.Println("[AGI] Failed to get share UUID: File not shared")
-			return otto.NullValue()
+			return jsvm.NullValue()
 		}
 
 		shareUUID := shareObject.UUID
-		val, _ := otto.ToValue(shareUUID)
+		val, _ := jsvm.ToValue(shareUUID)
 		return val
 	})
 
-	vm.Set("_share_checkShareExists", func(call otto.FunctionCall) otto.Value {
+	vm.Set("_share_checkShareExists", func(call jsvm.FunctionCall) jsvm.Value {
 		shareUUID, err := call.Argument(0).ToString()
 		if err != nil {
-			return otto.New().MakeCustomError("Failed to check share exists", "No share UUID given")
+			return vm.MakeCustomError("Failed to check share exists", "No share UUID given")
 		}
 
 		shareObject := g.Option.ShareManager.GetShareObjectFromUUID(shareUUID)
-		r, _ := otto.ToValue(!(shareObject == nil))
+		r, _ := jsvm.ToValue(!(shareObject == nil))
 		return r
 	})
 
-	vm.Set("_share_checkSharePermission", func(call otto.FunctionCall) otto.Value {
+	vm.Set("_share_checkSharePermission", func(call jsvm.FunctionCall) jsvm.Value {
 		shareUUID, err := call.Argument(0).ToString()
 		if err != nil {
-			return otto.New().MakeCustomError("Failed to check share permission", "No share UUID given")
+			return vm.MakeCustomError("Failed to check share permission", "No share UUID given")
 		}
 
 		shareObject := g.Option.ShareManager.GetShareObjectFromUUID(shareUUID)
 		if shareObject == nil {
-			return otto.NullValue()
+			return jsvm.NullValue()
 		}
-		r, _ := otto.ToValue(shareObject.Permission)
+		r, _ := jsvm.ToValue(shareObject.Permission)
 		return r
 	})
 
-	vm.Set("_share_fileIsShared", func(call otto.FunctionCall) otto.Value {
+	vm.Set("_share_fileIsShared", func(call jsvm.FunctionCall) jsvm.Value {
 		vpath, err := call.Argument(0).ToString()
 		if err != nil {
-			return otto.New().MakeCustomError("Failed to check share exists", "No filepath given")
+			return vm.MakeCustomError("Failed to check share exists", "No filepath given")
 		}
 
 		isShared := g.Option.ShareManager.FileIsShared(u, vpath)
-		r, _ := otto.ToValue(isShared)
+		r, _ := jsvm.ToValue(isShared)
 		return r
 	})
 
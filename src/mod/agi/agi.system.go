@@ -9,13 +9,14 @@ import (
 	"strings"
 	"time"
 
-	"github.com/robertkrimen/otto"
+	"imuslab.com/arozos/mod/agi/jsvm"
+	"imuslab.com/arozos/mod/agi/policy"
 	"imuslab.com/arozos/mod/agi/static"
 	"imuslab.com/arozos/mod/utils"
 )
 
 // Inject aroz online custom functions into the virtual machine
-func (g *Gateway) injectStandardLibs(vm *otto.Otto, scriptFile string, scriptScope string) {
+func (g *Gateway) injectStandardLibs(vm jsvm.VM, scriptFile string, scriptScope string) {
 	//Define system core modules and definations
 	sysdb := g.Option.UserHandler.GetDatabase()
 
@@ -29,13 +30,13 @@ func (g *Gateway) injectStandardLibs(vm *otto.Otto, scriptFile string, scriptSco
 	vm.Set("HTTP_HEADER", "text/plain")
 
 	//Response related
-	vm.Set("sendResp", func(call otto.FunctionCall) otto.Value {
+	vm.Set("sendResp", func(call jsvm.FunctionCall) jsvm.Value {
 		argString, _ := call.Argument(0).ToString()
 		vm.Set("HTTP_RESP", argString)
-		return otto.Value{}
+		return jsvm.Value{}
 	})
 
-	vm.Set("echo", func(call otto.FunctionCall) otto.Value {
+	vm.Set("echo", func(call jsvm.FunctionCall) jsvm.Value {
 		argString, _ := call.Argument(0).ToString()
 		currentResp, err := vm.Get("HTTP_RESP")
 		if err != nil {
@@ -49,19 +50,19 @@ func (g *Gateway) injectStandardLibs(vm *otto.Otto, scriptFile string, scriptSco
 			vm.Set("HTTP_RESP", currentRespText+argString)
 		}
 
-		return otto.Value{}
+		return jsvm.Value{}
 	})
 
-	vm.Set("sendOK", func(call otto.FunctionCall) otto.Value {
+	vm.Set("sendOK", func(call jsvm.FunctionCall) jsvm.Value {
 		vm.Set("HTTP_RESP", "ok")
-		return otto.Value{}
+		return jsvm.Value{}
 	})
 
-	vm.Set("_sendJSONResp", func(call otto.FunctionCall) otto.Value {
+	vm.Set("_sendJSONResp", func(call jsvm.FunctionCall) jsvm.Value {
 		argString, _ := call.Argument(0).ToString()
 		vm.Set("HTTP_HEADER", "application/json")
 		vm.Set("HTTP_RESP", argString)
-		return otto.Value{}
+		return jsvm.Value{}
 	})
 
 	vm.Run(`
@@ -74,19 +75,19 @@ func (g *Gateway) injectStandardLibs(vm *otto.Otto, scriptFile string, scriptSco
 		}
 	`)
 
-	vm.Set("addNightlyTask", func(call otto.FunctionCall) otto.Value {
+	vm.Set("addNightlyTask", func(call jsvm.FunctionCall) jsvm.Value {
 		scriptPath, _ := call.Argument(0).ToString() //From web directory
 		if static.IsValidAGIScript(scriptPath) {
 			g.NightlyScripts = append(g.NightlyScripts, scriptPath)
 		} else {
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
-		return otto.TrueValue()
+		return jsvm.TrueValue()
 	})
 
 	//Database related
 	//newDBTableIfNotExists(tableName)
-	vm.Set("newDBTableIfNotExists", func(call otto.FunctionCall) otto.Value {
+	vm.Set("newDBTableIfNotExists", func(call jsvm.FunctionCall) jsvm.Value {
 		tableName, err := call.Argument(0).ToString()
 		if err != nil {
 			g.RaiseError(err)
@@ -104,7 +105,7 @@ func (g *Gateway) injectStandardLibs(vm *otto.Otto, scriptFile string, scriptSco
 		return reply
 	})
 
-	vm.Set("DBTableExists", func(call otto.FunctionCall) otto.Value {
+	vm.Set("DBTableExists", func(call jsvm.FunctionCall) jsvm.Value {
 		tableName, err := call.Argument(0).ToString()
 		if err != nil {
 			g.RaiseError(err)
@@ -113,14 +114,14 @@ func (g *Gateway) injectStandardLibs(vm *otto.Otto, scriptFile string, scriptSco
 		}
 		//Create the table with given tableName
 		if sysdb.TableExists(tableName) {
-			return otto.TrueValue()
+			return jsvm.TrueValue()
 		}
 
-		return otto.FalseValue()
+		return jsvm.FalseValue()
 	})
 
 	//dropDBTable(tablename)
-	vm.Set("dropDBTable", func(call otto.FunctionCall) otto.Value {
+	vm.Set("dropDBTable", func(call jsvm.FunctionCall) jsvm.Value {
 		tableName, err := call.Argument(0).ToString()
 		if err != nil {
 			g.RaiseError(err)
@@ -140,7 +141,7 @@ func (g *Gateway) injectStandardLibs(vm *otto.Otto, scriptFile string, scriptSco
 	})
 
 	//writeDBItem(tablename, key, value) => return true when suceed
-	vm.Set("writeDBItem", func(call otto.FunctionCall) otto.Value {
+	vm.Set("writeDBItem", func(call jsvm.FunctionCall) jsvm.Value {
 		tableName, err := call.Argument(0).ToString()
 		if err != nil {
 			g.RaiseError(err)
@@ -173,7 +174,7 @@ func (g *Gateway) injectStandardLibs(vm *otto.Otto, scriptFile string, scriptSco
 	})
 
 	//readDBItem(tablename, key) => return value
-	vm.Set("readDBItem", func(call otto.FunctionCall) otto.Value {
+	vm.Set("readDBItem", func(call jsvm.FunctionCall) jsvm.Value {
 		tableName, _ := call.Argument(0).ToString()
 		keyString, _ := call.Argument(1).ToString()
 		returnValue := ""
@@ -183,13 +184,13 @@ func (g *Gateway) injectStandardLibs(vm *otto.Otto, scriptFile string, scriptSco
 			r, _ := vm.ToValue(returnValue)
 			reply = r
 		} else {
-			reply = otto.FalseValue()
+			reply = jsvm.FalseValue()
 		}
 		return reply
 	})
 
 	//listDBTable(tablename) => Return key values array
-	vm.Set("listDBTable", func(call otto.FunctionCall) otto.Value {
+	vm.Set("listDBTable", func(call jsvm.FunctionCall) jsvm.Value {
 		tableName, _ := call.Argument(0).ToString()
 		returnValue := map[string]string{}
 		reply, _ := vm.ToValue(nil)
@@ -203,34 +204,34 @@ func (g *Gateway) injectStandardLibs(vm *otto.Otto, scriptFile string, scriptSco
 			}
 			r, err := vm.ToValue(returnValue)
 			if err != nil {
-				return otto.NullValue()
+				return jsvm.NullValue()
 			}
 			return r
 		} else {
-			reply = otto.FalseValue()
+			reply = jsvm.FalseValue()
 		}
 		return reply
 	})
 
 	//deleteDBItem(tablename, key) => Return true if success, false if failed
-	vm.Set("deleteDBItem", func(call otto.FunctionCall) otto.Value {
+	vm.Set("deleteDBItem", func(call jsvm.FunctionCall) jsvm.Value {
 		tableName, _ := call.Argument(0).ToString()
 		keyString, _ := call.Argument(1).ToString()
 		if g.filterDBTable(tableName, true) {
 			err := sysdb.Delete(tableName, keyString)
 			if err != nil {
-				return otto.FalseValue()
+				return jsvm.FalseValue()
 			}
 		} else {
 			//Permission denied
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 
-		return otto.TrueValue()
+		return jsvm.TrueValue()
 	})
 
 	//Module registry
-	vm.Set("registerModule", func(call otto.FunctionCall) otto.Value {
+	vm.Set("registerModule", func(call jsvm.FunctionCall) jsvm.Value {
 		jsonModuleConfig, err := call.Argument(0).ToString()
 		if err != nil {
 			g.RaiseError(err)
@@ -252,6 +253,28 @@ func (g *Gateway) injectStandardLibs(vm *otto.Otto, scriptFile string, scriptSco
 		if scriptFile != "" && scriptScope != "" {
 			moduleDir := static.GetScriptRoot(scriptFile, scriptScope)
 
+			//Record the JavaScript engine requested by this module
+			if engine, ok := moduleConfig["AGIEngine"].(string); ok && engine != "" {
+				if !jsvm.IsSupportedEngine(engine) {
+					g.RaiseError(errors.New("unsupported AGI engine: " + engine))
+					reply, _ := vm.ToValue(false)
+					return reply
+				}
+				g.setModuleEngine(scriptFile, scriptScope, engine)
+			}
+
+			//Record the resource and network policy declared by this module
+			if declaredPolicy, ok := moduleConfig["AGIPolicy"]; ok && declaredPolicy != nil {
+				policyJSON, _ := json.Marshal(declaredPolicy)
+				modulePolicy, err := policy.ParseModulePolicy(policyJSON)
+				if err != nil {
+					g.RaiseError(errors.New("invalid AGI policy: " + err.Error()))
+					reply, _ := vm.ToValue(false)
+					return reply
+				}
+				g.setModulePolicy(moduleDir, modulePolicy)
+			}
+
 			//Convert relative paths to absolute paths for IconPath, StartDir, and LaunchFWDir
 			pathFields := []string{"IconPath", "StartDir", "LaunchFWDir", "LaunchEmb"}
 			for _, field := range pathFields {
@@ -283,43 +306,43 @@ func (g *Gateway) injectStandardLibs(vm *otto.Otto, scriptFile string, scriptSco
 			reply, _ := vm.ToValue(false)
 			return reply
 		}
-		return otto.Value{}
+		return jsvm.Value{}
 	})
 
 	//Package Executation. Only usable when called to a given script File.
 	if scriptFile != "" && scriptScope != "" {
 		//Package request --> Install linux package if not exists
-		vm.Set("requirepkg", func(call otto.FunctionCall) otto.Value {
+		vm.Set("requirepkg", func(call jsvm.FunctionCall) jsvm.Value {
 			g.RaiseError(errors.New("requirepkg has been deprecated in agi v3.0"))
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		})
 
 		//Exec required pkg with permission control
-		vm.Set("execpkg", func(call otto.FunctionCall) otto.Value {
+		vm.Set("execpkg", func(call jsvm.FunctionCall) jsvm.Value {
 			g.RaiseError(errors.New("execpkg has been deprecated in agi v3.0"))
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		})
 
 		//Include another js in runtime
-		vm.Set("includes", func(call otto.FunctionCall) otto.Value {
+		vm.Set("includes", func(call jsvm.FunctionCall) jsvm.Value {
 			//Check if the pkg is already registered
 			scriptName, err := call.Argument(0).ToString()
 			if err != nil {
 				g.RaiseError(err)
-				return otto.FalseValue()
+				return jsvm.FalseValue()
 			}
 
 			//Check if it is calling itself
 			if filepath.Base(scriptFile) == filepath.Base(scriptName) {
 				g.RaiseError(errors.New("*AGI* Self calling is not allowed"))
-				return otto.FalseValue()
+				return jsvm.FalseValue()
 			}
 
 			//Check if the script file exists
 			targetScriptPath := filepath.ToSlash(filepath.Join(filepath.Dir(scriptFile), scriptName))
 			if !utils.FileExists(targetScriptPath) {
 				g.RaiseError(errors.New("*AGI* Target path not exists!"))
-				return otto.FalseValue()
+				return jsvm.FalseValue()
 			}
 
 			//Run the script
@@ -329,30 +352,93 @@ func (g *Gateway) injectStandardLibs(vm *otto.Otto, scriptFile string, scriptSco
 				//Script execution failed
 				log.Println("Script Execution Failed: ", err.Error())
 				g.RaiseError(err)
-				return otto.FalseValue()
+				return jsvm.FalseValue()
 			}
 
-			return otto.TrueValue()
+			return jsvm.TrueValue()
 		})
 
+		//Load a JSON file or CommonJS module within the module folder
+		moduleCache := map[string]jsvm.Value{}
+		moduleLoading := map[string]bool{}
+		vm.Set("require", func(call jsvm.FunctionCall) jsvm.Value {
+			modulePath, err := call.Argument(0).ToString()
+			if err != nil {
+				g.RaiseError(err)
+				return jsvm.FalseValue()
+			}
+
+			//Resolve the path relative to the current script
+			targetScriptPath := filepath.ToSlash(filepath.Join(filepath.Dir(scriptFile), modulePath))
+			if filepath.Ext(targetScriptPath) == "" {
+				targetScriptPath = targetScriptPath + ".js"
+			}
+			moduleRoot := filepath.Join(scriptScope, static.GetScriptRoot(scriptFile, scriptScope))
+			if escaped, _ := static.CheckRootEscape(moduleRoot, targetScriptPath); escaped {
+				g.RaiseError(errors.New("*AGI* require path escaped module folder"))
+				return jsvm.FalseValue()
+			}
+			if !utils.FileExists(targetScriptPath) {
+				g.RaiseError(errors.New("*AGI* Target path not exists!"))
+				return jsvm.FalseValue()
+			}
+
+			if cached, ok := moduleCache[targetScriptPath]; ok {
+				return cached
+			}
+			if moduleLoading[targetScriptPath] {
+				g.RaiseError(errors.New("*AGI* Circular require detected: " + modulePath))
+				return jsvm.FalseValue()
+			}
+
+			content, err := os.ReadFile(targetScriptPath)
+			if err != nil {
+				g.RaiseError(err)
+				return jsvm.FalseValue()
+			}
+
+			var exported jsvm.Value
+			if filepath.Ext(targetScriptPath) == ".json" {
+				var parsed interface{}
+				err = json.Unmarshal(content, &parsed)
+				if err != nil {
+					g.RaiseError(err)
+					return jsvm.FalseValue()
+				}
+				exported, err = vm.ToValue(parsed)
+			} else {
+				//Wrap the module in a function scope and return its exports
+				moduleLoading[targetScriptPath] = true
+				exported, err = vm.Run("(function(){var module = {exports: {}}; var exports = module.exports;\n" + string(content) + "\n;return module.exports;})()")
+				delete(moduleLoading, targetScriptPath)
+			}
+			if err != nil {
+				log.Println("Script Execution Failed: ", err.Error())
+				g.RaiseError(err)
+				return jsvm.FalseValue()
+			}
+
+			moduleCache[targetScriptPath] = exported
+			return exported
+		})
 	}
 
 	//Delay, sleep given ms
-	vm.Set("delay", func(call otto.FunctionCall) otto.Value {
+	vm.Set("delay", func(call jsvm.FunctionCall) jsvm.Value {
 		delayTime, err := call.Argument(0).ToInteger()
 		if err != nil {
 			g.RaiseError(err)
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 		time.Sleep(time.Duration(delayTime) * time.Millisecond)
-		return otto.TrueValue()
+		return jsvm.TrueValue()
 	})
 
 	//Exit
-	vm.Set("exit", func(call otto.FunctionCall) otto.Value {
-		vm.Interrupt <- func() {
+	vm.Set("exit", func(call jsvm.FunctionCall) jsvm.Value {
+		vm.Interrupt(func() {
 			panic(errExitcall)
-		}
-		return otto.NullValue()
+		})
+		return jsvm.NullValue()
 	})
 }
@@ -8,7 +8,8 @@ import (
 	"os"
 	"path/filepath"
 
-	"github.com/robertkrimen/otto"
+	"imuslab.com/arozos/mod/agi/jsvm"
+	"imuslab.com/arozos/mod/agi/policy"
 	"imuslab.com/arozos/mod/agi/static"
 	"imuslab.com/arozos/mod/filesystem"
 	"imuslab.com/arozos/mod/filesystem/arozfs"
@@ -18,7 +19,7 @@ import (
 // Inject user based functions into the virtual machine
 // Note that the fsh might be nil and scriptPath must be real path of script being executed
 // **Use local file system check if fsh == nil**
-func (g *Gateway) injectUserFunctions(vm *otto.Otto, fsh *filesystem.FileSystemHandler, scriptPath string, scriptScope string, u *user.User, w http.ResponseWriter, r *http.Request) {
+func (g *Gateway) injectUserFunctions(vm jsvm.VM, fsh *filesystem.FileSystemHandler, scriptPath string, scriptScope string, u *user.User, w http.ResponseWriter, r *http.Request) {
 	username := u.Username
 	vm.Set("USERNAME", username)
 	vm.Set("USERICON", u.GetUserIcon())
@@ -28,40 +29,40 @@ func (g *Gateway) injectUserFunctions(vm *otto.Otto, fsh *filesystem.FileSystemH
 	vm.Set("USER_MODULES", u.GetUserAccessibleModules())
 
 	//File system and path related
-	vm.Set("decodeVirtualPath", func(call otto.FunctionCall) otto.Value {
+	vm.Set("decodeVirtualPath", func(call jsvm.FunctionCall) jsvm.Value {
 		log.Println("Call to deprecated function decodeVirtualPath")
-		return otto.FalseValue()
+		return jsvm.FalseValue()
 	})
 
-	vm.Set("decodeAbsoluteVirtualPath", func(call otto.FunctionCall) otto.Value {
+	vm.Set("decodeAbsoluteVirtualPath", func(call jsvm.FunctionCall) jsvm.Value {
 		log.Println("Call to deprecated function decodeAbsoluteVirtualPath")
-		return otto.FalseValue()
+		return jsvm.FalseValue()
 	})
 
-	vm.Set("encodeRealPath", func(call otto.FunctionCall) otto.Value {
+	vm.Set("encodeRealPath", func(call jsvm.FunctionCall) jsvm.Value {
 		log.Println("Call to deprecated function encodeRealPath")
-		return otto.FalseValue()
+		return jsvm.FalseValue()
 	})
 
 	//Check if a given virtual path is readonly
-	vm.Set("pathCanWrite", func(call otto.FunctionCall) otto.Value {
+	vm.Set("pathCanWrite", func(call jsvm.FunctionCall) jsvm.Value {
 		vpath, _ := call.Argument(0).ToString()
 		if u.CanWrite(vpath) {
-			return otto.TrueValue()
+			return jsvm.TrueValue()
 		} else {
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 	})
 
 	//Permission related
-	vm.Set("getUserPermissionGroup", func(call otto.FunctionCall) otto.Value {
+	vm.Set("getUserPermissionGroup", func(call jsvm.FunctionCall) jsvm.Value {
 		groupinfo := u.GetUserPermissionGroup()
 		jsonString, _ := json.Marshal(groupinfo)
 		reply, _ := vm.ToValue(string(jsonString))
 		return reply
 	})
 
-	vm.Set("userIsAdmin", func(call otto.FunctionCall) otto.Value {
+	vm.Set("userIsAdmin", func(call jsvm.FunctionCall) jsvm.Value {
 		reply, _ := vm.ToValue(u.IsAdmin())
 		return reply
 	})
@@ -70,7 +71,7 @@ func (g *Gateway) injectUserFunctions(vm *otto.Otto, fsh *filesystem.FileSystemH
 	/*
 		userExists(username);
 	*/
-	vm.Set("userExists", func(call otto.FunctionCall) otto.Value {
+	vm.Set("userExists", func(call jsvm.FunctionCall) jsvm.Value {
 		if u.IsAdmin() {
 			//Get username from function paramter
 			username, err := call.Argument(0).ToString()
@@ -83,14 +84,14 @@ func (g *Gateway) injectUserFunctions(vm *otto.Otto, fsh *filesystem.FileSystemH
 			//Check if user exists
 			userExists := u.Parent().GetAuthAgent().UserExists(username)
 			if userExists {
-				return otto.TrueValue()
+				return jsvm.TrueValue()
 			} else {
-				return otto.FalseValue()
+				return jsvm.FalseValue()
 			}
 
 		} else {
 			g.RaiseError(errors.New("Permission Denied: userExists require admin permission"))
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 
 	})
@@ -98,7 +99,7 @@ func (g *Gateway) injectUserFunctions(vm *otto.Otto, fsh *filesystem.FileSystemH
 	/*
 		createUser(username, password, defaultGroup);
 	*/
-	vm.Set("createUser", func(call otto.FunctionCall) otto.Value {
+	vm.Set("createUser", func(call jsvm.FunctionCall) jsvm.Value {
 		if u.IsAdmin() {
 			//Ok. Create user base on given information
 			username, err := call.Argument(0).ToString()
@@ -147,29 +148,29 @@ func (g *Gateway) injectUserFunctions(vm *otto.Otto, fsh *filesystem.FileSystemH
 				return reply
 			}
 
-			return otto.TrueValue()
+			return jsvm.TrueValue()
 		} else {
 			g.RaiseError(errors.New("Permission Denied: createUser require admin permission"))
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 
 	})
 
-	vm.Set("editUser", func(call otto.FunctionCall) otto.Value {
+	vm.Set("editUser", func(call jsvm.FunctionCall) jsvm.Value {
 		if u.IsAdmin() {
 
 		} else {
 			g.RaiseError(errors.New("Permission Denied: editUser require admin permission"))
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 		//libname, err := call.Argument(0).ToString()
-		return otto.FalseValue()
+		return jsvm.FalseValue()
 	})
 
 	/*
 		removeUser(username)
 	*/
-	vm.Set("removeUser", func(call otto.FunctionCall) otto.Value {
+	vm.Set("removeUser", func(call jsvm.FunctionCall) jsvm.Value {
 		if u.IsAdmin() {
 			//Get username from function paramters
 			username, err := call.Argument(0).ToString()
@@ -195,15 +196,15 @@ func (g *Gateway) injectUserFunctions(vm *otto.Otto, fsh *filesystem.FileSystemH
 				return reply
 			}
 
-			return otto.TrueValue()
+			return jsvm.TrueValue()
 		} else {
 			g.RaiseError(errors.New("Permission Denied: removeUser require admin permission"))
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 	})
 
 	//Allow real time library includsion into the virtual machine
-	vm.Set("requirelib", func(call otto.FunctionCall) otto.Value {
+	vm.Set("requirelib", func(call jsvm.FunctionCall) jsvm.Value {
 		libname, err := call.Argument(0).ToString()
 		if err != nil {
 			g.RaiseError(err)
@@ -214,7 +215,7 @@ func (g *Gateway) injectUserFunctions(vm *otto.Otto, fsh *filesystem.FileSystemH
 		//Handle special case on high level libraries
 		if libname == "websocket" && w != nil && r != nil {
 			g.injectWebSocketFunctions(vm, u, w, r)
-			return otto.TrueValue()
+			return jsvm.TrueValue()
 		} else {
 			//Check if the library name exists. If yes, run the initiation script on the vm
 			if entryPoint, ok := g.LoadedAGILibrary[libname]; ok {
@@ -225,23 +226,24 @@ func (g *Gateway) injectUserFunctions(vm *otto.Otto, fsh *filesystem.FileSystemH
 					ScriptPath: scriptPath,
 					Writer:     w,
 					Request:    r,
+					Policy:     g.GetScriptPolicy(scriptPath, scriptScope),
 				})
-				return otto.TrueValue()
+				return jsvm.TrueValue()
 			} else {
 				//Lib not exists
 				log.Println("Lib not found: " + libname)
-				return otto.FalseValue()
+				return jsvm.FalseValue()
 			}
 		}
 	})
 
 	//Execd (Execute & detach) run another script and detach the execution
-	vm.Set("execd", func(call otto.FunctionCall) otto.Value {
+	vm.Set("execd", func(call jsvm.FunctionCall) jsvm.Value {
 		//Check if the pkg is already registered
 		scriptName, err := call.Argument(0).ToString()
 		if err != nil {
 			g.RaiseError(err)
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 
 		//Carry the payload to the forked process if there are any
@@ -252,23 +254,38 @@ func (g *Gateway) injectUserFunctions(vm *otto.Otto, fsh *filesystem.FileSystemH
 		if fsh != nil {
 			if !fsh.FileSystemAbstraction.FileExists(targetScriptPath) {
 				g.RaiseError(errors.New("[AGI] Target path not exists!"))
-				return otto.FalseValue()
+				return jsvm.FalseValue()
 			}
 		} else {
 			if !filesystem.FileExists(targetScriptPath) {
 				g.RaiseError(errors.New("[AGI] Target path not exists!"))
-				return otto.FalseValue()
+				return jsvm.FalseValue()
 			}
 		}
 
 		//Run the script
 		scriptContent, _ := os.ReadFile(targetScriptPath)
 		go func() {
+			//Detached script has no caller to report to. Log the policy violations instead
+			defer func() {
+				if caught := recover(); caught != nil {
+					if violation, ok := caught.(*policy.Violation); ok {
+						log.Println("[AGI] " + violation.Error() + ": " + targetScriptPath)
+						return
+					} else if caught == errExitcall {
+						return
+					}
+					panic(caught)
+				}
+			}()
+
 			//Create a new VM to execute the script (also for isolation)
-			vm := otto.New()
+			vm := g.newVM(scriptPath, scriptScope)
 			//Inject standard libs into the vm
 			g.injectStandardLibs(vm, scriptPath, scriptScope)
 			g.injectUserFunctions(vm, fsh, scriptPath, scriptScope, u, w, r)
+			stopWatchdog := vm.startWatchdog()
+			defer stopWatchdog()
 
 			vm.Set("PARENT_DETACHED", true)
 			vm.Set("PARENT_PAYLOAD", payload)
@@ -280,7 +297,7 @@ func (g *Gateway) injectUserFunctions(vm *otto.Otto, fsh *filesystem.FileSystemH
 			}
 		}()
 
-		return otto.TrueValue()
+		return jsvm.TrueValue()
 	})
 
 }
@@ -7,8 +7,8 @@ import (
 	"time"
 
 	"github.com/gorilla/websocket"
-	"github.com/robertkrimen/otto"
 	uuid "github.com/satori/go.uuid"
+	"imuslab.com/arozos/mod/agi/jsvm"
 	user "imuslab.com/arozos/mod/user"
 )
 
@@ -32,11 +32,11 @@ var connections = sync.Map{}
 
 // This is a very special function to check if the connection has been updated or not
 // Return upgrade status (true for already upgraded) and connection uuid
-func checkWebSocketConnectionUpgradeStatus(vm *otto.Otto) (bool, string, *websocket.Conn) {
+func checkWebSocketConnectionUpgradeStatus(vm jsvm.VM) (bool, string, *websocket.Conn) {
 	if value, err := vm.Get("_websocket_conn_id"); err == nil {
 		//Exists!
 		//Check if this is undefined
-		if value == otto.UndefinedValue() {
+		if value.IsUndefined() {
 			//WebSocket connection has closed
 			return false, "", nil
 		}
@@ -60,9 +60,9 @@ func checkWebSocketConnectionUpgradeStatus(vm *otto.Otto) (bool, string, *websoc
 	return false, "", nil
 }
 
-func (g *Gateway) injectWebSocketFunctions(vm *otto.Otto, u *user.User, w http.ResponseWriter, r *http.Request) {
+func (g *Gateway) injectWebSocketFunctions(vm jsvm.VM, u *user.User, w http.ResponseWriter, r *http.Request) {
 
-	vm.Set("_websocket_upgrade", func(call otto.FunctionCall) otto.Value {
+	vm.Set("_websocket_upgrade", func(call jsvm.FunctionCall) jsvm.Value {
 		//Check if the user specified any timeout time in seconds
 		//Default to 5 minutes
 		timeout, err := call.Argument(0).ToInteger()
@@ -74,14 +74,14 @@ func (g *Gateway) injectWebSocketFunctions(vm *otto.Otto, u *user.User, w http.R
 		connState, _, _ := checkWebSocketConnectionUpgradeStatus(vm)
 		if connState {
 			//Already upgraded
-			return otto.TrueValue()
+			return jsvm.TrueValue()
 		}
 
 		//Not upgraded. Upgrade it now
 		c, err := upgrader.Upgrade(w, r, nil)
 		if err != nil {
 			log.Print("*AGI WebSocket*  WebSocket upgrade failed:", err)
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 
 		//Generate a UUID for this connection
@@ -92,6 +92,9 @@ func (g *Gateway) injectWebSocketFunctions(vm *otto.Otto, u *user.User, w http.R
 		//Record its creation time as opr time
 		vm.Set("_websocket_conn_lastopr", time.Now().Unix())
 
+		//The handler stay alive with the connection, which is closed by the idle timeout instead
+		liftExecutionTimeLimit(vm)
+
 		//Create a go routine to monitor the connection status and disconnect it if timeup
 		if timeout > 0 {
 			go func() {
@@ -113,7 +116,7 @@ func (g *Gateway) injectWebSocketFunctions(vm *otto.Otto, u *user.User, w http.R
 							conn.Close()
 
 							//Clean up the connection in sync map and vm
-							vm.Set("_websocket_conn_id", otto.UndefinedValue())
+							vm.Set("_websocket_conn_id", jsvm.UndefinedValue())
 							connections.Delete(connID)
 
 							log.Println("*AGI WebSocket* Closing connection due to timeout")
@@ -127,15 +130,15 @@ func (g *Gateway) injectWebSocketFunctions(vm *otto.Otto, u *user.User, w http.R
 			}()
 		}
 
-		return otto.TrueValue()
+		return jsvm.TrueValue()
 	})
 
-	vm.Set("_websocket_send", func(call otto.FunctionCall) otto.Value {
+	vm.Set("_websocket_send", func(call jsvm.FunctionCall) jsvm.Value {
 		//Get the content to send
 		content, err := call.Argument(0).ToString()
 		if err != nil {
 			g.RaiseError(err)
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 
 		//Send it
@@ -143,7 +146,7 @@ func (g *Gateway) injectWebSocketFunctions(vm *otto.Otto, u *user.User, w http.R
 		if !connState {
 			//Already upgraded
 			//log.Println("*AGI WebSocket* Connection id not found in VM")
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 
 		err = conn.WriteMessage(1, []byte(content))
@@ -153,9 +156,9 @@ func (g *Gateway) injectWebSocketFunctions(vm *otto.Otto, u *user.User, w http.R
 			conn.Close()
 
 			//Clean up the connection in sync map and vm
-			vm.Set("_websocket_conn_id", otto.UndefinedValue())
+			vm.Set("_websocket_conn_id", jsvm.UndefinedValue())
 			connections.Delete(connID)
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 
 		//Write succeed
@@ -163,10 +166,10 @@ func (g *Gateway) injectWebSocketFunctions(vm *otto.Otto, u *user.User, w http.R
 		//Update last opr time
 		vm.Set("_websocket_conn_lastopr", time.Now().Unix())
 
-		return otto.TrueValue()
+		return jsvm.TrueValue()
 	})
 
-	vm.Set("_websocket_read", func(call otto.FunctionCall) otto.Value {
+	vm.Set("_websocket_read", func(call jsvm.FunctionCall) jsvm.Value {
 		connState, connID, conn := checkWebSocketConnectionUpgradeStatus(vm)
 		if connState == true {
 			_, message, err := conn.ReadMessage()
@@ -175,21 +178,21 @@ func (g *Gateway) injectWebSocketFunctions(vm *otto.Otto, u *user.User, w http.R
 				conn.Close()
 
 				//Clean up the connection in sync map and vm
-				vm.Set("_websocket_conn_id", otto.UndefinedValue())
+				vm.Set("_websocket_conn_id", jsvm.UndefinedValue())
 				connections.Delete(connID)
 
 				log.Println("*AGI WebSocket* Trying to read from a closed socket")
-				return otto.FalseValue()
+				return jsvm.FalseValue()
 			}
 			//Update last opr time
 			vm.Set("_websocket_conn_lastopr", time.Now().Unix())
 
 			//Parse the incoming message
-			incomingString, err := otto.ToValue(string(message))
+			incomingString, err := jsvm.ToValue(string(message))
 			if err != nil {
 				log.Println(err)
 				//Unable to parse to JavaScript. Something out of the scope of otto?
-				return otto.NullValue()
+				return jsvm.NullValue()
 			}
 
 			//Return the incoming string to the AGI script
@@ -197,11 +200,11 @@ func (g *Gateway) injectWebSocketFunctions(vm *otto.Otto, u *user.User, w http.R
 		} else {
 			//WebSocket not exists
 			//log.Println("*AGI WebSocket* Trying to read from a closed socket")
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 	})
 
-	vm.Set("_websocket_close", func(call otto.FunctionCall) otto.Value {
+	vm.Set("_websocket_close", func(call jsvm.FunctionCall) jsvm.Value {
 		connState, connID, conn := checkWebSocketConnectionUpgradeStatus(vm)
 		if connState == true {
 			//Close the Websocket gracefully
@@ -210,14 +213,14 @@ func (g *Gateway) injectWebSocketFunctions(vm *otto.Otto, u *user.User, w http.R
 			conn.Close()
 
 			//Clean up the connection in sync map and vm
-			vm.Set("_websocket_conn_id", otto.UndefinedValue())
+			vm.Set("_websocket_conn_id", jsvm.UndefinedValue())
 			connections.Delete(connID)
 
 			//Return true value
-			return otto.TrueValue()
+			return jsvm.TrueValue()
 		} else {
 			//Connection not opened or closed already
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 
 	})
@@ -10,7 +10,7 @@ import (
 	"strings"
 
 	"github.com/mholt/archiver/v3"
-	"github.com/robertkrimen/otto"
+	"imuslab.com/arozos/mod/agi/jsvm"
 	"imuslab.com/arozos/mod/agi/static"
 	"imuslab.com/arozos/mod/filesystem"
 	"imuslab.com/arozos/mod/filesystem/arozfs"
@@ -37,16 +37,16 @@ func (g *Gateway) injectZipFileLibFunctions(payload *static.AgiLibInjectionPaylo
 	scriptFsh := payload.ScriptFsh
 
 	// extractZipFile(sourceVpath, destVpath) => Extract zip file to destination
-	vm.Set("_ziplib_extractZipFile", func(call otto.FunctionCall) otto.Value {
+	vm.Set("_ziplib_extractZipFile", func(call jsvm.FunctionCall) jsvm.Value {
 		srcVpath, err := call.Argument(0).ToString()
 		if err != nil {
 			g.RaiseError(err)
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 		destVpath, err := call.Argument(1).ToString()
 		if err != nil {
 			g.RaiseError(err)
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 
 		// Rewrite paths if relative
@@ -65,12 +65,12 @@ func (g *Gateway) injectZipFileLibFunctions(payload *static.AgiLibInjectionPaylo
 		_, srcRpath, err := static.VirtualPathToRealPath(srcVpath, u)
 		if err != nil {
 			g.RaiseError(err)
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 		destFsh, destRpath, err := static.VirtualPathToRealPath(destVpath, u)
 		if err != nil {
 			g.RaiseError(err)
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 
 		// Extract using archiver
@@ -78,7 +78,7 @@ func (g *Gateway) injectZipFileLibFunctions(payload *static.AgiLibInjectionPaylo
 		err = z.Unarchive(srcRpath, destRpath)
 		if err != nil {
 			g.RaiseError(err)
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 
 		// Update ownership
@@ -95,16 +95,16 @@ func (g *Gateway) injectZipFileLibFunctions(payload *static.AgiLibInjectionPaylo
 	})
 
 	// createZipFile(sourceVpaths, outputVpath) => Create zip file from array of sources
-	vm.Set("_ziplib_createZipFile", func(call otto.FunctionCall) otto.Value {
+	vm.Set("_ziplib_createZipFile", func(call jsvm.FunctionCall) jsvm.Value {
 		sourcesObj, err := call.Argument(0).Export()
 		if err != nil {
 			g.RaiseError(err)
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 		outputVpath, err := call.Argument(1).ToString()
 		if err != nil {
 			g.RaiseError(err)
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 
 		// Convert sources to string array
@@ -120,7 +120,7 @@ func (g *Gateway) injectZipFileLibFunctions(payload *static.AgiLibInjectionPaylo
 			sources = append(sources, static.RelativeVpathRewrite(scriptFsh, v, vm, u))
 		default:
 			g.RaiseError(errors.New("invalid source format"))
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 
 		outputVpath = static.RelativeVpathRewrite(scriptFsh, outputVpath, vm, u)
@@ -142,7 +142,7 @@ func (g *Gateway) injectZipFileLibFunctions(payload *static.AgiLibInjectionPaylo
 			fsh, rpath, err := static.VirtualPathToRealPath(src, u)
 			if err != nil {
 				g.RaiseError(err)
-				return otto.FalseValue()
+				return jsvm.FalseValue()
 			}
 			sourceFshs = append(sourceFshs, fsh)
 			sourceRpaths = append(sourceRpaths, rpath)
@@ -151,14 +151,14 @@ func (g *Gateway) injectZipFileLibFunctions(payload *static.AgiLibInjectionPaylo
 		outputFsh, outputRpath, err := static.VirtualPathToRealPath(outputVpath, u)
 		if err != nil {
 			g.RaiseError(err)
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 
 		// Create zip file
 		err = filesystem.ArozZipFile(sourceFshs, sourceRpaths, outputFsh, outputRpath, false)
 		if err != nil {
 			g.RaiseError(err)
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 
 		// Set ownership
@@ -169,16 +169,16 @@ func (g *Gateway) injectZipFileLibFunctions(payload *static.AgiLibInjectionPaylo
 	})
 
 	// createTarFile(sourceVpaths, outputVpath) => Create tar file
-	vm.Set("_ziplib_createTarFile", func(call otto.FunctionCall) otto.Value {
+	vm.Set("_ziplib_createTarFile", func(call jsvm.FunctionCall) jsvm.Value {
 		sourcesObj, err := call.Argument(0).Export()
 		if err != nil {
 			g.RaiseError(err)
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 		outputVpath, err := call.Argument(1).ToString()
 		if err != nil {
 			g.RaiseError(err)
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 
 		var sources []string
@@ -209,7 +209,7 @@ func (g *Gateway) injectZipFileLibFunctions(payload *static.AgiLibInjectionPaylo
 			_, rpath, err := static.VirtualPathToRealPath(src, u)
 			if err != nil {
 				g.RaiseError(err)
-				return otto.FalseValue()
+				return jsvm.FalseValue()
 			}
 			sourceRpaths = append(sourceRpaths, rpath)
 		}
@@ -217,14 +217,14 @@ func (g *Gateway) injectZipFileLibFunctions(payload *static.AgiLibInjectionPaylo
 		outputFsh, outputRpath, err := static.VirtualPathToRealPath(outputVpath, u)
 		if err != nil {
 			g.RaiseError(err)
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 
 		tar := archiver.Tar{}
 		err = tar.Archive(sourceRpaths, outputRpath)
 		if err != nil {
 			g.RaiseError(err)
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 
 		u.SetOwnerOfFile(outputFsh, outputVpath)
@@ -234,16 +234,16 @@ func (g *Gateway) injectZipFileLibFunctions(payload *static.AgiLibInjectionPaylo
 	})
 
 	// extractTarFile(sourceVpath, destVpath) => Extract tar file
-	vm.Set("_ziplib_extractTarFile", func(call otto.FunctionCall) otto.Value {
+	vm.Set("_ziplib_extractTarFile", func(call jsvm.FunctionCall) jsvm.Value {
 		srcVpath, err := call.Argument(0).ToString()
 		if err != nil {
 			g.RaiseError(err)
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 		destVpath, err := call.Argument(1).ToString()
 		if err != nil {
 			g.RaiseError(err)
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 
 		srcVpath = static.RelativeVpathRewrite(scriptFsh, srcVpath, vm, u)
@@ -259,19 +259,19 @@ func (g *Gateway) injectZipFileLibFunctions(payload *static.AgiLibInjectionPaylo
 		_, srcRpath, err := static.VirtualPathToRealPath(srcVpath, u)
 		if err != nil {
 			g.RaiseError(err)
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 		destFsh, destRpath, err := static.VirtualPathToRealPath(destVpath, u)
 		if err != nil {
 			g.RaiseError(err)
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 
 		tar := archiver.Tar{}
 		err = tar.Unarchive(srcRpath, destRpath)
 		if err != nil {
 			g.RaiseError(err)
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 
 		// Update ownership
@@ -288,16 +288,16 @@ func (g *Gateway) injectZipFileLibFunctions(payload *static.AgiLibInjectionPaylo
 	})
 
 	// createTarGzFile(sourceVpaths, outputVpath) => Create tar.gz file
-	vm.Set("_ziplib_createTarGzFile", func(call otto.FunctionCall) otto.Value {
+	vm.Set("_ziplib_createTarGzFile", func(call jsvm.FunctionCall) jsvm.Value {
 		sourcesObj, err := call.Argument(0).Export()
 		if err != nil {
 			g.RaiseError(err)
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 		outputVpath, err := call.Argument(1).ToString()
 		if err != nil {
 			g.RaiseError(err)
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 
 		var sources []string
@@ -328,7 +328,7 @@ func (g *Gateway) injectZipFileLibFunctions(payload *static.AgiLibInjectionPaylo
 			_, rpath, err := static.VirtualPathToRealPath(src, u)
 			if err != nil {
 				g.RaiseError(err)
-				return otto.FalseValue()
+				return jsvm.FalseValue()
 			}
 			sourceRpaths = append(sourceRpaths, rpath)
 		}
@@ -336,14 +336,14 @@ func (g *Gateway) injectZipFileLibFunctions(payload *static.AgiLibInjectionPaylo
 		outputFsh, outputRpath, err := static.VirtualPathToRealPath(outputVpath, u)
 		if err != nil {
 			g.RaiseError(err)
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 
 		tgz := archiver.TarGz{}
 		err = tgz.Archive(sourceRpaths, outputRpath)
 		if err != nil {
 			g.RaiseError(err)
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 
 		u.SetOwnerOfFile(outputFsh, outputVpath)
@@ -353,16 +353,16 @@ func (g *Gateway) injectZipFileLibFunctions(payload *static.AgiLibInjectionPaylo
 	})
 
 	// extractTarGzFile(sourceVpath, destVpath) => Extract tar.gz file
-	vm.Set("_ziplib_extractTarGzFile", func(call otto.FunctionCall) otto.Value {
+	vm.Set("_ziplib_extractTarGzFile", func(call jsvm.FunctionCall) jsvm.Value {
 		srcVpath, err := call.Argument(0).ToString()
 		if err != nil {
 			g.RaiseError(err)
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 		destVpath, err := call.Argument(1).ToString()
 		if err != nil {
 			g.RaiseError(err)
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 
 		srcVpath = static.RelativeVpathRewrite(scriptFsh, srcVpath, vm, u)
@@ -378,19 +378,19 @@ func (g *Gateway) injectZipFileLibFunctions(payload *static.AgiLibInjectionPaylo
 		_, srcRpath, err := static.VirtualPathToRealPath(srcVpath, u)
 		if err != nil {
 			g.RaiseError(err)
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 		destFsh, destRpath, err := static.VirtualPathToRealPath(destVpath, u)
 		if err != nil {
 			g.RaiseError(err)
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 
 		tgz := archiver.TarGz{}
 		err = tgz.Unarchive(srcRpath, destRpath)
 		if err != nil {
 			g.RaiseError(err)
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 
 		// Update ownership
@@ -407,16 +407,16 @@ func (g *Gateway) injectZipFileLibFunctions(payload *static.AgiLibInjectionPaylo
 	})
 
 	// createGzFile(sourceVpath, outputVpath) => Create gz file (single file compression)
-	vm.Set("_ziplib_createGzFile", func(call otto.FunctionCall) otto.Value {
+	vm.Set("_ziplib_createGzFile", func(call jsvm.FunctionCall) jsvm.Value {
 		srcVpath, err := call.Argument(0).ToString()
 		if err != nil {
 			g.RaiseError(err)
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 		outputVpath, err := call.Argument(1).ToString()
 		if err != nil {
 			g.RaiseError(err)
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 
 		srcVpath = static.RelativeVpathRewrite(scriptFsh, srcVpath, vm, u)
@@ -432,26 +432,26 @@ func (g *Gateway) injectZipFileLibFunctions(payload *static.AgiLibInjectionPaylo
 		srcFsh, srcRpath, err := static.VirtualPathToRealPath(srcVpath, u)
 		if err != nil {
 			g.RaiseError(err)
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 		outputFsh, outputRpath, err := static.VirtualPathToRealPath(outputVpath, u)
 		if err != nil {
 			g.RaiseError(err)
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 
 		// Compress using Gz - open source file and create output file
 		srcFile, err := srcFsh.FileSystemAbstraction.ReadStream(srcRpath)
 		if err != nil {
 			g.RaiseError(err)
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 		defer srcFile.Close()
 
 		outFile, err := outputFsh.FileSystemAbstraction.Create(outputRpath)
 		if err != nil {
 			g.RaiseError(err)
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 		defer outFile.Close()
 
@@ -459,7 +459,7 @@ func (g *Gateway) injectZipFileLibFunctions(payload *static.AgiLibInjectionPaylo
 		err = gz.Compress(srcFile, outFile)
 		if err != nil {
 			g.RaiseError(err)
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 
 		u.SetOwnerOfFile(outputFsh, outputVpath)
@@ -469,16 +469,16 @@ func (g *Gateway) injectZipFileLibFunctions(payload *static.AgiLibInjectionPaylo
 	})
 
 	// extractGzFile(sourceVpath, destVpath) => Extract gz file
-	vm.Set("_ziplib_extractGzFile", func(call otto.FunctionCall) otto.Value {
+	vm.Set("_ziplib_extractGzFile", func(call jsvm.FunctionCall) jsvm.Value {
 		srcVpath, err := call.Argument(0).ToString()
 		if err != nil {
 			g.RaiseError(err)
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 		destVpath, err := call.Argument(1).ToString()
 		if err != nil {
 			g.RaiseError(err)
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 
 		srcVpath = static.RelativeVpathRewrite(scriptFsh, srcVpath, vm, u)
@@ -494,26 +494,26 @@ func (g *Gateway) injectZipFileLibFunctions(payload *static.AgiLibInjectionPaylo
 		srcFsh, srcRpath, err := static.VirtualPathToRealPath(srcVpath, u)
 		if err != nil {
 			g.RaiseError(err)
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 		destFsh, destRpath, err := static.VirtualPathToRealPath(destVpath, u)
 		if err != nil {
 			g.RaiseError(err)
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 
 		// Decompress using Gz - open source file and create output file
 		srcFile, err := srcFsh.FileSystemAbstraction.ReadStream(srcRpath)
 		if err != nil {
 			g.RaiseError(err)
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 		defer srcFile.Close()
 
 		outFile, err := destFsh.FileSystemAbstraction.Create(destRpath)
 		if err != nil {
 			g.RaiseError(err)
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 		defer outFile.Close()
 
@@ -521,7 +521,7 @@ func (g *Gateway) injectZipFileLibFunctions(payload *static.AgiLibInjectionPaylo
 		err = gz.Decompress(srcFile, outFile)
 		if err != nil {
 			g.RaiseError(err)
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 
 		u.SetOwnerOfFile(destFsh, destVpath)
@@ -531,11 +531,11 @@ func (g *Gateway) injectZipFileLibFunctions(payload *static.AgiLibInjectionPaylo
 	})
 
 	// isValidZipFile(vpath) => Check if file is a valid archive (zip, tar, tar.gz, gz, etc.)
-	vm.Set("_ziplib_isValidZipFile", func(call otto.FunctionCall) otto.Value {
+	vm.Set("_ziplib_isValidZipFile", func(call jsvm.FunctionCall) jsvm.Value {
 		vpath, err := call.Argument(0).ToString()
 		if err != nil {
 			g.RaiseError(err)
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 
 		vpath = static.RelativeVpathRewrite(scriptFsh, vpath, vm, u)
@@ -547,7 +547,7 @@ func (g *Gateway) injectZipFileLibFunctions(payload *static.AgiLibInjectionPaylo
 		_, rpath, err := static.VirtualPathToRealPath(vpath, u)
 		if err != nil {
 			g.RaiseError(err)
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 
 		// Try to detect format using archiver library
@@ -572,11 +572,11 @@ func (g *Gateway) injectZipFileLibFunctions(payload *static.AgiLibInjectionPaylo
 	})
 
 	// listZipFileContents(vpath) => List contents of zip in json tree structure
-	vm.Set("_ziplib_listZipFileContents", func(call otto.FunctionCall) otto.Value {
+	vm.Set("_ziplib_listZipFileContents", func(call jsvm.FunctionCall) jsvm.Value {
 		vpath, err := call.Argument(0).ToString()
 		if err != nil {
 			g.RaiseError(err)
-			return otto.NullValue()
+			return jsvm.NullValue()
 		}
 
 		vpath = static.RelativeVpathRewrite(scriptFsh, vpath, vm, u)
@@ -588,13 +588,13 @@ func (g *Gateway) injectZipFileLibFunctions(payload *static.AgiLibInjectionPaylo
 		_, rpath, err := static.VirtualPathToRealPath(vpath, u)
 		if err != nil {
 			g.RaiseError(err)
-			return otto.NullValue()
+			return jsvm.NullValue()
 		}
 
 		r, err := zip.OpenReader(rpath)
 		if err != nil {
 			g.RaiseError(err)
-			return otto.NullValue()
+			return jsvm.NullValue()
 		}
 		defer r.Close()
 
@@ -642,7 +642,7 @@ func (g *Gateway) injectZipFileLibFunctions(payload *static.AgiLibInjectionPaylo
 		jsonData, err := json.Marshal(root)
 		if err != nil {
 			g.RaiseError(err)
-			return otto.NullValue()
+			return jsvm.NullValue()
 		}
 
 		reply, _ := vm.ToValue(string(jsonData))
@@ -650,11 +650,11 @@ func (g *Gateway) injectZipFileLibFunctions(payload *static.AgiLibInjectionPaylo
 	})
 
 	// listZipFileDir(zipVpath, dirPath) => List contents of specific directory in zip
-	vm.Set("_ziplib_listZipFileDir", func(call otto.FunctionCall) otto.Value {
+	vm.Set("_ziplib_listZipFileDir", func(call jsvm.FunctionCall) jsvm.Value {
 		zipVpath, err := call.Argument(0).ToString()
 		if err != nil {
 			g.RaiseError(err)
-			return otto.NullValue()
+			return jsvm.NullValue()
 		}
 		dirPath, err := call.Argument(1).ToString()
 		if err != nil {
@@ -671,14 +671,14 @@ func (g *Gateway) injectZipFileLibFunctions(payload *static.AgiLibInjectionPaylo
 		_, zipRpath, err := static.VirtualPathToRealPath(zipVpath, u)
 		if err != nil {
 			g.RaiseError(err)
-			return otto.NullValue()
+			return jsvm.NullValue()
 		}
 
 		// Open zip file
 		r, err := zip.OpenReader(zipRpath)
 		if err != nil {
 			g.RaiseError(err)
-			return otto.NullValue()
+			return jsvm.NullValue()
 		}
 		defer r.Close()
 
@@ -739,7 +739,7 @@ func (g *Gateway) injectZipFileLibFunctions(payload *static.AgiLibInjectionPaylo
 		// If directory path was specified but doesn't exist, return error
 		if dirPath != "" && !dirExists {
 			g.RaiseError(errors.New("Directory not found in zip: " + dirPath))
-			return otto.NullValue()
+			return jsvm.NullValue()
 		}
 
 		reply, _ := vm.ToValue(filelist)
@@ -747,16 +747,16 @@ func (g *Gateway) injectZipFileLibFunctions(payload *static.AgiLibInjectionPaylo
 	})
 
 	// getFileFromZip(zipVpath, filePathInZip) => Extract specific file from zip to tmp:/
-	vm.Set("_ziplib_getFileFromZip", func(call otto.FunctionCall) otto.Value {
+	vm.Set("_ziplib_getFileFromZip", func(call jsvm.FunctionCall) jsvm.Value {
 		zipVpath, err := call.Argument(0).ToString()
 		if err != nil {
 			g.RaiseError(err)
-			return otto.NullValue()
+			return jsvm.NullValue()
 		}
 		fileInZip, err := call.Argument(1).ToString()
 		if err != nil {
 			g.RaiseError(err)
-			return otto.NullValue()
+			return jsvm.NullValue()
 		}
 
 		zipVpath = static.RelativeVpathRewrite(scriptFsh, zipVpath, vm, u)
@@ -768,14 +768,14 @@ func (g *Gateway) injectZipFileLibFunctions(payload *static.AgiLibInjectionPaylo
 		_, zipRpath, err := static.VirtualPathToRealPath(zipVpath, u)
 		if err != nil {
 			g.RaiseError(err)
-			return otto.NullValue()
+			return jsvm.NullValue()
 		}
 
 		// Open zip file
 		r, err := zip.OpenReader(zipRpath)
 		if err != nil {
 			g.RaiseError(err)
-			return otto.NullValue()
+			return jsvm.NullValue()
 		}
 		defer r.Close()
 
@@ -790,14 +790,14 @@ func (g *Gateway) injectZipFileLibFunctions(payload *static.AgiLibInjectionPaylo
 
 		if targetFile == nil {
 			g.RaiseError(errors.New("File not found in zip: " + fileInZip))
-			return otto.NullValue()
+			return jsvm.NullValue()
 		}
 
 		// Extract to tmp
 		tmpFsh, err := u.GetFileSystemHandlerFromVirtualPath("tmp:/")
 		if err != nil {
 			g.RaiseError(err)
-			return otto.NullValue()
+			return jsvm.NullValue()
 		}
 
 		tmpFilename := arozfs.Base(fileInZip)
@@ -807,14 +807,14 @@ func (g *Gateway) injectZipFileLibFunctions(payload *static.AgiLibInjectionPaylo
 		rc, err := targetFile.Open()
 		if err != nil {
 			g.RaiseError(err)
-			return otto.NullValue()
+			return jsvm.NullValue()
 		}
 		defer rc.Close()
 
 		err = tmpFsh.FileSystemAbstraction.WriteStream(tmpRpath, rc, 0755)
 		if err != nil {
 			g.RaiseError(err)
-			return otto.NullValue()
+			return jsvm.NullValue()
 		}
 
 		u.SetOwnerOfFile(tmpFsh, tmpVpath)
@@ -824,11 +824,11 @@ func (g *Gateway) injectZipFileLibFunctions(payload *static.AgiLibInjectionPaylo
 	})
 
 	// getCompressFileType(vpath) => Detect compression type
-	vm.Set("_ziplib_getCompressFileType", func(call otto.FunctionCall) otto.Value {
+	vm.Set("_ziplib_getCompressFileType", func(call jsvm.FunctionCall) jsvm.Value {
 		vpath, err := call.Argument(0).ToString()
 		if err != nil {
 			g.RaiseError(err)
-			return otto.NullValue()
+			return jsvm.NullValue()
 		}
 
 		vpath = static.RelativeVpathRewrite(scriptFsh, vpath, vm, u)
@@ -840,7 +840,7 @@ func (g *Gateway) injectZipFileLibFunctions(payload *static.AgiLibInjectionPaylo
 		_, rpath, err := static.VirtualPathToRealPath(vpath, u)
 		if err != nil {
 			g.RaiseError(err)
-			return otto.NullValue()
+			return jsvm.NullValue()
 		}
 
 		// Check file extension and magic bytes
@@ -887,16 +887,16 @@ func (g *Gateway) injectZipFileLibFunctions(payload *static.AgiLibInjectionPaylo
 	})
 
 	// extractAnyFile(sourceVpath, destVpath) => Extract based on file type detection
-	vm.Set("_ziplib_extractAnyFile", func(call otto.FunctionCall) otto.Value {
+	vm.Set("_ziplib_extractAnyFile", func(call jsvm.FunctionCall) jsvm.Value {
 		srcVpath, err := call.Argument(0).ToString()
 		if err != nil {
 			g.RaiseError(err)
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 		destVpath, err := call.Argument(1).ToString()
 		if err != nil {
 			g.RaiseError(err)
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 
 		srcVpath = static.RelativeVpathRewrite(scriptFsh, srcVpath, vm, u)
@@ -912,12 +912,12 @@ func (g *Gateway) injectZipFileLibFunctions(payload *static.AgiLibInjectionPaylo
 		_, srcRpath, err := static.VirtualPathToRealPath(srcVpath, u)
 		if err != nil {
 			g.RaiseError(err)
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 		destFsh, destRpath, err := static.VirtualPathToRealPath(destVpath, u)
 		if err != nil {
 			g.RaiseError(err)
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 
 		// Detect format
@@ -927,13 +927,13 @@ func (g *Gateway) injectZipFileLibFunctions(payload *static.AgiLibInjectionPaylo
 			f, err := os.Open(srcRpath)
 			if err != nil {
 				g.RaiseError(err)
-				return otto.FalseValue()
+				return jsvm.FalseValue()
 			}
 			format, err = archiver.ByHeader(f)
 			f.Close()
 			if err != nil {
 				g.RaiseError(err)
-				return otto.FalseValue()
+				return jsvm.FalseValue()
 			}
 		}
 
@@ -942,11 +942,11 @@ func (g *Gateway) injectZipFileLibFunctions(payload *static.AgiLibInjectionPaylo
 			err = u.Unarchive(srcRpath, destRpath)
 			if err != nil {
 				g.RaiseError(err)
-				return otto.FalseValue()
+				return jsvm.FalseValue()
 			}
 		} else {
 			g.RaiseError(errors.New("format does not support extraction"))
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 
 		// Update ownership
@@ -963,16 +963,16 @@ func (g *Gateway) injectZipFileLibFunctions(payload *static.AgiLibInjectionPaylo
 	})
 
 	// createAnyZipFile(sourceVpaths, outputVpath, format) => Create archive based on format
-	vm.Set("_ziplib_createAnyZipFile", func(call otto.FunctionCall) otto.Value {
+	vm.Set("_ziplib_createAnyZipFile", func(call jsvm.FunctionCall) jsvm.Value {
 		sourcesObj, err := call.Argument(0).Export()
 		if err != nil {
 			g.RaiseError(err)
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 		outputVpath, err := call.Argument(1).ToString()
 		if err != nil {
 			g.RaiseError(err)
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 		format, err := call.Argument(2).ToString()
 		if err != nil {
@@ -1008,7 +1008,7 @@ func (g *Gateway) injectZipFileLibFunctions(payload *static.AgiLibInjectionPaylo
 			_, rpath, err := static.VirtualPathToRealPath(src, u)
 			if err != nil {
 				g.RaiseError(err)
-				return otto.FalseValue()
+				return jsvm.FalseValue()
 			}
 			sourceRpaths = append(sourceRpaths, rpath)
 		}
@@ -1016,7 +1016,7 @@ func (g *Gateway) injectZipFileLibFunctions(payload *static.AgiLibInjectionPaylo
 		outputFsh, outputRpath, err := static.VirtualPathToRealPath(outputVpath, u)
 		if err != nil {
 			g.RaiseError(err)
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 
 		// Create archive based on format
@@ -1032,14 +1032,14 @@ func (g *Gateway) injectZipFileLibFunctions(payload *static.AgiLibInjectionPaylo
 			err = tgz.Archive(sourceRpaths, outputRpath)
 		case "gz", "gzip":
 			g.RaiseError(errors.New("gz format requires createGzFile for single file compression"))
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		default:
 			g.RaiseError(errors.New("unsupported format: " + format))
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 		if err != nil {
 			g.RaiseError(err)
-			return otto.FalseValue()
+			return jsvm.FalseValue()
 		}
 
 		u.SetOwnerOfFile(outputFsh, outputVpath)
@@ -0,0 +1,380 @@
+package agi
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"imuslab.com/arozos/mod/agi/jsvm"
+	"imuslab.com/arozos/mod/agi/policy"
+	"imuslab.com/arozos/mod/auth"
+	db "imuslab.com/arozos/mod/database"
+	"imuslab.com/arozos/mod/filesystem"
+	"imuslab.com/arozos/mod/permission"
+	"imuslab.com/arozos/mod/share/shareEntry"
+	"imuslab.com/arozos/mod/storage"
+	"imuslab.com/arozos/mod/time/nightly"
+	user "imuslab.com/arozos/mod/user"
+)
+
+/*
+	AGI Engine Conformance Test
+
+	Run the AGI unit test scripts from the UnitTest WebApp on all
+	supported engines and check if they give the same results
+*/
+
+// Scripts that do not require network, IoT devices or external packages
+var conformanceScripts = []string{
+	"hello world.js",
+	"dbtest.js",
+	"dblist.js",
+	"dbExists.js",
+	"dbNotExists.js",
+	"dbattack_test.js",
+	"error.js",
+	"includes.js",
+	"getLoadedModules.js",
+	"getStorageDevices.js",
+	"modulelist.js",
+	"permission.js",
+	"vpath_test.js",
+	"filelib.mkdir.js",
+	"filelib.file.js",
+	"filelib.fileExists.js",
+	"filelib.readDir.js",
+	"filelib.glob.js",
+	"filelib.aglob.js",
+	"filelib.filesize.js",
+	"filelib.md5.js",
+	"filelib.walk.js",
+	"filelib.delete.js",
+	"appdata.readFile.js",
+	"appdata.listDir.js",
+}
+
+type testEnv struct {
+	gateway    *Gateway
+	user       *user.User
+	webRoot    string
+	storageDir string
+}
+
+func setupTestEnv(t *testing.T) *testEnv {
+	unitTestRoot, err := filepath.Abs("../../web")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//Auth agent create its log database in the working directory
+	tmpDir := t.TempDir()
+	t.Chdir(tmpDir)
+	webRoot = unitTestRoot
+
+	sysdb, err := db.NewDatabase(filepath.Join(tmpDir, "test.db"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		sysdb.Close()
+	})
+
+	authAgent := auth.NewAuthenticationAgent("test", []byte("0123456789abcdef"), sysdb, false, func(w http.ResponseWriter, r *http.Request) {})
+	t.Cleanup(func() {
+		authAgent.Close()
+	})
+
+	permissionHandler, err := permission.NewPermissionHandler(sysdb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	permissionHandler.NewPermissionGroup("administrator", true, -1, []string{}, "Desktop")
+
+	storageDir := filepath.Join(tmpDir, "files")
+	os.MkdirAll(storageDir, 0755)
+	fsh, err := filesystem.NewFileSystemHandler(filesystem.FileSystemOption{
+		Name:      "User",
+		Uuid:      "user",
+		Path:      storageDir,
+		Hierarchy: "user",
+		Access:    "readwrite",
+	}, filesystem.RuntimePersistenceConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool, err := storage.NewStoragePool([]*filesystem.FileSystemHandler{fsh}, "system")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	shareEntryTable := shareEntry.NewShareEntryTable(sysdb)
+	userHandler, err := user.NewUserHandler(sysdb, authAgent, permissionHandler, pool, &shareEntryTable)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := authAgent.CreateUserAccount("tester", "password", []string{"administrator"}); err != nil {
+		t.Fatal(err)
+	}
+	testUser, err := userHandler.GetUserInfoFromUsername("tester")
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.MkdirAll(filepath.Join(storageDir, "users", "tester", "Desktop"), 0755)
+
+	gateway, err := NewGateway(AgiSysInfo{
+		BuildVersion:         "test",
+		InternalVersion:      "0",
+		LoadedModule:         []string{"UnitTest"},
+		UserHandler:          userHandler,
+		ReservedTables:       []string{"auth", "permisson", "register", "desktop"},
+		ModuleRegisterParser: func(string) error { return nil },
+		NightlyManager:       nightly.NewNightlyTaskManager(3),
+		StartupRoot:          filepath.Join(tmpDir, "startup"),
+		ActivateScope:        []string{unitTestRoot},
+		TempFolderPath:       filepath.Join(tmpDir, "tmp"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &testEnv{
+		gateway:    gateway,
+		user:       testUser,
+		webRoot:    unitTestRoot,
+		storageDir: storageDir,
+	}
+}
+
+// Execute the script with the given engine and return the response
+func (e *testEnv) runScript(t *testing.T, engine string, scriptFile string, scriptScope string) *httptest.ResponseRecorder {
+	scriptContent, err := os.ReadFile(scriptFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e.gateway.Option.DefaultEngine = engine
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "/system/ajgi/interface", nil)
+	e.gateway.ExecuteAGIScript(string(scriptContent), nil, scriptFile, scriptScope, w, r, e.user)
+	return w
+}
+
+func TestEngineConformance(t *testing.T) {
+	env := setupTestEnv(t)
+	backendRoot := filepath.Join(env.webRoot, "UnitTest", "backend")
+
+	for _, script := range conformanceScripts {
+		t.Run(script, func(t *testing.T) {
+			scriptFile := filepath.ToSlash(filepath.Join(backendRoot, script))
+			results := map[string]*httptest.ResponseRecorder{}
+			for _, engine := range jsvm.ListEngines() {
+				results[engine] = env.runScript(t, engine, scriptFile, env.webRoot)
+			}
+
+			expected := results[jsvm.EngineOtto]
+			for engine, result := range results {
+				if result.Code != expected.Code {
+					t.Errorf("%s: expected status %d, got %d", engine, expected.Code, result.Code)
+				}
+				if result.Header().Get("Content-Type") != expected.Header().Get("Content-Type") {
+					t.Errorf("%s: expected content type %q, got %q", engine, expected.Header().Get("Content-Type"), result.Header().Get("Content-Type"))
+				}
+				if !sameResponseBody(expected, result) {
+					t.Errorf("%s: expected response %q, got %q", engine, expected.Body.String(), result.Body.String())
+				}
+			}
+		})
+	}
+}
+
+// Compare the response body. JSON are compared by value as engines order object keys differently
+func sameResponseBody(a *httptest.ResponseRecorder, b *httptest.ResponseRecorder) bool {
+	if a.Body.String() == b.Body.String() {
+		return true
+	}
+	if a.Header().Get("Content-Type") != "application/json" {
+		return false
+	}
+	var aObj, bObj interface{}
+	if json.Unmarshal(a.Body.Bytes(), &aObj) != nil || json.Unmarshal(b.Body.Bytes(), &bObj) != nil {
+		return false
+	}
+	return reflect.DeepEqual(aObj, bObj)
+}
+
+func TestEngineExit(t *testing.T) {
+	env := setupTestEnv(t)
+	scriptFile := filepath.Join(t.TempDir(), "exit.js")
+	os.WriteFile(scriptFile, []byte(`sendResp("before exit"); exit(); sendResp("after exit");`), 0644)
+
+	for _, engine := range jsvm.ListEngines() {
+		w := env.runScript(t, engine, scriptFile, "")
+		if w.Body.String() != "before exit" {
+			t.Errorf("%s: expected script to stop on exit(), got %q", engine, w.Body.String())
+		}
+	}
+}
+
+func TestModuleEngineSelection(t *testing.T) {
+	env := setupTestEnv(t)
+
+	//Create a module that use ES2020 syntax and JSON modules
+	scope := filepath.ToSlash(t.TempDir())
+	moduleRoot := filepath.Join(scope, "Modern")
+	os.MkdirAll(filepath.Join(moduleRoot, "backend"), 0755)
+	os.WriteFile(filepath.Join(moduleRoot, "init.agi"), []byte(`registerModule(JSON.stringify({Name: "Modern", AGIEngine: "goja"}));`), 0644)
+	os.WriteFile(filepath.Join(moduleRoot, "config.json"), []byte(`{"greeting": "Hello"}`), 0644)
+	os.WriteFile(filepath.Join(moduleRoot, "backend", "util.js"), []byte(`module.exports = { join: (...parts) => parts.join(" ") };`), 0644)
+	scriptFile := filepath.ToSlash(filepath.Join(moduleRoot, "backend", "modern.js"))
+	os.WriteFile(scriptFile, []byte(`
+		const config = require("../config.json");
+		const { join } = require("./util");
+		class Greeter {
+			constructor(name) { this.name = name; }
+			greet() { return join(config.greeting, this.name); }
+		}
+		let result = new Greeter("World").greet();
+		Promise.resolve(result).then((msg) => sendResp(`+"`${msg}!`"+`));
+	`), 0644)
+
+	//Module without engine setting run on the default engine and do not support ES2020
+	w := env.runScript(t, jsvm.EngineOtto, scriptFile, scope)
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("Expected ES2020 script to fail on otto, got %q", w.Body.String())
+	}
+
+	//Register the module, which select goja for the module scripts
+	initScript, _ := os.ReadFile(filepath.Join(moduleRoot, "init.agi"))
+	vm := env.gateway.newVM("", "")
+	env.gateway.injectStandardLibs(vm, filepath.ToSlash(filepath.Join(moduleRoot, "init.agi")), scope)
+	if _, err := vm.Run(string(initScript)); err != nil {
+		t.Fatal(err)
+	}
+	if engine := env.gateway.GetScriptEngine(scriptFile, scope); engine != jsvm.EngineGoja {
+		t.Fatalf("Expected module engine goja, got %s", engine)
+	}
+
+	w = env.runScript(t, jsvm.EngineOtto, scriptFile, scope)
+	if strings.TrimSpace(w.Body.String()) != "Hello World!" {
+		t.Errorf("Expected Hello World!, got %q", w.Body.String())
+	}
+}
+
+func TestPolicyViolation(t *testing.T) {
+	env := setupTestEnv(t)
+
+	//Render only the error message from the error template
+	os.MkdirAll("system/agi", 0755)
+	os.WriteFile("system/agi/error.html", []byte(`{{.error_msg}}`), 0644)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("internal service"))
+	}))
+	defer server.Close()
+
+	scope := filepath.ToSlash(t.TempDir())
+	moduleRoot := filepath.Join(scope, "Limited")
+	os.MkdirAll(moduleRoot, 0755)
+
+	//Private network access cannot be caught by the script
+	ssrfScript := filepath.ToSlash(filepath.Join(moduleRoot, "ssrf.js"))
+	os.WriteFile(ssrfScript, []byte(`
+		requirelib("http");
+		try {
+			sendResp(http.get("`+server.URL+`"));
+		} catch (e) {
+			sendResp("caught");
+		}
+	`), 0644)
+
+	loopScript := filepath.ToSlash(filepath.Join(moduleRoot, "loop.js"))
+	os.WriteFile(loopScript, []byte(`sendResp("started"); while(true){}`), 0644)
+
+	for _, engine := range jsvm.ListEngines() {
+		w := env.runScript(t, engine, ssrfScript, scope)
+		if !strings.Contains(w.Body.String(), "AGI policy violation (network)") {
+			t.Errorf("%s: expected network policy violation, got %q", engine, w.Body.String())
+		}
+	}
+
+	//Module cannot grant itself access to the loopback address
+	declaredPolicy, _ := policy.ParseModulePolicy([]byte(`{"AllowedHosts": ["127.0.0.1/32"], "AllowPrivateNetwork": true}`))
+	env.gateway.setModulePolicy("Limited", declaredPolicy)
+	for _, engine := range jsvm.ListEngines() {
+		w := env.runScript(t, engine, ssrfScript, scope)
+		if !strings.Contains(w.Body.String(), "AGI policy violation (network)") {
+			t.Errorf("%s: expected module declared policy to be denied, got %q", engine, w.Body.String())
+		}
+	}
+
+	//Admin override of other fields does not grant the hosts listed by the module
+	env.gateway.Option.UserHandler.GetDatabase().Write(policyTable, "Limited", `{"RequestTimeout": 10}`)
+	for _, engine := range jsvm.ListEngines() {
+		w := env.runScript(t, engine, ssrfScript, scope)
+		if !strings.Contains(w.Body.String(), "AGI policy violation (network)") {
+			t.Errorf("%s: expected module listed host to stay denied, got %q", engine, w.Body.String())
+		}
+	}
+
+	//Admin override allowing the loopback address and limiting execution time
+	env.gateway.Option.UserHandler.GetDatabase().Write(policyTable, "Limited", `{"AllowedHosts": ["127.0.0.1/32"], "MaxExecutionTime": 1}`)
+	for _, engine := range jsvm.ListEngines() {
+		w := env.runScript(t, engine, ssrfScript, scope)
+		if w.Body.String() != "internal service" {
+			t.Errorf("%s: expected allowed host to be reachable, got %q", engine, w.Body.String())
+		}
+
+		w = env.runScript(t, engine, loopScript, scope)
+		if !strings.Contains(w.Body.String(), "AGI policy violation (execution time)") {
+			t.Errorf("%s: expected execution time violation, got %q", engine, w.Body.String())
+		}
+	}
+}
+
+func TestScriptVMLimits(t *testing.T) {
+	runWithPolicy := func(engine string, scriptPolicy *policy.Policy, script string) (violation *policy.Violation) {
+		vm, _ := jsvm.New(engine)
+		sv := newScriptVM(vm, scriptPolicy)
+		sv.Set("loadData", func(call jsvm.FunctionCall) jsvm.Value {
+			value, _ := sv.ToValue(strings.Repeat("a", 600<<10))
+			return value
+		})
+		sv.Set("upgrade", func(call jsvm.FunctionCall) jsvm.Value {
+			liftExecutionTimeLimit(sv)
+			return jsvm.TrueValue()
+		})
+		defer func() {
+			if caught := recover(); caught != nil {
+				violation = caught.(*policy.Violation)
+			}
+		}()
+		stopWatchdog := sv.startWatchdog()
+		defer stopWatchdog()
+		sv.Run(script)
+		return nil
+	}
+
+	for _, engine := range jsvm.ListEngines() {
+		//Data loaded by native functions is charged to the memory budget
+		limited := policy.DefaultPolicy()
+		limited.MaxMemory = 1
+		if violation := runWithPolicy(engine, limited, `loadData(); loadData(); loadData();`); violation == nil || violation.Rule != "memory" {
+			t.Errorf("%s: expected memory violation, got %v", engine, violation)
+		}
+		if violation := runWithPolicy(engine, limited, `loadData();`); violation != nil {
+			t.Errorf("%s: unexpected violation %v", engine, violation)
+		}
+
+		//Long lived handlers can lift the execution time limit
+		limited.MaxExecutionTime = 1
+		if violation := runWithPolicy(engine, limited, `upgrade(); var s = Date.now(); while (Date.now() - s < 1500) {}`); violation != nil {
+			t.Errorf("%s: unexpected violation after lifting the time limit %v", engine, violation)
+		}
+	}
+}
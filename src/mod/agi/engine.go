@@ -0,0 +1,57 @@
+package agi
+
+import (
+	"log"
+	"path/filepath"
+
+	"imuslab.com/arozos/mod/agi/jsvm"
+	"imuslab.com/arozos/mod/agi/static"
+)
+
+/*
+	AGI Engine Selection
+
+	WebApp modules can choose the JavaScript engine that run their
+	scripts by setting "AGIEngine" in the module registration, e.g.
+
+	registerModule(JSON.stringify({Name: "Demo", AGIEngine: "goja", ...}));
+
+	Scripts from modules that do not specify one, init.agi scripts and
+	scripts from user file systems run on the system default engine
+*/
+
+// Get the module root that the engine setting is stored under
+func getModuleEngineKey(scriptFile string, scriptScope string) string {
+	moduleRoot := filepath.Join(scriptScope, static.GetScriptRoot(scriptFile, scriptScope))
+	moduleRootAbs, err := filepath.Abs(moduleRoot)
+	if err != nil {
+		return filepath.ToSlash(moduleRoot)
+	}
+	return filepath.ToSlash(moduleRootAbs)
+}
+
+// Set the engine used by scripts of the module
+func (g *Gateway) setModuleEngine(scriptFile string, scriptScope string, engine string) {
+	g.moduleEngines.Store(getModuleEngineKey(scriptFile, scriptScope), engine)
+}
+
+// Get the engine name for running the given script
+func (g *Gateway) GetScriptEngine(scriptFile string, scriptScope string) string {
+	if scriptFile != "" && scriptScope != "" {
+		if engine, ok := g.moduleEngines.Load(getModuleEngineKey(scriptFile, scriptScope)); ok {
+			return engine.(string)
+		}
+	}
+	return g.Option.DefaultEngine
+}
+
+// Create a new VM for running the given script
+func (g *Gateway) newVM(scriptFile string, scriptScope string) *scriptVM {
+	engine := g.GetScriptEngine(scriptFile, scriptScope)
+	vm, err := jsvm.New(engine)
+	if err != nil {
+		log.Println("[AGI] Unable to create " + engine + " VM: " + err.Error() + ". Using " + jsvm.DefaultEngine + " instead.")
+		vm, _ = jsvm.New(jsvm.DefaultEngine)
+	}
+	return newScriptVM(vm, g.GetScriptPolicy(scriptFile, scriptScope))
+}
@@ -0,0 +1,235 @@
+package jsvm
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync/atomic"
+
+	"github.com/dop251/goja"
+)
+
+/*
+	goja engine adapter
+
+	goja does not provide the console object and the otto style
+	interrupt channel. Both of them are emulated here so scripts
+	behave the same on both engines.
+*/
+
+type gojaVM struct {
+	rt      *goja.Runtime
+	depth   int          //Nested Run level, e.g. Run called by includes()
+	pending atomic.Value //Interrupt function that is not yet executed
+}
+
+type gojaValue struct {
+	value goja.Value
+}
+
+// Interrupt request carried by goja.InterruptedError
+type gojaInterrupt struct {
+	fn func()
+}
+
+func newGojaVM() *gojaVM {
+	thisVM := gojaVM{
+		rt: goja.New(),
+	}
+	thisVM.injectConsole()
+	return &thisVM
+}
+
+func (g *gojaVM) Engine() string {
+	return EngineGoja
+}
+
+func (g *gojaVM) Set(name string, value interface{}) error {
+	return g.rt.Set(name, g.toNative(value))
+}
+
+func (g *gojaVM) Get(name string) (Value, error) {
+	//Same as otto, undefined global variable is not an error
+	return g.wrap(g.rt.Get(name)), nil
+}
+
+func (g *gojaVM) Run(src interface{}) (Value, error) {
+	var script string
+	switch s := src.(type) {
+	case string:
+		script = s
+	case []byte:
+		script = string(s)
+	default:
+		return UndefinedValue(), errors.New("invalid script source type")
+	}
+
+	g.depth++
+	v, err := g.rt.RunString(script)
+	g.depth--
+	if err != nil {
+		var interrupted *goja.InterruptedError
+		if errors.As(err, &interrupted) {
+			g.rt.ClearInterrupt()
+			g.pending.Store(gojaInterrupt{})
+			if req, ok := interrupted.Value().(gojaInterrupt); ok && req.fn != nil {
+				//Execute the interrupt function on the running goroutine, same as otto
+				req.fn()
+			}
+		}
+		return UndefinedValue(), err
+	}
+
+	//Execute the interrupt requested right before the script finished
+	if g.depth == 0 {
+		if req, ok := g.pending.Load().(gojaInterrupt); ok && req.fn != nil {
+			g.rt.ClearInterrupt()
+			g.pending.Store(gojaInterrupt{})
+			req.fn()
+		}
+	}
+	return g.wrap(v), nil
+}
+
+func (g *gojaVM) ToValue(value interface{}) (Value, error) {
+	if v, ok := value.(Value); ok {
+		return v, nil
+	}
+	return g.wrap(g.rt.ToValue(g.toNative(value))), nil
+}
+
+func (g *gojaVM) Interrupt(fn func()) {
+	req := gojaInterrupt{fn: fn}
+	g.pending.Store(req)
+	g.rt.Interrupt(req)
+}
+
+func (g *gojaVM) MakeCustomError(name string, message string) Value {
+	errObj := g.rt.NewGoError(errors.New(message))
+	errObj.Set("name", name)
+	return g.wrap(errObj)
+}
+
+// Emulate the otto console object
+func (g *gojaVM) injectConsole() {
+	console := g.rt.NewObject()
+	printer := func(call goja.FunctionCall) goja.Value {
+		output := []string{}
+		for _, arg := range call.Arguments {
+			output = append(output, arg.String())
+		}
+		fmt.Fprintln(os.Stdout, strings.Join(output, " "))
+		return goja.Undefined()
+	}
+	for _, method := range []string{"log", "debug", "info", "warn", "error", "trace"} {
+		console.Set(method, printer)
+	}
+	g.rt.Set("console", console)
+}
+
+// Convert a value passed from native code into something goja understand
+func (g *gojaVM) toNative(value interface{}) interface{} {
+	switch v := value.(type) {
+	case Value:
+		return g.unwrap(v)
+	case func(FunctionCall) Value:
+		return g.wrapFunction(v)
+	case NativeFunction:
+		return g.wrapFunction(v)
+	}
+	return value
+}
+
+func (g *gojaVM) wrapFunction(fn func(FunctionCall) Value) func(goja.FunctionCall) goja.Value {
+	return func(call goja.FunctionCall) goja.Value {
+		args := make([]Value, len(call.Arguments))
+		for i, arg := range call.Arguments {
+			args[i] = g.wrap(arg)
+		}
+		return g.unwrap(fn(FunctionCall{
+			This:         g.wrap(call.This),
+			ArgumentList: args,
+			VM:           g,
+		}))
+	}
+}
+
+func (g *gojaVM) wrap(v goja.Value) Value {
+	if v == nil {
+		return UndefinedValue()
+	}
+	return Value{impl: gojaValue{value: v}}
+}
+
+func (g *gojaVM) unwrap(v Value) goja.Value {
+	switch impl := v.impl.(type) {
+	case nil:
+		return goja.Undefined()
+	case gojaValue:
+		return impl.value
+	case goValue:
+		if impl.null {
+			return goja.Null()
+		}
+		return g.rt.ToValue(impl.value)
+	}
+
+	//Value from another engine, convert through its exported form
+	exported, err := v.Export()
+	if err != nil {
+		return goja.Undefined()
+	}
+	return g.rt.ToValue(exported)
+}
+
+func (v gojaValue) export() (interface{}, error) {
+	if goja.IsUndefined(v.value) || goja.IsNull(v.value) {
+		return nil, nil
+	}
+	return v.value.Export(), nil
+}
+
+func (v gojaValue) toString() (str string, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("unable to convert value to string: %v", r)
+		}
+	}()
+	return v.value.String(), nil
+}
+
+func (v gojaValue) toInteger() (i int64, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("unable to convert value to integer: %v", r)
+		}
+	}()
+	return v.value.ToInteger(), nil
+}
+
+func (v gojaValue) toFloat() (f float64, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("unable to convert value to float: %v", r)
+		}
+	}()
+	return v.value.ToFloat(), nil
+}
+
+func (v gojaValue) toBoolean() (bool, error) {
+	return v.value.ToBoolean(), nil
+}
+
+func (v gojaValue) isUndefined() bool {
+	return goja.IsUndefined(v.value)
+}
+
+func (v gojaValue) isNull() bool {
+	return goja.IsNull(v.value)
+}
+
+func (v gojaValue) isFunction() bool {
+	_, ok := goja.AssertFunction(v.value)
+	return ok
+}
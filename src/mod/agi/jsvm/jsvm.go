@@ -0,0 +1,270 @@
+package jsvm
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+/*
+	AGI JavaScript VM Compatibility Layer
+
+	This package wrap different JavaScript engines behind the same
+	otto-like interface, so the AGI libraries can be written once and
+	run on any of the supported engines.
+
+	otto	ES5 only, the original AGI runtime
+	goja	ES2020 capable (let / const, arrow functions, classes,
+			template literals, Promises etc)
+*/
+
+const (
+	EngineOtto = "otto"
+	EngineGoja = "goja"
+
+	DefaultEngine = EngineOtto
+)
+
+// Function signature of native functions exposed to the VM
+type NativeFunction func(FunctionCall) Value
+
+type VM interface {
+	Engine() string                                    //Name of the engine running this VM
+	Set(name string, value interface{}) error          //Set a global variable or native function
+	Get(name string) (Value, error)                    //Get a global variable
+	Run(src interface{}) (Value, error)                //Run the given script, accept string or []byte
+	ToValue(value interface{}) (Value, error)          //Convert a go value into VM value
+	Interrupt(fn func())                               //Stop the running script and execute fn on the running goroutine
+	MakeCustomError(name string, message string) Value //Create a JavaScript Error object
+}
+
+// Create a new VM with the given engine. Empty engine name will use the default engine
+func New(engine string) (VM, error) {
+	switch strings.ToLower(strings.TrimSpace(engine)) {
+	case "", EngineOtto:
+		return newOttoVM(), nil
+	case EngineGoja:
+		return newGojaVM(), nil
+	}
+	return nil, errors.New("unsupported AGI engine: " + engine)
+}
+
+// Check if the engine name is supported
+func IsSupportedEngine(engine string) bool {
+	return engine == EngineOtto || engine == EngineGoja
+}
+
+// List all the supported engines
+func ListEngines() []string {
+	return []string{EngineOtto, EngineGoja}
+}
+
+// FunctionCall is the argument passed into a native function when it is called from the VM
+type FunctionCall struct {
+	This         Value
+	ArgumentList []Value
+	VM           VM
+}
+
+// Get the argument at index i, undefined if not given
+func (c FunctionCall) Argument(i int) Value {
+	if i < 0 || i >= len(c.ArgumentList) {
+		return UndefinedValue()
+	}
+	return c.ArgumentList[i]
+}
+
+/*
+	Value
+
+	A Value is either created by an engine (arguments and results)
+	or by the native code (return values of native functions). The
+	zero value of Value is undefined.
+*/
+
+type valueImpl interface {
+	export() (interface{}, error)
+	toString() (string, error)
+	toInteger() (int64, error)
+	toFloat() (float64, error)
+	toBoolean() (bool, error)
+	isUndefined() bool
+	isNull() bool
+	isFunction() bool
+}
+
+type Value struct {
+	impl valueImpl
+}
+
+func TrueValue() Value {
+	return Value{impl: goValue{value: true}}
+}
+
+func FalseValue() Value {
+	return Value{impl: goValue{value: false}}
+}
+
+func NullValue() Value {
+	return Value{impl: goValue{null: true}}
+}
+
+func UndefinedValue() Value {
+	return Value{}
+}
+
+// Convert a go value to Value without a VM. The value is converted when it is passed into the VM
+func ToValue(value interface{}) (Value, error) {
+	if v, ok := value.(Value); ok {
+		return v, nil
+	}
+	return Value{impl: goValue{value: value, null: value == nil}}, nil
+}
+
+func (v Value) Export() (interface{}, error) {
+	if v.impl == nil {
+		return nil, nil
+	}
+	return v.impl.export()
+}
+
+func (v Value) ToString() (string, error) {
+	if v.impl == nil {
+		return "undefined", nil
+	}
+	return v.impl.toString()
+}
+
+func (v Value) String() string {
+	s, _ := v.ToString()
+	return s
+}
+
+// Convert the value to integer. Same as otto, undefined and NaN convert to 0 without error
+func (v Value) ToInteger() (int64, error) {
+	if v.impl == nil {
+		return 0, nil
+	}
+	return v.impl.toInteger()
+}
+
+func (v Value) ToFloat() (float64, error) {
+	if v.impl == nil {
+		return math.NaN(), nil
+	}
+	return v.impl.toFloat()
+}
+
+func (v Value) ToBoolean() (bool, error) {
+	if v.impl == nil {
+		return false, nil
+	}
+	return v.impl.toBoolean()
+}
+
+func (v Value) IsUndefined() bool {
+	return v.impl == nil || v.impl.isUndefined()
+}
+
+func (v Value) IsNull() bool {
+	return v.impl != nil && v.impl.isNull()
+}
+
+func (v Value) IsDefined() bool {
+	return !v.IsUndefined()
+}
+
+func (v Value) IsFunction() bool {
+	return v.impl != nil && v.impl.isFunction()
+}
+
+/*
+	Go Value
+
+	Values created by native code, converted into engine value when
+	returned to the VM
+*/
+
+type goValue struct {
+	value interface{}
+	null  bool
+}
+
+func (g goValue) export() (interface{}, error) {
+	return g.value, nil
+}
+
+func (g goValue) toString() (string, error) {
+	if g.null {
+		return "null", nil
+	}
+	switch v := g.value.(type) {
+	case string:
+		return v, nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	}
+	return fmt.Sprint(g.value), nil
+}
+
+func (g goValue) toFloat() (float64, error) {
+	switch v := g.value.(type) {
+	case int:
+		return float64(v), nil
+	case int64:
+		return float64(v), nil
+	case int32:
+		return float64(v), nil
+	case float64:
+		return v, nil
+	case float32:
+		return float64(v), nil
+	case bool:
+		if v {
+			return 1, nil
+		}
+		return 0, nil
+	case string:
+		return strconv.ParseFloat(strings.TrimSpace(v), 64)
+	}
+	return 0, errors.New("value cannot be converted to number")
+}
+
+func (g goValue) toInteger() (int64, error) {
+	f, err := g.toFloat()
+	return int64(f), err
+}
+
+func (g goValue) toBoolean() (bool, error) {
+	if g.null || g.value == nil {
+		return false, nil
+	}
+	switch v := g.value.(type) {
+	case bool:
+		return v, nil
+	case string:
+		return v != "", nil
+	}
+	f, err := g.toFloat()
+	if err != nil {
+		//Objects are always true
+		return true, nil
+	}
+	return f != 0, nil
+}
+
+func (g goValue) isUndefined() bool {
+	return false
+}
+
+func (g goValue) isNull() bool {
+	return g.null
+}
+
+func (g goValue) isFunction() bool {
+	return false
+}
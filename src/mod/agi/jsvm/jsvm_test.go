@@ -0,0 +1,84 @@
+package jsvm
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+var errTestInterrupt = errors.New("interrupted")
+
+func TestNativeFunction(t *testing.T) {
+	for _, engine := range ListEngines() {
+		vm, err := New(engine)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		vm.Set("add", func(call FunctionCall) Value {
+			a, _ := call.Argument(0).ToInteger()
+			b, _ := call.Argument(1).ToInteger()
+			r, _ := call.VM.ToValue(a + b)
+			return r
+		})
+		vm.Set("isMissing", func(call FunctionCall) Value {
+			if call.Argument(0).IsUndefined() {
+				return TrueValue()
+			}
+			return FalseValue()
+		})
+
+		result, err := vm.Run(`add(1, 2) + "," + isMissing() + "," + isMissing(null)`)
+		if err != nil {
+			t.Fatalf("%s: %v", engine, err)
+		}
+		if result.String() != "3,true,false" {
+			t.Errorf("%s: expected 3,true,false, got %s", engine, result.String())
+		}
+
+		//Undefined global is not an error
+		value, err := vm.Get("notDefined")
+		if err != nil || !value.IsUndefined() {
+			t.Errorf("%s: expected undefined global to be undefined", engine)
+		}
+
+		//Global reset to undefined by native code
+		vm.Set("resetByNative", "value")
+		vm.Set("resetByNative", UndefinedValue())
+		value, err = vm.Get("resetByNative")
+		if err != nil || !value.IsUndefined() {
+			t.Errorf("%s: expected global reset to undefined to be undefined", engine)
+		}
+	}
+}
+
+func TestInterrupt(t *testing.T) {
+	for _, engine := range ListEngines() {
+		vm, err := New(engine)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		go func() {
+			time.Sleep(100 * time.Millisecond)
+			vm.Interrupt(func() {
+				panic(errTestInterrupt)
+			})
+		}()
+
+		func() {
+			defer func() {
+				if caught := recover(); caught != errTestInterrupt {
+					t.Errorf("%s: expected interrupt panic, got %v", engine, caught)
+				}
+			}()
+			vm.Run(`while(true){}`)
+		}()
+	}
+}
+
+func TestUnsupportedEngine(t *testing.T) {
+	if _, err := New("spidermonkey"); err == nil {
+		t.Errorf("Expected error for unsupported engine")
+	}
+}
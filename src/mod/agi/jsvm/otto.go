@@ -0,0 +1,178 @@
+package jsvm
+
+import (
+	"github.com/robertkrimen/otto"
+)
+
+/*
+	otto engine adapter
+*/
+
+type ottoVM struct {
+	vm    *otto.Otto
+	depth int //Nested Run level, e.g. Run called by includes()
+}
+
+type ottoValue struct {
+	value otto.Value
+}
+
+func newOttoVM() *ottoVM {
+	vm := otto.New()
+	vm.Interrupt = make(chan func(), 1)
+	return &ottoVM{
+		vm: vm,
+	}
+}
+
+func (o *ottoVM) Engine() string {
+	return EngineOtto
+}
+
+func (o *ottoVM) Set(name string, value interface{}) error {
+	return o.vm.Set(name, o.toNative(value))
+}
+
+func (o *ottoVM) Get(name string) (Value, error) {
+	v, err := o.vm.Get(name)
+	if err != nil {
+		return UndefinedValue(), err
+	}
+	return o.wrap(v), nil
+}
+
+func (o *ottoVM) Run(src interface{}) (Value, error) {
+	if b, ok := src.([]byte); ok {
+		src = string(b)
+	}
+	o.depth++
+	v, err := o.vm.Run(src)
+	o.depth--
+
+	//otto only check interrupt between statements. Execute the interrupt
+	//requested during the last statement before returning to the caller
+	if o.depth == 0 {
+		select {
+		case fn := <-o.vm.Interrupt:
+			fn()
+		default:
+		}
+	}
+
+	if err != nil {
+		return UndefinedValue(), err
+	}
+	return o.wrap(v), nil
+}
+
+func (o *ottoVM) ToValue(value interface{}) (Value, error) {
+	if v, ok := value.(Value); ok {
+		return v, nil
+	}
+	v, err := o.vm.ToValue(value)
+	if err != nil {
+		return UndefinedValue(), err
+	}
+	return o.wrap(v), nil
+}
+
+func (o *ottoVM) Interrupt(fn func()) {
+	select {
+	case o.vm.Interrupt <- fn:
+	default:
+		//Another interrupt is already pending
+	}
+}
+
+func (o *ottoVM) MakeCustomError(name string, message string) Value {
+	return o.wrap(o.vm.MakeCustomError(name, message))
+}
+
+// Convert a value passed from native code into something otto understand
+func (o *ottoVM) toNative(value interface{}) interface{} {
+	switch v := value.(type) {
+	case Value:
+		return o.unwrap(v)
+	case func(FunctionCall) Value:
+		return o.wrapFunction(v)
+	case NativeFunction:
+		return o.wrapFunction(v)
+	}
+	return value
+}
+
+func (o *ottoVM) wrapFunction(fn func(FunctionCall) Value) func(otto.FunctionCall) otto.Value {
+	return func(call otto.FunctionCall) otto.Value {
+		args := make([]Value, len(call.ArgumentList))
+		for i, arg := range call.ArgumentList {
+			args[i] = o.wrap(arg)
+		}
+		return o.unwrap(fn(FunctionCall{
+			This:         o.wrap(call.This),
+			ArgumentList: args,
+			VM:           o,
+		}))
+	}
+}
+
+func (o *ottoVM) wrap(v otto.Value) Value {
+	return Value{impl: ottoValue{value: v}}
+}
+
+func (o *ottoVM) unwrap(v Value) otto.Value {
+	switch impl := v.impl.(type) {
+	case nil:
+		return otto.UndefinedValue()
+	case ottoValue:
+		return impl.value
+	case goValue:
+		if impl.null {
+			return otto.NullValue()
+		}
+		converted, err := o.vm.ToValue(impl.value)
+		if err != nil {
+			return otto.UndefinedValue()
+		}
+		return converted
+	}
+
+	//Value from another engine, convert through its exported form
+	exported, err := v.Export()
+	if err != nil {
+		return otto.UndefinedValue()
+	}
+	converted, _ := o.vm.ToValue(exported)
+	return converted
+}
+
+func (v ottoValue) export() (interface{}, error) {
+	return v.value.Export()
+}
+
+func (v ottoValue) toString() (string, error) {
+	return v.value.ToString()
+}
+
+func (v ottoValue) toInteger() (int64, error) {
+	return v.value.ToInteger()
+}
+
+func (v ottoValue) toFloat() (float64, error) {
+	return v.value.ToFloat()
+}
+
+func (v ottoValue) toBoolean() (bool, error) {
+	return v.value.ToBoolean()
+}
+
+func (v ottoValue) isUndefined() bool {
+	return v.value.IsUndefined()
+}
+
+func (v ottoValue) isNull() bool {
+	return v.value.IsNull()
+}
+
+func (v ottoValue) isFunction() bool {
+	return v.value.IsFunction()
+}
@@ -54,6 +54,7 @@ func (g *Gateway) LoadAllFunctionalModules() {
 	g.AppdataLibRegister()
 	//g.AudioLibRegister() //work in progress
 	g.ZipLibRegister()
+	g.EventsLibRegister()
 
 	//Only register ffmpeg lib if host OS have ffmpeg installed
 	ffmpegExists, _ := apt.PackageExists("ffmpeg")
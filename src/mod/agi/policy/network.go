@@ -0,0 +1,221 @@
+package policy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+)
+
+/*
+	SSRF-safe networking
+
+	Destination hostnames are checked before the request is sent and
+	on every redirect. The resolved IP is checked again when the
+	connection is made, so DNS rebinding cannot reach internal services.
+*/
+
+const maxRedirects = 10
+
+// Address ranges that are not reachable from the public internet
+var nonPublicPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"), //Carrier-grade NAT
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+	netip.MustParsePrefix("240.0.0.0/4"),
+	netip.MustParsePrefix("64:ff9b::/96"), //NAT64, could map to private IPv4
+}
+
+// Check if the ip is loopback, private, link-local (e.g. cloud metadata) or other non-public addresses
+func IsNonPublicIP(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() {
+		return true
+	}
+	for _, prefix := range nonPublicPrefixes {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Check if the ip is explicitly allowed by an IP or CIDR entry
+func (p *Policy) ipExplicitlyAllowed(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	for _, entry := range p.AllowedHosts {
+		entry = strings.TrimSpace(entry)
+		if strings.Contains(entry, "/") {
+			if prefix, err := netip.ParsePrefix(entry); err == nil && prefix.Contains(ip) {
+				return true
+			}
+		} else if addr, err := netip.ParseAddr(strings.Trim(entry, "[]")); err == nil && addr.Unmap() == ip {
+			return true
+		}
+	}
+	return false
+}
+
+// Check if the hostname (or IP literal) is in the allowed host list
+func (p *Policy) hostAllowed(hostname string) bool {
+	if len(p.AllowedHosts) == 0 {
+		return true
+	}
+	if ip, err := netip.ParseAddr(hostname); err == nil {
+		return p.ipExplicitlyAllowed(ip)
+	}
+	hostname = strings.ToLower(strings.TrimSuffix(hostname, "."))
+	for _, entry := range p.AllowedHosts {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		if strings.HasPrefix(entry, "*.") {
+			if strings.HasSuffix(hostname, entry[1:]) {
+				return true
+			}
+		} else if entry == hostname {
+			return true
+		}
+	}
+	return false
+}
+
+// Check if the IP address can be connected to. IP or CIDR entries only
+// grant non-public access in policies set by the administrator
+func (p *Policy) CheckIP(ip netip.Addr) error {
+	if IsNonPublicIP(ip) && !p.AllowPrivateNetwork && (p.declaredByModule || !p.ipExplicitlyAllowed(ip)) {
+		return &Violation{Rule: "network", Detail: "connection to non-public address " + ip.Unmap().String() + " is not allowed"}
+	}
+	return nil
+}
+
+// Check if the script can send request to the given URL
+func (p *Policy) CheckURL(target *url.URL) error {
+	if target.Scheme != "http" && target.Scheme != "https" {
+		return &Violation{Rule: "network", Detail: "unsupported URL scheme " + target.Scheme}
+	}
+	hostname := target.Hostname()
+	if hostname == "" {
+		return &Violation{Rule: "network", Detail: "missing hostname in URL"}
+	}
+	if !p.hostAllowed(hostname) {
+		return &Violation{Rule: "network", Detail: hostname + " is not in the allowed host list"}
+	}
+	if ip, err := netip.ParseAddr(hostname); err == nil {
+		return p.CheckIP(ip)
+	}
+	return nil
+}
+
+// Create a http client that enforce the policy. Set streaming to true to
+// only apply the timeout to the response header, e.g. for file downloads
+func (p *Policy) NewHTTPClient(streaming bool) *http.Client {
+	timeout := time.Duration(p.RequestTimeout) * time.Second
+	dialer := &net.Dialer{
+		Timeout: timeout,
+		Control: func(network string, address string, c syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			ip, err := netip.ParseAddr(host)
+			if err != nil {
+				return err
+			}
+			return p.CheckIP(ip)
+		},
+	}
+
+	transport := &http.Transport{
+		//Proxy is not used, otherwise the destination check will be done on the proxy address
+		Proxy: nil,
+		DialContext: func(ctx context.Context, network string, addr string) (net.Conn, error) {
+			return dialer.DialContext(ctx, network, addr)
+		},
+		TLSHandshakeTimeout:   timeout,
+		ResponseHeaderTimeout: timeout,
+		MaxIdleConns:          10,
+		IdleConnTimeout:       30 * time.Second,
+	}
+
+	client := &http.Client{
+		Transport: transport,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= maxRedirects {
+				return errors.New("stopped after too many redirects")
+			}
+			return p.CheckURL(req.URL)
+		},
+	}
+	if !streaming {
+		client.Timeout = timeout
+	}
+	return client
+}
+
+// Create a request to the target URL after checking it against the policy
+func (p *Policy) NewRequest(method string, target string, body io.Reader) (*http.Request, error) {
+	if err := p.CheckMethod(method); err != nil {
+		return nil, err
+	}
+	parsedURL, err := url.Parse(target)
+	if err != nil {
+		return nil, err
+	}
+	if err := p.CheckURL(parsedURL); err != nil {
+		return nil, err
+	}
+	return http.NewRequest(method, parsedURL.String(), body)
+}
+
+// Read the response body within the response size limit
+func (p *Policy) ReadResponse(resp *http.Response) ([]byte, error) {
+	if p.MaxResponseSize <= 0 {
+		return io.ReadAll(resp.Body)
+	}
+	if resp.ContentLength > p.MaxResponseSize {
+		return nil, &Violation{Rule: "response size", Detail: "response larger than the size limit"}
+	}
+	buf := bytes.Buffer{}
+	_, err := io.Copy(&buf, p.LimitReader(resp.Body, p.MaxResponseSize))
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Wrap the reader so it return a violation when more than limit bytes are read, 0 for unlimited
+func (p *Policy) LimitReader(r io.Reader, limit int64) io.Reader {
+	if limit <= 0 {
+		return r
+	}
+	return &limitedReader{r: r, remaining: limit}
+}
+
+type limitedReader struct {
+	r         io.Reader
+	remaining int64
+}
+
+func (l *limitedReader) Read(b []byte) (int, error) {
+	if l.remaining < 0 {
+		return 0, &Violation{Rule: "response size", Detail: "response larger than the size limit"}
+	}
+	//Read one byte more than the limit to detect oversized body
+	if int64(len(b)) > l.remaining+1 {
+		b = b[:l.remaining+1]
+	}
+	n, err := l.r.Read(b)
+	l.remaining -= int64(n)
+	if l.remaining < 0 {
+		return n, &Violation{Rule: "response size", Detail: "response larger than the size limit"}
+	}
+	return n, err
+}
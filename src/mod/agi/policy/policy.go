@@ -0,0 +1,186 @@
+package policy
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+/*
+	AGI Script Policy
+
+	Resource limits and network restrictions applied to AGI scripts.
+	A policy can be declared by a WebApp module in its registration
+	(the "AGIPolicy" field) and overridden by the system administrator.
+	Access to non-public addresses can only be granted by the administrator.
+*/
+
+type Policy struct {
+	//Network
+	AllowedHosts        []string //Hostnames (e.g. api.example.com, *.example.com), IPs or CIDRs the script can connect to. Empty allow all public hosts
+	AllowPrivateNetwork bool     //Allow connecting to loopback, private, link-local and other non-public addresses
+	AllowedMethods      []string //HTTP methods the script can use
+	AllowCustomHeaders  bool     //Allow the script to set its own request headers
+	RequestTimeout      int      //HTTP request timeout in seconds
+	MaxResponseSize     int64    //Maximum HTTP response size read into the VM in bytes, 0 for unlimited
+	MaxDownloadSize     int64    //Maximum file size downloaded by http.download in bytes, 0 for unlimited
+
+	//Runtime
+	MaxExecutionTime int   //Maximum execution time in seconds, 0 for unlimited. Lifted once the script upgrade the request to WebSocket
+	MaxMemory        int64 //Maximum size of data loaded into the script by native functions in MB, 0 for unlimited
+
+	declaredByModule bool //Policy declared by the module itself, which cannot grant non-public network access
+}
+
+// Violation is raised when a script break its policy
+type Violation struct {
+	Rule   string
+	Detail string
+}
+
+func (v *Violation) Error() string {
+	return "AGI policy violation (" + v.Rule + "): " + v.Detail
+}
+
+// Headers that are managed by the HTTP client and cannot be set by scripts
+var restrictedHeaders = []string{"host", "content-length", "transfer-encoding", "connection", "upgrade", "te", "trailer", "proxy-authorization", "proxy-connection"}
+
+// The policy applied when neither the module nor the admin define one
+func DefaultPolicy() *Policy {
+	return &Policy{
+		AllowedHosts:        []string{},
+		AllowPrivateNetwork: false,
+		AllowedMethods:      []string{http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete, http.MethodOptions},
+		AllowCustomHeaders:  true,
+		RequestTimeout:      30,
+		MaxResponseSize:     32 << 20,
+		MaxDownloadSize:     0,
+		MaxExecutionTime:    300,
+		MaxMemory:           0,
+	}
+}
+
+// Parse a policy from JSON. Fields not given keep the values from base. Allowed
+// hosts inherited from a module declared policy keep the module restriction
+func ParsePolicy(jsonContent []byte, base *Policy) (*Policy, error) {
+	if base == nil {
+		base = DefaultPolicy()
+	}
+	fields := map[string]json.RawMessage{}
+	err := json.Unmarshal(jsonContent, &fields)
+	if err != nil {
+		return nil, err
+	}
+
+	newPolicy := *base
+	newPolicy.AllowedHosts = append([]string{}, base.AllowedHosts...)
+	newPolicy.AllowedMethods = append([]string{}, base.AllowedMethods...)
+	for field := range fields {
+		if strings.EqualFold(field, "AllowedHosts") {
+			//Hosts listed by the administrator
+			newPolicy.declaredByModule = false
+		}
+	}
+	err = json.Unmarshal(jsonContent, &newPolicy)
+	if err != nil {
+		return nil, err
+	}
+	return &newPolicy, newPolicy.Validate()
+}
+
+// Merge the fields of the patch JSON object into the base JSON object
+func MergePolicyJSON(baseJSON []byte, patchJSON []byte) ([]byte, error) {
+	merged := map[string]json.RawMessage{}
+	if len(baseJSON) > 0 {
+		if err := json.Unmarshal(baseJSON, &merged); err != nil {
+			return nil, err
+		}
+	}
+	patch := map[string]json.RawMessage{}
+	if err := json.Unmarshal(patchJSON, &patch); err != nil {
+		return nil, err
+	}
+	for field, value := range patch {
+		//Field names are case insensitive in JSON decoding
+		for existing := range merged {
+			if strings.EqualFold(existing, field) {
+				delete(merged, existing)
+			}
+		}
+		merged[field] = value
+	}
+	return json.Marshal(merged)
+}
+
+// Parse a policy declared by a module in its registration. The module cannot
+// grant itself access to loopback, private or other non-public addresses
+func ParseModulePolicy(jsonContent []byte) (*Policy, error) {
+	modulePolicy, err := ParsePolicy(jsonContent, nil)
+	if err != nil {
+		return nil, err
+	}
+	modulePolicy.AllowPrivateNetwork = false
+	modulePolicy.declaredByModule = true
+	return modulePolicy, nil
+}
+
+// Check if the policy values are valid
+func (p *Policy) Validate() error {
+	if p.RequestTimeout < 0 || p.MaxExecutionTime < 0 {
+		return errors.New("timeout cannot be negative")
+	}
+	if p.MaxResponseSize < 0 || p.MaxDownloadSize < 0 || p.MaxMemory < 0 {
+		return errors.New("size limit cannot be negative")
+	}
+	for _, host := range p.AllowedHosts {
+		host = strings.TrimSpace(host)
+		if host == "" {
+			return errors.New("empty allowed host entry")
+		}
+		if strings.Contains(host, "/") {
+			if _, err := netip.ParsePrefix(host); err != nil {
+				return errors.New("invalid CIDR: " + host)
+			}
+		}
+	}
+	for _, method := range p.AllowedMethods {
+		if method == "" || strings.ToUpper(method) != method {
+			return errors.New("invalid HTTP method: " + method)
+		}
+	}
+	return nil
+}
+
+// Check if the script can use the given HTTP method
+func (p *Policy) CheckMethod(method string) error {
+	for _, allowed := range p.AllowedMethods {
+		if allowed == method {
+			return nil
+		}
+	}
+	return &Violation{Rule: "method", Detail: method + " is not allowed"}
+}
+
+// Check if the script can set the given request header
+func (p *Policy) CheckHeader(name string) error {
+	if !p.AllowCustomHeaders {
+		return &Violation{Rule: "header", Detail: "custom headers are not allowed"}
+	}
+	for _, restricted := range restrictedHeaders {
+		if strings.EqualFold(name, restricted) {
+			return &Violation{Rule: "header", Detail: name + " cannot be set by scripts"}
+		}
+	}
+	return nil
+}
+
+// Get the policy violation from an error chain, if any
+func AsViolation(err error) (*Violation, bool) {
+	var violation *Violation
+	if errors.As(err, &violation) {
+		return violation, true
+	}
+	return nil, false
+}
@@ -0,0 +1,194 @@
+package policy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestNonPublicIP(t *testing.T) {
+	cases := map[string]bool{
+		"127.0.0.1":       true,
+		"10.1.2.3":        true,
+		"192.168.0.10":    true,
+		"169.254.169.254": true,
+		"100.64.0.1":      true,
+		"::1":             true,
+		"fd00::1":         true,
+		"::ffff:10.0.0.1": true,
+		"8.8.8.8":         false,
+		"2606:4700::1111": false,
+	}
+	for ip, expected := range cases {
+		if IsNonPublicIP(netip.MustParseAddr(ip)) != expected {
+			t.Errorf("%s: expected non-public = %v", ip, expected)
+		}
+	}
+}
+
+func TestCheckURL(t *testing.T) {
+	p := DefaultPolicy()
+	mustParse := func(s string) *url.URL {
+		u, _ := url.Parse(s)
+		return u
+	}
+
+	if err := p.CheckURL(mustParse("http://169.254.169.254/latest/meta-data")); err == nil {
+		t.Errorf("Expected cloud metadata address to be denied")
+	}
+	if err := p.CheckURL(mustParse("file:///etc/passwd")); err == nil {
+		t.Errorf("Expected file scheme to be denied")
+	}
+	if err := p.CheckURL(mustParse("https://example.com/")); err != nil {
+		t.Errorf("Expected public host to be allowed, got %v", err)
+	}
+
+	p.AllowedHosts = []string{"*.example.com", "10.0.0.0/24"}
+	if err := p.CheckURL(mustParse("https://api.example.com/")); err != nil {
+		t.Errorf("Expected wildcard host to be allowed, got %v", err)
+	}
+	if err := p.CheckURL(mustParse("https://example.org/")); err == nil {
+		t.Errorf("Expected host outside allow list to be denied")
+	}
+	if err := p.CheckURL(mustParse("http://10.0.0.5/")); err != nil {
+		t.Errorf("Expected explicitly allowed CIDR to be allowed, got %v", err)
+	}
+	if err := p.CheckURL(mustParse("http://10.0.1.5/")); err == nil {
+		t.Errorf("Expected IP outside CIDR to be denied")
+	}
+}
+
+func TestHTTPClient(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/redirect" {
+			http.Redirect(w, r, "http://169.254.169.254/", http.StatusFound)
+			return
+		}
+		w.Write([]byte(strings.Repeat("a", 1024)))
+	}))
+	defer server.Close()
+
+	//Loopback test server is denied by default
+	p := DefaultPolicy()
+	if _, err := p.NewRequest(http.MethodGet, server.URL, nil); err == nil {
+		t.Fatalf("Expected loopback request to be denied")
+	}
+
+	//Hostname that resolves to loopback is denied when connecting
+	localhostURL := strings.Replace(server.URL, "127.0.0.1", "localhost", 1)
+	req, err := p.NewRequest(http.MethodGet, localhostURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.NewHTTPClient(false).Do(req); err == nil {
+		t.Fatalf("Expected connection to localhost to be denied")
+	} else if _, ok := AsViolation(err); !ok {
+		t.Errorf("Expected policy violation, got %v", err)
+	}
+
+	//Explicitly allow the loopback address
+	p.AllowedHosts = []string{"127.0.0.1/32", "localhost"}
+	req, err = p.NewRequest(http.MethodGet, server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := p.NewHTTPClient(false).Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := p.ReadResponse(resp)
+	resp.Body.Close()
+	if err != nil || len(body) != 1024 {
+		t.Errorf("Expected 1024 bytes body, got %d (%v)", len(body), err)
+	}
+
+	//Response size limit
+	p.MaxResponseSize = 100
+	req, _ = p.NewRequest(http.MethodGet, server.URL, nil)
+	resp, err = p.NewHTTPClient(false).Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = p.ReadResponse(resp)
+	resp.Body.Close()
+	if _, ok := AsViolation(err); !ok {
+		t.Errorf("Expected response size violation, got %v", err)
+	}
+
+	//Redirect to a denied address
+	req, _ = p.NewRequest(http.MethodGet, server.URL+"/redirect", nil)
+	if _, err := p.NewHTTPClient(false).Do(req); err == nil {
+		t.Errorf("Expected redirect to metadata address to be denied")
+	}
+
+	//Method restriction
+	p.AllowedMethods = []string{http.MethodGet}
+	if _, err := p.NewRequest(http.MethodDelete, server.URL, nil); err == nil {
+		t.Errorf("Expected DELETE to be denied")
+	}
+}
+
+func TestParsePolicy(t *testing.T) {
+	p, err := ParsePolicy([]byte(`{"AllowedHosts": ["api.example.com"], "MaxExecutionTime": 10}`), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.MaxExecutionTime != 10 || len(p.AllowedHosts) != 1 {
+		t.Errorf("Given fields not parsed")
+	}
+	if p.RequestTimeout != DefaultPolicy().RequestTimeout {
+		t.Errorf("Missing fields should keep default values")
+	}
+
+	if _, err := ParsePolicy([]byte(`{"AllowedHosts": ["10.0.0.0/33"]}`), nil); err == nil {
+		t.Errorf("Expected invalid CIDR to be rejected")
+	}
+}
+
+func TestParseModulePolicy(t *testing.T) {
+	p, err := ParseModulePolicy([]byte(`{"AllowedHosts": ["10.0.0.0/8", "api.example.com"], "AllowPrivateNetwork": true}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.AllowPrivateNetwork {
+		t.Errorf("Module should not be able to allow private network")
+	}
+	if err := p.CheckIP(netip.MustParseAddr("10.0.0.1")); err == nil {
+		t.Errorf("Expected private address listed by module to be denied")
+	}
+
+	//Admin override of other fields keeps the hosts listed by the module restricted
+	override, err := ParsePolicy([]byte(`{"MaxExecutionTime": 60}`), p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := override.CheckIP(netip.MustParseAddr("10.0.0.1")); err == nil {
+		t.Errorf("Expected private address listed by module to be denied after admin override")
+	}
+
+	//Admin override listing the address allows it
+	override, err = ParsePolicy([]byte(`{"AllowedHosts": ["10.0.0.0/8"]}`), p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := override.CheckIP(netip.MustParseAddr("10.0.0.1")); err != nil {
+		t.Errorf("Expected private address listed by admin to be allowed, got %v", err)
+	}
+}
+
+func TestMergePolicyJSON(t *testing.T) {
+	merged, err := MergePolicyJSON([]byte(`{"AllowedHosts": ["10.0.0.0/8"], "maxexecutiontime": 10}`), []byte(`{"MaxExecutionTime": 60}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := ParsePolicy(merged, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.MaxExecutionTime != 60 || len(p.AllowedHosts) != 1 {
+		t.Errorf("Unexpected merged policy %s", merged)
+	}
+}
@@ -0,0 +1,303 @@
+package agi
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"imuslab.com/arozos/mod/agi/jsvm"
+	"imuslab.com/arozos/mod/agi/policy"
+	"imuslab.com/arozos/mod/agi/static"
+	"imuslab.com/arozos/mod/utils"
+)
+
+/*
+	AGI Policy Manager
+
+	Resolve the resource and network policy of a script. The policy
+	is selected in the following order
+
+	1. Admin override of the module
+	2. Policy declared by the module in its registration (AGIPolicy)
+	3. Admin override of the default policy
+	4. System default policy
+
+	Admin overrides only store the fields set by the administrator. Other
+	fields are inherited from the module or default policy when resolved.
+
+	The execution time limit and memory budget are enforced by scriptVM,
+	which wraps the VM of every script run with a policy.
+*/
+
+const (
+	policyTable      = "agi_policy"
+	policyDefaultKey = "default"
+)
+
+// Record the policy declared by the module in its registration
+func (g *Gateway) setModulePolicy(moduleName string, modulePolicy *policy.Policy) {
+	g.modulePolicies.Store(moduleName, modulePolicy)
+}
+
+// Read the fields set by the admin override with the given key
+func (g *Gateway) readPolicyOverride(key string) (string, bool) {
+	sysdb := g.Option.UserHandler.GetDatabase()
+	if !sysdb.KeyExists(policyTable, key) {
+		return "", false
+	}
+	policyJSON := ""
+	err := sysdb.Read(policyTable, key, &policyJSON)
+	if err != nil {
+		return "", false
+	}
+	return policyJSON, true
+}
+
+// Get the admin override policy with the given key, missing fields are taken from base
+func (g *Gateway) getPolicyOverride(key string, base *policy.Policy) (*policy.Policy, bool) {
+	policyJSON, ok := g.readPolicyOverride(key)
+	if !ok {
+		return nil, false
+	}
+	overridePolicy, err := policy.ParsePolicy([]byte(policyJSON), base)
+	if err != nil {
+		log.Println("[AGI] Invalid policy override for " + key + ": " + err.Error())
+		return nil, false
+	}
+	return overridePolicy, true
+}
+
+// Get the policy that the admin override of the module is applied on
+func (g *Gateway) getBasePolicy(moduleName string) *policy.Policy {
+	if moduleName == "" {
+		return policy.DefaultPolicy()
+	}
+	if declared, ok := g.modulePolicies.Load(moduleName); ok {
+		return declared.(*policy.Policy)
+	}
+	defaultPolicy, _ := g.getModulePolicy("")
+	return defaultPolicy
+}
+
+// Get the policy of the module and where it comes from
+func (g *Gateway) getModulePolicy(moduleName string) (*policy.Policy, string) {
+	if moduleName == "" {
+		if override, ok := g.getPolicyOverride(policyDefaultKey, nil); ok {
+			return override, "admin"
+		}
+		return policy.DefaultPolicy(), "default"
+	}
+
+	basePolicy := g.getBasePolicy(moduleName)
+	if override, ok := g.getPolicyOverride(moduleName, basePolicy); ok {
+		return override, "admin"
+	}
+	if _, ok := g.modulePolicies.Load(moduleName); ok {
+		return basePolicy, "module"
+	}
+	_, defaultSource := g.getModulePolicy("")
+	return basePolicy, defaultSource
+}
+
+// Get the policy for running the given script
+func (g *Gateway) GetScriptPolicy(scriptFile string, scriptScope string) *policy.Policy {
+	moduleName := ""
+	if scriptFile != "" && scriptScope != "" {
+		moduleName = static.GetScriptRoot(scriptFile, scriptScope)
+	}
+	scriptPolicy, _ := g.getModulePolicy(moduleName)
+	return scriptPolicy
+}
+
+/*
+	Script VM
+
+	Wrap the VM of a script to enforce the runtime limits of its policy.
+	The memory budget is charged with the strings and buffers that native
+	functions return into the script, e.g. file content and HTTP responses.
+	Memory used by the script itself cannot be measured per VM.
+*/
+
+type scriptVM struct {
+	jsvm.VM
+	policy *policy.Policy
+	loaded int64       //Bytes of data loaded into the script by native functions
+	timer  *time.Timer //Execution time watchdog, nil if not started or lifted
+	mutex  sync.Mutex
+}
+
+// Create a VM that enforce the given policy
+func newScriptVM(vm jsvm.VM, scriptPolicy *policy.Policy) *scriptVM {
+	return &scriptVM{
+		VM:     vm,
+		policy: scriptPolicy,
+	}
+}
+
+// Convert the go value into VM value and charge its size to the memory budget
+func (v *scriptVM) ToValue(value interface{}) (jsvm.Value, error) {
+	size := 0
+	switch data := value.(type) {
+	case string:
+		size = len(data)
+	case []byte:
+		size = len(data)
+	case []string:
+		for _, item := range data {
+			size += len(item)
+		}
+	}
+	if size > 0 && v.policy.MaxMemory > 0 {
+		v.mutex.Lock()
+		v.loaded += int64(size)
+		exceeded := v.loaded > v.policy.MaxMemory<<20
+		v.mutex.Unlock()
+		if exceeded {
+			raiseIfViolation(v.VM, &policy.Violation{Rule: "memory", Detail: "script exceeded the maximum memory usage"})
+		}
+	}
+	return v.VM.ToValue(value)
+}
+
+// Start the execution time watchdog. Return a function to stop the watchdog
+func (v *scriptVM) startWatchdog() func() {
+	if v.policy.MaxExecutionTime <= 0 {
+		return func() {}
+	}
+
+	v.mutex.Lock()
+	v.timer = time.AfterFunc(time.Duration(v.policy.MaxExecutionTime)*time.Second, func() {
+		violation := &policy.Violation{Rule: "execution time", Detail: "script exceeded the maximum execution time"}
+		v.VM.Interrupt(func() {
+			panic(violation)
+		})
+	})
+	v.mutex.Unlock()
+	return v.liftExecutionTimeLimit
+}
+
+// Stop the execution time watchdog, used by long lived scripts like WebSocket handlers
+func (v *scriptVM) liftExecutionTimeLimit() {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	if v.timer != nil {
+		v.timer.Stop()
+		v.timer = nil
+	}
+}
+
+// Lift the execution time limit of the VM if it is a script VM
+func liftExecutionTimeLimit(vm jsvm.VM) {
+	if sv, ok := vm.(*scriptVM); ok {
+		sv.liftExecutionTimeLimit()
+	}
+}
+
+// Stop the script if the error is caused by a policy violation. The script is stopped
+// by interrupt instead of panic in the native function, so it cannot be caught by the script
+func raiseIfViolation(vm jsvm.VM, err error) {
+	if violation, ok := policy.AsViolation(err); ok {
+		vm.Interrupt(func() {
+			panic(violation)
+		})
+	}
+}
+
+/*
+	Admin APIs
+*/
+
+type policyEntry struct {
+	Module string
+	Source string
+	Policy *policy.Policy
+}
+
+// List the effective policy of the default scope and all modules with a declared or overridden policy
+func (g *Gateway) HandleListPolicy(w http.ResponseWriter, r *http.Request) {
+	modules := map[string]bool{}
+	g.modulePolicies.Range(func(key, value interface{}) bool {
+		modules[key.(string)] = true
+		return true
+	})
+	sysdb := g.Option.UserHandler.GetDatabase()
+	entries, _ := sysdb.ListTable(policyTable)
+	for _, keypairs := range entries {
+		if string(keypairs[0]) != policyDefaultKey {
+			modules[string(keypairs[0])] = true
+		}
+	}
+
+	moduleNames := []string{}
+	for moduleName := range modules {
+		moduleNames = append(moduleNames, moduleName)
+	}
+	sort.Strings(moduleNames)
+
+	defaultPolicy, defaultSource := g.getModulePolicy("")
+	results := []policyEntry{{Module: "", Source: defaultSource, Policy: defaultPolicy}}
+	for _, moduleName := range moduleNames {
+		modulePolicy, source := g.getModulePolicy(moduleName)
+		results = append(results, policyEntry{
+			Module: moduleName,
+			Source: source,
+			Policy: modulePolicy,
+		})
+	}
+
+	js, _ := json.Marshal(results)
+	utils.SendJSONResponse(w, string(js))
+}
+
+// Override the policy of a module, or the default policy if module is empty
+func (g *Gateway) HandleSetPolicy(w http.ResponseWriter, r *http.Request) {
+	moduleName, _ := utils.PostPara(r, "module")
+	policyJSON, err := utils.PostPara(r, "policy")
+	if err != nil {
+		utils.SendErrorResponse(w, "Invalid policy given")
+		return
+	}
+
+	key := moduleName
+	if key == "" {
+		key = policyDefaultKey
+	}
+
+	//Given fields are added to the existing override, missing fields inherit from the module or default policy
+	previousJSON, _ := g.readPolicyOverride(key)
+	mergedJSON, err := policy.MergePolicyJSON([]byte(previousJSON), []byte(policyJSON))
+	if err != nil {
+		utils.SendErrorResponse(w, "Invalid policy: "+err.Error())
+		return
+	}
+	_, err = policy.ParsePolicy(mergedJSON, g.getBasePolicy(moduleName))
+	if err != nil {
+		utils.SendErrorResponse(w, "Invalid policy: "+err.Error())
+		return
+	}
+
+	sysdb := g.Option.UserHandler.GetDatabase()
+	err = sysdb.Write(policyTable, key, string(mergedJSON))
+	if err != nil {
+		utils.SendErrorResponse(w, err.Error())
+		return
+	}
+	utils.SendOK(w)
+}
+
+// Remove the admin override of a module, or the default policy if module is empty
+func (g *Gateway) HandleResetPolicy(w http.ResponseWriter, r *http.Request) {
+	moduleName, _ := utils.PostPara(r, "module")
+	key := moduleName
+	if key == "" {
+		key = policyDefaultKey
+	}
+	sysdb := g.Option.UserHandler.GetDatabase()
+	if sysdb.KeyExists(policyTable, key) {
+		sysdb.Delete(policyTable, key)
+	}
+	utils.SendOK(w)
+}
@@ -4,7 +4,7 @@ import (
 	"io"
 	"net/http"
 
-	"github.com/robertkrimen/otto"
+	"imuslab.com/arozos/mod/agi/jsvm"
 	user "imuslab.com/arozos/mod/user"
 	"imuslab.com/arozos/mod/utils"
 )
@@ -16,54 +16,54 @@ import (
 	Author: tobychui
 */
 
-func (g *Gateway) injectServerlessFunctions(vm *otto.Otto, scriptFile string, scriptScope string, u *user.User, r *http.Request) {
+func (g *Gateway) injectServerlessFunctions(vm jsvm.VM, scriptFile string, scriptScope string, u *user.User, r *http.Request) {
 	vm.Set("REQ_METHOD", r.Method)
-	vm.Set("getPara", func(call otto.FunctionCall) otto.Value {
+	vm.Set("getPara", func(call jsvm.FunctionCall) jsvm.Value {
 		key, _ := call.Argument(0).ToString()
 		if key == "" {
-			return otto.NullValue()
+			return jsvm.NullValue()
 		}
 		value, err := utils.GetPara(r, key)
 		if err != nil {
-			return otto.NullValue()
+			return jsvm.NullValue()
 		}
 
 		r, err := vm.ToValue(value)
 		if err != nil {
-			return otto.NullValue()
+			return jsvm.NullValue()
 		}
 
 		return r
 	})
-	vm.Set("postPara", func(call otto.FunctionCall) otto.Value {
+	vm.Set("postPara", func(call jsvm.FunctionCall) jsvm.Value {
 		key, _ := call.Argument(0).ToString()
 		if key == "" {
-			return otto.NullValue()
+			return jsvm.NullValue()
 		}
 		value, err := utils.PostPara(r, key)
 		if err != nil {
-			return otto.NullValue()
+			return jsvm.NullValue()
 		}
 
 		r, err := vm.ToValue(value)
 		if err != nil {
-			return otto.NullValue()
+			return jsvm.NullValue()
 		}
 
 		return r
 	})
-	vm.Set("readBody", func(call otto.FunctionCall) otto.Value {
+	vm.Set("readBody", func(call jsvm.FunctionCall) jsvm.Value {
 		if r.Body == nil {
-			return otto.NullValue()
+			return jsvm.NullValue()
 		}
 
 		bodyContent, err := io.ReadAll(r.Body)
 		if err != nil {
-			return otto.NullValue()
+			return jsvm.NullValue()
 		}
 		r, err := vm.ToValue(string(bodyContent))
 		if err != nil {
-			return otto.NullValue()
+			return jsvm.NullValue()
 		}
 		return r
 	})
@@ -6,7 +6,8 @@ import (
 	"path/filepath"
 	"strings"
 
-	"github.com/robertkrimen/otto"
+	"imuslab.com/arozos/mod/agi/jsvm"
+	"imuslab.com/arozos/mod/agi/policy"
 	"imuslab.com/arozos/mod/filesystem"
 	"imuslab.com/arozos/mod/filesystem/arozfs"
 	user "imuslab.com/arozos/mod/user"
@@ -16,17 +17,18 @@ import (
 // Injection payload, the minimal required information for a function module to execute the
 // agi script in virtualized environment
 type AgiLibInjectionPayload struct {
-	VM         *otto.Otto
+	VM         jsvm.VM
 	User       *user.User
 	ScriptFsh  *filesystem.FileSystemHandler
 	ScriptPath string
 	Writer     http.ResponseWriter
 	Request    *http.Request
+	Policy     *policy.Policy
 }
 
 // Get the full vpath if the passing value is a relative path
 // Return the original vpath if any error occured
-func RelativeVpathRewrite(fsh *filesystem.FileSystemHandler, vpath string, vm *otto.Otto, u *user.User) string {
+func RelativeVpathRewrite(fsh *filesystem.FileSystemHandler, vpath string, vm jsvm.VM, u *user.User) string {
 	//Check if the vpath contain a UUID
 	if strings.Contains(vpath, ":/") || (len(vpath) > 0 && vpath[len(vpath)-1:] == ":") {
 		//This vpath contain root uuid.
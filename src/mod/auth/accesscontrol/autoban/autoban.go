@@ -0,0 +1,256 @@
+package autoban
+
+import (
+	"errors"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"imuslab.com/arozos/mod/auth/accesscontrol/blacklist"
+	"imuslab.com/arozos/mod/auth/accesscontrol/whitelist"
+	"imuslab.com/arozos/mod/auth/authlogger"
+	"imuslab.com/arozos/mod/database"
+)
+
+/*
+	ArozOS Auto Ban Module
+
+	fail2ban style policy engine. It consume the failed login records of
+	all authentication paths (web, webdav, ftp, sftp, ldap, oauth) from the
+	auth logger and temporary ban the IP address in the blacklist after
+	too many failures within a time window.
+
+	Whitelisted and loopback addresses are never banned. The failures are
+	recorded with the same client IP resolver as the login access check,
+	which only trust forwarded headers from the configured trusted proxies.
+*/
+
+const autobanTable = "autoban"
+
+type Config struct {
+	Enabled     bool  //Enable automatic banning
+	MaxFailures int   //Number of failures within FindTime that trigger a ban
+	FindTime    int64 //Failure counting window in seconds
+	BanTime     int64 //Ban duration in seconds
+}
+
+type StrikeCounter struct {
+	IpAddr      string
+	Failures    []int64  //Timestamps of failures within the counting window
+	Usernames   []string //Usernames tried by this IP
+	AuthTypes   []string //Authentication paths used by this IP
+	LastFailure int64
+}
+
+type Manager struct {
+	config    Config
+	database  *database.Database
+	blacklist *blacklist.BlackList
+	whitelist *whitelist.WhiteList
+	strikes   map[string]*StrikeCounter
+	mutex     sync.Mutex
+}
+
+// Create a new auto ban manager. Call HandleAuthRecord on every logged authentication
+func NewAutoBanManager(sysdb *database.Database, bl *blacklist.BlackList, wl *whitelist.WhiteList) *Manager {
+	sysdb.NewTable(autobanTable)
+
+	config := Config{
+		Enabled:     true,
+		MaxFailures: 10,
+		FindTime:    600,
+		BanTime:     3600,
+	}
+	if sysdb.KeyExists(autobanTable, "config") {
+		err := sysdb.Read(autobanTable, "config", &config)
+		if err != nil {
+			log.Println("[Auth/AutoBan] Unable to load auto ban config from database. Using default.")
+		}
+	}
+
+	return &Manager{
+		config:    config,
+		database:  sysdb,
+		blacklist: bl,
+		whitelist: wl,
+		strikes:   map[string]*StrikeCounter{},
+	}
+}
+
+// Consume a login record from the auth logger
+func (m *Manager) HandleAuthRecord(record authlogger.LoginRecord) {
+	if record.LoginSucceed {
+		return
+	}
+	m.RecordFailure(record.IpAddr, record.TargetUsername, record.AuthType)
+}
+
+// Record a failed login from the given IP, return true if the IP got banned by this failure
+func (m *Manager) RecordFailure(ip string, username string, authType string) bool {
+	ip = normalizeIP(ip)
+	if ip == "" || m.isExempted(ip) {
+		return false
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if !m.config.Enabled {
+		return false
+	}
+
+	now := time.Now().Unix()
+	m.pruneStrikes(now)
+	counter, ok := m.strikes[ip]
+	if !ok {
+		counter = &StrikeCounter{
+			IpAddr:    ip,
+			Failures:  []int64{},
+			Usernames: []string{},
+			AuthTypes: []string{},
+		}
+		m.strikes[ip] = counter
+	}
+	counter.Failures = append(counter.Failures, now)
+	counter.LastFailure = now
+	counter.Usernames = appendUnique(counter.Usernames, username)
+	counter.AuthTypes = appendUnique(counter.AuthTypes, authType)
+
+	if len(counter.Failures) < m.config.MaxFailures {
+		return false
+	}
+
+	//Too many failures. Ban this IP
+	reason := strconv.Itoa(len(counter.Failures)) + " failed logins via " + strings.Join(counter.AuthTypes, ", ")
+	err := m.blacklist.BanTemporarily(ip, m.config.BanTime, reason)
+	if err != nil {
+		log.Println("[Auth/AutoBan] Unable to ban " + ip + ": " + err.Error())
+		return false
+	}
+	delete(m.strikes, ip)
+	log.Println("[Auth/AutoBan] " + ip + " banned for " + strconv.Itoa(int(m.config.BanTime)) + " seconds after " + reason)
+	return true
+}
+
+// List the strike counters of IPs that failed to login within the counting window
+func (m *Manager) ListStrikes() []StrikeCounter {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.pruneStrikes(time.Now().Unix())
+
+	results := []StrikeCounter{}
+	for _, counter := range m.strikes {
+		results = append(results, *counter)
+	}
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].LastFailure > results[j].LastFailure
+	})
+	return results
+}
+
+// Reset the strike counter of an IP, or all IPs if ip is empty
+func (m *Manager) ResetStrikes(ip string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if ip == "" {
+		m.strikes = map[string]*StrikeCounter{}
+		return
+	}
+	delete(m.strikes, normalizeIP(ip))
+}
+
+// Lift the ban of an IP and reset its strike counter
+func (m *Manager) Unban(ip string) error {
+	ip = normalizeIP(ip)
+	if ip == "" {
+		return errors.New("invalid IP address given")
+	}
+	m.ResetStrikes(ip)
+	return m.blacklist.LiftTemporaryBan(ip)
+}
+
+// List all active auto bans
+func (m *Manager) ListBans() []*blacklist.TemporaryBan {
+	return m.blacklist.ListTemporaryBans()
+}
+
+func (m *Manager) GetConfig() Config {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.config
+}
+
+func (m *Manager) SetConfig(config Config) error {
+	if config.MaxFailures < 1 {
+		return errors.New("max failures must be at least 1")
+	}
+	if config.FindTime < 1 || config.BanTime < 1 {
+		return errors.New("find time and ban time must be positive")
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.config = config
+	return m.database.Write(autobanTable, "config", config)
+}
+
+// Check if the ip should never be banned
+func (m *Manager) isExempted(ip string) bool {
+	if net.ParseIP(ip).IsLoopback() {
+		return true
+	}
+	return m.whitelist.Enabled && m.whitelist.IsWhitelisted(ip)
+}
+
+// Remove failures that are outside of the counting window. Must be called with mutex locked
+func (m *Manager) pruneStrikes(now int64) {
+	for ip, counter := range m.strikes {
+		recentFailures := []int64{}
+		for _, t := range counter.Failures {
+			if now-t < m.config.FindTime {
+				recentFailures = append(recentFailures, t)
+			}
+		}
+		if len(recentFailures) == 0 {
+			delete(m.strikes, ip)
+			continue
+		}
+		counter.Failures = recentFailures
+	}
+}
+
+/*
+	Helper functions
+*/
+
+// Normalize the IP address recorded by the auth logger, return empty string if it is not an IP
+func normalizeIP(ip string) string {
+	ip = strings.TrimSpace(ip)
+	if host, _, err := net.SplitHostPort(ip); err == nil {
+		ip = host
+	}
+	ip = strings.Trim(ip, "[]")
+	if net.ParseIP(ip) == nil {
+		return ""
+	}
+	return ip
+}
+
+func appendUnique(list []string, value string) []string {
+	if value == "" {
+		return list
+	}
+	for _, v := range list {
+		if v == value {
+			return list
+		}
+	}
+	if len(list) >= 10 {
+		//Only keep the latest 10 entries
+		list = list[1:]
+	}
+	return append(list, value)
+}
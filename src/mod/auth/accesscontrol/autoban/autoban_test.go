@@ -0,0 +1,66 @@
+package autoban
+
+import (
+	"path/filepath"
+	"testing"
+
+	"imuslab.com/arozos/mod/auth/accesscontrol/blacklist"
+	"imuslab.com/arozos/mod/auth/accesscontrol/whitelist"
+	"imuslab.com/arozos/mod/auth/authlogger"
+	"imuslab.com/arozos/mod/database"
+)
+
+func newTestManager(t *testing.T) (*Manager, *blacklist.BlackList, *whitelist.WhiteList) {
+	sysdb, err := database.NewDatabase(filepath.Join(t.TempDir(), "test.db"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(sysdb.Close)
+
+	bl := blacklist.NewBlacklistManager(sysdb)
+	wl := whitelist.NewWhitelistManager(sysdb)
+	m := NewAutoBanManager(sysdb, bl, wl)
+	m.SetConfig(Config{Enabled: true, MaxFailures: 3, FindTime: 600, BanTime: 600})
+	return m, bl, wl
+}
+
+func TestBanAfterFailuresAcrossAuthPaths(t *testing.T) {
+	m, bl, _ := newTestManager(t)
+
+	m.HandleAuthRecord(authlogger.LoginRecord{IpAddr: "10.0.0.5", TargetUsername: "admin", AuthType: "web"})
+	m.HandleAuthRecord(authlogger.LoginRecord{IpAddr: "10.0.0.5", TargetUsername: "admin", AuthType: "ftp", LoginSucceed: true})
+	m.HandleAuthRecord(authlogger.LoginRecord{IpAddr: "10.0.0.5", TargetUsername: "root", AuthType: "webdav"})
+	if bl.IsBanned("10.0.0.5") {
+		t.Fatal("IP banned before reaching the failure limit")
+	}
+	strikes := m.ListStrikes()
+	if len(strikes) != 1 || len(strikes[0].Failures) != 2 || len(strikes[0].AuthTypes) != 2 {
+		t.Fatalf("unexpected strike counters %+v", strikes)
+	}
+
+	//The temporary ban works even if the manual blacklist is disabled
+	if !m.RecordFailure("10.0.0.5:2121", "admin", "sftp") || !bl.IsBanned("10.0.0.5") {
+		t.Fatal("IP not banned after too many failures")
+	}
+	if bans := m.ListBans(); len(bans) != 1 || bans[0].IpAddr != "10.0.0.5" {
+		t.Fatalf("unexpected ban list %+v", bans)
+	}
+
+	if err := m.Unban("10.0.0.5"); err != nil || bl.IsBanned("10.0.0.5") {
+		t.Fatal("unable to lift the auto ban", err)
+	}
+}
+
+func TestWhitelistedIPNotBanned(t *testing.T) {
+	m, bl, wl := newTestManager(t)
+	wl.SetWhitelistEnabled(true)
+	wl.SetWhitelist("192.168.0.10")
+
+	for i := 0; i < 5; i++ {
+		m.RecordFailure("192.168.0.10", "admin", "web")
+		m.RecordFailure("127.0.0.1", "admin", "web")
+	}
+	if bl.IsBanned("192.168.0.10") || bl.IsBanned("127.0.0.1") {
+		t.Fatal("whitelisted IP got banned")
+	}
+}
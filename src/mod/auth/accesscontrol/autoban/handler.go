@@ -0,0 +1,93 @@
+package autoban
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"imuslab.com/arozos/mod/utils"
+)
+
+/*
+	Handler for auto ban module
+*/
+
+// Get or set the auto ban config. POST enabled, maxfailures, findtime and bantime to update
+func (m *Manager) HandleConfig(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		js, _ := json.Marshal(m.GetConfig())
+		utils.SendJSONResponse(w, string(js))
+		return
+	}
+
+	config := m.GetConfig()
+	if enabled, err := utils.PostPara(r, "enabled"); err == nil {
+		config.Enabled = enabled == "true"
+	}
+	if maxFailures, err := utils.PostPara(r, "maxfailures"); err == nil {
+		value, err := strconv.Atoi(maxFailures)
+		if err != nil {
+			utils.SendErrorResponse(w, "Invalid max failures given")
+			return
+		}
+		config.MaxFailures = value
+	}
+	if findTime, err := utils.PostPara(r, "findtime"); err == nil {
+		value, err := strconv.ParseInt(findTime, 10, 64)
+		if err != nil {
+			utils.SendErrorResponse(w, "Invalid find time given")
+			return
+		}
+		config.FindTime = value
+	}
+	if banTime, err := utils.PostPara(r, "bantime"); err == nil {
+		value, err := strconv.ParseInt(banTime, 10, 64)
+		if err != nil {
+			utils.SendErrorResponse(w, "Invalid ban time given")
+			return
+		}
+		config.BanTime = value
+	}
+
+	err := m.SetConfig(config)
+	if err != nil {
+		utils.SendErrorResponse(w, err.Error())
+		return
+	}
+	utils.SendOK(w)
+}
+
+// List the active auto bans
+func (m *Manager) HandleListBans(w http.ResponseWriter, r *http.Request) {
+	js, _ := json.Marshal(m.ListBans())
+	utils.SendJSONResponse(w, string(js))
+}
+
+// List the strike counters of IPs with recent failed logins
+func (m *Manager) HandleListStrikes(w http.ResponseWriter, r *http.Request) {
+	js, _ := json.Marshal(m.ListStrikes())
+	utils.SendJSONResponse(w, string(js))
+}
+
+// Lift an auto ban, require POST ip
+func (m *Manager) HandleUnban(w http.ResponseWriter, r *http.Request) {
+	ip, err := utils.PostPara(r, "ip")
+	if err != nil {
+		utils.SendErrorResponse(w, "Invalid ip given")
+		return
+	}
+
+	err = m.Unban(ip)
+	if err != nil {
+		utils.SendErrorResponse(w, err.Error())
+		return
+	}
+	utils.SendOK(w)
+}
+
+// Reset strike counters, POST ip to reset a single IP, otherwise reset all
+func (m *Manager) HandleResetStrikes(w http.ResponseWriter, r *http.Request) {
+	ip, _ := utils.PostPara(r, "ip")
+	m.ResetStrikes(ip)
+	utils.SendOK(w)
+}
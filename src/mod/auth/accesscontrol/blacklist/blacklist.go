@@ -26,6 +26,7 @@ type BlackList struct {
 
 func NewBlacklistManager(sysdb *db.Database) *BlackList {
 	sysdb.NewTable("ipblacklist")
+	sysdb.NewTable(tempBanTable)
 
 	blacklistEnabled := false
 	if sysdb.KeyExists("ipblacklist", "enable") {
@@ -43,6 +44,9 @@ func NewBlacklistManager(sysdb *db.Database) *BlackList {
 
 //Check if a given IP is banned
 func (bl *BlackList) IsBanned(ip string) bool {
+	if bl.IsTemporarilyBanned(ip) {
+		return true
+	}
 	if bl.Enabled == false {
 		return false
 	}
@@ -101,6 +105,10 @@ func (bl *BlackList) UnBan(ipRange string) error {
 
 	//Check if the ip range is banned
 	if !bl.database.KeyExists("ipblacklist", ipRange) {
+		if bl.IsTemporarilyBanned(ipRange) {
+			//Lift the temporary ban instead
+			return bl.LiftTemporaryBan(ipRange)
+		}
 		return errors.New("invalid IP range given")
 	}
 
@@ -82,10 +82,6 @@ func (bl *BlackList) HandleListBannedIPs(w http.ResponseWriter, r *http.Request)
 }
 
 func (bl *BlackList) CheckIsBannedByRequest(r *http.Request) bool {
-	if bl.Enabled == false {
-		//Blacklist not enabled. Always return not banned
-		return false
-	}
 	//Get the IP address from the request header
 	requestIP, err := network.GetIpFromRequest(r)
 	if err != nil {
@@ -0,0 +1,101 @@
+package blacklist
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"sort"
+	"time"
+)
+
+/*
+	Temporary Ban
+
+	Temporary bans are created by the auto ban policy (see accesscontrol/autoban)
+	and lifted automatically after their expire time. They are stored in a
+	separated table so the manual blacklist entries are not touched, and they
+	take effect even if the manual blacklist is disabled.
+*/
+
+const tempBanTable = "ipblacklist_temp"
+
+type TemporaryBan struct {
+	IpAddr     string //The banned IP address
+	Reason     string //Reason of the ban, e.g. 10 failed ftp logins
+	BanTime    int64  //Unix timestamp when the ban is created
+	ExpireTime int64  //Unix timestamp when the ban will be lifted
+}
+
+// Ban a single IP address for the given duration in seconds
+func (bl *BlackList) BanTemporarily(ip string, duration int64, reason string) error {
+	if net.ParseIP(ip) == nil {
+		return errors.New("invalid IP address given")
+	}
+	now := time.Now().Unix()
+	return bl.database.Write(tempBanTable, ip, TemporaryBan{
+		IpAddr:     ip,
+		Reason:     reason,
+		BanTime:    now,
+		ExpireTime: now + duration,
+	})
+}
+
+// Check if the IP is under an active temporary ban
+func (bl *BlackList) IsTemporarilyBanned(ip string) bool {
+	if !bl.database.KeyExists(tempBanTable, ip) {
+		return false
+	}
+	thisBan := TemporaryBan{}
+	err := bl.database.Read(tempBanTable, ip, &thisBan)
+	if err != nil {
+		return false
+	}
+	if thisBan.ExpireTime <= time.Now().Unix() {
+		//Ban expired. Lift it
+		bl.database.Delete(tempBanTable, ip)
+		return false
+	}
+	return true
+}
+
+// List all active temporary bans, expired bans are removed from database
+func (bl *BlackList) ListTemporaryBans() []*TemporaryBan {
+	results := []*TemporaryBan{}
+	entries, err := bl.database.ListTable(tempBanTable)
+	if err != nil {
+		return results
+	}
+	now := time.Now().Unix()
+	for _, keypairs := range entries {
+		thisBan := TemporaryBan{}
+		err = json.Unmarshal(keypairs[1], &thisBan)
+		if err != nil {
+			continue
+		}
+		if thisBan.ExpireTime <= now {
+			bl.database.Delete(tempBanTable, string(keypairs[0]))
+			continue
+		}
+		results = append(results, &thisBan)
+	}
+
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].ExpireTime < results[j].ExpireTime
+	})
+	return results
+}
+
+// Lift a temporary ban before it expires
+func (bl *BlackList) LiftTemporaryBan(ip string) error {
+	if !bl.database.KeyExists(tempBanTable, ip) {
+		return errors.New("IP is not temporarily banned")
+	}
+	return bl.database.Delete(tempBanTable, ip)
+}
+
+// Lift all temporary bans
+func (bl *BlackList) ClearTemporaryBans() {
+	for _, thisBan := range bl.ListTemporaryBans() {
+		bl.database.Delete(tempBanTable, thisBan.IpAddr)
+	}
+}
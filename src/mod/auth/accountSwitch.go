@@ -304,7 +304,7 @@ func (m *SwitchableAccountPoolManager) HandleAccountSwitch(w http.ResponseWriter
 		}
 
 		//Not expired. Switch over directly
-		m.authAgent.LoginUserByRequest(w, r, username, true)
+		m.authAgent.LoginUserByRequest(w, r, username, true, LoginMethodSwitch)
 	} else {
 		//Password given. Use Add User Account routine
 		ok, reason := m.authAgent.ValidateUsernameAndPasswordWithReason(username, password)
@@ -313,7 +313,9 @@ func (m *SwitchableAccountPoolManager) HandleAccountSwitch(w http.ResponseWriter
 			return
 		}
 
-		m.authAgent.LoginUserByRequest(w, r, username, true)
+		if !m.authAgent.LoginUserWithPassword(w, r, username, true, LoginMethodSwitch) {
+			return
+		}
 
 	}
 
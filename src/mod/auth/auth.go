@@ -22,6 +22,7 @@ package auth
 import (
 	"crypto/sha512"
 	"errors"
+	"net"
 	"net/http"
 	"strconv"
 	"strings"
@@ -33,6 +34,7 @@ import (
 
 	"github.com/gorilla/sessions"
 
+	"imuslab.com/arozos/mod/auth/accesscontrol/autoban"
 	"imuslab.com/arozos/mod/auth/accesscontrol/blacklist"
 	"imuslab.com/arozos/mod/auth/accesscontrol/whitelist"
 	"imuslab.com/arozos/mod/auth/authlogger"
@@ -65,10 +67,23 @@ type AuthAgent struct {
 	//IPLists manager
 	WhitelistManager *whitelist.WhiteList
 	BlacklistManager *blacklist.BlackList
+	AutoBanManager   *autoban.Manager
 
 	//Account Switcher
 	SwitchableAccountManager *SwitchableAccountPoolManager
 
+	//Server side session registry, see session.go
+	sessions     map[string]*Session
+	sessionMutex sync.RWMutex
+
+	//Second factor after password login, return true if it replied the request and the login is completed by the second factor
+	SecondFactorHandler func(w http.ResponseWriter, r *http.Request, username string, rememberme bool) bool
+	//Check if the user must complete the login with a second factor
+	SecondFactorRequired func(username string) bool
+
+	//Called after a user is removed, for cleaning up data kept by other modules
+	OnUserRemoved func(username string)
+
 	//Logger
 	Logger *authlogger.Logger
 }
@@ -103,11 +118,15 @@ func NewAuthenticationAgent(sessionName string, key []byte, sysdb *db.Database,
 	//Create a new blacklist manager
 	thisBlacklistManager := blacklist.NewBlacklistManager(sysdb)
 
+	//Create a new auto ban manager for banning IPs with too many failed logins
+	thisAutoBanManager := autoban.NewAutoBanManager(sysdb, thisBlacklistManager, thisWhitelistManager)
+
 	//Create a new logger for logging all login request
 	newLogger, err := authlogger.NewLogger()
 	if err != nil {
 		panic(err)
 	}
+	newLogger.AddListener(thisAutoBanManager.HandleAuthRecord)
 
 	//Create a new AuthAgent object
 	newAuthAgent := AuthAgent{
@@ -127,10 +146,19 @@ func NewAuthenticationAgent(sessionName string, key []byte, sysdb *db.Database,
 		//Blacklist management
 		WhitelistManager: thisWhitelistManager,
 		BlacklistManager: thisBlacklistManager,
+		AutoBanManager:   thisAutoBanManager,
 		ExpDelayHandler:  expLoginHandler,
 
 		//Switchable Account Pool Manager
 		Logger: newLogger,
+
+		sessions: map[string]*Session{},
+	}
+
+	//Load the sessions that are still valid
+	err = newAuthAgent.loadSessionsFromDB()
+	if err != nil {
+		log.Println("[System Auth] Unable to load session registry: " + err.Error())
 	}
 
 	poolManager := NewSwitchableAccountPoolManager(sysdb, &newAuthAgent, key)
@@ -144,6 +172,7 @@ func NewAuthenticationAgent(sessionName string, key []byte, sysdb *db.Database,
 				return
 			case <-ticker.C:
 				listeningAuthAgent.ClearTokenStore()
+				listeningAuthAgent.ClearExpiredSessions()
 			}
 		}
 	}(&newAuthAgent)
@@ -202,6 +231,13 @@ func (a *AuthAgent) HandleLogin(w http.ResponseWriter, r *http.Request) {
 		rememberme = true
 	}
 
+	//Check if this request origin is allowed to access
+	ok, reasons := a.ValidateLoginRequest(w, r)
+	if !ok {
+		sendErrorResponse(w, reasons.Error())
+		return
+	}
+
 	//Check Exponential Login Handler
 	ok, nextRetryIn := a.ExpDelayHandler.AllowImmediateAccess(username, r)
 	if !ok {
@@ -215,17 +251,11 @@ func (a *AuthAgent) HandleLogin(w http.ResponseWriter, r *http.Request) {
 	passwordCorrect, rejectionReason := a.ValidateUsernameAndPasswordWithReason(username, password)
 	//The database contain this user information. Check its password if it is correct
 	if passwordCorrect {
-		//Password correct
-		//Check if this request origin is allowed to access
-		ok, reasons := a.ValidateLoginRequest(w, r)
-		if !ok {
-			sendErrorResponse(w, reasons.Error())
+		//Password correct, set user as authenticated unless a second factor is required
+		if !a.LoginUserWithPassword(w, r, username, rememberme, LoginMethodPassword) {
 			return
 		}
 
-		// Set user as authenticated
-		a.LoginUserByRequest(w, r, username, rememberme)
-
 		//Reset user retry count if any
 		a.ExpDelayHandler.ResetUserRetryCount(username, r)
 
@@ -276,7 +306,7 @@ func (a *AuthAgent) ValidateLoginRequest(w http.ResponseWriter, r *http.Request)
 	//Get the ip address of the request
 	clientIP, err := network.GetIpFromRequest(r)
 	if err != nil {
-		return false, nil
+		return false, errors.New("Unable to resolve the IP address of this request")
 	}
 
 	return a.ValidateLoginIpAccess(clientIP)
@@ -284,6 +314,10 @@ func (a *AuthAgent) ValidateLoginRequest(w http.ResponseWriter, r *http.Request)
 
 func (a *AuthAgent) ValidateLoginIpAccess(ipv4 string) (bool, error) {
 	ipv4 = strings.ReplaceAll(ipv4, " ", "")
+	if host, _, err := net.SplitHostPort(ipv4); err == nil {
+		//Remote address with port, e.g. from FTP or SFTP connections
+		ipv4 = host
+	}
 	//Check if the account is whitelisted
 	if a.WhitelistManager.Enabled && !a.WhitelistManager.IsWhitelisted(ipv4) {
 		//Whitelist enabled but this IP is not whitelisted
@@ -298,13 +332,53 @@ func (a *AuthAgent) ValidateLoginIpAccess(ipv4 string) (bool, error) {
 	return true, nil
 }
 
-// Login the user by creating a valid session for this user
-func (a *AuthAgent) LoginUserByRequest(w http.ResponseWriter, r *http.Request, username string, rememberme bool) {
+// Finish a login after the password of the user is verified. All password based logins (local, LDAP
+// and account switching) must go through this function, so the second factor cannot be skipped.
+// Return false if the login is not completed, in which case the request is already replied
+func (a *AuthAgent) LoginUserWithPassword(w http.ResponseWriter, r *http.Request, username string, rememberme bool, method string) bool {
+	if method == LoginMethodSwitch {
+		//The account switcher cannot run the second factor, the user has to login from the login page
+		if err := a.LoginUserWithoutSecondFactor(w, r, username, rememberme, method); err != nil {
+			sendErrorResponse(w, err.Error())
+			return false
+		}
+		return true
+	} else if a.SecondFactorHandler != nil && a.SecondFactorHandler(w, r, username, rememberme) {
+		return false
+	}
+
+	a.LoginUserByRequest(w, r, username, rememberme, method)
+	return true
+}
+
+// Login the user with a method that cannot run the second factor, e.g. account switching, OAuth
+// and autologin tokens. Users that must login with a second factor are refused
+func (a *AuthAgent) LoginUserWithoutSecondFactor(w http.ResponseWriter, r *http.Request, username string, rememberme bool, method string) error {
+	if a.SecondFactorRequired != nil && a.SecondFactorRequired(username) {
+		return errors.New("This account requires passkey login, please sign in from the login page")
+	}
+	a.LoginUserByRequest(w, r, username, rememberme, method)
+	return nil
+}
+
+// Login the user by creating a valid session for this user, method is one of the LoginMethod* constants
+func (a *AuthAgent) LoginUserByRequest(w http.ResponseWriter, r *http.Request, username string, rememberme bool, method string) {
 	session, _ := a.SessionStore.Get(r, a.SessionName)
 
+	//Replace the previous session of this client if any
+	if previousSessionID, ok := session.Values["sessionid"].(string); ok && previousSessionID != "" {
+		a.RevokeSession(previousSessionID)
+	}
+
+	newSession, err := a.newSession(r, username, method, rememberme)
+	if err != nil {
+		log.Println("[System Auth] Unable to create session for " + username + ": " + err.Error())
+	}
+
 	session.Values["authenticated"] = true
 	session.Values["username"] = username
 	session.Values["rememberMe"] = rememberme
+	session.Values["sessionid"] = newSession.ID
 
 	CookieSetSameSitePolicy := http.SameSiteNoneMode
 	if r.TLS == nil {
@@ -348,7 +422,7 @@ func (a *AuthAgent) HandleLogout(w http.ResponseWriter, r *http.Request) {
 
 	if fallbackAccount != "" {
 		//Switch to fallback account
-		a.LoginUserByRequest(w, r, fallbackAccount, true)
+		a.LoginUserByRequest(w, r, fallbackAccount, true, LoginMethodSwitch)
 	}
 
 	w.Write([]byte("OK"))
@@ -359,8 +433,12 @@ func (a *AuthAgent) Logout(w http.ResponseWriter, r *http.Request) error {
 	if err != nil {
 		return err
 	}
+	if sessionID, ok := session.Values["sessionid"].(string); ok && sessionID != "" {
+		a.RevokeSession(sessionID)
+	}
 	session.Values["authenticated"] = false
 	session.Values["username"] = nil
+	session.Values["sessionid"] = nil
 	session.Save(r, w)
 
 	return nil
@@ -443,7 +521,10 @@ func (a *AuthAgent) CheckAuth(r *http.Request) bool {
 	if auth, ok := session.Values["authenticated"].(bool); !ok || !auth {
 		return false
 	}
-	return true
+
+	//The session must also exist in the session registry, i.e. not revoked or expired
+	_, err := a.GetSessionFromRequest(r)
+	return err == nil
 }
 
 // Handle de-register of users. Require POST username.
@@ -501,6 +582,13 @@ func (a *AuthAgent) UnregisterUser(username string) error {
 
 	//Remove user from switchable accounts
 	a.SwitchableAccountManager.RemoveUserFromAllSwitchableAccountPool(username)
+
+	//Logout the user from all devices
+	a.RevokeUserSessions(username, "")
+
+	if a.OnUserRemoved != nil {
+		a.OnUserRemoved(username)
+	}
 	return nil
 }
 
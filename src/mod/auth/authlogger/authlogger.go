@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"errors"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"strconv"
@@ -11,6 +12,7 @@ import (
 	"time"
 
 	"imuslab.com/arozos/mod/database"
+	"imuslab.com/arozos/mod/network"
 	"imuslab.com/arozos/mod/utils"
 )
 
@@ -24,7 +26,8 @@ import (
 */
 
 type Logger struct {
-	database *database.Database
+	database  *database.Database
+	listeners []func(LoginRecord)
 }
 
 type LoginRecord struct {
@@ -48,18 +51,19 @@ func NewLogger() (*Logger, error) {
 	}, nil
 }
 
+//Add a listener that get notified on every logged authentication, e.g. the auto ban policy
+func (l *Logger) AddListener(listener func(LoginRecord)) {
+	l.listeners = append(l.listeners, listener)
+}
+
 //Log the current authentication to record, Require the request object and login status
 func (l *Logger) LogAuth(r *http.Request, loginStatus bool) error {
 	username, _ := utils.PostPara(r, "username")
 	timestamp := time.Now().Unix()
-	//handling the reverse proxy remote IP issue
-	remoteIP := r.Header.Get("X-FORWARDED-FOR")
-	if remoteIP != "" {
-		//grab the last known remote IP from header
-		remoteIPs := strings.Split(remoteIP, ", ")
-		remoteIP = remoteIPs[len(remoteIPs)-1]
-	} else {
-		//if there is no X-FORWARDED-FOR, use default remote IP
+	//Use the same client IP as the login IP access check, so auto ban applies to the checked address
+	remoteIP, err := network.GetIpFromRequest(r)
+	if host, _, _ := net.SplitHostPort(r.RemoteAddr); err != nil || host == remoteIP {
+		//Direct connection, keep the port of the remote address
 		remoteIP = r.RemoteAddr
 	}
 	return l.LogAuthByRequestInfo(username, remoteIP, timestamp, loginStatus, "web")
@@ -78,7 +82,10 @@ func (l *Logger) LogAuthByRequestInfo(username string, remoteAddr string, timest
 
 	//Split the remote address into ipaddr and port
 	remoteAddrInfo := []string{"unknown", "N/A"}
-	if strings.Contains(remoteAddr, ":") {
+	if net.ParseIP(remoteAddr) != nil {
+		//IP address without port, e.g. from X-Forwarded-For header
+		remoteAddrInfo = []string{remoteAddr, "N/A"}
+	} else if strings.Contains(remoteAddr, ":") {
 		//For general IPv4  address
 		remoteAddrInfo = strings.Split(remoteAddr, ":")
 	}
@@ -109,6 +116,11 @@ func (l *Logger) LogAuthByRequestInfo(username string, remoteAddr string, timest
 		Port:           port,
 	}
 
+	//Notify the listeners
+	for _, listener := range l.listeners {
+		listener(thisRecord)
+	}
+
 	//Write the log to it
 	entryKey := strconv.Itoa(int(time.Now().UnixNano()))
 	err := l.database.Write(tableName, entryKey, thisRecord)
@@ -122,6 +134,22 @@ func (l *Logger) LogAuthByRequestInfo(username string, remoteAddr string, timest
 
 }
 
+//Create a consistent snapshot of all login records, for system backup
+func (l *Logger) Snapshot() (map[string][][][]byte, error) {
+	return l.database.Snapshot(nil)
+}
+
+//Replace the login records of the given months with the snapshot
+func (l *Logger) Restore(tables map[string][][][]byte) error {
+	for tableName, entries := range tables {
+		err := l.database.RestoreTable(tableName, entries)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 //Close the database when system shutdown
 func (l *Logger) Close() {
 	l.database.Close()
@@ -10,7 +10,6 @@ import (
 	"strings"
 	"time"
 
-	"github.com/gorilla/sessions"
 	uuid "github.com/satori/go.uuid"
 	"imuslab.com/arozos/mod/utils"
 )
@@ -112,7 +111,6 @@ func (a *AuthAgent) HandleAutologinTokenLogin(w http.ResponseWriter, r *http.Req
 		return
 	}
 
-	session, _ := a.SessionStore.Get(r, a.SessionName)
 	token, err := utils.GetPara(r, "token")
 	if err != nil {
 		//Username not defined
@@ -150,19 +148,13 @@ func (a *AuthAgent) HandleAutologinTokenLogin(w http.ResponseWriter, r *http.Req
 	}
 
 	//Ok. Allow this client to login
-	session.Values["authenticated"] = true
-	session.Values["username"] = username
-	session.Values["rememberMe"] = false
-
-	log.Println(username + " logged in via auto-login token")
-
-	//Check if remember me is clicked. If yes, set the maxage to 1 week.
-	session.Options = &sessions.Options{
-		MaxAge: 3600 * 1, //1 hour
-		Path:   "/",
+	err = a.LoginUserWithoutSecondFactor(w, r, username, false, LoginMethodAutologin)
+	if err != nil {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("403 - Forbidden (" + err.Error() + ")"))
+		return
 	}
-
-	session.Save(r, w)
+	log.Println(username + " logged in via auto-login token")
 
 	redirectTarget, _ := utils.GetPara(r, "redirect")
 	if redirectTarget != "" {
@@ -6,6 +6,7 @@ import (
 	"net/http"
 	"strconv"
 
+	auth "imuslab.com/arozos/mod/auth"
 	"imuslab.com/arozos/mod/utils"
 )
 
@@ -113,6 +114,13 @@ func (ldap *ldapHandler) HandleLogin(w http.ResponseWriter, r *http.Request) {
 		rememberme = true
 	}
 
+	//Check if this request origin is allowed to access
+	allowAccess, err := ldap.ag.ValidateLoginRequest(w, r)
+	if !allowAccess {
+		utils.SendErrorResponse(w, err.Error())
+		return
+	}
+
 	//Check the database and see if this user is in the database
 	passwordCorrect, err := ldap.ldapreader.Authenticate(username, password)
 	if err != nil {
@@ -129,8 +137,10 @@ func (ldap *ldapHandler) HandleLogin(w http.ResponseWriter, r *http.Request) {
 			authkey := ldap.syncdb.Store(username)
 			utils.SendJSONResponse(w, "{\"redirect\":\"system/auth/ldap/newPassword?username="+username+"&displayname="+username+"&authkey="+authkey+"\"}")
 		} else {
-			// Set user as authenticated
-			ldap.ag.LoginUserByRequest(w, r, username, rememberme)
+			// Set user as authenticated unless a second factor is required
+			if !ldap.ag.LoginUserWithPassword(w, r, username, rememberme, auth.LoginMethodLDAP) {
+				return
+			}
 			//Print the login message to console
 			log.Println(username + " logged in.")
 			ldap.ag.Logger.LogAuth(r, true)
@@ -186,7 +196,7 @@ func (ldap *ldapHandler) HandleSetPassword(w http.ResponseWriter, r *http.Reques
 			//create user account and login
 			ldap.ag.CreateUserAccount(username, password, convertedInfo.EquivGroup)
 			ldap.ag.Logger.LogAuth(r, true)
-			ldap.ag.LoginUserByRequest(w, r, username, false)
+			ldap.ag.LoginUserByRequest(w, r, username, false, auth.LoginMethodLDAP)
 			utils.SendOK(w)
 			return
 		} else {
@@ -6,7 +6,6 @@ import (
 	"log"
 	"net/http"
 	"strconv"
-	"strings"
 	"time"
 
 	"golang.org/x/oauth2"
@@ -14,6 +13,7 @@ import (
 	syncdb "imuslab.com/arozos/mod/auth/oauth2/syncdb"
 	reg "imuslab.com/arozos/mod/auth/register"
 	db "imuslab.com/arozos/mod/database"
+	"imuslab.com/arozos/mod/network"
 	"imuslab.com/arozos/mod/utils"
 )
 
@@ -90,6 +90,12 @@ func (oh *OauthHandler) HandleAuthorize(w http.ResponseWriter, r *http.Request)
 		utils.SendTextResponse(w, "OAuth disabled")
 		return
 	}
+	//check if this request origin is allowed to access
+	allowAccess, err := oh.ag.ValidateLoginRequest(w, r)
+	if !allowAccess {
+		utils.SendTextResponse(w, err.Error())
+		return
+	}
 	//read the uuid(aka the state parameter)
 	uuid, err := r.Cookie("uuid_login")
 	if err != nil {
@@ -121,9 +127,10 @@ func (oh *OauthHandler) HandleAuthorize(w http.ResponseWriter, r *http.Request)
 	}
 
 	//get user info
+	clientIP, _ := network.GetIpFromRequest(r)
 	username, err := getUserInfo(token.AccessToken, oh.coredb)
 	if err != nil {
-		oh.ag.Logger.LogAuthByRequestInfo(username, r.RemoteAddr, time.Now().Unix(), false, "web")
+		oh.ag.Logger.LogAuthByRequestInfo(username, clientIP, time.Now().Unix(), false, "web")
 		utils.SendTextResponse(w, "Failed to obtain user info.")
 		return
 	}
@@ -133,27 +140,22 @@ func (oh *OauthHandler) HandleAuthorize(w http.ResponseWriter, r *http.Request)
 		//if registration is closed, return error message.
 		//also makr the login as fail.
 		if oh.reg.AllowRegistry {
-			oh.ag.Logger.LogAuthByRequestInfo(username, r.RemoteAddr, time.Now().Unix(), false, "web")
+			oh.ag.Logger.LogAuthByRequestInfo(username, clientIP, time.Now().Unix(), false, "web")
 			http.Redirect(w, r, "/public/register/register.html?user="+username, http.StatusFound)
 		} else {
-			oh.ag.Logger.LogAuthByRequestInfo(username, r.RemoteAddr, time.Now().Unix(), false, "web")
+			oh.ag.Logger.LogAuthByRequestInfo(username, clientIP, time.Now().Unix(), false, "web")
 			w.Header().Set("Content-Type", "text/html")
 			w.Write([]byte("You are not allowed to register in this system.&nbsp;<a href=\"/\">Back</a>"))
 		}
 	} else {
-		log.Println(username + " logged in via OAuth.")
-		oh.ag.LoginUserByRequest(w, r, username, true)
-		//handling the reverse proxy remote IP issue
-		remoteIP := r.Header.Get("X-FORWARDED-FOR")
-		if remoteIP != "" {
-			//grab the last known remote IP from header
-			remoteIPs := strings.Split(remoteIP, ", ")
-			remoteIP = remoteIPs[len(remoteIPs)-1]
-		} else {
-			//if there is no X-FORWARDED-FOR, use default remote IP
-			remoteIP = r.RemoteAddr
+		err = oh.ag.LoginUserWithoutSecondFactor(w, r, username, true, auth.LoginMethodOAuth)
+		if err != nil {
+			oh.ag.Logger.LogAuthByRequestInfo(username, clientIP, time.Now().Unix(), false, "web")
+			utils.SendTextResponse(w, err.Error())
+			return
 		}
-		oh.ag.Logger.LogAuthByRequestInfo(username, remoteIP, time.Now().Unix(), true, "web")
+		log.Println(username + " logged in via OAuth.")
+		oh.ag.Logger.LogAuthByRequestInfo(username, clientIP, time.Now().Unix(), true, "web")
 		//clear the cooke
 		oh.addCookie(w, "uuid_login", "-invaild-", -1)
 		//read the value from db and delete it from db
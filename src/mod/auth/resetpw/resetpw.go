@@ -0,0 +1,281 @@
+package resetpw
+
+/*
+	Password Reset via E-mail
+
+	This module issue single use, time limited password reset tokens
+	and send them to the user's registered e-mail address.
+
+	Token format: base64(username|expire|nonce).base64(HMAC-SHA256(payload))
+
+	Only the nonce of the latest issued token of each user is stored in
+	the resetpw table, so requesting a new link or using a link
+	invalidates all the previously issued ones.
+*/
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"imuslab.com/arozos/mod/auth/authlogger"
+	"imuslab.com/arozos/mod/database"
+	"imuslab.com/arozos/mod/network"
+	"imuslab.com/arozos/mod/utils"
+)
+
+const resetTable = "resetpw"
+
+type Options struct {
+	Database      *database.Database
+	Logger        *authlogger.Logger                        //Auth logger for audit entries, can be nil
+	TokenLifetime int64                                     //Lifetime of the reset link in seconds, default 30 minutes
+	MaxPerUser    int                                       //Maximum reset requests per user within the rate limit window, default 3
+	MaxPerIP      int                                       //Maximum reset requests per IP within the rate limit window, default 10
+	RateWindow    int64                                     //Rate limit window in seconds, default 1 hour
+	UserExists    func(username string) bool                //Check if the user exists
+	GetUserEmail  func(username string) (string, error)     //Get the registered email of the user
+	SendResetLink func(username, email, token string) error //Send the reset token to the user
+}
+
+type Manager struct {
+	options    *Options
+	secret     []byte
+	rateLimits map[string][]int64 //user/{username} or ip/{ip} -> request timestamps
+	mutex      sync.Mutex
+}
+
+type storedToken struct {
+	Nonce  string
+	Expire int64
+}
+
+// Create a new password reset manager, the signing secret is generated on first start
+func NewManager(options *Options) (*Manager, error) {
+	if options.TokenLifetime <= 0 {
+		options.TokenLifetime = 1800
+	}
+	if options.MaxPerUser <= 0 {
+		options.MaxPerUser = 3
+	}
+	if options.MaxPerIP <= 0 {
+		options.MaxPerIP = 10
+	}
+	if options.RateWindow <= 0 {
+		options.RateWindow = 3600
+	}
+
+	err := options.Database.NewTable(resetTable)
+	if err != nil {
+		return nil, err
+	}
+
+	secretHex := ""
+	options.Database.Read(resetTable, "secret", &secretHex)
+	secret, err := hex.DecodeString(secretHex)
+	if err != nil || len(secret) < 32 {
+		secret = make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			return nil, err
+		}
+		err = options.Database.Write(resetTable, "secret", hex.EncodeToString(secret))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &Manager{
+		options:    options,
+		secret:     secret,
+		rateLimits: map[string][]int64{},
+	}, nil
+}
+
+// Handle a reset request. Return error only if the request is rate limited,
+// unknown users and users without e-mail are silently ignored to avoid account enumeration.
+// The reset link is sent in background, so the response time does not tell if the user exists
+func (m *Manager) RequestReset(username string, r *http.Request) error {
+	clientIP := m.clientIP(r)
+	if !m.allowRequest("ip/"+clientIP, m.options.MaxPerIP) || !m.allowRequest("user/"+username, m.options.MaxPerUser) {
+		m.audit(username, clientIP, false, "resetpw-request")
+		return errors.New("too many reset requests, please try again later")
+	}
+
+	go m.sendResetLink(username, clientIP)
+	return nil
+}
+
+// Issue a token and send the reset link to the e-mail of the user if the user exists
+func (m *Manager) sendResetLink(username string, clientIP string) {
+	if !m.options.UserExists(username) {
+		m.audit(username, clientIP, false, "resetpw-request")
+		return
+	}
+
+	email, err := m.options.GetUserEmail(username)
+	if err != nil || email == "" {
+		m.audit(username, clientIP, false, "resetpw-request")
+		return
+	}
+
+	token, err := m.IssueToken(username)
+	if err != nil {
+		log.Println("[Reset Password] Unable to issue reset token: " + err.Error())
+		return
+	}
+
+	err = m.options.SendResetLink(username, email, token)
+	if err != nil {
+		log.Println("[Reset Password] Unable to send reset link to " + username + ": " + err.Error())
+		m.audit(username, clientIP, false, "resetpw-request")
+		return
+	}
+
+	m.audit(username, clientIP, true, "resetpw-request")
+}
+
+// Issue a new reset token for the user, previously issued tokens become invalid
+func (m *Manager) IssueToken(username string) (string, error) {
+	nonceBytes := make([]byte, 16)
+	_, err := rand.Read(nonceBytes)
+	if err != nil {
+		return "", err
+	}
+	nonce := hex.EncodeToString(nonceBytes)
+	expire := time.Now().Unix() + m.options.TokenLifetime
+
+	err = m.options.Database.Write(resetTable, "token/"+username, storedToken{
+		Nonce:  nonce,
+		Expire: expire,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	payload := username + "|" + strconv.FormatInt(expire, 10) + "|" + nonce
+	return base64.RawURLEncoding.EncodeToString([]byte(payload)) + "." + base64.RawURLEncoding.EncodeToString(m.sign(payload)), nil
+}
+
+// Check if the token is a valid and unused reset token for the user
+func (m *Manager) ValidateToken(username string, token string) error {
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 {
+		return errors.New("invalid reset token")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return errors.New("invalid reset token")
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || !hmac.Equal(signature, m.sign(string(payload))) {
+		return errors.New("invalid reset token")
+	}
+
+	fields := strings.Split(string(payload), "|")
+	if len(fields) != 3 || fields[0] != username {
+		return errors.New("invalid reset token")
+	}
+	expire, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil || time.Now().Unix() > expire {
+		return errors.New("reset link expired")
+	}
+
+	//Check if this is the latest token and it is not used yet
+	issued := storedToken{}
+	err = m.options.Database.Read(resetTable, "token/"+username, &issued)
+	if err != nil || issued.Nonce == "" || !hmac.Equal([]byte(issued.Nonce), []byte(fields[2])) {
+		return errors.New("reset link already used or replaced by a newer one")
+	}
+	return nil
+}
+
+// Validate and invalidate the token. Return error if the token is not valid
+func (m *Manager) ConsumeToken(username string, token string, r *http.Request) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	err := m.ValidateToken(username, token)
+	if err != nil {
+		m.audit(username, m.clientIP(r), false, "resetpw")
+		return err
+	}
+	m.options.Database.Delete(resetTable, "token/"+username)
+	m.audit(username, m.clientIP(r), true, "resetpw")
+	return nil
+}
+
+func (m *Manager) sign(payload string) []byte {
+	h := hmac.New(sha256.New, m.secret)
+	h.Write([]byte(payload))
+	return h.Sum(nil)
+}
+
+// Record a request for the given key, return false if the key exceed the limit in the current window
+func (m *Manager) allowRequest(key string, limit int) bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	now := time.Now().Unix()
+	recentRequests := []int64{}
+	for _, t := range m.rateLimits[key] {
+		if now-t < m.options.RateWindow {
+			recentRequests = append(recentRequests, t)
+		}
+	}
+	if len(recentRequests) >= limit {
+		m.rateLimits[key] = recentRequests
+		return false
+	}
+	m.rateLimits[key] = append(recentRequests, now)
+
+	//Drop the idle keys once in a while
+	if len(m.rateLimits) > 4096 {
+		for k, v := range m.rateLimits {
+			if len(v) == 0 || now-v[len(v)-1] >= m.options.RateWindow {
+				delete(m.rateLimits, k)
+			}
+		}
+	}
+	return true
+}
+
+// Get the client IP of the request with the same trusted proxy rules as the login access check
+func (m *Manager) clientIP(r *http.Request) string {
+	clientIP, err := network.GetIpFromRequest(r)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return clientIP
+}
+
+func (m *Manager) audit(username string, remoteAddr string, succeed bool, authType string) {
+	if m.options.Logger != nil {
+		m.options.Logger.LogAuthByRequestInfo(username, remoteAddr, time.Now().Unix(), succeed, authType)
+	}
+}
+
+// Send a reset link to the user's e-mail, require POST username
+func (m *Manager) HandleRequestReset(w http.ResponseWriter, r *http.Request) {
+	username, err := utils.PostPara(r, "username")
+	if err != nil {
+		utils.SendErrorResponse(w, "Invalid username given")
+		return
+	}
+
+	err = m.RequestReset(username, r)
+	if err != nil {
+		utils.SendErrorResponse(w, err.Error())
+		return
+	}
+
+	//Always reply OK so the response does not tell if the user exists
+	utils.SendOK(w)
+}
@@ -0,0 +1,184 @@
+package resetpw
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"imuslab.com/arozos/mod/database"
+	"imuslab.com/arozos/mod/notification/agents/smtpn"
+)
+
+// Minimal SMTP server that accept all mails and forward the mail body to the returned channel
+func startSMTPStandIn(t *testing.T) (int, chan string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	mails := make(chan string, 8)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				reader := bufio.NewReader(conn)
+				reply := func(msg string) { conn.Write([]byte(msg + "\r\n")) }
+				reply("220 localhost ESMTP")
+				for {
+					line, err := reader.ReadString('\n')
+					if err != nil {
+						return
+					}
+					command := strings.ToUpper(strings.TrimSpace(line))
+					switch {
+					case strings.HasPrefix(command, "EHLO"), strings.HasPrefix(command, "HELO"):
+						reply("250-localhost")
+						reply("250 AUTH PLAIN")
+					case strings.HasPrefix(command, "AUTH"):
+						reply("235 Authentication successful")
+					case strings.HasPrefix(command, "DATA"):
+						reply("354 End data with <CR><LF>.<CR><LF>")
+						body := ""
+						for {
+							dataLine, err := reader.ReadString('\n')
+							if err != nil {
+								return
+							}
+							if strings.TrimRight(dataLine, "\r\n") == "." {
+								break
+							}
+							body += dataLine
+						}
+						mails <- body
+						reply("250 OK")
+					case strings.HasPrefix(command, "QUIT"):
+						reply("221 Bye")
+						return
+					default:
+						reply("250 OK")
+					}
+				}
+			}(conn)
+		}
+	}()
+	return listener.Addr().(*net.TCPAddr).Port, mails
+}
+
+func newTestManager(t *testing.T, smtpPort int) *Manager {
+	db, err := database.NewDatabase(filepath.Join(t.TempDir(), "test.db"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(db.Close)
+
+	mailer := smtpn.Agent{
+		SMTPSender:   "noreply@localhost",
+		SMTPPassword: "secret",
+		SMTPDomain:   "localhost",
+		SMTPPort:     smtpPort,
+	}
+	m, err := NewManager(&Options{
+		Database:   db,
+		MaxPerUser: 2,
+		UserExists: func(username string) bool {
+			return username == "alice" || username == "bob"
+		},
+		GetUserEmail: func(username string) (string, error) {
+			if username == "alice" {
+				return "alice@example.com", nil
+			}
+			return "", errors.New("email not set")
+		},
+		SendResetLink: func(username, email, token string) error {
+			return mailer.SendMail(email, "Reset your password", "<a href='http://localhost/reset.html?acc="+url.QueryEscape(username)+"&rkey="+token+"'>Reset</a>")
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestResetLinkByEmail(t *testing.T) {
+	smtpPort, mails := startSMTPStandIn(t)
+	m := newTestManager(t, smtpPort)
+
+	r := httptest.NewRequest("POST", "/system/reset/requestResetLink", nil)
+	if err := m.RequestReset("alice", r); err != nil {
+		t.Fatal(err)
+	}
+	mail := <-mails
+	if !strings.Contains(mail, "To: alice@example.com") {
+		t.Fatalf("reset mail sent to wrong receiver: %s", mail)
+	}
+	token := regexp.MustCompile(`rkey=([A-Za-z0-9_\-.]+)`).FindStringSubmatch(mail)
+	if token == nil {
+		t.Fatalf("reset link not found in mail: %s", mail)
+	}
+
+	//The token is bound to the user and can only be used once
+	if err := m.ValidateToken("bob", token[1]); err == nil {
+		t.Error("token accepted for another user")
+	}
+	if err := m.ValidateToken("alice", token[1]+"x"); err == nil {
+		t.Error("tampered token accepted")
+	}
+	if err := m.ConsumeToken("alice", token[1], r); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.ConsumeToken("alice", token[1], r); err == nil {
+		t.Error("token accepted twice")
+	}
+
+	//Users without e-mail do not receive anything and do not reveal it
+	if err := m.RequestReset("bob", r); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-mails:
+		t.Error("mail sent to user without email")
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestResetTokenExpiryAndRateLimit(t *testing.T) {
+	m := newTestManager(t, 1)
+	m.options.SendResetLink = func(username, email, token string) error { return nil }
+
+	//Expired tokens are rejected even with a valid signature
+	m.options.TokenLifetime = -10
+	token, _ := m.IssueToken("alice")
+	if err := m.ValidateToken("alice", token); err == nil {
+		t.Error("expired token accepted")
+	}
+
+	//Newer token replace the older one
+	m.options.TokenLifetime = 600
+	oldToken, _ := m.IssueToken("alice")
+	newToken, _ := m.IssueToken("alice")
+	if m.ValidateToken("alice", oldToken) == nil || m.ValidateToken("alice", newToken) != nil {
+		t.Error("only the latest token should be valid")
+	}
+
+	r := httptest.NewRequest("POST", "/system/reset/requestResetLink", nil)
+	for i := 0; i < 2; i++ {
+		if err := m.RequestReset("alice", r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := m.RequestReset("alice", r); err == nil {
+		t.Error("expected per user rate limit")
+	}
+}
@@ -0,0 +1,341 @@
+package auth
+
+/*
+	Session Registry
+
+	Every login creates a session record on the server side. The session
+	cookie only carries the session ID, so a session can be revoked from
+	the server even if the cookie is still valid on the client.
+
+	Session records are stored in the auth_sessions table
+	with the session ID as key
+*/
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"time"
+
+	"imuslab.com/arozos/mod/network"
+	"imuslab.com/arozos/mod/utils"
+)
+
+const (
+	sessionTable = "auth_sessions"
+
+	//Interval between two last seen time write back to database
+	sessionLastSeenSaveInterval = 60
+
+	LoginMethodPassword  = "password"
+	LoginMethodLDAP      = "ldap"
+	LoginMethodOAuth     = "oauth"
+	LoginMethodAutologin = "autologin"
+	LoginMethodSwitch    = "switch"
+	LoginMethodWebAuthn  = "webauthn"
+)
+
+type Session struct {
+	ID         string
+	Username   string
+	IP         string
+	UserAgent  string
+	Method     string //Login method, see LoginMethod* constants
+	RememberMe bool
+	CreateTime int64
+	LastSeen   int64
+
+	lastSaved int64
+}
+
+// Session info returned to the frontend
+type SessionInfo struct {
+	ID         string
+	Username   string
+	IP         string
+	UserAgent  string
+	Method     string
+	CreateTime int64
+	LastSeen   int64
+	ExpireTime int64
+	Current    bool //If this is the session of the requesting client
+}
+
+// Load the sessions from database and drop the expired ones
+func (a *AuthAgent) loadSessionsFromDB() error {
+	err := a.Database.NewTable(sessionTable)
+	if err != nil {
+		return err
+	}
+
+	entries, err := a.Database.ListTable(sessionTable)
+	if err != nil {
+		return err
+	}
+	for _, keypairs := range entries {
+		thisSession := Session{}
+		err = json.Unmarshal(keypairs[1], &thisSession)
+		if err != nil || thisSession.expired() {
+			a.Database.Delete(sessionTable, string(keypairs[0]))
+			continue
+		}
+		a.sessions[thisSession.ID] = &thisSession
+	}
+	return nil
+}
+
+// Create a new session record for the request
+func (a *AuthAgent) newSession(r *http.Request, username string, method string, rememberme bool) (Session, error) {
+	randomBytes := make([]byte, 32)
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return Session{}, err
+	}
+
+	clientIP, _ := network.GetIpFromRequest(r)
+	now := time.Now().Unix()
+	newSession := Session{
+		ID:         hex.EncodeToString(randomBytes),
+		Username:   username,
+		IP:         clientIP,
+		UserAgent:  r.UserAgent(),
+		Method:     method,
+		RememberMe: rememberme,
+		CreateTime: now,
+		LastSeen:   now,
+		lastSaved:  now,
+	}
+
+	sessionRecord := newSession
+	a.sessionMutex.Lock()
+	a.sessions[newSession.ID] = &sessionRecord
+	a.sessionMutex.Unlock()
+	return newSession, a.Database.Write(sessionTable, newSession.ID, newSession)
+}
+
+// Get a copy of the session record by the session cookie of the request and update its last seen time
+func (a *AuthAgent) GetSessionFromRequest(r *http.Request) (Session, error) {
+	session, _ := a.SessionStore.Get(r, a.SessionName)
+	sessionID, ok := session.Values["sessionid"].(string)
+	if !ok || sessionID == "" {
+		return Session{}, errors.New("session not found")
+	}
+
+	a.sessionMutex.Lock()
+	thisSession, ok := a.sessions[sessionID]
+	if !ok {
+		a.sessionMutex.Unlock()
+		return Session{}, errors.New("session not found")
+	}
+	if thisSession.expired() {
+		a.sessionMutex.Unlock()
+		a.RevokeSession(sessionID)
+		return Session{}, errors.New("session expired")
+	}
+
+	//The session cookie must belong to the same user
+	username, _ := session.Values["username"].(string)
+	if username != thisSession.Username {
+		a.sessionMutex.Unlock()
+		return Session{}, errors.New("session not found")
+	}
+
+	//Update the last seen time, written back to database periodically
+	now := time.Now().Unix()
+	thisSession.LastSeen = now
+	saveRequired := now-thisSession.lastSaved > sessionLastSeenSaveInterval
+	if saveRequired {
+		thisSession.lastSaved = now
+	}
+	sessionCopy := *thisSession
+	a.sessionMutex.Unlock()
+
+	if saveRequired {
+		a.Database.Write(sessionTable, sessionCopy.ID, sessionCopy)
+	}
+	return sessionCopy, nil
+}
+
+// List the active sessions of the given user. Set username to empty string to list all sessions
+func (a *AuthAgent) ListSessions(username string) []Session {
+	results := []Session{}
+	a.sessionMutex.RLock()
+	for _, thisSession := range a.sessions {
+		if !thisSession.expired() && (username == "" || thisSession.Username == username) {
+			results = append(results, *thisSession)
+		}
+	}
+	a.sessionMutex.RUnlock()
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].LastSeen > results[j].LastSeen
+	})
+	return results
+}
+
+// Revoke a session, the client holding this session will be logged out on next request
+func (a *AuthAgent) RevokeSession(sessionID string) error {
+	a.sessionMutex.Lock()
+	_, ok := a.sessions[sessionID]
+	delete(a.sessions, sessionID)
+	a.sessionMutex.Unlock()
+	if !ok {
+		return errors.New("session not found")
+	}
+	return a.Database.Delete(sessionTable, sessionID)
+}
+
+// Revoke all sessions of the given user except the one with exceptSessionID. Return the number of revoked sessions
+func (a *AuthAgent) RevokeUserSessions(username string, exceptSessionID string) int {
+	revokedCount := 0
+	for _, thisSession := range a.ListSessions(username) {
+		if thisSession.ID == exceptSessionID {
+			continue
+		}
+		if a.RevokeSession(thisSession.ID) == nil {
+			revokedCount++
+		}
+	}
+	return revokedCount
+}
+
+// Remove the expired sessions from the registry
+func (a *AuthAgent) ClearExpiredSessions() {
+	expiredSessionIDs := []string{}
+	a.sessionMutex.RLock()
+	for sessionID, thisSession := range a.sessions {
+		if thisSession.expired() {
+			expiredSessionIDs = append(expiredSessionIDs, sessionID)
+		}
+	}
+	a.sessionMutex.RUnlock()
+
+	for _, sessionID := range expiredSessionIDs {
+		a.RevokeSession(sessionID)
+	}
+}
+
+// Get the expire time of the session, follow the cookie max age set on login
+func (s *Session) expireTime() int64 {
+	if s.RememberMe {
+		return s.LastSeen + 3600*24*7
+	}
+	return s.LastSeen + 3600
+}
+
+func (s *Session) expired() bool {
+	return time.Now().Unix() > s.expireTime()
+}
+
+func (s *Session) info(currentSessionID string) SessionInfo {
+	return SessionInfo{
+		ID:         s.ID,
+		Username:   s.Username,
+		IP:         s.IP,
+		UserAgent:  s.UserAgent,
+		Method:     s.Method,
+		CreateTime: s.CreateTime,
+		LastSeen:   s.LastSeen,
+		ExpireTime: s.expireTime(),
+		Current:    s.ID == currentSessionID,
+	}
+}
+
+/*
+	HTTP Handlers
+*/
+
+// List the sessions (devices) of the current user
+func (a *AuthAgent) HandleListSessions(w http.ResponseWriter, r *http.Request) {
+	currentSession, err := a.GetSessionFromRequest(r)
+	if err != nil {
+		sendErrorResponse(w, "User not logged in")
+		return
+	}
+
+	results := []SessionInfo{}
+	for _, thisSession := range a.ListSessions(currentSession.Username) {
+		results = append(results, thisSession.info(currentSession.ID))
+	}
+	js, _ := json.Marshal(results)
+	sendJSONResponse(w, string(js))
+}
+
+// Revoke a session of the current user. Require POST id, or others=true to logout all other devices
+func (a *AuthAgent) HandleRevokeSession(w http.ResponseWriter, r *http.Request) {
+	currentSession, err := a.GetSessionFromRequest(r)
+	if err != nil {
+		sendErrorResponse(w, "User not logged in")
+		return
+	}
+
+	others, _ := utils.PostPara(r, "others")
+	if others == "true" {
+		a.RevokeUserSessions(currentSession.Username, currentSession.ID)
+		sendOK(w)
+		return
+	}
+
+	sessionID, err := utils.PostPara(r, "id")
+	if err != nil {
+		sendErrorResponse(w, "Invalid session id given")
+		return
+	}
+
+	//Users can only revoke their own sessions
+	a.sessionMutex.RLock()
+	targetSession, ok := a.sessions[sessionID]
+	ok = ok && targetSession.Username == currentSession.Username
+	a.sessionMutex.RUnlock()
+	if !ok {
+		sendErrorResponse(w, "Session not found")
+		return
+	}
+
+	err = a.RevokeSession(sessionID)
+	if err != nil {
+		sendErrorResponse(w, err.Error())
+		return
+	}
+	sendOK(w)
+}
+
+// List the sessions of all users, or a single user if username is given. Admin only
+func (a *AuthAgent) HandleAdminListSessions(w http.ResponseWriter, r *http.Request) {
+	currentSessionID := ""
+	if currentSession, err := a.GetSessionFromRequest(r); err == nil {
+		currentSessionID = currentSession.ID
+	}
+
+	username, _ := utils.GetPara(r, "username")
+	results := []SessionInfo{}
+	for _, thisSession := range a.ListSessions(username) {
+		results = append(results, thisSession.info(currentSessionID))
+	}
+	js, _ := json.Marshal(results)
+	sendJSONResponse(w, string(js))
+}
+
+// Force logout a session by POST id, or all sessions of a user by POST username. Admin only
+func (a *AuthAgent) HandleAdminRevokeSession(w http.ResponseWriter, r *http.Request) {
+	username, _ := utils.PostPara(r, "username")
+	if username != "" {
+		a.RevokeUserSessions(username, "")
+		sendOK(w)
+		return
+	}
+
+	sessionID, err := utils.PostPara(r, "id")
+	if err != nil {
+		sendErrorResponse(w, "Invalid session id or username given")
+		return
+	}
+	err = a.RevokeSession(sessionID)
+	if err != nil {
+		sendErrorResponse(w, err.Error())
+		return
+	}
+	sendOK(w)
+}
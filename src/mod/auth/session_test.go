@@ -0,0 +1,123 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"imuslab.com/arozos/mod/database"
+)
+
+func newTestAuthAgent(t *testing.T) *AuthAgent {
+	//The auth logger writes into ./system/auth, run inside a temporary folder
+	workingDir, _ := os.Getwd()
+	tmpDir := t.TempDir()
+	os.Chdir(tmpDir)
+	t.Cleanup(func() { os.Chdir(workingDir) })
+
+	sysdb, err := database.NewDatabase(filepath.Join(tmpDir, "test.db"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	agent := NewAuthenticationAgent("test_auth", []byte("0123456789abcdef0123456789abcdef"), sysdb, false, func(w http.ResponseWriter, r *http.Request) {})
+	t.Cleanup(func() {
+		agent.Close()
+		sysdb.Close()
+	})
+	return agent
+}
+
+// Login and return the request carrying the session cookie
+func loginTestUser(t *testing.T, agent *AuthAgent, username string, method string) *http.Request {
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "/system/auth/login", nil)
+	r.Header.Set("User-Agent", "test-agent")
+	agent.LoginUserByRequest(w, r, username, false, method)
+
+	authedRequest := httptest.NewRequest(http.MethodGet, "/", nil)
+	for _, c := range w.Result().Cookies() {
+		authedRequest.AddCookie(c)
+	}
+	return authedRequest
+}
+
+func TestSessionRevocation(t *testing.T) {
+	agent := newTestAuthAgent(t)
+	agent.CreateUserAccount("alice", "password", []string{"default"})
+
+	laptop := loginTestUser(t, agent, "alice", LoginMethodPassword)
+	phone := loginTestUser(t, agent, "alice", LoginMethodOAuth)
+	if !agent.CheckAuth(laptop) || !agent.CheckAuth(phone) {
+		t.Fatal("expected both sessions to be logged in")
+	}
+
+	sessions := agent.ListSessions("alice")
+	if len(sessions) != 2 || sessions[0].UserAgent != "test-agent" {
+		t.Fatalf("unexpected session list %+v", sessions)
+	}
+
+	//Revoking one device keeps the other logged in
+	phoneSession, err := agent.GetSessionFromRequest(phone)
+	if err != nil || phoneSession.Method != LoginMethodOAuth {
+		t.Fatalf("unable to get phone session: %v", err)
+	}
+	agent.RevokeSession(phoneSession.ID)
+	if agent.CheckAuth(phone) {
+		t.Error("revoked session still logged in")
+	}
+	if !agent.CheckAuth(laptop) {
+		t.Error("other session should not be revoked")
+	}
+
+	//Removing the user logs out all devices
+	agent.UnregisterUser("alice")
+	if agent.CheckAuth(laptop) || len(agent.ListSessions("")) != 0 {
+		t.Error("sessions not revoked after user removal")
+	}
+}
+
+func TestPasswordLoginRequireSecondFactor(t *testing.T) {
+	agent := newTestAuthAgent(t)
+	challenged := 0
+	agent.SecondFactorRequired = func(username string) bool { return username == "alice" }
+	agent.SecondFactorHandler = func(w http.ResponseWriter, r *http.Request, username string, rememberme bool) bool {
+		if agent.SecondFactorRequired(username) {
+			challenged++
+			return true
+		}
+		return false
+	}
+
+	for _, method := range []string{LoginMethodPassword, LoginMethodLDAP, LoginMethodSwitch} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPost, "/system/auth/login", nil)
+		if agent.LoginUserWithPassword(w, r, "alice", false, method) {
+			t.Errorf("%s: login completed without second factor", method)
+		}
+		if len(w.Result().Cookies()) != 0 {
+			t.Errorf("%s: session created without second factor", method)
+		}
+
+		w = httptest.NewRecorder()
+		if !agent.LoginUserWithPassword(w, r, "bob", false, method) {
+			t.Errorf("%s: login of user without second factor not completed", method)
+		}
+	}
+	if challenged != 2 {
+		t.Errorf("expected second factor challenge for password and LDAP login, got %d", challenged)
+	}
+
+	//OAuth and autologin tokens cannot run the second factor
+	for _, method := range []string{LoginMethodOAuth, LoginMethodAutologin} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "/system/auth/oauth/authorize", nil)
+		if agent.LoginUserWithoutSecondFactor(w, r, "alice", false, method) == nil || len(w.Result().Cookies()) != 0 {
+			t.Errorf("%s: login completed without second factor", method)
+		}
+		if agent.LoginUserWithoutSecondFactor(httptest.NewRecorder(), r, "bob", false, method) != nil {
+			t.Errorf("%s: login of user without second factor refused", method)
+		}
+	}
+}
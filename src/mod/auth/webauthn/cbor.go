@@ -0,0 +1,171 @@
+package webauthn
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+)
+
+/*
+	CBOR Decoder
+
+	Minimal CBOR (RFC 8949) decoder for the attestation object,
+	authenticator data and COSE keys. Only definite length items
+	are supported, which is all authenticators produce
+*/
+
+var errCBORTruncated = errors.New("cbor: unexpected end of data")
+
+const cborMaxDepth = 16
+
+// Decode the first CBOR item in data, returns the item and the number of bytes read
+func decodeCBOR(data []byte) (interface{}, int, error) {
+	d := cborDecoder{data: data}
+	value, err := d.decode(0)
+	if err != nil {
+		return nil, 0, err
+	}
+	return value, d.offset, nil
+}
+
+type cborDecoder struct {
+	data   []byte
+	offset int
+}
+
+func (d *cborDecoder) readByte() (byte, error) {
+	if d.offset >= len(d.data) {
+		return 0, errCBORTruncated
+	}
+	b := d.data[d.offset]
+	d.offset++
+	return b, nil
+}
+
+func (d *cborDecoder) readBytes(n uint64) ([]byte, error) {
+	if n > uint64(len(d.data)-d.offset) {
+		return nil, errCBORTruncated
+	}
+	b := d.data[d.offset : d.offset+int(n)]
+	d.offset += int(n)
+	return b, nil
+}
+
+// Read the argument of the item head
+func (d *cborDecoder) readArgument(info byte) (uint64, error) {
+	switch {
+	case info < 24:
+		return uint64(info), nil
+	case info == 24:
+		b, err := d.readByte()
+		return uint64(b), err
+	case info == 25:
+		b, err := d.readBytes(2)
+		if err != nil {
+			return 0, err
+		}
+		return uint64(binary.BigEndian.Uint16(b)), nil
+	case info == 26:
+		b, err := d.readBytes(4)
+		if err != nil {
+			return 0, err
+		}
+		return uint64(binary.BigEndian.Uint32(b)), nil
+	case info == 27:
+		b, err := d.readBytes(8)
+		if err != nil {
+			return 0, err
+		}
+		return binary.BigEndian.Uint64(b), nil
+	}
+	return 0, errors.New("cbor: indefinite length items are not supported")
+}
+
+func (d *cborDecoder) decode(depth int) (interface{}, error) {
+	if depth > cborMaxDepth {
+		return nil, errors.New("cbor: nested too deep")
+	}
+	head, err := d.readByte()
+	if err != nil {
+		return nil, err
+	}
+	major := head >> 5
+	info := head & 0x1f
+
+	if major == 7 {
+		switch info {
+		case 20:
+			return false, nil
+		case 21:
+			return true, nil
+		case 22, 23:
+			return nil, nil
+		case 25, 26, 27:
+			//Floats are not used by WebAuthn, skip over them
+			_, err := d.readArgument(info)
+			return nil, err
+		}
+		return nil, errors.New("cbor: unsupported simple value")
+	}
+
+	arg, err := d.readArgument(info)
+	if err != nil {
+		return nil, err
+	}
+	switch major {
+	case 0:
+		if arg > math.MaxInt64 {
+			return nil, errors.New("cbor: integer overflow")
+		}
+		return int64(arg), nil
+	case 1:
+		if arg > math.MaxInt64 {
+			return nil, errors.New("cbor: integer overflow")
+		}
+		return -1 - int64(arg), nil
+	case 2:
+		return d.readBytes(arg)
+	case 3:
+		b, err := d.readBytes(arg)
+		return string(b), err
+	case 4:
+		if arg > uint64(len(d.data)) {
+			return nil, errCBORTruncated
+		}
+		items := make([]interface{}, 0, arg)
+		for i := uint64(0); i < arg; i++ {
+			item, err := d.decode(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, item)
+		}
+		return items, nil
+	case 5:
+		if arg > uint64(len(d.data)) {
+			return nil, errCBORTruncated
+		}
+		items := make(map[interface{}]interface{}, arg)
+		for i := uint64(0); i < arg; i++ {
+			key, err := d.decode(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			switch key.(type) {
+			case int64, string:
+			default:
+				return nil, errors.New("cbor: unsupported map key type")
+			}
+			value, err := d.decode(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			items[key] = value
+		}
+		return items, nil
+	case 6:
+		//Tags are not used by WebAuthn, return the tagged item
+		return d.decode(depth + 1)
+	}
+	return nil, errors.New("cbor: unknown major type")
+}
@@ -0,0 +1,97 @@
+package webauthn
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"errors"
+	"math/big"
+)
+
+/*
+	COSE Keys
+
+	Credential public keys are COSE_Key (RFC 9053) encoded.
+	Supported algorithms are ES256, RS256 and EdDSA (Ed25519)
+*/
+
+const (
+	coseAlgES256 = -7
+	coseAlgEdDSA = -8
+	coseAlgRS256 = -257
+
+	coseKtyOKP = 1
+	coseKtyEC2 = 2
+	coseKtyRSA = 3
+)
+
+// Algorithms offered to the authenticator in the order of preference
+var supportedAlgorithms = []int{coseAlgES256, coseAlgEdDSA, coseAlgRS256}
+
+type coseKey struct {
+	alg int64
+	key crypto.PublicKey
+}
+
+// Parse a COSE_Key into a public key
+func parseCOSEKey(data []byte) (*coseKey, error) {
+	item, _, err := decodeCBOR(data)
+	if err != nil {
+		return nil, err
+	}
+	m, ok := item.(map[interface{}]interface{})
+	if !ok {
+		return nil, errors.New("invalid COSE key")
+	}
+	kty, _ := m[int64(1)].(int64)
+	alg, _ := m[int64(3)].(int64)
+
+	switch {
+	case kty == coseKtyEC2 && alg == coseAlgES256:
+		crv, _ := m[int64(-1)].(int64)
+		x, _ := m[int64(-2)].([]byte)
+		y, _ := m[int64(-3)].([]byte)
+		if crv != 1 || len(x) != 32 || len(y) != 32 {
+			return nil, errors.New("invalid P-256 key")
+		}
+		pub := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !pub.Curve.IsOnCurve(pub.X, pub.Y) {
+			return nil, errors.New("P-256 key not on curve")
+		}
+		return &coseKey{alg: alg, key: pub}, nil
+	case kty == coseKtyOKP && alg == coseAlgEdDSA:
+		crv, _ := m[int64(-1)].(int64)
+		x, _ := m[int64(-2)].([]byte)
+		if crv != 6 || len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid Ed25519 key")
+		}
+		return &coseKey{alg: alg, key: ed25519.PublicKey(x)}, nil
+	case kty == coseKtyRSA && alg == coseAlgRS256:
+		n, _ := m[int64(-1)].([]byte)
+		e, _ := m[int64(-2)].([]byte)
+		if len(n) < 256 || len(e) == 0 || len(e) > 4 {
+			return nil, errors.New("invalid RSA key")
+		}
+		exponent := new(big.Int).SetBytes(e)
+		return &coseKey{alg: alg, key: &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exponent.Int64())}}, nil
+	}
+	return nil, errors.New("unsupported credential algorithm")
+}
+
+// Verify the signature over the given data
+func (k *coseKey) verify(data []byte, signature []byte) bool {
+	switch pub := k.key.(type) {
+	case *ecdsa.PublicKey:
+		digest := sha256.Sum256(data)
+		return ecdsa.VerifyASN1(pub, digest[:], signature)
+	case ed25519.PublicKey:
+		return ed25519.Verify(pub, data, signature)
+	case *rsa.PublicKey:
+		digest := sha256.Sum256(data)
+		return rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], signature) == nil
+	}
+	return false
+}
@@ -0,0 +1,368 @@
+package webauthn
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"imuslab.com/arozos/mod/auth"
+	"imuslab.com/arozos/mod/network"
+	"imuslab.com/arozos/mod/utils"
+)
+
+func requestRPID(r *http.Request) (string, error) {
+	rpID := rpIDFromHost(r.Host)
+	if !validRPID(rpID) {
+		return "", errors.New("passkeys require accessing this system with a domain name instead of IP address")
+	}
+	return rpID, nil
+}
+
+// The forwarded scheme is only honored from trusted proxies, otherwise clients could
+// pick the origin that the ceremony is checked against
+func requestOrigin(r *http.Request) string {
+	secure := r.TLS != nil
+	if !secure && network.IsFromTrustedProxy(r) {
+		secure = r.Header.Get("X-Forwarded-Proto") == "https"
+	}
+	return expectedOrigin(r.Host, secure)
+}
+
+func sendCeremony(w http.ResponseWriter, key string, id string, options map[string]interface{}) {
+	js, _ := json.Marshal(map[string]interface{}{
+		key:  options,
+		"id": id,
+	})
+	utils.SendJSONResponse(w, string(js))
+}
+
+func parseAssertion(r *http.Request) (*assertionResponse, error) {
+	response := &assertionResponse{}
+	var err error
+	response.ID, _ = utils.PostPara(r, "credentialId")
+	fields := map[string]*[]byte{
+		"clientDataJSON":    &response.ClientDataJSON,
+		"authenticatorData": &response.AuthenticatorData,
+		"signature":         &response.Signature,
+	}
+	for name, target := range fields {
+		value, _ := utils.PostPara(r, name)
+		*target, err = decode(value)
+		if err != nil || len(*target) == 0 {
+			return nil, errors.New("invalid " + name)
+		}
+	}
+	userHandle, _ := utils.PostPara(r, "userHandle")
+	response.UserHandle, err = decode(userHandle)
+	if err != nil {
+		return nil, errors.New("invalid userHandle")
+	}
+	return response, nil
+}
+
+func (m *Manager) logAuth(r *http.Request, username string, succeed bool) {
+	remoteIP, err := network.GetIpFromRequest(r)
+	if err != nil {
+		remoteIP = r.RemoteAddr
+	}
+	m.options.AuthAgent.Logger.LogAuthByRequestInfo(username, remoteIP, time.Now().Unix(), succeed, "webauthn")
+}
+
+/*
+	Login handlers, accessible without login
+*/
+
+// Check if the user must complete a password login with a passkey
+func (m *Manager) SecondFactorRequired(username string) bool {
+	if !m.isRequired(username) {
+		return false
+	}
+	if len(m.ListCredentials(username)) == 0 {
+		//Admin promoted after the policy is enabled, allow login to register a passkey
+		log.Println("[WebAuthn] " + username + " is required to use passkey but has not registered any")
+		return false
+	}
+	return true
+}
+
+/*
+SecondFactorHandler is called by the auth agent after the password is verified.
+It returns true and replies with the passkey challenge if the user must complete
+the login with a passkey
+*/
+func (m *Manager) SecondFactorHandler(w http.ResponseWriter, r *http.Request, username string, rememberme bool) bool {
+	if !m.SecondFactorRequired(username) {
+		return false
+	}
+
+	rpID, err := requestRPID(r)
+	if err != nil {
+		utils.SendErrorResponse(w, err.Error())
+		return true
+	}
+	id, options, err := m.beginLogin(ceremonySecondFactor, username, rpID, rememberme)
+	if err != nil {
+		utils.SendErrorResponse(w, err.Error())
+		return true
+	}
+	sendCeremony(w, "webauthn", id, options)
+	return true
+}
+
+// Start a passwordless login
+func (m *Manager) HandleLoginBegin(w http.ResponseWriter, r *http.Request) {
+	ok, err := m.options.AuthAgent.ValidateLoginRequest(w, r)
+	if !ok {
+		utils.SendErrorResponse(w, err.Error())
+		return
+	}
+	rpID, err := requestRPID(r)
+	if err != nil {
+		utils.SendErrorResponse(w, err.Error())
+		return
+	}
+	rememberme, _ := utils.PostBool(r, "rmbme")
+	id, options, err := m.beginLogin(ceremonyLogin, "", rpID, rememberme)
+	if err != nil {
+		utils.SendErrorResponse(w, err.Error())
+		return
+	}
+	sendCeremony(w, "publicKey", id, options)
+}
+
+// Finish a passwordless login or the second factor of a password login
+func (m *Manager) HandleLoginFinish(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		utils.SendErrorResponse(w, "invalid request method")
+		return
+	}
+	ok, err := m.options.AuthAgent.ValidateLoginRequest(w, r)
+	if !ok {
+		utils.SendErrorResponse(w, err.Error())
+		return
+	}
+	id, err := utils.PostPara(r, "id")
+	if err != nil {
+		utils.SendErrorResponse(w, "invalid request")
+		return
+	}
+	ceremonyType := ceremonyLogin
+	if secondFactor, _ := utils.PostBool(r, "secondFactor"); secondFactor {
+		ceremonyType = ceremonySecondFactor
+	}
+	response, err := parseAssertion(r)
+	if err != nil {
+		utils.SendErrorResponse(w, err.Error())
+		return
+	}
+
+	c, err := m.finishLogin(id, ceremonyType, response, requestOrigin(r))
+	if err == nil && !m.options.AuthAgent.UserExists(c.Username) {
+		err = errors.New("unknown passkey")
+	}
+	if err != nil {
+		username := ""
+		if cred, credErr := m.GetCredential(response.ID); credErr == nil {
+			username = cred.Username
+		}
+		log.Println("[WebAuthn] Passkey login rejected: " + err.Error())
+		m.logAuth(r, username, false)
+		utils.SendErrorResponse(w, err.Error())
+		return
+	}
+
+	m.options.AuthAgent.LoginUserByRequest(w, r, c.Username, c.RememberMe, auth.LoginMethodWebAuthn)
+	m.options.AuthAgent.SwitchableAccountManager.MatchPoolCreatorOrResetPoolID(c.Username, w, r)
+	log.Println(c.Username + " logged in with passkey.")
+	m.logAuth(r, c.Username, true)
+	utils.SendOK(w)
+}
+
+/*
+	Credential management of the current user
+*/
+
+// Start registering a passkey for the current user
+func (m *Manager) HandleRegisterBegin(w http.ResponseWriter, r *http.Request) {
+	username, err := m.options.AuthAgent.GetUserName(w, r)
+	if err != nil {
+		utils.SendErrorResponse(w, "user not logged in")
+		return
+	}
+	rpID, err := requestRPID(r)
+	if err != nil {
+		utils.SendErrorResponse(w, err.Error())
+		return
+	}
+	id, options, err := m.beginRegistration(username, rpID)
+	if err != nil {
+		utils.SendErrorResponse(w, err.Error())
+		return
+	}
+	sendCeremony(w, "publicKey", id, options)
+}
+
+// Save the passkey created by the authenticator
+func (m *Manager) HandleRegisterFinish(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		utils.SendErrorResponse(w, "invalid request method")
+		return
+	}
+	username, err := m.options.AuthAgent.GetUserName(w, r)
+	if err != nil {
+		utils.SendErrorResponse(w, "user not logged in")
+		return
+	}
+	id, _ := utils.PostPara(r, "id")
+	name, _ := utils.PostPara(r, "name")
+	response := &attestationResponse{}
+	response.ID, _ = utils.PostPara(r, "credentialId")
+	clientDataJSON, _ := utils.PostPara(r, "clientDataJSON")
+	attestationObject, _ := utils.PostPara(r, "attestationObject")
+	transports, _ := utils.PostPara(r, "transports")
+	response.ClientDataJSON, err = decode(clientDataJSON)
+	if err != nil {
+		utils.SendErrorResponse(w, "invalid clientDataJSON")
+		return
+	}
+	response.AttestationObject, err = decode(attestationObject)
+	if err != nil {
+		utils.SendErrorResponse(w, "invalid attestationObject")
+		return
+	}
+	if transports != "" {
+		json.Unmarshal([]byte(transports), &response.Transports)
+	}
+
+	//The ceremony must be started by the same user
+	if value, ok := m.ceremonies.Load(id); !ok || value.(*ceremony).Username != username {
+		utils.SendErrorResponse(w, "passkey request expired, please try again")
+		return
+	}
+	cred, err := m.finishRegistration(id, response, requestOrigin(r), name)
+	if err != nil {
+		utils.SendErrorResponse(w, err.Error())
+		return
+	}
+	log.Println("[WebAuthn] " + username + " registered passkey " + cred.Name)
+	utils.SendOK(w)
+}
+
+// List the passkeys and settings of the current user
+func (m *Manager) HandleListCredentials(w http.ResponseWriter, r *http.Request) {
+	username, err := m.options.AuthAgent.GetUserName(w, r)
+	if err != nil {
+		utils.SendErrorResponse(w, "user not logged in")
+		return
+	}
+	type credentialInfo struct {
+		ID       string
+		Name     string
+		RPID     string
+		Created  int64
+		LastUsed int64
+	}
+	credentials := []*credentialInfo{}
+	for _, cred := range m.ListCredentials(username) {
+		credentials = append(credentials, &credentialInfo{
+			ID:       cred.ID,
+			Name:     cred.Name,
+			RPID:     cred.RPID,
+			Created:  cred.Created,
+			LastUsed: cred.LastUsed,
+		})
+	}
+	policy := m.GetPolicy()
+	rpID, err := requestRPID(r)
+	js, _ := json.Marshal(map[string]interface{}{
+		"credentials":  credentials,
+		"secondFactor": m.GetUserSetting(username).SecondFactor,
+		"required":     policy.RequireForAdmin && m.options.IsAdmin != nil && m.options.IsAdmin(username),
+		"rpId":         rpID,
+		"supported":    err == nil,
+	})
+	utils.SendJSONResponse(w, string(js))
+}
+
+// Rename a passkey of the current user
+func (m *Manager) HandleRenameCredential(w http.ResponseWriter, r *http.Request) {
+	username, err := m.options.AuthAgent.GetUserName(w, r)
+	if err != nil {
+		utils.SendErrorResponse(w, "user not logged in")
+		return
+	}
+	id, _ := utils.PostPara(r, "id")
+	name, _ := utils.PostPara(r, "name")
+	err = m.RenameCredential(username, id, name)
+	if err != nil {
+		utils.SendErrorResponse(w, err.Error())
+		return
+	}
+	utils.SendOK(w)
+}
+
+// Revoke a passkey of the current user
+func (m *Manager) HandleRevokeCredential(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		utils.SendErrorResponse(w, "invalid request method")
+		return
+	}
+	username, err := m.options.AuthAgent.GetUserName(w, r)
+	if err != nil {
+		utils.SendErrorResponse(w, "user not logged in")
+		return
+	}
+	id, _ := utils.PostPara(r, "id")
+	err = m.RevokeCredential(username, id)
+	if err != nil {
+		utils.SendErrorResponse(w, err.Error())
+		return
+	}
+	log.Println("[WebAuthn] " + username + " revoked a passkey")
+	utils.SendOK(w)
+}
+
+// Enable or disable passkey as second factor for the current user
+func (m *Manager) HandleSetSecondFactor(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		utils.SendErrorResponse(w, "invalid request method")
+		return
+	}
+	username, err := m.options.AuthAgent.GetUserName(w, r)
+	if err != nil {
+		utils.SendErrorResponse(w, "user not logged in")
+		return
+	}
+	enabled, _ := utils.PostBool(r, "enable")
+	err = m.SetUserSetting(username, &UserSetting{SecondFactor: enabled})
+	if err != nil {
+		utils.SendErrorResponse(w, err.Error())
+		return
+	}
+	utils.SendOK(w)
+}
+
+/*
+	Admin policy
+*/
+
+// Get or set (POST requireAdmin) the passkey policy
+func (m *Manager) HandlePolicy(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		requireAdmin, _ := utils.PostBool(r, "requireAdmin")
+		err := m.SetPolicy(&Policy{RequireForAdmin: requireAdmin})
+		if err != nil {
+			utils.SendErrorResponse(w, err.Error())
+			return
+		}
+		utils.SendOK(w)
+		return
+	}
+	js, _ := json.Marshal(map[string]interface{}{
+		"policy":                  m.GetPolicy(),
+		"adminsWithoutCredential": m.AdminsWithoutCredential(),
+	})
+	utils.SendJSONResponse(w, string(js))
+}
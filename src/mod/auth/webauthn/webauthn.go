@@ -0,0 +1,609 @@
+package webauthn
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"imuslab.com/arozos/mod/auth"
+	"imuslab.com/arozos/mod/database"
+)
+
+/*
+	WebAuthn / Passkey Login
+
+	Users can register FIDO2 security keys or platform passkeys and
+	use them for passwordless login or as a second factor after
+	password login. Attestation is not verified, credentials are
+	trusted on first use like most relying parties do
+*/
+
+const (
+	webauthnTable   = "webauthn"
+	ceremonyTimeout = 5 * time.Minute
+
+	ceremonyRegister     = "register"
+	ceremonyLogin        = "login"  //Passwordless login with discoverable credential
+	ceremonySecondFactor = "second" //Second factor after password login
+
+	flagUserPresent  = 0x01
+	flagUserVerified = 0x04
+	flagAttestedData = 0x40
+)
+
+type Options struct {
+	Database  *database.Database
+	AuthAgent *auth.AuthAgent
+	RPName    string                     //Name of this system shown by the authenticator
+	IsAdmin   func(username string) bool //Check if the user is a member of the admin group
+}
+
+type Credential struct {
+	ID         string //Base64url encoded credential ID
+	Username   string
+	Name       string //Name given by the user, e.g. YubiKey
+	RPID       string //The hostname this credential is registered on
+	PublicKey  []byte //COSE encoded public key
+	SignCount  uint32
+	Transports []string
+	Created    int64
+	LastUsed   int64
+}
+
+type UserSetting struct {
+	SecondFactor bool //Require passkey after password login
+}
+
+type Policy struct {
+	RequireForAdmin bool //Require passkey login for members of the admin group
+}
+
+type ceremony struct {
+	Type       string
+	Username   string
+	Challenge  []byte
+	RPID       string
+	RememberMe bool
+	Expire     time.Time
+}
+
+// Credential returned by navigator.credentials.create()
+type attestationResponse struct {
+	ID                string
+	ClientDataJSON    []byte
+	AttestationObject []byte
+	Transports        []string
+}
+
+// Credential returned by navigator.credentials.get()
+type assertionResponse struct {
+	ID                string
+	ClientDataJSON    []byte
+	AuthenticatorData []byte
+	Signature         []byte
+	UserHandle        []byte
+}
+
+type clientData struct {
+	Type      string `json:"type"`
+	Challenge string `json:"challenge"`
+	Origin    string `json:"origin"`
+}
+
+type authenticatorData struct {
+	RPIDHash     []byte
+	Flags        byte
+	SignCount    uint32
+	CredentialID []byte
+	PublicKey    []byte
+}
+
+type Manager struct {
+	options    *Options
+	ceremonies sync.Map //Ceremony ID -> *ceremony
+	mutex      sync.Mutex
+}
+
+// Create a new WebAuthn manager
+func NewManager(options *Options) (*Manager, error) {
+	err := options.Database.NewTable(webauthnTable)
+	if err != nil {
+		return nil, err
+	}
+	if options.RPName == "" {
+		options.RPName = "ArozOS"
+	}
+	return &Manager{options: options}, nil
+}
+
+/*
+	Ceremonies
+*/
+
+func (m *Manager) newCeremony(ceremonyType string, username string, rpID string, rememberme bool) (string, *ceremony, error) {
+	challenge := make([]byte, 32)
+	_, err := rand.Read(challenge)
+	if err != nil {
+		return "", nil, err
+	}
+	idBytes := make([]byte, 16)
+	_, err = rand.Read(idBytes)
+	if err != nil {
+		return "", nil, err
+	}
+
+	//Drop the expired ceremonies
+	now := time.Now()
+	m.ceremonies.Range(func(key, value interface{}) bool {
+		if now.After(value.(*ceremony).Expire) {
+			m.ceremonies.Delete(key)
+		}
+		return true
+	})
+
+	c := &ceremony{
+		Type:       ceremonyType,
+		Username:   username,
+		Challenge:  challenge,
+		RPID:       rpID,
+		RememberMe: rememberme,
+		Expire:     now.Add(ceremonyTimeout),
+	}
+	id := encode(idBytes)
+	m.ceremonies.Store(id, c)
+	return id, c, nil
+}
+
+// Get and remove the ceremony, each ceremony can only be used once
+func (m *Manager) takeCeremony(id string, ceremonyType string) (*ceremony, error) {
+	value, ok := m.ceremonies.LoadAndDelete(id)
+	if !ok {
+		return nil, errors.New("passkey request expired, please try again")
+	}
+	c := value.(*ceremony)
+	if c.Type != ceremonyType || time.Now().After(c.Expire) {
+		return nil, errors.New("passkey request expired, please try again")
+	}
+	return c, nil
+}
+
+// Start registering a new credential for the user
+func (m *Manager) beginRegistration(username string, rpID string) (string, map[string]interface{}, error) {
+	id, c, err := m.newCeremony(ceremonyRegister, username, rpID, false)
+	if err != nil {
+		return "", nil, err
+	}
+
+	params := []map[string]interface{}{}
+	for _, alg := range supportedAlgorithms {
+		params = append(params, map[string]interface{}{"type": "public-key", "alg": alg})
+	}
+
+	//Do not register the same authenticator twice
+	exclude := []map[string]interface{}{}
+	for _, cred := range m.ListCredentials(username) {
+		exclude = append(exclude, map[string]interface{}{"type": "public-key", "id": cred.ID})
+	}
+
+	return id, map[string]interface{}{
+		"challenge": encode(c.Challenge),
+		"rp":        map[string]string{"id": rpID, "name": m.options.RPName},
+		"user": map[string]string{
+			"id":          encode([]byte(username)),
+			"name":        username,
+			"displayName": username,
+		},
+		"pubKeyCredParams":   params,
+		"timeout":            ceremonyTimeout.Milliseconds(),
+		"attestation":        "none",
+		"excludeCredentials": exclude,
+		"authenticatorSelection": map[string]interface{}{
+			"residentKey":      "preferred",
+			"userVerification": "preferred",
+		},
+	}, nil
+}
+
+// Verify the new credential and save it
+func (m *Manager) finishRegistration(id string, response *attestationResponse, origin string, name string) (*Credential, error) {
+	c, err := m.takeCeremony(id, ceremonyRegister)
+	if err != nil {
+		return nil, err
+	}
+	err = verifyClientData(response.ClientDataJSON, "webauthn.create", c, origin)
+	if err != nil {
+		return nil, err
+	}
+
+	item, _, err := decodeCBOR(response.AttestationObject)
+	if err != nil {
+		return nil, errors.New("invalid attestation object")
+	}
+	attestation, ok := item.(map[interface{}]interface{})
+	if !ok {
+		return nil, errors.New("invalid attestation object")
+	}
+	rawAuthData, _ := attestation["authData"].([]byte)
+	authData, err := parseAuthenticatorData(rawAuthData)
+	if err != nil {
+		return nil, err
+	}
+	err = verifyAuthenticatorData(authData, c.RPID, false)
+	if err != nil {
+		return nil, err
+	}
+	if authData.Flags&flagAttestedData == 0 {
+		return nil, errors.New("credential data missing")
+	}
+	_, err = parseCOSEKey(authData.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	credID := encode(authData.CredentialID)
+	if response.ID != "" && response.ID != credID {
+		return nil, errors.New("credential ID mismatch")
+	}
+	if m.options.Database.KeyExists(webauthnTable, "cred/"+credID) {
+		return nil, errors.New("this passkey is already registered")
+	}
+
+	name = strings.TrimSpace(name)
+	if name == "" {
+		name = "Passkey " + time.Now().Format("2006-01-02")
+	}
+	cred := &Credential{
+		ID:         credID,
+		Username:   c.Username,
+		Name:       name,
+		RPID:       c.RPID,
+		PublicKey:  authData.PublicKey,
+		SignCount:  authData.SignCount,
+		Transports: response.Transports,
+		Created:    time.Now().Unix(),
+	}
+	err = m.options.Database.Write(webauthnTable, "cred/"+credID, cred)
+	if err != nil {
+		return nil, err
+	}
+	return cred, nil
+}
+
+// Start a login ceremony. Username is empty for passwordless login
+func (m *Manager) beginLogin(ceremonyType string, username string, rpID string, rememberme bool) (string, map[string]interface{}, error) {
+	allowCredentials := []map[string]interface{}{}
+	userVerification := "required"
+	if ceremonyType == ceremonySecondFactor {
+		for _, cred := range m.ListCredentials(username) {
+			if cred.RPID != rpID {
+				continue
+			}
+			allowed := map[string]interface{}{"type": "public-key", "id": cred.ID}
+			if len(cred.Transports) > 0 {
+				allowed["transports"] = cred.Transports
+			}
+			allowCredentials = append(allowCredentials, allowed)
+		}
+		if len(allowCredentials) == 0 {
+			return "", nil, errors.New("no passkey registered for " + rpID)
+		}
+		//Password is the first factor already
+		userVerification = "discouraged"
+	}
+
+	id, c, err := m.newCeremony(ceremonyType, username, rpID, rememberme)
+	if err != nil {
+		return "", nil, err
+	}
+	return id, map[string]interface{}{
+		"challenge":        encode(c.Challenge),
+		"rpId":             rpID,
+		"timeout":          ceremonyTimeout.Milliseconds(),
+		"userVerification": userVerification,
+		"allowCredentials": allowCredentials,
+	}, nil
+}
+
+// Verify the assertion and return the ceremony with the logged in username
+func (m *Manager) finishLogin(id string, ceremonyType string, response *assertionResponse, origin string) (*ceremony, error) {
+	c, err := m.takeCeremony(id, ceremonyType)
+	if err != nil {
+		return nil, err
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	cred, err := m.GetCredential(response.ID)
+	if err != nil || cred.RPID != c.RPID {
+		return nil, errors.New("unknown passkey")
+	}
+	if ceremonyType == ceremonySecondFactor && cred.Username != c.Username {
+		return nil, errors.New("passkey does not belong to this user")
+	}
+	if len(response.UserHandle) > 0 && string(response.UserHandle) != cred.Username {
+		return nil, errors.New("passkey does not belong to this user")
+	}
+
+	err = verifyClientData(response.ClientDataJSON, "webauthn.get", c, origin)
+	if err != nil {
+		return nil, err
+	}
+	authData, err := parseAuthenticatorData(response.AuthenticatorData)
+	if err != nil {
+		return nil, err
+	}
+	err = verifyAuthenticatorData(authData, c.RPID, ceremonyType == ceremonyLogin)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := parseCOSEKey(cred.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	clientDataHash := sha256.Sum256(response.ClientDataJSON)
+	signed := append(append([]byte{}, response.AuthenticatorData...), clientDataHash[:]...)
+	if !key.verify(signed, response.Signature) {
+		return nil, errors.New("invalid passkey signature")
+	}
+
+	//Counter not increasing means the authenticator might be cloned
+	if (authData.SignCount != 0 || cred.SignCount != 0) && authData.SignCount <= cred.SignCount {
+		return nil, errors.New("passkey signature counter mismatch, the authenticator might be cloned")
+	}
+	cred.SignCount = authData.SignCount
+	cred.LastUsed = time.Now().Unix()
+	err = m.options.Database.Write(webauthnTable, "cred/"+cred.ID, cred)
+	if err != nil {
+		return nil, err
+	}
+
+	c.Username = cred.Username
+	return c, nil
+}
+
+func verifyClientData(raw []byte, expectedType string, c *ceremony, origin string) error {
+	data := clientData{}
+	err := json.Unmarshal(raw, &data)
+	if err != nil {
+		return errors.New("invalid client data")
+	}
+	if data.Type != expectedType {
+		return errors.New("invalid client data type")
+	}
+	if data.Challenge != encode(c.Challenge) {
+		return errors.New("challenge mismatch")
+	}
+	if data.Origin != origin {
+		return errors.New("origin mismatch")
+	}
+	return nil
+}
+
+func verifyAuthenticatorData(authData *authenticatorData, rpID string, requireUserVerified bool) error {
+	rpIDHash := sha256.Sum256([]byte(rpID))
+	if !bytes.Equal(authData.RPIDHash, rpIDHash[:]) {
+		return errors.New("relying party ID mismatch")
+	}
+	if authData.Flags&flagUserPresent == 0 {
+		return errors.New("user presence not confirmed")
+	}
+	if requireUserVerified && authData.Flags&flagUserVerified == 0 {
+		return errors.New("user verification (PIN or biometric) is required for passwordless login")
+	}
+	return nil
+}
+
+func parseAuthenticatorData(data []byte) (*authenticatorData, error) {
+	if len(data) < 37 {
+		return nil, errors.New("invalid authenticator data")
+	}
+	result := &authenticatorData{
+		RPIDHash:  data[:32],
+		Flags:     data[32],
+		SignCount: binary.BigEndian.Uint32(data[33:37]),
+	}
+	if result.Flags&flagAttestedData == 0 {
+		return result, nil
+	}
+
+	//AAGUID (16 bytes), credential ID length (2 bytes), credential ID and COSE public key
+	rest := data[37:]
+	if len(rest) < 18 {
+		return nil, errors.New("invalid attested credential data")
+	}
+	idLength := int(binary.BigEndian.Uint16(rest[16:18]))
+	rest = rest[18:]
+	if idLength == 0 || len(rest) < idLength {
+		return nil, errors.New("invalid credential ID")
+	}
+	result.CredentialID = rest[:idLength]
+	_, keyLength, err := decodeCBOR(rest[idLength:])
+	if err != nil {
+		return nil, errors.New("invalid credential public key")
+	}
+	result.PublicKey = rest[idLength : idLength+keyLength]
+	return result, nil
+}
+
+/*
+	Credentials and settings
+*/
+
+// Get the credential with the given base64url encoded ID
+func (m *Manager) GetCredential(id string) (*Credential, error) {
+	cred := Credential{}
+	if id == "" || !m.options.Database.KeyExists(webauthnTable, "cred/"+id) {
+		return nil, errors.New("credential not found")
+	}
+	err := m.options.Database.Read(webauthnTable, "cred/"+id, &cred)
+	if err != nil {
+		return nil, err
+	}
+	return &cred, nil
+}
+
+// List the credentials of the user, oldest first
+func (m *Manager) ListCredentials(username string) []*Credential {
+	results := []*Credential{}
+	entries, err := m.options.Database.ListTable(webauthnTable)
+	if err != nil {
+		return results
+	}
+	for _, entry := range entries {
+		if !strings.HasPrefix(string(entry[0]), "cred/") {
+			continue
+		}
+		cred := Credential{}
+		err = json.Unmarshal(entry[1], &cred)
+		if err != nil || cred.Username != username {
+			continue
+		}
+		results = append(results, &cred)
+	}
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].Created < results[j].Created
+	})
+	return results
+}
+
+// Rename a credential of the user
+func (m *Manager) RenameCredential(username string, id string, name string) error {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return errors.New("name cannot be empty")
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	cred, err := m.GetCredential(id)
+	if err != nil || cred.Username != username {
+		return errors.New("credential not found")
+	}
+	cred.Name = name
+	return m.options.Database.Write(webauthnTable, "cred/"+id, cred)
+}
+
+// Revoke a credential of the user
+func (m *Manager) RevokeCredential(username string, id string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	cred, err := m.GetCredential(id)
+	if err != nil || cred.Username != username {
+		return errors.New("credential not found")
+	}
+	if len(m.ListCredentials(username)) == 1 && m.isRequired(username) {
+		return errors.New("cannot revoke the last passkey while passkey login is required")
+	}
+	return m.options.Database.Delete(webauthnTable, "cred/"+id)
+}
+
+// Remove all credentials and settings of the user, e.g. when the user is removed
+func (m *Manager) RemoveUser(username string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for _, cred := range m.ListCredentials(username) {
+		m.options.Database.Delete(webauthnTable, "cred/"+cred.ID)
+	}
+	m.options.Database.Delete(webauthnTable, "user/"+username)
+}
+
+func (m *Manager) GetUserSetting(username string) *UserSetting {
+	setting := UserSetting{}
+	if m.options.Database.KeyExists(webauthnTable, "user/"+username) {
+		m.options.Database.Read(webauthnTable, "user/"+username, &setting)
+	}
+	return &setting
+}
+
+func (m *Manager) SetUserSetting(username string, setting *UserSetting) error {
+	if setting.SecondFactor && len(m.ListCredentials(username)) == 0 {
+		return errors.New("register a passkey before enabling it as second factor")
+	}
+	return m.options.Database.Write(webauthnTable, "user/"+username, setting)
+}
+
+func (m *Manager) GetPolicy() *Policy {
+	policy := Policy{}
+	if m.options.Database.KeyExists(webauthnTable, "policy") {
+		m.options.Database.Read(webauthnTable, "policy", &policy)
+	}
+	return &policy
+}
+
+// Update the policy. Require passkey for admins only if all admins have registered one
+func (m *Manager) SetPolicy(policy *Policy) error {
+	if policy.RequireForAdmin {
+		missing := m.AdminsWithoutCredential()
+		if len(missing) > 0 {
+			return errors.New("these administrators must register a passkey first: " + strings.Join(missing, ", "))
+		}
+	}
+	return m.options.Database.Write(webauthnTable, "policy", policy)
+}
+
+// List the admins that have not registered any passkey
+func (m *Manager) AdminsWithoutCredential() []string {
+	results := []string{}
+	if m.options.IsAdmin == nil || m.options.AuthAgent == nil {
+		return results
+	}
+	for _, username := range m.options.AuthAgent.ListUsers() {
+		if m.options.IsAdmin(username) && len(m.ListCredentials(username)) == 0 {
+			results = append(results, username)
+		}
+	}
+	return results
+}
+
+// Check if the user must login with passkey
+func (m *Manager) isRequired(username string) bool {
+	if m.GetUserSetting(username).SecondFactor {
+		return true
+	}
+	return m.GetPolicy().RequireForAdmin && m.options.IsAdmin != nil && m.options.IsAdmin(username)
+}
+
+/*
+	Utilities
+*/
+
+func encode(data []byte) string {
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// Decode base64url with or without padding
+func decode(data string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(data, "="))
+}
+
+// The relying party ID is the hostname used to access this system
+func rpIDFromHost(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(strings.Trim(host, "[]"))
+}
+
+// Check if passkeys can be used on this hostname. Browsers reject IP address as relying party ID
+func validRPID(rpID string) bool {
+	return rpID != "" && net.ParseIP(rpID) == nil
+}
+
+// Expected origin of the client data for the request host
+func expectedOrigin(host string, tls bool) string {
+	u := url.URL{Scheme: "http", Host: host}
+	if tls {
+		u.Scheme = "https"
+	}
+	return u.String()
+}
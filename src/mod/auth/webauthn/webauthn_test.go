@@ -0,0 +1,243 @@
+package webauthn
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"net/http/httptest"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"imuslab.com/arozos/mod/database"
+)
+
+const (
+	testRPID   = "aroz.example.com"
+	testOrigin = "https://aroz.example.com"
+)
+
+// Minimal CBOR encoder for building authenticator responses
+func encodeCBOR(value interface{}) []byte {
+	head := func(major byte, n uint64) []byte {
+		switch {
+		case n < 24:
+			return []byte{major<<5 | byte(n)}
+		case n < 256:
+			return []byte{major<<5 | 24, byte(n)}
+		default:
+			b := []byte{major<<5 | 25, 0, 0}
+			binary.BigEndian.PutUint16(b[1:], uint16(n))
+			return b
+		}
+	}
+	switch v := value.(type) {
+	case int:
+		if v < 0 {
+			return head(1, uint64(-1-v))
+		}
+		return head(0, uint64(v))
+	case []byte:
+		return append(head(2, uint64(len(v))), v...)
+	case string:
+		return append(head(3, uint64(len(v))), v...)
+	case map[interface{}]interface{}:
+		keys := []interface{}{}
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Slice(keys, func(i, j int) bool {
+			return string(encodeCBOR(keys[i])) < string(encodeCBOR(keys[j]))
+		})
+		out := head(5, uint64(len(v)))
+		for _, k := range keys {
+			out = append(out, encodeCBOR(k)...)
+			out = append(out, encodeCBOR(v[k])...)
+		}
+		return out
+	}
+	panic("unsupported type")
+}
+
+type testAuthenticator struct {
+	key       *ecdsa.PrivateKey
+	id        []byte
+	signCount uint32
+}
+
+func newTestAuthenticator(t *testing.T) *testAuthenticator {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testAuthenticator{key: key, id: []byte("test-credential-id")}
+}
+
+func (a *testAuthenticator) authData(flags byte, attested bool) []byte {
+	rpIDHash := sha256.Sum256([]byte(testRPID))
+	data := append([]byte{}, rpIDHash[:]...)
+	data = append(data, flags)
+	data = binary.BigEndian.AppendUint32(data, a.signCount)
+	if attested {
+		x := make([]byte, 32)
+		y := make([]byte, 32)
+		a.key.X.FillBytes(x)
+		a.key.Y.FillBytes(y)
+		data = append(data, make([]byte, 16)...)
+		data = binary.BigEndian.AppendUint16(data, uint16(len(a.id)))
+		data = append(data, a.id...)
+		data = append(data, encodeCBOR(map[interface{}]interface{}{1: 2, 3: -7, -1: 1, -2: x, -3: y})...)
+	}
+	return data
+}
+
+func clientDataJSON(ceremonyType string, options map[string]interface{}, origin string) []byte {
+	js, _ := json.Marshal(map[string]string{
+		"type":      ceremonyType,
+		"challenge": options["challenge"].(string),
+		"origin":    origin,
+	})
+	return js
+}
+
+func (a *testAuthenticator) register(t *testing.T, options map[string]interface{}) *attestationResponse {
+	return &attestationResponse{
+		ID:             encode(a.id),
+		ClientDataJSON: clientDataJSON("webauthn.create", options, testOrigin),
+		AttestationObject: encodeCBOR(map[interface{}]interface{}{
+			"fmt":      "none",
+			"attStmt":  map[interface{}]interface{}{},
+			"authData": a.authData(flagUserPresent|flagUserVerified|flagAttestedData, true),
+		}),
+	}
+}
+
+func (a *testAuthenticator) assert(t *testing.T, options map[string]interface{}, flags byte, origin string) *assertionResponse {
+	a.signCount++
+	authData := a.authData(flags, false)
+	clientData := clientDataJSON("webauthn.get", options, origin)
+	clientDataHash := sha256.Sum256(clientData)
+	digest := sha256.Sum256(append(append([]byte{}, authData...), clientDataHash[:]...))
+	signature, err := ecdsa.SignASN1(rand.Reader, a.key, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &assertionResponse{
+		ID:                encode(a.id),
+		ClientDataJSON:    clientData,
+		AuthenticatorData: authData,
+		Signature:         signature,
+	}
+}
+
+func TestRegisterAndLogin(t *testing.T) {
+	sysdb, err := database.NewDatabase(filepath.Join(t.TempDir(), "test.db"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sysdb.Close()
+	m, err := NewManager(&Options{Database: sysdb})
+	if err != nil {
+		t.Fatal(err)
+	}
+	authenticator := newTestAuthenticator(t)
+
+	//Registration
+	id, options, err := m.beginRegistration("alice", testRPID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cred, err := m.finishRegistration(id, authenticator.register(t, options), testOrigin, "YubiKey")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cred.Username != "alice" || cred.Name != "YubiKey" || len(m.ListCredentials("alice")) != 1 {
+		t.Fatalf("unexpected credential %+v", cred)
+	}
+	id, options, _ = m.beginRegistration("alice", testRPID)
+	if _, err := m.finishRegistration(id, authenticator.register(t, options), testOrigin, ""); err == nil {
+		t.Fatal("same credential registered twice")
+	}
+
+	//Passwordless login
+	id, options, _ = m.beginLogin(ceremonyLogin, "", testRPID, true)
+	c, err := m.finishLogin(id, ceremonyLogin, authenticator.assert(t, options, flagUserPresent|flagUserVerified, testOrigin), testOrigin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Username != "alice" || !c.RememberMe {
+		t.Fatalf("unexpected login result %+v", c)
+	}
+	if _, err := m.finishLogin(id, ceremonyLogin, authenticator.assert(t, options, flagUserPresent|flagUserVerified, testOrigin), testOrigin); err == nil {
+		t.Fatal("ceremony replayed")
+	}
+
+	//Rejected assertions
+	id, options, _ = m.beginLogin(ceremonyLogin, "", testRPID, false)
+	if _, err := m.finishLogin(id, ceremonyLogin, authenticator.assert(t, options, flagUserPresent, testOrigin), testOrigin); err == nil {
+		t.Fatal("passwordless login without user verification accepted")
+	}
+	id, options, _ = m.beginLogin(ceremonyLogin, "", testRPID, false)
+	if _, err := m.finishLogin(id, ceremonyLogin, authenticator.assert(t, options, flagUserPresent|flagUserVerified, "https://evil.example.com"), testOrigin); err == nil {
+		t.Fatal("assertion from other origin accepted")
+	}
+	id, options, _ = m.beginLogin(ceremonyLogin, "", testRPID, false)
+	authenticator.signCount = 0
+	if _, err := m.finishLogin(id, ceremonyLogin, authenticator.assert(t, options, flagUserPresent|flagUserVerified, testOrigin), testOrigin); err == nil {
+		t.Fatal("cloned authenticator accepted")
+	}
+	authenticator.signCount = 10
+
+	//Second factor only accepts the credentials of the user
+	if _, _, err := m.beginLogin(ceremonySecondFactor, "bob", testRPID, false); err == nil {
+		t.Fatal("second factor started without credential")
+	}
+	id, options, _ = m.beginLogin(ceremonySecondFactor, "alice", testRPID, false)
+	if len(options["allowCredentials"].([]map[string]interface{})) != 1 {
+		t.Fatal("credential not allowed in second factor")
+	}
+	if _, err := m.finishLogin(id, ceremonySecondFactor, authenticator.assert(t, options, flagUserPresent, testOrigin), testOrigin); err != nil {
+		t.Fatal(err)
+	}
+
+	//Cannot revoke the last credential while second factor is enabled
+	if err := m.SetUserSetting("alice", &UserSetting{SecondFactor: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.RevokeCredential("alice", cred.ID); err == nil {
+		t.Fatal("last credential revoked while required")
+	}
+	m.SetUserSetting("alice", &UserSetting{SecondFactor: false})
+	if err := m.RevokeCredential("bob", cred.ID); err == nil {
+		t.Fatal("credential revoked by other user")
+	}
+	if err := m.RevokeCredential("alice", cred.ID); err != nil || len(m.ListCredentials("alice")) != 0 {
+		t.Fatal("credential not revoked")
+	}
+}
+
+func TestRequestOrigin(t *testing.T) {
+	tests := []struct {
+		remoteAddr string
+		proto      string
+		expected   string
+	}{
+		{"127.0.0.1:5000", "https", testOrigin},
+		{"127.0.0.1:5000", "", "http://aroz.example.com"},
+		//Forwarded scheme from untrusted clients is ignored
+		{"203.0.113.7:5000", "https", "http://aroz.example.com"},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "http://aroz.example.com/", nil)
+		r.RemoteAddr = test.remoteAddr
+		if test.proto != "" {
+			r.Header.Set("X-Forwarded-Proto", test.proto)
+		}
+		if origin := requestOrigin(r); origin != test.expected {
+			t.Errorf("%s (%s): expected %s, got %s", test.remoteAddr, test.proto, test.expected, origin)
+		}
+	}
+}
@@ -0,0 +1,295 @@
+package backup
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+/*
+	Archive packing and encryption
+
+	Encrypted archive: magic | salt (16 bytes) | nonce (12 bytes) | AES-256-GCM ciphertext
+	The key is derived from the passphrase with scrypt
+*/
+
+const encryptedMagic = "AROZBAK1"
+
+// Maximum size of a single entry when reading an archive
+const maxEntrySize = 512 << 20
+
+type archiveContent struct {
+	manifest *Manifest
+	tables   map[string][][][]byte //ao.db table -> key value pairs
+	authlog  map[string][][][]byte //authlog.db table -> key value pairs
+	files    map[string][]byte     //archive path -> file content
+}
+
+type tableEntry struct {
+	Key   string
+	Value json.RawMessage `json:",omitempty"` //Stored as is if the value is JSON
+	Raw   []byte          `json:",omitempty"` //Base64 encoded value if the value is not JSON
+}
+
+func (c *archiveContent) pack() ([]byte, error) {
+	buf := bytes.Buffer{}
+	gw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gw)
+
+	manifest, err := json.MarshalIndent(c.manifest, "", " ")
+	if err != nil {
+		return nil, err
+	}
+	if err := writeTarEntry(tw, "manifest.json", manifest); err != nil {
+		return nil, err
+	}
+
+	for folder, tables := range map[string]map[string][][][]byte{"db": c.tables, "authlog": c.authlog} {
+		for tableName, entries := range tables {
+			tableContent, err := encodeTable(entries)
+			if err != nil {
+				return nil, err
+			}
+			if err := writeTarEntry(tw, folder+"/"+url.PathEscape(tableName)+".json", tableContent); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	for archivePath, fileContent := range c.files {
+		if err := writeTarEntry(tw, "files/"+archivePath, fileContent); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	if err := gw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Read and validate the archive content
+func unpack(archive []byte, passphrase string) (*archiveContent, error) {
+	if isEncrypted(archive) {
+		if passphrase == "" {
+			return nil, errors.New("backup is encrypted, passphrase required")
+		}
+		var err error
+		archive, err = decrypt(archive, passphrase)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	gr, err := gzip.NewReader(bytes.NewReader(archive))
+	if err != nil {
+		return nil, errors.New("invalid backup file")
+	}
+	defer gr.Close()
+
+	content := archiveContent{
+		tables:  map[string][][][]byte{},
+		authlog: map[string][][][]byte{},
+		files:   map[string][]byte{},
+	}
+	tr := tar.NewReader(gr)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, errors.New("invalid backup file")
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		data, err := io.ReadAll(io.LimitReader(tr, maxEntrySize+1))
+		if err != nil {
+			return nil, err
+		}
+		if len(data) > maxEntrySize {
+			return nil, errors.New("backup entry too large: " + header.Name)
+		}
+
+		switch {
+		case header.Name == "manifest.json":
+			manifest := Manifest{}
+			if err := json.Unmarshal(data, &manifest); err != nil {
+				return nil, errors.New("invalid backup manifest")
+			}
+			content.manifest = &manifest
+		case strings.HasPrefix(header.Name, "db/"), strings.HasPrefix(header.Name, "authlog/"):
+			folder, filename, _ := strings.Cut(header.Name, "/")
+			tableName, err := url.PathUnescape(strings.TrimSuffix(filename, ".json"))
+			if err != nil {
+				return nil, errors.New("invalid table name in backup: " + header.Name)
+			}
+			entries, err := decodeTable(data)
+			if err != nil {
+				return nil, errors.New("invalid table in backup: " + tableName)
+			}
+			if folder == "db" {
+				content.tables[tableName] = entries
+			} else {
+				content.authlog[tableName] = entries
+			}
+		case strings.HasPrefix(header.Name, "files/"):
+			content.files[strings.TrimPrefix(header.Name, "files/")] = data
+		}
+	}
+
+	if err := content.validate(); err != nil {
+		return nil, err
+	}
+	return &content, nil
+}
+
+// Check the schema version and if the content matches the manifest
+func (c *archiveContent) validate() error {
+	if c.manifest == nil {
+		return errors.New("backup manifest not found")
+	}
+	if c.manifest.SchemaVersion < 1 || c.manifest.SchemaVersion > SchemaVersion {
+		return errors.New("unsupported backup schema version " + strconv.Itoa(c.manifest.SchemaVersion))
+	}
+	for tableName, count := range c.manifest.Tables {
+		if len(c.tables[tableName]) != count {
+			return errors.New("backup corrupted: table " + tableName + " does not match the manifest")
+		}
+	}
+	for tableName, count := range c.manifest.AuthLogTables {
+		if len(c.authlog[tableName]) != count {
+			return errors.New("backup corrupted: login record table " + tableName + " does not match the manifest")
+		}
+	}
+	for _, files := range c.manifest.Files {
+		for _, archivePath := range files {
+			if _, ok := c.files[archivePath]; !ok {
+				return errors.New("backup corrupted: file " + archivePath + " not found")
+			}
+		}
+	}
+	return nil
+}
+
+func writeTarEntry(tw *tar.Writer, name string, data []byte) error {
+	err := tw.WriteHeader(&tar.Header{
+		Name:    name,
+		Mode:    0644,
+		Size:    int64(len(data)),
+		ModTime: time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = tw.Write(data)
+	return err
+}
+
+func encodeTable(entries [][][]byte) ([]byte, error) {
+	results := []tableEntry{}
+	for _, keypairs := range entries {
+		thisEntry := tableEntry{Key: string(keypairs[0])}
+		if json.Valid(keypairs[1]) {
+			thisEntry.Value = keypairs[1]
+		} else {
+			thisEntry.Raw = keypairs[1]
+		}
+		results = append(results, thisEntry)
+	}
+	return json.Marshal(results)
+}
+
+func decodeTable(data []byte) ([][][]byte, error) {
+	entries := []tableEntry{}
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, err
+	}
+	results := [][][]byte{}
+	for _, entry := range entries {
+		value := []byte(entry.Raw)
+		if entry.Value != nil {
+			value = []byte(entry.Value)
+		}
+		if value == nil {
+			value = []byte{}
+		}
+		results = append(results, [][]byte{[]byte(entry.Key), value})
+	}
+	return results, nil
+}
+
+func isEncrypted(archive []byte) bool {
+	return bytes.HasPrefix(archive, []byte(encryptedMagic))
+}
+
+func deriveKey(passphrase string, salt []byte) ([]byte, error) {
+	return scrypt.Key([]byte(passphrase), salt, 1<<15, 8, 1, 32)
+}
+
+func encrypt(data []byte, passphrase string) ([]byte, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	key, err := deriveKey(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	results := append([]byte(encryptedMagic), salt...)
+	results = append(results, nonce...)
+	return gcm.Seal(results, nonce, data, []byte(encryptedMagic)), nil
+}
+
+func decrypt(data []byte, passphrase string) ([]byte, error) {
+	data = data[len(encryptedMagic):]
+	if len(data) < 16+12 {
+		return nil, errors.New("invalid backup file")
+	}
+	key, err := deriveKey(passphrase, data[:16])
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	nonce := data[16 : 16+gcm.NonceSize()]
+	plaintext, err := gcm.Open(nil, nonce, data[16+gcm.NonceSize():], []byte(encryptedMagic))
+	if err != nil {
+		return nil, errors.New("invalid passphrase or corrupted backup")
+	}
+	return plaintext, nil
+}
@@ -0,0 +1,248 @@
+package backup
+
+/*
+	System Configuration Backup
+
+	This module export the system configurations (users, groups, shares,
+	storage pools, scheduler tasks, login records and other settings) into
+	a single versioned archive and restore them selectively or completely.
+
+	Archive layout (tar.gz, optionally encrypted with AES-256-GCM)
+	manifest.json        Schema version, build version and content summary
+	db/{table}.json      Entries of the system database tables
+	authlog/{table}.json Entries of the login record database tables
+	files/{path}         Configuration files, e.g. system/storage.json
+
+	Database tables are exported with a single read transaction so the
+	exported entries are consistent with each other.
+*/
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"imuslab.com/arozos/mod/auth/authlogger"
+	"imuslab.com/arozos/mod/database"
+)
+
+// Schema version of the archive, increase this when the layout changes
+const SchemaVersion = 1
+
+const (
+	SectionUsers   = "users"
+	SectionGroups  = "groups"
+	SectionShares  = "shares"
+	SectionAuthLog = "authlog"
+	SectionSystem  = "system" //All other database tables
+)
+
+// Database tables that belongs to each section
+var sectionTables = map[string][]string{
+	SectionUsers:  {"auth", "register", "quota", "quota_owner", "desktop", "fs-sortpref"},
+	SectionGroups: {"permission", "quota_policy"},
+	SectionShares: {"share"},
+}
+
+// Runtime states that should not be carried to another host or restored
+var volatileTables = []string{"auth_sessions", "auth_acswitch", "resetpw", "fileopr_jobs", "ipblacklist_temp", "iot_history", "smart_history"}
+
+type Options struct {
+	Database     *database.Database
+	AuthLogger   *authlogger.Logger  //Login records, can be nil
+	FileSections map[string][]string //Section name -> glob patterns of the configuration files, e.g. "scheduler": {"./system/cron.json"}
+	BuildVersion string              //Build version of this host
+	Hostname     string
+	BackupFolder string //Folder to store the safety backup before restore, leave empty to skip
+}
+
+type Manager struct {
+	options *Options
+}
+
+type Manifest struct {
+	SchemaVersion int
+	BuildVersion  string
+	Hostname      string
+	CreateTime    int64
+	Sections      []string
+	Tables        map[string]int      //Database table -> number of entries
+	AuthLogTables map[string]int      //Login record table -> number of entries
+	Files         map[string][]string //Section name -> configuration files
+}
+
+func NewManager(options *Options) *Manager {
+	if options.FileSections == nil {
+		options.FileSections = map[string][]string{}
+	}
+	return &Manager{
+		options: options,
+	}
+}
+
+// List the sections that can be backup on this host
+func (m *Manager) ListSections() []string {
+	sections := []string{SectionUsers, SectionGroups, SectionShares}
+	fileSections := []string{}
+	for sectionName := range m.options.FileSections {
+		fileSections = append(fileSections, sectionName)
+	}
+	sort.Strings(fileSections)
+	sections = append(sections, fileSections...)
+	if m.options.AuthLogger != nil {
+		sections = append(sections, SectionAuthLog)
+	}
+	return append(sections, SectionSystem)
+}
+
+// Export the given sections into an archive, or all sections if sections is empty.
+// The archive is encrypted if passphrase is not empty
+func (m *Manager) Export(sections []string, passphrase string) ([]byte, *Manifest, error) {
+	sections, err := m.resolveSections(sections, m.ListSections())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	content := archiveContent{
+		manifest: &Manifest{
+			SchemaVersion: SchemaVersion,
+			BuildVersion:  m.options.BuildVersion,
+			Hostname:      m.options.Hostname,
+			CreateTime:    time.Now().Unix(),
+			Sections:      sections,
+			Tables:        map[string]int{},
+			AuthLogTables: map[string]int{},
+			Files:         map[string][]string{},
+		},
+		tables:  map[string][][][]byte{},
+		authlog: map[string][][][]byte{},
+		files:   map[string][]byte{},
+	}
+
+	//Snapshot all required tables in one go
+	snapshot, err := m.options.Database.Snapshot(nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	for tableName, entries := range snapshot {
+		if inSlice(sections, tableSection(tableName)) {
+			content.tables[tableName] = entries
+			content.manifest.Tables[tableName] = len(entries)
+		}
+	}
+
+	if inSlice(sections, SectionAuthLog) {
+		authlogSnapshot, err := m.options.AuthLogger.Snapshot()
+		if err != nil {
+			return nil, nil, err
+		}
+		for tableName, entries := range authlogSnapshot {
+			content.authlog[tableName] = entries
+			content.manifest.AuthLogTables[tableName] = len(entries)
+		}
+	}
+
+	for _, sectionName := range sections {
+		patterns, ok := m.options.FileSections[sectionName]
+		if !ok {
+			continue
+		}
+		files := []string{}
+		for _, filename := range matchFiles(patterns) {
+			fileContent, err := os.ReadFile(filename)
+			if err != nil {
+				return nil, nil, err
+			}
+			archivePath := cleanFilePath(filename)
+			content.files[archivePath] = fileContent
+			files = append(files, archivePath)
+		}
+		content.manifest.Files[sectionName] = files
+	}
+
+	archive, err := content.pack()
+	if err != nil {
+		return nil, nil, err
+	}
+	if passphrase != "" {
+		archive, err = encrypt(archive, passphrase)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return archive, content.manifest, nil
+}
+
+// Validate the requested sections against the available ones. Return all available sections if none is requested
+func (m *Manager) resolveSections(requested []string, available []string) ([]string, error) {
+	if len(requested) == 0 {
+		return available, nil
+	}
+	results := []string{}
+	for _, sectionName := range requested {
+		if !inSlice(available, sectionName) {
+			return nil, errors.New("section not available: " + sectionName)
+		}
+		if !inSlice(results, sectionName) {
+			results = append(results, sectionName)
+		}
+	}
+	return results, nil
+}
+
+// Get the section of the database table
+func tableSection(tableName string) string {
+	if inSlice(volatileTables, tableName) {
+		return ""
+	}
+	for sectionName, tables := range sectionTables {
+		if inSlice(tables, tableName) {
+			return sectionName
+		}
+	}
+	return SectionSystem
+}
+
+// List the files matching the glob patterns, sorted and without duplicates
+func matchFiles(patterns []string) []string {
+	results := []string{}
+	for _, pattern := range patterns {
+		matches, _ := filepath.Glob(pattern)
+		for _, match := range matches {
+			info, err := os.Stat(match)
+			if err != nil || info.IsDir() || inSlice(results, match) {
+				continue
+			}
+			results = append(results, match)
+		}
+	}
+	sort.Strings(results)
+	return results
+}
+
+// Check if the archive path belongs to one of the patterns of the section
+func matchPatterns(patterns []string, archivePath string) bool {
+	for _, pattern := range patterns {
+		matched, err := filepath.Match(cleanFilePath(pattern), archivePath)
+		if err == nil && matched {
+			return true
+		}
+	}
+	return false
+}
+
+// Convert a file path to the relative, slash separated form used in the archive
+func cleanFilePath(filename string) string {
+	return filepath.ToSlash(filepath.Clean(filename))
+}
+
+func inSlice(slice []string, val string) bool {
+	for _, item := range slice {
+		if item == val {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,131 @@
+package backup
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"imuslab.com/arozos/mod/database"
+)
+
+func newTestManager(t *testing.T, folder string) (*Manager, *database.Database) {
+	sysdb, err := database.NewDatabase(filepath.Join(folder, "ao.db"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(sysdb.Close)
+	return NewManager(&Options{
+		Database: sysdb,
+		FileSections: map[string][]string{
+			"scheduler": {filepath.Join(folder, "cron.json")},
+		},
+		BuildVersion: "test",
+		Hostname:     "test",
+		BackupFolder: filepath.Join(folder, "backups"),
+	}), sysdb
+}
+
+func TestExportAndSelectiveRestore(t *testing.T) {
+	tmp := t.TempDir()
+	m, sysdb := newTestManager(t, tmp)
+	sysdb.NewTable("auth")
+	sysdb.NewTable("permission")
+	sysdb.NewTable("auth_sessions")
+	sysdb.Write("auth", "passhash/alice", "hash")
+	sysdb.Write("permission", "group/admin", []string{"admin"})
+	sysdb.Write("auth_sessions", "session", "token")
+	os.WriteFile(filepath.Join(tmp, "cron.json"), []byte("[]"), 0644)
+
+	archive, manifest, err := m.Export(nil, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := manifest.Tables["auth_sessions"]; ok {
+		t.Fatal("volatile table should not be exported")
+	}
+
+	if _, err := m.Preview(archive, ""); err == nil {
+		t.Fatal("encrypted backup should require a passphrase")
+	}
+	if _, err := m.Preview(archive, "wrong"); err == nil {
+		t.Fatal("wrong passphrase accepted")
+	}
+	preview, err := m.Preview(archive, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if preview.Manifest.SchemaVersion != SchemaVersion || len(preview.Sections) != len(m.ListSections()) {
+		t.Fatalf("unexpected preview %+v", preview)
+	}
+
+	//Change the configurations and restore the users section only
+	sysdb.Write("auth", "passhash/alice", "changed")
+	sysdb.Write("auth", "passhash/bob", "hash")
+	sysdb.Write("permission", "group/admin", []string{"changed"})
+	os.WriteFile(filepath.Join(tmp, "cron.json"), []byte("changed"), 0644)
+
+	result, err := m.Restore(archive, "secret", []string{SectionUsers})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.SafetyBackup == "" || !result.RestartRequired {
+		t.Fatalf("unexpected restore result %+v", result)
+	}
+
+	passhash := ""
+	sysdb.Read("auth", "passhash/alice", &passhash)
+	if passhash != "hash" || sysdb.KeyExists("auth", "passhash/bob") {
+		t.Fatal("users section not restored")
+	}
+	groups := []string{}
+	sysdb.Read("permission", "group/admin", &groups)
+	if groups[0] != "changed" {
+		t.Fatal("groups section should not be restored")
+	}
+	if content, _ := os.ReadFile(filepath.Join(tmp, "cron.json")); string(content) != "changed" {
+		t.Fatal("scheduler section should not be restored")
+	}
+
+	//Complete restore
+	if _, err := m.Restore(archive, "secret", nil); err != nil {
+		t.Fatal(err)
+	}
+	sysdb.Read("permission", "group/admin", &groups)
+	if content, _ := os.ReadFile(filepath.Join(tmp, "cron.json")); groups[0] != "admin" || string(content) != "[]" {
+		t.Fatal("complete restore failed")
+	}
+}
+
+func TestRejectInvalidBackup(t *testing.T) {
+	tmp := t.TempDir()
+	m, _ := newTestManager(t, tmp)
+
+	content := archiveContent{
+		manifest: &Manifest{
+			SchemaVersion: SchemaVersion + 1,
+			Sections:      []string{SectionUsers},
+		},
+	}
+	archive, _ := content.pack()
+	if _, err := m.Preview(archive, ""); err == nil {
+		t.Fatal("unsupported schema version accepted")
+	}
+
+	//Files outside of the section patterns are never written
+	content = archiveContent{
+		manifest: &Manifest{
+			SchemaVersion: SchemaVersion,
+			Sections:      []string{"scheduler"},
+			Files:         map[string][]string{"scheduler": {"../evil.json"}},
+		},
+		files: map[string][]byte{"../evil.json": []byte("evil")},
+	}
+	archive, _ = content.pack()
+	result, err := m.Restore(archive, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Files) != 0 {
+		t.Fatalf("unexpected restored files %v", result.Files)
+	}
+}
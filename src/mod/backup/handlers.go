@@ -0,0 +1,115 @@
+package backup
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"imuslab.com/arozos/mod/utils"
+)
+
+// Maximum size of the uploaded backup file
+const maxUploadSize = 1 << 30
+
+// List the sections that can be backup on this host
+func (m *Manager) HandleListSections(w http.ResponseWriter, r *http.Request) {
+	js, _ := json.Marshal(m.ListSections())
+	utils.SendJSONResponse(w, string(js))
+}
+
+// Download a backup of the selected sections. Encrypted if passphrase is given
+func (m *Manager) HandleExport(w http.ResponseWriter, r *http.Request) {
+	sections, err := parseSections(r)
+	if err != nil {
+		utils.SendErrorResponse(w, "invalid sections given")
+		return
+	}
+	passphrase, _ := utils.PostPara(r, "passphrase")
+
+	archive, _, err := m.Export(sections, passphrase)
+	if err != nil {
+		utils.SendErrorResponse(w, err.Error())
+		return
+	}
+
+	hostname := strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == '-' || r == '_' {
+			return r
+		}
+		return '_'
+	}, m.options.Hostname)
+	filename := "arozos-backup-" + hostname + "-" + time.Now().Format("20060102-150405") + ".aobak"
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", "attachment; filename="+filename)
+	w.Header().Set("Content-Length", strconv.Itoa(len(archive)))
+	w.Write(archive)
+}
+
+// Show the content of the uploaded backup and the current entries on this host
+func (m *Manager) HandlePreview(w http.ResponseWriter, r *http.Request) {
+	archive, err := readUploadedBackup(w, r)
+	if err != nil {
+		utils.SendErrorResponse(w, err.Error())
+		return
+	}
+	passphrase, _ := utils.PostPara(r, "passphrase")
+
+	preview, err := m.Preview(archive, passphrase)
+	if err != nil {
+		utils.SendErrorResponse(w, err.Error())
+		return
+	}
+	js, _ := json.Marshal(preview)
+	utils.SendJSONResponse(w, string(js))
+}
+
+// Restore the uploaded backup. Restore all sections if no sections is given
+func (m *Manager) HandleRestore(w http.ResponseWriter, r *http.Request) {
+	archive, err := readUploadedBackup(w, r)
+	if err != nil {
+		utils.SendErrorResponse(w, err.Error())
+		return
+	}
+	passphrase, _ := utils.PostPara(r, "passphrase")
+	sections, err := parseSections(r)
+	if err != nil {
+		utils.SendErrorResponse(w, "invalid sections given")
+		return
+	}
+
+	result, err := m.Restore(archive, passphrase, sections)
+	if err != nil {
+		utils.SendErrorResponse(w, err.Error())
+		return
+	}
+	js, _ := json.Marshal(result)
+	utils.SendJSONResponse(w, string(js))
+}
+
+// Parse the sections parameter, a JSON array of section names
+func parseSections(r *http.Request) ([]string, error) {
+	sections := []string{}
+	sectionsJSON, err := utils.PostPara(r, "sections")
+	if err != nil || sectionsJSON == "" {
+		return sections, nil
+	}
+	err = json.Unmarshal([]byte(sectionsJSON), &sections)
+	return sections, err
+}
+
+func readUploadedBackup(w http.ResponseWriter, r *http.Request) ([]byte, error) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxUploadSize)
+	err := r.ParseMultipartForm(32 << 20)
+	if err != nil {
+		return nil, err
+	}
+	file, _, err := r.FormFile("file")
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return io.ReadAll(file)
+}
@@ -0,0 +1,221 @@
+package backup
+
+import (
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+)
+
+/*
+	Backup Preview and Restore
+
+	A backup can be restored completely or only the selected sections.
+	Configuration files are only written if their path matches the
+	patterns of the section on this host.
+*/
+
+type TablePreview struct {
+	Name           string
+	BackupEntries  int
+	CurrentEntries int //-1 if the table does not exist on this host
+}
+
+type FilePreview struct {
+	Path   string
+	Size   int
+	Exists bool //If the file exists on this host and will be overwritten
+}
+
+type SectionPreview struct {
+	Name   string
+	Tables []*TablePreview
+	Files  []*FilePreview
+}
+
+type Preview struct {
+	Manifest *Manifest
+	Sections []*SectionPreview
+}
+
+type RestoreResult struct {
+	Sections        []string
+	Tables          []string
+	Files           []string
+	SafetyBackup    string //Backup of the configurations before restore, empty if not created
+	RestartRequired bool
+}
+
+// Read the backup and compare its content with the current configurations
+func (m *Manager) Preview(archive []byte, passphrase string) (*Preview, error) {
+	content, err := unpack(archive, passphrase)
+	if err != nil {
+		return nil, err
+	}
+
+	current := m.currentEntries()
+	result := Preview{
+		Manifest: content.manifest,
+		Sections: []*SectionPreview{},
+	}
+	for _, sectionName := range content.manifest.Sections {
+		sectionPreview := SectionPreview{
+			Name:   sectionName,
+			Tables: []*TablePreview{},
+			Files:  []*FilePreview{},
+		}
+		currentTables := current["db"]
+		if sectionName == SectionAuthLog {
+			currentTables = current["authlog"]
+		}
+		for _, tableName := range content.sectionTables(sectionName) {
+			currentEntries, ok := currentTables[tableName]
+			if !ok {
+				currentEntries = -1
+			}
+			sectionPreview.Tables = append(sectionPreview.Tables, &TablePreview{
+				Name:           tableName,
+				BackupEntries:  len(content.sectionTableEntries(sectionName, tableName)),
+				CurrentEntries: currentEntries,
+			})
+		}
+		for _, archivePath := range content.manifest.Files[sectionName] {
+			_, err := os.Stat(filepath.FromSlash(archivePath))
+			sectionPreview.Files = append(sectionPreview.Files, &FilePreview{
+				Path:   archivePath,
+				Size:   len(content.files[archivePath]),
+				Exists: err == nil,
+			})
+		}
+		result.Sections = append(result.Sections, &sectionPreview)
+	}
+	return &result, nil
+}
+
+// Restore the selected sections of the backup, or all sections if sections is empty
+func (m *Manager) Restore(archive []byte, passphrase string, sections []string) (*RestoreResult, error) {
+	content, err := unpack(archive, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	sections, err = m.resolveSections(sections, content.manifest.Sections)
+	if err != nil {
+		return nil, err
+	}
+	for _, sectionName := range sections {
+		if !inSlice(m.ListSections(), sectionName) {
+			return nil, errors.New("section not supported on this host: " + sectionName)
+		}
+	}
+
+	if m.options.Database.ReadOnly {
+		return nil, errors.New("database is in read only mode")
+	}
+
+	result := RestoreResult{
+		Sections:        sections,
+		Tables:          []string{},
+		Files:           []string{},
+		RestartRequired: true,
+	}
+
+	//Keep a copy of the current configurations in case the restore goes wrong
+	if m.options.BackupFolder != "" {
+		safetyBackup, err := m.createSafetyBackup()
+		if err != nil {
+			return nil, errors.New("unable to create safety backup: " + err.Error())
+		}
+		result.SafetyBackup = safetyBackup
+	}
+
+	for _, sectionName := range sections {
+		for _, tableName := range content.sectionTables(sectionName) {
+			entries := content.sectionTableEntries(sectionName, tableName)
+			if sectionName == SectionAuthLog {
+				err = m.options.AuthLogger.Restore(map[string][][][]byte{tableName: entries})
+			} else {
+				err = m.options.Database.RestoreTable(tableName, entries)
+			}
+			if err != nil {
+				return &result, errors.New("unable to restore table " + tableName + ": " + err.Error())
+			}
+			result.Tables = append(result.Tables, tableName)
+		}
+
+		for _, archivePath := range content.manifest.Files[sectionName] {
+			if !matchPatterns(m.options.FileSections[sectionName], archivePath) {
+				log.Println("[Backup] Skipping file outside of section " + sectionName + ": " + archivePath)
+				continue
+			}
+			filename := filepath.FromSlash(archivePath)
+			os.MkdirAll(filepath.Dir(filename), 0775)
+			if err := os.WriteFile(filename, content.files[archivePath], 0775); err != nil {
+				return &result, errors.New("unable to restore file " + archivePath + ": " + err.Error())
+			}
+			result.Files = append(result.Files, archivePath)
+		}
+	}
+
+	log.Println("[Backup] Restored sections", sections, "from backup created at", time.Unix(content.manifest.CreateTime, 0).Format("2006-01-02 15:04:05"))
+	return &result, nil
+}
+
+// Export all sections into the backup folder, return the filename of the backup
+func (m *Manager) createSafetyBackup() (string, error) {
+	archive, _, err := m.Export(nil, "")
+	if err != nil {
+		return "", err
+	}
+	os.MkdirAll(m.options.BackupFolder, 0700)
+	filename := filepath.Join(m.options.BackupFolder, "pre-restore-"+strconv.FormatInt(time.Now().Unix(), 10)+".aobak")
+	return filename, os.WriteFile(filename, archive, 0600)
+}
+
+// Number of entries of each table on this host
+func (m *Manager) currentEntries() map[string]map[string]int {
+	results := map[string]map[string]int{
+		"db":      {},
+		"authlog": {},
+	}
+	if snapshot, err := m.options.Database.Snapshot(nil); err == nil {
+		for tableName, entries := range snapshot {
+			results["db"][tableName] = len(entries)
+		}
+	}
+	if m.options.AuthLogger != nil {
+		if snapshot, err := m.options.AuthLogger.Snapshot(); err == nil {
+			for tableName, entries := range snapshot {
+				results["authlog"][tableName] = len(entries)
+			}
+		}
+	}
+	return results
+}
+
+// List the tables in the backup that belongs to the section
+func (c *archiveContent) sectionTables(sectionName string) []string {
+	results := []string{}
+	if sectionName == SectionAuthLog {
+		for tableName := range c.authlog {
+			results = append(results, tableName)
+		}
+	} else {
+		for tableName := range c.tables {
+			if tableSection(tableName) == sectionName {
+				results = append(results, tableName)
+			}
+		}
+	}
+	sort.Strings(results)
+	return results
+}
+
+func (c *archiveContent) sectionTableEntries(sectionName string, tableName string) [][][]byte {
+	if sectionName == SectionAuthLog {
+		return c.authlog[tableName]
+	}
+	return c.tables[tableName]
+}
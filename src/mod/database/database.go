@@ -115,6 +115,43 @@ func (d *Database) ListTable(tableName string) ([][][]byte, error) {
 	return d.listTable(tableName)
 }
 
+/*
+	Create a consistent snapshot of the given tables, or all tables if tableNames is empty.
+	The result map table name to its key value pairs in the same format as ListTable
+*/
+func (d *Database) Snapshot(tableNames []string) (map[string][][][]byte, error) {
+	return d.snapshot(tableNames)
+}
+
+//Replace all the content of the table with the given key value pairs in one transaction
+func (d *Database) RestoreTable(tableName string, entries [][][]byte) error {
+	return d.restoreTable(tableName, entries)
+}
+
+/*
+	Iterate the entries with the given key prefix in key order, or in reverse key order.
+	Return false in fn to stop the iteration. Key and value are only valid inside fn
+	and fn must not write to the database
+
+	err := sysdb.ScanPrefix("MyTable", "username/", false, func(key []byte, value []byte) bool {
+		log.Println(string(key))
+		return true
+	})
+*/
+func (d *Database) ScanPrefix(tableName string, prefix string, reverse bool, fn func(key []byte, value []byte) bool) error {
+	return d.scanPrefix(tableName, prefix, reverse, fn)
+}
+
+//Write multiple key value pairs to the table in one transaction
+func (d *Database) WriteBatch(tableName string, entries map[string]interface{}) error {
+	return d.writeBatch(tableName, entries)
+}
+
+//Delete multiple keys from the table in one transaction
+func (d *Database) DeleteBatch(tableName string, keys []string) error {
+	return d.deleteBatch(tableName, keys)
+}
+
 func (d *Database) Close() {
 	d.close()
 }
@@ -4,6 +4,7 @@
 package database
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
 	"log"
@@ -184,6 +185,156 @@ func (d *Database) listTable(tableName string) ([][][]byte, error) {
 	return results, err
 }
 
+func (d *Database) scanPrefix(tableName string, prefix string, reverse bool, fn func(key []byte, value []byte) bool) error {
+	return d.Db.(*bolt.DB).View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(tableName))
+		if b == nil {
+			return errors.New("table not exists")
+		}
+		c := b.Cursor()
+		bprefix := []byte(prefix)
+		if !reverse {
+			for k, v := c.Seek(bprefix); k != nil && bytes.HasPrefix(k, bprefix); k, v = c.Next() {
+				if !fn(k, v) {
+					break
+				}
+			}
+			return nil
+		}
+
+		//Start from the last key with the prefix, i.e. before the first key after all prefixed keys
+		var k, v []byte
+		if upperBound := prefixUpperBound(bprefix); upperBound == nil {
+			k, v = c.Last()
+		} else if k, _ = c.Seek(upperBound); k == nil {
+			k, v = c.Last()
+		} else {
+			k, v = c.Prev()
+		}
+		for ; k != nil && bytes.HasPrefix(k, bprefix); k, v = c.Prev() {
+			if !fn(k, v) {
+				break
+			}
+		}
+		return nil
+	})
+}
+
+// Return the smallest key that is larger than all keys with the given prefix, nil if there is none
+func prefixUpperBound(prefix []byte) []byte {
+	upperBound := append([]byte{}, prefix...)
+	for i := len(upperBound) - 1; i >= 0; i-- {
+		if upperBound[i] < 0xff {
+			upperBound[i]++
+			return upperBound[:i+1]
+		}
+	}
+	return nil
+}
+
+func (d *Database) writeBatch(tableName string, entries map[string]interface{}) error {
+	if d.ReadOnly {
+		return errors.New("Operation rejected in ReadOnly mode")
+	}
+
+	return d.Db.(*bolt.DB).Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(tableName))
+		if err != nil {
+			return err
+		}
+		for key, value := range entries {
+			jsonString, err := json.Marshal(value)
+			if err != nil {
+				return err
+			}
+			if err := b.Put([]byte(key), jsonString); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (d *Database) deleteBatch(tableName string, keys []string) error {
+	if d.ReadOnly {
+		return errors.New("Operation rejected in ReadOnly mode")
+	}
+
+	return d.Db.(*bolt.DB).Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(tableName))
+		if b == nil {
+			return nil
+		}
+		for _, key := range keys {
+			if err := b.Delete([]byte(key)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (d *Database) snapshot(tableNames []string) (map[string][][][]byte, error) {
+	results := map[string][][][]byte{}
+	err := d.Db.(*bolt.DB).View(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+			tableName := string(name)
+			if len(tableNames) > 0 && !inSlice(tableNames, tableName) {
+				return nil
+			}
+			entries := [][][]byte{}
+			err := b.ForEach(func(k, v []byte) error {
+				//Bolt values are only valid inside the transaction. Copy them out
+				entries = append(entries, [][]byte{append([]byte{}, k...), append([]byte{}, v...)})
+				return nil
+			})
+			results[tableName] = entries
+			return err
+		})
+	})
+	return results, err
+}
+
+func (d *Database) restoreTable(tableName string, entries [][][]byte) error {
+	if d.ReadOnly {
+		return errors.New("Operation rejected in ReadOnly mode")
+	}
+
+	err := d.Db.(*bolt.DB).Update(func(tx *bolt.Tx) error {
+		if tx.Bucket([]byte(tableName)) != nil {
+			if err := tx.DeleteBucket([]byte(tableName)); err != nil {
+				return err
+			}
+		}
+		b, err := tx.CreateBucket([]byte(tableName))
+		if err != nil {
+			return err
+		}
+		for _, keypairs := range entries {
+			if len(keypairs) != 2 {
+				return errors.New("invalid entry in table " + tableName)
+			}
+			if err := b.Put(keypairs[0], keypairs[1]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err == nil {
+		d.Tables.Store(tableName, "")
+	}
+	return err
+}
+
+func inSlice(slice []string, val string) bool {
+	for _, item := range slice {
+		if item == val {
+			return true
+		}
+	}
+	return false
+}
+
 func (d *Database) close() {
 	d.Db.(*bolt.DB).Close()
 }
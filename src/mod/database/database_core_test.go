@@ -131,3 +131,52 @@ func TestDatabaseComplexRW(t *testing.T) {
 
 	defer db.close()
 }
+
+func TestDatabaseScanPrefix(t *testing.T) {
+	teardownSuite := setupSuite(t)
+	defer teardownSuite(t)
+
+	var err error
+	db, err = newDatabase(dbFilePath+dbFileName, false)
+	if err != nil {
+		t.Fatalf("Failed to create a new database: %v", err)
+	}
+	defer db.close()
+
+	err = db.writeBatch("testTable", map[string]interface{}{
+		"a/1": 1, "a/2": 2, "a/3": 3, "b/1": 4, "a\xff": 5,
+	})
+	if err != nil {
+		t.Fatalf("Failed to write batch: %v", err)
+	}
+
+	scan := func(prefix string, reverse bool, limit int) string {
+		keys := ""
+		db.scanPrefix("testTable", prefix, reverse, func(key []byte, value []byte) bool {
+			keys += string(key) + ","
+			limit--
+			return limit != 0
+		})
+		return keys
+	}
+	if keys := scan("a/", false, -1); keys != "a/1,a/2,a/3," {
+		t.Fatalf("Unexpected forward scan result: %s", keys)
+	}
+	if keys := scan("a/", true, 2); keys != "a/3,a/2," {
+		t.Fatalf("Unexpected reverse scan result: %s", keys)
+	}
+	if keys := scan("b/", true, -1); keys != "b/1," {
+		t.Fatalf("Unexpected reverse scan on last prefix: %s", keys)
+	}
+	if keys := scan("", true, 1); keys != "b/1," {
+		t.Fatalf("Unexpected reverse scan on whole table: %s", keys)
+	}
+
+	err = db.deleteBatch("testTable", []string{"a/1", "a/2", "missing"})
+	if err != nil {
+		t.Fatalf("Failed to delete batch: %v", err)
+	}
+	if keys := scan("a/", false, -1); keys != "a/3," {
+		t.Fatalf("Unexpected keys after delete batch: %s", keys)
+	}
+}
@@ -9,6 +9,7 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
 )
@@ -183,6 +184,97 @@ func (d *Database) listTable(tableName string) ([][][]byte, error) {
 	return results, nil
 }
 
+func (d *Database) scanPrefix(tableName string, prefix string, reverse bool, fn func(key []byte, value []byte) bool) error {
+	entries, err := d.listTable(tableName)
+	if err != nil {
+		return err
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if reverse {
+			return string(entries[i][0]) > string(entries[j][0])
+		}
+		return string(entries[i][0]) < string(entries[j][0])
+	})
+	for _, keypairs := range entries {
+		if strings.HasPrefix(string(keypairs[0]), prefix) && !fn(keypairs[0], keypairs[1]) {
+			break
+		}
+	}
+	return nil
+}
+
+func (d *Database) writeBatch(tableName string, entries map[string]interface{}) error {
+	for key, value := range entries {
+		if err := d.write(tableName, key, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *Database) deleteBatch(tableName string, keys []string) error {
+	for _, key := range keys {
+		if d.keyExists(tableName, key) {
+			if err := d.delete(tableName, key); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (d *Database) snapshot(tableNames []string) (map[string][][][]byte, error) {
+	results := map[string][][][]byte{}
+	tableFolders, err := filepath.Glob(filepath.Join(d.Db.(string), "/*"))
+	if err != nil {
+		return results, err
+	}
+	for _, tableFolder := range tableFolders {
+		tableName := filepath.Base(tableFolder)
+		if !isDirectory(tableFolder) || (len(tableNames) > 0 && !inSlice(tableNames, tableName)) {
+			continue
+		}
+		entries, err := d.listTable(tableName)
+		if err != nil {
+			return results, err
+		}
+		results[tableName] = entries
+	}
+	return results, nil
+}
+
+func (d *Database) restoreTable(tableName string, entries [][][]byte) error {
+	if d.ReadOnly {
+		return errors.New("Operation rejected in ReadOnly mode")
+	}
+	tablePath := filepath.Join(d.Db.(string), filepath.Base(tableName))
+	os.RemoveAll(tablePath)
+	err := os.MkdirAll(tablePath, 0755)
+	if err != nil {
+		return err
+	}
+	for _, keypairs := range entries {
+		if len(keypairs) != 2 {
+			return errors.New("invalid entry in table " + tableName)
+		}
+		key := strings.ReplaceAll(string(keypairs[0]), "/", "-SLASH_SIGN-")
+		err = os.WriteFile(filepath.Join(tablePath, key+".entry"), keypairs[1], 0755)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func inSlice(slice []string, val string) bool {
+	for _, item := range slice {
+		if item == val {
+			return true
+		}
+	}
+	return false
+}
+
 func (d *Database) close() {
 	//Nothing to close as it is file system
 }
@@ -679,3 +679,80 @@ func (m *Manager) HandleRenderOverview(w http.ResponseWriter, r *http.Request) {
 	js, _ := json.Marshal(results)
 	utils.SendJSONResponse(w, string(js))
 }
+
+// Handle getting the array states from /proc/mdstat, including the rebuild and scrub progress
+func (m *Manager) HandleMonitorStatus(w http.ResponseWriter, r *http.Request) {
+	arrays, err := m.CheckArrays()
+	if err != nil {
+		utils.SendErrorResponse(w, err.Error())
+		return
+	}
+	js, _ := json.Marshal(arrays)
+	utils.SendJSONResponse(w, string(js))
+}
+
+// Handle starting or stopping a check scrub on an array
+func (m *Manager) HandleScrub(w http.ResponseWriter, r *http.Request) {
+	devName, err := utils.PostPara(r, "devName")
+	if err != nil {
+		utils.SendErrorResponse(w, "invalid device name given")
+		return
+	}
+	opr, _ := utils.PostPara(r, "opr")
+	switch opr {
+	case "", "start":
+		err = m.StartScrub(devName)
+	case "stop":
+		err = m.StopScrub(devName)
+	default:
+		utils.SendErrorResponse(w, "unknown operation")
+		return
+	}
+	if err != nil {
+		utils.SendErrorResponse(w, err.Error())
+		return
+	}
+	utils.SendOK(w)
+}
+
+// Handle listing the finished scrubs of an array
+func (m *Manager) HandleScrubHistory(w http.ResponseWriter, r *http.Request) {
+	devName, err := utils.GetPara(r, "devName")
+	if err != nil {
+		utils.SendErrorResponse(w, "invalid device name given")
+		return
+	}
+	js, _ := json.Marshal(m.GetScrubHistory(devName))
+	utils.SendJSONResponse(w, string(js))
+}
+
+// Handle listing the alerts raised by the monitor
+func (m *Manager) HandleMonitorAlerts(w http.ResponseWriter, r *http.Request) {
+	js, _ := json.Marshal(m.GetAlerts())
+	utils.SendJSONResponse(w, string(js))
+}
+
+// Handle getting or setting the scrub interval in days, 0 to disable scheduled scrubs
+func (m *Manager) HandleMonitorConfig(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		_, lastScan := m.GetArrayStates()
+		js, _ := json.Marshal(map[string]interface{}{
+			"scrubInterval": int64(m.GetScrubInterval().Hours() / 24),
+			"lastScan":      lastScan,
+		})
+		utils.SendJSONResponse(w, string(js))
+		return
+	}
+
+	days, err := utils.PostInt(r, "scrubInterval")
+	if err != nil {
+		utils.SendErrorResponse(w, "invalid scrub interval given")
+		return
+	}
+	err = m.SetScrubInterval(time.Duration(days) * 24 * time.Hour)
+	if err != nil {
+		utils.SendErrorResponse(w, err.Error())
+		return
+	}
+	utils.SendOK(w)
+}
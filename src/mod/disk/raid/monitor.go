@@ -0,0 +1,676 @@
+package raid
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"imuslab.com/arozos/mod/database"
+)
+
+/*
+	RAID Monitor
+
+	Read /proc/mdstat in background to detect degraded, inactive or
+	rebuilding arrays, run periodic check scrubs with their mismatch
+	counts recorded and raise alerts when a member drops out
+*/
+
+const (
+	monitorTable    = "raid_monitor"
+	maxAlertLog     = 100
+	maxScrubHistory = 50
+
+	AlertCritical = "critical" //Member dropped out, array degraded or inactive
+	AlertWarning  = "warning"  //Scrub found mismatched sectors
+	AlertInfo     = "info"     //Array recovered
+
+	ScrubRunning     = "running"
+	ScrubCompleted   = "completed"
+	ScrubAborted     = "aborted"     //Stopped by admin
+	ScrubInterrupted = "interrupted" //Array degraded during the check
+)
+
+type MonitorOptions struct {
+	Database      *database.Database
+	Interval      time.Duration      //How often /proc/mdstat is read, default 30 seconds
+	ScrubInterval time.Duration      //Default interval between scheduled scrubs, can be changed with SetScrubInterval. Default 30 days
+	OnAlert       func(*Alert) error //Called when an alert is raised, the alert is raised again on next poll if this return error
+}
+
+// State of an array as reported by /proc/mdstat
+type ArrayState struct {
+	Name         string //e.g. md0
+	Status       string //active, inactive, active (auto-read-only)
+	Level        string
+	Members      []*RAIDMember
+	Spares       []string
+	Expected     int    //Number of devices the array should have, e.g. 2 in [2/1]
+	Working      int    //Number of working devices, e.g. 1 in [2/1]
+	MemberMap    string //e.g. U_, U is in sync and _ is missing or failed
+	Degraded     bool
+	SyncAction   string  //resync, recovery, reshape, check or repair. Empty if idle
+	SyncProgress float64 //Progress of the sync action in percentage
+	SyncFinish   string  //Estimated time to finish, e.g. 12.5min
+	SyncSpeed    string  //e.g. 22368K/sec
+	SyncPending  bool    //Sync action is DELAYED or PENDING
+}
+
+type Alert struct {
+	Time    int64
+	Array   string
+	Level   string //critical, warning or info
+	Message string
+}
+
+type ScrubRecord struct {
+	Array    string
+	Start    int64
+	End      int64 //0 if still running
+	Progress float64
+	Mismatch int64  //mismatch_cnt after the check in sectors, -1 if unknown
+	Result   string //running, completed, aborted or interrupted
+	Trigger  string //schedule, manual or external (e.g. checkarray cron job of the distro)
+}
+
+type monitor struct {
+	options       *MonitorOptions
+	mdstatPath    string
+	sysfsRoot     string
+	scrubInterval atomic.Int64 //Scrub interval in nanoseconds, 0 if disabled
+	stop          chan bool
+	mutex         sync.Mutex //Serialize the checks from polling and API calls
+	arrays        []*ArrayState
+	lastScan      int64
+	aborted       map[string]bool //Scrubs stopped by admin
+}
+
+var (
+	mdstatMemberRegex   = regexp.MustCompile(`^([^\[\s]+)\[(\d+)\]((?:\([A-Z]\))*)$`)
+	mdstatMapRegex      = regexp.MustCompile(`\[(\d+)/(\d+)\]\s+\[([U_]+)\]`)
+	mdstatProgressRegex = regexp.MustCompile(`(resync|recovery|reshape|check|repair)\s*=\s*([\d.]+)%`)
+	mdstatPendingRegex  = regexp.MustCompile(`(resync|recovery|reshape|check|repair)\s*=\s*(DELAYED|PENDING)`)
+	mdstatFinishRegex   = regexp.MustCompile(`finish=(\S+)`)
+	mdstatSpeedRegex    = regexp.MustCompile(`speed=(\S+)`)
+)
+
+// Parse the content of /proc/mdstat into array states
+func parseMDStat(content string) []*ArrayState {
+	arrays := []*ArrayState{}
+	var current *ArrayState
+	for _, line := range strings.Split(content, "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+
+		//Array lines start at column 0, e.g. md0 : active raid1 sdc[1] sdb[0](F)
+		if !strings.HasPrefix(line, " ") && !strings.HasPrefix(line, "\t") {
+			current = nil
+			parts := strings.SplitN(line, " : ", 2)
+			if len(parts) != 2 || !strings.HasPrefix(parts[0], "md") {
+				//Personalities or unused devices
+				continue
+			}
+			current = &ArrayState{
+				Name:    strings.TrimSpace(parts[0]),
+				Members: []*RAIDMember{},
+				Spares:  []string{},
+			}
+			for i, field := range strings.Fields(parts[1]) {
+				if i == 0 {
+					current.Status = field
+					continue
+				}
+				if strings.HasPrefix(field, "(") && strings.HasSuffix(field, ")") {
+					current.Status += " " + field
+					continue
+				}
+				matches := mdstatMemberRegex.FindStringSubmatch(field)
+				if matches == nil {
+					if current.Level == "" {
+						current.Level = field
+					}
+					continue
+				}
+				seq, _ := strconv.Atoi(matches[2])
+				switch {
+				case strings.Contains(matches[3], "(S)"):
+					current.Spares = append(current.Spares, matches[1])
+				default:
+					current.Members = append(current.Members, &RAIDMember{
+						Name:   matches[1],
+						Seq:    seq,
+						Failed: strings.Contains(matches[3], "(F)"),
+					})
+				}
+			}
+			arrays = append(arrays, current)
+			continue
+		}
+
+		if current == nil {
+			continue
+		}
+		if matches := mdstatMapRegex.FindStringSubmatch(line); matches != nil {
+			current.Expected, _ = strconv.Atoi(matches[1])
+			current.Working, _ = strconv.Atoi(matches[2])
+			current.MemberMap = matches[3]
+			current.Degraded = current.Working < current.Expected || strings.Contains(current.MemberMap, "_")
+		}
+		if matches := mdstatProgressRegex.FindStringSubmatch(line); matches != nil {
+			current.SyncAction = matches[1]
+			current.SyncProgress, _ = strconv.ParseFloat(matches[2], 64)
+			if finish := mdstatFinishRegex.FindStringSubmatch(line); finish != nil {
+				current.SyncFinish = finish[1]
+			}
+			if speed := mdstatSpeedRegex.FindStringSubmatch(line); speed != nil {
+				current.SyncSpeed = speed[1]
+			}
+		} else if matches := mdstatPendingRegex.FindStringSubmatch(line); matches != nil {
+			current.SyncAction = matches[1]
+			current.SyncPending = true
+		}
+	}
+	return arrays
+}
+
+// Get the problem of the array, return empty strings if the array is healthy
+func arrayProblem(array *ArrayState) (string, string) {
+	if strings.HasPrefix(array.Status, "inactive") {
+		return "inactive", array.Name + " is inactive"
+	}
+	if array.Degraded {
+		message := fmt.Sprintf("%s is degraded [%d/%d] [%s]", array.Name, array.Expected, array.Working, array.MemberMap)
+		if array.SyncAction == "recovery" {
+			message += fmt.Sprintf(", rebuilding %.1f%%", array.SyncProgress)
+		}
+		return "degraded:" + array.MemberMap, message
+	}
+	return "", ""
+}
+
+// Check if the array has redundancy to be checked
+func canScrub(array *ArrayState) bool {
+	switch array.Level {
+	case "raid1", "raid4", "raid5", "raid6", "raid10":
+		return strings.HasPrefix(array.Status, "active") && !array.Degraded
+	}
+	return false
+}
+
+// Start watching the RAID arrays in background. Can only be called once
+func (m *Manager) StartMonitor(options *MonitorOptions) error {
+	if m.monitor != nil {
+		return errors.New("monitor already started")
+	}
+	mon, err := newMonitor(options, "/proc/mdstat", "/sys/block")
+	if err != nil {
+		return err
+	}
+	if _, err := os.ReadFile(mon.mdstatPath); err != nil {
+		return err
+	}
+	m.monitor = mon
+
+	go func() {
+		ticker := time.NewTicker(options.Interval)
+		defer ticker.Stop()
+		m.checkArrays(time.Now())
+		for {
+			select {
+			case <-mon.stop:
+				return
+			case now := <-ticker.C:
+				m.checkArrays(now)
+			}
+		}
+	}()
+	return nil
+}
+
+func newMonitor(options *MonitorOptions, mdstatPath string, sysfsRoot string) (*monitor, error) {
+	if options.Interval <= 0 {
+		options.Interval = 30 * time.Second
+	}
+	if options.ScrubInterval <= 0 {
+		options.ScrubInterval = 30 * 24 * time.Hour
+	}
+	err := options.Database.NewTable(monitorTable)
+	if err != nil {
+		return nil, err
+	}
+
+	mon := &monitor{
+		options:    options,
+		mdstatPath: mdstatPath,
+		sysfsRoot:  sysfsRoot,
+		stop:       make(chan bool),
+		arrays:     []*ArrayState{},
+		aborted:    map[string]bool{},
+	}
+	scrubInterval := options.ScrubInterval
+	if options.Database.KeyExists(monitorTable, "scrub_interval") {
+		seconds := int64(0)
+		options.Database.Read(monitorTable, "scrub_interval", &seconds)
+		scrubInterval = time.Duration(seconds) * time.Second
+	}
+	mon.scrubInterval.Store(int64(scrubInterval))
+	return mon, nil
+}
+
+// Stop the background monitoring
+func (m *Manager) Close() {
+	if m.monitor != nil {
+		close(m.monitor.stop)
+	}
+}
+
+// Get the interval between scheduled scrubs, 0 if disabled
+func (m *Manager) GetScrubInterval() time.Duration {
+	if m.monitor == nil {
+		return 0
+	}
+	return time.Duration(m.monitor.scrubInterval.Load())
+}
+
+// Change the interval between scheduled scrubs, 0 to disable. The value is saved into database
+func (m *Manager) SetScrubInterval(interval time.Duration) error {
+	if m.monitor == nil {
+		return errors.New("monitor not started")
+	}
+	if interval < 0 || (interval > 0 && interval < 24*time.Hour) {
+		return errors.New("scrub interval must be at least 1 day")
+	}
+	m.monitor.scrubInterval.Store(int64(interval))
+	return m.monitor.options.Database.Write(monitorTable, "scrub_interval", int64(interval.Seconds()))
+}
+
+// Read /proc/mdstat now and check the arrays, return the latest array states
+func (m *Manager) CheckArrays() ([]*ArrayState, error) {
+	if m.monitor == nil {
+		return nil, errors.New("monitor not started")
+	}
+	return m.checkArrays(time.Now())
+}
+
+// Get the array states and the unix time of the last check
+func (m *Manager) GetArrayStates() ([]*ArrayState, int64) {
+	if m.monitor == nil {
+		return []*ArrayState{}, 0
+	}
+	m.monitor.mutex.Lock()
+	defer m.monitor.mutex.Unlock()
+	return m.monitor.arrays, m.monitor.lastScan
+}
+
+func (m *Manager) checkArrays(now time.Time) ([]*ArrayState, error) {
+	mon := m.monitor
+	content, err := os.ReadFile(mon.mdstatPath)
+	if err != nil {
+		return nil, err
+	}
+	arrays := parseMDStat(string(content))
+
+	mon.mutex.Lock()
+	defer mon.mutex.Unlock()
+
+	//Only one check runs at a time as arrays might share the same disks
+	syncing := false
+	for _, array := range arrays {
+		if array.SyncAction != "" {
+			syncing = true
+		}
+	}
+
+	seen := map[string]bool{}
+	for _, array := range arrays {
+		seen[array.Name] = true
+		m.updateArrayHealth(array, now)
+		if m.updateScrub(array, syncing, now) {
+			syncing = true
+		}
+	}
+
+	//Arrays removed while running, clear their states so a new array with the same name starts clean
+	db := mon.options.Database
+	for _, previous := range mon.arrays {
+		if !seen[previous.Name] {
+			db.Delete(monitorTable, "members/"+previous.Name)
+			db.Delete(monitorTable, "state/"+previous.Name)
+			db.Delete(monitorTable, "scrub/"+previous.Name)
+		}
+	}
+
+	mon.arrays = arrays
+	mon.lastScan = now.Unix()
+	return arrays, nil
+}
+
+// Compare the array with its last known state and raise alerts on changes
+func (m *Manager) updateArrayHealth(array *ArrayState, now time.Time) {
+	db := m.monitor.options.Database
+	membersKey := "members/" + array.Name
+	stateKey := "state/" + array.Name
+
+	healthy := []string{}
+	for _, member := range array.Members {
+		if !member.Failed {
+			healthy = append(healthy, member.Name)
+		}
+	}
+	healthy = append(healthy, array.Spares...)
+
+	//Members that were working on last check but now failed or missing
+	dropouts := []string{}
+	if db.KeyExists(monitorTable, membersKey) {
+		previous := []string{}
+		db.Read(monitorTable, membersKey, &previous)
+		for _, name := range previous {
+			stillHealthy := false
+			for _, current := range healthy {
+				if current == name {
+					stillHealthy = true
+					break
+				}
+			}
+			if !stillHealthy {
+				dropouts = append(dropouts, name)
+			}
+		}
+	}
+
+	state := ""
+	if db.KeyExists(monitorTable, stateKey) {
+		db.Read(monitorTable, stateKey, &state)
+	}
+	fingerprint, problem := arrayProblem(array)
+
+	var alert *Alert
+	if len(dropouts) > 0 {
+		message := "Member " + strings.Join(dropouts, ", ") + " dropped out of " + array.Name
+		if problem != "" {
+			message += ", " + problem
+		}
+		alert = &Alert{Level: AlertCritical, Message: message}
+	} else if fingerprint != "" && fingerprint != state {
+		alert = &Alert{Level: AlertCritical, Message: problem}
+	} else if fingerprint == "" && state != "" {
+		alert = &Alert{Level: AlertInfo, Message: array.Name + " recovered, all members are in sync"}
+	}
+	if alert != nil {
+		alert.Time = now.Unix()
+		alert.Array = array.Name
+		if !m.sendAlert(alert) {
+			//Keep the last known state so the alert is raised again on next check
+			return
+		}
+	}
+
+	db.Write(monitorTable, membersKey, healthy)
+	if fingerprint == "" {
+		if state != "" {
+			db.Delete(monitorTable, stateKey)
+		}
+	} else {
+		db.Write(monitorTable, stateKey, fingerprint)
+	}
+}
+
+// Track the running scrub of the array or start a scheduled one. Return true if a scrub is started
+func (m *Manager) updateScrub(array *ArrayState, syncing bool, now time.Time) bool {
+	mon := m.monitor
+	db := mon.options.Database
+	runningKey := "scrub/" + array.Name
+
+	if db.KeyExists(monitorTable, runningKey) {
+		record := ScrubRecord{}
+		db.Read(monitorTable, runningKey, &record)
+		if array.SyncAction == "check" || m.readSysfs(array.Name, "sync_action") == "check" {
+			record.Progress = array.SyncProgress
+			db.Write(monitorTable, runningKey, &record)
+		} else {
+			m.finishScrub(array, &record, now)
+		}
+		return false
+	}
+
+	if array.SyncAction == "check" {
+		//Started outside of ArozOS, record its result as well
+		db.Write(monitorTable, runningKey, &ScrubRecord{
+			Array:    array.Name,
+			Start:    now.Unix(),
+			Progress: array.SyncProgress,
+			Mismatch: -1,
+			Result:   ScrubRunning,
+			Trigger:  "external",
+		})
+		return false
+	}
+
+	interval := time.Duration(mon.scrubInterval.Load())
+	if interval <= 0 || !canScrub(array) {
+		return false
+	}
+	lastKey := "scrub_last/" + array.Name
+	if !db.KeyExists(monitorTable, lastKey) {
+		//New array, schedule its first scrub one interval later
+		db.Write(monitorTable, lastKey, now.Unix())
+		return false
+	}
+	last := int64(0)
+	db.Read(monitorTable, lastKey, &last)
+	if syncing || now.Sub(time.Unix(last, 0)) < interval {
+		return false
+	}
+
+	err := m.startScrub(array, "schedule", now)
+	if err != nil {
+		log.Println("[RAID] Unable to start scheduled scrub on " + array.Name + ": " + err.Error())
+		//Try again on next interval instead of every check
+		db.Write(monitorTable, lastKey, now.Unix())
+		return false
+	}
+	return true
+}
+
+func (m *Manager) startScrub(array *ArrayState, trigger string, now time.Time) error {
+	db := m.monitor.options.Database
+	err := m.writeSyncAction(array.Name, "check")
+	if err != nil {
+		return err
+	}
+	delete(m.monitor.aborted, array.Name)
+	array.SyncAction = "check"
+	array.SyncProgress = 0
+	db.Write(monitorTable, "scrub_last/"+array.Name, now.Unix())
+	log.Println("[RAID] Scrub started on " + array.Name + " (" + trigger + ")")
+	return db.Write(monitorTable, "scrub/"+array.Name, &ScrubRecord{
+		Array:    array.Name,
+		Start:    now.Unix(),
+		Mismatch: -1,
+		Result:   ScrubRunning,
+		Trigger:  trigger,
+	})
+}
+
+// Record the result of a finished scrub
+func (m *Manager) finishScrub(array *ArrayState, record *ScrubRecord, now time.Time) {
+	mon := m.monitor
+	db := mon.options.Database
+
+	record.End = now.Unix()
+	record.Mismatch = -1
+	if value, err := strconv.ParseInt(m.readSysfs(array.Name, "mismatch_cnt"), 10, 64); err == nil {
+		record.Mismatch = value
+	}
+	switch {
+	case mon.aborted[array.Name]:
+		record.Result = ScrubAborted
+	case array.Degraded || array.SyncAction != "":
+		//Kernel stopped the check for recovery or resync
+		record.Result = ScrubInterrupted
+	default:
+		record.Result = ScrubCompleted
+		record.Progress = 100
+	}
+
+	if record.Result == ScrubCompleted && record.Mismatch > 0 {
+		alert := &Alert{
+			Time:    now.Unix(),
+			Array:   array.Name,
+			Level:   AlertWarning,
+			Message: "Scrub of " + array.Name + " found " + strconv.FormatInt(record.Mismatch, 10) + " mismatched sectors",
+		}
+		if !m.sendAlert(alert) {
+			return
+		}
+	}
+	delete(mon.aborted, array.Name)
+
+	historyKey := "scrub_history/" + array.Name
+	history := []*ScrubRecord{}
+	if db.KeyExists(monitorTable, historyKey) {
+		db.Read(monitorTable, historyKey, &history)
+	}
+	history = append(history, record)
+	if len(history) > maxScrubHistory {
+		history = history[len(history)-maxScrubHistory:]
+	}
+	db.Write(monitorTable, historyKey, history)
+	db.Delete(monitorTable, "scrub/"+array.Name)
+	log.Println("[RAID] Scrub on " + array.Name + " " + record.Result + " with " + strconv.FormatInt(record.Mismatch, 10) + " mismatches")
+}
+
+// Start a check scrub on the array now
+func (m *Manager) StartScrub(arrayName string) error {
+	if m.monitor == nil {
+		return errors.New("monitor not started")
+	}
+	arrayName = filepath.Base(arrayName)
+	content, err := os.ReadFile(m.monitor.mdstatPath)
+	if err != nil {
+		return err
+	}
+	m.monitor.mutex.Lock()
+	defer m.monitor.mutex.Unlock()
+	for _, array := range parseMDStat(string(content)) {
+		if array.Name != arrayName {
+			continue
+		}
+		if array.SyncAction != "" {
+			return errors.New(array.Name + " is busy with " + array.SyncAction)
+		}
+		if !canScrub(array) {
+			return errors.New(array.Name + " cannot be scrubbed in its current state")
+		}
+		return m.startScrub(array, "manual", time.Now())
+	}
+	return errors.New("target RAID array not exists")
+}
+
+// Stop the running scrub on the array
+func (m *Manager) StopScrub(arrayName string) error {
+	if m.monitor == nil {
+		return errors.New("monitor not started")
+	}
+	arrayName = filepath.Base(arrayName)
+	m.monitor.mutex.Lock()
+	defer m.monitor.mutex.Unlock()
+	if m.readSysfs(arrayName, "sync_action") != "check" {
+		return errors.New("no scrub running on " + arrayName)
+	}
+	err := m.writeSyncAction(arrayName, "idle")
+	if err != nil {
+		return err
+	}
+	m.monitor.aborted[arrayName] = true
+	return nil
+}
+
+// Get the finished scrubs of the array, newest first
+func (m *Manager) GetScrubHistory(arrayName string) []*ScrubRecord {
+	history := []*ScrubRecord{}
+	if m.monitor == nil {
+		return history
+	}
+	db := m.monitor.options.Database
+	key := "scrub_history/" + filepath.Base(arrayName)
+	if db.KeyExists(monitorTable, key) {
+		db.Read(monitorTable, key, &history)
+	}
+	for i, j := 0, len(history)-1; i < j; i, j = i+1, j-1 {
+		history[i], history[j] = history[j], history[i]
+	}
+	return history
+}
+
+func (m *Manager) readSysfs(arrayName string, filename string) string {
+	content, err := os.ReadFile(filepath.Join(m.monitor.sysfsRoot, arrayName, "md", filename))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(content))
+}
+
+func (m *Manager) writeSyncAction(arrayName string, action string) error {
+	target := filepath.Join(m.monitor.sysfsRoot, arrayName, "md", "sync_action")
+	err := os.WriteFile(target, []byte(action), 0644)
+	if err != nil && os.IsPermission(err) {
+		//Not running as root, retry with sudo like other mdadm operations
+		cmd := exec.Command("sudo", "tee", target)
+		cmd.Stdin = strings.NewReader(action)
+		output, cmdErr := cmd.CombinedOutput()
+		if cmdErr != nil {
+			return fmt.Errorf("unable to write sync action: %s", strings.TrimSpace(string(output)))
+		}
+		return nil
+	}
+	return err
+}
+
+func (m *Manager) sendAlert(alert *Alert) bool {
+	if m.monitor.options.OnAlert != nil {
+		if err := m.monitor.options.OnAlert(alert); err != nil {
+			log.Println("[RAID] Unable to send alert: " + err.Error())
+			return false
+		}
+	}
+	log.Println("[RAID] " + alert.Array + " " + alert.Level + ": " + alert.Message)
+
+	db := m.monitor.options.Database
+	alerts := []*Alert{}
+	if db.KeyExists(monitorTable, "alerts") {
+		db.Read(monitorTable, "alerts", &alerts)
+	}
+	alerts = append(alerts, alert)
+	if len(alerts) > maxAlertLog {
+		alerts = alerts[len(alerts)-maxAlertLog:]
+	}
+	db.Write(monitorTable, "alerts", alerts)
+	return true
+}
+
+// Get the alerts raised, newest first
+func (m *Manager) GetAlerts() []*Alert {
+	alerts := []*Alert{}
+	if m.monitor == nil {
+		return alerts
+	}
+	db := m.monitor.options.Database
+	if db.KeyExists(monitorTable, "alerts") {
+		db.Read(monitorTable, "alerts", &alerts)
+	}
+	for i, j := 0, len(alerts)-1; i < j; i, j = i+1, j-1 {
+		alerts[i], alerts[j] = alerts[j], alerts[i]
+	}
+	return alerts
+}
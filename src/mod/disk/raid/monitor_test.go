@@ -0,0 +1,178 @@
+package raid
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"imuslab.com/arozos/mod/database"
+)
+
+const testMDStat = `Personalities : [raid1] [raid6] [raid5] [raid4]
+md1 : active raid5 sdf[3] sde[1] sdd[0](F)
+      2093056 blocks super 1.2 level 5, 512k chunk, algorithm 2 [3/2] [_U_]
+      [==>..................]  recovery = 12.6% (132096/1046528) finish=0.6min speed=22016K/sec
+
+md0 : active raid1 nvme1n1p1[1] nvme0n1p1[0] sdg[2](S)
+      1046528 blocks super 1.2 [2/2] [UU]
+      [=====>...............]  check = 27.5% (288000/1046528) finish=1.2min speed=96000K/sec
+
+md2 : inactive sdh[0](S)
+      1046528 blocks super 1.2
+
+unused devices: <none>
+`
+
+func TestParseMDStat(t *testing.T) {
+	arrays := parseMDStat(testMDStat)
+	if len(arrays) != 3 {
+		t.Fatalf("expected 3 arrays, got %d", len(arrays))
+	}
+
+	md1 := arrays[0]
+	if md1.Name != "md1" || md1.Level != "raid5" || !md1.Degraded || md1.MemberMap != "_U_" || md1.Expected != 3 || md1.Working != 2 {
+		t.Fatalf("unexpected md1 %+v", md1)
+	}
+	if len(md1.Members) != 3 || md1.Members[2].Name != "sdd" || !md1.Members[2].Failed {
+		t.Fatalf("unexpected md1 members %+v", md1.Members)
+	}
+	if md1.SyncAction != "recovery" || md1.SyncProgress != 12.6 || md1.SyncFinish != "0.6min" || md1.SyncSpeed != "22016K/sec" {
+		t.Fatalf("unexpected md1 sync %+v", md1)
+	}
+
+	md0 := arrays[1]
+	if md0.Degraded || md0.SyncAction != "check" || len(md0.Members) != 2 || md0.Members[0].Name != "nvme1n1p1" || len(md0.Spares) != 1 {
+		t.Fatalf("unexpected md0 %+v", md0)
+	}
+
+	if fingerprint, _ := arrayProblem(arrays[2]); fingerprint != "inactive" {
+		t.Fatalf("inactive array not detected: %q", fingerprint)
+	}
+}
+
+func TestMonitorAlertsAndScrub(t *testing.T) {
+	dir := t.TempDir()
+	sysdb, err := database.NewDatabase(filepath.Join(dir, "test.db"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sysdb.Close()
+
+	mdstatPath := filepath.Join(dir, "mdstat")
+	sysfsRoot := filepath.Join(dir, "block")
+	os.MkdirAll(filepath.Join(sysfsRoot, "md0", "md"), 0755)
+	writeFile := func(path string, content string) {
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	setMDStat := func(members string, status string, sync string) {
+		writeFile(mdstatPath, "Personalities : [raid1]\nmd0 : active raid1 "+members+"\n      1046528 blocks super 1.2 "+status+"\n"+sync+"\nunused devices: <none>\n")
+	}
+	syncActionPath := filepath.Join(sysfsRoot, "md0", "md", "sync_action")
+	writeFile(syncActionPath, "idle\n")
+
+	alerts := []*Alert{}
+	failSending := false
+	mon, err := newMonitor(&MonitorOptions{
+		Database:      sysdb,
+		ScrubInterval: 7 * 24 * time.Hour,
+		OnAlert: func(alert *Alert) error {
+			if failSending {
+				return errors.New("offline")
+			}
+			alerts = append(alerts, alert)
+			return nil
+		},
+	}, mdstatPath, sysfsRoot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &Manager{Options: &Options{}, monitor: mon}
+
+	//Healthy array raise nothing
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	setMDStat("sdc[1] sdb[0]", "[2/2] [UU]", "")
+	if _, err := m.checkArrays(now); err != nil {
+		t.Fatal(err)
+	}
+	if len(alerts) != 0 {
+		t.Fatalf("unexpected alert %v", alerts[0].Message)
+	}
+
+	//Member dropped out, notification is down
+	failSending = true
+	setMDStat("sdc[1] sdb[0](F)", "[2/1] [_U]", "")
+	now = now.Add(time.Minute)
+	m.checkArrays(now)
+	if len(alerts) != 0 {
+		t.Fatal("alert sent while notification is down")
+	}
+
+	//Retried on next check, once
+	failSending = false
+	for i := 0; i < 2; i++ {
+		now = now.Add(time.Minute)
+		m.checkArrays(now)
+	}
+	if len(alerts) != 1 || alerts[0].Level != AlertCritical || !strings.Contains(alerts[0].Message, "sdb dropped out of md0") {
+		t.Fatalf("dropout not alerted once: %v", alerts)
+	}
+
+	//Rebuild does not alert until finished
+	setMDStat("sdd[2] sdc[1]", "[2/1] [_U]", "      [=>...]  recovery = 8.5% (89472/1046528) finish=0.7min speed=22368K/sec")
+	now = now.Add(time.Minute)
+	arrays, _ := m.checkArrays(now)
+	if len(alerts) != 1 || arrays[0].SyncAction != "recovery" {
+		t.Fatalf("unexpected state during rebuild %v %+v", len(alerts), arrays[0])
+	}
+	setMDStat("sdd[2] sdc[1]", "[2/2] [UU]", "")
+	now = now.Add(time.Minute)
+	m.checkArrays(now)
+	if len(alerts) != 2 || alerts[1].Level != AlertInfo {
+		t.Fatalf("recovery not alerted: %v", alerts)
+	}
+
+	//Scheduled scrub starts one interval after the array is first seen
+	now = now.Add(7 * 24 * time.Hour)
+	m.checkArrays(now)
+	content, _ := os.ReadFile(syncActionPath)
+	if string(content) != "check" {
+		t.Fatalf("scrub not started, sync_action is %q", content)
+	}
+
+	//Scrub finished with mismatches
+	setMDStat("sdd[2] sdc[1]", "[2/2] [UU]", "      [=====>...]  check = 50.0% (523264/1046528) finish=0.1min speed=96000K/sec")
+	now = now.Add(time.Minute)
+	m.checkArrays(now)
+	writeFile(syncActionPath, "idle\n")
+	writeFile(filepath.Join(sysfsRoot, "md0", "md", "mismatch_cnt"), "128\n")
+	setMDStat("sdd[2] sdc[1]", "[2/2] [UU]", "")
+	now = now.Add(time.Minute)
+	m.checkArrays(now)
+	if len(alerts) != 3 || alerts[2].Level != AlertWarning || !strings.Contains(alerts[2].Message, "128 mismatched") {
+		t.Fatalf("mismatch not alerted: %v", alerts)
+	}
+	history := m.GetScrubHistory("/dev/md0")
+	if len(history) != 1 || history[0].Result != ScrubCompleted || history[0].Mismatch != 128 || history[0].Trigger != "schedule" {
+		t.Fatalf("unexpected scrub history %+v", history)
+	}
+
+	//Not started again before the next interval
+	writeFile(syncActionPath, "idle\n")
+	now = now.Add(24 * time.Hour)
+	m.checkArrays(now)
+	content, _ = os.ReadFile(syncActionPath)
+	if string(content) != "idle\n" {
+		t.Fatal("scrub started before the next interval")
+	}
+
+	//Alert log is newest first
+	logged := m.GetAlerts()
+	if len(logged) != 3 || logged[0].Level != AlertWarning {
+		t.Fatalf("unexpected alert log %v", logged)
+	}
+}
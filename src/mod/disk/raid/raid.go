@@ -24,6 +24,7 @@ type Options struct {
 
 type Manager struct {
 	Options *Options
+	monitor *monitor
 }
 
 // Create a new raid manager
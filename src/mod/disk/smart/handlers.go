@@ -0,0 +1,95 @@
+package smart
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"imuslab.com/arozos/mod/utils"
+)
+
+// Scan the drives now instead of waiting for the next poll
+func (s *SMARTListener) HandleRefresh(w http.ResponseWriter, r *http.Request) {
+	var driveList DevicesList
+	if s.monitor != nil {
+		driveList = s.Check()
+	} else {
+		driveList = s.Refresh()
+	}
+	js, _ := json.Marshal(driveList)
+	utils.SendJSONResponse(w, string(js))
+}
+
+// Get the history of a drive attribute. drive is the serial number (or device path if serial is not available)
+func (s *SMARTListener) HandleHistory(w http.ResponseWriter, r *http.Request) {
+	drive, err := utils.GetPara(r, "drive")
+	if err != nil {
+		utils.SendErrorResponse(w, "Invalid drive")
+		return
+	}
+	attribute, err := utils.GetPara(r, "attr")
+	if err != nil {
+		utils.SendErrorResponse(w, "Invalid attribute")
+		return
+	}
+
+	//Default to last 30 days
+	to := time.Now().Unix()
+	from := to - 30*86400
+	if value, err := utils.GetPara(r, "from"); err == nil {
+		from, err = strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			utils.SendErrorResponse(w, "Invalid from time")
+			return
+		}
+	}
+	if value, err := utils.GetPara(r, "to"); err == nil {
+		to, err = strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			utils.SendErrorResponse(w, "Invalid to time")
+			return
+		}
+	}
+
+	points, err := s.GetHistory(drive, attribute, from, to)
+	if err != nil {
+		utils.SendErrorResponse(w, err.Error())
+		return
+	}
+	js, _ := json.Marshal(points)
+	utils.SendJSONResponse(w, string(js))
+}
+
+// List the alerts raised by the monitor
+func (s *SMARTListener) HandleAlerts(w http.ResponseWriter, r *http.Request) {
+	js, _ := json.Marshal(s.GetAlerts())
+	utils.SendJSONResponse(w, string(js))
+}
+
+// Get or set the polling interval in minutes
+func (s *SMARTListener) HandleMonitorConfig(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		s.mutex.RLock()
+		lastScan := s.LastScan
+		s.mutex.RUnlock()
+		js, _ := json.Marshal(map[string]interface{}{
+			"interval": int64(s.GetInterval().Minutes()),
+			"lastScan": lastScan,
+		})
+		utils.SendJSONResponse(w, string(js))
+		return
+	}
+
+	interval, err := utils.PostInt(r, "interval")
+	if err != nil {
+		utils.SendErrorResponse(w, "Invalid interval")
+		return
+	}
+	err = s.SetInterval(time.Duration(interval) * time.Minute)
+	if err != nil {
+		utils.SendErrorResponse(w, err.Error())
+		return
+	}
+	utils.SendOK(w)
+}
@@ -0,0 +1,458 @@
+package smart
+
+import (
+	"errors"
+	"log"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"imuslab.com/arozos/mod/database"
+)
+
+/*
+	SMART Monitor
+
+	Poll the SMART data of all drives periodically, record the
+	attribute values into history and raise alerts when a drive
+	attribute crosses its threshold or a self-test fails
+*/
+
+const (
+	historyTable = "smart_history"
+	monitorTable = "smart"
+	maxAlertLog  = 100
+
+	AlertFailing = "failing" //Attribute crossed its threshold, self-test failed or overall health failed
+	AlertWarning = "warning" //Attribute failed in the past or a critical counter increased
+)
+
+// Raw counters that indicate media degradation when they grow
+var criticalAttributes = map[int]bool{
+	5:   true, //Reallocated_Sector_Ct
+	187: true, //Reported_Uncorrect
+	188: true, //Command_Timeout
+	197: true, //Current_Pending_Sector
+	198: true, //Offline_Uncorrectable
+}
+
+type MonitorOptions struct {
+	Database  *database.Database
+	Interval  time.Duration      //Default polling interval, can be changed with SetInterval. Default 1 hour
+	Retention time.Duration      //How long the attribute history is kept, default 1 year
+	OnAlert   func(*Alert) error //Called when an alert is raised, the alert is raised again on next poll if this return error
+}
+
+type Alert struct {
+	Time      int64
+	Device    string //Device path, e.g. /dev/sda
+	Drive     string //Drive ID used in history, serial number if available
+	Model     string
+	Attribute string //Attribute name, "self-test" or "overall"
+	Level     string //failing or warning
+	Message   string
+}
+
+type HistoryPoint struct {
+	Time  int64 `json:"t"`
+	Value int   `json:"value"` //Normalized value, 0 for NVMe attributes
+	Worst int   `json:"worst"`
+	Raw   int64 `json:"raw"`
+}
+
+// A single attribute reading of a drive
+type attributeSample struct {
+	Key        string //Attribute key used in history, the ATA attribute id or NVMe field name
+	Name       string
+	Value      int
+	Worst      int
+	Thresh     int
+	Raw        int64
+	WhenFailed string
+}
+
+type monitor struct {
+	options  *MonitorOptions
+	interval atomic.Int64 //Polling interval in nanoseconds
+	reset    chan time.Duration
+	stop     chan bool
+	mutex    sync.Mutex //Serialize the checks from polling and manual refresh
+}
+
+// Start polling the drives in background. Can only be called once
+func (s *SMARTListener) StartMonitor(options *MonitorOptions) error {
+	if s.monitor != nil {
+		return errors.New("monitor already started")
+	}
+	if options.Interval <= 0 {
+		options.Interval = time.Hour
+	}
+	if options.Retention <= 0 {
+		options.Retention = 365 * 24 * time.Hour
+	}
+	options.Database.NewTable(historyTable)
+	options.Database.NewTable(monitorTable)
+
+	interval := options.Interval
+	if options.Database.KeyExists(monitorTable, "interval") {
+		seconds := int64(0)
+		options.Database.Read(monitorTable, "interval", &seconds)
+		if seconds > 0 {
+			interval = time.Duration(seconds) * time.Second
+		}
+	}
+
+	s.monitor = &monitor{
+		options: options,
+		reset:   make(chan time.Duration, 1),
+		stop:    make(chan bool),
+	}
+	s.monitor.interval.Store(int64(interval))
+
+	go func() {
+		//Check the scan result from startup first
+		s.checkDrives(s.GetDriveList(), time.Now())
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		lastPrune := time.Time{}
+		for {
+			select {
+			case <-s.monitor.stop:
+				return
+			case newInterval := <-s.monitor.reset:
+				ticker.Reset(newInterval)
+			case now := <-ticker.C:
+				s.checkDrives(s.Refresh(), now)
+				if now.Sub(lastPrune) > 24*time.Hour {
+					s.pruneHistory(now)
+					lastPrune = now
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+// Stop the background polling
+func (s *SMARTListener) Close() {
+	if s.monitor != nil {
+		close(s.monitor.stop)
+	}
+}
+
+// Get the current polling interval, 0 if the monitor is not started
+func (s *SMARTListener) GetInterval() time.Duration {
+	if s.monitor == nil {
+		return 0
+	}
+	return time.Duration(s.monitor.interval.Load())
+}
+
+// Change the polling interval, the value is saved into database
+func (s *SMARTListener) SetInterval(interval time.Duration) error {
+	if s.monitor == nil {
+		return errors.New("monitor not started")
+	}
+	if interval < 5*time.Minute {
+		return errors.New("polling interval must be at least 5 minutes")
+	}
+	s.monitor.interval.Store(int64(interval))
+	//Replace the pending reset if any
+	select {
+	case <-s.monitor.reset:
+	default:
+	}
+	s.monitor.reset <- interval
+	return s.monitor.options.Database.Write(monitorTable, "interval", int64(interval.Seconds()))
+}
+
+// Get the ID of the drive used in history and alert states
+func driveID(name string, serial string) string {
+	if serial != "" {
+		return serial
+	}
+	return name
+}
+
+// Extract the attributes of ATA and NVMe drives into a common format
+func getAttributeSamples(device *DeviceSMART) []*attributeSample {
+	samples := []*attributeSample{}
+	for _, attr := range device.AtaSmartAttributes.Table {
+		samples = append(samples, &attributeSample{
+			Key:        strconv.Itoa(attr.ID),
+			Name:       attr.Name,
+			Value:      attr.Value,
+			Worst:      attr.Worst,
+			Thresh:     attr.Thresh,
+			Raw:        int64(attr.Raw.Value),
+			WhenFailed: attr.WhenFailed,
+		})
+	}
+
+	if nvme := device.NvmeSmartHealthInformationLog; nvme != nil {
+		samples = append(samples,
+			&attributeSample{Key: "critical_warning", Name: "Critical Warning", Raw: int64(nvme.CriticalWarning)},
+			&attributeSample{Key: "available_spare", Name: "Available Spare", Raw: int64(nvme.AvailableSpare)},
+			&attributeSample{Key: "percentage_used", Name: "Percentage Used", Raw: int64(nvme.PercentageUsed)},
+			&attributeSample{Key: "media_errors", Name: "Media Errors", Raw: nvme.MediaErrors},
+			&attributeSample{Key: "num_err_log_entries", Name: "Error Log Entries", Raw: nvme.NumErrLogEntries},
+		)
+	}
+	return samples
+}
+
+// Evaluate the attribute sample, return the alert level and message if any
+func evaluateAttribute(sample *attributeSample, previousRaw int64, hasPrevious bool, nvme bool) (string, string) {
+	if nvme {
+		switch sample.Key {
+		case "critical_warning":
+			if sample.Raw != 0 {
+				return AlertFailing, "NVMe critical warning raised (0x" + strconv.FormatInt(sample.Raw, 16) + ")"
+			}
+		case "media_errors":
+			if hasPrevious && sample.Raw > previousRaw {
+				return AlertWarning, "Media errors increased from " + strconv.FormatInt(previousRaw, 10) + " to " + strconv.FormatInt(sample.Raw, 10)
+			}
+		}
+		return "", ""
+	}
+
+	if sample.WhenFailed == "FAILING_NOW" || (sample.Thresh > 0 && sample.Value <= sample.Thresh) {
+		return AlertFailing, sample.Name + " value " + strconv.Itoa(sample.Value) + " reached the threshold " + strconv.Itoa(sample.Thresh)
+	}
+	id, _ := strconv.Atoi(sample.Key)
+	if criticalAttributes[id] && hasPrevious && sample.Raw > previousRaw {
+		return AlertWarning, sample.Name + " increased from " + strconv.FormatInt(previousRaw, 10) + " to " + strconv.FormatInt(sample.Raw, 10)
+	}
+	if sample.WhenFailed == "In_the_past" {
+		return AlertWarning, sample.Name + " failed in the past"
+	}
+	return "", ""
+}
+
+// Check if the latest self-test in the log failed, return its lifetime hours as identifier
+func latestSelfTestFailure(device *DeviceSMART) (int, string, bool) {
+	table := device.AtaSmartSelfTestLog.Standard.Table
+	if len(table) == 0 {
+		return 0, "", false
+	}
+	//The first entry is the most recent test. Status 3 - 8 are failures
+	latest := table[0]
+	status := latest.Status.Value >> 4
+	if latest.Status.Passed || status < 3 || status > 8 {
+		return 0, "", false
+	}
+	return latest.LifetimeHours, latest.Type.String + " self-test failed: " + latest.Status.String, true
+}
+
+// Scan the drives now and check the result, used for manual refresh
+func (s *SMARTListener) Check() DevicesList {
+	driveList := s.Refresh()
+	s.checkDrives(driveList, time.Now())
+	return driveList
+}
+
+// Record the drive states into history and raise alerts on changes
+func (s *SMARTListener) checkDrives(driveList DevicesList, now time.Time) {
+	if s.monitor == nil {
+		return
+	}
+	s.monitor.mutex.Lock()
+	defer s.monitor.mutex.Unlock()
+	db := s.monitor.options.Database
+	for _, device := range driveList.Devices {
+		info := device.Smart
+		if info.ModelName == "" && info.SerialNumber == "" {
+			//smartctl returned nothing for this device
+			continue
+		}
+		drive := driveID(device.Name, info.SerialNumber)
+		escaped := url.PathEscape(drive)
+		newAlert := func(attribute string, level string, message string) *Alert {
+			return &Alert{
+				Time:      now.Unix(),
+				Device:    device.Name,
+				Drive:     drive,
+				Model:     info.ModelName,
+				Attribute: attribute,
+				Level:     level,
+				Message:   message,
+			}
+		}
+
+		//Overall health
+		level := ""
+		if !info.SmartStatus.Passed {
+			level = AlertFailing
+		}
+		s.updateAlertState(escaped+"/overall", level, "", newAlert("overall", AlertFailing, "SMART overall health self-assessment failed"))
+
+		//Latest self-test
+		hours, message, failed := latestSelfTestFailure(&info)
+		if failed {
+			s.updateAlertState(escaped+"/self-test", AlertFailing, strconv.Itoa(hours), newAlert("self-test", AlertFailing, message))
+		}
+
+		//Attributes
+		isNvme := info.NvmeSmartHealthInformationLog != nil
+		for _, sample := range getAttributeSamples(&info) {
+			rawKey := "raw/" + escaped + "/" + sample.Key
+			previousRaw := int64(0)
+			hasPrevious := db.KeyExists(monitorTable, rawKey)
+			if hasPrevious {
+				db.Read(monitorTable, rawKey, &previousRaw)
+			}
+
+			level, message := evaluateAttribute(sample, previousRaw, hasPrevious, isNvme)
+			version := ""
+			if level == AlertWarning && hasPrevious && sample.Raw > previousRaw {
+				//Each increase of the counter is a new alert
+				version = strconv.FormatInt(sample.Raw, 10)
+			}
+			s.updateAlertState(escaped+"/"+sample.Key, level, version, newAlert(sample.Name, level, message))
+
+			db.Write(monitorTable, rawKey, sample.Raw)
+			s.recordHistory(drive, sample, now)
+		}
+	}
+}
+
+/*
+Update the alert state of a drive attribute and raise the alert when it gets worse.
+version distinguish different occurrences at the same level, e.g. a new failed self-test
+*/
+func (s *SMARTListener) updateAlertState(stateKey string, level string, version string, alert *Alert) {
+	db := s.monitor.options.Database
+	key := "state/" + stateKey
+	previous := ""
+	if db.KeyExists(monitorTable, key) {
+		db.Read(monitorTable, key, &previous)
+	}
+
+	current := level
+	if version != "" {
+		current = level + "@" + version
+	}
+	if level == "" {
+		if previous != "" {
+			db.Delete(monitorTable, key)
+		}
+		return
+	}
+
+	//Only alert when the state changed, failing is not downgraded to warning
+	if previous == current || (strings.HasPrefix(previous, AlertFailing) && level == AlertWarning && version == "") {
+		return
+	}
+
+	if s.monitor.options.OnAlert != nil {
+		if err := s.monitor.options.OnAlert(alert); err != nil {
+			log.Println("[SMART] Unable to send alert: " + err.Error())
+			return
+		}
+	}
+	log.Println("[SMART] " + alert.Device + " " + alert.Level + ": " + alert.Message)
+	s.appendAlertLog(alert)
+	db.Write(monitorTable, key, current)
+}
+
+func (s *SMARTListener) appendAlertLog(alert *Alert) {
+	db := s.monitor.options.Database
+	alerts := []*Alert{}
+	if db.KeyExists(monitorTable, "alerts") {
+		db.Read(monitorTable, "alerts", &alerts)
+	}
+	alerts = append(alerts, alert)
+	if len(alerts) > maxAlertLog {
+		alerts = alerts[len(alerts)-maxAlertLog:]
+	}
+	db.Write(monitorTable, "alerts", alerts)
+}
+
+// Get the alerts raised, newest first
+func (s *SMARTListener) GetAlerts() []*Alert {
+	alerts := []*Alert{}
+	if s.monitor == nil {
+		return alerts
+	}
+	db := s.monitor.options.Database
+	if db.KeyExists(monitorTable, "alerts") {
+		db.Read(monitorTable, "alerts", &alerts)
+	}
+	for i, j := 0, len(alerts)-1; i < j; i, j = i+1, j-1 {
+		alerts[i], alerts[j] = alerts[j], alerts[i]
+	}
+	return alerts
+}
+
+// History is stored in one record per drive attribute per day
+func historyKey(drive string, attribute string, day time.Time) string {
+	return url.PathEscape(drive) + "/" + url.PathEscape(attribute) + "/" + day.UTC().Format("20060102")
+}
+
+func (s *SMARTListener) recordHistory(drive string, sample *attributeSample, now time.Time) {
+	db := s.monitor.options.Database
+	key := historyKey(drive, sample.Key, now)
+	points := []*HistoryPoint{}
+	if db.KeyExists(historyTable, key) {
+		db.Read(historyTable, key, &points)
+	}
+	points = append(points, &HistoryPoint{
+		Time:  now.Unix(),
+		Value: sample.Value,
+		Worst: sample.Worst,
+		Raw:   sample.Raw,
+	})
+	db.Write(historyTable, key, points)
+}
+
+// Get the recorded values of a drive attribute between the given unix timestamps
+func (s *SMARTListener) GetHistory(drive string, attribute string, from int64, to int64) ([]*HistoryPoint, error) {
+	if s.monitor == nil {
+		return nil, errors.New("monitor not started")
+	}
+	if to < from {
+		return nil, errors.New("invalid time range")
+	}
+	if to-from > int64(s.monitor.options.Retention.Seconds())+86400 {
+		from = to - int64(s.monitor.options.Retention.Seconds()) - 86400
+	}
+
+	db := s.monitor.options.Database
+	results := []*HistoryPoint{}
+	end := time.Unix(to, 0).UTC()
+	for day := time.Unix(from, 0).UTC().Truncate(24 * time.Hour); !day.After(end); day = day.Add(24 * time.Hour) {
+		key := historyKey(drive, attribute, day)
+		if !db.KeyExists(historyTable, key) {
+			continue
+		}
+		points := []*HistoryPoint{}
+		db.Read(historyTable, key, &points)
+		for _, point := range points {
+			if point.Time >= from && point.Time <= to {
+				results = append(results, point)
+			}
+		}
+	}
+	return results, nil
+}
+
+// Remove history older than the retention period
+func (s *SMARTListener) pruneHistory(now time.Time) {
+	db := s.monitor.options.Database
+	entries, err := db.ListTable(historyTable)
+	if err != nil {
+		return
+	}
+	cutoff := now.Add(-s.monitor.options.Retention).UTC().Format("20060102")
+	for _, entry := range entries {
+		key := string(entry[0])
+		day := key[strings.LastIndex(key, "/")+1:]
+		if day < cutoff {
+			db.Delete(historyTable, key)
+		}
+	}
+}
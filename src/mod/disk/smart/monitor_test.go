@@ -0,0 +1,124 @@
+package smart
+
+import (
+	"encoding/json"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"imuslab.com/arozos/mod/database"
+)
+
+// Build a drive list with one ATA drive from the smartctl style JSON
+func testDriveList(t *testing.T, reallocated int, pendingValue int, selfTest string) DevicesList {
+	raw := `{"devices":[{"name":"/dev/sda","smart":{
+		"model_name":"Test Disk","serial_number":"SN01",
+		"smart_status":{"passed":true},
+		"ata_smart_attributes":{"table":[
+			{"id":5,"name":"Reallocated_Sector_Ct","value":100,"worst":100,"thresh":10,"when_failed":"","raw":{"value":` + itoa(reallocated) + `}},
+			{"id":197,"name":"Current_Pending_Sector","value":` + itoa(pendingValue) + `,"worst":100,"thresh":5,"when_failed":"","raw":{"value":0}}
+		]},
+		"ata_smart_self_test_log":{"standard":{"table":[` + selfTest + `]}}
+	}}]}`
+	list := DevicesList{}
+	if err := json.Unmarshal([]byte(raw), &list); err != nil {
+		t.Fatal(err)
+	}
+	return list
+}
+
+func itoa(value int) string {
+	js, _ := json.Marshal(value)
+	return string(js)
+}
+
+func TestMonitorAlerts(t *testing.T) {
+	sysdb, err := database.NewDatabase(filepath.Join(t.TempDir(), "test.db"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sysdb.Close()
+
+	alerts := []*Alert{}
+	failSending := false
+	listener := &SMARTListener{}
+	listener.monitor = &monitor{options: &MonitorOptions{
+		Database:  sysdb,
+		Retention: 24 * time.Hour,
+		OnAlert: func(alert *Alert) error {
+			if failSending {
+				return errors.New("offline")
+			}
+			alerts = append(alerts, alert)
+			return nil
+		},
+	}}
+	sysdb.NewTable(historyTable)
+	sysdb.NewTable(monitorTable)
+
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	passedTest := `{"type":{"string":"Short offline"},"status":{"value":0,"string":"Completed without error","passed":true},"lifetime_hours":100}`
+	failedTest := `{"type":{"string":"Extended offline"},"status":{"value":121,"string":"Completed: read failure","passed":false},"lifetime_hours":120}`
+
+	//Healthy drive raise nothing
+	listener.checkDrives(testDriveList(t, 0, 100, passedTest), now)
+	if len(alerts) != 0 {
+		t.Fatalf("unexpected alerts %v", alerts[0].Message)
+	}
+
+	//Reallocated sectors increased
+	now = now.Add(time.Hour)
+	listener.checkDrives(testDriveList(t, 8, 100, passedTest), now)
+	if len(alerts) != 1 || alerts[0].Level != AlertWarning || !strings.Contains(alerts[0].Message, "from 0 to 8") {
+		t.Fatalf("reallocated increase not alerted: %v", alerts)
+	}
+
+	//Same count does not alert again
+	now = now.Add(time.Hour)
+	listener.checkDrives(testDriveList(t, 8, 100, passedTest), now)
+	if len(alerts) != 1 {
+		t.Fatal("alert repeated without change")
+	}
+
+	//Threshold crossed and self-test failed, but notification is down
+	failSending = true
+	now = now.Add(time.Hour)
+	listener.checkDrives(testDriveList(t, 8, 5, failedTest), now)
+	if len(alerts) != 1 {
+		t.Fatal("alert sent while notification is down")
+	}
+
+	//Retried on the next poll, once each
+	failSending = false
+	for i := 0; i < 2; i++ {
+		now = now.Add(time.Hour)
+		listener.checkDrives(testDriveList(t, 8, 5, failedTest), now)
+	}
+	if len(alerts) != 3 {
+		t.Fatalf("expected 3 alerts, got %d", len(alerts))
+	}
+	if alerts[1].Attribute != "self-test" || alerts[2].Attribute != "Current_Pending_Sector" || alerts[2].Level != AlertFailing {
+		t.Fatalf("unexpected alerts %+v %+v", alerts[1], alerts[2])
+	}
+
+	//Attribute history is recorded for every poll
+	points, err := listener.GetHistory("SN01", "5", now.Add(-24*time.Hour).Unix(), now.Unix())
+	if err != nil || len(points) != 6 || points[0].Raw != 0 || points[5].Raw != 8 {
+		t.Fatalf("unexpected history %v %v", err, points)
+	}
+
+	//Alert log is newest first
+	logged := listener.GetAlerts()
+	if len(logged) < 3 || logged[0].Attribute != "Current_Pending_Sector" {
+		t.Fatalf("unexpected alert log %v", logged)
+	}
+
+	//History beyond retention is pruned
+	listener.pruneHistory(now.Add(72 * time.Hour))
+	points, _ = listener.GetHistory("SN01", "5", now.Add(-24*time.Hour).Unix(), now.Unix())
+	if len(points) != 0 {
+		t.Fatal("history not pruned")
+	}
+}
@@ -17,6 +17,8 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	//"os/exec"
 	"errors"
@@ -29,6 +31,10 @@ import (
 type SMARTListener struct {
 	SystemSmartExecutable string
 	DriveList             DevicesList `json:"driveList"`
+	LastScan              int64       `json:"lastScan"` //Unix timestamp of the last smartctl scan
+
+	mutex   sync.RWMutex
+	monitor *monitor
 }
 
 // DiskSmartInit Desktop script initiation
@@ -51,14 +57,32 @@ func NewSmartListener() (*SMARTListener, error) {
 		os.Chmod(smartExec, 0777)
 	}
 
-	driveList := scanAvailableDevices(smartExec)
-	readSMARTDevices(smartExec, &driveList)
+	listener := SMARTListener{
+		SystemSmartExecutable: smartExec,
+	}
+	listener.Refresh()
+	return &listener, nil
+}
+
+// Scan the drives and read their SMART data again
+func (s *SMARTListener) Refresh() DevicesList {
+	driveList := scanAvailableDevices(s.SystemSmartExecutable)
+	readSMARTDevices(s.SystemSmartExecutable, &driveList)
 	fillHealthyStatus(&driveList)
 	fillCapacity(&driveList)
-	return &SMARTListener{
-		SystemSmartExecutable: smartExec,
-		DriveList:             driveList,
-	}, nil
+
+	s.mutex.Lock()
+	s.DriveList = driveList
+	s.LastScan = time.Now().Unix()
+	s.mutex.Unlock()
+	return driveList
+}
+
+// Get the drive list from the last scan
+func (s *SMARTListener) GetDriveList() DevicesList {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.DriveList
 }
 
 // this function used for fetch available devices by using smartctl
@@ -131,7 +155,7 @@ func fillCapacity(devicesList *DevicesList) {
 }
 
 func (s *SMARTListener) GetSMART(w http.ResponseWriter, r *http.Request) {
-	jsonText, _ := json.Marshal(s.DriveList)
+	jsonText, _ := json.Marshal(s.GetDriveList())
 	utils.SendJSONResponse(w, string(jsonText))
 }
 
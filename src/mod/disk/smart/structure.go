@@ -216,5 +216,29 @@ type DeviceSMART struct {
 			PowerUpScanResumeMinutes int `json:"power_up_scan_resume_minutes"`
 		} `json:"ata_smart_selective_self_test_log"`
 	*/
+	AtaSmartSelfTestLog struct {
+		Standard struct {
+			Table []struct {
+				Type struct {
+					Value  int    `json:"value"`
+					String string `json:"string"`
+				} `json:"type"`
+				Status struct {
+					Value  int    `json:"value"`
+					String string `json:"string"`
+					Passed bool   `json:"passed"`
+				} `json:"status,omitempty"`
+				LifetimeHours int `json:"lifetime_hours"`
+			} `json:"table"`
+		} `json:"standard"`
+	} `json:"ata_smart_self_test_log"`
+	NvmeSmartHealthInformationLog *struct {
+		CriticalWarning         int   `json:"critical_warning"`
+		AvailableSpare          int   `json:"available_spare"`
+		AvailableSpareThreshold int   `json:"available_spare_threshold"`
+		PercentageUsed          int   `json:"percentage_used"`
+		MediaErrors             int64 `json:"media_errors"`
+		NumErrLogEntries        int64 `json:"num_err_log_entries"`
+	} `json:"nvme_smart_health_information_log,omitempty"`
 	Healthy string `json:"healthy"`
 }
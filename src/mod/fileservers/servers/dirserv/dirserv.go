@@ -7,10 +7,12 @@ import (
 	"net/url"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"imuslab.com/arozos/mod/database"
 	"imuslab.com/arozos/mod/fileservers"
 	"imuslab.com/arozos/mod/filesystem/arozfs"
+	"imuslab.com/arozos/mod/network"
 	"imuslab.com/arozos/mod/user"
 )
 
@@ -87,9 +89,19 @@ func (m *Manager) ServerWebFileRequest(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	//Validate request origin
+	authAgent := m.option.UserManager.GetAuthAgent()
+	allowAccess, err := authAgent.ValidateLoginRequest(w, r)
+	if !allowAccess {
+		http.Error(w, "403 - Forbidden: "+err.Error(), http.StatusForbidden)
+		return
+	}
+
 	//Validate username and password
-	allowAccess, reason := m.option.UserManager.GetAuthAgent().ValidateUsernameAndPasswordWithReason(username, password)
+	allowAccess, reason := authAgent.ValidateUsernameAndPasswordWithReason(username, password)
 	if !allowAccess {
+		clientIP, _ := network.GetIpFromRequest(r)
+		authAgent.Logger.LogAuthByRequestInfo(username, clientIP, time.Now().Unix(), false, "dirserv")
 		w.Header().Set("WWW-Authenticate", `Basic realm="`+m.option.ServerUUID+`", charset="UTF-8"`)
 		http.Error(w, "401 - Unauthorized: "+reason, http.StatusUnauthorized)
 		return
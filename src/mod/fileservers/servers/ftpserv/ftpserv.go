@@ -1,10 +1,13 @@
 package ftpserv
 
 import (
+	"crypto/tls"
 	"errors"
+	"strconv"
 
 	"imuslab.com/arozos/mod/database"
 	"imuslab.com/arozos/mod/fileservers"
+	"imuslab.com/arozos/mod/filesystem/fileaudit"
 	"imuslab.com/arozos/mod/info/logger"
 	upnp "imuslab.com/arozos/mod/network/upnp"
 	"imuslab.com/arozos/mod/storage/ftp"
@@ -20,6 +23,23 @@ type ServerStatus struct {
 	PublicAddr     string
 	PassiveMode    bool
 	UserGroups     []string
+
+	//FTPS and passive port range settings
+	TLSAvailable     bool //If a certificate is available for FTPS
+	TLSEnabled       bool
+	RequireTLS       bool
+	RefusePlaintext  bool
+	PassivePortStart int
+	PassivePortEnd   int
+}
+
+// FTPS and passive port range settings saved in database
+type SecuritySetting struct {
+	TLSEnabled       bool //Allow explicit FTPS with AUTH TLS
+	RequireTLS       bool //Require TLS on both control and data channels
+	RefusePlaintext  bool //Refuse login on plaintext control channel
+	PassivePortStart int  //0 for default range Port + 1 to Port + 2
+	PassivePortEnd   int
 }
 
 type ManagerOption struct {
@@ -31,6 +51,9 @@ type ManagerOption struct {
 	Sysdb       *database.Database
 	Upnp        *upnp.UPnPClient
 	AllowUpnp   bool
+
+	GetCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error) //Certificate shared with the web server, used for FTPS
+	AuditLogger    *fileaudit.Logger                                    //Optional, record file operations to the file audit trail
 }
 
 type Manager struct {
@@ -101,7 +124,22 @@ func (m *Manager) StartFtpServer() error {
 		passiveModeIP = externalIP
 	}
 
-	h, err := ftp.NewFTPHandler(m.option.UserManager, m.option.Hostname, serverPort, m.option.TmpFolder, passiveModeIP)
+	security := m.GetSecuritySetting()
+	serverOption := ftp.ServerOption{
+		PassivePortStart: security.PassivePortStart,
+		PassivePortEnd:   security.PassivePortEnd,
+		AuditLogger:      m.option.AuditLogger,
+	}
+	if security.TLSEnabled {
+		if !m.IsTLSAvailable() {
+			return errors.New("FTPS enabled but no certificate is available. Start ArozOS with -cert and -key or setup ACME certificates")
+		}
+		serverOption.GetCertificate = m.option.GetCertificate
+		serverOption.RequireTLS = security.RequireTLS
+		serverOption.RefusePlaintext = security.RefusePlaintext
+	}
+
+	h, err := ftp.NewFTPHandler(m.option.UserManager, m.option.Hostname, serverPort, m.option.TmpFolder, passiveModeIP, &serverOption)
 	if err != nil {
 		return err
 	}
@@ -120,9 +158,10 @@ func (m *Manager) StartFtpServer() error {
 					m.option.FtpServer.UPNPEnabled = false
 					return err
 				} else {
-					//Forward other data ports
-					m.option.Upnp.ForwardPort(m.option.FtpServer.Port+1, m.option.Hostname+" FTP Data 1")
-					m.option.Upnp.ForwardPort(m.option.FtpServer.Port+2, m.option.Hostname+" FTP Data 2")
+					//Forward the passive mode data ports
+					for port := serverOption.PassivePortStart; port <= serverOption.PassivePortEnd; port++ {
+						m.option.Upnp.ForwardPort(port, m.option.Hostname+" FTP Data "+strconv.Itoa(port-serverOption.PassivePortStart+1))
+					}
 					m.option.FtpServer.UPNPEnabled = true
 				}
 				return nil
@@ -134,8 +173,9 @@ func (m *Manager) StartFtpServer() error {
 				return errors.New("Upnp did not started correctly on this host. Ignore this option")
 			} else {
 				m.option.Upnp.ClosePort(m.option.FtpServer.Port)
-				m.option.Upnp.ClosePort(m.option.FtpServer.Port + 1)
-				m.option.Upnp.ClosePort(m.option.FtpServer.Port + 2)
+				for port := serverOption.PassivePortStart; port <= serverOption.PassivePortEnd; port++ {
+					m.option.Upnp.ClosePort(port)
+				}
 
 				m.option.FtpServer.UPNPEnabled = false
 			}
@@ -214,23 +254,88 @@ func (m *Manager) GetFtpServerStatus() (*ServerStatus, error) {
 		}
 	}
 
+	security := m.GetSecuritySetting()
+	if security.PassivePortStart == 0 {
+		security.PassivePortStart = serverPort + 1
+		security.PassivePortEnd = serverPort + 2
+	}
+
 	currnetStatus := ServerStatus{
-		Enabled:        enabled,
-		Port:           serverPort,
-		AllowUpnp:      m.option.AllowUpnp,
-		UPNPEnabled:    enableUpnp,
-		FTPUPNPEnabled: ftpUpnp,
-		PublicAddr:     publicAddr,
-		UserGroups:     userGroups,
-		PassiveMode:    forcePassiveMode,
+		Enabled:          enabled,
+		Port:             serverPort,
+		AllowUpnp:        m.option.AllowUpnp,
+		UPNPEnabled:      enableUpnp,
+		FTPUPNPEnabled:   ftpUpnp,
+		PublicAddr:       publicAddr,
+		UserGroups:       userGroups,
+		PassiveMode:      forcePassiveMode,
+		TLSAvailable:     m.IsTLSAvailable(),
+		TLSEnabled:       security.TLSEnabled,
+		RequireTLS:       security.RequireTLS,
+		RefusePlaintext:  security.RefusePlaintext,
+		PassivePortStart: security.PassivePortStart,
+		PassivePortEnd:   security.PassivePortEnd,
 	}
 	return &currnetStatus, nil
 }
 
+// Get the FTPS and passive port range settings
+func (m *Manager) GetSecuritySetting() *SecuritySetting {
+	setting := SecuritySetting{}
+	if m.option.Sysdb.KeyExists("ftp", "security") {
+		m.option.Sysdb.Read("ftp", "security", &setting)
+	}
+	return &setting
+}
+
+// Update the FTPS and passive port range settings, restart the FTP server if it is running
+func (m *Manager) SetSecuritySetting(setting *SecuritySetting) error {
+	if setting.PassivePortStart != 0 || setting.PassivePortEnd != 0 {
+		if setting.PassivePortStart < 1024 || setting.PassivePortEnd > 65535 || setting.PassivePortEnd < setting.PassivePortStart {
+			return errors.New("invalid passive port range")
+		}
+		if setting.PassivePortEnd-setting.PassivePortStart >= 1000 {
+			return errors.New("passive port range cannot contain more than 1000 ports")
+		}
+	}
+	if !setting.TLSEnabled {
+		setting.RequireTLS = false
+		setting.RefusePlaintext = false
+	} else if !m.IsTLSAvailable() {
+		return errors.New("no certificate available for FTPS. Start ArozOS with -cert and -key or setup ACME certificates")
+	}
+
+	err := m.option.Sysdb.Write("ftp", "security", setting)
+	if err != nil {
+		return err
+	}
+	if m.IsFtpServerEnabled() {
+		return m.StartFtpServer()
+	}
+	return nil
+}
+
+// Check if a certificate is available for FTPS
+func (m *Manager) IsTLSAvailable() bool {
+	if m.option.GetCertificate == nil {
+		return false
+	}
+	cert, err := m.option.GetCertificate(&tls.ClientHelloInfo{})
+	return err == nil && cert != nil
+}
+
 func (m *Manager) IsFtpServerEnabled() bool {
 	return m.option.FtpServer != nil && m.option.FtpServer.ServerRunning
 }
 
+// Get the number of clients connected to the FTP server
+func (m *Manager) GetConnectedClients() int {
+	if m.option.FtpServer == nil {
+		return 0
+	}
+	return m.option.FtpServer.ConnectedClientCount()
+}
+
 func (m *Manager) FTPServerToggle(enabled bool) error {
 	if m.option.FtpServer != nil && m.option.FtpServer.ServerRunning {
 		//Enabled
@@ -251,10 +356,21 @@ func (m *Manager) FTPGetEndpoints(userinfo *user.User) []*fileservers.Endpoint {
 	if m.option.FtpServer != nil {
 		port = m.option.FtpServer.Port
 	}
-	ftpEndpoints = append(ftpEndpoints, &fileservers.Endpoint{
-		ProtocolName: "ftp://",
-		Port:         port,
-		Subpath:      "",
-	})
+	security := m.GetSecuritySetting()
+	if !security.RequireTLS && !security.RefusePlaintext {
+		ftpEndpoints = append(ftpEndpoints, &fileservers.Endpoint{
+			ProtocolName: "ftp://",
+			Port:         port,
+			Subpath:      "",
+		})
+	}
+	if security.TLSEnabled {
+		//Explicit FTPS, aka FTP over TLS
+		ftpEndpoints = append(ftpEndpoints, &fileservers.Endpoint{
+			ProtocolName: "ftpes://",
+			Port:         port,
+			Subpath:      "",
+		})
+	}
 	return ftpEndpoints
 }
@@ -152,3 +152,46 @@ func (m *Manager) HandleFTPPassiveModeSettings(w http.ResponseWriter, r *http.Re
 	}
 
 }
+
+// Update the FTPS and passive port range settings
+func (m *Manager) HandleFTPSecuritySettings(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		utils.SendErrorResponse(w, "invalid request method")
+		return
+	}
+	tlsEnabled, _ := utils.PostBool(r, "tls")
+	requireTLS, _ := utils.PostBool(r, "requireTLS")
+	refusePlaintext, _ := utils.PostBool(r, "refusePlaintext")
+
+	//Empty port range for using the default range
+	passivePortStart, passivePortEnd := 0, 0
+	start, _ := utils.PostPara(r, "pasvStart")
+	end, _ := utils.PostPara(r, "pasvEnd")
+	if start != "" || end != "" {
+		var err error
+		passivePortStart, err = strconv.Atoi(start)
+		if err != nil {
+			utils.SendErrorResponse(w, "Invalid passive port range start")
+			return
+		}
+		passivePortEnd, err = strconv.Atoi(end)
+		if err != nil {
+			utils.SendErrorResponse(w, "Invalid passive port range end")
+			return
+		}
+	}
+
+	m.option.Logger.PrintAndLog("FTP", "Updating FTPS setting, TLS: "+strconv.FormatBool(tlsEnabled)+", require TLS: "+strconv.FormatBool(requireTLS)+", refuse plaintext login: "+strconv.FormatBool(refusePlaintext), nil)
+	err := m.SetSecuritySetting(&SecuritySetting{
+		TLSEnabled:       tlsEnabled,
+		RequireTLS:       requireTLS,
+		RefusePlaintext:  refusePlaintext,
+		PassivePortStart: passivePortStart,
+		PassivePortEnd:   passivePortEnd,
+	})
+	if err != nil {
+		utils.SendErrorResponse(w, err.Error())
+		return
+	}
+	utils.SendOK(w)
+}
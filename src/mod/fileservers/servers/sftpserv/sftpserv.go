@@ -8,6 +8,7 @@ import (
 
 	"imuslab.com/arozos/mod/database"
 	"imuslab.com/arozos/mod/fileservers"
+	"imuslab.com/arozos/mod/filesystem/fileaudit"
 	"imuslab.com/arozos/mod/info/logger"
 	"imuslab.com/arozos/mod/network/upnp"
 	"imuslab.com/arozos/mod/storage/sftpserver"
@@ -22,6 +23,7 @@ type ManagerOption struct {
 	Logger      *logger.Logger
 	Sysdb       *database.Database
 	Upnp        *upnp.UPnPClient
+	AuditLogger *fileaudit.Logger //Optional, record file operations to the file audit trail
 }
 
 type Manager struct {
@@ -54,6 +56,7 @@ func newSFTPServerInstance(option *ManagerOption) (*sftpserver.Instance, int, er
 		ListeningIP: "0.0.0.0:" + strconv.Itoa(defaultListeningPort),
 		KeyFile:     option.KeyFile,
 		UserManager: option.UserManager,
+		AuditLogger: option.AuditLogger,
 	}
 
 	enableUPnP := getUpnPEnabled(option.Sysdb)
@@ -132,7 +135,8 @@ func getUpnPEnabled(sysdb *database.Database) bool {
 	return enableUPnP
 }
 
-func (m *Manager) HandleGetConnectedClients(w http.ResponseWriter, r *http.Request) {
+// Get the number of clients connected to the SFTP server
+func (m *Manager) GetConnectedClients() int {
 	userCount := 0
 	if m.IsEnabled() {
 		m.instance.ConnectedClients.Range(func(k, v interface{}) bool {
@@ -140,8 +144,11 @@ func (m *Manager) HandleGetConnectedClients(w http.ResponseWriter, r *http.Reque
 			return true
 		})
 	}
+	return userCount
+}
 
-	js, _ := json.Marshal(userCount)
+func (m *Manager) HandleGetConnectedClients(w http.ResponseWriter, r *http.Request) {
+	js, _ := json.Marshal(m.GetConnectedClients())
 	utils.SendJSONResponse(w, string(js))
 }
 
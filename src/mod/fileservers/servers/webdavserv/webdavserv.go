@@ -3,9 +3,11 @@ package webdavserv
 import (
 	"encoding/json"
 	"net/http"
+	"time"
 
 	"imuslab.com/arozos/mod/database"
 	"imuslab.com/arozos/mod/fileservers"
+	"imuslab.com/arozos/mod/filesystem/fileaudit"
 	awebdav "imuslab.com/arozos/mod/storage/webdav"
 	"imuslab.com/arozos/mod/user"
 	"imuslab.com/arozos/mod/utils"
@@ -21,6 +23,7 @@ type ManagerOption struct {
 	Port        int
 	UseTls      bool
 	UserHandler *user.UserHandler
+	AuditLogger *fileaudit.Logger //Optional, record file operations to the file audit trail
 }
 type Manager struct {
 	WebDavHandler *awebdav.Server
@@ -37,6 +40,7 @@ func NewWebDAVManager(option *ManagerOption) *Manager {
 
 	//Create a new webdav server
 	newserver := awebdav.NewServer(m.option.Hostname, "/webdav", m.option.TmpDir, m.option.UseTls, m.option.UserHandler)
+	newserver.AuditLogger = m.option.AuditLogger
 	m.WebDavHandler = newserver
 
 	//Check the webdav default state
@@ -103,6 +107,11 @@ func (m *Manager) GetWebDavEnabled() bool {
 	return m.WebDavHandler.Enabled
 }
 
+// Get the number of clients that accessed the WebDAV server in the last 5 minutes
+func (m *Manager) GetActiveClients() int {
+	return m.WebDavHandler.ActiveClientCount(5 * time.Minute)
+}
+
 //Mapper of the original Connection related features
 func (m *Manager) HandleConnectionList(w http.ResponseWriter, r *http.Request) {
 	m.WebDavHandler.HandleConnectionList(w, r)
@@ -0,0 +1,541 @@
+package filesystem
+
+/*
+	Archive Browsing and Creation
+
+	This script provide format independent functions for listing and
+	extracting zip, tar, tar.gz, tar.zst, tar.xz and 7z archives, and
+	creating the tar family archives from any file system handlers
+*/
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+	"imuslab.com/arozos/mod/filesystem/arozfs"
+)
+
+// Supported archive formats
+const (
+	ArchiveFormatZip    = "zip"
+	ArchiveFormatTar    = "tar"
+	ArchiveFormatTarGz  = "tar.gz"
+	ArchiveFormatTarZst = "tar.zst"
+	ArchiveFormatTarXz  = "tar.xz"
+	ArchiveFormat7z     = "7z"
+)
+
+// An entry inside an archive
+type ArchiveEntry struct {
+	Name    string //Path of the entry inside the archive, separated by forward slash
+	Size    int64  //Uncompressed size of the entry
+	IsDir   bool
+	ModTime int64
+}
+
+// Get the archive format of the given file by its extension, return empty string if not supported
+func GetArchiveFormat(filename string) string {
+	filename = strings.ToLower(filename)
+	switch {
+	case strings.HasSuffix(filename, ".zip"):
+		return ArchiveFormatZip
+	case strings.HasSuffix(filename, ".tar"):
+		return ArchiveFormatTar
+	case strings.HasSuffix(filename, ".tar.gz"), strings.HasSuffix(filename, ".tgz"):
+		return ArchiveFormatTarGz
+	case strings.HasSuffix(filename, ".tar.zst"), strings.HasSuffix(filename, ".tzst"):
+		return ArchiveFormatTarZst
+	case strings.HasSuffix(filename, ".tar.xz"), strings.HasSuffix(filename, ".txz"):
+		return ArchiveFormatTarXz
+	case strings.HasSuffix(filename, ".7z"):
+		return ArchiveFormat7z
+	}
+	return ""
+}
+
+// Check if the given file is an archive that can be browsed and extracted
+func IsArchiveFile(filename string) bool {
+	return GetArchiveFormat(filename) != ""
+}
+
+// Check if the given format is one of the tar family formats that can be created
+func IsTarArchiveFormat(format string) bool {
+	return format == ArchiveFormatTar || format == ArchiveFormatTarGz || format == ArchiveFormatTarZst || format == ArchiveFormatTarXz
+}
+
+/*
+ListArchive list all entries inside an archive
+Pass in nil as fsh if the archive is located on local file system outside of any fsh
+*/
+func ListArchive(fsh *FileSystemHandler, archivePath string) ([]*ArchiveEntry, error) {
+	entries := []*ArchiveEntry{}
+	err := walkArchive(fsh, archivePath, func(entry *ArchiveEntry, _ func() (io.Reader, error)) error {
+		entries = append(entries, entry)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+/*
+GetArchiveEntrySize return the uncompressed size of a single file or folder in the archive.
+Pass in nil as fsh if the archive is located on local file system outside of any fsh
+*/
+func GetArchiveEntrySize(fsh *FileSystemHandler, archivePath string, entryName string) (int64, error) {
+	entryName, ok := cleanArchiveEntryName(entryName)
+	if !ok {
+		return 0, errors.New("invalid entry name")
+	}
+	var size int64 = 0
+	err := walkArchive(fsh, archivePath, func(entry *ArchiveEntry, _ func() (io.Reader, error)) error {
+		if entry.Name == entryName || strings.HasPrefix(entry.Name, entryName+"/") {
+			size += entry.Size
+		}
+		return nil
+	})
+	return size, err
+}
+
+/*
+ExtractArchiveEntry extract a single file or folder from the archive into destFolder.
+If the entry is a folder, all of its content will be extracted as well.
+Pass in nil as fsh or destFsh for local file system outside of any fsh
+*/
+func ExtractArchiveEntry(fsh *FileSystemHandler, archivePath string, entryName string, destFsh *FileSystemHandler, destFolder string) error {
+	entryName, ok := cleanArchiveEntryName(entryName)
+	if !ok {
+		return errors.New("invalid entry name")
+	}
+	entryParent := path.Dir(entryName)
+
+	found := false
+	err := walkArchive(fsh, archivePath, func(entry *ArchiveEntry, open func() (io.Reader, error)) error {
+		if entry.Name != entryName && !strings.HasPrefix(entry.Name, entryName+"/") {
+			return nil
+		}
+		found = true
+
+		//Keep the entry itself as the top level item in destFolder
+		relativePath := entry.Name
+		if entryParent != "." {
+			relativePath = strings.TrimPrefix(entry.Name, entryParent+"/")
+		}
+		target := filepath.Join(destFolder, filepath.FromSlash(relativePath))
+		return writeArchiveEntry(destFsh, target, entry, open)
+	})
+	if err != nil {
+		return err
+	}
+	if !found {
+		return errors.New("entry not found in archive")
+	}
+	return nil
+}
+
+/*
+ArozExtractArchiveWithProgress extract all the given archives to the output folder on local file system.
+Returns the following progress: (current filename / current file count / total file count / progress in percentage)
+*/
+func ArozExtractArchiveWithProgress(filelist []string, outputfile string, progressHandler func(string, int, int, float64) int) error {
+	//Gether the total number of entries in all archives
+	totalFileCounts := 0
+	for _, srcFile := range filelist {
+		entries, err := ListArchive(nil, srcFile)
+		if err != nil {
+			return err
+		}
+		totalFileCounts += len(entries)
+	}
+
+	extractedFileCount := 0
+	for _, srcFile := range filelist {
+		err := walkArchive(nil, srcFile, func(entry *ArchiveEntry, open func() (io.Reader, error)) error {
+			target := filepath.Join(outputfile, filepath.FromSlash(entry.Name))
+			err := writeArchiveEntry(nil, target, entry, open)
+			if err != nil {
+				return err
+			}
+
+			extractedFileCount++
+			return waitArchiveProgress(progressHandler, entry.Name, extractedFileCount, totalFileCounts)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+ArozTarFileWithProgress create a tar family archive with progress update, support any fsh as source or output.
+format must be one of tar, tar.gz, tar.zst or tar.xz.
+Returns the following progress: (current filename / current file count / total file count / progress in percentage)
+if output is local path that is out of the scope of any fsh, leave outputFsh as nil
+*/
+func ArozTarFileWithProgress(targetFshs []*FileSystemHandler, filelist []string, outputFsh *FileSystemHandler, outputfile string, format string, includeTopLevelFolder bool, progressHandler func(string, int, int, float64) int) error {
+	if !IsTarArchiveFormat(format) {
+		return errors.New("unsupported archive format: " + format)
+	}
+
+	//Get the file count from the filelist
+	totalFileCount := 0
+	for i, srcpath := range filelist {
+		fshAbs := targetFshs[i].FileSystemAbstraction
+		if fshAbs.IsDir(srcpath) {
+			fshAbs.Walk(srcpath, func(_ string, info os.FileInfo, _ error) error {
+				if info != nil && !info.IsDir() {
+					totalFileCount++
+				}
+				return nil
+			})
+		} else {
+			totalFileCount++
+		}
+	}
+
+	//Create the target archive file
+	var file arozfs.File
+	var err error
+	if outputFsh != nil {
+		file, err = outputFsh.FileSystemAbstraction.Create(outputfile)
+	} else {
+		//Force local fs
+		file, err = os.Create(outputfile)
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	compressor, err := newArchiveCompressor(file, format)
+	if err != nil {
+		return err
+	}
+	writer := tar.NewWriter(compressor)
+
+	currentFileCount := 0
+	addFile := func(fshAbs FileSystemAbstraction, srcpath string, info os.FileInfo, relativePath string) error {
+		thisFile, err := fshAbs.ReadStream(srcpath)
+		if err != nil {
+			return err
+		}
+		defer thisFile.Close()
+
+		header, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		header.Name = relativePath
+		err = writer.WriteHeader(header)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(writer, thisFile)
+		if err != nil {
+			return err
+		}
+
+		currentFileCount++
+		return waitArchiveProgress(progressHandler, arozfs.Base(srcpath), currentFileCount, totalFileCount)
+	}
+
+	for i, srcpath := range filelist {
+		fshAbs := targetFshs[i].FileSystemAbstraction
+		if fshAbs.IsDir(srcpath) {
+			//This is a directory
+			topLevelFolderName := filepath.ToSlash(arozfs.Base(filepath.Dir(srcpath)) + "/" + arozfs.Base(srcpath))
+			err = fshAbs.Walk(srcpath, func(path string, info os.FileInfo, err error) error {
+				if err != nil {
+					return err
+				}
+				if info.IsDir() || insideHiddenFolder(path) {
+					return nil
+				}
+
+				relativePath := strings.ReplaceAll(filepath.ToSlash(path), filepath.ToSlash(filepath.Clean(srcpath))+"/", "")
+				if includeTopLevelFolder {
+					relativePath = topLevelFolderName + "/" + relativePath
+				} else {
+					relativePath = arozfs.Base(srcpath) + "/" + relativePath
+				}
+				return addFile(fshAbs, path, info, relativePath)
+			})
+		} else {
+			//This is a file
+			var info os.FileInfo
+			info, err = fshAbs.Stat(srcpath)
+			if err == nil {
+				relativePath := arozfs.Base(srcpath)
+				if includeTopLevelFolder {
+					relativePath = arozfs.Base(filepath.Dir(srcpath)) + "/" + relativePath
+				}
+				err = addFile(fshAbs, srcpath, info, relativePath)
+			}
+		}
+
+		if err != nil {
+			writer.Close()
+			compressor.Close()
+			return err
+		}
+	}
+
+	err = writer.Close()
+	if err != nil {
+		compressor.Close()
+		return err
+	}
+	return compressor.Close()
+}
+
+/*
+	Internal functions
+*/
+
+// Walk through all entries in the archive. The content of the entry can only be read inside the walk function
+func walkArchive(fsh *FileSystemHandler, archivePath string, walkFunc func(entry *ArchiveEntry, open func() (io.Reader, error)) error) error {
+	var f arozfs.File
+	var err error
+	if fsh != nil {
+		f, err = fsh.FileSystemAbstraction.Open(archivePath)
+	} else {
+		f, err = os.Open(archivePath)
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	format := GetArchiveFormat(archivePath)
+	switch format {
+	case ArchiveFormat7z:
+		stat, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		archive, err := openSevenZip(f, stat.Size())
+		if err != nil {
+			return err
+		}
+		return archive.walk(func(file *sevenZipFile, open func() (io.Reader, error)) error {
+			name, ok := cleanArchiveEntryName(file.name)
+			if !ok {
+				return nil
+			}
+			return walkFunc(&ArchiveEntry{
+				Name:    name,
+				Size:    int64(file.size),
+				IsDir:   file.isDir,
+				ModTime: file.modTime.Unix(),
+			}, open)
+		})
+	case ArchiveFormatTar, ArchiveFormatTarGz, ArchiveFormatTarZst, ArchiveFormatTarXz:
+		decompressor, err := newArchiveDecompressor(f, format)
+		if err != nil {
+			return err
+		}
+		defer decompressor.Close()
+
+		tarReader := tar.NewReader(decompressor)
+		for {
+			header, err := tarReader.Next()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if header.Typeflag != tar.TypeDir && header.Typeflag != tar.TypeReg {
+				//Links and special files are not supported
+				continue
+			}
+			name, ok := cleanArchiveEntryName(header.Name)
+			if !ok {
+				continue
+			}
+			err = walkFunc(&ArchiveEntry{
+				Name:    name,
+				Size:    header.Size,
+				IsDir:   header.Typeflag == tar.TypeDir,
+				ModTime: header.ModTime.Unix(),
+			}, func() (io.Reader, error) {
+				return tarReader, nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+	default:
+		//Treat unknown formats as zip, e.g. jar or docx
+		stat, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		archive, err := zip.NewReader(f, stat.Size())
+		if err != nil {
+			return err
+		}
+		for _, file := range archive.File {
+			name, ok := cleanArchiveEntryName(file.Name)
+			if !ok {
+				continue
+			}
+			var opened io.ReadCloser
+			err = walkFunc(&ArchiveEntry{
+				Name:    name,
+				Size:    int64(file.UncompressedSize64),
+				IsDir:   file.FileInfo().IsDir(),
+				ModTime: file.Modified.Unix(),
+			}, func() (io.Reader, error) {
+				r, err := file.Open()
+				if err != nil {
+					return nil, err
+				}
+				opened = r
+				return r, nil
+			})
+			if opened != nil {
+				opened.Close()
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// Write an archive entry to the target path, create parent folders if needed
+func writeArchiveEntry(destFsh *FileSystemHandler, target string, entry *ArchiveEntry, open func() (io.Reader, error)) error {
+	if destFsh == nil {
+		if entry.IsDir {
+			return os.MkdirAll(target, 0775)
+		}
+		err := os.MkdirAll(filepath.Dir(target), 0775)
+		if err != nil {
+			return err
+		}
+		r, err := open()
+		if err != nil {
+			return err
+		}
+		writer, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0775)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(writer, r)
+		writer.Close()
+		if err != nil {
+			//Extraction failed. Remove the incomplete file
+			os.Remove(target)
+			return err
+		}
+		if entry.ModTime > 0 {
+			os.Chtimes(target, time.Now(), time.Unix(entry.ModTime, 0))
+		}
+		return nil
+	}
+
+	destFshAbs := destFsh.FileSystemAbstraction
+	if entry.IsDir {
+		return destFshAbs.MkdirAll(target, 0775)
+	}
+	err := destFshAbs.MkdirAll(filepath.Dir(target), 0775)
+	if err != nil {
+		return err
+	}
+	r, err := open()
+	if err != nil {
+		return err
+	}
+	err = destFshAbs.WriteStream(target, r, 0775)
+	if err != nil {
+		destFshAbs.Remove(target)
+		return err
+	}
+	return nil
+}
+
+// Normalize the entry name and reject names that escape the extraction folder
+func cleanArchiveEntryName(name string) (string, bool) {
+	name = strings.ReplaceAll(name, "\\", "/")
+	name = strings.TrimLeft(name, "/")
+	name = path.Clean(name)
+	if name == "." || name == ".." || strings.HasPrefix(name, "../") {
+		return "", false
+	}
+	return name, true
+}
+
+func newArchiveDecompressor(r io.Reader, format string) (io.ReadCloser, error) {
+	switch format {
+	case ArchiveFormatTar:
+		return io.NopCloser(r), nil
+	case ArchiveFormatTarGz:
+		return gzip.NewReader(r)
+	case ArchiveFormatTarZst:
+		decoder, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return decoder.IOReadCloser(), nil
+	case ArchiveFormatTarXz:
+		decoder, err := xz.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return io.NopCloser(decoder), nil
+	}
+	return nil, errors.New("unsupported archive format: " + format)
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+func newArchiveCompressor(w io.Writer, format string) (io.WriteCloser, error) {
+	switch format {
+	case ArchiveFormatTar:
+		return nopWriteCloser{w}, nil
+	case ArchiveFormatTarGz:
+		return gzip.NewWriter(w), nil
+	case ArchiveFormatTarZst:
+		return zstd.NewWriter(w)
+	case ArchiveFormatTarXz:
+		return xz.NewWriter(w)
+	}
+	return nil, errors.New("unsupported archive format: " + format)
+}
+
+// Report the progress and block while the operation is paused. Return error if it is cancelled
+func waitArchiveProgress(progressHandler func(string, int, int, float64) int, filename string, current int, total int) error {
+	progress := float64(100)
+	if total > 0 {
+		progress = float64(current) / float64(total) * float64(100)
+	}
+	statusCode := progressHandler(filename, current, total, progress)
+	for statusCode == 1 {
+		//Wait for the task to be resumed
+		time.Sleep(1 * time.Second)
+		statusCode = progressHandler(filename, current, total, progress)
+	}
+	if statusCode == 2 {
+		//Cancel
+		return errors.New("Operation cancelled by user")
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+package filesystem
+
+import (
+	"archive/tar"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// A 7z archive with LZMA2 content and LZMA encoded header, containing
+// docs/hello.txt, docs/second.txt and an empty folder docs/empty
+const testSevenZipArchive = "N3q8ryccAAOYmXOmwQAAAAAAAAAiAAAAAAAAAFb7v7MAOZlIkbFplgfDGFmm6e6IuTpVAtwNuMcY" +
+	"nTB0mStDDpHIBhcN1H/5hEAAAACBMweuD9C1KPyfP0dBWNb+AmolqOiAhYQgoVdQobTueQBPR9Wk" +
+	"Ohb+wrFsvuVIOi72DV5wwdvz/XMoCGWjmISkxARYV9tbswiRTvmDwlzaQr3p5uMbm7jkm/dm0SkV" +
+	"OA7Ioht62QJD3bXICd8GPXws0iH17iZNN4FHPO5zRoG2Ht1D1dVwivc30lrYVgD37f/S2oAAFwYr" +
+	"AQmAlgAHCwEAASMDAQEFXQAAgAAMgRMKAWb1OkYAAA=="
+
+func TestSevenZipArchive(t *testing.T) {
+	tmp := t.TempDir()
+	data, err := base64.StdEncoding.DecodeString(testSevenZipArchive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	archivePath := filepath.Join(tmp, "test.7z")
+	os.WriteFile(archivePath, data, 0775)
+
+	entries, err := ListArchive(nil, archivePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := map[string]*ArchiveEntry{}
+	for _, entry := range entries {
+		found[entry.Name] = entry
+	}
+	if len(found) != 4 || found["docs/hello.txt"] == nil || found["docs/second.txt"] == nil || !found["docs/empty"].IsDir {
+		t.Fatalf("unexpected entries: %v", found)
+	}
+	if found["docs/hello.txt"].Size != 12 {
+		t.Errorf("unexpected size %d", found["docs/hello.txt"].Size)
+	}
+
+	if size, err := GetArchiveEntrySize(nil, archivePath, "docs"); err != nil || size != 72 {
+		t.Errorf("unexpected entry size %d: %v", size, err)
+	}
+
+	//Extract a file that come after another file in the same solid block
+	err = ExtractArchiveEntry(nil, archivePath, "docs/second.txt", nil, filepath.Join(tmp, "single"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, _ := os.ReadFile(filepath.Join(tmp, "single", "second.txt"))
+	if string(content) != strings.Repeat("second file content\n", 3) {
+		t.Errorf("unexpected content %q", content)
+	}
+
+	//Extract a folder
+	err = ExtractArchiveEntry(nil, archivePath, "docs", nil, filepath.Join(tmp, "folder"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, _ = os.ReadFile(filepath.Join(tmp, "folder", "docs", "hello.txt"))
+	if string(content) != "hello world\n" {
+		t.Errorf("unexpected content %q", content)
+	}
+	if !IsDir(filepath.Join(tmp, "folder", "docs", "empty")) {
+		t.Error("empty folder not extracted")
+	}
+}
+
+func TestTarArchiveFormats(t *testing.T) {
+	tmp := t.TempDir()
+	files := map[string]string{
+		"project/readme.md":    "# Readme",
+		"project/src/main.go":  "package main",
+		"../escape/secret.txt": "should be skipped",
+	}
+
+	for _, format := range []string{ArchiveFormatTar, ArchiveFormatTarGz, ArchiveFormatTarZst, ArchiveFormatTarXz} {
+		archivePath := filepath.Join(tmp, "test."+format)
+		f, err := os.Create(archivePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		compressor, err := newArchiveCompressor(f, format)
+		if err != nil {
+			t.Fatal(err)
+		}
+		writer := tar.NewWriter(compressor)
+		for name, content := range files {
+			writer.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg})
+			writer.Write([]byte(content))
+		}
+		writer.Close()
+		compressor.Close()
+		f.Close()
+
+		if GetArchiveFormat(archivePath) != format {
+			t.Fatalf("format of %s not detected", archivePath)
+		}
+
+		entries, err := ListArchive(nil, archivePath)
+		if err != nil {
+			t.Fatal(format, err)
+		}
+		if len(entries) != 2 {
+			t.Errorf("%s: expect 2 entries, got %d", format, len(entries))
+		}
+
+		dest := filepath.Join(tmp, "out_"+format)
+		err = ExtractArchiveEntry(nil, archivePath, "project/src/main.go", nil, dest)
+		if err != nil {
+			t.Fatal(format, err)
+		}
+		content, _ := os.ReadFile(filepath.Join(dest, "main.go"))
+		if string(content) != "package main" {
+			t.Errorf("%s: unexpected content %q", format, content)
+		}
+
+		err = ArozExtractArchiveWithProgress([]string{archivePath}, dest, func(string, int, int, float64) int { return 0 })
+		if err != nil {
+			t.Fatal(format, err)
+		}
+		if !FileExists(filepath.Join(dest, "project", "readme.md")) || FileExists(filepath.Join(tmp, "escape")) {
+			t.Errorf("%s: unexpected extraction result", format)
+		}
+	}
+}
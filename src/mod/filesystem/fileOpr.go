@@ -90,6 +90,13 @@ func Unzip(source, destination string) error {
 
 // Aroz Unzip File with progress update function  (current filename / current file count / total file count / progress in percentage)
 func ArozUnzipFileWithProgress(filelist []string, outputfile string, progressHandler func(string, int, int, float64) int) error {
+	for _, srcFile := range filelist {
+		if format := GetArchiveFormat(srcFile); format != "" && format != ArchiveFormatZip {
+			//Not a zip file, use the format independent extractor instead
+			return ArozExtractArchiveWithProgress(filelist, outputfile, progressHandler)
+		}
+	}
+
 	//Gether the total number of files in all zip files
 	totalFileCounts := 0
 	unzippedFileCount := 0
@@ -520,15 +527,17 @@ func insideHiddenFolder(path string) bool {
 	return FileIsHidden
 }
 
+// List the filenames inside an archive on local file system, see ListArchive for supported formats
 func ViewZipFile(filepath string) ([]string, error) {
-	z := archiver.Zip{}
 	filelist := []string{}
-	err := z.Walk(filepath, func(f archiver.File) error {
-		filelist = append(filelist, f.Name())
-		return nil
-	})
-
-	return filelist, err
+	entries, err := ListArchive(nil, filepath)
+	if err != nil {
+		return filelist, err
+	}
+	for _, entry := range entries {
+		filelist = append(filelist, entry.Name)
+	}
+	return filelist, nil
 }
 
 func FileCopy(srcFsh *FileSystemHandler, src string, destFsh *FileSystemHandler, dest string, mode string, progressUpdate func(int, string) int) error {
@@ -0,0 +1,205 @@
+package fileaudit
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"imuslab.com/arozos/mod/database"
+)
+
+/*
+	File Audit Logger
+
+	This module keep an append-only trail of file operations done by users
+	across all file system handlers and access channels, so admins can trace
+	who created, moved or removed a file
+
+*/
+
+// Access channels of the file operations
+const (
+	ChannelWeb    = "web"
+	ChannelWebDAV = "webdav"
+	ChannelSFTP   = "sftp"
+	ChannelFTP    = "ftp"
+	ChannelShare  = "share"
+	ChannelAGI    = "agi"
+)
+
+// File operation actions
+const (
+	ActionUpload   = "upload"
+	ActionDownload = "download"
+	ActionCreate   = "create"
+	ActionMkdir    = "mkdir"
+	ActionMove     = "move"
+	ActionCopy     = "copy"
+	ActionRename   = "rename"
+	ActionDelete   = "delete"
+	ActionRecycle  = "recycle"
+	ActionRestore  = "restore"
+	ActionZip      = "zip"
+	ActionUnzip    = "unzip"
+	ActionShare    = "share"
+	ActionUnshare  = "unshare"
+)
+
+type Record struct {
+	Timestamp   int64  //Unix timestamp of the operation
+	Username    string //User who perform the operation
+	Action      string //One of the Action constants
+	Source      string //Virtual path of the file being operated
+	Destination string //Virtual path of the destination, empty if not applicable
+	IpAddr      string //IP address of the client
+	Channel     string //One of the Channel constants
+}
+
+// Filter of the audit log query, empty fields are not filtered
+type Filter struct {
+	Username string
+	Path     string //Match records with source or destination path containing this string
+	Action   string
+	Channel  string
+	From     time.Time
+	To       time.Time
+	Limit    int //Maximum number of records to return, newest first. 0 for unlimited
+}
+
+type Logger struct {
+	database *database.Database
+	lastKey  int64
+	mutex    sync.Mutex
+}
+
+// Create a new file audit logger with its own database file
+func NewLogger(dbPath string) (*Logger, error) {
+	os.MkdirAll(filepath.Dir(dbPath), 0775)
+	db, err := database.NewDatabase(dbPath, false)
+	if err != nil {
+		return nil, errors.New("*ERROR* Failed to create database for file audit: " + err.Error())
+	}
+	return &Logger{
+		database: db,
+	}, nil
+}
+
+// Append a record to the audit trail. Safe to call on a nil logger
+func (l *Logger) Log(record Record) error {
+	if l == nil {
+		return nil
+	}
+	if record.Timestamp == 0 {
+		record.Timestamp = time.Now().Unix()
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	//One table per month
+	tableName := time.Unix(record.Timestamp, 0).UTC().Format("Jan-2006")
+	if !l.database.TableExists(tableName) {
+		l.database.NewTable(tableName)
+	}
+
+	//Keys are strictly increasing so entries keep their logging order and never overwrite each other
+	key := time.Now().UnixNano()
+	if key <= l.lastKey {
+		key = l.lastKey + 1
+	}
+	l.lastKey = key
+
+	err := l.database.Write(tableName, fmt.Sprintf("%020d", key), record)
+	if err != nil {
+		log.Println("[File Audit] Failed to write audit log: " + err.Error())
+		return err
+	}
+	return nil
+}
+
+// Query the audit trail with the given filter, newest records first. Months and
+// entries are scanned from the newest one and the scan stops once Limit is reached
+func (l *Logger) Query(filter Filter) ([]Record, error) {
+	results := []Record{}
+	for _, tableName := range l.listMonths(filter.From, filter.To) {
+		err := l.database.ScanPrefix(tableName, "", true, func(_ []byte, value []byte) bool {
+			record := Record{}
+			if json.Unmarshal(value, &record) != nil {
+				return true
+			}
+			if filter.match(record) {
+				results = append(results, record)
+			}
+			return filter.Limit <= 0 || len(results) < filter.Limit
+		})
+		if err != nil {
+			return results, err
+		}
+		if filter.Limit > 0 && len(results) >= filter.Limit {
+			break
+		}
+	}
+	return results, nil
+}
+
+// Close the database when system shutdown
+func (l *Logger) Close() {
+	if l == nil {
+		return
+	}
+	l.database.Close()
+}
+
+// List the monthly tables that overlap with the given time range, newest month first
+func (l *Logger) listMonths(from time.Time, to time.Time) []string {
+	tableNames := []string{}
+	months := map[string]time.Time{}
+	l.database.Tables.Range(func(tableName, _ interface{}) bool {
+		month, err := time.Parse("Jan-2006", tableName.(string))
+		if err != nil {
+			return true
+		}
+		if !from.IsZero() && month.AddDate(0, 1, 0).Before(from.UTC()) {
+			return true
+		}
+		if !to.IsZero() && month.After(to.UTC()) {
+			return true
+		}
+		tableNames = append(tableNames, tableName.(string))
+		months[tableName.(string)] = month
+		return true
+	})
+	sort.Slice(tableNames, func(i, j int) bool {
+		return months[tableNames[i]].After(months[tableNames[j]])
+	})
+	return tableNames
+}
+
+func (f Filter) match(record Record) bool {
+	if f.Username != "" && record.Username != f.Username {
+		return false
+	}
+	if f.Action != "" && record.Action != f.Action {
+		return false
+	}
+	if f.Channel != "" && record.Channel != f.Channel {
+		return false
+	}
+	if f.Path != "" && !strings.Contains(record.Source, f.Path) && !strings.Contains(record.Destination, f.Path) {
+		return false
+	}
+	if !f.From.IsZero() && record.Timestamp < f.From.Unix() {
+		return false
+	}
+	if !f.To.IsZero() && record.Timestamp > f.To.Unix() {
+		return false
+	}
+	return true
+}
@@ -0,0 +1,52 @@
+package fileaudit
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLogAndQuery(t *testing.T) {
+	logger, err := NewLogger(filepath.Join(t.TempDir(), "fileaudit.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer logger.Close()
+
+	now := time.Now()
+	logger.NewRecorder("alice", "10.0.0.1", ChannelWeb).Record(ActionUpload, "user:/docs/a.txt", "")
+	logger.NewRecorder("bob", "10.0.0.2", ChannelSFTP).Record(ActionMove, "user:/docs/b.txt", "user:/old/b.txt")
+	logger.Log(Record{Timestamp: now.AddDate(0, -2, 0).Unix(), Username: "alice", Action: ActionDelete, Source: "user:/docs/c.txt", Channel: ChannelFTP})
+
+	records, err := logger.Query(Filter{})
+	if err != nil || len(records) != 3 {
+		t.Fatalf("expected 3 records, got %d (%v)", len(records), err)
+	}
+	if records[2].Action != ActionDelete {
+		t.Fatal("records not sorted newest first")
+	}
+
+	records, _ = logger.Query(Filter{Limit: 2})
+	if len(records) != 2 || records[0].Username != "bob" || records[1].Username != "alice" {
+		t.Fatalf("limit should return the newest records, got %+v", records)
+	}
+
+	records, _ = logger.Query(Filter{Username: "alice"})
+	if len(records) != 2 {
+		t.Fatalf("user filter returned %d records", len(records))
+	}
+
+	records, _ = logger.Query(Filter{Path: "/old/"})
+	if len(records) != 1 || records[0].Username != "bob" {
+		t.Fatal("path filter should match destination")
+	}
+
+	records, _ = logger.Query(Filter{From: now.AddDate(0, 0, -1), To: now.Add(time.Minute)})
+	if len(records) != 2 {
+		t.Fatalf("date filter returned %d records", len(records))
+	}
+
+	//Nil logger and recorder are no-op
+	var nilLogger *Logger
+	nilLogger.NewRecorder("alice", "", ChannelWeb).Record(ActionMkdir, "user:/x", "")
+}
@@ -0,0 +1,62 @@
+package fileaudit
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"imuslab.com/arozos/mod/utils"
+)
+
+// Handle the query of the audit trail. Filter by user, path, action, channel
+// and date range (from / to in YYYY-MM-DD, inclusive)
+func (l *Logger) HandleQuery(w http.ResponseWriter, r *http.Request) {
+	filter := Filter{
+		Limit: 1000,
+	}
+	filter.Username, _ = utils.GetPara(r, "user")
+	filter.Path, _ = utils.GetPara(r, "path")
+	filter.Action, _ = utils.GetPara(r, "action")
+	filter.Channel, _ = utils.GetPara(r, "channel")
+
+	from, _ := utils.GetPara(r, "from")
+	if from != "" {
+		t, err := time.ParseInLocation("2006-01-02", from, time.Local)
+		if err != nil {
+			utils.SendErrorResponse(w, "Invalid from date")
+			return
+		}
+		filter.From = t
+	}
+
+	to, _ := utils.GetPara(r, "to")
+	if to != "" {
+		t, err := time.ParseInLocation("2006-01-02", to, time.Local)
+		if err != nil {
+			utils.SendErrorResponse(w, "Invalid to date")
+			return
+		}
+		//Include the whole day
+		filter.To = t.AddDate(0, 0, 1).Add(-time.Second)
+	}
+
+	limit, _ := utils.GetPara(r, "limit")
+	if limit != "" {
+		l, err := strconv.Atoi(limit)
+		if err != nil || l < 0 {
+			utils.SendErrorResponse(w, "Invalid limit")
+			return
+		}
+		filter.Limit = l
+	}
+
+	records, err := l.Query(filter)
+	if err != nil {
+		utils.SendErrorResponse(w, err.Error())
+		return
+	}
+
+	js, _ := json.Marshal(records)
+	utils.SendJSONResponse(w, string(js))
+}
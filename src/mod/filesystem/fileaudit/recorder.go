@@ -0,0 +1,50 @@
+package fileaudit
+
+import (
+	"net/http"
+
+	"imuslab.com/arozos/mod/network"
+)
+
+// Recorder bind the user, client address and access channel of a session
+// so file servers can log operations without carrying the request context around
+type Recorder struct {
+	logger   *Logger
+	username string
+	ipAddr   string
+	channel  string
+}
+
+// Create a recorder for the given session. Safe to call on a nil logger
+func (l *Logger) NewRecorder(username string, ipAddr string, channel string) *Recorder {
+	if l == nil {
+		return nil
+	}
+	return &Recorder{
+		logger:   l,
+		username: username,
+		ipAddr:   ipAddr,
+		channel:  channel,
+	}
+}
+
+// Create a recorder for a web request, the client IP is resolved through the trusted proxies
+func (l *Logger) NewRecorderFromRequest(r *http.Request, username string, channel string) *Recorder {
+	ipAddr, _ := network.GetIpFromRequest(r)
+	return l.NewRecorder(username, ipAddr, channel)
+}
+
+// Record a file operation, dest can be empty. Safe to call on a nil recorder
+func (r *Recorder) Record(action string, src string, dest string) {
+	if r == nil {
+		return
+	}
+	r.logger.Log(Record{
+		Username:    r.username,
+		Action:      action,
+		Source:      src,
+		Destination: dest,
+		IpAddr:      r.ipAddr,
+		Channel:     r.channel,
+	})
+}
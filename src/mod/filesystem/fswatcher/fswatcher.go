@@ -0,0 +1,100 @@
+package fswatcher
+
+import (
+	"errors"
+	"path/filepath"
+	"sync"
+)
+
+/*
+	File System Watcher
+
+	Watch local directories for changes made outside of ArozOS
+	(e.g. by SMB, shell or other programs). Only the direct children
+	of the watched directories are reported, sub-directories need to
+	be added separately.
+
+	Directories are reference counted, so the same directory can be
+	added by multiple listeners and will only be unwatched after all
+	of them removed it.
+*/
+
+const (
+	OpCreate = "create"
+	OpDelete = "delete"
+	OpModify = "modify"
+)
+
+var ErrNotSupported = errors.New("file system watcher is not supported on this platform")
+
+type Event struct {
+	Path string //Real path of the changed file
+	Op   string //Type of change, see OpCreate, OpDelete and OpModify
+}
+
+type Watcher struct {
+	handler  func(Event)
+	refCount map[string]int
+	mutex    sync.Mutex
+	backend  *watcherBackend
+}
+
+// Create a new watcher that call handler on every change. Return ErrNotSupported
+// if the platform do not support file system notifications
+func NewWatcher(handler func(Event)) (*Watcher, error) {
+	w := &Watcher{
+		handler:  handler,
+		refCount: map[string]int{},
+	}
+	backend, err := newWatcherBackend(w.emit)
+	if err != nil {
+		return nil, err
+	}
+	w.backend = backend
+	return w, nil
+}
+
+func (w *Watcher) emit(e Event) {
+	e.Path = filepath.ToSlash(e.Path)
+	w.handler(e)
+}
+
+// Start watching the given directory
+func (w *Watcher) Add(dir string) error {
+	dir = filepath.Clean(dir)
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.refCount[dir] == 0 {
+		err := w.backend.add(dir)
+		if err != nil {
+			return err
+		}
+	}
+	w.refCount[dir]++
+	return nil
+}
+
+// Stop watching the given directory if no one else is watching it
+func (w *Watcher) Remove(dir string) error {
+	dir = filepath.Clean(dir)
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	count, ok := w.refCount[dir]
+	if !ok {
+		return nil
+	}
+	if count > 1 {
+		w.refCount[dir] = count - 1
+		return nil
+	}
+	delete(w.refCount, dir)
+	return w.backend.remove(dir)
+}
+
+// Stop all watches and release the watcher resources
+func (w *Watcher) Close() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.refCount = map[string]int{}
+	return w.backend.close()
+}
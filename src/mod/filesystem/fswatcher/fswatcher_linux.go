@@ -0,0 +1,156 @@
+//go:build linux
+// +build linux
+
+package fswatcher
+
+import (
+	"errors"
+	"path/filepath"
+	"sync"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+/*
+	inotify backend of the file system watcher
+*/
+
+const watchMask = unix.IN_CREATE | unix.IN_DELETE | unix.IN_MODIFY | unix.IN_CLOSE_WRITE |
+	unix.IN_MOVED_FROM | unix.IN_MOVED_TO | unix.IN_ATTRIB | unix.IN_DELETE_SELF
+
+type watcherBackend struct {
+	fd       int
+	emit     func(Event)
+	watches  map[string]int //dir -> watch descriptor
+	dirs     map[int]string //watch descriptor -> dir
+	mutex    sync.Mutex
+	stopChan chan bool
+	stopped  chan bool
+}
+
+func newWatcherBackend(emit func(Event)) (*watcherBackend, error) {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if err != nil {
+		return nil, err
+	}
+
+	b := &watcherBackend{
+		fd:       fd,
+		emit:     emit,
+		watches:  map[string]int{},
+		dirs:     map[int]string{},
+		stopChan: make(chan bool),
+		stopped:  make(chan bool),
+	}
+	go b.readEvents()
+	return b, nil
+}
+
+func (b *watcherBackend) add(dir string) error {
+	wd, err := unix.InotifyAddWatch(b.fd, dir, watchMask)
+	if err != nil {
+		return err
+	}
+	b.mutex.Lock()
+	b.watches[dir] = wd
+	b.dirs[wd] = dir
+	b.mutex.Unlock()
+	return nil
+}
+
+func (b *watcherBackend) remove(dir string) error {
+	b.mutex.Lock()
+	wd, ok := b.watches[dir]
+	if ok {
+		delete(b.watches, dir)
+		delete(b.dirs, wd)
+	}
+	b.mutex.Unlock()
+	if !ok {
+		return errors.New("directory not watched")
+	}
+	_, err := unix.InotifyRmWatch(b.fd, uint32(wd))
+	return err
+}
+
+func (b *watcherBackend) close() error {
+	select {
+	case <-b.stopChan:
+		return nil
+	default:
+	}
+	close(b.stopChan)
+	<-b.stopped
+	return unix.Close(b.fd)
+}
+
+// Read the events from inotify until the backend is closed. The fd is
+// non-blocking and polled with timeout so closing the watcher do not
+// depends on a new event arriving
+func (b *watcherBackend) readEvents() {
+	defer close(b.stopped)
+	buf := make([]byte, 64*(unix.SizeofInotifyEvent+unix.NAME_MAX+1))
+	for {
+		select {
+		case <-b.stopChan:
+			return
+		default:
+		}
+
+		fds := []unix.PollFd{{Fd: int32(b.fd), Events: unix.POLLIN}}
+		n, err := unix.Poll(fds, 500)
+		if err != nil && err != unix.EINTR {
+			return
+		}
+		if n <= 0 {
+			continue
+		}
+
+		n, err = unix.Read(b.fd, buf)
+		if err != nil || n < unix.SizeofInotifyEvent {
+			continue
+		}
+
+		offset := 0
+		for offset+unix.SizeofInotifyEvent <= n {
+			raw := (*unix.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			nameBytes := buf[offset+unix.SizeofInotifyEvent : offset+unix.SizeofInotifyEvent+int(raw.Len)]
+			offset += unix.SizeofInotifyEvent + int(raw.Len)
+
+			b.mutex.Lock()
+			dir, ok := b.dirs[int(raw.Wd)]
+			if ok && raw.Mask&(unix.IN_DELETE_SELF|unix.IN_IGNORED) != 0 {
+				//The watched directory itself is gone
+				delete(b.dirs, int(raw.Wd))
+				delete(b.watches, dir)
+			}
+			b.mutex.Unlock()
+			if !ok {
+				continue
+			}
+
+			name := string(nameBytes)
+			for i := 0; i < len(name); i++ {
+				if name[i] == 0 {
+					name = name[:i]
+					break
+				}
+			}
+
+			filename := dir
+			if name != "" {
+				filename = filepath.Join(dir, name)
+			}
+
+			switch {
+			case raw.Mask&(unix.IN_CREATE|unix.IN_MOVED_TO) != 0:
+				b.emit(Event{Path: filename, Op: OpCreate})
+			case raw.Mask&(unix.IN_DELETE|unix.IN_MOVED_FROM|unix.IN_DELETE_SELF) != 0:
+				b.emit(Event{Path: filename, Op: OpDelete})
+			case raw.Mask&(unix.IN_MODIFY|unix.IN_CLOSE_WRITE|unix.IN_ATTRIB) != 0:
+				b.emit(Event{Path: filename, Op: OpModify})
+			}
+		}
+	}
+}
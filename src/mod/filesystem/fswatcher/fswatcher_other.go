@@ -0,0 +1,28 @@
+//go:build !linux
+// +build !linux
+
+package fswatcher
+
+/*
+	Fallback backend for platforms without inotify support.
+	Changes made through ArozOS are still published by the
+	file system handlers.
+*/
+
+type watcherBackend struct{}
+
+func newWatcherBackend(emit func(Event)) (*watcherBackend, error) {
+	return nil, ErrNotSupported
+}
+
+func (b *watcherBackend) add(dir string) error {
+	return ErrNotSupported
+}
+
+func (b *watcherBackend) remove(dir string) error {
+	return ErrNotSupported
+}
+
+func (b *watcherBackend) close() error {
+	return nil
+}
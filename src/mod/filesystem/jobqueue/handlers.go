@@ -0,0 +1,171 @@
+package jobqueue
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"imuslab.com/arozos/mod/user"
+	"imuslab.com/arozos/mod/utils"
+)
+
+/*
+	File Operation Queue HTTP Handlers
+
+	Users can only see and control their own jobs,
+	administrators can list and control the jobs of all users
+*/
+
+// Add a new job, require opr, src (JSON array of vpaths), dest and optional conflict
+func (q *Queue) HandleAddJob(w http.ResponseWriter, r *http.Request) {
+	userinfo, err := q.options.UserHandler.GetUserInfoFromRequest(w, r)
+	if err != nil {
+		utils.SendErrorResponse(w, "user not logged in")
+		return
+	}
+
+	operation, err := utils.PostPara(r, "opr")
+	if err != nil {
+		utils.SendErrorResponse(w, "invalid operation given")
+		return
+	}
+
+	srcJSON, err := utils.PostPara(r, "src")
+	if err != nil {
+		utils.SendErrorResponse(w, "invalid source files given")
+		return
+	}
+	sources := []string{}
+	err = json.Unmarshal([]byte(srcJSON), &sources)
+	if err != nil || len(sources) == 0 {
+		utils.SendErrorResponse(w, "unable to parse source file list")
+		return
+	}
+
+	dest, err := utils.PostPara(r, "dest")
+	if err != nil {
+		utils.SendErrorResponse(w, "invalid destination given")
+		return
+	}
+	conflict, _ := utils.PostPara(r, "conflict")
+
+	//Check permissions and quota before the job is queued
+	var totalSize int64
+	for _, vsrc := range sources {
+		if !userinfo.CanRead(vsrc) {
+			utils.SendErrorResponse(w, "permission denied: "+vsrc)
+			return
+		}
+		if operation == OprMove && !userinfo.CanWrite(vsrc) {
+			utils.SendErrorResponse(w, "permission denied: "+vsrc)
+			return
+		}
+		fsh, rpath, err := q.options.Resolve(userinfo.Username, vsrc)
+		if err != nil || !fsh.FileSystemAbstraction.FileExists(rpath) {
+			utils.SendErrorResponse(w, "source file not exists: "+vsrc)
+			return
+		}
+		totalSize += sizeOf(fsh, rpath)
+	}
+	if !userinfo.CanWrite(dest) {
+		utils.SendErrorResponse(w, "permission denied: "+dest)
+		return
+	}
+	if operation != OprUnzip {
+		destFsh, rdest, err := q.options.Resolve(userinfo.Username, dest)
+		if err != nil || !destFsh.FileSystemAbstraction.IsDir(rdest) {
+			utils.SendErrorResponse(w, "destination folder not exists")
+			return
+		}
+		if operation == OprCopy && !userinfo.HaveSpaceOn(destFsh, totalSize) {
+			utils.SendErrorResponse(w, "storage quota exceeded")
+			return
+		}
+	}
+
+	job, err := q.AddJob(userinfo.Username, operation, sources, dest, conflict)
+	if err != nil {
+		utils.SendErrorResponse(w, err.Error())
+		return
+	}
+	js, _ := json.Marshal(job)
+	utils.SendJSONResponse(w, string(js))
+}
+
+// List the jobs of the current user. Administrators can set all=true to list jobs of all users
+func (q *Queue) HandleListJobs(w http.ResponseWriter, r *http.Request) {
+	userinfo, err := q.options.UserHandler.GetUserInfoFromRequest(w, r)
+	if err != nil {
+		utils.SendErrorResponse(w, "user not logged in")
+		return
+	}
+
+	owner := userinfo.Username
+	listAll, _ := utils.GetPara(r, "all")
+	if listAll == "true" && userinfo.IsAdmin() {
+		owner = ""
+	}
+
+	jobID, _ := utils.GetPara(r, "id")
+	if jobID != "" {
+		job, err := q.GetJob(jobID)
+		if err != nil || !canControl(userinfo, job) {
+			utils.SendErrorResponse(w, "job not found")
+			return
+		}
+		js, _ := json.Marshal(job)
+		utils.SendJSONResponse(w, string(js))
+		return
+	}
+
+	js, _ := json.Marshal(q.ListJobs(owner))
+	utils.SendJSONResponse(w, string(js))
+}
+
+// Pause, resume, cancel or remove a job, require id and action
+func (q *Queue) HandleJobControl(w http.ResponseWriter, r *http.Request) {
+	userinfo, err := q.options.UserHandler.GetUserInfoFromRequest(w, r)
+	if err != nil {
+		utils.SendErrorResponse(w, "user not logged in")
+		return
+	}
+
+	jobID, err := utils.PostPara(r, "id")
+	if err != nil {
+		utils.SendErrorResponse(w, "invalid job id given")
+		return
+	}
+	action, err := utils.PostPara(r, "action")
+	if err != nil {
+		utils.SendErrorResponse(w, "invalid action given")
+		return
+	}
+
+	job, err := q.GetJob(jobID)
+	if err != nil || !canControl(userinfo, job) {
+		utils.SendErrorResponse(w, "job not found")
+		return
+	}
+
+	switch action {
+	case "pause":
+		err = q.PauseJob(jobID)
+	case "resume":
+		err = q.ResumeJob(jobID)
+	case "cancel":
+		err = q.CancelJob(jobID)
+	case "remove":
+		err = q.RemoveJob(jobID)
+	default:
+		utils.SendErrorResponse(w, "unsupported action")
+		return
+	}
+	if err != nil {
+		utils.SendErrorResponse(w, err.Error())
+		return
+	}
+	utils.SendOK(w)
+}
+
+func canControl(userinfo *user.User, job Job) bool {
+	return job.Owner == userinfo.Username || userinfo.IsAdmin()
+}
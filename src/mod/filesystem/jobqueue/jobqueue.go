@@ -0,0 +1,544 @@
+package jobqueue
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+	"imuslab.com/arozos/mod/database"
+	"imuslab.com/arozos/mod/filesystem"
+	"imuslab.com/arozos/mod/user"
+)
+
+/*
+	Background File Operation Queue
+
+	Persistent queue for long running file operations (copy, move, zip
+	and unzip). Jobs are stored in the system database, so they are not
+	tied to the browser tab that created them and survive restarts.
+
+	Conflicts are resolved with the policy given when the job is created
+	(skip, overwrite or keep both), so jobs never stop and wait for user input.
+	Interrupted copy / move jobs continue from the last processed file
+	when resumed, zip / unzip jobs restart from the beginning.
+	Finished jobs are removed from the database after FinishedJobTTL.
+*/
+
+const (
+	jobTable = "fileopr_jobs"
+
+	StatusQueued    = "queued"
+	StatusRunning   = "running"
+	StatusPaused    = "paused"
+	StatusCompleted = "completed"
+	StatusFailed    = "failed"
+	StatusCancelled = "cancelled"
+
+	OprCopy  = "copy"
+	OprMove  = "move"
+	OprZip   = "zip"
+	OprUnzip = "unzip"
+
+	ConflictSkip      = "skip"
+	ConflictOverwrite = "overwrite"
+	ConflictKeep      = "keep"
+)
+
+var (
+	errJobPaused    = errors.New("job paused")
+	errJobCancelled = errors.New("job cancelled")
+)
+
+type Job struct {
+	ID         string
+	Owner      string   //Username of the job creator, paths are resolved with this user's permission
+	Operation  string   //copy, move, zip or unzip
+	Sources    []string //Virtual paths of the source files
+	Dest       string   //Virtual path of the destination folder
+	Conflict   string   //Conflict policy when the target already exists, see ConflictSkip, ConflictOverwrite and ConflictKeep
+	Status     string
+	Progress   float64 //Progress in percentage
+	LatestFile string  //Name of the file being processed
+	Error      string
+	Attempts   int //Number of times this job has been started
+	CreateTime int64
+	StartTime  int64
+	FinishTime int64
+
+	//Checkpoints for resuming
+	Targets     map[string]string //Source vpath -> resolved target real path, empty if skipped
+	SourceSizes map[string]int64  //Source vpath -> total size in bytes
+	Completed   []string          //Source vpaths that are fully processed
+	DoneSize    int64
+	TotalSize   int64
+}
+
+type Options struct {
+	Database       *database.Database
+	UserHandler    *user.UserHandler
+	Resolve        func(owner string, vpath string) (*filesystem.FileSystemHandler, string, error) //Resolve a virtual path of the owner into its file system handler and real path
+	MaxJobs        int                                                                             //Maximum number of jobs running at the same time
+	MaxJobsPerUser int                                                                             //Maximum number of jobs running at the same time for each user
+	OnUpdate       func(job Job, event string)                                                     //Called when a job is updated, can be nil
+	FinishedJobTTL time.Duration                                                                   //Time to keep completed, failed and cancelled jobs, 0 to keep until removed by user
+}
+
+type Queue struct {
+	options  *Options
+	jobs     map[string]*Job
+	signals  map[string]int //Job ID -> control signal of running jobs, see filesystem.FsOpr_*
+	mutex    sync.Mutex
+	wake     chan bool
+	stop     chan bool
+	workers  sync.WaitGroup
+	stopOnce sync.Once
+}
+
+// Create a new queue and resume the unfinished jobs from the database
+func NewQueue(options *Options) (*Queue, error) {
+	if options.MaxJobs <= 0 {
+		options.MaxJobs = 1
+	}
+	if options.MaxJobsPerUser <= 0 || options.MaxJobsPerUser > options.MaxJobs {
+		options.MaxJobsPerUser = options.MaxJobs
+	}
+
+	err := options.Database.NewTable(jobTable)
+	if err != nil {
+		return nil, err
+	}
+
+	q := &Queue{
+		options: options,
+		jobs:    map[string]*Job{},
+		signals: map[string]int{},
+		wake:    make(chan bool, 1),
+		stop:    make(chan bool),
+	}
+
+	//Load the jobs from the database. Jobs that were running are queued again
+	entries, err := options.Database.ListTable(jobTable)
+	if err != nil {
+		return nil, err
+	}
+	for _, keypairs := range entries {
+		job := Job{}
+		if err := json.Unmarshal(keypairs[1], &job); err != nil {
+			continue
+		}
+		if job.Status == StatusRunning {
+			job.Status = StatusQueued
+			q.saveJob(&job)
+		}
+		q.jobs[job.ID] = &job
+	}
+	q.pruneFinishedJobs()
+
+	go q.dispatchLoop()
+	q.notify()
+	return q, nil
+}
+
+// Add a new job to the queue. The paths and permissions should be checked by the caller
+func (q *Queue) AddJob(owner string, operation string, sources []string, dest string, conflict string) (*Job, error) {
+	if operation != OprCopy && operation != OprMove && operation != OprZip && operation != OprUnzip {
+		return nil, errors.New("unsupported operation")
+	}
+	if conflict == "" {
+		conflict = ConflictSkip
+	}
+	if conflict != ConflictSkip && conflict != ConflictOverwrite && conflict != ConflictKeep {
+		return nil, errors.New("unsupported conflict policy")
+	}
+	if len(sources) == 0 {
+		return nil, errors.New("no source files given")
+	}
+
+	job := &Job{
+		ID:          strconv.FormatInt(time.Now().Unix(), 10) + "_" + uuid.NewV4().String(),
+		Owner:       owner,
+		Operation:   operation,
+		Sources:     sources,
+		Dest:        dest,
+		Conflict:    conflict,
+		Status:      StatusQueued,
+		CreateTime:  time.Now().Unix(),
+		Targets:     map[string]string{},
+		SourceSizes: map[string]int64{},
+		Completed:   []string{},
+	}
+
+	q.mutex.Lock()
+	q.jobs[job.ID] = job
+	err := q.saveJob(job)
+	snapshot := *job
+	q.mutex.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	q.emit(snapshot, "queued")
+	q.notify()
+	return &snapshot, nil
+}
+
+// Get a copy of the job with the given ID
+func (q *Queue) GetJob(id string) (Job, error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	job, ok := q.jobs[id]
+	if !ok {
+		return Job{}, errors.New("job not found")
+	}
+	return *job, nil
+}
+
+// List the jobs of the given user, or all jobs if owner is empty. Sorted by creation time
+func (q *Queue) ListJobs(owner string) []Job {
+	q.mutex.Lock()
+	results := []Job{}
+	for _, job := range q.jobs {
+		if owner == "" || job.Owner == owner {
+			results = append(results, *job)
+		}
+	}
+	q.mutex.Unlock()
+
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].CreateTime == results[j].CreateTime {
+			return results[i].ID < results[j].ID
+		}
+		return results[i].CreateTime < results[j].CreateTime
+	})
+	return results
+}
+
+// Pause a queued or running job. Running jobs stop after the current file
+func (q *Queue) PauseJob(id string) error {
+	q.mutex.Lock()
+	job, ok := q.jobs[id]
+	if !ok {
+		q.mutex.Unlock()
+		return errors.New("job not found")
+	}
+	switch job.Status {
+	case StatusQueued:
+		job.Status = StatusPaused
+		q.saveJob(job)
+	case StatusRunning:
+		q.signals[id] = filesystem.FsOpr_Pause
+	case StatusPaused:
+	default:
+		q.mutex.Unlock()
+		return errors.New("job already finished")
+	}
+	snapshot := *job
+	q.mutex.Unlock()
+
+	if snapshot.Status == StatusPaused {
+		q.emit(snapshot, "paused")
+	}
+	return nil
+}
+
+// Resume a paused, failed or cancelled job
+func (q *Queue) ResumeJob(id string) error {
+	q.mutex.Lock()
+	job, ok := q.jobs[id]
+	if !ok {
+		q.mutex.Unlock()
+		return errors.New("job not found")
+	}
+	switch job.Status {
+	case StatusPaused, StatusFailed:
+		job.Status = StatusQueued
+		job.Error = ""
+		q.saveJob(job)
+	case StatusRunning:
+		//Withdraw the pending pause request if any
+		q.signals[id] = filesystem.FsOpr_Continue
+	case StatusQueued:
+	default:
+		q.mutex.Unlock()
+		return errors.New("job cannot be resumed")
+	}
+	snapshot := *job
+	q.mutex.Unlock()
+
+	q.emit(snapshot, "queued")
+	q.notify()
+	return nil
+}
+
+// Cancel a job. Files that are already processed are kept
+func (q *Queue) CancelJob(id string) error {
+	q.mutex.Lock()
+	job, ok := q.jobs[id]
+	if !ok {
+		q.mutex.Unlock()
+		return errors.New("job not found")
+	}
+	switch job.Status {
+	case StatusQueued, StatusPaused, StatusFailed:
+		job.Status = StatusCancelled
+		job.FinishTime = time.Now().Unix()
+		q.saveJob(job)
+	case StatusRunning:
+		q.signals[id] = filesystem.FsOpr_Cancel
+	default:
+		q.mutex.Unlock()
+		return errors.New("job already finished")
+	}
+	snapshot := *job
+	q.mutex.Unlock()
+
+	if snapshot.Status == StatusCancelled {
+		q.emit(snapshot, "cancelled")
+	}
+	return nil
+}
+
+// Remove a finished job from the job list
+func (q *Queue) RemoveJob(id string) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	job, ok := q.jobs[id]
+	if !ok {
+		return errors.New("job not found")
+	}
+	if job.Status == StatusRunning || job.Status == StatusQueued {
+		return errors.New("job is not finished")
+	}
+	delete(q.jobs, id)
+	return q.options.Database.Delete(jobTable, id)
+}
+
+// Stop dispatching new jobs and pause the running ones. The paused jobs continue on next startup
+func (q *Queue) Close() {
+	q.stopOnce.Do(func() {
+		close(q.stop)
+		q.mutex.Lock()
+		for id := range q.signals {
+			q.signals[id] = filesystem.FsOpr_Pause
+		}
+		q.mutex.Unlock()
+		q.workers.Wait()
+
+		//Jobs paused by shutdown should continue after restart
+		q.mutex.Lock()
+		for _, job := range q.jobs {
+			if job.Status == StatusPaused && job.Error == shutdownMarker {
+				job.Status = StatusQueued
+				job.Error = ""
+				q.saveJob(job)
+			}
+		}
+		q.mutex.Unlock()
+	})
+}
+
+/*
+	Internal functions
+*/
+
+const shutdownMarker = "interrupted by shutdown"
+
+// Write the job to database, must be called with the mutex locked
+func (q *Queue) saveJob(job *Job) error {
+	return q.options.Database.Write(jobTable, job.ID, job)
+}
+
+func (q *Queue) emit(job Job, event string) {
+	if q.options.OnUpdate != nil {
+		q.options.OnUpdate(job, event)
+	}
+}
+
+// Wake up the dispatcher
+func (q *Queue) notify() {
+	select {
+	case q.wake <- true:
+	default:
+	}
+}
+
+func (q *Queue) dispatchLoop() {
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+	pruneTicker := time.NewTicker(time.Hour)
+	defer pruneTicker.Stop()
+	for {
+		select {
+		case <-q.stop:
+			return
+		case <-q.wake:
+		case <-ticker.C:
+		case <-pruneTicker.C:
+			q.pruneFinishedJobs()
+			continue
+		}
+		q.dispatch()
+	}
+}
+
+// Remove the finished jobs that are older than FinishedJobTTL
+func (q *Queue) pruneFinishedJobs() {
+	if q.options.FinishedJobTTL <= 0 {
+		return
+	}
+	expireTime := time.Now().Add(-q.options.FinishedJobTTL).Unix()
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	for id, job := range q.jobs {
+		if job.Status != StatusCompleted && job.Status != StatusFailed && job.Status != StatusCancelled {
+			continue
+		}
+		if job.FinishTime > 0 && job.FinishTime < expireTime {
+			delete(q.jobs, id)
+			q.options.Database.Delete(jobTable, id)
+		}
+	}
+}
+
+// Start the queued jobs that fit into the concurrency limits, oldest first
+func (q *Queue) dispatch() {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	select {
+	case <-q.stop:
+		return
+	default:
+	}
+
+	runningTotal := 0
+	runningPerUser := map[string]int{}
+	queued := []*Job{}
+	for _, job := range q.jobs {
+		if job.Status == StatusRunning {
+			runningTotal++
+			runningPerUser[job.Owner]++
+		} else if job.Status == StatusQueued {
+			queued = append(queued, job)
+		}
+	}
+	sort.Slice(queued, func(i, j int) bool {
+		if queued[i].CreateTime == queued[j].CreateTime {
+			return queued[i].ID < queued[j].ID
+		}
+		return queued[i].CreateTime < queued[j].CreateTime
+	})
+
+	for _, job := range queued {
+		if runningTotal >= q.options.MaxJobs {
+			return
+		}
+		if runningPerUser[job.Owner] >= q.options.MaxJobsPerUser {
+			continue
+		}
+		runningTotal++
+		runningPerUser[job.Owner]++
+
+		job.Status = StatusRunning
+		job.Attempts++
+		job.Error = ""
+		if job.StartTime == 0 {
+			job.StartTime = time.Now().Unix()
+		}
+		q.signals[job.ID] = filesystem.FsOpr_Continue
+		q.saveJob(job)
+
+		q.workers.Add(1)
+		go q.runJob(job.ID)
+	}
+}
+
+// Execute the job and record its result
+func (q *Queue) runJob(id string) {
+	defer q.workers.Done()
+
+	q.mutex.Lock()
+	job := *q.jobs[id]
+	q.mutex.Unlock()
+	q.emit(job, "started")
+
+	err := q.execute(&job)
+
+	q.mutex.Lock()
+	event := ""
+	switch err {
+	case nil:
+		job.Status = StatusCompleted
+		job.Progress = 100
+		job.FinishTime = time.Now().Unix()
+		event = "completed"
+	case errJobPaused:
+		job.Status = StatusPaused
+		select {
+		case <-q.stop:
+			job.Error = shutdownMarker
+		default:
+		}
+		event = "paused"
+	case errJobCancelled:
+		job.Status = StatusCancelled
+		job.FinishTime = time.Now().Unix()
+		event = "cancelled"
+	default:
+		job.Status = StatusFailed
+		job.Error = err.Error()
+		job.FinishTime = time.Now().Unix()
+		event = "failed"
+		log.Println("[File Operation] Job " + job.ID + " failed: " + err.Error())
+	}
+	delete(q.signals, id)
+	q.jobs[id] = &job
+	q.saveJob(&job)
+	q.mutex.Unlock()
+
+	q.emit(job, event)
+	q.notify()
+}
+
+// Save the checkpoint of a running job and return the current control signal
+func (q *Queue) checkpoint(job *Job, persist bool) int {
+	q.mutex.Lock()
+	signal := q.signals[job.ID]
+	snapshot := *job
+	snapshot.Targets = copyStringMap(job.Targets)
+	snapshot.SourceSizes = copySizeMap(job.SourceSizes)
+	snapshot.Completed = append([]string{}, job.Completed...)
+	snapshot.Status = StatusRunning
+	q.jobs[job.ID] = &snapshot
+	if persist {
+		q.saveJob(&snapshot)
+	}
+	q.mutex.Unlock()
+
+	if persist {
+		q.emit(snapshot, "progress")
+	}
+	return signal
+}
+
+func copyStringMap(m map[string]string) map[string]string {
+	result := map[string]string{}
+	for k, v := range m {
+		result[k] = v
+	}
+	return result
+}
+
+func copySizeMap(m map[string]int64) map[string]int64 {
+	result := map[string]int64{}
+	for k, v := range m {
+		result[k] = v
+	}
+	return result
+}
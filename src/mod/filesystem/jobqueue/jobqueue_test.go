@@ -0,0 +1,284 @@
+package jobqueue
+
+import (
+	"archive/zip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"imuslab.com/arozos/mod/database"
+	"imuslab.com/arozos/mod/filesystem"
+	"imuslab.com/arozos/mod/filesystem/abstractions/localfs"
+)
+
+// Create a queue that resolve test:/ into a temporary folder
+func newTestQueue(t *testing.T, root string, db *database.Database) *Queue {
+	fsh := &filesystem.FileSystemHandler{
+		UUID:                  "test",
+		Path:                  root,
+		Filesystem:            "ext4",
+		FileSystemAbstraction: localfs.NewLocalFileSystemAbstraction("test", root, "public", false),
+	}
+	q, err := NewQueue(&Options{
+		Database: db,
+		Resolve: func(owner string, vpath string) (*filesystem.FileSystemHandler, string, error) {
+			return fsh, filepath.Join(root, strings.TrimPrefix(vpath, "test:/")), nil
+		},
+		MaxJobs:        2,
+		MaxJobsPerUser: 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return q
+}
+
+func newTestDatabase(t *testing.T) *database.Database {
+	db, err := database.NewDatabase(filepath.Join(t.TempDir(), "test.db"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(db.Close)
+	return db
+}
+
+func waitForJob(t *testing.T, q *Queue, id string) Job {
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		job, err := q.GetJob(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if job.Status != StatusQueued && job.Status != StatusRunning {
+			return job
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatalf("job %s not finished in time", id)
+	return Job{}
+}
+
+func writeTestFile(t *testing.T, path string, content string) {
+	os.MkdirAll(filepath.Dir(path), 0775)
+	if err := os.WriteFile(path, []byte(content), 0775); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCopyWithConflictPolicy(t *testing.T) {
+	root := t.TempDir()
+	writeTestFile(t, filepath.Join(root, "src/album/a.txt"), "aaa")
+	writeTestFile(t, filepath.Join(root, "src/album/sub/b.txt"), "bbbb")
+	writeTestFile(t, filepath.Join(root, "dest/album/a.txt"), "old")
+
+	q := newTestQueue(t, root, newTestDatabase(t))
+	defer q.Close()
+
+	created, err := q.AddJob("alice", OprCopy, []string{"test:/src/album"}, "test:/dest", ConflictKeep)
+	if err != nil {
+		t.Fatal(err)
+	}
+	job := waitForJob(t, q, created.ID)
+	if job.Status != StatusCompleted {
+		t.Fatalf("expected completed job, got %s (%s)", job.Status, job.Error)
+	}
+
+	content, err := os.ReadFile(filepath.Join(root, "dest/album - Copy/sub/b.txt"))
+	if err != nil || string(content) != "bbbb" {
+		t.Fatalf("copied file not found in renamed folder: %v", err)
+	}
+	content, _ = os.ReadFile(filepath.Join(root, "dest/album/a.txt"))
+	if string(content) != "old" {
+		t.Fatalf("existing file should not be touched")
+	}
+	if job.DoneSize != 7 || job.Progress != 100 {
+		t.Fatalf("unexpected progress %d bytes / %f%%", job.DoneSize, job.Progress)
+	}
+}
+
+func TestResumeInterruptedMove(t *testing.T) {
+	root := t.TempDir()
+	writeTestFile(t, filepath.Join(root, "src/a.txt"), "aaa")
+	writeTestFile(t, filepath.Join(root, "src/docs/b.txt"), "bbbb")
+	writeTestFile(t, filepath.Join(root, "other/docs/b.txt"), "bb")
+
+	//A move job that was interrupted after a.txt, with docs targeted into the other folder
+	db := newTestDatabase(t)
+	db.NewTable(jobTable)
+	db.Write(jobTable, "job1", Job{
+		ID:          "job1",
+		Owner:       "alice",
+		Operation:   OprMove,
+		Sources:     []string{"test:/src/a.txt", "test:/src/docs"},
+		Dest:        "test:/other",
+		Conflict:    ConflictOverwrite,
+		Status:      StatusRunning,
+		Attempts:    1,
+		Targets:     map[string]string{"test:/src/a.txt": filepath.Join(root, "other/a.txt"), "test:/src/docs": filepath.Join(root, "other/docs")},
+		SourceSizes: map[string]int64{"test:/src/a.txt": 3, "test:/src/docs": 4},
+		Completed:   []string{"test:/src/a.txt"},
+		DoneSize:    3,
+		TotalSize:   7,
+	})
+
+	q := newTestQueue(t, root, db)
+	defer q.Close()
+
+	job := waitForJob(t, q, "job1")
+	if job.Status != StatusCompleted || job.Attempts != 2 {
+		t.Fatalf("expected resumed job to complete, got %s after %d attempts (%s)", job.Status, job.Attempts, job.Error)
+	}
+	content, _ := os.ReadFile(filepath.Join(root, "other/docs/b.txt"))
+	if string(content) != "bbbb" {
+		t.Fatalf("partially copied file not overwritten, got %q", content)
+	}
+	if _, err := os.Stat(filepath.Join(root, "src/docs")); !os.IsNotExist(err) {
+		t.Fatalf("moved source folder should be removed")
+	}
+	if job.DoneSize != 7 {
+		t.Fatalf("expected 7 bytes done, got %d", job.DoneSize)
+	}
+}
+
+func TestPauseAndCancelQueuedJob(t *testing.T) {
+	root := t.TempDir()
+	writeTestFile(t, filepath.Join(root, "src/a.txt"), "aaa")
+	os.MkdirAll(filepath.Join(root, "dest"), 0775)
+
+	q := newTestQueue(t, root, newTestDatabase(t))
+	defer q.Close()
+
+	//Hold the only slot of alice so the next job stays in queue
+	q.mutex.Lock()
+	blocker := &Job{ID: "blocker", Owner: "alice", Status: StatusRunning, CreateTime: 1}
+	q.jobs[blocker.ID] = blocker
+	q.mutex.Unlock()
+
+	created, err := q.AddJob("alice", OprCopy, []string{"test:/src/a.txt"}, "test:/dest", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if job, _ := q.GetJob(created.ID); job.Status != StatusQueued {
+		t.Fatalf("job should wait for the per user limit, got %s", job.Status)
+	}
+
+	if err := q.PauseJob(created.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.CancelJob(created.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.ResumeJob(created.ID); err == nil {
+		t.Fatalf("cancelled job should not be resumed")
+	}
+	if _, err := os.Stat(filepath.Join(root, "dest/a.txt")); !os.IsNotExist(err) {
+		t.Fatalf("cancelled job should not copy any file")
+	}
+	if err := q.RemoveJob(created.ID); err != nil {
+		t.Fatal(err)
+	}
+	if len(q.ListJobs("alice")) != 1 {
+		t.Fatalf("removed job still listed")
+	}
+}
+
+func TestResumeMoveAfterSourceRemoved(t *testing.T) {
+	root := t.TempDir()
+	writeTestFile(t, filepath.Join(root, "dest/a.txt"), "aaa")
+	writeTestFile(t, filepath.Join(root, "dest/b.txt"), "old")
+	writeTestFile(t, filepath.Join(root, "src/b.txt"), "new")
+
+	//a.txt was moved but the job stopped before it is marked as completed
+	db := newTestDatabase(t)
+	db.NewTable(jobTable)
+	db.Write(jobTable, "job1", Job{
+		ID:          "job1",
+		Owner:       "alice",
+		Operation:   OprMove,
+		Sources:     []string{"test:/src/a.txt", "test:/src/b.txt"},
+		Dest:        "test:/dest",
+		Conflict:    ConflictOverwrite,
+		Status:      StatusRunning,
+		Attempts:    1,
+		Targets:     map[string]string{"test:/src/a.txt": filepath.Join(root, "dest/a.txt"), "test:/src/b.txt": filepath.Join(root, "dest/b.txt")},
+		SourceSizes: map[string]int64{"test:/src/a.txt": 3, "test:/src/b.txt": 3},
+		Completed:   []string{},
+		TotalSize:   6,
+	})
+
+	q := newTestQueue(t, root, db)
+	defer q.Close()
+
+	job := waitForJob(t, q, "job1")
+	if job.Status != StatusCompleted || job.DoneSize != 6 {
+		t.Fatalf("expected resumed job to complete, got %s with %d bytes (%s)", job.Status, job.DoneSize, job.Error)
+	}
+	//Same size file must not be treated as copied under overwrite policy
+	content, _ := os.ReadFile(filepath.Join(root, "dest/b.txt"))
+	if string(content) != "new" {
+		t.Fatalf("existing file with the same size not overwritten, got %q", content)
+	}
+}
+
+func TestUnzipWithConflictPolicy(t *testing.T) {
+	root := t.TempDir()
+	os.MkdirAll(filepath.Join(root, "src"), 0775)
+	f, err := os.Create(filepath.Join(root, "src/test.zip"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer := zip.NewWriter(f)
+	for name, content := range map[string]string{"a.txt": "new", "docs/b.txt": "new"} {
+		w, _ := writer.Create(name)
+		w.Write([]byte(content))
+	}
+	writer.Close()
+	f.Close()
+	writeTestFile(t, filepath.Join(root, "dest/a.txt"), "old")
+
+	q := newTestQueue(t, root, newTestDatabase(t))
+	defer q.Close()
+
+	created, err := q.AddJob("alice", OprUnzip, []string{"test:/src/test.zip"}, "test:/dest", ConflictSkip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	job := waitForJob(t, q, created.ID)
+	if job.Status != StatusCompleted {
+		t.Fatalf("expected completed job, got %s (%s)", job.Status, job.Error)
+	}
+	content, _ := os.ReadFile(filepath.Join(root, "dest/a.txt"))
+	if string(content) != "old" {
+		t.Fatalf("existing file should be skipped, got %q", content)
+	}
+	content, _ = os.ReadFile(filepath.Join(root, "dest/docs/b.txt"))
+	if string(content) != "new" {
+		t.Fatalf("new file not extracted, got %q", content)
+	}
+	if entries, _ := os.ReadDir(filepath.Join(root, "dest")); len(entries) != 2 {
+		t.Fatalf("staging folder not removed, got %d entries", len(entries))
+	}
+}
+
+func TestPruneFinishedJobs(t *testing.T) {
+	db := newTestDatabase(t)
+	db.NewTable(jobTable)
+	db.Write(jobTable, "old", Job{ID: "old", Owner: "alice", Status: StatusCompleted, FinishTime: time.Now().Add(-48 * time.Hour).Unix()})
+	db.Write(jobTable, "recent", Job{ID: "recent", Owner: "alice", Status: StatusFailed, FinishTime: time.Now().Unix()})
+
+	q, err := NewQueue(&Options{Database: db, FinishedJobTTL: 24 * time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+
+	if _, err := q.GetJob("old"); err == nil || db.KeyExists(jobTable, "old") {
+		t.Fatalf("expired job should be removed")
+	}
+	if _, err := q.GetJob("recent"); err != nil {
+		t.Fatalf("recent job should be kept")
+	}
+}
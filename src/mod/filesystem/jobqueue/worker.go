@@ -0,0 +1,500 @@
+package jobqueue
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"imuslab.com/arozos/mod/filesystem"
+	"imuslab.com/arozos/mod/filesystem/arozfs"
+)
+
+/*
+	Job Worker
+
+	Executes a single job and keep its checkpoint updated, so an
+	interrupted copy / move can continue from where it stopped.
+*/
+
+// Minimum interval between two checkpoint writes to the database
+const checkpointInterval = 2 * time.Second
+
+type jobRunner struct {
+	queue    *Queue
+	job      *Job
+	lastSave time.Time
+}
+
+func (q *Queue) execute(job *Job) error {
+	if job.Targets == nil {
+		job.Targets = map[string]string{}
+	}
+	if job.SourceSizes == nil {
+		job.SourceSizes = map[string]int64{}
+	}
+
+	//Permissions might be changed since the job is created
+	if err := q.checkPermission(job); err != nil {
+		return err
+	}
+
+	runner := &jobRunner{queue: q, job: job}
+	switch job.Operation {
+	case OprCopy, OprMove:
+		return runner.transfer()
+	case OprZip:
+		return runner.zip()
+	case OprUnzip:
+		return runner.unzip()
+	}
+	return errors.New("unsupported operation")
+}
+
+// Update the job state and return errJobPaused or errJobCancelled if requested by user
+func (r *jobRunner) checkpoint(force bool) error {
+	if r.job.TotalSize > 0 {
+		r.job.Progress = float64(r.job.DoneSize) / float64(r.job.TotalSize) * 100
+		if r.job.Progress > 100 {
+			r.job.Progress = 100
+		}
+	}
+
+	persist := force || time.Since(r.lastSave) > checkpointInterval
+	if persist {
+		r.lastSave = time.Now()
+	}
+	switch r.queue.checkpoint(r.job, persist) {
+	case filesystem.FsOpr_Pause:
+		return errJobPaused
+	case filesystem.FsOpr_Cancel:
+		return errJobCancelled
+	}
+	return nil
+}
+
+// Convert the control signal into the status code used by the filesystem progress handlers
+func (r *jobRunner) progressStatus(currentFile string, progress float64) int {
+	r.job.LatestFile = currentFile
+	r.job.Progress = progress
+	switch r.checkpoint(false) {
+	case errJobPaused, errJobCancelled:
+		return filesystem.FsOpr_Cancel
+	}
+	return filesystem.FsOpr_Continue
+}
+
+// Return the pending control signal after a progress handler aborted the operation
+func (r *jobRunner) abortReason(err error) error {
+	if cerr := r.checkpoint(true); cerr != nil {
+		if cerr == errJobPaused {
+			//Zip and unzip cannot continue half way, start over when resumed
+			r.job.DoneSize = 0
+			r.job.Progress = 0
+		}
+		return cerr
+	}
+	return err
+}
+
+// Check if the job owner can still read the sources and write to the destination
+func (q *Queue) checkPermission(job *Job) error {
+	if q.options.UserHandler == nil {
+		return nil
+	}
+	userinfo, err := q.options.UserHandler.GetUserInfoFromUsername(job.Owner)
+	if err != nil {
+		return err
+	}
+	for _, vsrc := range job.Sources {
+		if !userinfo.CanRead(vsrc) || (job.Operation == OprMove && !userinfo.CanWrite(vsrc)) {
+			return errors.New("permission denied: " + vsrc)
+		}
+	}
+	if !userinfo.CanWrite(job.Dest) {
+		return errors.New("permission denied: " + job.Dest)
+	}
+	return nil
+}
+
+func (r *jobRunner) isCompleted(vsrc string) bool {
+	for _, completed := range r.job.Completed {
+		if completed == vsrc {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+	Copy and Move
+*/
+
+func (r *jobRunner) transfer() error {
+	job := r.job
+	destFsh, rdest, err := r.queue.options.Resolve(job.Owner, job.Dest)
+	if err != nil {
+		return err
+	}
+	destFshAbs := destFsh.FileSystemAbstraction
+	if !destFshAbs.IsDir(rdest) {
+		return errors.New("destination folder not exists")
+	}
+
+	//Calculate the total size on first run
+	if job.TotalSize == 0 {
+		for _, vsrc := range job.Sources {
+			srcFsh, rsrc, err := r.queue.options.Resolve(job.Owner, vsrc)
+			if err != nil {
+				return err
+			}
+			if !srcFsh.FileSystemAbstraction.FileExists(rsrc) {
+				return errors.New(arozfs.Base(vsrc) + " not exists")
+			}
+			size := sizeOf(srcFsh, rsrc)
+			job.SourceSizes[vsrc] = size
+			job.TotalSize += size
+		}
+	}
+
+	for _, vsrc := range job.Sources {
+		if r.isCompleted(vsrc) {
+			continue
+		}
+		if err := r.checkpoint(false); err != nil {
+			return err
+		}
+
+		srcFsh, rsrc, err := r.queue.options.Resolve(job.Owner, vsrc)
+		if err != nil {
+			return err
+		}
+		srcFshAbs := srcFsh.FileSystemAbstraction
+		if !srcFshAbs.FileExists(rsrc) {
+			target, decided := job.Targets[vsrc]
+			if job.Operation == OprMove && decided && target != "" && destFshAbs.FileExists(target) {
+				//Moved before interruption, but not yet marked as completed
+				job.DoneSize += job.SourceSizes[vsrc]
+				job.Completed = append(job.Completed, vsrc)
+				if err := r.checkpoint(true); err != nil {
+					return err
+				}
+				continue
+			}
+			return errors.New(arozfs.Base(vsrc) + " not exists")
+		}
+
+		//Reject operations that copy a folder into itself
+		cleanSrc := arozfs.ToSlash(filepath.Clean(rsrc))
+		cleanDest := arozfs.ToSlash(filepath.Clean(rdest))
+		if srcFsh.UUID == destFsh.UUID && srcFshAbs.IsDir(rsrc) && (cleanDest == cleanSrc || strings.HasPrefix(cleanDest, cleanSrc+"/")) {
+			return errors.New("recursive " + job.Operation + " operation")
+		}
+
+		//Decide the target path once, so a resumed job writes to the same place
+		target, decided := job.Targets[vsrc]
+		resuming := decided
+		if !decided {
+			target, err = resolveConflict(destFshAbs, rsrc, rdest, job.Conflict)
+			if err != nil {
+				return err
+			}
+			if srcFsh.UUID == destFsh.UUID && target != "" && arozfs.ToSlash(filepath.Clean(target)) == cleanSrc {
+				return errors.New("source and destination paths are identical")
+			}
+			job.Targets[vsrc] = target
+			if err := r.checkpoint(true); err != nil {
+				return err
+			}
+		}
+
+		job.LatestFile = arozfs.Base(rsrc)
+		if target == "" {
+			//Skipped by conflict policy
+			job.DoneSize += job.SourceSizes[vsrc]
+		} else {
+			startSize := job.DoneSize
+			moved := false
+			if job.Operation == OprMove && srcFsh.UUID == destFsh.UUID && !destFshAbs.FileExists(target) {
+				//Same storage, try renaming first
+				if srcFshAbs.Rename(rsrc, target) == nil {
+					moved = true
+					job.DoneSize += job.SourceSizes[vsrc]
+				}
+			}
+
+			if !moved {
+				if job.Conflict == ConflictOverwrite && !resuming && !srcFshAbs.IsDir(rsrc) && destFshAbs.FileExists(target) {
+					destFshAbs.Remove(target)
+				}
+				err = r.copyTree(srcFsh, rsrc, destFsh, target, resuming || job.Attempts > 1)
+				if err != nil {
+					//Count the finished part of this source again when resumed
+					job.DoneSize = startSize
+					if err == errJobPaused || err == errJobCancelled {
+						r.checkpoint(true)
+					}
+					return err
+				}
+				if job.Operation == OprMove {
+					if err := srcFshAbs.RemoveAll(rsrc); err != nil {
+						return err
+					}
+				}
+			}
+		}
+
+		job.Completed = append(job.Completed, vsrc)
+		if err := r.checkpoint(true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Copy a file or folder to the target path. When resuming, files that already exist with the same size
+// are skipped, unless the conflict policy is overwrite where the existing file might not be written by this job
+func (r *jobRunner) copyTree(srcFsh *filesystem.FileSystemHandler, rsrc string, destFsh *filesystem.FileSystemHandler, target string, resuming bool) error {
+	srcFshAbs := srcFsh.FileSystemAbstraction
+	destFshAbs := destFsh.FileSystemAbstraction
+	if !srcFshAbs.IsDir(rsrc) {
+		return r.copyFile(srcFshAbs, rsrc, destFshAbs, target, resuming)
+	}
+
+	baseDir := arozfs.ToSlash(filepath.Clean(rsrc))
+	return srcFshAbs.Walk(rsrc, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relPath := strings.TrimPrefix(strings.TrimPrefix(arozfs.ToSlash(filepath.Clean(path)), baseDir), "/")
+		destPath := filepath.Join(target, relPath)
+		if info.IsDir() {
+			return destFshAbs.MkdirAll(destPath, 0775)
+		}
+		return r.copyFile(srcFshAbs, path, destFshAbs, destPath, resuming)
+	})
+}
+
+func (r *jobRunner) copyFile(srcFshAbs filesystem.FileSystemAbstraction, src string, destFshAbs filesystem.FileSystemAbstraction, dest string, resuming bool) error {
+	if err := r.checkpoint(false); err != nil {
+		return err
+	}
+
+	size := srcFshAbs.GetFileSize(src)
+	r.job.LatestFile = arozfs.Base(src)
+	if resuming && r.job.Conflict != ConflictOverwrite && destFshAbs.FileExists(dest) && destFshAbs.GetFileSize(dest) == size {
+		//Copied before interruption
+		r.job.DoneSize += size
+		return nil
+	}
+
+	f, err := srcFshAbs.ReadStream(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	err = destFshAbs.WriteStream(dest, f, 0775)
+	if err != nil {
+		return err
+	}
+	r.job.DoneSize += size
+	return nil
+}
+
+/*
+	Zip and Unzip
+*/
+
+func (r *jobRunner) zip() error {
+	job := r.job
+	destFsh, rdest, err := r.queue.options.Resolve(job.Owner, job.Dest)
+	if err != nil {
+		return err
+	}
+	if destFsh.RequireBuffer {
+		return errors.New("background zipping is not supported on " + destFsh.Filesystem + " storage")
+	}
+
+	srcFshs := []*filesystem.FileSystemHandler{}
+	rsrcs := []string{}
+	for _, vsrc := range job.Sources {
+		srcFsh, rsrc, err := r.queue.options.Resolve(job.Owner, vsrc)
+		if err != nil {
+			return err
+		}
+		if !srcFsh.FileSystemAbstraction.FileExists(rsrc) {
+			return errors.New(arozfs.Base(vsrc) + " not exists")
+		}
+		srcFshs = append(srcFshs, srcFsh)
+		rsrcs = append(rsrcs, rsrc)
+	}
+
+	//Use the same naming as the interactive zip operation
+	target, decided := job.Targets[job.Dest]
+	if !decided {
+		zipFilename := strings.ReplaceAll(arozfs.Base(filepath.Dir(rsrcs[0])), ":", "") + ".zip"
+		if len(rsrcs) == 1 {
+			zipFilename = arozfs.Base(rsrcs[0]) + ".zip"
+		}
+		target, err = resolveConflict(destFsh.FileSystemAbstraction, filepath.Join(rdest, zipFilename), rdest, job.Conflict)
+		if err != nil {
+			return err
+		}
+		job.Targets[job.Dest] = target
+		if err := r.checkpoint(true); err != nil {
+			return err
+		}
+	}
+	if target == "" {
+		return nil
+	}
+
+	err = filesystem.ArozZipFileWithProgress(srcFshs, rsrcs, destFsh, target, false, func(currentFile string, _ int, _ int, progress float64) int {
+		return r.progressStatus(currentFile, progress)
+	})
+	if err != nil {
+		//Remove the incomplete zip file
+		destFsh.FileSystemAbstraction.Remove(target)
+		return r.abortReason(err)
+	}
+	return nil
+}
+
+func (r *jobRunner) unzip() error {
+	job := r.job
+	destFsh, rdest, err := r.queue.options.Resolve(job.Owner, job.Dest)
+	if err != nil {
+		return err
+	}
+	if destFsh.RequireBuffer || !destFsh.IsLocalDrive() {
+		return errors.New("background unzipping is only supported on local storage")
+	}
+
+	rsrcs := []string{}
+	for _, vsrc := range job.Sources {
+		srcFsh, rsrc, err := r.queue.options.Resolve(job.Owner, vsrc)
+		if err != nil {
+			return err
+		}
+		if srcFsh.RequireBuffer || !srcFsh.IsLocalDrive() {
+			return errors.New("background unzipping is only supported on local storage")
+		}
+		if !srcFsh.FileSystemAbstraction.FileExists(rsrc) {
+			return errors.New(arozfs.Base(vsrc) + " not exists")
+		}
+		rsrcs = append(rsrcs, rsrc)
+	}
+
+	//Extract into a staging folder, then move the items into the destination following the conflict policy
+	destFshAbs := destFsh.FileSystemAbstraction
+	staging := filepath.Join(rdest, ".unzip_"+job.ID)
+	destFshAbs.RemoveAll(staging)
+	err = destFshAbs.MkdirAll(staging, 0775)
+	if err != nil {
+		return err
+	}
+	defer destFshAbs.RemoveAll(staging)
+
+	err = filesystem.ArozUnzipFileWithProgress(rsrcs, staging, func(currentFile string, _ int, _ int, progress float64) int {
+		return r.progressStatus(arozfs.Base(currentFile), progress)
+	})
+	if err != nil {
+		return r.abortReason(err)
+	}
+
+	entries, err := destFshAbs.ReadDir(staging)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		extracted := filepath.Join(staging, entry.Name())
+		target, err := resolveConflict(destFshAbs, extracted, rdest, job.Conflict)
+		if err != nil {
+			return err
+		}
+		if target == "" {
+			//Skipped by conflict policy
+			continue
+		}
+		err = mergeExtracted(destFshAbs, extracted, target)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Move an extracted file or folder to the target path. Existing folders are merged and existing files replaced
+func mergeExtracted(fshAbs filesystem.FileSystemAbstraction, extracted string, target string) error {
+	if fshAbs.FileExists(target) {
+		if fshAbs.IsDir(extracted) && fshAbs.IsDir(target) {
+			entries, err := fshAbs.ReadDir(extracted)
+			if err != nil {
+				return err
+			}
+			for _, entry := range entries {
+				err = mergeExtracted(fshAbs, filepath.Join(extracted, entry.Name()), filepath.Join(target, entry.Name()))
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+		if err := fshAbs.RemoveAll(target); err != nil {
+			return err
+		}
+	}
+	return fshAbs.Rename(extracted, target)
+}
+
+/*
+	Utilities
+*/
+
+// Get the target path of src inside destFolder following the conflict policy. Return empty string if it should be skipped
+func resolveConflict(destFshAbs filesystem.FileSystemAbstraction, src string, destFolder string, policy string) (string, error) {
+	filename := arozfs.Base(src)
+	target := filepath.Join(destFolder, filename)
+	if !destFshAbs.FileExists(target) {
+		return target, nil
+	}
+
+	switch policy {
+	case ConflictSkip:
+		return "", nil
+	case ConflictOverwrite:
+		return target, nil
+	case ConflictKeep:
+		ext := filepath.Ext(filename)
+		basename := strings.TrimSuffix(filename, ext)
+		target = filepath.Join(destFolder, basename+" - Copy"+ext)
+		duplicateCounter := 0
+		for destFshAbs.FileExists(target) {
+			duplicateCounter++
+			if duplicateCounter > 1024 {
+				return "", errors.New("too many copies of identical files")
+			}
+			target = filepath.Join(destFolder, basename+" - Copy("+strconv.Itoa(duplicateCounter)+")"+ext)
+		}
+		return target, nil
+	}
+	return "", errors.New("unsupported conflict policy")
+}
+
+// Get the total size of a file or folder
+func sizeOf(fsh *filesystem.FileSystemHandler, rpath string) int64 {
+	fshAbs := fsh.FileSystemAbstraction
+	if !fshAbs.IsDir(rpath) {
+		return fshAbs.GetFileSize(rpath)
+	}
+	var totalSize int64
+	fshAbs.Walk(rpath, func(_ string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			totalSize += info.Size()
+		}
+		return nil
+	})
+	return totalSize
+}
@@ -0,0 +1,1072 @@
+package filesystem
+
+/*
+	7z Archive Reader
+
+	A minimal read-only parser for the 7z archive format. Only the parts
+	required for browsing and extracting are implemented, which include
+	plain and encoded headers, solid blocks and the Copy, LZMA, LZMA2,
+	Deflate and BZip2 coders. Encrypted archives and branch converter
+	filters (e.g. BCJ) are not supported.
+*/
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"io"
+	"time"
+	"unicode/utf16"
+
+	"github.com/ulikunitz/xz/lzma"
+)
+
+var sevenZipSignature = []byte{'7', 'z', 0xBC, 0xAF, 0x27, 0x1C}
+
+// Property IDs used in the 7z header
+const (
+	szIDEnd                   = 0x00
+	szIDHeader                = 0x01
+	szIDArchiveProperties     = 0x02
+	szIDAdditionalStreamsInfo = 0x03
+	szIDMainStreamsInfo       = 0x04
+	szIDFilesInfo             = 0x05
+	szIDPackInfo              = 0x06
+	szIDUnpackInfo            = 0x07
+	szIDSubStreamsInfo        = 0x08
+	szIDSize                  = 0x09
+	szIDCRC                   = 0x0A
+	szIDFolder                = 0x0B
+	szIDCodersUnpackSize      = 0x0C
+	szIDNumUnpackStream       = 0x0D
+	szIDEmptyStream           = 0x0E
+	szIDEmptyFile             = 0x0F
+	szIDAnti                  = 0x10
+	szIDName                  = 0x11
+	szIDMTime                 = 0x14
+	szIDWinAttributes         = 0x15
+	szIDEncodedHeader         = 0x17
+)
+
+// Supported coder method IDs
+const (
+	szMethodCopy    = "\x00"
+	szMethodLZMA2   = "\x21"
+	szMethodLZMA    = "\x03\x01\x01"
+	szMethodDeflate = "\x04\x01\x08"
+	szMethodBZip2   = "\x04\x02\x02"
+	szMethodAES     = "\x06\xF1\x07\x01"
+)
+
+var errSevenZipFormat = errors.New("invalid or corrupted 7z archive")
+
+// Maximum number of nested encoded headers. Real encoders only encode the header once
+const sevenZipMaxEncodedHeaders = 4
+
+type sevenZipCoder struct {
+	method     string
+	numIn      int
+	numOut     int
+	properties []byte
+}
+
+type sevenZipBindPair struct {
+	inIndex  int
+	outIndex int
+}
+
+type sevenZipFolder struct {
+	coders        []*sevenZipCoder
+	bindPairs     []sevenZipBindPair
+	packedStreams []int
+	unpackSizes   []uint64
+	packOffset    int64 //Offset of the first packed stream of this folder in the archive
+	packSizes     []uint64
+	numSubstreams int
+	hasCRC        bool
+}
+
+type sevenZipStreamsInfo struct {
+	packPos        uint64
+	packSizes      []uint64
+	folders        []*sevenZipFolder
+	substreamSizes []uint64
+}
+
+type sevenZipFile struct {
+	name    string
+	size    uint64
+	isDir   bool
+	modTime time.Time
+	folder  int //Index of the folder holding the file content, -1 for empty files and dirs
+	index   int //Index of the file inside its folder
+}
+
+type sevenZipReader struct {
+	r       io.ReaderAt
+	size    int64
+	folders []*sevenZipFolder
+	files   []*sevenZipFile
+}
+
+/*
+	Header byte reader
+*/
+
+type sevenZipHeaderReader struct {
+	buf []byte
+	pos int
+}
+
+func (h *sevenZipHeaderReader) readByte() (byte, error) {
+	if h.pos >= len(h.buf) {
+		return 0, errSevenZipFormat
+	}
+	b := h.buf[h.pos]
+	h.pos++
+	return b, nil
+}
+
+func (h *sevenZipHeaderReader) readBytes(n uint64) ([]byte, error) {
+	if n > uint64(len(h.buf)-h.pos) {
+		return nil, errSevenZipFormat
+	}
+	b := h.buf[h.pos : h.pos+int(n)]
+	h.pos += int(n)
+	return b, nil
+}
+
+// Read a variable length number as defined in the 7z specification
+func (h *sevenZipHeaderReader) readNumber() (uint64, error) {
+	first, err := h.readByte()
+	if err != nil {
+		return 0, err
+	}
+	mask := byte(0x80)
+	var value uint64
+	for i := 0; i < 8; i++ {
+		if first&mask == 0 {
+			high := uint64(first & (mask - 1))
+			value += high << (8 * i)
+			return value, nil
+		}
+		b, err := h.readByte()
+		if err != nil {
+			return 0, err
+		}
+		value |= uint64(b) << (8 * i)
+		mask >>= 1
+	}
+	return value, nil
+}
+
+// Read a number and make sure it is small enough to be used as a count
+func (h *sevenZipHeaderReader) readCount() (int, error) {
+	n, err := h.readNumber()
+	if err != nil {
+		return 0, err
+	}
+	if n > uint64(len(h.buf)) && n > 1<<16 {
+		return 0, errSevenZipFormat
+	}
+	return int(n), nil
+}
+
+func (h *sevenZipHeaderReader) readUint32() (uint32, error) {
+	b, err := h.readBytes(4)
+	if err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint32(b), nil
+}
+
+func (h *sevenZipHeaderReader) readUint64() (uint64, error) {
+	b, err := h.readBytes(8)
+	if err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint64(b), nil
+}
+
+func (h *sevenZipHeaderReader) readBitField(n int) ([]bool, error) {
+	bits := make([]bool, n)
+	var b, mask byte
+	for i := 0; i < n; i++ {
+		if mask == 0 {
+			var err error
+			b, err = h.readByte()
+			if err != nil {
+				return nil, err
+			}
+			mask = 0x80
+		}
+		bits[i] = b&mask != 0
+		mask >>= 1
+	}
+	return bits, nil
+}
+
+// Read the "all defined" flag followed by an optional bit field
+func (h *sevenZipHeaderReader) readOptionalBitField(n int) ([]bool, error) {
+	allDefined, err := h.readByte()
+	if err != nil {
+		return nil, err
+	}
+	if allDefined == 0 {
+		return h.readBitField(n)
+	}
+	bits := make([]bool, n)
+	for i := range bits {
+		bits[i] = true
+	}
+	return bits, nil
+}
+
+// Skip CRC digests and return which of them are defined. The checksums
+// are not verified by this reader
+func (h *sevenZipHeaderReader) skipDigests(n int) ([]bool, error) {
+	defined, err := h.readOptionalBitField(n)
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range defined {
+		if d {
+			if _, err := h.readUint32(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return defined, nil
+}
+
+// Skip a property with a size prefix
+func (h *sevenZipHeaderReader) skipProperty() error {
+	size, err := h.readNumber()
+	if err != nil {
+		return err
+	}
+	_, err = h.readBytes(size)
+	return err
+}
+
+/*
+	Archive opening and header parsing
+*/
+
+func openSevenZip(r io.ReaderAt, size int64) (*sevenZipReader, error) {
+	startHeader := make([]byte, 32)
+	if _, err := r.ReadAt(startHeader, 0); err != nil {
+		return nil, errSevenZipFormat
+	}
+	if !bytes.Equal(startHeader[:6], sevenZipSignature) {
+		return nil, errors.New("not a 7z archive")
+	}
+
+	nextHeaderOffset := binary.LittleEndian.Uint64(startHeader[12:20])
+	nextHeaderSize := binary.LittleEndian.Uint64(startHeader[20:28])
+	if nextHeaderOffset > uint64(size) || nextHeaderSize > uint64(size)-nextHeaderOffset || 32+nextHeaderOffset+nextHeaderSize > uint64(size) {
+		return nil, errSevenZipFormat
+	}
+
+	z := &sevenZipReader{
+		r:    r,
+		size: size,
+	}
+	if nextHeaderSize == 0 {
+		//Empty archive
+		return z, nil
+	}
+
+	header := make([]byte, nextHeaderSize)
+	if _, err := r.ReadAt(header, 32+int64(nextHeaderOffset)); err != nil {
+		return nil, err
+	}
+
+	for depth := 0; ; depth++ {
+		h := &sevenZipHeaderReader{buf: header}
+		id, err := h.readByte()
+		if err != nil {
+			return nil, err
+		}
+		if id == szIDHeader {
+			err = z.readHeader(h)
+			if err != nil {
+				return nil, err
+			}
+			return z, nil
+		}
+		if id != szIDEncodedHeader || depth >= sevenZipMaxEncodedHeaders {
+			return nil, errSevenZipFormat
+		}
+
+		//The header is compressed and stored as a packed stream
+		streamsInfo, err := z.readStreamsInfo(h)
+		if err != nil {
+			return nil, err
+		}
+		if len(streamsInfo.folders) == 0 {
+			return nil, errSevenZipFormat
+		}
+		folder := streamsInfo.folders[0]
+		if folder.unpackSize() > 1<<28 {
+			return nil, errSevenZipFormat
+		}
+		decoder, err := z.folderReader(folder)
+		if err != nil {
+			return nil, err
+		}
+		header = make([]byte, folder.unpackSize())
+		if _, err := io.ReadFull(decoder, header); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (z *sevenZipReader) readHeader(h *sevenZipHeaderReader) error {
+	id, err := h.readByte()
+	if err != nil {
+		return err
+	}
+
+	if id == szIDArchiveProperties {
+		for {
+			propType, err := h.readByte()
+			if err != nil {
+				return err
+			}
+			if propType == szIDEnd {
+				break
+			}
+			if err := h.skipProperty(); err != nil {
+				return err
+			}
+		}
+		if id, err = h.readByte(); err != nil {
+			return err
+		}
+	}
+
+	if id == szIDAdditionalStreamsInfo {
+		if _, err := z.readStreamsInfo(h); err != nil {
+			return err
+		}
+		if id, err = h.readByte(); err != nil {
+			return err
+		}
+	}
+
+	streamsInfo := &sevenZipStreamsInfo{}
+	if id == szIDMainStreamsInfo {
+		streamsInfo, err = z.readStreamsInfo(h)
+		if err != nil {
+			return err
+		}
+		if id, err = h.readByte(); err != nil {
+			return err
+		}
+	}
+	z.folders = streamsInfo.folders
+
+	if id == szIDFilesInfo {
+		err = z.readFilesInfo(h, streamsInfo)
+		if err != nil {
+			return err
+		}
+		if id, err = h.readByte(); err != nil {
+			return err
+		}
+	}
+
+	if id != szIDEnd {
+		return errSevenZipFormat
+	}
+	return nil
+}
+
+func (z *sevenZipReader) readStreamsInfo(h *sevenZipHeaderReader) (*sevenZipStreamsInfo, error) {
+	info := &sevenZipStreamsInfo{}
+	id, err := h.readByte()
+	if err != nil {
+		return nil, err
+	}
+
+	if id == szIDPackInfo {
+		if err := readSevenZipPackInfo(h, info); err != nil {
+			return nil, err
+		}
+		if id, err = h.readByte(); err != nil {
+			return nil, err
+		}
+	}
+
+	if id == szIDUnpackInfo {
+		if err := readSevenZipUnpackInfo(h, info); err != nil {
+			return nil, err
+		}
+		if id, err = h.readByte(); err != nil {
+			return nil, err
+		}
+	}
+
+	//Assign the packed streams to each folder
+	packIndex := 0
+	packOffset := int64(32 + info.packPos)
+	for _, folder := range info.folders {
+		folder.packOffset = packOffset
+		for range folder.packedStreams {
+			if packIndex >= len(info.packSizes) {
+				return nil, errSevenZipFormat
+			}
+			folder.packSizes = append(folder.packSizes, info.packSizes[packIndex])
+			packOffset += int64(info.packSizes[packIndex])
+			packIndex++
+		}
+		if packOffset > z.size {
+			return nil, errSevenZipFormat
+		}
+		folder.numSubstreams = 1
+	}
+
+	if id == szIDSubStreamsInfo {
+		if err := readSevenZipSubStreamsInfo(h, info); err != nil {
+			return nil, err
+		}
+		if id, err = h.readByte(); err != nil {
+			return nil, err
+		}
+	} else {
+		for _, folder := range info.folders {
+			info.substreamSizes = append(info.substreamSizes, folder.unpackSize())
+		}
+	}
+
+	if id != szIDEnd {
+		return nil, errSevenZipFormat
+	}
+	return info, nil
+}
+
+func readSevenZipPackInfo(h *sevenZipHeaderReader, info *sevenZipStreamsInfo) error {
+	var err error
+	info.packPos, err = h.readNumber()
+	if err != nil {
+		return err
+	}
+	numPackStreams, err := h.readCount()
+	if err != nil {
+		return err
+	}
+
+	for {
+		id, err := h.readByte()
+		if err != nil {
+			return err
+		}
+		switch id {
+		case szIDEnd:
+			return nil
+		case szIDSize:
+			info.packSizes = make([]uint64, numPackStreams)
+			for i := range info.packSizes {
+				if info.packSizes[i], err = h.readNumber(); err != nil {
+					return err
+				}
+			}
+		case szIDCRC:
+			if _, err := h.skipDigests(numPackStreams); err != nil {
+				return err
+			}
+		default:
+			if err := h.skipProperty(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func readSevenZipUnpackInfo(h *sevenZipHeaderReader, info *sevenZipStreamsInfo) error {
+	id, err := h.readByte()
+	if err != nil {
+		return err
+	}
+	if id != szIDFolder {
+		return errSevenZipFormat
+	}
+	numFolders, err := h.readCount()
+	if err != nil {
+		return err
+	}
+	external, err := h.readByte()
+	if err != nil {
+		return err
+	}
+	if external != 0 {
+		return errors.New("external 7z folder definitions are not supported")
+	}
+
+	info.folders = make([]*sevenZipFolder, numFolders)
+	for i := range info.folders {
+		info.folders[i], err = readSevenZipFolder(h)
+		if err != nil {
+			return err
+		}
+	}
+
+	id, err = h.readByte()
+	if err != nil {
+		return err
+	}
+	if id != szIDCodersUnpackSize {
+		return errSevenZipFormat
+	}
+	for _, folder := range info.folders {
+		numOut := 0
+		for _, coder := range folder.coders {
+			numOut += coder.numOut
+		}
+		folder.unpackSizes = make([]uint64, numOut)
+		for i := range folder.unpackSizes {
+			if folder.unpackSizes[i], err = h.readNumber(); err != nil {
+				return err
+			}
+		}
+	}
+
+	for {
+		id, err := h.readByte()
+		if err != nil {
+			return err
+		}
+		switch id {
+		case szIDEnd:
+			return nil
+		case szIDCRC:
+			defined, err := h.skipDigests(numFolders)
+			if err != nil {
+				return err
+			}
+			for i, d := range defined {
+				info.folders[i].hasCRC = d
+			}
+		default:
+			if err := h.skipProperty(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func readSevenZipFolder(h *sevenZipHeaderReader) (*sevenZipFolder, error) {
+	numCoders, err := h.readCount()
+	if err != nil {
+		return nil, err
+	}
+	if numCoders == 0 || numCoders > 64 {
+		return nil, errSevenZipFormat
+	}
+
+	folder := &sevenZipFolder{}
+	numInTotal := 0
+	numOutTotal := 0
+	for i := 0; i < numCoders; i++ {
+		flag, err := h.readByte()
+		if err != nil {
+			return nil, err
+		}
+		if flag&0x80 != 0 {
+			return nil, errors.New("alternative 7z coder methods are not supported")
+		}
+		method, err := h.readBytes(uint64(flag & 0x0F))
+		if err != nil {
+			return nil, err
+		}
+		coder := &sevenZipCoder{
+			method: string(method),
+			numIn:  1,
+			numOut: 1,
+		}
+		if flag&0x10 != 0 {
+			if coder.numIn, err = h.readCount(); err != nil {
+				return nil, err
+			}
+			if coder.numOut, err = h.readCount(); err != nil {
+				return nil, err
+			}
+		}
+		if flag&0x20 != 0 {
+			propSize, err := h.readNumber()
+			if err != nil {
+				return nil, err
+			}
+			if coder.properties, err = h.readBytes(propSize); err != nil {
+				return nil, err
+			}
+		}
+		numInTotal += coder.numIn
+		numOutTotal += coder.numOut
+		folder.coders = append(folder.coders, coder)
+	}
+
+	if numOutTotal == 0 || numInTotal < numOutTotal-1 {
+		return nil, errSevenZipFormat
+	}
+	for i := 0; i < numOutTotal-1; i++ {
+		inIndex, err := h.readCount()
+		if err != nil {
+			return nil, err
+		}
+		outIndex, err := h.readCount()
+		if err != nil {
+			return nil, err
+		}
+		folder.bindPairs = append(folder.bindPairs, sevenZipBindPair{inIndex, outIndex})
+	}
+
+	numPacked := numInTotal - (numOutTotal - 1)
+	if numPacked == 1 {
+		for i := 0; i < numInTotal; i++ {
+			if folder.findBindPairForIn(i) < 0 {
+				folder.packedStreams = append(folder.packedStreams, i)
+				break
+			}
+		}
+		if len(folder.packedStreams) == 0 {
+			return nil, errSevenZipFormat
+		}
+	} else {
+		for i := 0; i < numPacked; i++ {
+			index, err := h.readCount()
+			if err != nil {
+				return nil, err
+			}
+			folder.packedStreams = append(folder.packedStreams, index)
+		}
+	}
+	return folder, nil
+}
+
+func readSevenZipSubStreamsInfo(h *sevenZipHeaderReader, info *sevenZipStreamsInfo) error {
+	id, err := h.readByte()
+	if err != nil {
+		return err
+	}
+
+	if id == szIDNumUnpackStream {
+		for _, folder := range info.folders {
+			if folder.numSubstreams, err = h.readCount(); err != nil {
+				return err
+			}
+		}
+		if id, err = h.readByte(); err != nil {
+			return err
+		}
+	}
+
+	for _, folder := range info.folders {
+		if folder.numSubstreams == 0 {
+			continue
+		}
+		var sum uint64
+		for i := 1; i < folder.numSubstreams; i++ {
+			if id != szIDSize {
+				return errSevenZipFormat
+			}
+			size, err := h.readNumber()
+			if err != nil {
+				return err
+			}
+			info.substreamSizes = append(info.substreamSizes, size)
+			sum += size
+		}
+		if sum > folder.unpackSize() {
+			return errSevenZipFormat
+		}
+		info.substreamSizes = append(info.substreamSizes, folder.unpackSize()-sum)
+	}
+	if id == szIDSize {
+		if id, err = h.readByte(); err != nil {
+			return err
+		}
+	}
+
+	for id != szIDEnd {
+		if id == szIDCRC {
+			//Digests are given for each substream without a known folder CRC
+			numDigests := 0
+			for _, folder := range info.folders {
+				if folder.numSubstreams != 1 || !folder.hasCRC {
+					numDigests += folder.numSubstreams
+				}
+			}
+			if _, err := h.skipDigests(numDigests); err != nil {
+				return err
+			}
+		} else if err := h.skipProperty(); err != nil {
+			return err
+		}
+		if id, err = h.readByte(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (z *sevenZipReader) readFilesInfo(h *sevenZipHeaderReader, streamsInfo *sevenZipStreamsInfo) error {
+	numFiles, err := h.readCount()
+	if err != nil {
+		return err
+	}
+
+	files := make([]*sevenZipFile, numFiles)
+	for i := range files {
+		files[i] = &sevenZipFile{}
+	}
+	emptyStream := make([]bool, numFiles)
+	emptyFile := []bool{}
+	anti := []bool{}
+	attributes := make([]uint32, numFiles)
+	hasAttributes := make([]bool, numFiles)
+
+	for {
+		propType, err := h.readNumber()
+		if err != nil {
+			return err
+		}
+		if propType == szIDEnd {
+			break
+		}
+		size, err := h.readNumber()
+		if err != nil {
+			return err
+		}
+		data, err := h.readBytes(size)
+		if err != nil {
+			return err
+		}
+		prop := &sevenZipHeaderReader{buf: data}
+
+		switch propType {
+		case szIDEmptyStream:
+			if emptyStream, err = prop.readBitField(numFiles); err != nil {
+				return err
+			}
+		case szIDEmptyFile, szIDAnti:
+			numEmpty := 0
+			for _, e := range emptyStream {
+				if e {
+					numEmpty++
+				}
+			}
+			bits, err := prop.readBitField(numEmpty)
+			if err != nil {
+				return err
+			}
+			if propType == szIDEmptyFile {
+				emptyFile = bits
+			} else {
+				anti = bits
+			}
+		case szIDName:
+			if external, err := prop.readByte(); err != nil || external != 0 {
+				return errSevenZipFormat
+			}
+			names := prop.buf[prop.pos:]
+			for _, file := range files {
+				end := -1
+				for j := 0; j+1 < len(names); j += 2 {
+					if names[j] == 0 && names[j+1] == 0 {
+						end = j
+						break
+					}
+				}
+				if end < 0 {
+					return errSevenZipFormat
+				}
+				u16 := make([]uint16, end/2)
+				for j := range u16 {
+					u16[j] = binary.LittleEndian.Uint16(names[j*2:])
+				}
+				file.name = string(utf16.Decode(u16))
+				names = names[end+2:]
+			}
+		case szIDMTime:
+			defined, err := prop.readOptionalBitField(numFiles)
+			if err != nil {
+				return err
+			}
+			if external, err := prop.readByte(); err != nil || external != 0 {
+				return errSevenZipFormat
+			}
+			for i, d := range defined {
+				if !d {
+					continue
+				}
+				filetime, err := prop.readUint64()
+				if err != nil {
+					return err
+				}
+				files[i].modTime = sevenZipFiletimeToTime(filetime)
+			}
+		case szIDWinAttributes:
+			defined, err := prop.readOptionalBitField(numFiles)
+			if err != nil {
+				return err
+			}
+			if external, err := prop.readByte(); err != nil || external != 0 {
+				return errSevenZipFormat
+			}
+			for i, d := range defined {
+				if !d {
+					continue
+				}
+				if attributes[i], err = prop.readUint32(); err != nil {
+					return err
+				}
+				hasAttributes[i] = true
+			}
+		}
+	}
+
+	//Map each file with content into the substreams of the folders
+	folderIndex := 0
+	indexInFolder := 0
+	substreamIndex := 0
+	emptyIndex := 0
+	for i, file := range files {
+		file.folder = -1
+		if emptyStream[i] {
+			isEmptyFile := emptyIndex < len(emptyFile) && emptyFile[emptyIndex]
+			isAnti := emptyIndex < len(anti) && anti[emptyIndex]
+			emptyIndex++
+			if isAnti {
+				continue
+			}
+			file.isDir = !isEmptyFile
+			if hasAttributes[i] {
+				file.isDir = attributes[i]&0x10 != 0
+			}
+			z.files = append(z.files, file)
+			continue
+		}
+
+		for folderIndex < len(streamsInfo.folders) && indexInFolder >= streamsInfo.folders[folderIndex].numSubstreams {
+			folderIndex++
+			indexInFolder = 0
+		}
+		if folderIndex >= len(streamsInfo.folders) || substreamIndex >= len(streamsInfo.substreamSizes) {
+			return errSevenZipFormat
+		}
+		file.folder = folderIndex
+		file.index = indexInFolder
+		file.size = streamsInfo.substreamSizes[substreamIndex]
+		indexInFolder++
+		substreamIndex++
+		z.files = append(z.files, file)
+	}
+	return nil
+}
+
+// Convert Windows FILETIME (100ns intervals since 1601) into time
+func sevenZipFiletimeToTime(filetime uint64) time.Time {
+	const epochDiff = 116444736000000000
+	if filetime < epochDiff {
+		return time.Unix(0, 0)
+	}
+	return time.Unix(0, int64(filetime-epochDiff)*100)
+}
+
+/*
+	Folder decoding
+*/
+
+func (f *sevenZipFolder) findBindPairForIn(inIndex int) int {
+	for i, bp := range f.bindPairs {
+		if bp.inIndex == inIndex {
+			return i
+		}
+	}
+	return -1
+}
+
+func (f *sevenZipFolder) findBindPairForOut(outIndex int) int {
+	for i, bp := range f.bindPairs {
+		if bp.outIndex == outIndex {
+			return i
+		}
+	}
+	return -1
+}
+
+// The size of the final output stream of the folder
+func (f *sevenZipFolder) unpackSize() uint64 {
+	for i := len(f.unpackSizes) - 1; i >= 0; i-- {
+		if f.findBindPairForOut(i) < 0 {
+			return f.unpackSizes[i]
+		}
+	}
+	return 0
+}
+
+// Create a reader that outputs the uncompressed content of the given folder
+func (z *sevenZipReader) folderReader(folder *sevenZipFolder) (io.Reader, error) {
+	//Only chains of coders with single input and output are supported,
+	//in which case the in and out stream index equal to the coder index
+	for _, coder := range folder.coders {
+		if coder.numIn != 1 || coder.numOut != 1 {
+			return nil, errors.New("unsupported 7z coder configuration")
+		}
+	}
+
+	mainOut := -1
+	for i := range folder.coders {
+		if folder.findBindPairForOut(i) < 0 {
+			mainOut = i
+			break
+		}
+	}
+	if mainOut < 0 {
+		return nil, errSevenZipFormat
+	}
+	return z.coderReader(folder, mainOut, 0)
+}
+
+func (z *sevenZipReader) coderReader(folder *sevenZipFolder, coderIndex int, depth int) (io.Reader, error) {
+	if depth > len(folder.coders) {
+		return nil, errSevenZipFormat
+	}
+
+	var input io.Reader
+	if bp := folder.findBindPairForIn(coderIndex); bp >= 0 {
+		source := folder.bindPairs[bp].outIndex
+		if source >= len(folder.coders) {
+			return nil, errSevenZipFormat
+		}
+		r, err := z.coderReader(folder, source, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		input = r
+	} else {
+		offset := folder.packOffset
+		found := false
+		for i, streamIndex := range folder.packedStreams {
+			if streamIndex == coderIndex {
+				input = bufio.NewReader(io.NewSectionReader(z.r, offset, int64(folder.packSizes[i])))
+				found = true
+				break
+			}
+			offset += int64(folder.packSizes[i])
+		}
+		if !found {
+			return nil, errSevenZipFormat
+		}
+	}
+
+	return newSevenZipDecoder(folder.coders[coderIndex], input, folder.unpackSizes[coderIndex])
+}
+
+func newSevenZipDecoder(coder *sevenZipCoder, input io.Reader, unpackSize uint64) (io.Reader, error) {
+	switch coder.method {
+	case szMethodCopy:
+		return io.LimitReader(input, int64(unpackSize)), nil
+	case szMethodLZMA:
+		if len(coder.properties) != 5 {
+			return nil, errSevenZipFormat
+		}
+		//Rebuild the classic .lzma header from the coder properties
+		header := make([]byte, lzma.HeaderLen)
+		copy(header, coder.properties)
+		binary.LittleEndian.PutUint64(header[5:], unpackSize)
+		r, err := lzma.NewReader(io.MultiReader(bytes.NewReader(header), input))
+		if err != nil {
+			return nil, err
+		}
+		return io.LimitReader(r, int64(unpackSize)), nil
+	case szMethodLZMA2:
+		if len(coder.properties) != 1 || coder.properties[0] > 40 {
+			return nil, errSevenZipFormat
+		}
+		dictSize := uint64(lzma.MaxDictCap)
+		if coder.properties[0] < 40 {
+			dictSize = uint64(2|(coder.properties[0]&1)) << (coder.properties[0]/2 + 11)
+		}
+		//The data never refers further back than its own size
+		if unpackSize < dictSize {
+			dictSize = unpackSize
+		}
+		if dictSize < lzma.MinDictCap {
+			dictSize = lzma.MinDictCap
+		}
+		r, err := lzma.Reader2Config{DictCap: int(dictSize)}.NewReader2(input)
+		if err != nil {
+			return nil, err
+		}
+		return io.LimitReader(r, int64(unpackSize)), nil
+	case szMethodDeflate:
+		return io.LimitReader(flate.NewReader(input), int64(unpackSize)), nil
+	case szMethodBZip2:
+		return io.LimitReader(bzip2.NewReader(input), int64(unpackSize)), nil
+	case szMethodAES:
+		return nil, errors.New("encrypted 7z archives are not supported")
+	}
+	return nil, errors.New("unsupported 7z compression method")
+}
+
+/*
+	File access
+*/
+
+// Walk through all files in the archive. Content of a file can be read
+// by calling open inside the callback, the content of each folder is
+// decoded at most once if the files are read in order
+func (z *sevenZipReader) walk(walkFunc func(file *sevenZipFile, open func() (io.Reader, error)) error) error {
+	var currentFolder = -1
+	var currentReader io.Reader
+	var nextIndex int
+
+	for _, file := range z.files {
+		var opened io.Reader
+		open := func() (io.Reader, error) {
+			if file.folder < 0 {
+				return bytes.NewReader(nil), nil
+			}
+			if currentFolder != file.folder || nextIndex > file.index {
+				r, err := z.folderReader(z.folders[file.folder])
+				if err != nil {
+					return nil, err
+				}
+				currentFolder = file.folder
+				currentReader = r
+				nextIndex = 0
+			}
+
+			//Skip the files that come before this one in a solid block
+			for _, skipped := range z.files {
+				if skipped.folder == file.folder && skipped.index >= nextIndex && skipped.index < file.index {
+					if _, err := io.CopyN(io.Discard, currentReader, int64(skipped.size)); err != nil {
+						return nil, err
+					}
+				}
+			}
+			nextIndex = file.index + 1
+			opened = io.LimitReader(currentReader, int64(file.size))
+			return opened, nil
+		}
+
+		err := walkFunc(file, open)
+		if err != nil {
+			return err
+		}
+
+		if opened != nil {
+			//Consume the rest of the file so the next file starts at the right position
+			if _, err := io.Copy(io.Discard, opened); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -1,11 +1,15 @@
 package logger
 
 import (
+	"encoding/json"
 	"fmt"
 	"log"
 	"os"
 	"path/filepath"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
@@ -14,39 +18,85 @@ import (
 
 	This script is designed to make a managed log for the ArozOS system
 	and replace the ton of log.Println in the system core
+
+	Each log entry is written as one JSON object per line. The current log
+	file is named {prefix}.log and get rotated into {prefix}_{datetime}.log
+	once it grows beyond the size limit. Rotated files are removed when they
+	exceed the retention age or the total size limit of the log folder.
+	Monthly logs in the legacy {prefix}_{year}-{month}.log format are never
+	removed by the retention policy.
 */
 
+// Log levels
+const (
+	LevelInfo  = "info"
+	LevelWarn  = "warn"
+	LevelError = "error"
+)
+
+type Options struct {
+	Prefix       string        //Prefix for log files
+	LogFolder    string        //Folder to store the log files
+	LogToFile    bool          //Set enable write to file
+	MaxFileSize  int64         //Rotate the log file when it grows beyond this size in bytes, 0 to disable rotation
+	MaxAge       time.Duration //Remove rotated log files older than this duration, 0 to keep forever
+	MaxTotalSize int64         //Remove the oldest rotated log files when the log folder exceeds this size in bytes, 0 for unlimited
+}
+
+// A structured log entry
+type Entry struct {
+	Time    time.Time `json:"time"`
+	Level   string    `json:"level"`
+	Module  string    `json:"module"`
+	Message string    `json:"msg"`
+	Error   string    `json:"error,omitempty"`
+}
+
 type Logger struct {
 	LogToFile      bool     //Set enable write to file
 	Prefix         string   //Prefix for log files
 	LogFolder      string   //Folder to store the log  file
 	CurrentLogFile string   //Current writing filename
 	file           *os.File //File, empty if LogToFile is false
+	fileSize       int64
+	options        Options
+	mutex          sync.Mutex
 }
 
-// Create a default logger
+// Create a default logger, rotate at 10MB and keep the rotated logs for 90 days
 func NewLogger(logFilePrefix string, logFolder string, logToFile bool) (*Logger, error) {
-	if logToFile {
-		err := os.MkdirAll(logFolder, 0775)
+	return NewLoggerWithOptions(Options{
+		Prefix:       logFilePrefix,
+		LogFolder:    logFolder,
+		LogToFile:    logToFile,
+		MaxFileSize:  10 << 20,
+		MaxAge:       90 * 24 * time.Hour,
+		MaxTotalSize: 0,
+	})
+}
+
+// Create a logger with custom rotation and retention settings
+func NewLoggerWithOptions(options Options) (*Logger, error) {
+	if options.LogToFile {
+		err := os.MkdirAll(options.LogFolder, 0775)
 		if err != nil {
 			return nil, err
 		}
 	}
 
 	thisLogger := Logger{
-		LogToFile: logToFile,
-		Prefix:    logFilePrefix,
-		LogFolder: logFolder,
+		LogToFile: options.LogToFile,
+		Prefix:    options.Prefix,
+		LogFolder: options.LogFolder,
+		options:   options,
 	}
 
-	if logToFile {
-		logFilePath := thisLogger.getLogFilepath()
-		f, err := os.OpenFile(logFilePath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0755)
+	if options.LogToFile {
+		err := thisLogger.openLogFile()
 		if err != nil {
 			return nil, err
 		}
-		thisLogger.CurrentLogFile = logFilePath
-		thisLogger.file = f
+		thisLogger.applyRetention()
 	}
 
 	return &thisLogger, nil
@@ -58,47 +108,229 @@ func NewTmpLogger() (*Logger, error) {
 }
 
 func (l *Logger) getLogFilepath() string {
-	year, month, _ := time.Now().Date()
-	return filepath.Join(l.LogFolder, l.Prefix+"_"+strconv.Itoa(year)+"-"+strconv.Itoa(int(month))+".log")
+	return filepath.Join(l.LogFolder, l.Prefix+".log")
 }
 
-// PrintAndLog will log the message to file and print the log to STDOUT
+// PrintAndLog will log the message to file and print the log to STDOUT.
+// The entry is logged as error if originalError is not nil, otherwise info
 func (l *Logger) PrintAndLog(title string, message string, originalError error) {
-	go func() {
-		l.Log(title, message, originalError)
-	}()
+	level := LevelInfo
+	if originalError != nil {
+		level = LevelError
+	}
+	l.PrintAndLogWithLevel(level, title, message, originalError)
+}
+
+// PrintAndLogWithLevel log the message with the given level to file and print it to STDOUT
+func (l *Logger) PrintAndLogWithLevel(level string, title string, message string, originalError error) {
+	l.LogWithLevel(level, title, message, originalError)
 	log.Println("[" + title + "] " + message)
 }
 
+// Log the message to file only
 func (l *Logger) Log(title string, errorMessage string, originalError error) {
-	if l.LogToFile {
-		l.ValidateAndUpdateLogFilepath()
-		if originalError == nil {
-			l.file.WriteString(time.Now().Format("2006-01-02 15:04:05.000000") + "|" + fmt.Sprintf("%-16s", title) + " [INFO]" + errorMessage + "\n")
-		} else {
-			l.file.WriteString(time.Now().Format("2006-01-02 15:04:05.000000") + "|" + fmt.Sprintf("%-16s", title) + " [ERROR]" + errorMessage + " " + originalError.Error() + "\n")
-		}
+	level := LevelInfo
+	if originalError != nil {
+		level = LevelError
 	}
+	l.LogWithLevel(level, title, errorMessage, originalError)
+}
 
+// Log the message with the given level to file only
+func (l *Logger) LogWithLevel(level string, title string, message string, originalError error) {
+	entry := Entry{
+		Time:    time.Now(),
+		Level:   level,
+		Module:  title,
+		Message: message,
+	}
+	if originalError != nil {
+		entry.Error = originalError.Error()
+	}
+	l.write(entry)
 }
 
-// Validate if the logging target is still valid (detect any months change)
-func (l *Logger) ValidateAndUpdateLogFilepath() {
-	expectedCurrentLogFilepath := l.getLogFilepath()
-	if l.CurrentLogFile != expectedCurrentLogFilepath {
-		//Change of month. Update to a new log file
-		l.file.Close()
-		f, err := os.OpenFile(expectedCurrentLogFilepath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0755)
+// Write an entry to the log file, writes are serialized so entries never interleave
+func (l *Logger) write(entry Entry) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if !l.LogToFile || l.file == nil {
+		return
+	}
+
+	js, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+	line := append(js, '\n')
+
+	if l.options.MaxFileSize > 0 && l.fileSize > 0 && l.fileSize+int64(len(line)) > l.options.MaxFileSize {
+		err := l.rotate()
 		if err != nil {
-			log.Println("[Logger] Unable to create new log. Logging to file disabled.")
+			log.Println("[Logger] Unable to rotate log. Logging to file disabled.")
 			l.LogToFile = false
 			return
 		}
-		l.CurrentLogFile = expectedCurrentLogFilepath
-		l.file = f
 	}
+
+	n, _ := l.file.Write(line)
+	l.fileSize += int64(n)
 }
 
-func (l *Logger) Close() {
+func (l *Logger) openLogFile() error {
+	logFilePath := l.getLogFilepath()
+	f, err := os.OpenFile(logFilePath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0755)
+	if err != nil {
+		return err
+	}
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	l.CurrentLogFile = logFilePath
+	l.file = f
+	l.fileSize = st.Size()
+	return nil
+}
+
+// Move the current log file aside and start a new one. Must be called with mutex locked
+func (l *Logger) rotate() error {
 	l.file.Close()
+	l.file = nil
+
+	rotatedName := l.Prefix + "_" + time.Now().Format("2006-01-02_150405")
+	rotatedPath := filepath.Join(l.LogFolder, rotatedName+".log")
+	for i := 1; fileExists(rotatedPath); i++ {
+		rotatedPath = filepath.Join(l.LogFolder, fmt.Sprintf("%s_%d.log", rotatedName, i))
+	}
+	err := os.Rename(l.CurrentLogFile, rotatedPath)
+	if err != nil {
+		return err
+	}
+
+	err = l.openLogFile()
+	if err != nil {
+		return err
+	}
+	l.applyRetention()
+	return nil
+}
+
+// Remove rotated log files that exceed the retention age or total size limit
+func (l *Logger) applyRetention() {
+	if l.options.MaxAge <= 0 && l.options.MaxTotalSize <= 0 {
+		return
+	}
+	rotatedFiles, err := filepath.Glob(filepath.Join(l.LogFolder, l.Prefix+"_*.log"))
+	if err != nil {
+		return
+	}
+
+	type logFile struct {
+		path    string
+		size    int64
+		modTime time.Time
+	}
+	files := []logFile{}
+	for _, path := range rotatedFiles {
+		if !isRotatedLogName(l.Prefix, filepath.Base(path)) {
+			//Legacy monthly logs or files from other loggers sharing the prefix
+			continue
+		}
+		st, err := os.Stat(path)
+		if err != nil || st.IsDir() {
+			continue
+		}
+		files = append(files, logFile{path, st.Size(), st.ModTime()})
+	}
+
+	//Newest first, so the oldest files are removed when the size limit is reached
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].modTime.After(files[j].modTime)
+	})
+
+	totalSize := l.fileSize
+	for _, file := range files {
+		totalSize += file.size
+		expired := l.options.MaxAge > 0 && time.Since(file.modTime) > l.options.MaxAge
+		oversized := l.options.MaxTotalSize > 0 && totalSize > l.options.MaxTotalSize
+		if expired || oversized {
+			if os.Remove(file.path) == nil {
+				totalSize -= file.size
+			}
+		}
+	}
+}
+
+// Check if the filename is a log rotated by this logger, in the format of
+// {prefix}_{2006-01-02_150405}.log or {prefix}_{2006-01-02_150405}_{n}.log
+func isRotatedLogName(prefix string, filename string) bool {
+	const rotatedTimeFormat = "2006-01-02_150405"
+	name := strings.TrimSuffix(strings.TrimPrefix(filename, prefix+"_"), ".log")
+	if len(name) < len(rotatedTimeFormat) {
+		return false
+	}
+	if _, err := time.Parse(rotatedTimeFormat, name[:len(rotatedTimeFormat)]); err != nil {
+		return false
+	}
+	suffix := name[len(rotatedTimeFormat):]
+	if suffix == "" {
+		return true
+	}
+	_, err := strconv.Atoi(strings.TrimPrefix(suffix, "_"))
+	return strings.HasPrefix(suffix, "_") && err == nil
+}
+
+func (l *Logger) Close() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.file != nil {
+		l.file.Close()
+		l.file = nil
+	}
+}
+
+// Parse a line in the log file into entry. Support both the structured
+// format and the legacy pipe-separated format
+func ParseLine(line string) (Entry, bool) {
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return Entry{}, false
+	}
+	if strings.HasPrefix(line, "{") {
+		entry := Entry{}
+		if json.Unmarshal([]byte(line), &entry) != nil {
+			return Entry{}, false
+		}
+		return entry, true
+	}
+
+	//Legacy format: 2006-01-02 15:04:05.000000|{title padded to 16} [INFO]{message}
+	chunks := strings.SplitN(line, "|", 2)
+	if len(chunks) != 2 {
+		return Entry{}, false
+	}
+	t, err := time.ParseInLocation("2006-01-02 15:04:05.000000", chunks[0], time.Local)
+	if err != nil {
+		return Entry{}, false
+	}
+	entry := Entry{Time: t}
+	if idx := strings.Index(chunks[1], " [INFO]"); idx >= 0 {
+		entry.Level = LevelInfo
+		entry.Module = strings.TrimSpace(chunks[1][:idx])
+		entry.Message = chunks[1][idx+len(" [INFO]"):]
+	} else if idx := strings.Index(chunks[1], " [ERROR]"); idx >= 0 {
+		entry.Level = LevelError
+		entry.Module = strings.TrimSpace(chunks[1][:idx])
+		entry.Message = chunks[1][idx+len(" [ERROR]"):]
+	} else {
+		return Entry{}, false
+	}
+	return entry, true
+}
+
+func fileExists(filename string) bool {
+	_, err := os.Stat(filename)
+	return err == nil
 }
@@ -0,0 +1,72 @@
+package logger
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRotationAndRetention(t *testing.T) {
+	logFolder := t.TempDir()
+
+	//An expired rotated log from previous runs
+	expired := filepath.Join(logFolder, "test_2020-01-01_000000.log")
+	os.WriteFile(expired, []byte("old\n"), 0755)
+	os.Chtimes(expired, time.Now().AddDate(0, 0, -10), time.Now().AddDate(0, 0, -10))
+
+	//Legacy monthly log should be kept
+	legacy := filepath.Join(logFolder, "test_2020-1.log")
+	os.WriteFile(legacy, []byte("old\n"), 0755)
+	os.Chtimes(legacy, time.Now().AddDate(0, 0, -10), time.Now().AddDate(0, 0, -10))
+
+	l, err := NewLoggerWithOptions(Options{
+		Prefix:      "test",
+		LogFolder:   logFolder,
+		LogToFile:   true,
+		MaxFileSize: 512,
+		MaxAge:      24 * time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	if fileExists(expired) {
+		t.Fatal("expired log not removed on startup")
+	}
+	if !fileExists(legacy) {
+		t.Fatal("legacy monthly log removed by retention")
+	}
+
+	for i := 0; i < 20; i++ {
+		l.Log("Test", "rotation message", nil)
+	}
+	l.LogWithLevel(LevelWarn, "Test", "last message", errors.New("oops"))
+
+	rotated, _ := filepath.Glob(filepath.Join(logFolder, "test_*_*.log"))
+	if len(rotated) == 0 {
+		t.Fatal("log not rotated")
+	}
+	st, _ := os.Stat(filepath.Join(logFolder, "test.log"))
+	if st.Size() > 512 {
+		t.Fatalf("current log exceeds size limit: %d", st.Size())
+	}
+}
+
+func TestParseLine(t *testing.T) {
+	entry, ok := ParseLine(`{"time":"2024-05-01T10:00:00Z","level":"warn","module":"Storage","msg":"disk slow","error":"timeout"}`)
+	if !ok || entry.Level != LevelWarn || entry.Module != "Storage" || entry.Error != "timeout" {
+		t.Fatalf("structured line parsed incorrectly: %+v", entry)
+	}
+
+	entry, ok = ParseLine("2023-04-05 06:07:08.000000|File System     [ERROR]Upload failed disk full")
+	if !ok || entry.Level != LevelError || entry.Module != "File System" || entry.Message != "Upload failed disk full" {
+		t.Fatalf("legacy line parsed incorrectly: %+v", entry)
+	}
+
+	if _, ok := ParseLine("random text"); ok {
+		t.Fatal("invalid line accepted")
+	}
+}
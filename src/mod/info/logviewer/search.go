@@ -0,0 +1,200 @@
+package logviewer
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"imuslab.com/arozos/mod/info/logger"
+	"imuslab.com/arozos/mod/utils"
+)
+
+// Filter of the log search, empty fields are not filtered
+type SearchFilter struct {
+	Keyword string //Match entries with message, error or module containing this string (case insensitive)
+	Level   string
+	Module  string
+	From    time.Time
+	To      time.Time
+	Limit   int //Maximum number of entries to return, the newest entries are kept. 0 for unlimited
+}
+
+type SearchResult struct {
+	Entries   []logger.Entry
+	Truncated bool //More entries matched than the limit
+}
+
+// Search log entries of a given catergory and filename
+// Require GET varaible: catergory. Optional: file (search all files in catergory if empty),
+// keyword, level, module, from, to (YYYY-MM-DD or YYYY-MM-DDTHH:MM) and limit
+func (v *Viewer) HandleSearchLog(w http.ResponseWriter, r *http.Request) {
+	catergory, err := utils.GetPara(r, "catergory")
+	if err != nil {
+		utils.SendErrorResponse(w, "invalid catergory given")
+		return
+	}
+	filename, _ := utils.GetPara(r, "file")
+
+	filter := SearchFilter{
+		Limit: 500,
+	}
+	filter.Keyword, _ = utils.GetPara(r, "keyword")
+	filter.Level, _ = utils.GetPara(r, "level")
+	filter.Module, _ = utils.GetPara(r, "module")
+
+	from, _ := utils.GetPara(r, "from")
+	if from != "" {
+		filter.From, err = parseSearchTime(from, false)
+		if err != nil {
+			utils.SendErrorResponse(w, "invalid from time given")
+			return
+		}
+	}
+	to, _ := utils.GetPara(r, "to")
+	if to != "" {
+		filter.To, err = parseSearchTime(to, true)
+		if err != nil {
+			utils.SendErrorResponse(w, "invalid to time given")
+			return
+		}
+	}
+	limit, _ := utils.GetPara(r, "limit")
+	if limit != "" {
+		filter.Limit, err = strconv.Atoi(limit)
+		if err != nil || filter.Limit < 0 {
+			utils.SendErrorResponse(w, "invalid limit given")
+			return
+		}
+	}
+
+	result, err := v.SearchLog(strings.TrimSpace(filepath.Base(catergory)), strings.TrimSpace(filepath.Base(filename)), filter)
+	if err != nil {
+		utils.SendErrorResponse(w, err.Error())
+		return
+	}
+
+	js, _ := json.Marshal(result)
+	utils.SendJSONResponse(w, string(js))
+}
+
+// Search the log files of a catergory line by line without loading the whole file into memory.
+// Search all log files in the catergory if filename is empty
+func (v *Viewer) SearchLog(catergory string, filename string, filter SearchFilter) (*SearchResult, error) {
+	logFiles := []string{}
+	if filename != "" && filename != "." {
+		logFilepath := filepath.Join(v.option.RootFolder, catergory, filename)
+		if !utils.FileExists(logFilepath) {
+			return nil, errors.New("log file not found")
+		}
+		logFiles = append(logFiles, logFilepath)
+	} else {
+		matches, err := filepath.Glob(filepath.Join(v.option.RootFolder, catergory, "*"+v.option.Extension))
+		if err != nil || len(matches) == 0 {
+			return nil, errors.New("log catergory not found")
+		}
+		logFiles = matches
+	}
+
+	//Skip the files that were last written before the search range
+	type logFile struct {
+		path    string
+		modTime time.Time
+	}
+	candidates := []logFile{}
+	for _, path := range logFiles {
+		st, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		if !filter.From.IsZero() && st.ModTime().Before(filter.From) {
+			continue
+		}
+		candidates = append(candidates, logFile{path, st.ModTime()})
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].modTime.Before(candidates[j].modTime)
+	})
+
+	result := SearchResult{
+		Entries: []logger.Entry{},
+	}
+	for _, candidate := range candidates {
+		f, err := os.Open(candidate.path)
+		if err != nil {
+			continue
+		}
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			entry, ok := logger.ParseLine(scanner.Text())
+			if !ok || !filter.match(entry) {
+				continue
+			}
+			result.Entries = append(result.Entries, entry)
+			if filter.Limit > 0 && len(result.Entries) > filter.Limit*2 {
+				//Keep only the newest entries
+				result.Entries = append([]logger.Entry{}, result.Entries[len(result.Entries)-filter.Limit:]...)
+				result.Truncated = true
+			}
+		}
+		f.Close()
+	}
+
+	sort.SliceStable(result.Entries, func(i, j int) bool {
+		return result.Entries[i].Time.Before(result.Entries[j].Time)
+	})
+	if filter.Limit > 0 && len(result.Entries) > filter.Limit {
+		result.Entries = result.Entries[len(result.Entries)-filter.Limit:]
+		result.Truncated = true
+	}
+	return &result, nil
+}
+
+func (f SearchFilter) match(entry logger.Entry) bool {
+	if f.Level != "" && entry.Level != f.Level {
+		return false
+	}
+	if f.Module != "" && !strings.EqualFold(entry.Module, f.Module) {
+		return false
+	}
+	if !f.From.IsZero() && entry.Time.Before(f.From) {
+		return false
+	}
+	if !f.To.IsZero() && entry.Time.After(f.To) {
+		return false
+	}
+	if f.Keyword != "" {
+		keyword := strings.ToLower(f.Keyword)
+		if !strings.Contains(strings.ToLower(entry.Message), keyword) &&
+			!strings.Contains(strings.ToLower(entry.Error), keyword) &&
+			!strings.Contains(strings.ToLower(entry.Module), keyword) {
+			return false
+		}
+	}
+	return true
+}
+
+// Parse the search time in local time zone. A date only "to" value include the whole day
+func parseSearchTime(value string, endOfRange bool) (time.Time, error) {
+	if t, err := time.ParseInLocation("2006-01-02T15:04", value, time.Local); err == nil {
+		if endOfRange {
+			return t.Add(time.Minute - time.Nanosecond), nil
+		}
+		return t, nil
+	}
+	t, err := time.ParseInLocation("2006-01-02", value, time.Local)
+	if err != nil {
+		return t, err
+	}
+	if endOfRange {
+		return t.AddDate(0, 0, 1).Add(-time.Nanosecond), nil
+	}
+	return t, nil
+}
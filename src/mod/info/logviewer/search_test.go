@@ -0,0 +1,44 @@
+package logviewer
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"imuslab.com/arozos/mod/info/logger"
+)
+
+func TestSearchLog(t *testing.T) {
+	root := t.TempDir()
+	l, err := logger.NewLogger("system", filepath.Join(root, "system"), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Log("Storage", "pool mounted", nil)
+	l.LogWithLevel(logger.LevelWarn, "Network", "port in use", nil)
+	l.Log("Storage", "pool failed", os.ErrNotExist)
+	l.Close()
+
+	v := NewLogViewer(&ViewerOption{RootFolder: root, Extension: ".log"})
+
+	result, err := v.SearchLog("system", "", SearchFilter{Module: "storage"})
+	if err != nil || len(result.Entries) != 2 {
+		t.Fatalf("module filter returned %v (%v)", result, err)
+	}
+
+	result, _ = v.SearchLog("system", "system.log", SearchFilter{Level: logger.LevelError, Keyword: "FAILED"})
+	if len(result.Entries) != 1 || result.Entries[0].Error == "" {
+		t.Fatalf("level and keyword filter returned %+v", result.Entries)
+	}
+
+	result, _ = v.SearchLog("system", "", SearchFilter{Limit: 1})
+	if len(result.Entries) != 1 || !result.Truncated || result.Entries[0].Module != "Storage" {
+		t.Fatalf("limit should keep the newest entry, got %+v", result)
+	}
+
+	result, _ = v.SearchLog("system", "", SearchFilter{To: time.Now().Add(-time.Hour)})
+	if len(result.Entries) != 0 {
+		t.Fatal("time range filter not applied")
+	}
+}
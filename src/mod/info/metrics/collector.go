@@ -0,0 +1,172 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"imuslab.com/arozos/mod/disk/diskspace"
+	"imuslab.com/arozos/mod/info/usageinfo"
+	"imuslab.com/arozos/mod/network/netstat"
+)
+
+/*
+	System Collector
+
+	Read the host and service states when the metrics are scraped
+*/
+
+type systemCollector struct {
+	options *Options
+
+	cpuUsage    *prometheus.Desc
+	memoryUsed  *prometheus.Desc
+	memoryTotal *prometheus.Desc
+	networkRx   *prometheus.Desc
+	networkTx   *prometheus.Desc
+	diskUsed    *prometheus.Desc
+	diskTotal   *prometheus.Desc
+
+	storageUp    *prometheus.Desc
+	storageUsed  *prometheus.Desc
+	storageTotal *prometheus.Desc
+
+	raidHealthy *prometheus.Desc
+	raidActive  *prometheus.Desc
+	raidFailed  *prometheus.Desc
+
+	diskSmartPassed *prometheus.Desc
+	diskTemperature *prometheus.Desc
+
+	subserviceUp      *prometheus.Desc
+	fileServerEnabled *prometheus.Desc
+	fileServerClients *prometheus.Desc
+	fileQueueJobs     *prometheus.Desc
+}
+
+func newSystemCollector(options *Options) *systemCollector {
+	ns := options.Namespace
+	return &systemCollector{
+		options: options,
+
+		cpuUsage:    prometheus.NewDesc(ns+"_cpu_usage_percent", "Host CPU usage in percentage.", nil, nil),
+		memoryUsed:  prometheus.NewDesc(ns+"_memory_used_bytes", "Host memory in use.", nil, nil),
+		memoryTotal: prometheus.NewDesc(ns+"_memory_total_bytes", "Host physical memory.", nil, nil),
+		networkRx:   prometheus.NewDesc(ns+"_network_receive_bytes_total", "Bytes received on all network interfaces.", nil, nil),
+		networkTx:   prometheus.NewDesc(ns+"_network_transmit_bytes_total", "Bytes transmitted on all network interfaces.", nil, nil),
+		diskUsed:    prometheus.NewDesc(ns+"_disk_used_bytes", "Used space of the mounted logical disk.", []string{"device", "mountpoint"}, nil),
+		diskTotal:   prometheus.NewDesc(ns+"_disk_size_bytes", "Size of the mounted logical disk.", []string{"device", "mountpoint"}, nil),
+
+		storageUp:    prometheus.NewDesc(ns+"_storage_up", "If the file system handler passed its last heartbeat.", []string{"uuid", "name", "filesystem"}, nil),
+		storageUsed:  prometheus.NewDesc(ns+"_storage_used_bytes", "Used space of the file system handler.", []string{"uuid", "name"}, nil),
+		storageTotal: prometheus.NewDesc(ns+"_storage_size_bytes", "Size of the file system handler.", []string{"uuid", "name"}, nil),
+
+		raidHealthy: prometheus.NewDesc(ns+"_raid_healthy", "If the RAID array is clean and has no failed member.", []string{"array", "level", "state"}, nil),
+		raidActive:  prometheus.NewDesc(ns+"_raid_active_devices", "Number of active devices in the RAID array.", []string{"array"}, nil),
+		raidFailed:  prometheus.NewDesc(ns+"_raid_failed_devices", "Number of failed devices in the RAID array.", []string{"array"}, nil),
+
+		diskSmartPassed: prometheus.NewDesc(ns+"_disk_smart_passed", "SMART overall health self-assessment of the disk.", []string{"device", "model"}, nil),
+		diskTemperature: prometheus.NewDesc(ns+"_disk_temperature_celsius", "Disk temperature reported by SMART.", []string{"device"}, nil),
+
+		subserviceUp:      prometheus.NewDesc(ns+"_subservice_up", "If the subservice process is running.", []string{"name"}, nil),
+		fileServerEnabled: prometheus.NewDesc(ns+"_fileserver_enabled", "If the file server is enabled.", []string{"protocol"}, nil),
+		fileServerClients: prometheus.NewDesc(ns+"_fileserver_active_clients", "Number of clients connected to the file server.", []string{"protocol"}, nil),
+		fileQueueJobs:     prometheus.NewDesc(ns+"_file_operation_jobs", "Number of jobs in the file operation queue by status.", []string{"status"}, nil),
+	}
+}
+
+func (c *systemCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, desc := range []*prometheus.Desc{
+		c.cpuUsage, c.memoryUsed, c.memoryTotal, c.networkRx, c.networkTx, c.diskUsed, c.diskTotal,
+		c.storageUp, c.storageUsed, c.storageTotal,
+		c.raidHealthy, c.raidActive, c.raidFailed,
+		c.diskSmartPassed, c.diskTemperature,
+		c.subserviceUp, c.fileServerEnabled, c.fileServerClients, c.fileQueueJobs,
+	} {
+		ch <- desc
+	}
+}
+
+func (c *systemCollector) Collect(ch chan<- prometheus.Metric) {
+	c.collectHost(ch)
+
+	if c.options.Storages != nil {
+		for _, s := range c.options.Storages() {
+			ch <- prometheus.MustNewConstMetric(c.storageUp, prometheus.GaugeValue, boolToFloat(s.Online), s.UUID, s.Name, s.Filesystem)
+			if s.Total >= 0 {
+				ch <- prometheus.MustNewConstMetric(c.storageUsed, prometheus.GaugeValue, float64(s.Used), s.UUID, s.Name)
+				ch <- prometheus.MustNewConstMetric(c.storageTotal, prometheus.GaugeValue, float64(s.Total), s.UUID, s.Name)
+			}
+		}
+	}
+
+	if c.options.RAIDArrays != nil {
+		for _, r := range c.options.RAIDArrays() {
+			ch <- prometheus.MustNewConstMetric(c.raidHealthy, prometheus.GaugeValue, boolToFloat(r.Healthy), r.Name, r.Level, r.State)
+			ch <- prometheus.MustNewConstMetric(c.raidActive, prometheus.GaugeValue, float64(r.ActiveDevices), r.Name)
+			ch <- prometheus.MustNewConstMetric(c.raidFailed, prometheus.GaugeValue, float64(r.FailedDevices), r.Name)
+		}
+	}
+
+	if c.options.Disks != nil {
+		for _, d := range c.options.Disks() {
+			ch <- prometheus.MustNewConstMetric(c.diskSmartPassed, prometheus.GaugeValue, boolToFloat(d.Passed), d.Device, d.Model)
+			if d.Temperature > 0 {
+				ch <- prometheus.MustNewConstMetric(c.diskTemperature, prometheus.GaugeValue, float64(d.Temperature), d.Device)
+			}
+		}
+	}
+
+	if c.options.Subservices != nil {
+		for _, s := range c.options.Subservices() {
+			ch <- prometheus.MustNewConstMetric(c.subserviceUp, prometheus.GaugeValue, boolToFloat(s.Up), s.Name)
+		}
+	}
+
+	if c.options.FileServers != nil {
+		for _, f := range c.options.FileServers() {
+			ch <- prometheus.MustNewConstMetric(c.fileServerEnabled, prometheus.GaugeValue, boolToFloat(f.Enabled), f.Protocol)
+			if f.Clients >= 0 {
+				ch <- prometheus.MustNewConstMetric(c.fileServerClients, prometheus.GaugeValue, float64(f.Clients), f.Protocol)
+			}
+		}
+	}
+
+	if c.options.QueueDepth != nil {
+		for status, count := range c.options.QueueDepth() {
+			ch <- prometheus.MustNewConstMetric(c.fileQueueJobs, prometheus.GaugeValue, float64(count), status)
+		}
+	}
+}
+
+func (c *systemCollector) collectHost(ch chan<- prometheus.Metric) {
+	ch <- prometheus.MustNewConstMetric(c.cpuUsage, prometheus.GaugeValue, usageinfo.GetCPUUsage())
+
+	used, total := usageinfo.GetNumericRAMUsage()
+	if total > 0 {
+		ch <- prometheus.MustNewConstMetric(c.memoryUsed, prometheus.GaugeValue, float64(used))
+		ch <- prometheus.MustNewConstMetric(c.memoryTotal, prometheus.GaugeValue, float64(total))
+	}
+
+	//netstat reports in bits
+	rx, tx, err := netstat.GetNetworkInterfaceStats()
+	if err == nil {
+		ch <- prometheus.MustNewConstMetric(c.networkRx, prometheus.CounterValue, float64(rx/8))
+		ch <- prometheus.MustNewConstMetric(c.networkTx, prometheus.CounterValue, float64(tx/8))
+	}
+
+	//The same mountpoint can be listed twice (e.g. bind mounts), only report it once
+	reported := map[string]bool{}
+	for _, disk := range diskspace.GetAllLogicDiskInfo() {
+		if reported[disk.MountPoint] {
+			continue
+		}
+		reported[disk.MountPoint] = true
+		ch <- prometheus.MustNewConstMetric(c.diskUsed, prometheus.GaugeValue, float64(disk.Used), disk.Device, disk.MountPoint)
+		ch <- prometheus.MustNewConstMetric(c.diskTotal, prometheus.GaugeValue, float64(disk.Volume), disk.Device, disk.MountPoint)
+	}
+}
+
+func boolToFloat(value bool) float64 {
+	if value {
+		return 1
+	}
+	return 0
+}
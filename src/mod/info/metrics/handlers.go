@@ -0,0 +1,38 @@
+package metrics
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"imuslab.com/arozos/mod/utils"
+)
+
+// Get the scrape token state, or generate / revoke it with opr=generate / revoke. Admin only
+func (e *Exporter) HandleToken(w http.ResponseWriter, r *http.Request) {
+	opr, _ := utils.PostPara(r, "opr")
+	switch opr {
+	case "":
+		js, _ := json.Marshal(map[string]interface{}{
+			"enabled": e.getToken() != "",
+		})
+		utils.SendJSONResponse(w, string(js))
+	case "generate":
+		//The token is only shown once after it is generated
+		token, err := e.GenerateToken()
+		if err != nil {
+			utils.SendErrorResponse(w, err.Error())
+			return
+		}
+		js, _ := json.Marshal(token)
+		utils.SendJSONResponse(w, string(js))
+	case "revoke":
+		err := e.RevokeToken()
+		if err != nil {
+			utils.SendErrorResponse(w, err.Error())
+			return
+		}
+		utils.SendOK(w)
+	default:
+		utils.SendErrorResponse(w, "Invalid operation")
+	}
+}
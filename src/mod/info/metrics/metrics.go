@@ -0,0 +1,271 @@
+package metrics
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"imuslab.com/arozos/mod/database"
+	"imuslab.com/arozos/mod/user"
+)
+
+/*
+	System Metrics Exporter
+
+	Expose host, storage and service metrics in OpenMetrics format
+	for Prometheus and compatible scrapers. Values owned by other
+	modules are read through the source functions in Options
+	every time the endpoint is scraped.
+*/
+
+const metricsTable = "metrics"
+
+type StorageStat struct {
+	UUID       string
+	Name       string
+	Filesystem string
+	Online     bool  //Result of the last heartbeat
+	Used       int64 //Used bytes, -1 if unknown (e.g. network drives)
+	Total      int64 //Total bytes, -1 if unknown
+}
+
+type RAIDStat struct {
+	Name          string //e.g. md0
+	Level         string
+	State         string //State reported by mdadm, e.g. clean, degraded
+	Healthy       bool
+	ActiveDevices int
+	FailedDevices int
+}
+
+type DiskHealthStat struct {
+	Device      string //e.g. /dev/sda
+	Model       string
+	Passed      bool //SMART overall health self-assessment
+	Temperature int  //Celsius, 0 if unknown
+}
+
+type ServiceStat struct {
+	Name string
+	Up   bool
+}
+
+type FileServerStat struct {
+	Protocol string //e.g. webdav, sftp, ftp
+	Enabled  bool
+	Clients  int //Active clients, -1 if the server cannot tell
+}
+
+type Options struct {
+	Database    *database.Database
+	UserHandler *user.UserHandler
+	Namespace   string //Prefix of all metric names, default arozos
+
+	Storages    func() []*StorageStat
+	RAIDArrays  func() []*RAIDStat
+	Disks       func() []*DiskHealthStat
+	Subservices func() []*ServiceStat
+	FileServers func() []*FileServerStat
+	QueueDepth  func() map[string]int //Job status -> number of jobs
+}
+
+type Exporter struct {
+	options  *Options
+	registry *prometheus.Registry
+
+	loginAttempts *prometheus.CounterVec
+	agiDuration   *prometheus.HistogramVec
+	httpDuration  *prometheus.HistogramVec
+}
+
+// Create a new metrics exporter
+func NewExporter(options *Options) *Exporter {
+	if options.Namespace == "" {
+		options.Namespace = "arozos"
+	}
+	options.Database.NewTable(metricsTable)
+
+	e := &Exporter{
+		options:  options,
+		registry: prometheus.NewRegistry(),
+		loginAttempts: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: options.Namespace,
+			Name:      "login_attempts_total",
+			Help:      "Number of login attempts by authentication method and result.",
+		}, []string{"method", "result"}),
+		agiDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: options.Namespace,
+			Name:      "agi_execution_duration_seconds",
+			Help:      "Execution time of AGI scripts by entry type and module.",
+			Buckets:   []float64{0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 300},
+		}, []string{"entry", "module"}),
+		httpDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: options.Namespace,
+			Name:      "http_request_duration_seconds",
+			Help:      "Latency of HTTP requests by registered route.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"route", "method", "code"}),
+	}
+
+	e.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		e.loginAttempts,
+		e.agiDuration,
+		e.httpDuration,
+		newSystemCollector(options),
+	)
+	return e
+}
+
+// Count a login attempt, method is the auth type like web, webdav or ftp
+func (e *Exporter) RecordLogin(method string, succeed bool) {
+	if method == "" {
+		method = "web"
+	}
+	result := "failure"
+	if succeed {
+		result = "success"
+	}
+	e.loginAttempts.WithLabelValues(method, result).Inc()
+}
+
+// Record the execution time of an AGI script. Module is the WebApp the script belongs to,
+// empty for scripts outside of modules like user scripts
+func (e *Exporter) ObserveAGIExecution(entry string, module string, duration time.Duration) {
+	if module == "" {
+		module = "none"
+	}
+	e.agiDuration.WithLabelValues(entry, module).Observe(duration.Seconds())
+}
+
+// HTTP methods recorded as is, other methods sent by clients are grouped to keep the label cardinality bounded
+var knownHTTPMethods = []string{
+	http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch,
+	http.MethodDelete, http.MethodOptions, http.MethodConnect, http.MethodTrace,
+	//WebDAV
+	"PROPFIND", "PROPPATCH", "MKCOL", "COPY", "MOVE", "LOCK", "UNLOCK",
+}
+
+func methodLabel(method string) string {
+	for _, known := range knownHTTPMethods {
+		if method == known {
+			return method
+		}
+	}
+	return "other"
+}
+
+// Wrap the mux so the latency of every request is recorded under the pattern it matched
+func (e *Exporter) InstrumentHandler(mux *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		//Use the registered pattern instead of the path to keep the label cardinality bounded
+		_, route := mux.Handler(r)
+		if route == "" {
+			route = "unmatched"
+		}
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		start := time.Now()
+		mux.ServeHTTP(recorder, r)
+		e.httpDuration.WithLabelValues(route, methodLabel(r.Method), strconv.Itoa(recorder.status)).Observe(time.Since(start).Seconds())
+	})
+}
+
+// Serve the metrics to an admin session or a request with the scrape token
+func (e *Exporter) HandleMetrics(w http.ResponseWriter, r *http.Request) {
+	if !e.authorized(w, r) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="metrics"`)
+		http.Error(w, "401 - Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	promhttp.HandlerFor(e.registry, promhttp.HandlerOpts{
+		EnableOpenMetrics: true,
+	}).ServeHTTP(w, r)
+}
+
+func (e *Exporter) authorized(w http.ResponseWriter, r *http.Request) bool {
+	if given, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		token := e.getToken()
+		return token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(strings.TrimSpace(given))) == 1
+	}
+	if e.options.UserHandler == nil {
+		return false
+	}
+	userinfo, err := e.options.UserHandler.GetUserInfoFromRequest(w, r)
+	return err == nil && userinfo.IsAdmin()
+}
+
+func (e *Exporter) getToken() string {
+	token := ""
+	if e.options.Database.KeyExists(metricsTable, "token") {
+		e.options.Database.Read(metricsTable, "token", &token)
+	}
+	return token
+}
+
+// Generate a new scrape token, replacing the old one
+func (e *Exporter) GenerateToken() (string, error) {
+	buf := make([]byte, 24)
+	_, err := rand.Read(buf)
+	if err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(buf)
+	return token, e.options.Database.Write(metricsTable, "token", token)
+}
+
+// Remove the scrape token, after that only admin sessions can read the metrics
+func (e *Exporter) RevokeToken() error {
+	return e.options.Database.Delete(metricsTable, "token")
+}
+
+// Capture the status code written by the wrapped handler
+type statusRecorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+func (s *statusRecorder) WriteHeader(code int) {
+	if !s.wroteHeader {
+		s.status = code
+		s.wroteHeader = true
+	}
+	s.ResponseWriter.WriteHeader(code)
+}
+
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	s.wroteHeader = true
+	return s.ResponseWriter.Write(b)
+}
+
+// Allow websocket upgrade and streaming through the wrapper
+func (s *statusRecorder) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
+
+func (s *statusRecorder) Flush() {
+	if flusher, ok := s.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (s *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := s.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response writer does not support hijacking")
+	}
+	s.status = http.StatusSwitchingProtocols
+	s.wroteHeader = true
+	return hijacker.Hijack()
+}
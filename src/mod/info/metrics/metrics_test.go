@@ -0,0 +1,123 @@
+package metrics
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"imuslab.com/arozos/mod/database"
+)
+
+func newTestExporter(t *testing.T) *Exporter {
+	sysdb, err := database.NewDatabase(filepath.Join(t.TempDir(), "test.db"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(sysdb.Close)
+
+	return NewExporter(&Options{
+		Database: sysdb,
+		Storages: func() []*StorageStat {
+			return []*StorageStat{
+				{UUID: "user", Name: "User", Filesystem: "ext4", Online: true, Used: 100, Total: 1000},
+				{UUID: "nas", Name: "NAS", Filesystem: "smb", Online: false, Used: -1, Total: -1},
+			}
+		},
+		RAIDArrays: func() []*RAIDStat {
+			return []*RAIDStat{{Name: "md0", Level: "raid1", State: "clean, degraded", ActiveDevices: 1, FailedDevices: 1}}
+		},
+		FileServers: func() []*FileServerStat {
+			return []*FileServerStat{{Protocol: "sftp", Enabled: true, Clients: 2}}
+		},
+		QueueDepth: func() map[string]int {
+			return map[string]int{"queued": 3}
+		},
+	})
+}
+
+func scrape(t *testing.T, e *Exporter, token string) (int, string) {
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	req.Header.Set("Accept", "application/openmetrics-text; version=1.0.0")
+	req.Header.Set("Authorization", "Bearer "+token)
+	rec := httptest.NewRecorder()
+	e.HandleMetrics(rec, req)
+	body, _ := io.ReadAll(rec.Body)
+	return rec.Code, string(body)
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+	e := newTestExporter(t)
+	token, err := e.GenerateToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if code, _ := scrape(t, e, "wrong"); code != http.StatusUnauthorized {
+		t.Fatalf("wrong token accepted with status %d", code)
+	}
+
+	e.RecordLogin("webdav", false)
+	e.RecordLogin("", true)
+	e.ObserveAGIExecution("webapp", "Music", 30*time.Millisecond)
+
+	code, body := scrape(t, e, token)
+	if code != http.StatusOK {
+		t.Fatalf("unexpected status %d", code)
+	}
+	expected := []string{
+		`arozos_storage_up{filesystem="ext4",name="User",uuid="user"} 1`,
+		`arozos_storage_up{filesystem="smb",name="NAS",uuid="nas"} 0`,
+		`arozos_storage_size_bytes{name="User",uuid="user"} 1000`,
+		`arozos_raid_healthy{array="md0",level="raid1",state="clean, degraded"} 0`,
+		`arozos_fileserver_active_clients{protocol="sftp"} 2`,
+		`arozos_file_operation_jobs{status="queued"} 3`,
+		`arozos_login_attempts_total{method="webdav",result="failure"} 1`,
+		`arozos_login_attempts_total{method="web",result="success"} 1`,
+		`arozos_agi_execution_duration_seconds_count{entry="webapp",module="Music"} 1`,
+		`# EOF`,
+	}
+	for _, line := range expected {
+		if !strings.Contains(body, line) {
+			t.Errorf("metric not found: %s", line)
+		}
+	}
+	if strings.Contains(body, `arozos_storage_size_bytes{name="NAS"`) {
+		t.Error("unknown capacity should not be reported")
+	}
+
+	//Revoked token can no longer scrape
+	e.RevokeToken()
+	if code, _ := scrape(t, e, token); code != http.StatusUnauthorized {
+		t.Fatalf("revoked token accepted with status %d", code)
+	}
+}
+
+func TestInstrumentHandler(t *testing.T) {
+	e := newTestExporter(t)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/system/test", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	})
+	handler := e.InstrumentHandler(mux)
+
+	for _, path := range []string{"/system/test", "/system/test?x=1", "/missing"} {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+	}
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("RANDOM123", "/system/test", nil))
+
+	token, _ := e.GenerateToken()
+	_, body := scrape(t, e, token)
+	if !strings.Contains(body, `arozos_http_request_duration_seconds_count{code="418",method="GET",route="/system/test"} 2`) {
+		t.Error("route latency not recorded")
+	}
+	if !strings.Contains(body, `route="unmatched"`) {
+		t.Error("unmatched route not recorded")
+	}
+	if strings.Contains(body, "RANDOM123") || !strings.Contains(body, `method="other"`) {
+		t.Error("unknown method not grouped")
+	}
+}
@@ -0,0 +1,619 @@
+package automation
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+	"imuslab.com/arozos/mod/database"
+	"imuslab.com/arozos/mod/iot"
+	"imuslab.com/arozos/mod/user"
+)
+
+/*
+	IoT Automation Engine
+
+	This module records the device status history and runs the
+	automation rules created by users on the IoT Hub devices
+*/
+
+const (
+	rulesTable     = "iot_automation"
+	maxLogEntries  = 100
+	minFireSpacing = 1 //Min seconds between two executions of the same rule, prevent rules triggering each others in loop
+)
+
+type Options struct {
+	Database    *database.Database
+	IotManager  *iot.Manager
+	UserHandler *user.UserHandler //Check if the rule owner can still access the IoT Hub, can be nil
+
+	Notify    func(username string, title string, message string) error                            //Send notification to the user
+	RunScript func(username string, scriptVpath string, context map[string]string) (string, error) //Run an AGI script as the user
+}
+
+type Config struct {
+	Latitude     float64 //Location for sunrise and sunset
+	Longitude    float64
+	PollInterval int64 //Seconds between status polling of the devices, 0 to disable
+}
+
+type LogEntry struct {
+	Time    int64
+	Trigger TriggerContext
+	Success bool
+	Results []string //Result of each action
+	Error   string
+}
+
+type Engine struct {
+	options    *Options
+	db         *database.Database
+	history    *History
+	config     Config
+	rules      map[string]*Rule
+	lastStatus map[string]map[string]interface{} //Device UUID -> last known status
+	lastMinute int64                             //The last minute the schedule triggers were checked
+	stop       chan bool
+	mutex      sync.RWMutex
+}
+
+func NewEngine(options *Options) (*Engine, error) {
+	sysdb := options.Database
+	if !sysdb.TableExists(rulesTable) {
+		sysdb.NewTable(rulesTable)
+	}
+
+	config := Config{PollInterval: 60}
+	if sysdb.KeyExists(rulesTable, "config") {
+		sysdb.Read(rulesTable, "config", &config)
+	}
+
+	engine := Engine{
+		options:    options,
+		db:         sysdb,
+		history:    newHistory(sysdb),
+		config:     config,
+		rules:      map[string]*Rule{},
+		lastStatus: map[string]map[string]interface{}{},
+	}
+
+	//Load rules from database
+	entries, err := sysdb.ListTable(rulesTable)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if !strings.HasPrefix(string(entry[0]), "rule/") {
+			continue
+		}
+		rule := Rule{}
+		if err := decodeJSON(entry[1], &rule); err != nil {
+			log.Println("[IoT] Unable to load automation rule " + string(entry[0]) + ": " + err.Error())
+			continue
+		}
+		engine.rules[rule.ID] = &rule
+	}
+
+	return &engine, nil
+}
+
+// Start the schedule ticker and the status polling
+func (e *Engine) Start() {
+	e.stop = make(chan bool)
+	go func() {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		lastPoll := time.Now()
+		lastPrune := time.Now()
+		for {
+			select {
+			case now := <-ticker.C:
+				e.tick(now)
+
+				e.mutex.RLock()
+				pollInterval := e.config.PollInterval
+				e.mutex.RUnlock()
+				if pollInterval > 0 && now.Sub(lastPoll) >= time.Duration(pollInterval)*time.Second {
+					lastPoll = now
+					go e.pollDevices()
+				}
+				if now.Sub(lastPrune) >= time.Hour {
+					lastPrune = now
+					go e.history.Prune(now)
+				}
+			case <-e.stop:
+				return
+			}
+		}
+	}()
+	log.Println("[IoT] Automation engine started with " + itoa(len(e.rules)) + " rules")
+}
+
+func (e *Engine) Close() {
+	if e.stop != nil {
+		close(e.stop)
+		e.stop = nil
+	}
+}
+
+// Read the status of all devices, the result is delivered to HandleDeviceEvent by the IoT manager
+func (e *Engine) pollDevices() {
+	if e.options.IotManager == nil {
+		return
+	}
+	for _, device := range e.options.IotManager.GetCachedDeviceList() {
+		e.options.IotManager.GetDeviceStatus(device)
+	}
+}
+
+func (e *Engine) GetConfig() Config {
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+	return e.config
+}
+
+func (e *Engine) SetConfig(config Config) error {
+	if config.Latitude < -90 || config.Latitude > 90 || config.Longitude < -180 || config.Longitude > 180 {
+		return errors.New("invalid location")
+	}
+	if config.PollInterval < 0 {
+		return errors.New("invalid poll interval")
+	}
+	e.mutex.Lock()
+	e.config = config
+	e.mutex.Unlock()
+	return e.db.Write(rulesTable, "config", config)
+}
+
+func (e *Engine) GetHistory() *History {
+	return e.history
+}
+
+/*
+	Rule Management
+*/
+
+// List the rules of the given user, or all rules if username is empty
+func (e *Engine) ListRules(username string) []*Rule {
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+	results := []*Rule{}
+	for _, rule := range e.rules {
+		if username == "" || rule.Owner == username {
+			copied := *rule
+			results = append(results, &copied)
+		}
+	}
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].CreatedTime < results[j].CreatedTime
+	})
+	return results
+}
+
+func (e *Engine) GetRule(id string) *Rule {
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+	rule, ok := e.rules[id]
+	if !ok {
+		return nil
+	}
+	copied := *rule
+	return &copied
+}
+
+// Create or update a rule. The ID, webhook token and created time are assigned for new rules
+func (e *Engine) SaveRule(rule *Rule) error {
+	if err := rule.Validate(); err != nil {
+		return err
+	}
+
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if rule.ID == "" {
+		rule.ID = uuid.NewV4().String()
+		rule.CreatedTime = time.Now().Unix()
+	} else if existing, ok := e.rules[rule.ID]; ok {
+		rule.CreatedTime = existing.CreatedTime
+		rule.LastFired = existing.LastFired
+		rule.WebhookToken = existing.WebhookToken
+	} else {
+		return errors.New("rule not exists")
+	}
+
+	if rule.HasTrigger(TriggerWebhook) && rule.WebhookToken == "" {
+		token := make([]byte, 24)
+		rand.Read(token)
+		rule.WebhookToken = hex.EncodeToString(token)
+	}
+
+	err := e.db.Write(rulesTable, "rule/"+rule.ID, rule)
+	if err != nil {
+		return err
+	}
+	e.rules[rule.ID] = rule
+	return nil
+}
+
+func (e *Engine) RemoveRule(id string) error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if _, ok := e.rules[id]; !ok {
+		return errors.New("rule not exists")
+	}
+	delete(e.rules, id)
+	e.db.Delete(rulesTable, "log/"+id)
+	return e.db.Delete(rulesTable, "rule/"+id)
+}
+
+// Get the execution log of a rule, latest first
+func (e *Engine) GetLog(id string) []*LogEntry {
+	logs := []*LogEntry{}
+	if e.db.KeyExists(rulesTable, "log/"+id) {
+		e.db.Read(rulesTable, "log/"+id, &logs)
+	}
+	return logs
+}
+
+func (e *Engine) appendLog(id string, entry *LogEntry) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if _, ok := e.rules[id]; !ok {
+		//Removed during execution
+		return
+	}
+	logs := []*LogEntry{}
+	if e.db.KeyExists(rulesTable, "log/"+id) {
+		e.db.Read(rulesTable, "log/"+id, &logs)
+	}
+	logs = append([]*LogEntry{entry}, logs...)
+	if len(logs) > maxLogEntries {
+		logs = logs[:maxLogEntries]
+	}
+	e.db.Write(rulesTable, "log/"+id, logs)
+}
+
+/*
+	Triggers
+*/
+
+// Handle the status events from the IoT manager. Set this as (part of) the IoT manager status listener
+func (e *Engine) HandleDeviceEvent(device *iot.Device, event string, data interface{}) {
+	if device == nil || event != "status" {
+		return
+	}
+	status, ok := data.(map[string]interface{})
+	if !ok {
+		return
+	}
+
+	now := time.Now()
+	for field, value := range status {
+		if number, ok := numericValue(value); ok {
+			if err := e.history.Record(device.DeviceUUID, field, number, now); err != nil {
+				log.Println("[IoT] Unable to record status history: " + err.Error())
+			}
+		}
+	}
+
+	//Compare with the last status and find the rules to fire
+	e.mutex.Lock()
+	previous, seen := e.lastStatus[device.DeviceUUID]
+	current := map[string]interface{}{}
+	for field, value := range status {
+		current[field] = value
+	}
+	e.lastStatus[device.DeviceUUID] = current
+
+	toFire := []*Rule{}
+	contexts := []TriggerContext{}
+	for _, rule := range e.rules {
+		if !rule.Enabled {
+			continue
+		}
+		for _, t := range rule.Triggers {
+			if t.Device != device.DeviceUUID || (t.Type != TriggerStatus && t.Type != TriggerThreshold) {
+				continue
+			}
+			value, exists := current[t.Field]
+			if !exists {
+				continue
+			}
+			oldValue, oldExists := previous[t.Field]
+
+			fired := false
+			if t.Type == TriggerStatus {
+				//Fire on change, but not on the first status seen after startup
+				changed := seen && (!oldExists || toString(oldValue) != toString(value))
+				fired = changed && (t.Value == "" || compareValue(value, t.Operator, t.Value))
+			} else {
+				//Fire when the value crosses the threshold
+				fired = compareValue(value, t.Operator, t.Value) && seen && !(oldExists && compareValue(oldValue, t.Operator, t.Value))
+			}
+			if fired {
+				toFire = append(toFire, rule)
+				contexts = append(contexts, TriggerContext{Type: t.Type, Device: device.DeviceUUID, Field: t.Field, Value: value})
+				break
+			}
+		}
+	}
+	e.mutex.Unlock()
+
+	for i, rule := range toFire {
+		go e.Fire(rule.ID, contexts[i], false)
+	}
+}
+
+// Check the schedule and sun triggers. Called every second, run once per minute
+func (e *Engine) tick(now time.Time) {
+	minute := now.Unix() / 60
+	e.mutex.Lock()
+	if minute == e.lastMinute {
+		e.mutex.Unlock()
+		return
+	}
+	e.lastMinute = minute
+	config := e.config
+
+	clock := now.Hour()*60 + now.Minute()
+	toFire := []*Rule{}
+	contexts := []TriggerContext{}
+	for _, rule := range e.rules {
+		if !rule.Enabled {
+			continue
+		}
+		for _, t := range rule.Triggers {
+			fired := false
+			switch t.Type {
+			case TriggerSchedule:
+				scheduled, _ := parseClock(t.Time)
+				fired = scheduled == clock && matchWeekday(t.Weekdays, now)
+			case TriggerSun:
+				eventTime, ok := sunEventTime(now, t.Event, config)
+				if ok {
+					eventTime = eventTime.Add(time.Duration(t.Offset) * time.Minute)
+					fired = eventTime.Unix()/60 == minute
+				}
+			}
+			if fired {
+				toFire = append(toFire, rule)
+				contexts = append(contexts, TriggerContext{Type: t.Type})
+				break
+			}
+		}
+	}
+	e.mutex.Unlock()
+
+	for i, rule := range toFire {
+		go e.Fire(rule.ID, contexts[i], false)
+	}
+}
+
+// Get the sunrise or sunset time of the day at the configured location
+func sunEventTime(now time.Time, event string, config Config) (time.Time, bool) {
+	if config.Latitude == 0 && config.Longitude == 0 {
+		//Location not configured
+		return time.Time{}, false
+	}
+	sunrise, sunset, ok := SunTimes(now, config.Latitude, config.Longitude)
+	if !ok {
+		return time.Time{}, false
+	}
+	if event == "sunrise" {
+		return sunrise, true
+	}
+	return sunset, true
+}
+
+// Fire the rule by webhook, return error if the token does not match
+func (e *Engine) FireWebhook(id string, token string, payload string) error {
+	rule := e.GetRule(id)
+	if rule == nil || !rule.Enabled || !rule.HasTrigger(TriggerWebhook) || !tokenEqual(rule.WebhookToken, token) {
+		return errors.New("invalid webhook")
+	}
+	go e.Fire(id, TriggerContext{Type: TriggerWebhook, Payload: payload}, false)
+	return nil
+}
+
+/*
+	Conditions and Actions
+*/
+
+// Check conditions and execute the actions of a rule. Set force to skip the conditions and cooldown
+func (e *Engine) Fire(id string, context TriggerContext, force bool) (*LogEntry, error) {
+	now := time.Now()
+	e.mutex.Lock()
+	rule, ok := e.rules[id]
+	if !ok {
+		e.mutex.Unlock()
+		return nil, errors.New("rule not exists")
+	}
+	if !force {
+		spacing := rule.Cooldown
+		if spacing < minFireSpacing {
+			spacing = minFireSpacing
+		}
+		if now.Unix()-rule.LastFired < spacing {
+			e.mutex.Unlock()
+			return nil, errors.New("rule in cooldown")
+		}
+		if !e.checkConditions(rule, now) {
+			e.mutex.Unlock()
+			return nil, errors.New("conditions not met")
+		}
+	}
+	rule.LastFired = now.Unix()
+	e.db.Write(rulesTable, "rule/"+rule.ID, rule)
+	actions := rule.Actions
+	owner := rule.Owner
+	ruleName := rule.Name
+	e.mutex.Unlock()
+
+	entry := LogEntry{
+		Time:    now.Unix(),
+		Trigger: context,
+		Success: true,
+		Results: []string{},
+	}
+
+	if err := e.checkOwner(owner); err != nil {
+		entry.Success = false
+		entry.Error = err.Error()
+	} else {
+		for _, action := range actions {
+			result, err := e.runAction(action, ruleName, owner, context)
+			if err != nil {
+				entry.Success = false
+				entry.Error = action.Type + ": " + err.Error()
+				break
+			}
+			entry.Results = append(entry.Results, action.Type+": "+result)
+		}
+	}
+
+	if !entry.Success {
+		log.Println("[IoT] Automation rule " + ruleName + " failed: " + entry.Error)
+	}
+	e.appendLog(id, &entry)
+	return &entry, nil
+}
+
+// Check if the rule owner still exists and can access the IoT Hub
+func (e *Engine) checkOwner(owner string) error {
+	if e.options.UserHandler == nil {
+		return nil
+	}
+	userinfo, err := e.options.UserHandler.GetUserInfoFromUsername(owner)
+	if err != nil {
+		return errors.New("rule owner no longer exists")
+	}
+	if !userinfo.GetModuleAccessPermission("IoT Hub") {
+		return errors.New("rule owner has no permission to access IoT Hub")
+	}
+	return nil
+}
+
+// Check if the user can access the given device in the IoT Hub
+func (e *Engine) checkDeviceAccess(username string, devid string) error {
+	if err := e.checkOwner(username); err != nil {
+		return errors.New("permission denied")
+	}
+	if e.options.IotManager == nil || e.options.IotManager.GetDeviceByID(devid) == nil {
+		return errors.New("device not found")
+	}
+	return nil
+}
+
+// Check all conditions of the rule. Caller must hold the lock
+func (e *Engine) checkConditions(rule *Rule, now time.Time) bool {
+	clock := now.Hour()*60 + now.Minute()
+	for _, c := range rule.Conditions {
+		switch c.Type {
+		case ConditionStatus:
+			status, ok := e.lastStatus[c.Device]
+			if !ok || !compareValue(status[c.Field], c.Operator, c.Value) {
+				return false
+			}
+		case ConditionTime:
+			after, ok1 := e.resolveClock(c.After, now)
+			before, ok2 := e.resolveClock(c.Before, now)
+			if !ok1 || !ok2 {
+				return false
+			}
+			if after <= before && (clock < after || clock >= before) {
+				return false
+			}
+			if after > before && clock < after && clock >= before {
+				//Time range across midnight, e.g. 22:00 to 06:00
+				return false
+			}
+		case ConditionWeekday:
+			if !matchWeekday(c.Weekdays, now) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Resolve HH:MM, sunrise or sunset into minutes of the day. Caller must hold the lock
+func (e *Engine) resolveClock(clock string, now time.Time) (int, bool) {
+	if clock == "sunrise" || clock == "sunset" {
+		eventTime, ok := sunEventTime(now, clock, e.config)
+		if !ok {
+			return 0, false
+		}
+		return eventTime.Hour()*60 + eventTime.Minute(), true
+	}
+	minutes, err := parseClock(clock)
+	return minutes, err == nil
+}
+
+func (e *Engine) runAction(action *Action, ruleName string, owner string, context TriggerContext) (string, error) {
+	switch action.Type {
+	case ActionExecute:
+		if e.options.IotManager == nil {
+			return "", errors.New("IoT manager not available")
+		}
+		device := e.options.IotManager.GetDeviceByID(action.Device)
+		if device == nil {
+			return "", errors.New("device not found: " + action.Device)
+		}
+		var endpoint *iot.Endpoint
+		for _, ept := range device.ControlEndpoints {
+			if ept.Name == action.Endpoint {
+				endpoint = ept
+				break
+			}
+		}
+		if endpoint == nil {
+			return "", errors.New("endpoint not found: " + action.Endpoint)
+		}
+		result, err := e.options.IotManager.ExecuteEndpoint(device, endpoint, action.Payload)
+		if err != nil {
+			return "", err
+		}
+		return toString(result), nil
+	case ActionNotify:
+		if e.options.Notify == nil {
+			return "", errors.New("notification not available")
+		}
+		title := fillTemplate(action.Title, ruleName, context)
+		if title == "" {
+			title = ruleName
+		}
+		err := e.options.Notify(owner, title, fillTemplate(action.Message, ruleName, context))
+		if err != nil {
+			return "", err
+		}
+		return "sent", nil
+	case ActionScript:
+		if e.options.RunScript == nil {
+			return "", errors.New("script execution not available")
+		}
+		return e.options.RunScript(owner, action.Script, map[string]string{
+			"rule":    ruleName,
+			"trigger": context.Type,
+			"device":  context.Device,
+			"field":   context.Field,
+			"value":   toString(context.Value),
+			"payload": context.Payload,
+		})
+	}
+	return "", errors.New("invalid action type")
+}
+
+func fillTemplate(template string, ruleName string, context TriggerContext) string {
+	return strings.NewReplacer(
+		"{{rule}}", ruleName,
+		"{{device}}", context.Device,
+		"{{field}}", context.Field,
+		"{{value}}", toString(context.Value),
+	).Replace(template)
+}
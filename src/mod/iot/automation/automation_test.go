@@ -0,0 +1,233 @@
+package automation
+
+import (
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"imuslab.com/arozos/mod/database"
+	"imuslab.com/arozos/mod/iot"
+)
+
+// A protocol handler with a single switch device
+type testHandler struct {
+	mutex    sync.Mutex
+	executed []string
+}
+
+func (h *testHandler) Start() error { return nil }
+func (h *testHandler) Scan() ([]*iot.Device, error) {
+	return []*iot.Device{{
+		Name:       "Fan",
+		DeviceUUID: "fan",
+		Status:     map[string]interface{}{},
+		ControlEndpoints: []*iot.Endpoint{
+			{RelPath: "/toggle", Name: "Toggle", Type: "bool"},
+		},
+		Handler: h,
+	}}, nil
+}
+func (h *testHandler) Connect(device *iot.Device, authInfo *iot.AuthInfo) error { return nil }
+func (h *testHandler) Status(device *iot.Device) (map[string]interface{}, error) {
+	return map[string]interface{}{}, nil
+}
+func (h *testHandler) Execute(device *iot.Device, endpoint *iot.Endpoint, payload interface{}) (interface{}, error) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.executed = append(h.executed, endpoint.Name+"="+payload.(string))
+	return "ok", nil
+}
+func (h *testHandler) Disconnect(device *iot.Device) error { return nil }
+func (h *testHandler) Stats() iot.Stats                    { return iot.Stats{} }
+func (h *testHandler) Icon(device *iot.Device) string      { return "unknown" }
+
+func newTestEngine(t *testing.T) (*Engine, *testHandler, *[]string) {
+	sysdb, err := database.NewDatabase(filepath.Join(t.TempDir(), "test.db"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(sysdb.Close)
+
+	handler := &testHandler{}
+	manager := iot.NewIoTManager(sysdb)
+	manager.RegisterHandler(handler)
+	manager.ScanDevices()
+
+	notifications := []string{}
+	engine, err := NewEngine(&Options{
+		Database:   sysdb,
+		IotManager: manager,
+		Notify: func(username string, title string, message string) error {
+			notifications = append(notifications, username+":"+title+":"+message)
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return engine, handler, &notifications
+}
+
+func waitForLog(t *testing.T, engine *Engine, id string, count int) []*LogEntry {
+	deadline := time.Now().Add(3 * time.Second)
+	for time.Now().Before(deadline) {
+		if logs := engine.GetLog(id); len(logs) >= count {
+			return logs
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("rule not executed")
+	return nil
+}
+
+func TestThresholdRule(t *testing.T) {
+	engine, handler, notifications := newTestEngine(t)
+	rule := &Rule{
+		Name:    "Cooling",
+		Owner:   "alice",
+		Enabled: true,
+		Triggers: []*Trigger{
+			{Type: TriggerThreshold, Device: "sensor", Field: "Temperature", Operator: ">", Value: "28"},
+		},
+		Conditions: []*Condition{
+			{Type: ConditionStatus, Device: "sensor", Field: "Online", Operator: "==", Value: "true"},
+		},
+		Actions: []*Action{
+			{Type: ActionExecute, Device: "fan", Endpoint: "Toggle", Payload: "true"},
+			{Type: ActionNotify, Title: "{{rule}}", Message: "{{field}} is {{value}}"},
+		},
+	}
+	if err := engine.SaveRule(rule); err != nil {
+		t.Fatal(err)
+	}
+
+	sensor := &iot.Device{DeviceUUID: "sensor"}
+	engine.HandleDeviceEvent(sensor, "status", map[string]interface{}{"Temperature": 25.0, "Online": true})
+	engine.HandleDeviceEvent(sensor, "status", map[string]interface{}{"Temperature": 29.5, "Online": true})
+	logs := waitForLog(t, engine, rule.ID, 1)
+	if !logs[0].Success || logs[0].Trigger.Value != 29.5 {
+		t.Fatalf("unexpected log %+v", logs[0])
+	}
+	if len(handler.executed) != 1 || handler.executed[0] != "Toggle=true" {
+		t.Fatalf("endpoint not executed %v", handler.executed)
+	}
+	if len(*notifications) != 1 || (*notifications)[0] != "alice:Cooling:Temperature is 29.5" {
+		t.Fatalf("unexpected notification %v", *notifications)
+	}
+
+	//Staying above the threshold does not fire again
+	engine.HandleDeviceEvent(sensor, "status", map[string]interface{}{"Temperature": 30.0, "Online": true})
+	time.Sleep(100 * time.Millisecond)
+	if len(engine.GetLog(rule.ID)) != 1 {
+		t.Fatal("rule fired without crossing the threshold")
+	}
+
+	//Numeric status are recorded into the history
+	now := time.Now()
+	points, resolution, err := engine.GetHistory().Query("sensor", "Temperature", now.Unix()-3600, now.Unix(), "", now)
+	if err != nil || resolution != "1m" || len(points) == 0 || points[len(points)-1].Max != 30 {
+		t.Fatalf("history not recorded: %v %s %v", err, resolution, points)
+	}
+}
+
+func TestScheduleAndWebhook(t *testing.T) {
+	engine, _, notifications := newTestEngine(t)
+	scheduled := &Rule{
+		Name:     "Morning",
+		Owner:    "bob",
+		Enabled:  true,
+		Triggers: []*Trigger{{Type: TriggerSchedule, Time: "07:30"}},
+		Conditions: []*Condition{
+			{Type: ConditionTime, After: "22:00", Before: "08:00"},
+		},
+		Actions: []*Action{{Type: ActionNotify, Message: "Good morning"}},
+	}
+	if err := engine.SaveRule(scheduled); err != nil {
+		t.Fatal(err)
+	}
+
+	engine.tick(time.Date(2026, 1, 5, 7, 29, 0, 0, time.Local))
+	engine.tick(time.Date(2026, 1, 5, 7, 30, 10, 0, time.Local))
+	waitForLog(t, engine, scheduled.ID, 1)
+	if (*notifications)[0] != "bob:Morning:Good morning" {
+		t.Fatalf("unexpected notification %v", *notifications)
+	}
+
+	hook := &Rule{
+		Name:     "Doorbell",
+		Owner:    "bob",
+		Enabled:  true,
+		Triggers: []*Trigger{{Type: TriggerWebhook}},
+		Actions:  []*Action{{Type: ActionNotify, Message: "Ding"}},
+	}
+	if err := engine.SaveRule(hook); err != nil {
+		t.Fatal(err)
+	}
+	if hook.WebhookToken == "" {
+		t.Fatal("webhook token not generated")
+	}
+	if err := engine.FireWebhook(hook.ID, "wrong", ""); err == nil {
+		t.Fatal("webhook with wrong token accepted")
+	}
+	if err := engine.FireWebhook(hook.ID, hook.WebhookToken, "{}"); err != nil {
+		t.Fatal(err)
+	}
+	waitForLog(t, engine, hook.ID, 1)
+}
+
+func TestRuleValidation(t *testing.T) {
+	invalid := []*Rule{
+		{Name: "No trigger", Actions: []*Action{{Type: ActionNotify, Message: "x"}}},
+		{Name: "Bad time", Triggers: []*Trigger{{Type: TriggerSchedule, Time: "25:00"}}, Actions: []*Action{{Type: ActionNotify, Message: "x"}}},
+		{Name: "Bad operator", Triggers: []*Trigger{{Type: TriggerThreshold, Device: "a", Field: "b", Operator: "~"}}, Actions: []*Action{{Type: ActionNotify, Message: "x"}}},
+		{Name: "Bad script", Triggers: []*Trigger{{Type: TriggerWebhook}}, Actions: []*Action{{Type: ActionScript, Script: "user:/run.sh"}}},
+	}
+	for _, rule := range invalid {
+		if rule.Validate() == nil {
+			t.Fatal("invalid rule accepted: " + rule.Name)
+		}
+	}
+}
+
+func TestSunTimes(t *testing.T) {
+	//London on the summer solstice, sunrise 03:43 and sunset 20:21 UTC
+	sunrise, sunset, ok := SunTimes(time.Date(2024, 6, 21, 0, 0, 0, 0, time.UTC), 51.5074, -0.1278)
+	if !ok {
+		t.Fatal("sun times not calculated")
+	}
+	expectedRise := time.Date(2024, 6, 21, 3, 43, 0, 0, time.UTC)
+	expectedSet := time.Date(2024, 6, 21, 20, 21, 0, 0, time.UTC)
+	if sunrise.Sub(expectedRise).Abs() > 3*time.Minute || sunset.Sub(expectedSet).Abs() > 3*time.Minute {
+		t.Fatalf("unexpected sun times %v %v", sunrise, sunset)
+	}
+
+	//Polar night
+	if _, _, ok := SunTimes(time.Date(2024, 12, 21, 0, 0, 0, 0, time.UTC), 78.22, 15.65); ok {
+		t.Fatal("sun should not rise in polar night")
+	}
+}
+
+func TestHistoryPrune(t *testing.T) {
+	engine, _, _ := newTestEngine(t)
+	history := engine.GetHistory()
+	now := time.Now()
+	history.Record("sensor", "Temperature", 20, now.Add(-2*24*time.Hour))
+	history.Record("sensor", "Temperature", 25, now)
+
+	//Only the expired 1m bucket is removed, the coarser resolutions are kept
+	if removed := history.Prune(now); removed != 1 {
+		t.Fatalf("expect 1 bucket removed, got %d", removed)
+	}
+	points, _, err := history.Query("sensor", "Temperature", now.Unix()-3*86400, now.Unix(), "15m", now)
+	if err != nil || len(points) != 2 {
+		t.Fatalf("unexpected history %v %v", points, err)
+	}
+
+	if err := engine.checkDeviceAccess("alice", "fan"); err != nil {
+		t.Fatal(err)
+	}
+	if err := engine.checkDeviceAccess("alice", "unknown"); err == nil {
+		t.Fatal("history of unknown device is accessible")
+	}
+}
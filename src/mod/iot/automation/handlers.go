@@ -0,0 +1,261 @@
+package automation
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"imuslab.com/arozos/mod/user"
+	"imuslab.com/arozos/mod/utils"
+)
+
+// Get the rule with the given id if the user is the owner or an admin
+func (e *Engine) getUserRule(w http.ResponseWriter, r *http.Request, userinfo *user.User) *Rule {
+	id, err := utils.GetPara(r, "id")
+	if err != nil {
+		id, err = utils.PostPara(r, "id")
+		if err != nil {
+			utils.SendErrorResponse(w, "Invalid rule id")
+			return nil
+		}
+	}
+	rule := e.GetRule(id)
+	if rule == nil || (rule.Owner != userinfo.Username && !userinfo.IsAdmin()) {
+		utils.SendErrorResponse(w, "Rule not exists")
+		return nil
+	}
+	return rule
+}
+
+// List the rules of the current user, or all rules for admin with listall=true
+func (e *Engine) HandleListRules(w http.ResponseWriter, r *http.Request) {
+	userinfo, err := e.options.UserHandler.GetUserInfoFromRequest(w, r)
+	if err != nil {
+		utils.SendErrorResponse(w, "User not logged in")
+		return
+	}
+
+	username := userinfo.Username
+	listAll, _ := utils.GetBool(r, "listall")
+	if listAll && userinfo.IsAdmin() {
+		username = ""
+	}
+
+	js, _ := json.Marshal(e.ListRules(username))
+	utils.SendJSONResponse(w, string(js))
+}
+
+// Create or update a rule, the rule is given as JSON in the rule paramter
+func (e *Engine) HandleSaveRule(w http.ResponseWriter, r *http.Request) {
+	userinfo, err := e.options.UserHandler.GetUserInfoFromRequest(w, r)
+	if err != nil {
+		utils.SendErrorResponse(w, "User not logged in")
+		return
+	}
+
+	ruleJSON, err := utils.PostPara(r, "rule")
+	if err != nil {
+		utils.SendErrorResponse(w, "Invalid rule")
+		return
+	}
+	rule := Rule{}
+	err = json.Unmarshal([]byte(ruleJSON), &rule)
+	if err != nil {
+		utils.SendErrorResponse(w, "Invalid rule")
+		return
+	}
+
+	//Only the owner or admin can edit an existing rule, the owner never changes
+	rule.Owner = userinfo.Username
+	if rule.ID != "" {
+		existing := e.GetRule(rule.ID)
+		if existing == nil || (existing.Owner != userinfo.Username && !userinfo.IsAdmin()) {
+			utils.SendErrorResponse(w, "Rule not exists")
+			return
+		}
+		rule.Owner = existing.Owner
+	}
+
+	err = e.SaveRule(&rule)
+	if err != nil {
+		utils.SendErrorResponse(w, err.Error())
+		return
+	}
+
+	js, _ := json.Marshal(rule)
+	utils.SendJSONResponse(w, string(js))
+}
+
+func (e *Engine) HandleRemoveRule(w http.ResponseWriter, r *http.Request) {
+	userinfo, err := e.options.UserHandler.GetUserInfoFromRequest(w, r)
+	if err != nil {
+		utils.SendErrorResponse(w, "User not logged in")
+		return
+	}
+	rule := e.getUserRule(w, r, userinfo)
+	if rule == nil {
+		return
+	}
+
+	err = e.RemoveRule(rule.ID)
+	if err != nil {
+		utils.SendErrorResponse(w, err.Error())
+		return
+	}
+	utils.SendOK(w)
+}
+
+// Run the actions of a rule now, skipping the conditions
+func (e *Engine) HandleRunRule(w http.ResponseWriter, r *http.Request) {
+	userinfo, err := e.options.UserHandler.GetUserInfoFromRequest(w, r)
+	if err != nil {
+		utils.SendErrorResponse(w, "User not logged in")
+		return
+	}
+	rule := e.getUserRule(w, r, userinfo)
+	if rule == nil {
+		return
+	}
+
+	entry, err := e.Fire(rule.ID, TriggerContext{Type: "manual"}, true)
+	if err != nil {
+		utils.SendErrorResponse(w, err.Error())
+		return
+	}
+	js, _ := json.Marshal(entry)
+	utils.SendJSONResponse(w, string(js))
+}
+
+// Get the execution log of a rule
+func (e *Engine) HandleRuleLog(w http.ResponseWriter, r *http.Request) {
+	userinfo, err := e.options.UserHandler.GetUserInfoFromRequest(w, r)
+	if err != nil {
+		utils.SendErrorResponse(w, "User not logged in")
+		return
+	}
+	rule := e.getUserRule(w, r, userinfo)
+	if rule == nil {
+		return
+	}
+
+	js, _ := json.Marshal(e.GetLog(rule.ID))
+	utils.SendJSONResponse(w, string(js))
+}
+
+// Get or set the location and polling interval, admin only
+func (e *Engine) HandleConfig(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		config := e.GetConfig()
+		result := map[string]interface{}{
+			"config": config,
+		}
+		sunrise, sunset, ok := SunTimes(time.Now(), config.Latitude, config.Longitude)
+		if ok && (config.Latitude != 0 || config.Longitude != 0) {
+			result["sunrise"] = sunrise.Unix()
+			result["sunset"] = sunset.Unix()
+		}
+		js, _ := json.Marshal(result)
+		utils.SendJSONResponse(w, string(js))
+		return
+	}
+
+	config := e.GetConfig()
+	for key, target := range map[string]*float64{"latitude": &config.Latitude, "longitude": &config.Longitude} {
+		value, err := utils.PostPara(r, key)
+		if err != nil {
+			continue
+		}
+		number, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			utils.SendErrorResponse(w, "Invalid "+key)
+			return
+		}
+		*target = number
+	}
+	if interval, err := utils.PostInt(r, "pollInterval"); err == nil {
+		config.PollInterval = int64(interval)
+	}
+
+	err := e.SetConfig(config)
+	if err != nil {
+		utils.SendErrorResponse(w, err.Error())
+		return
+	}
+	utils.SendOK(w)
+}
+
+// Query the status history of a device field for charts
+func (e *Engine) HandleHistory(w http.ResponseWriter, r *http.Request) {
+	userinfo, err := e.options.UserHandler.GetUserInfoFromRequest(w, r)
+	if err != nil {
+		utils.SendErrorResponse(w, "User not logged in")
+		return
+	}
+	devid, err := utils.GetPara(r, "devid")
+	if err != nil {
+		utils.SendErrorResponse(w, "Invalid device id")
+		return
+	}
+	if err := e.checkDeviceAccess(userinfo.Username, devid); err != nil {
+		utils.SendErrorResponse(w, err.Error())
+		return
+	}
+	field, err := utils.GetPara(r, "field")
+	if err != nil {
+		utils.SendErrorResponse(w, "Invalid field")
+		return
+	}
+
+	//Default to last 24 hours
+	now := time.Now()
+	to := now.Unix()
+	from := to - 86400
+	if value, err := utils.GetPara(r, "from"); err == nil {
+		from, err = strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			utils.SendErrorResponse(w, "Invalid from time")
+			return
+		}
+	}
+	if value, err := utils.GetPara(r, "to"); err == nil {
+		to, err = strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			utils.SendErrorResponse(w, "Invalid to time")
+			return
+		}
+	}
+	resolution, _ := utils.GetPara(r, "resolution")
+
+	points, resolution, err := e.history.Query(devid, field, from, to, resolution, now)
+	if err != nil {
+		utils.SendErrorResponse(w, err.Error())
+		return
+	}
+	js, _ := json.Marshal(map[string]interface{}{
+		"resolution": resolution,
+		"points":     points,
+	})
+	utils.SendJSONResponse(w, string(js))
+}
+
+// Fire a rule with webhook trigger. This does not require login, the rule is identified by its id and token
+func (e *Engine) HandleWebhook(w http.ResponseWriter, r *http.Request) {
+	id, _ := utils.GetPara(r, "id")
+	token, _ := utils.GetPara(r, "token")
+	payload := ""
+	if r.Method == http.MethodPost && r.Body != nil {
+		body, err := io.ReadAll(io.LimitReader(r.Body, 64*1024))
+		if err == nil {
+			payload = string(body)
+		}
+	}
+
+	err := e.FireWebhook(id, token, payload)
+	if err != nil {
+		utils.SendErrorResponse(w, err.Error())
+		return
+	}
+	utils.SendOK(w)
+}
@@ -0,0 +1,220 @@
+package automation
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"imuslab.com/arozos/mod/database"
+)
+
+/*
+	Device Status History
+
+	Numeric and boolean status fields are recorded into time buckets of
+	different resolutions. Each bucket keeps the average, min and max of
+	the samples in it, finer resolutions are kept for a shorter period.
+
+	Buckets are stored with the key {resolution}/{bucket time}/{series}, so
+	the expired buckets of a resolution are always at the start of its range.
+*/
+
+const historyTable = "iot_history"
+
+type resolution struct {
+	Name      string
+	Interval  int64 //Bucket size in seconds
+	Retention int64 //How long the buckets are kept in seconds
+}
+
+var resolutions = []resolution{
+	{Name: "1m", Interval: 60, Retention: 86400},
+	{Name: "15m", Interval: 900, Retention: 7 * 86400},
+	{Name: "1h", Interval: 3600, Retention: 90 * 86400},
+	{Name: "1d", Interval: 86400, Retention: 730 * 86400},
+}
+
+// Max number of points returned by a query
+const maxHistoryPoints = 1500
+
+type HistoryPoint struct {
+	Time  int64   `json:"t"` //Bucket start time in unix timestamp
+	Avg   float64 `json:"avg"`
+	Min   float64 `json:"min"`
+	Max   float64 `json:"max"`
+	Count int     `json:"count"`
+}
+
+type History struct {
+	db          *database.Database
+	openBuckets map[string]*HistoryPoint //Series key + resolution -> current bucket
+	mutex       sync.Mutex
+}
+
+func newHistory(sysdb *database.Database) *History {
+	if !sysdb.TableExists(historyTable) {
+		sysdb.NewTable(historyTable)
+	}
+	return &History{
+		db:          sysdb,
+		openBuckets: map[string]*HistoryPoint{},
+	}
+}
+
+func seriesKey(devid string, field string) string {
+	return url.PathEscape(devid) + "/" + url.PathEscape(field)
+}
+
+func bucketKey(res resolution, series string, bucket int64) string {
+	//Zero padded so the keys sort by time
+	return res.Name + "/" + fmt.Sprintf("%012d", bucket) + "/" + series
+}
+
+// Convert the status value into a number, return false if it cannot be recorded
+func numericValue(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return v, !math.IsNaN(v) && !math.IsInf(v, 0)
+	case float32:
+		return float64(v), true
+	case int:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case bool:
+		if v {
+			return 1, true
+		}
+		return 0, true
+	case string:
+		number, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		return number, err == nil
+	}
+	return 0, false
+}
+
+// Record a sample of the device status field
+func (h *History) Record(devid string, field string, value float64, now time.Time) error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	series := seriesKey(devid, field)
+	updates := map[string]interface{}{}
+	for _, res := range resolutions {
+		bucket := now.Unix() - now.Unix()%res.Interval
+		cacheKey := res.Name + "/" + series
+		point, ok := h.openBuckets[cacheKey]
+		if !ok || point.Time != bucket {
+			//Continue the bucket in database if it was written before restart
+			point = &HistoryPoint{Time: bucket}
+			key := bucketKey(res, series, bucket)
+			if h.db.KeyExists(historyTable, key) {
+				h.db.Read(historyTable, key, point)
+			}
+			h.openBuckets[cacheKey] = point
+		}
+
+		if point.Count == 0 {
+			point.Min = value
+			point.Max = value
+		}
+		point.Avg = (point.Avg*float64(point.Count) + value) / float64(point.Count+1)
+		point.Min = math.Min(point.Min, value)
+		point.Max = math.Max(point.Max, value)
+		point.Count++
+		updates[bucketKey(res, series, bucket)] = point
+	}
+	return h.db.WriteBatch(historyTable, updates)
+}
+
+// Pick the finest resolution that covers the time range within the point limit
+func pickResolution(from int64, to int64, now int64) resolution {
+	for _, res := range resolutions {
+		if from >= now-res.Retention && (to-from)/res.Interval <= maxHistoryPoints {
+			return res
+		}
+	}
+	return resolutions[len(resolutions)-1]
+}
+
+// Query the history of a device status field. Leave resolutionName empty to pick automatically
+func (h *History) Query(devid string, field string, from int64, to int64, resolutionName string, now time.Time) ([]*HistoryPoint, string, error) {
+	if to <= from {
+		return nil, "", errors.New("invalid time range")
+	}
+
+	var res resolution
+	if resolutionName == "" {
+		res = pickResolution(from, to, now.Unix())
+	} else {
+		found := false
+		for _, r := range resolutions {
+			if r.Name == resolutionName {
+				res = r
+				found = true
+			}
+		}
+		if !found {
+			return nil, "", errors.New("invalid resolution")
+		}
+		if (to-from)/res.Interval > maxHistoryPoints {
+			return nil, "", errors.New("too many points for this resolution, select a shorter time range")
+		}
+	}
+
+	series := seriesKey(devid, field)
+	results := []*HistoryPoint{}
+	for bucket := from - from%res.Interval; bucket <= to; bucket += res.Interval {
+		key := bucketKey(res, series, bucket)
+		if !h.db.KeyExists(historyTable, key) {
+			continue
+		}
+		point := HistoryPoint{}
+		if err := h.db.Read(historyTable, key, &point); err != nil {
+			continue
+		}
+		results = append(results, &point)
+	}
+	return results, res.Name, nil
+}
+
+// Remove the buckets that exceed the retention period of their resolution
+func (h *History) Prune(now time.Time) int {
+	removed := 0
+	for _, res := range resolutions {
+		//Keys are sorted by bucket time, stop at the first bucket within retention
+		prefix := res.Name + "/"
+		cutoff := bucketKey(res, "", now.Unix()-res.Retention)
+		expired := []string{}
+		err := h.db.ScanPrefix(historyTable, prefix, false, func(key []byte, value []byte) bool {
+			if string(key) >= cutoff {
+				return false
+			}
+			expired = append(expired, string(key))
+			return true
+		})
+		if err != nil || len(expired) == 0 {
+			continue
+		}
+		if h.db.DeleteBatch(historyTable, expired) == nil {
+			removed += len(expired)
+		}
+	}
+
+	//Drop the cached buckets that are already closed
+	h.mutex.Lock()
+	for cacheKey, point := range h.openBuckets {
+		for _, res := range resolutions {
+			if strings.HasPrefix(cacheKey, res.Name+"/") && point.Time+res.Interval < now.Unix() {
+				delete(h.openBuckets, cacheKey)
+			}
+		}
+	}
+	h.mutex.Unlock()
+	return removed
+}
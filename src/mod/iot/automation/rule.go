@@ -0,0 +1,311 @@
+package automation
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+	Automation Rules
+
+	A rule fires when any of its triggers is met and all of its
+	conditions are true, then its actions are executed in order
+	with the permission of the rule owner.
+*/
+
+const (
+	TriggerStatus    = "status"    //Status field of a device changed
+	TriggerThreshold = "threshold" //Status field of a device crossed a threshold
+	TriggerSchedule  = "schedule"  //Given time of day
+	TriggerSun       = "sun"       //Sunrise or sunset at the configured location
+	TriggerWebhook   = "webhook"   //HTTP request to the rule webhook
+
+	ConditionStatus  = "status"  //Compare the current status field of a device
+	ConditionTime    = "time"    //Time of day is between After and Before
+	ConditionWeekday = "weekday" //Day of week is one of the Weekdays
+
+	ActionExecute = "execute" //Execute a device endpoint
+	ActionNotify  = "notify"  //Send notification to the rule owner
+	ActionScript  = "script"  //Run an AGI script as the rule owner
+)
+
+var operators = []string{"==", "!=", ">", ">=", "<", "<="}
+
+type Trigger struct {
+	Type string
+
+	//Status and threshold triggers
+	Device   string //Device UUID
+	Field    string //Status field name
+	Operator string //Comparison operator, {==, !=, >, >=, <, <=}
+	Value    string //Value to compare with. For status trigger, leave empty to fire on any change
+
+	//Schedule trigger
+	Time     string //Time of day in HH:MM
+	Weekdays []int  //0 = Sunday. Empty for every day
+
+	//Sun trigger
+	Event  string //sunrise or sunset
+	Offset int    //Offset in minutes, negative for before the event
+}
+
+type Condition struct {
+	Type string
+
+	//Status condition
+	Device   string
+	Field    string
+	Operator string
+	Value    string
+
+	//Time condition, HH:MM or sunrise / sunset. Wraps around midnight if After is later than Before
+	After  string
+	Before string
+
+	//Weekday condition
+	Weekdays []int
+}
+
+type Action struct {
+	Type string
+
+	//Execute action
+	Device   string
+	Endpoint string //Endpoint name
+	Payload  string
+
+	//Notify action, {{rule}}, {{device}}, {{field}} and {{value}} are replaced with the trigger context
+	Title   string
+	Message string
+
+	//Script action, virtual path of the AGI script
+	Script string
+}
+
+type Rule struct {
+	ID           string
+	Name         string
+	Owner        string //Username of the creator. Actions are executed with this user permission
+	Enabled      bool
+	Triggers     []*Trigger
+	Conditions   []*Condition
+	Actions      []*Action
+	Cooldown     int64  //Min seconds between two executions
+	WebhookToken string //Secret of the webhook trigger
+	CreatedTime  int64
+	LastFired    int64
+}
+
+// The event that fired the rule
+type TriggerContext struct {
+	Type    string
+	Device  string
+	Field   string
+	Value   interface{}
+	Payload string //Request body of the webhook
+}
+
+// Check if the rule is valid to be saved
+func (r *Rule) Validate() error {
+	if strings.TrimSpace(r.Name) == "" {
+		return errors.New("rule name is empty")
+	}
+	if len(r.Triggers) == 0 {
+		return errors.New("rule must have at least one trigger")
+	}
+	if len(r.Actions) == 0 {
+		return errors.New("rule must have at least one action")
+	}
+	if r.Cooldown < 0 {
+		return errors.New("invalid cooldown")
+	}
+
+	for _, t := range r.Triggers {
+		switch t.Type {
+		case TriggerStatus:
+			if t.Device == "" || t.Field == "" {
+				return errors.New("status trigger requires device and field")
+			}
+			if t.Value != "" && !inSlice(operators, t.Operator) {
+				return errors.New("invalid operator: " + t.Operator)
+			}
+		case TriggerThreshold:
+			if t.Device == "" || t.Field == "" || !inSlice(operators, t.Operator) {
+				return errors.New("threshold trigger requires device, field and operator")
+			}
+		case TriggerSchedule:
+			if _, err := parseClock(t.Time); err != nil {
+				return err
+			}
+			if err := validateWeekdays(t.Weekdays); err != nil {
+				return err
+			}
+		case TriggerSun:
+			if t.Event != "sunrise" && t.Event != "sunset" {
+				return errors.New("sun trigger event must be sunrise or sunset")
+			}
+			if t.Offset < -720 || t.Offset > 720 {
+				return errors.New("sun trigger offset out of range")
+			}
+		case TriggerWebhook:
+		default:
+			return errors.New("invalid trigger type: " + t.Type)
+		}
+	}
+
+	for _, c := range r.Conditions {
+		switch c.Type {
+		case ConditionStatus:
+			if c.Device == "" || c.Field == "" || !inSlice(operators, c.Operator) {
+				return errors.New("status condition requires device, field and operator")
+			}
+		case ConditionTime:
+			for _, clock := range []string{c.After, c.Before} {
+				if clock == "sunrise" || clock == "sunset" {
+					continue
+				}
+				if _, err := parseClock(clock); err != nil {
+					return err
+				}
+			}
+		case ConditionWeekday:
+			if len(c.Weekdays) == 0 {
+				return errors.New("weekday condition requires at least one weekday")
+			}
+			if err := validateWeekdays(c.Weekdays); err != nil {
+				return err
+			}
+		default:
+			return errors.New("invalid condition type: " + c.Type)
+		}
+	}
+
+	for _, a := range r.Actions {
+		switch a.Type {
+		case ActionExecute:
+			if a.Device == "" || a.Endpoint == "" {
+				return errors.New("execute action requires device and endpoint")
+			}
+		case ActionNotify:
+			if a.Title == "" && a.Message == "" {
+				return errors.New("notify action requires title or message")
+			}
+		case ActionScript:
+			ext := strings.ToLower(filepath.Ext(a.Script))
+			if ext != ".js" && ext != ".agi" {
+				return errors.New("script action requires an AGI script")
+			}
+		default:
+			return errors.New("invalid action type: " + a.Type)
+		}
+	}
+	return nil
+}
+
+// Check if the rule has a trigger of the given type
+func (r *Rule) HasTrigger(triggerType string) bool {
+	for _, t := range r.Triggers {
+		if t.Type == triggerType {
+			return true
+		}
+	}
+	return false
+}
+
+// Parse HH:MM into minutes of the day
+func parseClock(clock string) (int, error) {
+	hour, minute, ok := strings.Cut(clock, ":")
+	h, err1 := strconv.Atoi(hour)
+	m, err2 := strconv.Atoi(minute)
+	if !ok || err1 != nil || err2 != nil || h < 0 || h > 23 || m < 0 || m > 59 {
+		return 0, errors.New("invalid time: " + clock)
+	}
+	return h*60 + m, nil
+}
+
+func validateWeekdays(weekdays []int) error {
+	for _, day := range weekdays {
+		if day < 0 || day > 6 {
+			return errors.New("invalid weekday: " + strconv.Itoa(day))
+		}
+	}
+	return nil
+}
+
+func matchWeekday(weekdays []int, now time.Time) bool {
+	if len(weekdays) == 0 {
+		return true
+	}
+	for _, day := range weekdays {
+		if time.Weekday(day) == now.Weekday() {
+			return true
+		}
+	}
+	return false
+}
+
+// Compare the status value with the given value. Numbers are compared numerically
+func compareValue(value interface{}, operator string, target string) bool {
+	if value == nil {
+		return false
+	}
+	number, isNumber := numericValue(value)
+	targetNumber, err := strconv.ParseFloat(strings.TrimSpace(target), 64)
+	if isNumber && (err == nil || (operator != "==" && operator != "!=")) {
+		if err != nil {
+			return false
+		}
+		switch operator {
+		case "==":
+			return math.Abs(number-targetNumber) < 1e-9
+		case "!=":
+			return math.Abs(number-targetNumber) >= 1e-9
+		case ">":
+			return number > targetNumber
+		case ">=":
+			return number >= targetNumber
+		case "<":
+			return number < targetNumber
+		case "<=":
+			return number <= targetNumber
+		}
+		return false
+	}
+
+	text := toString(value)
+	switch operator {
+	case "==":
+		return text == target
+	case "!=":
+		return text != target
+	}
+	return false
+}
+
+func toString(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(v)
+	case nil:
+		return ""
+	}
+	return fmt.Sprint(value)
+}
+
+func inSlice(slice []string, val string) bool {
+	for _, item := range slice {
+		if item == val {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,43 @@
+package automation
+
+import (
+	"math"
+	"time"
+)
+
+/*
+	Sunrise and Sunset Calculation
+
+	Implementation of the sunrise equation, accurate to around one minute
+	See https://en.wikipedia.org/wiki/Sunrise_equation
+*/
+
+// Get the sunrise and sunset time of the given date at the given location.
+// Return false if the sun does not rise or set on that day (polar day / night)
+func SunTimes(date time.Time, latitude float64, longitude float64) (time.Time, time.Time, bool) {
+	toRad := math.Pi / 180
+
+	//Julian day at noon of the given date
+	noon := time.Date(date.Year(), date.Month(), date.Day(), 12, 0, 0, 0, time.UTC)
+	julianDay := float64(noon.Unix())/86400 + 2440587.5
+	n := math.Round(julianDay - 2451545.0 + 0.0008)
+
+	meanSolarTime := n - longitude/360
+	meanAnomaly := math.Mod(357.5291+0.98560028*meanSolarTime, 360)
+	center := 1.9148*math.Sin(meanAnomaly*toRad) + 0.02*math.Sin(2*meanAnomaly*toRad) + 0.0003*math.Sin(3*meanAnomaly*toRad)
+	eclipticLongitude := math.Mod(meanAnomaly+center+180+102.9372, 360)
+	transit := 2451545.0 + meanSolarTime + 0.0053*math.Sin(meanAnomaly*toRad) - 0.0069*math.Sin(2*eclipticLongitude*toRad)
+
+	sinDeclination := math.Sin(eclipticLongitude*toRad) * math.Sin(23.4397*toRad)
+	cosDeclination := math.Cos(math.Asin(sinDeclination))
+	cosHourAngle := (math.Sin(-0.833*toRad) - math.Sin(latitude*toRad)*sinDeclination) / (math.Cos(latitude*toRad) * cosDeclination)
+	if cosHourAngle < -1 || cosHourAngle > 1 {
+		return time.Time{}, time.Time{}, false
+	}
+	hourAngle := math.Acos(cosHourAngle) / toRad
+
+	julianToTime := func(jd float64) time.Time {
+		return time.Unix(int64(math.Round((jd-2440587.5)*86400)), 0).In(date.Location())
+	}
+	return julianToTime(transit - hourAngle/360), julianToTime(transit + hourAngle/360), true
+}
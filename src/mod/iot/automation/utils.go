@@ -0,0 +1,23 @@
+package automation
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"strconv"
+)
+
+func decodeJSON(data []byte, assignee interface{}) error {
+	return json.Unmarshal(data, assignee)
+}
+
+func itoa(value int) string {
+	return strconv.Itoa(value)
+}
+
+// Compare the webhook tokens in constant time
+func tokenEqual(expected string, given string) bool {
+	if expected == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(given)) == 1
+}
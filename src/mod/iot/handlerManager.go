@@ -22,6 +22,7 @@ type Manager struct {
 	RegisteredHandler []ProtocolHandler
 	cachedDeviceList  []*Device
 	db                *database.Database
+	statusListener    func(device *Device, event string, data interface{})
 }
 
 func NewIoTManager(sysdb *database.Database) *Manager {
@@ -65,6 +66,46 @@ func (m *Manager) HandleScannerList(w http.ResponseWriter, r *http.Request) {
 	utils.SendJSONResponse(w, string(js))
 }
 
+// Set the listener to be called when a device status is read, a device endpoint is executed
+// or the device list is updated (with nil device)
+func (m *Manager) SetStatusListener(listener func(device *Device, event string, data interface{})) {
+	m.statusListener = listener
+}
+
+func (m *Manager) emitStatus(device *Device, event string, data interface{}) {
+	if m.statusListener != nil {
+		m.statusListener(device, event, data)
+	}
+}
+
+// Notify the status listener about the status pushed by the device itself
+func (m *Manager) UpdateDeviceStatus(device *Device, status map[string]interface{}) {
+	m.emitStatus(device, "status", status)
+}
+
+// Get the status of the given device and notify the status listener
+func (m *Manager) GetDeviceStatus(device *Device) (map[string]interface{}, error) {
+	status, err := device.Handler.Status(device)
+	if err != nil {
+		return nil, err
+	}
+	m.emitStatus(device, "status", status)
+	return status, nil
+}
+
+// Execute an endpoint of the given device and notify the status listener
+func (m *Manager) ExecuteEndpoint(device *Device, endpoint *Endpoint, payload interface{}) (interface{}, error) {
+	result, err := device.Handler.Execute(device, endpoint, payload)
+	if err != nil {
+		return nil, err
+	}
+	m.emitStatus(device, "execute", map[string]interface{}{
+		"endpoint": endpoint.Name,
+		"result":   result,
+	})
+	return result, nil
+}
+
 // Get the device object by id
 func (m *Manager) GetDeviceByID(devid string) *Device {
 	for _, dev := range m.cachedDeviceList {
@@ -132,7 +173,7 @@ func (m *Manager) HandleExecute(w http.ResponseWriter, r *http.Request) {
 	//log.Println(dev.IPAddr, targetEndpoint, payload)
 
 	//Send request to the target IoT device
-	result, err := dev.Handler.Execute(dev, &targetEndpoint, payload)
+	result, err := m.ExecuteEndpoint(dev, &targetEndpoint, payload)
 	if err != nil {
 		utils.SendErrorResponse(w, err.Error())
 		return
@@ -154,7 +195,7 @@ func (m *Manager) HandleGetDeviceStatus(w http.ResponseWriter, r *http.Request)
 	for _, dev := range m.cachedDeviceList {
 		if dev.DeviceUUID == devid {
 			//Found. Get it status and return
-			status, err := dev.Handler.Status(dev)
+			status, err := m.GetDeviceStatus(dev)
 			if err != nil {
 				utils.SendErrorResponse(w, err.Error())
 				return
@@ -217,6 +258,7 @@ func (m *Manager) ScanDevices() []*Device {
 
 	//Cache the scan record
 	m.cachedDeviceList = scannedDevices
+	m.emitStatus(nil, "scan", scannedDevices)
 
 	return scannedDevices
 }
@@ -0,0 +1,330 @@
+package mqtt
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+)
+
+/*
+	Home Assistant MQTT Discovery
+
+	Discovery topic: {prefix}/{component}/[{node_id}/]{object_id}/config
+	The payload may use abbreviated keys (e.g. stat_t for state_topic) and
+	"~" as the base topic, both are expanded before use.
+
+	See https://www.home-assistant.io/integrations/mqtt/#mqtt-discovery
+*/
+
+// Abbreviations used by the devices that are supported by this handler
+var abbreviations = map[string]string{
+	"avty_t":        "availability_topic",
+	"bri_cmd_t":     "brightness_command_topic",
+	"bri_scl":       "brightness_scale",
+	"bri_stat_t":    "brightness_state_topic",
+	"bri_val_tpl":   "brightness_value_template",
+	"cmd_t":         "command_topic",
+	"dev":           "device",
+	"dev_cla":       "device_class",
+	"json_attr_t":   "json_attributes_topic",
+	"max":           "max",
+	"min":           "min",
+	"name":          "name",
+	"obj_id":        "object_id",
+	"ops":           "options",
+	"pl_avail":      "payload_available",
+	"pl_not_avail":  "payload_not_available",
+	"pl_off":        "payload_off",
+	"pl_on":         "payload_on",
+	"pl_prs":        "payload_press",
+	"ptrn":          "pattern",
+	"stat_off":      "state_off",
+	"stat_on":       "state_on",
+	"stat_t":        "state_topic",
+	"step":          "step",
+	"uniq_id":       "unique_id",
+	"unit_of_meas":  "unit_of_measurement",
+	"val_tpl":       "value_template",
+	"cmd_tpl":       "command_template",
+	"schema":        "schema",
+	"stat_val_tpl":  "state_value_template",
+	"avty_tpl":      "availability_template",
+	"frc_upd":       "force_update",
+	"ret":           "retain",
+	"opt":           "optimistic",
+	"e":             "encoding",
+	"ic":            "icon",
+	"qos":           "qos",
+	"exp_aft":       "expire_after",
+	"ent_cat":       "entity_category",
+	"en":            "enabled_by_default",
+	"sug_dsp_prc":   "suggested_display_precision",
+	"stat_cla":      "state_class",
+	"mode":          "mode",
+	"pl_stop":       "payload_stop",
+	"cmd_off_tpl":   "command_off_template",
+	"cmd_on_tpl":    "command_on_template",
+	"on_cmd_type":   "on_command_type",
+	"pct_cmd_t":     "percentage_command_topic",
+	"pct_stat_t":    "percentage_state_topic",
+	"spd_rng_max":   "speed_range_max",
+	"spd_rng_min":   "speed_range_min",
+	"bri_cmd_tpl":   "brightness_command_template",
+	"clrm_stat_t":   "color_mode_state_topic",
+	"json_attr_tpl": "json_attributes_template",
+}
+
+var deviceAbbreviations = map[string]string{
+	"ids":  "identifiers",
+	"mf":   "manufacturer",
+	"mdl":  "model",
+	"sw":   "sw_version",
+	"name": "name",
+	"cns":  "connections",
+	"sa":   "suggested_area",
+	"hw":   "hw_version",
+}
+
+// Components supported by this handler
+var supportedComponents = []string{"switch", "light", "fan", "button", "number", "select", "text", "sensor", "binary_sensor"}
+
+type discoveryDevice struct {
+	Identifiers  []string
+	Name         string
+	Model        string
+	Manufacturer string
+	SWVersion    string
+}
+
+// An entity (e.g. a relay channel or a sensor reading) announced via discovery
+type entity struct {
+	Key         string //Unique ID of the entity, used as endpoint RelPath
+	Component   string
+	Name        string
+	DeviceID    string
+	Device      discoveryDevice
+	StateTopic  string
+	CommandTop  string
+	ValueTpl    string
+	PayloadOn   string
+	PayloadOff  string
+	StateOn     string
+	StateOff    string
+	PayloadPres string
+	Min         float64
+	Max         float64
+	Step        float64
+	Options     []string
+	Pattern     string
+	Unit        string
+
+	BrightnessCmdTopic   string
+	BrightnessStateTopic string
+	BrightnessValueTpl   string
+	BrightnessScale      float64
+
+	AvailabilityTopic   string
+	PayloadAvailable    string
+	PayloadNotAvailable string
+}
+
+// Parse the discovery topic, return the component and object key (node_id/object_id)
+func parseDiscoveryTopic(prefix string, topic string) (string, string, bool) {
+	chunks := strings.Split(strings.TrimPrefix(topic, prefix+"/"), "/")
+	if !strings.HasPrefix(topic, prefix+"/") || len(chunks) < 3 || len(chunks) > 4 || chunks[len(chunks)-1] != "config" {
+		return "", "", false
+	}
+	if !inSlice(supportedComponents, chunks[0]) {
+		return "", "", false
+	}
+	return chunks[0], strings.Join(chunks[1:len(chunks)-1], "/"), true
+}
+
+// Parse the discovery payload into an entity. Return nil if the entity is not usable
+func parseDiscoveryPayload(component string, objectKey string, payload []byte) *entity {
+	raw := map[string]interface{}{}
+	if err := json.Unmarshal(payload, &raw); err != nil {
+		return nil
+	}
+	config := expandKeys(raw, abbreviations)
+
+	//Expand the base topic
+	if base, ok := config["~"].(string); ok {
+		for key, value := range config {
+			if topic, ok := value.(string); ok && strings.HasSuffix(key, "_topic") {
+				if strings.HasPrefix(topic, "~") {
+					config[key] = base + strings.TrimPrefix(topic, "~")
+				} else if strings.HasSuffix(topic, "~") {
+					config[key] = strings.TrimSuffix(topic, "~") + base
+				}
+			}
+		}
+	}
+
+	e := entity{
+		Key:         getString(config, "unique_id", component+"/"+objectKey),
+		Component:   component,
+		Name:        getString(config, "name", objectKey),
+		StateTopic:  getString(config, "state_topic", ""),
+		CommandTop:  getString(config, "command_topic", ""),
+		ValueTpl:    getString(config, "value_template", ""),
+		PayloadOn:   getString(config, "payload_on", "ON"),
+		PayloadOff:  getString(config, "payload_off", "OFF"),
+		PayloadPres: getString(config, "payload_press", "PRESS"),
+		Min:         getFloat(config, "min", 1),
+		Max:         getFloat(config, "max", 100),
+		Step:        getFloat(config, "step", 1),
+		Pattern:     getString(config, "pattern", ""),
+		Unit:        getString(config, "unit_of_measurement", ""),
+
+		BrightnessCmdTopic:   getString(config, "brightness_command_topic", ""),
+		BrightnessStateTopic: getString(config, "brightness_state_topic", ""),
+		BrightnessValueTpl:   getString(config, "brightness_value_template", ""),
+		BrightnessScale:      getFloat(config, "brightness_scale", 255),
+
+		AvailabilityTopic:   getString(config, "availability_topic", ""),
+		PayloadAvailable:    getString(config, "payload_available", "online"),
+		PayloadNotAvailable: getString(config, "payload_not_available", "offline"),
+	}
+	e.StateOn = getString(config, "state_on", e.PayloadOn)
+	e.StateOff = getString(config, "state_off", e.PayloadOff)
+	if component == "binary_sensor" {
+		e.Min, e.Max, e.Step = 0, 0, 0
+	}
+	if options, ok := config["options"].([]interface{}); ok {
+		for _, option := range options {
+			e.Options = append(e.Options, toString(option))
+		}
+	}
+
+	//Group the entity by the device it belongs to
+	if deviceConfig, ok := config["device"].(map[string]interface{}); ok {
+		deviceConfig = expandKeys(deviceConfig, deviceAbbreviations)
+		switch identifiers := deviceConfig["identifiers"].(type) {
+		case string:
+			e.Device.Identifiers = []string{identifiers}
+		case []interface{}:
+			for _, id := range identifiers {
+				e.Device.Identifiers = append(e.Device.Identifiers, toString(id))
+			}
+		}
+		e.Device.Name = getString(deviceConfig, "name", "")
+		e.Device.Model = getString(deviceConfig, "model", "")
+		e.Device.Manufacturer = getString(deviceConfig, "manufacturer", "")
+		e.Device.SWVersion = getString(deviceConfig, "sw_version", "")
+	}
+	if len(e.Device.Identifiers) > 0 {
+		e.DeviceID = e.Device.Identifiers[0]
+	} else {
+		//Standalone entity, treat it as its own device
+		e.DeviceID = e.Key
+		e.Device.Name = e.Name
+	}
+	if e.Device.Name == "" {
+		e.Device.Name = e.DeviceID
+	}
+
+	//Entities without state or command topic are useless here
+	if e.StateTopic == "" && e.CommandTop == "" {
+		return nil
+	}
+	return &e
+}
+
+// Extract the value from the state payload with the value template.
+// Only {{ value }} and {{ value_json.a.b }} templates are supported
+func renderValueTemplate(template string, payload []byte) interface{} {
+	expression := strings.TrimSpace(template)
+	expression = strings.TrimSpace(strings.TrimSuffix(strings.TrimPrefix(expression, "{{"), "}}"))
+	//Drop filters, e.g. value_json.temperature | float
+	expression = strings.TrimSpace(strings.Split(expression, "|")[0])
+
+	if expression == "" || expression == "value" {
+		return parseValue(string(payload))
+	}
+	if !strings.HasPrefix(expression, "value_json") {
+		return parseValue(string(payload))
+	}
+
+	var current interface{}
+	if err := json.Unmarshal(payload, &current); err != nil {
+		return parseValue(string(payload))
+	}
+	path := strings.TrimPrefix(expression, "value_json")
+	path = strings.NewReplacer("['", ".", "']", "", "[\"", ".", "\"]", "").Replace(path)
+	for _, key := range strings.Split(strings.Trim(path, "."), ".") {
+		if key == "" {
+			continue
+		}
+		object, ok := current.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		current = object[key]
+	}
+	return current
+}
+
+// Convert the raw payload into number if possible
+func parseValue(payload string) interface{} {
+	payload = strings.TrimSpace(payload)
+	if number, err := strconv.ParseFloat(payload, 64); err == nil {
+		return number
+	}
+	return payload
+}
+
+func expandKeys(config map[string]interface{}, abbreviationMap map[string]string) map[string]interface{} {
+	results := map[string]interface{}{}
+	for key, value := range config {
+		if fullKey, ok := abbreviationMap[key]; ok {
+			key = fullKey
+		}
+		results[key] = value
+	}
+	return results
+}
+
+func getString(config map[string]interface{}, key string, defaultValue string) string {
+	value, ok := config[key]
+	if !ok || value == nil {
+		return defaultValue
+	}
+	return toString(value)
+}
+
+func getFloat(config map[string]interface{}, key string, defaultValue float64) float64 {
+	switch value := config[key].(type) {
+	case float64:
+		return value
+	case string:
+		if number, err := strconv.ParseFloat(value, 64); err == nil {
+			return number
+		}
+	}
+	return defaultValue
+}
+
+func toString(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(v)
+	case nil:
+		return ""
+	}
+	js, _ := json.Marshal(value)
+	return string(js)
+}
+
+func inSlice(slice []string, val string) bool {
+	for _, item := range slice {
+		if item == val {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,48 @@
+package mqtt
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"imuslab.com/arozos/mod/utils"
+)
+
+// Handle get and set of the broker config
+func (h *Handler) HandleConfig(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		config := h.GetConfig()
+		passwordSet := config.Password != ""
+		config.Password = ""
+		js, _ := json.Marshal(map[string]interface{}{
+			"config":      config,
+			"passwordSet": passwordSet,
+			"connected":   h.IsConnected(),
+		})
+		utils.SendJSONResponse(w, string(js))
+		return
+	}
+
+	configJSON, err := utils.PostPara(r, "config")
+	if err != nil {
+		utils.SendErrorResponse(w, "config not given")
+		return
+	}
+	newConfig := Config{}
+	err = json.Unmarshal([]byte(configJSON), &newConfig)
+	if err != nil {
+		utils.SendErrorResponse(w, "Invalid config")
+		return
+	}
+
+	//Keep the old password if it is not changed
+	if newConfig.Password == "" {
+		newConfig.Password = h.GetConfig().Password
+	}
+
+	err = h.SetConfig(newConfig)
+	if err != nil {
+		utils.SendErrorResponse(w, err.Error())
+		return
+	}
+	utils.SendOK(w)
+}
@@ -0,0 +1,734 @@
+package mqtt
+
+import (
+	"errors"
+	"log"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+	"imuslab.com/arozos/mod/database"
+	"imuslab.com/arozos/mod/iot"
+)
+
+/*
+	MQTT Protocol Handler
+
+	This is a module that handles devices connected to an MQTT broker
+	which announce themselves with Home Assistant style discovery
+	messages (e.g. Tasmota, ESPHome, Zigbee2MQTT and Shelly)
+
+	Device status are kept up to date with subscriptions to the
+	state topics and commands are published to the command topics
+*/
+
+const (
+	devicePrefix     = "mqtt:"
+	brightnessSuffix = "/brightness"
+)
+
+type Config struct {
+	Enabled         bool   //Connect to the broker on startup
+	Broker          string //Broker address, e.g. tcp://192.168.0.10:1883
+	Username        string
+	Password        string
+	ClientID        string //Client ID, default to arozos-{unix time}
+	DiscoveryPrefix string //Discovery prefix, default to homeassistant
+}
+
+// Subscriber of a state topic
+type subscriber struct {
+	Key  string //Entity key
+	Kind string //Kind of the subscription, {state, brightness, availability}
+}
+
+type Handler struct {
+	db     *database.Database
+	config Config
+	client paho.Client
+
+	entities     map[string]*entity      //Discovered entities, key by entity unique id
+	configTopics map[string]string       //Discovery config topic to entity key
+	subscribers  map[string][]subscriber //State topic to the entities listening on it
+	states       map[string]interface{}  //Last known value of each entity
+	available    map[string]bool         //Availability of each entity that has an availability topic
+	onStatus     func(device *iot.Device, status map[string]interface{})
+	mutex        sync.RWMutex
+}
+
+// Create a new MQTT Protocol Handler
+func NewProtocolHandler(sysdb *database.Database) *Handler {
+	if !sysdb.TableExists("iot") {
+		sysdb.NewTable("iot")
+	}
+
+	config := Config{DiscoveryPrefix: "homeassistant"}
+	if sysdb.KeyExists("iot", "mqtt/config") {
+		sysdb.Read("iot", "mqtt/config", &config)
+	}
+
+	return &Handler{
+		db:           sysdb,
+		config:       config,
+		entities:     map[string]*entity{},
+		configTopics: map[string]string{},
+		subscribers:  map[string][]subscriber{},
+		states:       map[string]interface{}{},
+		available:    map[string]bool{},
+	}
+}
+
+// Set the listener to be called when a device pushes a new status
+func (h *Handler) SetStatusListener(listener func(device *iot.Device, status map[string]interface{})) {
+	h.onStatus = listener
+}
+
+func (h *Handler) Start() error {
+	log.Println("[IoT] MQTT scanner loaded")
+	if h.config.Enabled {
+		return h.connect()
+	}
+	return nil
+}
+
+// Get a copy of the current config
+func (h *Handler) GetConfig() Config {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	return h.config
+}
+
+// Update the config and reconnect to the broker
+func (h *Handler) SetConfig(config Config) error {
+	if config.DiscoveryPrefix == "" {
+		config.DiscoveryPrefix = "homeassistant"
+	}
+	if config.Enabled && config.Broker == "" {
+		return errors.New("broker address is empty")
+	}
+
+	h.disconnect()
+	h.mutex.Lock()
+	h.config = config
+	h.mutex.Unlock()
+
+	err := h.db.Write("iot", "mqtt/config", config)
+	if err != nil {
+		return err
+	}
+
+	if config.Enabled {
+		return h.connect()
+	}
+	return nil
+}
+
+// Check if the handler is connected to the broker
+func (h *Handler) IsConnected() bool {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	return h.client != nil && h.client.IsConnected()
+}
+
+// Connect to the broker. This does not block, connection retry is handled by the client
+func (h *Handler) connect() error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	clientID := h.config.ClientID
+	if clientID == "" {
+		clientID = "arozos-" + strconv.FormatInt(time.Now().UnixNano(), 36)
+	}
+
+	opts := paho.NewClientOptions()
+	opts.AddBroker(h.config.Broker)
+	opts.SetClientID(clientID)
+	opts.SetUsername(h.config.Username)
+	opts.SetPassword(h.config.Password)
+	opts.SetAutoReconnect(true)
+	opts.SetConnectRetry(true)
+	opts.SetConnectRetryInterval(10 * time.Second)
+	opts.SetDefaultPublishHandler(h.handleMessage)
+	opts.SetOnConnectHandler(h.handleConnect)
+	opts.SetConnectionLostHandler(func(c paho.Client, err error) {
+		log.Println("[IoT] MQTT connection lost: " + err.Error())
+	})
+
+	h.client = paho.NewClient(opts)
+	token := h.client.Connect()
+	go func() {
+		token.Wait()
+		if token.Error() != nil {
+			log.Println("[IoT] MQTT connection failed: " + token.Error().Error())
+		}
+	}()
+	return nil
+}
+
+func (h *Handler) disconnect() {
+	h.mutex.Lock()
+	client := h.client
+	h.client = nil
+
+	//Forget everything learnt from the previous broker
+	h.entities = map[string]*entity{}
+	h.configTopics = map[string]string{}
+	h.subscribers = map[string][]subscriber{}
+	h.states = map[string]interface{}{}
+	h.available = map[string]bool{}
+	h.mutex.Unlock()
+
+	if client != nil {
+		client.Disconnect(250)
+	}
+}
+
+// Subscribe to the discovery topics. Retained discovery messages are
+// resent by the broker on every connect, which restores the state subscriptions
+func (h *Handler) handleConnect(c paho.Client) {
+	h.mutex.RLock()
+	prefix := h.config.DiscoveryPrefix
+	h.mutex.RUnlock()
+
+	log.Println("[IoT] MQTT connected to broker")
+	c.SubscribeMultiple(map[string]byte{
+		prefix + "/+/+/config":   0,
+		prefix + "/+/+/+/config": 0,
+	}, nil)
+}
+
+func (h *Handler) handleMessage(c paho.Client, msg paho.Message) {
+	h.mutex.RLock()
+	prefix := h.config.DiscoveryPrefix
+	h.mutex.RUnlock()
+
+	if component, objectKey, ok := parseDiscoveryTopic(prefix, msg.Topic()); ok {
+		h.handleDiscovery(c, msg.Topic(), component, objectKey, msg.Payload())
+		return
+	}
+	h.handleState(msg.Topic(), msg.Payload())
+}
+
+// Add, update or remove (with empty payload) an entity
+func (h *Handler) handleDiscovery(c paho.Client, topic string, component string, objectKey string, payload []byte) {
+	h.mutex.Lock()
+	unusedTopics := []string{}
+	if oldKey, ok := h.configTopics[topic]; ok {
+		unusedTopics = append(unusedTopics, h.removeEntity(oldKey)...)
+		delete(h.configTopics, topic)
+	}
+
+	e := parseDiscoveryPayload(component, objectKey, payload)
+	if e == nil {
+		h.mutex.Unlock()
+		if len(payload) > 0 {
+			log.Println("[IoT] MQTT unsupported discovery message on " + topic)
+		}
+		h.unsubscribe(c, unusedTopics)
+		return
+	}
+	if _, ok := h.entities[e.Key]; ok {
+		unusedTopics = append(unusedTopics, h.removeEntity(e.Key)...)
+	}
+	h.entities[e.Key] = e
+	h.configTopics[topic] = e.Key
+
+	newTopics := []string{}
+	addSubscriber := func(topic string, kind string) {
+		if topic == "" {
+			return
+		}
+		if len(h.subscribers[topic]) == 0 {
+			newTopics = append(newTopics, topic)
+		}
+		h.subscribers[topic] = append(h.subscribers[topic], subscriber{Key: e.Key, Kind: kind})
+	}
+	addSubscriber(e.StateTopic, "state")
+	addSubscriber(e.BrightnessStateTopic, "brightness")
+	addSubscriber(e.AvailabilityTopic, "availability")
+	h.mutex.Unlock()
+
+	for _, topic := range newTopics {
+		c.Subscribe(topic, 0, nil)
+	}
+	h.unsubscribe(c, unusedTopics)
+}
+
+// Unsubscribe the topics that no entity is listening on anymore
+func (h *Handler) unsubscribe(c paho.Client, topics []string) {
+	h.mutex.RLock()
+	unused := []string{}
+	for _, topic := range topics {
+		if len(h.subscribers[topic]) == 0 && !inSlice(unused, topic) {
+			unused = append(unused, topic)
+		}
+	}
+	h.mutex.RUnlock()
+
+	if len(unused) > 0 {
+		c.Unsubscribe(unused...)
+	}
+}
+
+// Remove an entity and return the topics it was subscribed to. Caller must hold the lock
+func (h *Handler) removeEntity(key string) []string {
+	topics := []string{}
+	delete(h.entities, key)
+	delete(h.states, key)
+	delete(h.states, key+brightnessSuffix)
+	delete(h.available, key)
+	for topic, subs := range h.subscribers {
+		remaining := []subscriber{}
+		for _, sub := range subs {
+			if sub.Key != key {
+				remaining = append(remaining, sub)
+			}
+		}
+		if len(remaining) < len(subs) {
+			topics = append(topics, topic)
+		}
+		if len(remaining) == 0 {
+			delete(h.subscribers, topic)
+		} else {
+			h.subscribers[topic] = remaining
+		}
+	}
+	return topics
+}
+
+// Update the entity values from the state topic
+func (h *Handler) handleState(topic string, payload []byte) {
+	h.mutex.Lock()
+	updatedDevices := map[string]bool{}
+	for _, sub := range h.subscribers[topic] {
+		e, ok := h.entities[sub.Key]
+		if !ok {
+			continue
+		}
+		switch sub.Kind {
+		case "state":
+			value := e.parseState(payload)
+			if value == nil {
+				continue
+			}
+			h.states[e.Key] = value
+		case "brightness":
+			value := renderValueTemplate(e.BrightnessValueTpl, payload)
+			if value == nil {
+				continue
+			}
+			h.states[e.Key+brightnessSuffix] = value
+		case "availability":
+			state := strings.TrimSpace(string(payload))
+			if state == e.PayloadAvailable {
+				h.available[e.Key] = true
+			} else if state == e.PayloadNotAvailable {
+				h.available[e.Key] = false
+			}
+		}
+		updatedDevices[e.DeviceID] = true
+	}
+
+	devices := []*iot.Device{}
+	for deviceID := range updatedDevices {
+		if device := h.buildDevice(deviceID); device != nil {
+			devices = append(devices, device)
+		}
+	}
+	h.mutex.Unlock()
+
+	if h.onStatus != nil {
+		for _, device := range devices {
+			h.onStatus(device, device.Status)
+		}
+	}
+}
+
+// Parse the state payload of the entity into the value shown in device status
+func (e *entity) parseState(payload []byte) interface{} {
+	template := e.ValueTpl
+	if template == "" && e.Component == "light" && strings.HasPrefix(strings.TrimSpace(string(payload)), "{") {
+		//Lights with JSON schema report {"state":"ON","brightness":255}
+		template = "{{ value_json.state }}"
+	}
+	value := renderValueTemplate(template, payload)
+
+	switch e.Component {
+	case "switch", "light", "fan", "binary_sensor":
+		state := toString(value)
+		if state == e.StateOn {
+			return true
+		} else if state == e.StateOff {
+			return false
+		}
+		return nil
+	case "select", "text":
+		return toString(value)
+	}
+	return value
+}
+
+func (h *Handler) Scan() ([]*iot.Device, error) {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+
+	deviceIDs := []string{}
+	for _, e := range h.entities {
+		if !inSlice(deviceIDs, e.DeviceID) {
+			deviceIDs = append(deviceIDs, e.DeviceID)
+		}
+	}
+	sort.Strings(deviceIDs)
+
+	results := []*iot.Device{}
+	for _, deviceID := range deviceIDs {
+		if device := h.buildDevice(deviceID); device != nil {
+			results = append(results, device)
+		}
+	}
+	return results, nil
+}
+
+// Get the entities of the given device sorted by name. Caller must hold the lock
+func (h *Handler) deviceEntities(deviceID string) []*entity {
+	results := []*entity{}
+	for _, e := range h.entities {
+		if e.DeviceID == deviceID {
+			results = append(results, e)
+		}
+	}
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Name == results[j].Name {
+			return results[i].Key < results[j].Key
+		}
+		return results[i].Name < results[j].Name
+	})
+	return results
+}
+
+// Build the device object from its entities. Caller must hold the lock
+func (h *Handler) buildDevice(deviceID string) *iot.Device {
+	entities := h.deviceEntities(deviceID)
+	if len(entities) == 0 {
+		return nil
+	}
+
+	//Usually only one of the entities carries the full device info
+	info := discoveryDevice{}
+	for _, e := range entities {
+		if info.Name == "" || info.Name == deviceID {
+			info.Name = e.Device.Name
+		}
+		if info.Model == "" {
+			info.Model = e.Device.Model
+		}
+		if info.Manufacturer == "" {
+			info.Manufacturer = e.Device.Manufacturer
+		}
+		if info.SWVersion == "" {
+			info.SWVersion = e.Device.SWVersion
+		}
+	}
+	device := iot.Device{
+		Name:             info.Name,
+		Port:             -1,
+		Model:            info.Model,
+		Version:          info.SWVersion,
+		Manufacturer:     info.Manufacturer,
+		DeviceUUID:       devicePrefix + deviceID,
+		IPAddr:           "",
+		RequireAuth:      false,
+		RequireConnect:   false,
+		Status:           h.deviceStatus(entities),
+		ControlEndpoints: []*iot.Endpoint{},
+		Handler:          h,
+	}
+	for _, e := range entities {
+		device.ControlEndpoints = append(device.ControlEndpoints, e.endpoints()...)
+	}
+	return &device
+}
+
+// Build the status map of a device. Caller must hold the lock
+func (h *Handler) deviceStatus(entities []*entity) map[string]interface{} {
+	status := map[string]interface{}{}
+	hasAvailability := false
+	online := true
+	for _, e := range entities {
+		if value, ok := h.states[e.Key]; ok {
+			status[e.Name] = value
+		}
+		if value, ok := h.states[e.Key+brightnessSuffix]; ok {
+			status[e.Name+" Brightness"] = value
+		}
+		if available, ok := h.available[e.Key]; ok {
+			hasAvailability = true
+			online = online && available
+		}
+	}
+	if hasAvailability {
+		status["Online"] = online
+	}
+	return status
+}
+
+// Map the entity into control endpoints. Read only entities have no endpoints
+func (e *entity) endpoints() []*iot.Endpoint {
+	if e.CommandTop == "" {
+		return []*iot.Endpoint{}
+	}
+
+	switch e.Component {
+	case "switch", "light", "fan":
+		results := []*iot.Endpoint{{
+			RelPath: e.Key,
+			Name:    e.Name,
+			Desc:    "Toggle " + e.Name + " on and off",
+			Type:    "bool",
+		}}
+		if e.Component == "light" && e.BrightnessCmdTopic != "" {
+			results = append(results, &iot.Endpoint{
+				RelPath: e.Key + brightnessSuffix,
+				Name:    e.Name + " Brightness",
+				Desc:    "Set the brightness of " + e.Name,
+				Type:    "integer",
+				Min:     0,
+				Max:     e.BrightnessScale,
+				Steps:   1,
+			})
+		}
+		return results
+	case "button":
+		return []*iot.Endpoint{{
+			RelPath: e.Key,
+			Name:    e.Name,
+			Desc:    "Press " + e.Name,
+			Type:    "none",
+		}}
+	case "number":
+		endpointType := "integer"
+		if e.Step != math.Trunc(e.Step) || e.Min != math.Trunc(e.Min) {
+			endpointType = "float"
+		}
+		desc := "Set the value of " + e.Name
+		if e.Unit != "" {
+			desc += " (" + e.Unit + ")"
+		}
+		return []*iot.Endpoint{{
+			RelPath: e.Key,
+			Name:    e.Name,
+			Desc:    desc,
+			Type:    endpointType,
+			Min:     e.Min,
+			Max:     e.Max,
+			Steps:   e.Step,
+		}}
+	case "select":
+		options := []string{}
+		for _, option := range e.Options {
+			options = append(options, regexp.QuoteMeta(option))
+		}
+		return []*iot.Endpoint{{
+			RelPath: e.Key,
+			Name:    e.Name,
+			Desc:    "Select one of " + strings.Join(e.Options, ", "),
+			Type:    "string",
+			Regex:   "^(" + strings.Join(options, "|") + ")$",
+		}}
+	case "text":
+		return []*iot.Endpoint{{
+			RelPath: e.Key,
+			Name:    e.Name,
+			Desc:    "Set the text of " + e.Name,
+			Type:    "string",
+			Regex:   e.Pattern,
+		}}
+	}
+	return []*iot.Endpoint{}
+}
+
+func (h *Handler) Connect(device *iot.Device, authInfo *iot.AuthInfo) error {
+	return nil
+}
+
+func (h *Handler) Status(device *iot.Device) (map[string]interface{}, error) {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	entities := h.deviceEntities(strings.TrimPrefix(device.DeviceUUID, devicePrefix))
+	if len(entities) == 0 {
+		return nil, errors.New("device not found")
+	}
+	return h.deviceStatus(entities), nil
+}
+
+func (h *Handler) Execute(device *iot.Device, endpoint *iot.Endpoint, payload interface{}) (interface{}, error) {
+	h.mutex.RLock()
+	client := h.client
+	deviceID := strings.TrimPrefix(device.DeviceUUID, devicePrefix)
+	key := endpoint.RelPath
+	brightness := false
+	e, ok := h.entities[key]
+	if !ok && strings.HasSuffix(key, brightnessSuffix) {
+		e, ok = h.entities[strings.TrimSuffix(key, brightnessSuffix)]
+		brightness = true
+	}
+	var current interface{}
+	if ok {
+		current = h.states[e.Key]
+	}
+	h.mutex.RUnlock()
+
+	if !ok || e.DeviceID != deviceID {
+		return nil, errors.New("endpoint not found on this device")
+	}
+	if client == nil || !client.IsConnected() {
+		return nil, errors.New("not connected to MQTT broker")
+	}
+
+	topic := e.CommandTop
+	message := ""
+	if brightness {
+		value, err := parseNumber(payload, 0, e.BrightnessScale)
+		if err != nil {
+			return nil, err
+		}
+		topic = e.BrightnessCmdTopic
+		message = strconv.Itoa(int(math.Round(value)))
+	} else {
+		var err error
+		message, err = e.commandPayload(payload, current)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	token := client.Publish(topic, 0, false, message)
+	if !token.WaitTimeout(5 * time.Second) {
+		return nil, errors.New("publish timeout")
+	}
+	if token.Error() != nil {
+		return nil, token.Error()
+	}
+
+	return map[string]interface{}{
+		"topic":   topic,
+		"payload": message,
+	}, nil
+}
+
+// Convert the execute payload into the command payload of the entity
+func (e *entity) commandPayload(payload interface{}, current interface{}) (string, error) {
+	switch e.Component {
+	case "switch", "light", "fan":
+		var on bool
+		switch value := payload.(type) {
+		case bool:
+			on = value
+		case nil:
+			//Toggle
+			on = current != true
+		default:
+			state := strings.ToLower(toString(value))
+			if state == "" {
+				on = current != true
+			} else if state == "true" || state == "on" || state == "1" || state == strings.ToLower(e.PayloadOn) {
+				on = true
+			} else if state == "false" || state == "off" || state == "0" || state == strings.ToLower(e.PayloadOff) {
+				on = false
+			} else {
+				return "", errors.New("invalid state: " + state)
+			}
+		}
+		if on {
+			return e.PayloadOn, nil
+		}
+		return e.PayloadOff, nil
+	case "button":
+		return e.PayloadPres, nil
+	case "number":
+		value, err := parseNumber(payload, e.Min, e.Max)
+		if err != nil {
+			return "", err
+		}
+		if e.Step > 0 && math.Abs(math.Remainder(value-e.Min, e.Step)) > 1e-9 {
+			return "", errors.New("value is not a multiple of step " + toString(e.Step))
+		}
+		return toString(value), nil
+	case "select":
+		option := toString(payload)
+		if !inSlice(e.Options, option) {
+			return "", errors.New("invalid option: " + option)
+		}
+		return option, nil
+	case "text":
+		text := toString(payload)
+		if e.Pattern != "" {
+			re, err := regexp.Compile(e.Pattern)
+			if err == nil && !re.MatchString(text) {
+				return "", errors.New("text does not match pattern " + e.Pattern)
+			}
+		}
+		return text, nil
+	}
+	return "", errors.New("entity is read only")
+}
+
+func parseNumber(payload interface{}, min float64, max float64) (float64, error) {
+	var value float64
+	switch v := payload.(type) {
+	case float64:
+		value = v
+	case int:
+		value = float64(v)
+	default:
+		number, err := strconv.ParseFloat(strings.TrimSpace(toString(v)), 64)
+		if err != nil {
+			return 0, errors.New("invalid number")
+		}
+		value = number
+	}
+	if value < min || value > max {
+		return 0, errors.New("value out of range " + toString(min) + " - " + toString(max))
+	}
+	return value, nil
+}
+
+func (h *Handler) Disconnect(device *iot.Device) error {
+	return nil
+}
+
+func (h *Handler) Icon(device *iot.Device) string {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+
+	components := []string{}
+	for _, e := range h.deviceEntities(strings.TrimPrefix(device.DeviceUUID, devicePrefix)) {
+		components = append(components, e.Component)
+	}
+	if inSlice(components, "switch") || inSlice(components, "light") || inSlice(components, "fan") {
+		return "switch"
+	} else if inSlice(components, "sensor") || inSlice(components, "binary_sensor") {
+		return "weather"
+	} else if len(components) > 0 {
+		return "panel"
+	}
+	return "unknown"
+}
+
+func (h *Handler) Stats() iot.Stats {
+	return iot.Stats{
+		Name:          "MQTT",
+		Desc:          "Devices using Home Assistant MQTT discovery",
+		Version:       "1.0",
+		ProtocolVer:   "3.1.1",
+		Author:        "tobychui",
+		AuthorWebsite: "http://arozos.com",
+		AuthorEmail:   "imuslab@gmail.com",
+		ReleaseDate:   1760832000,
+	}
+}
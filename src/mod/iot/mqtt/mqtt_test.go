@@ -0,0 +1,374 @@
+package mqtt
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+	"imuslab.com/arozos/mod/database"
+	"imuslab.com/arozos/mod/iot"
+)
+
+// A minimal MQTT 3.1.1 broker with QoS 0/1, retained messages and wildcards
+type testBroker struct {
+	listener net.Listener
+	mutex    sync.Mutex
+	retained map[string][]byte
+	clients  map[net.Conn][]string
+}
+
+func newTestBroker(t *testing.T) *testBroker {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &testBroker{
+		listener: listener,
+		retained: map[string][]byte{},
+		clients:  map[net.Conn][]string{},
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go b.serve(conn)
+		}
+	}()
+	t.Cleanup(func() { listener.Close() })
+	return b
+}
+
+func (b *testBroker) address() string {
+	return "tcp://" + b.listener.Addr().String()
+}
+
+func topicMatch(filter string, topic string) bool {
+	filterChunks := strings.Split(filter, "/")
+	topicChunks := strings.Split(topic, "/")
+	for i, chunk := range filterChunks {
+		if chunk == "#" {
+			return true
+		}
+		if i >= len(topicChunks) || (chunk != "+" && chunk != topicChunks[i]) {
+			return false
+		}
+	}
+	return len(filterChunks) == len(topicChunks)
+}
+
+func encodePacket(header byte, body []byte) []byte {
+	packet := []byte{header}
+	length := len(body)
+	for {
+		digit := byte(length % 128)
+		length /= 128
+		if length > 0 {
+			digit |= 0x80
+		}
+		packet = append(packet, digit)
+		if length == 0 {
+			break
+		}
+	}
+	return append(packet, body...)
+}
+
+func encodePublish(topic string, payload []byte, retain bool) []byte {
+	header := byte(0x30)
+	if retain {
+		header |= 0x01
+	}
+	body := binary.BigEndian.AppendUint16(nil, uint16(len(topic)))
+	body = append(body, topic...)
+	return encodePacket(header, append(body, payload...))
+}
+
+func (b *testBroker) serve(conn net.Conn) {
+	defer func() {
+		b.mutex.Lock()
+		delete(b.clients, conn)
+		b.mutex.Unlock()
+		conn.Close()
+	}()
+
+	reader := bufio.NewReader(conn)
+	write := func(packet []byte) {
+		b.mutex.Lock()
+		conn.Write(packet)
+		b.mutex.Unlock()
+	}
+	for {
+		header, err := reader.ReadByte()
+		if err != nil {
+			return
+		}
+		length, multiplier := 0, 1
+		for {
+			digit, err := reader.ReadByte()
+			if err != nil {
+				return
+			}
+			length += int(digit&0x7F) * multiplier
+			multiplier *= 128
+			if digit&0x80 == 0 {
+				break
+			}
+		}
+		body := make([]byte, length)
+		if _, err := io.ReadFull(reader, body); err != nil {
+			return
+		}
+
+		switch header >> 4 {
+		case 1: //CONNECT
+			write([]byte{0x20, 0x02, 0x00, 0x00})
+		case 3: //PUBLISH
+			qos := (header >> 1) & 0x03
+			topicLength := int(binary.BigEndian.Uint16(body))
+			topic := string(body[2 : 2+topicLength])
+			payload := body[2+topicLength:]
+			if qos > 0 {
+				write([]byte{0x40, 0x02, payload[0], payload[1]})
+				payload = payload[2:]
+			}
+			b.publish(topic, payload, header&0x01 == 1)
+		case 8: //SUBSCRIBE
+			filters := []string{}
+			ack := []byte{body[0], body[1]}
+			for i := 2; i < len(body); {
+				filterLength := int(binary.BigEndian.Uint16(body[i:]))
+				filters = append(filters, string(body[i+2:i+2+filterLength]))
+				i += 3 + filterLength
+				ack = append(ack, 0x00)
+			}
+			write(encodePacket(0x90, ack))
+
+			b.mutex.Lock()
+			b.clients[conn] = append(b.clients[conn], filters...)
+			for topic, payload := range b.retained {
+				for _, filter := range filters {
+					if topicMatch(filter, topic) {
+						conn.Write(encodePublish(topic, payload, true))
+						break
+					}
+				}
+			}
+			b.mutex.Unlock()
+		case 10: //UNSUBSCRIBE
+			b.mutex.Lock()
+			for i := 2; i < len(body); {
+				filterLength := int(binary.BigEndian.Uint16(body[i:]))
+				filter := string(body[i+2 : i+2+filterLength])
+				remaining := []string{}
+				for _, existing := range b.clients[conn] {
+					if existing != filter {
+						remaining = append(remaining, existing)
+					}
+				}
+				b.clients[conn] = remaining
+				i += 2 + filterLength
+			}
+			b.mutex.Unlock()
+			write([]byte{0xB0, 0x02, body[0], body[1]})
+		case 12: //PINGREQ
+			write([]byte{0xD0, 0x00})
+		case 14: //DISCONNECT
+			return
+		}
+	}
+}
+
+func (b *testBroker) publish(topic string, payload []byte, retain bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if retain {
+		if len(payload) == 0 {
+			delete(b.retained, topic)
+		} else {
+			b.retained[topic] = payload
+		}
+	}
+	for conn, filters := range b.clients {
+		for _, filter := range filters {
+			if topicMatch(filter, topic) {
+				conn.Write(encodePublish(topic, payload, false))
+				break
+			}
+		}
+	}
+}
+
+// Wait until the condition is met or fail the test
+func waitFor(t *testing.T, desc string, condition func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if condition() {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatal("timeout waiting for " + desc)
+}
+
+func findEndpoint(device *iot.Device, name string) *iot.Endpoint {
+	for _, endpoint := range device.ControlEndpoints {
+		if endpoint.Name == name {
+			return endpoint
+		}
+	}
+	return nil
+}
+
+func TestDiscoveryStatusAndExecute(t *testing.T) {
+	broker := newTestBroker(t)
+	sysdb, err := database.NewDatabase(filepath.Join(t.TempDir(), "test.db"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sysdb.Close()
+
+	//Announce the device before the handler connects, the broker retains the configs
+	broker.publish("homeassistant/switch/plug01/relay/config", []byte(`{"~":"plug01","name":"Relay","uniq_id":"plug01_relay","stat_t":"~/state","cmd_t":"~/set","avty_t":"~/status","dev":{"ids":["plug01"],"name":"Smart Plug","mf":"Acme","mdl":"P1","sw":"1.2"}}`), true)
+	broker.publish("homeassistant/sensor/plug01/power/config", []byte(`{"name":"Power","uniq_id":"plug01_power","stat_t":"plug01/sensor","val_tpl":"{{ value_json.energy.power }}","unit_of_meas":"W","dev":{"ids":"plug01"}}`), true)
+	broker.publish("homeassistant/number/plug01/limit/config", []byte(`{"name":"Limit","uniq_id":"plug01_limit","cmd_t":"plug01/limit/set","min":0.5,"max":10,"step":0.5,"dev":{"ids":["plug01"]}}`), true)
+	broker.publish("homeassistant/select/plug01/mode/config", []byte(`{"name":"Mode","uniq_id":"plug01_mode","cmd_t":"plug01/mode/set","options":["auto","manual"],"dev":{"ids":["plug01"]}}`), true)
+	broker.publish("homeassistant/light/lamp/config", []byte(`{"name":"Lamp","uniq_id":"lamp","cmd_t":"lamp/set","bri_cmd_t":"lamp/bri/set","bri_scl":100}`), true)
+
+	handler := NewProtocolHandler(sysdb)
+	statusUpdates := make(chan map[string]interface{}, 100)
+	handler.SetStatusListener(func(device *iot.Device, status map[string]interface{}) {
+		statusUpdates <- status
+	})
+	if err := handler.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := handler.SetConfig(Config{Enabled: true, Broker: broker.address(), ClientID: "arozos-test"}); err != nil {
+		t.Fatal(err)
+	}
+	defer handler.disconnect()
+
+	var plug *iot.Device
+	waitFor(t, "discovery", func() bool {
+		devices, _ := handler.Scan()
+		for _, device := range devices {
+			if device.DeviceUUID == "mqtt:plug01" && len(device.ControlEndpoints) == 3 {
+				plug = device
+			}
+		}
+		return len(devices) == 2 && plug != nil
+	})
+	if plug.Name != "Smart Plug" || plug.Manufacturer != "Acme" || plug.Model != "P1" || plug.Version != "1.2" {
+		t.Fatalf("unexpected device info %+v", plug)
+	}
+	if endpoint := findEndpoint(plug, "Relay"); endpoint == nil || endpoint.Type != "bool" {
+		t.Fatal("switch not mapped to bool endpoint")
+	}
+	if endpoint := findEndpoint(plug, "Limit"); endpoint == nil || endpoint.Type != "float" || endpoint.Min != 0.5 || endpoint.Max != 10 || endpoint.Steps != 0.5 {
+		t.Fatalf("number not mapped to float endpoint %+v", endpoint)
+	}
+	if endpoint := findEndpoint(plug, "Mode"); endpoint == nil || endpoint.Type != "string" || endpoint.Regex != "^(auto|manual)$" {
+		t.Fatalf("select not mapped to string endpoint %+v", endpoint)
+	}
+
+	//Device pushes its state
+	broker.publish("plug01/state", []byte("ON"), false)
+	broker.publish("plug01/sensor", []byte(`{"energy":{"power":12.5}}`), false)
+	broker.publish("plug01/status", []byte("online"), true)
+	waitFor(t, "status", func() bool {
+		status, _ := handler.Status(plug)
+		return status["Relay"] == true && status["Power"] == 12.5 && status["Online"] == true
+	})
+	select {
+	case <-statusUpdates:
+	default:
+		t.Fatal("status listener not called")
+	}
+
+	//Commands are published to the command topics
+	commands := make(chan string, 10)
+	device := paho.NewClient(paho.NewClientOptions().AddBroker(broker.address()).SetClientID("device"))
+	if token := device.Connect(); token.Wait() && token.Error() != nil {
+		t.Fatal(token.Error())
+	}
+	defer device.Disconnect(0)
+	device.Subscribe("+/#", 0, func(c paho.Client, msg paho.Message) {
+		if strings.HasSuffix(msg.Topic(), "set") {
+			commands <- msg.Topic() + "=" + string(msg.Payload())
+		}
+	}).Wait()
+
+	expectCommand := func(expected string) {
+		select {
+		case command := <-commands:
+			if command != expected {
+				t.Fatalf("expected command %s, got %s", expected, command)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("command not received: " + expected)
+		}
+	}
+
+	//Empty payload toggles the relay
+	if _, err := handler.Execute(plug, findEndpoint(plug, "Relay"), ""); err != nil {
+		t.Fatal(err)
+	}
+	expectCommand("plug01/set=OFF")
+	if _, err := handler.Execute(plug, findEndpoint(plug, "Limit"), "2.5"); err != nil {
+		t.Fatal(err)
+	}
+	expectCommand("plug01/limit/set=2.5")
+	if _, err := handler.Execute(plug, findEndpoint(plug, "Limit"), 20.0); err == nil {
+		t.Fatal("out of range value accepted")
+	}
+	if _, err := handler.Execute(plug, findEndpoint(plug, "Mode"), "turbo"); err == nil {
+		t.Fatal("invalid option accepted")
+	}
+
+	lamp, _ := handler.Scan()
+	for _, device := range lamp {
+		if device.DeviceUUID == "mqtt:lamp" {
+			endpoint := findEndpoint(device, "Lamp Brightness")
+			if endpoint == nil || endpoint.Type != "integer" || endpoint.Max != 100 {
+				t.Fatalf("brightness not mapped %+v", endpoint)
+			}
+			if _, err := handler.Execute(device, endpoint, 40); err != nil {
+				t.Fatal(err)
+			}
+			expectCommand("lamp/bri/set=40")
+		}
+	}
+
+	//Empty discovery payload removes the entity
+	broker.publish("homeassistant/select/plug01/mode/config", []byte{}, true)
+	waitFor(t, "removal", func() bool {
+		devices, _ := handler.Scan()
+		for _, device := range devices {
+			if device.DeviceUUID == "mqtt:plug01" {
+				return findEndpoint(device, "Mode") == nil
+			}
+		}
+		return false
+	})
+}
+
+func TestParseDiscoveryTopic(t *testing.T) {
+	component, key, ok := parseDiscoveryTopic("homeassistant", "homeassistant/binary_sensor/node/door/config")
+	if !ok || component != "binary_sensor" || key != "node/door" {
+		t.Fatal("discovery topic with node id not parsed")
+	}
+	if _, _, ok := parseDiscoveryTopic("homeassistant", "homeassistant/vacuum/robot/config"); ok {
+		t.Fatal("unsupported component accepted")
+	}
+	if _, _, ok := parseDiscoveryTopic("homeassistant", "other/switch/plug/config"); ok {
+		t.Fatal("topic outside prefix accepted")
+	}
+}
@@ -17,6 +17,7 @@ import (
 	"imuslab.com/arozos/mod/compatibility"
 	"imuslab.com/arozos/mod/filesystem"
 	fs "imuslab.com/arozos/mod/filesystem"
+	"imuslab.com/arozos/mod/filesystem/fileaudit"
 	"imuslab.com/arozos/mod/filesystem/metadata"
 	"imuslab.com/arozos/mod/info/logger"
 	"imuslab.com/arozos/mod/media/transcoder"
@@ -42,6 +43,7 @@ type Options struct {
 	Authagent   *auth.AuthAgent
 	UserHandler *user.UserHandler
 	Logger      *logger.Logger
+	AuditLogger *fileaudit.Logger //Optional, record file downloads to the file audit trail
 }
 
 type Instance struct {
@@ -215,6 +217,9 @@ func (s *Instance) ServerMedia(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 		filename := filepath.Base(escapedRealFilepath)
+		if userinfo != nil {
+			s.options.AuditLogger.NewRecorderFromRequest(r, userinfo.Username, fileaudit.ChannelWeb).Record(fileaudit.ActionDownload, vpath, "")
+		}
 
 		w.Header().Set("Content-Disposition", "attachment; filename=\""+filename+"\"")
 		w.Header().Set("Content-Type", compatibility.BrowserCompatibilityOverrideContentType(r.UserAgent(), filename, r.Header.Get("Content-Type")))
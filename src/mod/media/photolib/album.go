@@ -0,0 +1,163 @@
+package photolib
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"strings"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+	"imuslab.com/arozos/mod/utils"
+)
+
+/*
+	Virtual Albums
+
+	Albums only store references (vpath) to the photos,
+	the files are not moved or copied on disk.
+*/
+
+type Album struct {
+	ID         string   //Album UUID
+	Name       string   //Display name of the album
+	Owner      string   //Owner username
+	Cover      string   //Vpath of the cover photo, use the first photo if empty
+	Photos     []string //Vpath of photos in this album
+	CreateTime int64    //Creation time of this album
+}
+
+// Create a new album for the user
+func (l *Library) CreateAlbum(username string, name string) (*Album, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return nil, errors.New("album name cannot be empty")
+	}
+
+	newAlbum := Album{
+		ID:         uuid.NewV4().String(),
+		Name:       name,
+		Owner:      username,
+		Photos:     []string{},
+		CreateTime: time.Now().Unix(),
+	}
+
+	err := l.writeAlbum(&newAlbum)
+	if err != nil {
+		return nil, err
+	}
+	return &newAlbum, nil
+}
+
+// List all albums owned by the user, sorted by creation time
+func (l *Library) ListAlbums(username string) ([]*Album, error) {
+	results := []*Album{}
+	entries, err := l.options.Database.ListTable(tableName)
+	if err != nil {
+		return results, err
+	}
+
+	prefix := username + "/album/"
+	for _, keypairs := range entries {
+		if !strings.HasPrefix(string(keypairs[0]), prefix) {
+			continue
+		}
+		thisAlbum := Album{}
+		err = json.Unmarshal(keypairs[1], &thisAlbum)
+		if err != nil {
+			continue
+		}
+		results = append(results, &thisAlbum)
+	}
+
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].CreateTime < results[j].CreateTime
+	})
+	return results, nil
+}
+
+// Get an album by its id
+func (l *Library) GetAlbum(username string, albumID string) (*Album, error) {
+	key := username + "/album/" + albumID
+	if !l.options.Database.KeyExists(tableName, key) {
+		return nil, errors.New("album not exists")
+	}
+	thisAlbum := Album{}
+	err := l.options.Database.Read(tableName, key, &thisAlbum)
+	if err != nil {
+		return nil, err
+	}
+	return &thisAlbum, nil
+}
+
+// Rename an album
+func (l *Library) RenameAlbum(username string, albumID string, newName string) error {
+	thisAlbum, err := l.GetAlbum(username, albumID)
+	if err != nil {
+		return err
+	}
+	newName = strings.TrimSpace(newName)
+	if newName == "" {
+		return errors.New("album name cannot be empty")
+	}
+	thisAlbum.Name = newName
+	return l.writeAlbum(thisAlbum)
+}
+
+// Remove an album. The photos inside the album are not affected
+func (l *Library) RemoveAlbum(username string, albumID string) error {
+	if _, err := l.GetAlbum(username, albumID); err != nil {
+		return err
+	}
+	return l.options.Database.Delete(tableName, username+"/album/"+albumID)
+}
+
+// Add photos to an album, photos already in the album are ignored
+func (l *Library) AddPhotosToAlbum(username string, albumID string, vpaths []string) error {
+	thisAlbum, err := l.GetAlbum(username, albumID)
+	if err != nil {
+		return err
+	}
+	for _, vpath := range vpaths {
+		if !utils.StringInArray(thisAlbum.Photos, vpath) {
+			thisAlbum.Photos = append(thisAlbum.Photos, vpath)
+		}
+	}
+	return l.writeAlbum(thisAlbum)
+}
+
+// Remove photos from an album
+func (l *Library) RemovePhotosFromAlbum(username string, albumID string, vpaths []string) error {
+	thisAlbum, err := l.GetAlbum(username, albumID)
+	if err != nil {
+		return err
+	}
+	remaining := []string{}
+	for _, photo := range thisAlbum.Photos {
+		if !utils.StringInArray(vpaths, photo) {
+			remaining = append(remaining, photo)
+		}
+	}
+	thisAlbum.Photos = remaining
+	if utils.StringInArray(vpaths, thisAlbum.Cover) {
+		thisAlbum.Cover = ""
+	}
+	return l.writeAlbum(thisAlbum)
+}
+
+// Set the cover photo of an album
+func (l *Library) SetAlbumCover(username string, albumID string, vpath string) error {
+	thisAlbum, err := l.GetAlbum(username, albumID)
+	if err != nil {
+		return err
+	}
+	if !utils.StringInArray(thisAlbum.Photos, vpath) {
+		return errors.New("cover photo must be inside the album")
+	}
+	thisAlbum.Cover = vpath
+	return l.writeAlbum(thisAlbum)
+}
+
+func (l *Library) writeAlbum(album *Album) error {
+	return l.options.Database.Write(tableName, album.Owner+"/album/"+album.ID, album)
+}
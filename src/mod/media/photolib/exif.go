@@ -0,0 +1,107 @@
+package photolib
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	_ "image/jpeg"
+	_ "image/png"
+	"strings"
+
+	"github.com/rwcarlsen/goexif/exif"
+	_ "golang.org/x/image/webp"
+	"imuslab.com/arozos/mod/filesystem"
+	"imuslab.com/arozos/mod/filesystem/metadata"
+)
+
+// Maximum file size for decoding the full image for perceptual hash calculation
+const maxDecodeSize = 25 << 20
+
+// Load the content of a photo for information extraction. For RAW files, the embedded
+// JPEG preview is returned as the decodable image data
+func loadPhotoData(fsh *filesystem.FileSystemHandler, rpath string) (rawContent []byte, imageData []byte, err error) {
+	fshAbs := fsh.FileSystemAbstraction
+	if metadata.IsRawImageFile(rpath) {
+		if fsh.RequireBuffer {
+			return nil, nil, errors.New("RAW image indexing not supported for buffered file systems")
+		}
+		rawContent, err = fshAbs.ReadFile(rpath)
+		if err != nil {
+			return nil, nil, err
+		}
+		imageData, err = metadata.RenderRAWImage(fsh, rpath)
+		if err != nil {
+			return rawContent, nil, err
+		}
+		return rawContent, imageData, nil
+	}
+
+	if fshAbs.GetFileSize(rpath) > maxDecodeSize {
+		return nil, nil, errors.New("image file too large")
+	}
+
+	content, err := fshAbs.ReadFile(rpath)
+	if err != nil {
+		return nil, nil, err
+	}
+	return content, content, nil
+}
+
+// Fill in the EXIF information of the photo. Missing fields are left untouched
+func extractExifInfo(photo *Photo, rawContent []byte, imageData []byte) {
+	//RAW files (CR2 / NEF / ARW / DNG) are TIFF based and can be parsed directly.
+	//If that fails, try the embedded JPEG preview instead
+	x, err := exif.Decode(bytes.NewReader(rawContent))
+	if err != nil && imageData != nil {
+		x, err = exif.Decode(bytes.NewReader(imageData))
+	}
+
+	if err == nil && x != nil {
+		if t, err := x.DateTime(); err == nil {
+			photo.TakenTime = t.Unix()
+		}
+
+		if tag, err := x.Get(exif.Make); err == nil {
+			if val, err := tag.StringVal(); err == nil {
+				photo.CameraMake = strings.TrimSpace(strings.Trim(val, "\x00"))
+			}
+		}
+
+		if tag, err := x.Get(exif.Model); err == nil {
+			if val, err := tag.StringVal(); err == nil {
+				photo.CameraModel = strings.TrimSpace(strings.Trim(val, "\x00"))
+			}
+		}
+
+		if lat, long, err := x.LatLong(); err == nil {
+			photo.HasGPS = true
+			photo.Latitude = lat
+			photo.Longitude = long
+		}
+
+		if tag, err := x.Get(exif.PixelXDimension); err == nil {
+			if val, err := tag.Int(0); err == nil {
+				photo.Width = val
+			}
+		}
+
+		if tag, err := x.Get(exif.PixelYDimension); err == nil {
+			if val, err := tag.Int(0); err == nil {
+				photo.Height = val
+			}
+		}
+	}
+
+	//Fallback to the image header for dimensions
+	if (photo.Width == 0 || photo.Height == 0) && imageData != nil {
+		config, _, err := image.DecodeConfig(bytes.NewReader(imageData))
+		if err == nil {
+			photo.Width = config.Width
+			photo.Height = config.Height
+		}
+	}
+
+	if photo.TakenTime == 0 {
+		photo.TakenTime = photo.ModTime
+	}
+}
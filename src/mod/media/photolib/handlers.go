@@ -0,0 +1,376 @@
+package photolib
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"imuslab.com/arozos/mod/utils"
+)
+
+/*
+	Photo Library HTTP Handlers
+
+	All handlers require the request to be authenticated
+	and only operate on the requesting user's library.
+*/
+
+// Get or set the library folders of the current user
+func (l *Library) HandleLibraryFolders(w http.ResponseWriter, r *http.Request) {
+	userinfo, err := l.options.UserHandler.GetUserInfoFromRequest(w, r)
+	if err != nil {
+		utils.SendErrorResponse(w, "user not logged in")
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		js, _ := json.Marshal(l.GetLibraryFolders(userinfo.Username))
+		utils.SendJSONResponse(w, string(js))
+		return
+	}
+
+	foldersJSON, err := utils.PostPara(r, "folders")
+	if err != nil {
+		utils.SendErrorResponse(w, "invalid folders given")
+		return
+	}
+
+	folders := []string{}
+	err = json.Unmarshal([]byte(foldersJSON), &folders)
+	if err != nil {
+		utils.SendErrorResponse(w, "unable to parse folder list")
+		return
+	}
+
+	for _, folder := range folders {
+		if !userinfo.CanRead(folder) {
+			utils.SendErrorResponse(w, "permission denied: "+folder)
+			return
+		}
+	}
+
+	err = l.SetLibraryFolders(userinfo.Username, folders)
+	if err != nil {
+		utils.SendErrorResponse(w, err.Error())
+		return
+	}
+	utils.SendOK(w)
+}
+
+// Start refreshing the current user library in the background
+func (l *Library) HandleRefresh(w http.ResponseWriter, r *http.Request) {
+	userinfo, err := l.options.UserHandler.GetUserInfoFromRequest(w, r)
+	if err != nil {
+		utils.SendErrorResponse(w, "user not logged in")
+		return
+	}
+
+	go func() {
+		err := l.RefreshLibrary(userinfo)
+		if err != nil {
+			l.log("Unable to refresh photo library for "+userinfo.Username, err)
+		}
+	}()
+	utils.SendOK(w)
+}
+
+// Get the indexing status of the current user
+func (l *Library) HandleIndexStatus(w http.ResponseWriter, r *http.Request) {
+	userinfo, err := l.options.UserHandler.GetUserInfoFromRequest(w, r)
+	if err != nil {
+		utils.SendErrorResponse(w, "user not logged in")
+		return
+	}
+
+	status := l.GetIndexStatus(userinfo.Username)
+	if status == nil {
+		status = &IndexStatus{}
+	}
+	js, _ := json.Marshal(status)
+	utils.SendJSONResponse(w, string(js))
+}
+
+// Get the photo timeline, accept bucket={day/month/year} and optional start / end unix timestamp
+func (l *Library) HandleTimeline(w http.ResponseWriter, r *http.Request) {
+	userinfo, err := l.options.UserHandler.GetUserInfoFromRequest(w, r)
+	if err != nil {
+		utils.SendErrorResponse(w, "user not logged in")
+		return
+	}
+
+	bucket, _ := utils.GetPara(r, "bucket")
+	start, _ := utils.GetPara(r, "start")
+	end, _ := utils.GetPara(r, "end")
+	startTime, _ := utils.StringToInt64(start)
+	endTime, _ := utils.StringToInt64(end)
+
+	photos, err := l.ListPhotos(userinfo.Username)
+	if err != nil {
+		utils.SendErrorResponse(w, err.Error())
+		return
+	}
+
+	timeline, err := BuildTimeline(hidePairedRAW(photos), bucket, startTime, endTime, nil)
+	if err != nil {
+		utils.SendErrorResponse(w, err.Error())
+		return
+	}
+
+	js, _ := json.Marshal(timeline)
+	utils.SendJSONResponse(w, string(js))
+}
+
+// Get the indexed information of a single photo
+func (l *Library) HandlePhotoInfo(w http.ResponseWriter, r *http.Request) {
+	userinfo, err := l.options.UserHandler.GetUserInfoFromRequest(w, r)
+	if err != nil {
+		utils.SendErrorResponse(w, "user not logged in")
+		return
+	}
+
+	vpath, err := utils.GetPara(r, "file")
+	if err != nil {
+		utils.SendErrorResponse(w, "invalid file given")
+		return
+	}
+
+	photo, err := l.GetPhoto(userinfo.Username, vpath)
+	if err != nil {
+		utils.SendErrorResponse(w, err.Error())
+		return
+	}
+
+	js, _ := json.Marshal(photo)
+	utils.SendJSONResponse(w, string(js))
+}
+
+// Get geotagged photos, accept optional minlat, maxlat, minlong and maxlong boundary
+func (l *Library) HandleMap(w http.ResponseWriter, r *http.Request) {
+	userinfo, err := l.options.UserHandler.GetUserInfoFromRequest(w, r)
+	if err != nil {
+		utils.SendErrorResponse(w, "user not logged in")
+		return
+	}
+
+	var boundary *GeoBoundary
+	boundaryValues := []float64{}
+	for _, key := range []string{"minlat", "maxlat", "minlong", "maxlong"} {
+		val, err := utils.GetPara(r, key)
+		if err != nil {
+			break
+		}
+		floatVal, err := strconv.ParseFloat(val, 64)
+		if err != nil {
+			utils.SendErrorResponse(w, "invalid "+key+" given")
+			return
+		}
+		boundaryValues = append(boundaryValues, floatVal)
+	}
+
+	if len(boundaryValues) == 4 {
+		boundary = &GeoBoundary{
+			MinLat:  boundaryValues[0],
+			MaxLat:  boundaryValues[1],
+			MinLong: boundaryValues[2],
+			MaxLong: boundaryValues[3],
+		}
+	}
+
+	photos, err := l.ListPhotos(userinfo.Username)
+	if err != nil {
+		utils.SendErrorResponse(w, err.Error())
+		return
+	}
+
+	js, _ := json.Marshal(FilterByLocation(hidePairedRAW(photos), boundary))
+	utils.SendJSONResponse(w, string(js))
+}
+
+// List groups of visually similar photos, accept optional threshold (0 - 64)
+func (l *Library) HandleDuplicates(w http.ResponseWriter, r *http.Request) {
+	userinfo, err := l.options.UserHandler.GetUserInfoFromRequest(w, r)
+	if err != nil {
+		utils.SendErrorResponse(w, "user not logged in")
+		return
+	}
+
+	threshold, err := utils.GetInt(r, "threshold")
+	if err != nil || threshold < 0 || threshold > 64 {
+		threshold = DefaultDuplicateThreshold
+	}
+
+	photos, err := l.ListPhotos(userinfo.Username)
+	if err != nil {
+		utils.SendErrorResponse(w, err.Error())
+		return
+	}
+
+	js, _ := json.Marshal(FindDuplicates(photos, threshold))
+	utils.SendJSONResponse(w, string(js))
+}
+
+// Serve the thumbnail of a photo, accept file and size={small/medium/large}
+func (l *Library) HandleThumbnail(w http.ResponseWriter, r *http.Request) {
+	userinfo, err := l.options.UserHandler.GetUserInfoFromRequest(w, r)
+	if err != nil {
+		utils.SendErrorResponse(w, "user not logged in")
+		return
+	}
+
+	vpath, err := utils.GetPara(r, "file")
+	if err != nil {
+		utils.SendErrorResponse(w, "invalid file given")
+		return
+	}
+
+	if !userinfo.CanRead(vpath) {
+		utils.SendErrorResponse(w, "permission denied")
+		return
+	}
+
+	size, _ := utils.GetPara(r, "size")
+	fsh, err := userinfo.GetFileSystemHandlerFromVirtualPath(vpath)
+	if err != nil {
+		utils.SendErrorResponse(w, err.Error())
+		return
+	}
+
+	thumbnail, err := l.LoadThumbnail(fsh, vpath, userinfo.Username, size)
+	if err != nil {
+		utils.SendErrorResponse(w, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/jpeg")
+	w.Header().Set("Cache-Control", "private, max-age=3600")
+	w.Write(thumbnail)
+}
+
+// Handle album operations, accept opr={list/create/rename/remove/add/removePhotos/setCover/get}
+func (l *Library) HandleAlbums(w http.ResponseWriter, r *http.Request) {
+	userinfo, err := l.options.UserHandler.GetUserInfoFromRequest(w, r)
+	if err != nil {
+		utils.SendErrorResponse(w, "user not logged in")
+		return
+	}
+	username := userinfo.Username
+
+	opr, _ := utils.PostPara(r, "opr")
+	if opr == "" {
+		opr, _ = utils.GetPara(r, "opr")
+	}
+	albumID, _ := utils.PostPara(r, "id")
+	if albumID == "" {
+		albumID, _ = utils.GetPara(r, "id")
+	}
+
+	//Parse the photo list for add / remove operations
+	parsePhotoList := func() ([]string, bool) {
+		photosJSON, err := utils.PostPara(r, "photos")
+		if err != nil {
+			utils.SendErrorResponse(w, "invalid photos given")
+			return nil, false
+		}
+		photos := []string{}
+		err = json.Unmarshal([]byte(photosJSON), &photos)
+		if err != nil {
+			utils.SendErrorResponse(w, "unable to parse photo list")
+			return nil, false
+		}
+		return photos, true
+	}
+
+	switch opr {
+	case "", "list":
+		albums, err := l.ListAlbums(username)
+		if err != nil {
+			utils.SendErrorResponse(w, err.Error())
+			return
+		}
+		js, _ := json.Marshal(albums)
+		utils.SendJSONResponse(w, string(js))
+	case "get":
+		album, err := l.GetAlbum(username, albumID)
+		if err != nil {
+			utils.SendErrorResponse(w, err.Error())
+			return
+		}
+		js, _ := json.Marshal(album)
+		utils.SendJSONResponse(w, string(js))
+	case "create":
+		name, err := utils.PostPara(r, "name")
+		if err != nil {
+			utils.SendErrorResponse(w, "invalid album name given")
+			return
+		}
+		album, err := l.CreateAlbum(username, name)
+		if err != nil {
+			utils.SendErrorResponse(w, err.Error())
+			return
+		}
+		js, _ := json.Marshal(album)
+		utils.SendJSONResponse(w, string(js))
+	case "rename":
+		name, err := utils.PostPara(r, "name")
+		if err != nil {
+			utils.SendErrorResponse(w, "invalid album name given")
+			return
+		}
+		err = l.RenameAlbum(username, albumID, name)
+		if err != nil {
+			utils.SendErrorResponse(w, err.Error())
+			return
+		}
+		utils.SendOK(w)
+	case "remove":
+		err = l.RemoveAlbum(username, albumID)
+		if err != nil {
+			utils.SendErrorResponse(w, err.Error())
+			return
+		}
+		utils.SendOK(w)
+	case "add":
+		photos, ok := parsePhotoList()
+		if !ok {
+			return
+		}
+		for _, photo := range photos {
+			if !strings.Contains(photo, ":/") || !userinfo.CanRead(photo) {
+				utils.SendErrorResponse(w, "permission denied: "+photo)
+				return
+			}
+		}
+		err = l.AddPhotosToAlbum(username, albumID, photos)
+		if err != nil {
+			utils.SendErrorResponse(w, err.Error())
+			return
+		}
+		utils.SendOK(w)
+	case "removePhotos":
+		photos, ok := parsePhotoList()
+		if !ok {
+			return
+		}
+		err = l.RemovePhotosFromAlbum(username, albumID, photos)
+		if err != nil {
+			utils.SendErrorResponse(w, err.Error())
+			return
+		}
+		utils.SendOK(w)
+	case "setCover":
+		cover, err := utils.PostPara(r, "cover")
+		if err != nil {
+			utils.SendErrorResponse(w, "invalid cover given")
+			return
+		}
+		err = l.SetAlbumCover(username, albumID, cover)
+		if err != nil {
+			utils.SendErrorResponse(w, err.Error())
+			return
+		}
+		utils.SendOK(w)
+	default:
+		utils.SendErrorResponse(w, "unknown operation")
+	}
+}
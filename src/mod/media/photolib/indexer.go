@@ -0,0 +1,250 @@
+package photolib
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"imuslab.com/arozos/mod/filesystem"
+	"imuslab.com/arozos/mod/filesystem/metadata"
+	"imuslab.com/arozos/mod/user"
+)
+
+/*
+	Indexer
+
+	Walk through the user's library folders and update the index.
+	Files with unchanged size and modification time are skipped,
+	so a refresh after the initial scan only process new or edited files.
+*/
+
+type IndexStatus struct {
+	Running   bool  //If the indexer is running
+	Scanned   int   //Number of files scanned
+	Updated   int   //Number of photos added or updated
+	Removed   int   //Number of photos removed from index
+	StartTime int64 //Start time of this indexing
+	EndTime   int64 //End time of this indexing, 0 if still running
+	mutex     sync.Mutex
+}
+
+// Update the status fields with the lock held, as the status is read by the status API
+func (s *IndexStatus) update(fn func(s *IndexStatus)) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	fn(s)
+}
+
+// Get a copy of the status that is safe to read while the indexer is running
+func (s *IndexStatus) snapshot() *IndexStatus {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return &IndexStatus{
+		Running:   s.Running,
+		Scanned:   s.Scanned,
+		Updated:   s.Updated,
+		Removed:   s.Removed,
+		StartTime: s.StartTime,
+		EndTime:   s.EndTime,
+	}
+}
+
+// Get the indexing status of the given user, return nil if never indexed since startup
+func (l *Library) GetIndexStatus(username string) *IndexStatus {
+	status, ok := l.indexing.Load(username)
+	if !ok {
+		return nil
+	}
+	return status.(*IndexStatus).snapshot()
+}
+
+// Claim the indexing run of the user, return nil if another run is in progress
+func (l *Library) claimIndexing(username string) *IndexStatus {
+	status := &IndexStatus{
+		Running:   true,
+		StartTime: time.Now().Unix(),
+	}
+	for {
+		previous, loaded := l.indexing.LoadOrStore(username, status)
+		if !loaded {
+			return status
+		}
+		if previous.(*IndexStatus).snapshot().Running {
+			return nil
+		}
+		//Replace the finished run, retry if another refresh claimed it first
+		if l.indexing.CompareAndSwap(username, previous, status) {
+			return status
+		}
+	}
+}
+
+// Refresh the photo index of all users
+func (l *Library) RefreshAllLibraries() {
+	authAgent := l.options.UserHandler.GetAuthAgent()
+	for _, username := range authAgent.ListUsers() {
+		userinfo, err := l.options.UserHandler.GetUserInfoFromUsername(username)
+		if err != nil {
+			continue
+		}
+		err = l.RefreshLibrary(userinfo)
+		if err != nil {
+			l.log("Unable to refresh photo library for "+username, err)
+		}
+	}
+}
+
+// Incrementally refresh the photo index of the given user
+func (l *Library) RefreshLibrary(userinfo *user.User) error {
+	username := userinfo.Username
+	status := l.claimIndexing(username)
+	if status == nil {
+		return nil
+	}
+	defer status.update(func(s *IndexStatus) {
+		s.Running = false
+		s.EndTime = time.Now().Unix()
+	})
+
+	//Load the existing index into a map for lookup
+	existingPhotos, err := l.ListPhotos(username)
+	if err != nil {
+		return err
+	}
+	existingIndex := map[string]*Photo{}
+	for _, photo := range existingPhotos {
+		existingIndex[photo.Vpath] = photo
+	}
+
+	seen := map[string]bool{}
+	for _, folder := range l.GetLibraryFolders(username) {
+		fsh, err := userinfo.GetFileSystemHandlerFromVirtualPath(folder)
+		if err != nil {
+			l.log("Unable to resolve library folder "+folder, err)
+			continue
+		}
+		fshAbs := fsh.FileSystemAbstraction
+		rpath, err := fshAbs.VirtualPathToRealPath(folder, username)
+		if err != nil || !fshAbs.FileExists(rpath) {
+			continue
+		}
+
+		fshAbs.Walk(rpath, func(path string, info os.FileInfo, err error) error {
+			if err != nil || info == nil {
+				return nil
+			}
+
+			if info.IsDir() {
+				if path != rpath && strings.HasPrefix(info.Name(), ".") {
+					//Skip hidden folders like .metadata
+					return filepath.SkipDir
+				}
+				return nil
+			}
+
+			if !IsSupportedPhoto(path) {
+				return nil
+			}
+
+			vpath, err := fshAbs.RealPathToVirtualPath(path, username)
+			if err != nil {
+				return nil
+			}
+			status.update(func(s *IndexStatus) { s.Scanned++ })
+			seen[vpath] = true
+
+			existing, ok := existingIndex[vpath]
+			if ok && existing.ModTime == info.ModTime().Unix() && existing.Size == info.Size() {
+				//Unchanged since last index
+				return nil
+			}
+
+			photo := l.indexPhoto(fsh, path, vpath, info)
+			if ok {
+				//Keep pairing info until the pairing is recalculated
+				photo.PairedWith = existing.PairedWith
+			}
+			existingIndex[vpath] = photo
+			l.writePhoto(username, photo)
+			status.update(func(s *IndexStatus) { s.Updated++ })
+			return nil
+		})
+	}
+
+	//Remove photos that no longer exists or moved out of library folders
+	for vpath := range existingIndex {
+		if !seen[vpath] {
+			l.removePhoto(username, vpath)
+			delete(existingIndex, vpath)
+			status.update(func(s *IndexStatus) { s.Removed++ })
+		}
+	}
+
+	l.updatePairing(username, existingIndex)
+	return nil
+}
+
+// Extract the information of a single photo
+func (l *Library) indexPhoto(fsh *filesystem.FileSystemHandler, rpath string, vpath string, info os.FileInfo) *Photo {
+	photo := Photo{
+		Vpath:    vpath,
+		Filename: filepath.Base(vpath),
+		Size:     info.Size(),
+		ModTime:  info.ModTime().Unix(),
+		IsRAW:    metadata.IsRawImageFile(rpath),
+	}
+
+	rawContent, imageData, err := loadPhotoData(fsh, rpath)
+	if err != nil {
+		photo.TakenTime = photo.ModTime
+		return &photo
+	}
+
+	extractExifInfo(&photo, rawContent, imageData)
+	hash, err := perceptualHashFromBytes(imageData)
+	if err == nil {
+		photo.PHash = hash
+	}
+
+	return &photo
+}
+
+// Pair RAW and JPEG files with the same name in the same folder
+func (l *Library) updatePairing(username string, index map[string]*Photo) {
+	//Group photos by their path without extension
+	groups := map[string][]*Photo{}
+	for _, photo := range index {
+		key := strings.TrimSuffix(photo.Vpath, filepath.Ext(photo.Vpath))
+		groups[key] = append(groups[key], photo)
+	}
+
+	for _, photos := range groups {
+		var rawPhoto, jpegPhoto *Photo
+		for _, photo := range photos {
+			ext := strings.ToLower(filepath.Ext(photo.Vpath))
+			if photo.IsRAW {
+				rawPhoto = photo
+			} else if ext == ".jpg" || ext == ".jpeg" {
+				jpegPhoto = photo
+			}
+		}
+
+		for _, photo := range photos {
+			pairedWith := ""
+			if rawPhoto != nil && jpegPhoto != nil {
+				if photo == rawPhoto {
+					pairedWith = jpegPhoto.Vpath
+				} else if photo == jpegPhoto {
+					pairedWith = rawPhoto.Vpath
+				}
+			}
+
+			if photo.PairedWith != pairedWith {
+				photo.PairedWith = pairedWith
+				l.writePhoto(username, photo)
+			}
+		}
+	}
+}
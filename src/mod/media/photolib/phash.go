@@ -0,0 +1,70 @@
+package photolib
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"math/bits"
+	"strconv"
+
+	"github.com/nfnt/resize"
+)
+
+/*
+	Perceptual Hash
+
+	This implements the difference hash (dHash) algorithm. The image is
+	scaled down to 9x8 greyscale pixels and each bit of the 64 bit hash
+	represent if a pixel is brighter than its right neighbour.
+
+	Visually similar images (resized, recompressed, slightly edited)
+	will have hashes with a small hamming distance.
+*/
+
+// Default maximum hamming distance for two photos to be considered duplicates
+const DefaultDuplicateThreshold = 6
+
+// Calculate the perceptual hash of the given image
+func PerceptualHash(img image.Image) uint64 {
+	scaled := resize.Resize(9, 8, img, resize.Bilinear)
+	var hash uint64
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			if luminance(scaled, x, y) > luminance(scaled, x+1, y) {
+				hash |= 1 << uint(y*8+x)
+			}
+		}
+	}
+	return hash
+}
+
+// Calculate the perceptual hash from encoded image data
+func perceptualHashFromBytes(imageData []byte) (string, error) {
+	if len(imageData) == 0 {
+		return "", errors.New("empty image data")
+	}
+	img, _, err := image.Decode(bytes.NewReader(imageData))
+	if err != nil {
+		return "", err
+	}
+	return strconv.FormatUint(PerceptualHash(img), 16), nil
+}
+
+// Get the hamming distance between two perceptual hashes in hex string format
+func HammingDistance(hashA string, hashB string) (int, error) {
+	a, err := strconv.ParseUint(hashA, 16, 64)
+	if err != nil {
+		return -1, err
+	}
+	b, err := strconv.ParseUint(hashB, 16, 64)
+	if err != nil {
+		return -1, err
+	}
+	return bits.OnesCount64(a ^ b), nil
+}
+
+func luminance(img image.Image, x int, y int) uint32 {
+	b := img.Bounds()
+	r, g, bl, _ := img.At(b.Min.X+x, b.Min.Y+y).RGBA()
+	return (299*r + 587*g + 114*bl) / 1000
+}
@@ -0,0 +1,181 @@
+package photolib
+
+/*
+	Photo Library
+
+	This module index photos from user selected folders and
+	provide timeline, album, map and duplicate lookup functions
+	on top of the indexed EXIF information.
+
+	The index is stored in the system database under the
+	"photolib" table with the following key structure
+
+	{username}/folders			=> []string (vpath of library folders)
+	{username}/photo/{vpath}	=> Photo
+	{username}/album/{albumid}	=> Album
+*/
+
+import (
+	"encoding/json"
+	"errors"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"imuslab.com/arozos/mod/database"
+	"imuslab.com/arozos/mod/filesystem/metadata"
+	"imuslab.com/arozos/mod/info/logger"
+	"imuslab.com/arozos/mod/user"
+	"imuslab.com/arozos/mod/utils"
+)
+
+const tableName = "photolib"
+
+// Supported image formats that will be indexed by the library
+var SupportedImageFormats = []string{".jpg", ".jpeg", ".png", ".webp"}
+
+type Options struct {
+	Database      *database.Database      //System database for storing the index
+	UserHandler   *user.UserHandler       //User handler for resolving user file system handlers
+	RenderHandler *metadata.RenderHandler //Thumbnail render handler, shared with the file manager
+	Logger        *logger.Logger          //System wide logger
+}
+
+// Photo is an indexed image file in the user's library
+type Photo struct {
+	Vpath       string  //Virtual path of the photo
+	Filename    string  //Filename of the photo
+	Size        int64   //File size in bytes
+	ModTime     int64   //Last modification time of the file, used for incremental refresh
+	TakenTime   int64   //EXIF DateTimeOriginal, fallback to ModTime if not exists
+	CameraMake  string  //Camera manufacturer
+	CameraModel string  //Camera model
+	HasGPS      bool    //If the photo contains GPS information
+	Latitude    float64 //GPS latitude
+	Longitude   float64 //GPS longitude
+	Width       int     //Image width in pixels
+	Height      int     //Image height in pixels
+	IsRAW       bool    //If this photo is a RAW image
+	PairedWith  string  //Vpath of the RAW / JPEG sibling of this photo, empty if not paired
+	PHash       string  //Perceptual hash of the image in hex, empty if not calculated
+}
+
+type Library struct {
+	options  *Options
+	indexing sync.Map //Username currently being indexed, map[string]*IndexStatus
+}
+
+// Create a new photo library
+func NewPhotoLibrary(options *Options) (*Library, error) {
+	if options.Database == nil {
+		return nil, errors.New("database not set")
+	}
+	err := options.Database.NewTable(tableName)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Library{
+		options:  options,
+		indexing: sync.Map{},
+	}, nil
+}
+
+// Check if the given file is supported by the photo library
+func IsSupportedPhoto(filename string) bool {
+	ext := strings.ToLower(filepath.Ext(filename))
+	return utils.StringInArray(SupportedImageFormats, ext) || metadata.IsRawImageFile(filename)
+}
+
+// Get the folders that is included in the user's photo library
+func (l *Library) GetLibraryFolders(username string) []string {
+	folders := []string{}
+	if !l.options.Database.KeyExists(tableName, username+"/folders") {
+		//Use the user's Photo folder as default
+		return []string{"user:/Photo"}
+	}
+	l.options.Database.Read(tableName, username+"/folders", &folders)
+	return folders
+}
+
+// Set the folders that is included in the user's photo library
+func (l *Library) SetLibraryFolders(username string, folders []string) error {
+	cleanedFolders := []string{}
+	for _, folder := range folders {
+		folder = strings.TrimSpace(filepath.ToSlash(folder))
+		if folder == "" || utils.StringInArray(cleanedFolders, folder) {
+			continue
+		}
+		if !strings.Contains(folder, ":/") {
+			return errors.New("invalid folder path given: " + folder)
+		}
+		cleanedFolders = append(cleanedFolders, strings.TrimSuffix(folder, "/"))
+	}
+	return l.options.Database.Write(tableName, username+"/folders", cleanedFolders)
+}
+
+// List all photos in the user's library
+func (l *Library) ListPhotos(username string) ([]*Photo, error) {
+	results := []*Photo{}
+	entries, err := l.options.Database.ListTable(tableName)
+	if err != nil {
+		return results, err
+	}
+
+	prefix := username + "/photo/"
+	for _, keypairs := range entries {
+		if !strings.HasPrefix(string(keypairs[0]), prefix) {
+			continue
+		}
+		thisPhoto := Photo{}
+		err = json.Unmarshal(keypairs[1], &thisPhoto)
+		if err != nil {
+			continue
+		}
+		results = append(results, &thisPhoto)
+	}
+
+	return results, nil
+}
+
+// Get a single photo record from the user's library
+func (l *Library) GetPhoto(username string, vpath string) (*Photo, error) {
+	key := username + "/photo/" + vpath
+	if !l.options.Database.KeyExists(tableName, key) {
+		return nil, errors.New("photo not found in library")
+	}
+	thisPhoto := Photo{}
+	err := l.options.Database.Read(tableName, key, &thisPhoto)
+	if err != nil {
+		return nil, err
+	}
+	return &thisPhoto, nil
+}
+
+func (l *Library) writePhoto(username string, photo *Photo) error {
+	return l.options.Database.Write(tableName, username+"/photo/"+photo.Vpath, photo)
+}
+
+func (l *Library) removePhoto(username string, vpath string) error {
+	return l.options.Database.Delete(tableName, username+"/photo/"+vpath)
+}
+
+// Remove all library records of the given user, call this when the user is removed
+func (l *Library) RemoveUserLibrary(username string) error {
+	entries, err := l.options.Database.ListTable(tableName)
+	if err != nil {
+		return err
+	}
+	for _, keypairs := range entries {
+		if strings.HasPrefix(string(keypairs[0]), username+"/") {
+			l.options.Database.Delete(tableName, string(keypairs[0]))
+		}
+	}
+	return nil
+}
+
+func (l *Library) log(message string, err error) {
+	if l.options.Logger != nil {
+		l.options.Logger.PrintAndLog("Photo", message, err)
+	}
+}
@@ -0,0 +1,122 @@
+package photolib
+
+import (
+	"image"
+	"image/color"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func createGradientImage(width int, height int, inverted bool) image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			val := uint8(x * 255 / width)
+			if inverted {
+				val = 255 - val
+			}
+			img.Set(x, y, color.RGBA{val, val, val, 255})
+		}
+	}
+	return img
+}
+
+func TestPerceptualHashSimilarity(t *testing.T) {
+	original := PerceptualHash(createGradientImage(640, 480, false))
+	resized := PerceptualHash(createGradientImage(320, 240, false))
+	inverted := PerceptualHash(createGradientImage(640, 480, true))
+
+	hashString := func(h uint64) string {
+		return strconv.FormatUint(h, 16)
+	}
+
+	distance, err := HammingDistance(hashString(original), hashString(resized))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if distance > DefaultDuplicateThreshold {
+		t.Errorf("Resized image should be similar, got distance %d", distance)
+	}
+
+	distance, err = HammingDistance(hashString(original), hashString(inverted))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if distance <= DefaultDuplicateThreshold {
+		t.Errorf("Inverted image should not be similar, got distance %d", distance)
+	}
+}
+
+func TestBuildTimeline(t *testing.T) {
+	day := func(year int, month time.Month, d int) int64 {
+		return time.Date(year, month, d, 12, 0, 0, 0, time.UTC).Unix()
+	}
+	photos := []*Photo{
+		{Vpath: "user:/Photo/a.jpg", TakenTime: day(2023, 1, 1)},
+		{Vpath: "user:/Photo/b.jpg", TakenTime: day(2024, 5, 1)},
+		{Vpath: "user:/Photo/c.jpg", TakenTime: day(2024, 5, 20)},
+		{Vpath: "user:/Photo/d.jpg", TakenTime: day(2024, 6, 2)},
+	}
+
+	timeline, err := BuildTimeline(photos, "month", 0, 0, time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectedKeys := []string{"2024-06", "2024-05", "2023-01"}
+	if len(timeline) != len(expectedKeys) {
+		t.Fatalf("Expected %d buckets, got %d", len(expectedKeys), len(timeline))
+	}
+	for i, key := range expectedKeys {
+		if timeline[i].Key != key {
+			t.Errorf("Bucket %d: expected %s, got %s", i, key, timeline[i].Key)
+		}
+	}
+	if timeline[1].Count != 2 {
+		t.Errorf("Expected 2 photos in 2024-05, got %d", timeline[1].Count)
+	}
+
+	//Filter by time range
+	timeline, _ = BuildTimeline(photos, "year", day(2024, 1, 1), 0, time.UTC)
+	if len(timeline) != 1 || timeline[0].Count != 3 {
+		t.Errorf("Expected a single 2024 bucket with 3 photos")
+	}
+
+	if _, err := BuildTimeline(photos, "week", 0, 0, time.UTC); err == nil {
+		t.Errorf("Expected error for invalid bucket size")
+	}
+}
+
+func TestFilterByLocation(t *testing.T) {
+	photos := []*Photo{
+		{Vpath: "a", HasGPS: true, Latitude: 22.3, Longitude: 114.2},
+		{Vpath: "b", HasGPS: true, Latitude: 51.5, Longitude: -0.1},
+		{Vpath: "c", HasGPS: false},
+	}
+
+	if len(FilterByLocation(photos, nil)) != 2 {
+		t.Errorf("Expected all geotagged photos without boundary")
+	}
+
+	results := FilterByLocation(photos, &GeoBoundary{MinLat: 20, MaxLat: 25, MinLong: 110, MaxLong: 120})
+	if len(results) != 1 || results[0].Vpath != "a" {
+		t.Errorf("Expected only photo a inside boundary")
+	}
+}
+
+func TestClaimIndexing(t *testing.T) {
+	l := &Library{}
+	status := l.claimIndexing("alice")
+	if status == nil {
+		t.Fatal("unable to claim indexing")
+	}
+	if l.claimIndexing("alice") != nil {
+		t.Fatal("second refresh started while the first is running")
+	}
+
+	status.update(func(s *IndexStatus) { s.Running = false })
+	if l.claimIndexing("alice") == nil {
+		t.Fatal("unable to claim indexing after the previous run finished")
+	}
+}
@@ -0,0 +1,155 @@
+package photolib
+
+import (
+	"errors"
+	"sort"
+	"time"
+)
+
+/*
+	Library Queries
+
+	Timeline, map and duplicates lookup on the indexed photos
+*/
+
+// TimelineBucket is a group of photos taken in the same day / month / year
+type TimelineBucket struct {
+	Key    string   //Bucket key, e.g. 2024-05-21 for day, 2024-05 for month and 2024 for year
+	Count  int      //Number of photos in this bucket
+	Photos []*Photo //Photos in this bucket, sorted by taken time (newest first)
+}
+
+// GeoBoundary is a rectangle area on the map
+type GeoBoundary struct {
+	MinLat  float64
+	MaxLat  float64
+	MinLong float64
+	MaxLong float64
+}
+
+// Get the time layout for the given bucket size, accept {day, month, year}
+func bucketLayout(bucketSize string) (string, error) {
+	switch bucketSize {
+	case "", "day":
+		return "2006-01-02", nil
+	case "month":
+		return "2006-01", nil
+	case "year":
+		return "2006", nil
+	}
+	return "", errors.New("invalid bucket size given")
+}
+
+// Remove the RAW half of RAW+JPEG pairs so the pair only show once in listings
+func hidePairedRAW(photos []*Photo) []*Photo {
+	results := []*Photo{}
+	for _, photo := range photos {
+		if photo.IsRAW && photo.PairedWith != "" {
+			continue
+		}
+		results = append(results, photo)
+	}
+	return results
+}
+
+// Group the photos into date buckets by their taken time. Set start or end to 0 for no limit
+func BuildTimeline(photos []*Photo, bucketSize string, start int64, end int64, loc *time.Location) ([]*TimelineBucket, error) {
+	layout, err := bucketLayout(bucketSize)
+	if err != nil {
+		return nil, err
+	}
+	if loc == nil {
+		loc = time.Local
+	}
+
+	sort.Slice(photos, func(i, j int) bool {
+		return photos[i].TakenTime > photos[j].TakenTime
+	})
+
+	results := []*TimelineBucket{}
+	var current *TimelineBucket
+	for _, photo := range photos {
+		if start > 0 && photo.TakenTime < start {
+			continue
+		}
+		if end > 0 && photo.TakenTime > end {
+			continue
+		}
+
+		key := time.Unix(photo.TakenTime, 0).In(loc).Format(layout)
+		if current == nil || current.Key != key {
+			current = &TimelineBucket{
+				Key:    key,
+				Photos: []*Photo{},
+			}
+			results = append(results, current)
+		}
+		current.Photos = append(current.Photos, photo)
+		current.Count++
+	}
+
+	return results, nil
+}
+
+// Get all photos with GPS information within the given boundary. Pass nil for all geotagged photos
+func FilterByLocation(photos []*Photo, boundary *GeoBoundary) []*Photo {
+	results := []*Photo{}
+	for _, photo := range photos {
+		if !photo.HasGPS {
+			continue
+		}
+		if boundary != nil {
+			if photo.Latitude < boundary.MinLat || photo.Latitude > boundary.MaxLat {
+				continue
+			}
+			if boundary.MinLong <= boundary.MaxLong {
+				if photo.Longitude < boundary.MinLong || photo.Longitude > boundary.MaxLong {
+					continue
+				}
+			} else if photo.Longitude < boundary.MinLong && photo.Longitude > boundary.MaxLong {
+				//Boundary crossing the antimeridian
+				continue
+			}
+		}
+		results = append(results, photo)
+	}
+	return results
+}
+
+// Find groups of visually similar photos by their perceptual hash
+func FindDuplicates(photos []*Photo, threshold int) [][]*Photo {
+	candidates := []*Photo{}
+	for _, photo := range photos {
+		if photo.PHash != "" {
+			candidates = append(candidates, photo)
+		}
+	}
+
+	grouped := make([]bool, len(candidates))
+	results := [][]*Photo{}
+	for i, photo := range candidates {
+		if grouped[i] {
+			continue
+		}
+		group := []*Photo{photo}
+		for j := i + 1; j < len(candidates); j++ {
+			if grouped[j] {
+				continue
+			}
+			if candidates[j].Vpath == photo.PairedWith {
+				//RAW+JPEG pairs are not duplicates
+				continue
+			}
+			distance, err := HammingDistance(photo.PHash, candidates[j].PHash)
+			if err != nil || distance > threshold {
+				continue
+			}
+			grouped[j] = true
+			group = append(group, candidates[j])
+		}
+		if len(group) > 1 {
+			results = append(results, group)
+		}
+	}
+	return results
+}
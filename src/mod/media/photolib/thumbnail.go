@@ -0,0 +1,113 @@
+package photolib
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/jpeg"
+	"path/filepath"
+
+	"github.com/nfnt/resize"
+	"github.com/oliamb/cutter"
+	"imuslab.com/arozos/mod/filesystem"
+	"imuslab.com/arozos/mod/filesystem/hidden"
+)
+
+/*
+	Multi-size thumbnails
+
+	small	240 x 240 center cropped, for dense timeline grid
+	medium	480 x 480 center cropped, shared with the file manager thumbnail cache
+	large	1280px on the long edge, for preview without loading the original
+*/
+
+var thumbnailSizes = map[string]uint{
+	"small": 240,
+	"large": 1280,
+}
+
+// Load the thumbnail of the given size for a photo, generate it if not cached
+func (l *Library) LoadThumbnail(fsh *filesystem.FileSystemHandler, vpath string, username string, size string) ([]byte, error) {
+	if size == "" || size == "medium" {
+		if l.options.RenderHandler == nil {
+			return nil, errors.New("render handler not set")
+		}
+		return l.options.RenderHandler.LoadCacheAsBytes(fsh, vpath, username, false)
+	}
+
+	targetSize, ok := thumbnailSizes[size]
+	if !ok {
+		return nil, errors.New("invalid thumbnail size given")
+	}
+
+	fshAbs := fsh.FileSystemAbstraction
+	rpath, err := fshAbs.VirtualPathToRealPath(vpath, username)
+	if err != nil {
+		return nil, err
+	}
+	if !fshAbs.FileExists(rpath) {
+		return nil, errors.New("photo not exists")
+	}
+
+	cacheFolder := filepath.ToSlash(filepath.Join(filepath.Dir(rpath), ".metadata", ".photolib", size)) + "/"
+	cacheFile := cacheFolder + filepath.Base(rpath) + ".jpg"
+	if !fsh.RequireBuffer && fshAbs.FileExists(cacheFile) {
+		photoModTime, _ := fshAbs.GetModTime(rpath)
+		cacheModTime, _ := fshAbs.GetModTime(cacheFile)
+		if cacheModTime >= photoModTime {
+			return fshAbs.ReadFile(cacheFile)
+		}
+	}
+
+	_, imageData, err := loadPhotoData(fsh, rpath)
+	if err != nil {
+		return nil, err
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(imageData))
+	if err != nil {
+		return nil, err
+	}
+
+	var thumbnail image.Image
+	if size == "large" {
+		b := img.Bounds()
+		if b.Dx() > b.Dy() {
+			thumbnail = resize.Thumbnail(targetSize, uint(b.Dy())*targetSize/uint(b.Dx())+1, img, resize.Lanczos3)
+		} else {
+			thumbnail = resize.Thumbnail(uint(b.Dx())*targetSize/uint(b.Dy())+1, targetSize, img, resize.Lanczos3)
+		}
+	} else {
+		b := img.Bounds()
+		var resized image.Image
+		if b.Dx() > b.Dy() {
+			resized = resize.Resize(0, targetSize, img, resize.Lanczos3)
+		} else {
+			resized = resize.Resize(targetSize, 0, img, resize.Lanczos3)
+		}
+		thumbnail, err = cutter.Crop(resized, cutter.Config{
+			Width:  int(targetSize),
+			Height: int(targetSize),
+			Mode:   cutter.Centered,
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	buf := bytes.NewBuffer(nil)
+	err = jpeg.Encode(buf, thumbnail, &jpeg.Options{Quality: 85})
+	if err != nil {
+		return nil, err
+	}
+
+	if !fsh.RequireBuffer && !fsh.ReadOnly {
+		//Write the cache for next load
+		metadataFolder := filepath.ToSlash(filepath.Join(filepath.Dir(rpath), ".metadata"))
+		fshAbs.MkdirAll(cacheFolder, 0755)
+		hidden.HideFile(metadataFolder)
+		fshAbs.WriteFile(cacheFile, buf.Bytes(), 0755)
+	}
+
+	return buf.Bytes(), nil
+}
@@ -7,11 +7,8 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
-	"strconv"
 	"time"
 
-	"github.com/go-git/go-git/v5"
-	uuid "github.com/satori/go.uuid"
 	agi "imuslab.com/arozos/mod/agi"
 	fs "imuslab.com/arozos/mod/filesystem"
 	"imuslab.com/arozos/mod/utils"
@@ -22,58 +19,10 @@ import (
 	author: tobychui
 
 	This script handle the installation of modules in the arozos system
+	Signed module packages are installed by the PackageInstaller, see package.go
 
 */
 
-// Install a module via selecting a zip file
-func (m *ModuleHandler) InstallViaZip(realpath string, gateway *agi.Gateway) error {
-	//Check if file exists
-	if !utils.FileExists(realpath) {
-		return errors.New("*Module Installer* Installer file not found. Given: " + realpath)
-	}
-
-	//Install it
-	unzipTmpFolder := "./tmp/installer/" + strconv.Itoa(int(time.Now().Unix()))
-	err := fs.Unzip(realpath, unzipTmpFolder)
-	if err != nil {
-		return err
-	}
-
-	//Move the module(s) to the web root
-	files, _ := filepath.Glob(unzipTmpFolder + "/*")
-	folders := []string{}
-	for _, file := range files {
-		if utils.IsDir(file) && utils.FileExists(filepath.Join(file, "init.agi")) {
-			//This looks like a module folder
-			folders = append(folders, file)
-		}
-	}
-	/*
-		for _, folder := range folders {
-			//Copy the module
-			//WIP
-
-					err = fs.CopyDir(folder, "./web/"+filepath.Base(folder))
-					if err != nil {
-						log.Println(err)
-						continue
-					}
-
-
-				//Activate the module
-				m.ActivateModuleByRoot("./web/"+filepath.Base(folder), gateway)
-				m.ModuleSortList()
-
-		}
-	*/
-
-	//Remove the tmp folder
-	os.RemoveAll(unzipTmpFolder)
-
-	//OK
-	return nil
-}
-
 // Reload all modules from agi file again
 func (m *ModuleHandler) ReloadAllModules(gateway *agi.Gateway) error {
 	//Clear the current registered module list
@@ -91,62 +40,6 @@ func (m *ModuleHandler) ReloadAllModules(gateway *agi.Gateway) error {
 	return nil
 }
 
-// Install a module via git clone
-func (m *ModuleHandler) InstallModuleViaGit(gitURL string, gateway *agi.Gateway) error {
-	//Download the module from the gitURL
-	log.Println("Starting module installation by Git cloning ", gitURL)
-	newDownloadUUID := uuid.NewV4().String()
-	downloadFolder := filepath.Join(m.tmpDirectory, "download", newDownloadUUID)
-	os.MkdirAll(downloadFolder, 0777)
-	_, err := git.PlainClone(downloadFolder, false, &git.CloneOptions{
-		URL:      gitURL,
-		Progress: os.Stdout,
-	})
-
-	if err != nil {
-		return err
-	}
-
-	//Copy all folder within the download folder to the web root
-	downloadedFiles, _ := filepath.Glob(downloadFolder + "/*")
-	copyPendingList := []string{}
-	for _, file := range downloadedFiles {
-		if utils.IsDir(file) {
-			//Exclude two special folder: github and images
-			if filepath.Base(file) == ".github" || filepath.Base(file) == "images" || filepath.Base(file)[:1] == "." {
-				//Reserved folder for putting Github readme screenshots or other things
-				continue
-			}
-			//This file object is a folder. Copy to webroot
-			copyPendingList = append(copyPendingList, file)
-		}
-	}
-
-	//Do the copying
-	//WIP
-	/*
-		for _, src := range copyPendingList {
-			fs.FileCopy(src, "./web/", "skip", func(progress int, filename string) {
-				log.Println("Copying ", filename)
-			})
-		}
-	*/
-
-	//Clean up the download folder
-	os.RemoveAll(downloadFolder)
-
-	//Add the newly installed module to module list
-	for _, moduleFolder := range copyPendingList {
-		//This module folder has been moved to web successfully.
-		m.ActivateModuleByRoot(moduleFolder, gateway)
-	}
-
-	//Sort the module lsit
-	m.ModuleSortList()
-
-	return nil
-}
-
 func (m *ModuleHandler) ActivateModuleByRoot(moduleFolder string, gateway *agi.Gateway) error {
 	//Check if there is init.agi. If yes, load it as an module
 	thisModuleEstimataedRoot := filepath.Join("./web/", filepath.Base(moduleFolder))
@@ -244,6 +137,10 @@ func (m *ModuleHandler) UninstallModule(moduleName string) error {
 		}
 	}
 
+	if targetModuleInfo == nil {
+		return errors.New("Module not exists")
+	}
+
 	if targetModuleInfo.Group == "System Tools" || targetModuleInfo.Name == "System Setting" {
 		//Reject Remove Operation
 		return errors.New("Protected modules cannot be removed")
@@ -3,6 +3,7 @@ package modules
 import (
 	"encoding/json"
 	"net/http"
+	"path/filepath"
 	"sort"
 	"strings"
 
@@ -24,6 +25,7 @@ type ModuleInfo struct {
 	InitFWSize   []int    //Floatwindow init size. [0] => Width, [1] => Height
 	InitEmbSize  []int    //Embedded mode init size. [0] => Width, [1] => Height
 	SupportedExt []string //Supported File Extensions. e.g. ".mp3", ".flac", ".wav"
+	AGIEngine    string   //JavaScript engine for the AGI scripts of this module, e.g. "goja". Leave empty for system default
 
 	//Hidden properties
 	allowReload bool //Allow module reload by user
@@ -99,6 +101,18 @@ func (m *ModuleHandler) DeregisterModule(moduleName string) {
 	m.LoadedModule = newLoadedModuleList
 }
 
+//Deregister all modules that start from the given module folder under web root
+func (m *ModuleHandler) DeregisterModuleByFolder(folderName string) {
+	newLoadedModuleList := []*ModuleInfo{}
+	for _, thisModule := range m.LoadedModule {
+		if !strings.HasPrefix(filepath.ToSlash(thisModule.StartDir), folderName+"/") {
+			newLoadedModuleList = append(newLoadedModuleList, thisModule)
+		}
+	}
+
+	m.LoadedModule = newLoadedModuleList
+}
+
 //Get a list of module names
 func (m *ModuleHandler) GetModuleNameList() []string {
 	result := []string{}
@@ -0,0 +1,643 @@
+package modules
+
+/*
+	Module Package Installer
+
+	A module package is a zip file (or a git repository) with the following layout
+
+	manifest.json   Package manifest, see PackageManifest
+	manifest.sig    Base64 encoded ed25519 signature of manifest.json
+	{Name}/...      The module folder, must contains init.agi
+
+	The manifest contains the SHA256 hash of every file in the module folder,
+	so the signature covers the whole package content. Only packages signed by
+	one of the admin trusted keys can be installed.
+
+	Install and upgrade are staged next to the module folder and swapped in
+	with a rename. If the new version failed to start, the previous version
+	is restored.
+*/
+
+import (
+	"archive/zip"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	uuid "github.com/satori/go.uuid"
+	"imuslab.com/arozos/mod/database"
+	"imuslab.com/arozos/mod/utils"
+)
+
+const packageTable = "module_package"
+
+type PackageManifest struct {
+	Name          string            //Module folder name, installed to {web root}/{Name}
+	Version       string            //Version of the package, e.g. 1.2.0
+	MinAGIVersion string            //Minimum AGI runtime version required, e.g. 3.0
+	RequirePkg    []string          //System packages required by the module
+	Permissions   []string          //Permissions requested by the module, shown to admin before install
+	Tables        []string          //Database tables owned by the module, removed on uninstall if prefixed by the module name
+	Files         map[string]string //Path of each file in the package -> SHA256 hash of the content
+}
+
+type InstalledPackage struct {
+	Manifest        *PackageManifest
+	Signer          string //Name of the trusted key that signed this package
+	InstallTime     int64
+	UpdateTime      int64
+	PreviousVersion string //Version before the last upgrade, empty if never upgraded
+}
+
+type TrustedKey struct {
+	Name      string
+	PublicKey string //Base64 encoded ed25519 public key
+	AddTime   int64
+}
+
+type PackageInfo struct {
+	Manifest         *PackageManifest
+	Signer           string //Empty if the package is not signed by a trusted key
+	VerifyError      string //Reason the package cannot be installed, empty if verified
+	InstalledVersion string //Empty if the module is not installed
+}
+
+type InstallerOptions struct {
+	Database             *database.Database
+	WebRoot              string                          //Root of the web modules, e.g. ./web
+	TmpDirectory         string                          //Folder for git clone
+	AGIVersion           string                          //Current AGI runtime version
+	InstallSystemPackage func(pkgname string) error      //Install a required system package, e.g. via apt
+	ActivateModule       func(moduleFolder string) error //Run the init script of the module in the given folder
+}
+
+type PackageInstaller struct {
+	options       *InstallerOptions
+	moduleHandler *ModuleHandler
+}
+
+func NewPackageInstaller(moduleHandler *ModuleHandler, options *InstallerOptions) (*PackageInstaller, error) {
+	err := options.Database.NewTable(packageTable)
+	if err != nil {
+		return nil, err
+	}
+	return &PackageInstaller{
+		options:       options,
+		moduleHandler: moduleHandler,
+	}, nil
+}
+
+/*
+	Trusted keys
+*/
+
+// Add a trusted ed25519 public key (base64 encoded) for package signature verification
+func (p *PackageInstaller) AddTrustedKey(name string, publicKey string) error {
+	name = strings.TrimSpace(name)
+	if name == "" || strings.Contains(name, "/") {
+		return errors.New("invalid key name")
+	}
+	rawKey, err := base64.StdEncoding.DecodeString(strings.TrimSpace(publicKey))
+	if err != nil || len(rawKey) != ed25519.PublicKeySize {
+		return errors.New("invalid ed25519 public key")
+	}
+	return p.options.Database.Write(packageTable, "trustedkey/"+name, TrustedKey{
+		Name:      name,
+		PublicKey: base64.StdEncoding.EncodeToString(rawKey),
+		AddTime:   time.Now().Unix(),
+	})
+}
+
+func (p *PackageInstaller) RemoveTrustedKey(name string) error {
+	if !p.options.Database.KeyExists(packageTable, "trustedkey/"+name) {
+		return errors.New("trusted key not found")
+	}
+	return p.options.Database.Delete(packageTable, "trustedkey/"+name)
+}
+
+func (p *PackageInstaller) ListTrustedKeys() []*TrustedKey {
+	results := []*TrustedKey{}
+	for _, value := range p.listRecords("trustedkey/") {
+		thisKey := TrustedKey{}
+		if json.Unmarshal(value, &thisKey) == nil {
+			results = append(results, &thisKey)
+		}
+	}
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].Name < results[j].Name
+	})
+	return results
+}
+
+/*
+	Installed packages
+*/
+
+func (p *PackageInstaller) ListInstalledPackages() []*InstalledPackage {
+	results := []*InstalledPackage{}
+	for _, value := range p.listRecords("installed/") {
+		thisPackage := InstalledPackage{}
+		if json.Unmarshal(value, &thisPackage) == nil {
+			results = append(results, &thisPackage)
+		}
+	}
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].Manifest.Name < results[j].Manifest.Name
+	})
+	return results
+}
+
+// Get the install record of the module folder, return nil if it is not installed as a package
+func (p *PackageInstaller) GetInstalledPackage(name string) *InstalledPackage {
+	installed := InstalledPackage{}
+	if p.options.Database.Read(packageTable, "installed/"+name, &installed) != nil || installed.Manifest == nil {
+		return nil
+	}
+	return &installed
+}
+
+func (p *PackageInstaller) listRecords(prefix string) [][]byte {
+	results := [][]byte{}
+	entries, err := p.options.Database.ListTable(packageTable)
+	if err != nil {
+		return results
+	}
+	for _, keypairs := range entries {
+		if strings.HasPrefix(string(keypairs[0]), prefix) {
+			results = append(results, keypairs[1])
+		}
+	}
+	return results
+}
+
+/*
+	Install and upgrade
+*/
+
+// Read and verify the package without installing it
+func (p *PackageInstaller) InspectZip(zipPath string) (*PackageInfo, error) {
+	archive, err := zip.OpenReader(zipPath)
+	if err != nil {
+		return nil, errors.New("invalid package file")
+	}
+	defer archive.Close()
+
+	info := PackageInfo{}
+	manifest, signer, err := p.verifyPackage(archive)
+	if manifest == nil {
+		return nil, err
+	}
+	info.Manifest = manifest
+	info.Signer = signer
+	if err != nil {
+		info.VerifyError = err.Error()
+	}
+	if installed := p.GetInstalledPackage(manifest.Name); installed != nil {
+		info.InstalledVersion = installed.Manifest.Version
+	}
+	return &info, nil
+}
+
+// Install or upgrade the module from a package zip file
+func (p *PackageInstaller) InstallFromZip(zipPath string) (*InstalledPackage, error) {
+	archive, err := zip.OpenReader(zipPath)
+	if err != nil {
+		return nil, errors.New("invalid package file")
+	}
+	defer archive.Close()
+	return p.Install(archive)
+}
+
+// Install or upgrade the module from a git repository with the package layout
+func (p *PackageInstaller) InstallFromGit(gitURL string) (*InstalledPackage, error) {
+	log.Println("[Module] Cloning module package from " + gitURL)
+	downloadFolder := filepath.Join(p.options.TmpDirectory, "download", uuid.NewV4().String())
+	os.MkdirAll(downloadFolder, 0777)
+	defer os.RemoveAll(downloadFolder)
+
+	_, err := git.PlainClone(downloadFolder, false, &git.CloneOptions{
+		URL:   gitURL,
+		Depth: 1,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return p.Install(os.DirFS(downloadFolder))
+}
+
+// Verify and install the package from the given source
+func (p *PackageInstaller) Install(source fs.FS) (*InstalledPackage, error) {
+	manifest, signer, err := p.verifyPackage(source)
+	if err != nil {
+		return nil, err
+	}
+
+	//Check if this is an upgrade
+	previous := p.GetInstalledPackage(manifest.Name)
+	moduleFolder := filepath.Join(p.options.WebRoot, manifest.Name)
+	if previous != nil {
+		if compareVersion(manifest.Version, previous.Manifest.Version) <= 0 {
+			return nil, errors.New("version " + previous.Manifest.Version + " or newer is already installed")
+		}
+	} else if _, err := os.Stat(moduleFolder); err == nil {
+		return nil, errors.New("module folder " + manifest.Name + " already exists and is not managed by the package installer")
+	}
+
+	//Install the required system packages
+	for _, pkgname := range manifest.RequirePkg {
+		if p.options.InstallSystemPackage == nil {
+			return nil, errors.New("required package " + pkgname + " cannot be installed")
+		}
+		if err := p.options.InstallSystemPackage(pkgname); err != nil {
+			return nil, errors.New("unable to install required package " + pkgname + ": " + err.Error())
+		}
+	}
+
+	//Extract the module to a staging folder in the web root so the swap is a rename
+	stagingFolder := filepath.Join(p.options.WebRoot, "."+manifest.Name+".installing")
+	rollbackFolder := filepath.Join(p.options.WebRoot, "."+manifest.Name+".rollback")
+	os.RemoveAll(stagingFolder)
+	os.RemoveAll(rollbackFolder)
+	if err := extractPackage(source, manifest, stagingFolder); err != nil {
+		os.RemoveAll(stagingFolder)
+		return nil, err
+	}
+
+	//Swap in the new version
+	if previous != nil {
+		if err := os.Rename(moduleFolder, rollbackFolder); err != nil {
+			os.RemoveAll(stagingFolder)
+			return nil, err
+		}
+	}
+	if err := os.Rename(filepath.Join(stagingFolder, manifest.Name), moduleFolder); err != nil {
+		p.rollback(manifest.Name, previous != nil)
+		os.RemoveAll(stagingFolder)
+		return nil, err
+	}
+	os.RemoveAll(stagingFolder)
+
+	//Activate the new version
+	p.moduleHandler.DeregisterModuleByFolder(manifest.Name)
+	if p.options.ActivateModule != nil {
+		if err := p.options.ActivateModule(moduleFolder); err != nil {
+			log.Println("[Module] " + manifest.Name + " " + manifest.Version + " failed to start. Rolling back")
+			p.moduleHandler.DeregisterModuleByFolder(manifest.Name)
+			p.rollback(manifest.Name, previous != nil)
+			if previous != nil {
+				p.options.ActivateModule(moduleFolder)
+			}
+			p.moduleHandler.ModuleSortList()
+			return nil, err
+		}
+	}
+	p.moduleHandler.ModuleSortList()
+	os.RemoveAll(rollbackFolder)
+
+	//Record the installed version
+	installed := InstalledPackage{
+		Manifest:    manifest,
+		Signer:      signer,
+		InstallTime: time.Now().Unix(),
+		UpdateTime:  time.Now().Unix(),
+	}
+	if previous != nil {
+		installed.InstallTime = previous.InstallTime
+		installed.PreviousVersion = previous.Manifest.Version
+	}
+	err = p.options.Database.Write(packageTable, "installed/"+manifest.Name, installed)
+	if err != nil {
+		return nil, err
+	}
+	log.Println("[Module] Installed " + manifest.Name + " " + manifest.Version + " signed by " + signer)
+	return &installed, nil
+}
+
+// Restore the previous version of the module folder, or remove the new one if this is a fresh install
+func (p *PackageInstaller) rollback(name string, hasPrevious bool) {
+	moduleFolder := filepath.Join(p.options.WebRoot, name)
+	os.RemoveAll(moduleFolder)
+	if hasPrevious {
+		err := os.Rename(filepath.Join(p.options.WebRoot, "."+name+".rollback"), moduleFolder)
+		if err != nil {
+			log.Println("[Module] Unable to restore previous version of " + name + ": " + err.Error())
+		}
+	}
+}
+
+/*
+	Uninstall
+*/
+
+// Uninstall the module by its name. Packages installed by the installer also get
+// their database tables removed. The appdata of a module is stored in its module
+// folder and is removed together with it
+func (p *PackageInstaller) Uninstall(moduleName string) error {
+	moduleFolder := ""
+	for _, mod := range p.moduleHandler.LoadedModule {
+		if mod.Name == moduleName && mod.StartDir != "" {
+			moduleFolder = strings.Split(filepath.ToSlash(mod.StartDir), "/")[0]
+			break
+		}
+	}
+
+	installed := p.GetInstalledPackage(moduleFolder)
+	if installed == nil {
+		installed = p.GetInstalledPackage(moduleName)
+	}
+	if installed == nil {
+		//Not installed via the package installer
+		return p.moduleHandler.UninstallModule(moduleName)
+	}
+
+	name := installed.Manifest.Name
+	log.Println("[Module] Uninstalling " + name + " " + installed.Manifest.Version)
+	if err := os.RemoveAll(filepath.Join(p.options.WebRoot, name)); err != nil {
+		return err
+	}
+	p.moduleHandler.DeregisterModuleByFolder(name)
+
+	for _, tableName := range installed.Manifest.Tables {
+		if !isModuleTable(name, tableName) {
+			log.Println("[Module] Skipping removal of table " + tableName + " not owned by " + name)
+			continue
+		}
+		if p.options.Database.TableExists(tableName) {
+			p.options.Database.DropTable(tableName)
+		}
+	}
+
+	return p.options.Database.Delete(packageTable, "installed/"+name)
+}
+
+// Check if the table is owned by the module, i.e. named {module} or {module}_*
+// in lower case. Tables of the system and other modules are never removed
+func isModuleTable(moduleName string, tableName string) bool {
+	prefix := strings.ToLower(moduleName)
+	return tableName != packageTable && (tableName == prefix || strings.HasPrefix(tableName, prefix+"_"))
+}
+
+/*
+	Package verification
+*/
+
+// Read the manifest and verify its signature and content. The manifest is returned
+// together with signature error so the package can still be inspected
+func (p *PackageInstaller) verifyPackage(source fs.FS) (*PackageManifest, string, error) {
+	manifestContent, err := fs.ReadFile(source, "manifest.json")
+	if err != nil {
+		return nil, "", errors.New("package manifest not found")
+	}
+	manifest := PackageManifest{}
+	if err := json.Unmarshal(manifestContent, &manifest); err != nil {
+		return nil, "", errors.New("invalid package manifest")
+	}
+	if err := p.validateManifest(&manifest); err != nil {
+		return nil, "", err
+	}
+
+	signature, err := fs.ReadFile(source, "manifest.sig")
+	if err != nil {
+		return &manifest, "", errors.New("package is not signed")
+	}
+	signer, err := p.verifySignature(manifestContent, signature)
+	if err != nil {
+		return &manifest, "", err
+	}
+
+	//Check the content of each file against the signed manifest
+	for filename, hash := range manifest.Files {
+		content, err := fs.ReadFile(source, filename)
+		if err != nil {
+			return &manifest, "", errors.New("file missing in package: " + filename)
+		}
+		checksum := sha256.Sum256(content)
+		if !strings.EqualFold(hex.EncodeToString(checksum[:]), hash) {
+			return &manifest, "", errors.New("checksum mismatch: " + filename)
+		}
+	}
+	return &manifest, signer, nil
+}
+
+func (p *PackageInstaller) validateManifest(manifest *PackageManifest) error {
+	if manifest.Name == "" || manifest.Name != filepath.Base(manifest.Name) || strings.HasPrefix(manifest.Name, ".") || manifest.Name == "SystemAO" {
+		return errors.New("invalid module name in manifest")
+	}
+	if !isValidVersion(manifest.Version) {
+		return errors.New("invalid version in manifest")
+	}
+	if manifest.MinAGIVersion != "" {
+		if !isValidVersion(manifest.MinAGIVersion) {
+			return errors.New("invalid minimum AGI version in manifest")
+		}
+		if compareVersion(manifest.MinAGIVersion, p.options.AGIVersion) > 0 {
+			return errors.New("this module requires AGI " + manifest.MinAGIVersion + " or above")
+		}
+	}
+
+	initScriptFound := false
+	for filename := range manifest.Files {
+		if !fs.ValidPath(filename) || !strings.HasPrefix(filename, manifest.Name+"/") {
+			return errors.New("invalid file path in manifest: " + filename)
+		}
+		if filename == manifest.Name+"/init.agi" {
+			initScriptFound = true
+		}
+	}
+	if !initScriptFound {
+		return errors.New("init.agi not found in package")
+	}
+	return nil
+}
+
+// Verify the manifest signature with the trusted keys, return the name of the signer
+func (p *PackageInstaller) verifySignature(manifestContent []byte, signature []byte) (string, error) {
+	rawSignature, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(signature)))
+	if err != nil || len(rawSignature) != ed25519.SignatureSize {
+		return "", errors.New("invalid package signature")
+	}
+	for _, trustedKey := range p.ListTrustedKeys() {
+		publicKey, err := base64.StdEncoding.DecodeString(trustedKey.PublicKey)
+		if err != nil || len(publicKey) != ed25519.PublicKeySize {
+			continue
+		}
+		if ed25519.Verify(ed25519.PublicKey(publicKey), manifestContent, rawSignature) {
+			return trustedKey.Name, nil
+		}
+	}
+	return "", errors.New("package is not signed by a trusted key")
+}
+
+// Extract the files listed in the manifest into the target folder
+func extractPackage(source fs.FS, manifest *PackageManifest, target string) error {
+	for filename := range manifest.Files {
+		destination := filepath.Join(target, filepath.FromSlash(filename))
+		if err := os.MkdirAll(filepath.Dir(destination), 0775); err != nil {
+			return err
+		}
+		src, err := source.Open(filename)
+		if err != nil {
+			return err
+		}
+		dst, err := os.OpenFile(destination, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0775)
+		if err != nil {
+			src.Close()
+			return err
+		}
+		_, err = io.Copy(dst, src)
+		src.Close()
+		dst.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Build a signed package from the module folder, for module developers and testing
+func BuildPackage(moduleFolder string, manifest PackageManifest, privateKey ed25519.PrivateKey, output io.Writer) error {
+	manifest.Name = filepath.Base(moduleFolder)
+	manifest.Files = map[string]string{}
+	files := map[string][]byte{}
+	err := filepath.WalkDir(moduleFolder, func(filename string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		relPath, err := filepath.Rel(moduleFolder, filename)
+		if err != nil {
+			return err
+		}
+		content, err := os.ReadFile(filename)
+		if err != nil {
+			return err
+		}
+		archivePath := path.Join(manifest.Name, filepath.ToSlash(relPath))
+		checksum := sha256.Sum256(content)
+		manifest.Files[archivePath] = hex.EncodeToString(checksum[:])
+		files[archivePath] = content
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	manifestContent, err := json.MarshalIndent(manifest, "", " ")
+	if err != nil {
+		return err
+	}
+	files["manifest.json"] = manifestContent
+	files["manifest.sig"] = []byte(base64.StdEncoding.EncodeToString(ed25519.Sign(privateKey, manifestContent)))
+
+	zw := zip.NewWriter(output)
+	for filename, content := range files {
+		w, err := zw.Create(filename)
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(content); err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
+
+/*
+	Version utilities
+*/
+
+func isValidVersion(version string) bool {
+	if version == "" {
+		return false
+	}
+	for _, chunk := range strings.Split(version, ".") {
+		if _, err := strconv.Atoi(chunk); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// Compare two dot separated numeric versions. Return -1 if a < b, 0 if a == b and 1 if a > b
+func compareVersion(a string, b string) int {
+	chunksA := strings.Split(a, ".")
+	chunksB := strings.Split(b, ".")
+	for i := 0; i < len(chunksA) || i < len(chunksB); i++ {
+		valueA, valueB := 0, 0
+		if i < len(chunksA) {
+			valueA, _ = strconv.Atoi(chunksA[i])
+		}
+		if i < len(chunksB) {
+			valueB, _ = strconv.Atoi(chunksB[i])
+		}
+		if valueA != valueB {
+			if valueA < valueB {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+/*
+	Handlers
+*/
+
+// List the packages installed by the package installer
+func (p *PackageInstaller) HandleListInstalledPackages(w http.ResponseWriter, r *http.Request) {
+	js, _ := json.Marshal(p.ListInstalledPackages())
+	utils.SendJSONResponse(w, string(js))
+}
+
+// List, add or remove the trusted package signing keys
+func (p *PackageInstaller) HandleTrustedKeys(w http.ResponseWriter, r *http.Request) {
+	opr, _ := utils.PostPara(r, "opr")
+	if opr == "add" {
+		name, err := utils.PostPara(r, "name")
+		if err != nil {
+			utils.SendErrorResponse(w, "invalid key name")
+			return
+		}
+		publicKey, err := utils.PostPara(r, "key")
+		if err != nil {
+			utils.SendErrorResponse(w, "invalid public key")
+			return
+		}
+		err = p.AddTrustedKey(name, publicKey)
+		if err != nil {
+			utils.SendErrorResponse(w, err.Error())
+			return
+		}
+		utils.SendOK(w)
+	} else if opr == "remove" {
+		name, err := utils.PostPara(r, "name")
+		if err != nil {
+			utils.SendErrorResponse(w, "invalid key name")
+			return
+		}
+		err = p.RemoveTrustedKey(name)
+		if err != nil {
+			utils.SendErrorResponse(w, err.Error())
+			return
+		}
+		utils.SendOK(w)
+	} else {
+		js, _ := json.Marshal(p.ListTrustedKeys())
+		utils.SendJSONResponse(w, string(js))
+	}
+}
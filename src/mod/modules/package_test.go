@@ -0,0 +1,153 @@
+package modules
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"imuslab.com/arozos/mod/database"
+)
+
+func buildTestPackage(t *testing.T, folder string, version string, initScript string, privateKey ed25519.PrivateKey) string {
+	moduleFolder := filepath.Join(folder, "src", "Demo")
+	os.MkdirAll(moduleFolder, 0755)
+	os.WriteFile(filepath.Join(moduleFolder, "init.agi"), []byte(initScript), 0644)
+	os.WriteFile(filepath.Join(moduleFolder, "index.html"), []byte(version), 0644)
+
+	buf := bytes.Buffer{}
+	err := BuildPackage(moduleFolder, PackageManifest{
+		Version:       version,
+		MinAGIVersion: "3.0",
+		Tables:        []string{"demo", "demo_cache", "auth", "demonstration"},
+	}, privateKey, &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	filename := filepath.Join(folder, "demo-"+version+".zip")
+	os.WriteFile(filename, buf.Bytes(), 0644)
+	return filename
+}
+
+func TestPackageInstallUpgradeAndUninstall(t *testing.T) {
+	tmp := t.TempDir()
+	sysdb, err := database.NewDatabase(filepath.Join(tmp, "test.db"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sysdb.Close()
+
+	webRoot := filepath.Join(tmp, "web")
+	os.MkdirAll(webRoot, 0755)
+	installer, err := NewPackageInstaller(NewModuleHandler(nil, tmp), &InstallerOptions{
+		Database:   sysdb,
+		WebRoot:    webRoot,
+		AGIVersion: "3.0",
+		ActivateModule: func(moduleFolder string) error {
+			content, _ := os.ReadFile(filepath.Join(moduleFolder, "init.agi"))
+			if string(content) == "broken" {
+				return errors.New("init failed")
+			}
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	publicKey, privateKey, _ := ed25519.GenerateKey(nil)
+	pkg := buildTestPackage(t, tmp, "1.0.0", "ok", privateKey)
+
+	//Reject packages signed by unknown keys
+	if _, err := installer.InstallFromZip(pkg); err == nil {
+		t.Fatal("untrusted package installed")
+	}
+	if err := installer.AddTrustedKey("dev", base64.StdEncoding.EncodeToString(publicKey)); err != nil {
+		t.Fatal(err)
+	}
+	installed, err := installer.InstallFromZip(pkg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if installed.Signer != "dev" || installer.GetInstalledPackage("Demo").Manifest.Version != "1.0.0" {
+		t.Fatalf("unexpected install record %+v", installed)
+	}
+
+	//Downgrade or reinstall is rejected, failed upgrade is rolled back
+	if _, err := installer.InstallFromZip(pkg); err == nil {
+		t.Fatal("same version reinstalled")
+	}
+	if _, err := installer.InstallFromZip(buildTestPackage(t, tmp, "1.1.0", "broken", privateKey)); err == nil {
+		t.Fatal("broken upgrade installed")
+	}
+	if content, _ := os.ReadFile(filepath.Join(webRoot, "Demo", "index.html")); string(content) != "1.0.0" {
+		t.Fatal("failed upgrade not rolled back")
+	}
+	installed, err = installer.InstallFromZip(buildTestPackage(t, tmp, "1.2.0", "ok", privateKey))
+	if err != nil || installed.PreviousVersion != "1.0.0" {
+		t.Fatalf("upgrade failed: %v", err)
+	}
+
+	//Uninstall removes the module folder and the tables prefixed by the module name only
+	for _, tableName := range []string{"demo", "demo_cache", "auth", "demonstration"} {
+		sysdb.NewTable(tableName)
+	}
+	if err := installer.Uninstall("Demo"); err != nil {
+		t.Fatal(err)
+	}
+	if sysdb.TableExists("demo") || sysdb.TableExists("demo_cache") || installer.GetInstalledPackage("Demo") != nil {
+		t.Fatal("module not cleaned up")
+	}
+	if !sysdb.TableExists("auth") || !sysdb.TableExists("demonstration") {
+		t.Fatal("table not owned by the module removed")
+	}
+	if _, err := os.Stat(filepath.Join(webRoot, "Demo")); err == nil {
+		t.Fatal("module folder not removed")
+	}
+}
+
+func TestTamperedPackageRejected(t *testing.T) {
+	tmp := t.TempDir()
+	sysdb, _ := database.NewDatabase(filepath.Join(tmp, "test.db"), false)
+	defer sysdb.Close()
+	installer, _ := NewPackageInstaller(NewModuleHandler(nil, tmp), &InstallerOptions{
+		Database:   sysdb,
+		WebRoot:    filepath.Join(tmp, "web"),
+		AGIVersion: "3.0",
+	})
+	publicKey, privateKey, _ := ed25519.GenerateKey(nil)
+	installer.AddTrustedKey("dev", base64.StdEncoding.EncodeToString(publicKey))
+	pkg := buildTestPackage(t, tmp, "1.0.0", "ok", privateKey)
+
+	//Replace the init script after signing
+	original, _ := zip.OpenReader(pkg)
+	buf := bytes.Buffer{}
+	zw := zip.NewWriter(&buf)
+	for _, file := range original.File {
+		w, _ := zw.Create(file.Name)
+		if file.Name == "Demo/init.agi" {
+			w.Write([]byte("tampered"))
+			continue
+		}
+		r, _ := file.Open()
+		content := bytes.Buffer{}
+		content.ReadFrom(r)
+		r.Close()
+		w.Write(content.Bytes())
+	}
+	zw.Close()
+	original.Close()
+	os.WriteFile(pkg, buf.Bytes(), 0644)
+
+	info, err := installer.InspectZip(pkg)
+	if err != nil || info.VerifyError == "" {
+		t.Fatal("tampered package not detected")
+	}
+	if _, err := installer.InstallFromZip(pkg); err == nil {
+		t.Fatal("tampered package installed")
+	}
+}
@@ -0,0 +1,385 @@
+package acme
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"imuslab.com/arozos/mod/database"
+)
+
+/*
+	ACME Certificate Manager
+
+	Obtain and renew TLS certificates from Let's Encrypt or any
+	other ACME compatible CA, using the HTTP-01 or TLS-ALPN-01
+	challenge. Hostnames not covered by the ACME certificate are
+	served with the fallback certificate given in startup flags
+*/
+
+const (
+	acmeTable = "acme"
+
+	ChallengeHTTP01    = "http-01"
+	ChallengeTLSALPN01 = "tls-alpn-01"
+
+	LetsEncryptURL = "https://acme-v02.api.letsencrypt.org/directory"
+)
+
+type Options struct {
+	Database         *database.Database
+	StorePath        string        //Folder for the account key and certificate, e.g. ./system/acme/
+	FallbackCert     string        //Certificate file used for hostnames not managed by ACME
+	FallbackKey      string        //Key file of the fallback certificate
+	RenewBefore      time.Duration //Renew the certificate this long before it expires, default 30 days
+	FailureThreshold int           //Consecutive renew failures before OnRenewFailed is called, default 3
+	TLSEnabled       bool          //If the HTTPS server is running, shown in status only
+
+	OnRenewFailed func(status *Status) error //Called when renew keeps failing, called again on next failure if this return error
+}
+
+type Config struct {
+	Enabled      bool
+	Email        string
+	Domains      []string
+	DirectoryURL string   //ACME directory, default Let's Encrypt. Change this to use a private CA
+	Challenges   []string //Challenge types in the order of preference, default tls-alpn-01 then http-01
+	EABKeyID     string   //External account binding required by some CA
+	EABHMACKey   string   //Base64url encoded MAC key of the external account binding
+	TrustedRoot  string   //PEM encoded root certificate of a private CA directory
+}
+
+type Status struct {
+	Domains     []string //Domains covered by the current certificate
+	Issuer      string
+	NotBefore   int64
+	NotAfter    int64
+	LastAttempt int64 //Unix time of the last obtain or renew attempt
+	LastRenewed int64
+	LastError   string
+	Failures    int  //Consecutive failures since the last success
+	Notified    bool //If the failure notification has been sent
+}
+
+type Manager struct {
+	options     *Options
+	mutex       sync.RWMutex
+	config      *Config
+	status      *Status
+	certificate *tls.Certificate //Certificate obtained from ACME, nil if not available
+	fallback    *tls.Certificate
+	httpTokens  sync.Map //Token -> key authorization of pending HTTP-01 challenges
+	alpnCerts   sync.Map //Domain -> *tls.Certificate of pending TLS-ALPN-01 challenges
+	renewMutex  sync.Mutex
+	wake        chan bool
+	stop        chan bool
+
+	//Obtain a certificate for the given config, replaced in tests
+	obtain func(ctx context.Context, config *Config) (*tls.Certificate, error)
+}
+
+// Create a new ACME manager and load the stored certificate
+func NewManager(options *Options) (*Manager, error) {
+	if options.RenewBefore <= 0 {
+		options.RenewBefore = 30 * 24 * time.Hour
+	}
+	if options.FailureThreshold <= 0 {
+		options.FailureThreshold = 3
+	}
+	err := os.MkdirAll(options.StorePath, 0700)
+	if err != nil {
+		return nil, err
+	}
+	options.Database.NewTable(acmeTable)
+
+	m := &Manager{
+		options: options,
+		config:  &Config{},
+		status:  &Status{},
+		wake:    make(chan bool, 1),
+		stop:    make(chan bool),
+	}
+	m.obtain = m.obtainCertificate
+	if options.Database.KeyExists(acmeTable, "config") {
+		options.Database.Read(acmeTable, "config", m.config)
+	}
+	if options.Database.KeyExists(acmeTable, "status") {
+		options.Database.Read(acmeTable, "status", m.status)
+	}
+
+	//Load the certificate obtained in previous runs
+	cert, err := tls.LoadX509KeyPair(m.certPath(), m.keyPath())
+	if err == nil {
+		m.setCertificate(&cert)
+	}
+
+	//Fallback certificate is optional
+	fallback, err := tls.LoadX509KeyPair(options.FallbackCert, options.FallbackKey)
+	if err == nil {
+		m.fallback = &fallback
+	}
+	return m, nil
+}
+
+func (m *Manager) certPath() string {
+	return filepath.Join(m.options.StorePath, "cert.pem")
+}
+
+func (m *Manager) keyPath() string {
+	return filepath.Join(m.options.StorePath, "key.pem")
+}
+
+// Start the renew loop in background
+func (m *Manager) Start() {
+	go func() {
+		ticker := time.NewTicker(time.Hour)
+		defer ticker.Stop()
+		m.renewIfNeeded(time.Now())
+		for {
+			select {
+			case <-m.stop:
+				return
+			case <-m.wake:
+				m.renewIfNeeded(time.Now())
+			case now := <-ticker.C:
+				m.renewIfNeeded(now)
+			}
+		}
+	}()
+}
+
+// Stop the renew loop
+func (m *Manager) Close() {
+	close(m.stop)
+}
+
+// Get a copy of the current config
+func (m *Manager) GetConfig() *Config {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	config := *m.config
+	config.Domains = append([]string{}, m.config.Domains...)
+	config.Challenges = append([]string{}, m.config.Challenges...)
+	return &config
+}
+
+// Update the config and obtain a new certificate if needed
+func (m *Manager) SetConfig(config *Config) error {
+	domains := []string{}
+	for _, domain := range config.Domains {
+		domain = strings.ToLower(strings.TrimSpace(domain))
+		if domain == "" {
+			continue
+		}
+		if strings.Contains(domain, "*") {
+			return errors.New("wildcard domains require DNS-01 challenge which is not supported")
+		}
+		if net.ParseIP(domain) != nil || !strings.Contains(domain, ".") {
+			return errors.New("invalid domain: " + domain)
+		}
+		domains = append(domains, domain)
+	}
+	if config.Enabled && len(domains) == 0 {
+		return errors.New("at least one domain is required")
+	}
+	for _, challenge := range config.Challenges {
+		if challenge != ChallengeHTTP01 && challenge != ChallengeTLSALPN01 {
+			return errors.New("unsupported challenge type: " + challenge)
+		}
+	}
+	if config.TrustedRoot != "" && !x509.NewCertPool().AppendCertsFromPEM([]byte(config.TrustedRoot)) {
+		return errors.New("invalid trusted root certificate")
+	}
+	config.Domains = domains
+
+	m.mutex.Lock()
+	m.config = config
+	//Retry immediately with the new config
+	m.status.Failures = 0
+	m.status.Notified = false
+	m.mutex.Unlock()
+	err := m.options.Database.Write(acmeTable, "config", config)
+	if err != nil {
+		return err
+	}
+
+	//Check on the renew loop now
+	select {
+	case m.wake <- true:
+	default:
+	}
+	return nil
+}
+
+// Get a copy of the certificate status
+func (m *Manager) GetStatus() *Status {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	status := *m.status
+	status.Domains = append([]string{}, m.status.Domains...)
+	return &status
+}
+
+// Update the status with the details of the given certificate
+func (m *Manager) setCertificate(cert *tls.Certificate) {
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return
+	}
+	cert.Leaf = leaf
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.certificate = cert
+	m.status.Domains = append([]string{}, leaf.DNSNames...)
+	m.status.Issuer = leaf.Issuer.CommonName
+	m.status.NotBefore = leaf.NotBefore.Unix()
+	m.status.NotAfter = leaf.NotAfter.Unix()
+}
+
+// Check if the certificate should be obtained or renewed now
+func (m *Manager) needsRenew(now time.Time) bool {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	if !m.config.Enabled || len(m.config.Domains) == 0 {
+		return false
+	}
+	if m.certificate == nil || !sameDomains(m.certificate.Leaf.DNSNames, m.config.Domains) {
+		return true
+	}
+	return now.Add(m.options.RenewBefore).After(m.certificate.Leaf.NotAfter)
+}
+
+// Back off after failures, 1 hour after the first failure and doubled up to 1 day
+func (m *Manager) retryAfter() time.Duration {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	if m.status.Failures == 0 {
+		return 0
+	}
+	delay := time.Hour << (m.status.Failures - 1)
+	if m.status.Failures > 5 || delay > 24*time.Hour {
+		delay = 24 * time.Hour
+	}
+	return delay
+}
+
+func (m *Manager) renewIfNeeded(now time.Time) {
+	if !m.needsRenew(now) {
+		return
+	}
+	m.mutex.RLock()
+	lastAttempt := time.Unix(m.status.LastAttempt, 0)
+	m.mutex.RUnlock()
+	if now.Sub(lastAttempt) < m.retryAfter() {
+		return
+	}
+	m.Renew(now)
+}
+
+// Obtain or renew the certificate now, regardless of its expiry
+func (m *Manager) Renew(now time.Time) error {
+	config := m.GetConfig()
+	if !config.Enabled {
+		return errors.New("ACME is not enabled")
+	}
+	m.renewMutex.Lock()
+	defer m.renewMutex.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+	cert, err := m.obtain(ctx, config)
+
+	m.mutex.Lock()
+	m.status.LastAttempt = now.Unix()
+	if err != nil {
+		m.status.Failures++
+		m.status.LastError = err.Error()
+		log.Println("[ACME] Unable to obtain certificate for " + strings.Join(config.Domains, ", ") + ": " + err.Error())
+	} else {
+		m.status.Failures = 0
+		m.status.LastError = ""
+		m.status.Notified = false
+		m.status.LastRenewed = now.Unix()
+		log.Println("[ACME] Certificate obtained for " + strings.Join(config.Domains, ", "))
+	}
+	shouldNotify := err != nil && !m.status.Notified && m.status.Failures >= m.options.FailureThreshold
+	m.mutex.Unlock()
+
+	if err == nil {
+		m.setCertificate(cert)
+	} else if shouldNotify && m.options.OnRenewFailed != nil {
+		if notifyErr := m.options.OnRenewFailed(m.GetStatus()); notifyErr == nil {
+			m.mutex.Lock()
+			m.status.Notified = true
+			m.mutex.Unlock()
+		} else {
+			log.Println("[ACME] Unable to send renew failure notification: " + notifyErr.Error())
+		}
+	}
+
+	m.options.Database.Write(acmeTable, "status", m.GetStatus())
+	return err
+}
+
+/*
+GetCertificate is used as tls.Config.GetCertificate of the HTTPS server.
+It answers TLS-ALPN-01 challenges, serves the ACME certificate to its
+domains and the fallback certificate to everything else
+*/
+func (m *Manager) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	serverName := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+	if len(hello.SupportedProtos) == 1 && hello.SupportedProtos[0] == acme.ALPNProto {
+		if cert, ok := m.alpnCerts.Load(serverName); ok {
+			return cert.(*tls.Certificate), nil
+		}
+		return nil, errors.New("no pending TLS-ALPN-01 challenge for " + serverName)
+	}
+
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	if m.certificate != nil && m.config.Enabled && m.certificate.Leaf.VerifyHostname(serverName) == nil {
+		return m.certificate, nil
+	}
+	if m.fallback != nil {
+		return m.fallback, nil
+	}
+	if m.certificate != nil {
+		//Better than failing the handshake
+		return m.certificate, nil
+	}
+	return nil, errors.New("no certificate available")
+}
+
+// Create the TLS config for the HTTPS server
+func (m *Manager) TLSConfig() *tls.Config {
+	return &tls.Config{
+		GetCertificate: m.GetCertificate,
+		NextProtos:     []string{"h2", "http/1.1", acme.ALPNProto},
+	}
+}
+
+func sameDomains(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	x := append([]string{}, a...)
+	y := append([]string{}, b...)
+	sort.Strings(x)
+	sort.Strings(y)
+	for i := range x {
+		if !strings.EqualFold(x[i], y[i]) {
+			return false
+		}
+	}
+	return true
+}
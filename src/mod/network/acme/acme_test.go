@@ -0,0 +1,177 @@
+package acme
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"imuslab.com/arozos/mod/database"
+)
+
+// Create a self-signed certificate for the given domains
+func testCertificate(t *testing.T, domains []string, notAfter time.Time) *tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: domains[0]},
+		Issuer:       pkix.Name{CommonName: "Test CA"},
+		DNSNames:     domains,
+		NotBefore:    notAfter.Add(-90 * 24 * time.Hour),
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func newTestManager(t *testing.T) *Manager {
+	dir := t.TempDir()
+	sysdb, err := database.NewDatabase(filepath.Join(dir, "test.db"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(sysdb.Close)
+	m, err := NewManager(&Options{
+		Database:  sysdb,
+		StorePath: filepath.Join(dir, "acme"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestRenewFailureNotification(t *testing.T) {
+	m := newTestManager(t)
+	notified := 0
+	m.options.OnRenewFailed = func(status *Status) error {
+		notified++
+		return nil
+	}
+
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	failing := true
+	obtained := 0
+	m.obtain = func(ctx context.Context, config *Config) (*tls.Certificate, error) {
+		if failing {
+			return nil, errors.New("connection refused")
+		}
+		obtained++
+		return testCertificate(t, config.Domains, now.Add(90*24*time.Hour)), nil
+	}
+
+	//Nothing to do when disabled
+	m.renewIfNeeded(now)
+	if m.GetStatus().LastAttempt != 0 {
+		t.Fatal("renew attempted while disabled")
+	}
+
+	err := m.SetConfig(&Config{Enabled: true, Domains: []string{"Aroz.Example.com", " "}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.GetConfig().Domains[0] != "aroz.example.com" || len(m.GetConfig().Domains) != 1 {
+		t.Fatalf("domains not normalized: %v", m.GetConfig().Domains)
+	}
+
+	//Retry with back off, notify once after the third failure
+	for i := 0; i < 12; i++ {
+		m.renewIfNeeded(now)
+		now = now.Add(30 * time.Minute)
+	}
+	status := m.GetStatus()
+	if status.Failures != 3 || notified != 1 || status.LastError == "" {
+		t.Fatalf("unexpected failures %d, notified %d", status.Failures, notified)
+	}
+	m.renewIfNeeded(now.Add(24 * time.Hour))
+	if notified != 1 || m.GetStatus().Failures != 4 {
+		t.Fatal("notified again before success")
+	}
+
+	//Success clears the failures
+	failing = false
+	now = now.Add(48 * time.Hour)
+	m.renewIfNeeded(now)
+	status = m.GetStatus()
+	if obtained != 1 || status.Failures != 0 || status.Notified || status.NotAfter != now.Add(90*24*time.Hour).Unix() {
+		t.Fatalf("unexpected status after success %+v", status)
+	}
+
+	//Renewed only when close to expiry
+	m.renewIfNeeded(now.Add(30 * 24 * time.Hour))
+	if obtained != 1 {
+		t.Fatal("renewed too early")
+	}
+	m.renewIfNeeded(now.Add(61 * 24 * time.Hour))
+	if obtained != 2 {
+		t.Fatal("not renewed before expiry")
+	}
+
+	//Domain change requires a new certificate
+	m.SetConfig(&Config{Enabled: true, Domains: []string{"aroz.example.com", "nas.example.com"}})
+	m.renewIfNeeded(now.Add(61 * 24 * time.Hour))
+	if obtained != 3 {
+		t.Fatal("not obtained after domain change")
+	}
+
+	if err := m.SetConfig(&Config{Enabled: true, Domains: []string{"*.example.com"}}); err == nil {
+		t.Fatal("wildcard domain accepted")
+	}
+}
+
+func TestGetCertificate(t *testing.T) {
+	m := newTestManager(t)
+	m.fallback = testCertificate(t, []string{"localhost"}, time.Now().Add(time.Hour))
+	m.SetConfig(&Config{Enabled: true, Domains: []string{"aroz.example.com"}})
+	m.setCertificate(testCertificate(t, []string{"aroz.example.com"}, time.Now().Add(time.Hour)))
+
+	cert, err := m.GetCertificate(&tls.ClientHelloInfo{ServerName: "aroz.example.com"})
+	if err != nil || cert != m.certificate {
+		t.Fatal("ACME certificate not served to its domain")
+	}
+	cert, err = m.GetCertificate(&tls.ClientHelloInfo{ServerName: "192.168.1.10"})
+	if err != nil || cert != m.fallback {
+		t.Fatal("fallback certificate not served to other hostnames")
+	}
+
+	//TLS-ALPN-01 challenge
+	_, err = m.GetCertificate(&tls.ClientHelloInfo{ServerName: "aroz.example.com", SupportedProtos: []string{acme.ALPNProto}})
+	if err == nil {
+		t.Fatal("challenge answered without pending challenge")
+	}
+	challengeCert := testCertificate(t, []string{"aroz.example.com"}, time.Now().Add(time.Hour))
+	m.alpnCerts.Store("aroz.example.com", challengeCert)
+	cert, err = m.GetCertificate(&tls.ClientHelloInfo{ServerName: "aroz.example.com", SupportedProtos: []string{acme.ALPNProto}})
+	if err != nil || cert != challengeCert {
+		t.Fatal("TLS-ALPN-01 challenge not answered")
+	}
+
+	//HTTP-01 challenge
+	m.httpTokens.Store("token123", "token123.thumbprint")
+	recorder := httptest.NewRecorder()
+	m.HandleHTTPChallenge(recorder, httptest.NewRequest("GET", "/.well-known/acme-challenge/token123", nil))
+	if recorder.Body.String() != "token123.thumbprint" {
+		t.Fatalf("unexpected challenge response %q", recorder.Body.String())
+	}
+	recorder = httptest.NewRecorder()
+	m.HandleHTTPChallenge(recorder, httptest.NewRequest("GET", "/.well-known/acme-challenge/other", nil))
+	if recorder.Code != 404 {
+		t.Fatal("unknown token answered")
+	}
+}
@@ -0,0 +1,98 @@
+package acme
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"imuslab.com/arozos/mod/utils"
+)
+
+// Answer the HTTP-01 challenge, must be reachable without login at /.well-known/acme-challenge/
+func (m *Manager) HandleHTTPChallenge(w http.ResponseWriter, r *http.Request) {
+	token := strings.TrimPrefix(r.URL.Path, "/.well-known/acme-challenge/")
+	response, ok := m.httpTokens.Load(token)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte(response.(string)))
+}
+
+// Get the config and certificate status. The external account binding key is not returned
+func (m *Manager) HandleStatus(w http.ResponseWriter, r *http.Request) {
+	config := m.GetConfig()
+	hasEABKey := config.EABHMACKey != ""
+	config.EABHMACKey = ""
+	js, _ := json.Marshal(map[string]interface{}{
+		"config":     config,
+		"hasEABKey":  hasEABKey,
+		"status":     m.GetStatus(),
+		"tlsEnabled": m.options.TLSEnabled,
+	})
+	utils.SendJSONResponse(w, string(js))
+}
+
+// Update the config. Domains and challenges are comma or newline separated
+func (m *Manager) HandleSetConfig(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		utils.SendErrorResponse(w, "invalid request method")
+		return
+	}
+	enabled, _ := utils.PostBool(r, "enabled")
+	email, _ := utils.PostPara(r, "email")
+	domains, _ := utils.PostPara(r, "domains")
+	directory, _ := utils.PostPara(r, "directory")
+	challenges, _ := utils.PostPara(r, "challenges")
+	eabKeyID, _ := utils.PostPara(r, "eabKid")
+	eabKey, _ := utils.PostPara(r, "eabKey")
+	trustedRoot, _ := utils.PostPara(r, "trustedRoot")
+
+	current := m.GetConfig()
+	if eabKey == "" && eabKeyID == current.EABKeyID {
+		//Key is not sent back to the client, keep the current one
+		eabKey = current.EABHMACKey
+	}
+
+	err := m.SetConfig(&Config{
+		Enabled:      enabled,
+		Email:        strings.TrimSpace(email),
+		Domains:      splitList(domains),
+		DirectoryURL: strings.TrimSpace(directory),
+		Challenges:   splitList(challenges),
+		EABKeyID:     strings.TrimSpace(eabKeyID),
+		EABHMACKey:   strings.TrimSpace(eabKey),
+		TrustedRoot:  strings.TrimSpace(trustedRoot),
+	})
+	if err != nil {
+		utils.SendErrorResponse(w, err.Error())
+		return
+	}
+	utils.SendOK(w)
+}
+
+// Obtain or renew the certificate now
+func (m *Manager) HandleRenew(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		utils.SendErrorResponse(w, "invalid request method")
+		return
+	}
+	err := m.Renew(time.Now())
+	if err != nil {
+		utils.SendErrorResponse(w, err.Error())
+		return
+	}
+	utils.SendOK(w)
+}
+
+func splitList(value string) []string {
+	results := []string{}
+	for _, item := range strings.FieldsFunc(value, func(r rune) bool {
+		return r == ',' || r == '\n' || r == '\r' || r == ' '
+	}) {
+		results = append(results, item)
+	}
+	return results
+}
@@ -0,0 +1,235 @@
+package acme
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/acme"
+)
+
+/*
+	Certificate Issuing
+
+	Register the account, complete the challenges of
+	all domains and download the signed certificate
+*/
+
+// Load the account key or create one if it does not exists
+func (m *Manager) accountKey() (crypto.Signer, error) {
+	keyFile := filepath.Join(m.options.StorePath, "account.key")
+	content, err := os.ReadFile(keyFile)
+	if err == nil {
+		block, _ := pem.Decode(content)
+		if block == nil {
+			return nil, errors.New("invalid account key")
+		}
+		return x509.ParseECPrivateKey(block.Bytes)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	err = os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600)
+	return key, err
+}
+
+func (m *Manager) newClient(config *Config) (*acme.Client, error) {
+	key, err := m.accountKey()
+	if err != nil {
+		return nil, err
+	}
+	client := &acme.Client{
+		Key:          key,
+		DirectoryURL: config.DirectoryURL,
+		UserAgent:    "ArozOS",
+	}
+	if client.DirectoryURL == "" {
+		client.DirectoryURL = LetsEncryptURL
+	}
+	if config.TrustedRoot != "" {
+		pool := x509.NewCertPool()
+		pool.AppendCertsFromPEM([]byte(config.TrustedRoot))
+		client.HTTPClient = &http.Client{
+			Timeout: 30 * time.Second,
+			Transport: &http.Transport{
+				Proxy:           http.ProxyFromEnvironment,
+				TLSClientConfig: &tls.Config{RootCAs: pool},
+			},
+		}
+	}
+	return client, nil
+}
+
+// Obtain a certificate covering all domains in config
+func (m *Manager) obtainCertificate(ctx context.Context, config *Config) (*tls.Certificate, error) {
+	client, err := m.newClient(config)
+	if err != nil {
+		return nil, err
+	}
+
+	account := &acme.Account{}
+	if config.Email != "" {
+		account.Contact = []string{"mailto:" + config.Email}
+	}
+	if config.EABKeyID != "" {
+		hmacKey, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(config.EABHMACKey, "="))
+		if err != nil {
+			return nil, errors.New("invalid external account binding key")
+		}
+		account.ExternalAccountBinding = &acme.ExternalAccountBinding{KID: config.EABKeyID, Key: hmacKey}
+	}
+	_, err = client.Register(ctx, account, acme.AcceptTOS)
+	if err != nil && !errors.Is(err, acme.ErrAccountAlreadyExists) {
+		return nil, err
+	}
+
+	challenges := config.Challenges
+	if len(challenges) == 0 {
+		challenges = []string{ChallengeTLSALPN01, ChallengeHTTP01}
+	}
+
+	//An authorization failed with one challenge type is invalid, try the next type with a new order
+	var lastErr error
+	for _, challengeType := range challenges {
+		cert, err := m.obtainWithChallenge(ctx, client, config.Domains, challengeType)
+		if err == nil {
+			return cert, nil
+		}
+		lastErr = errors.New(challengeType + ": " + err.Error())
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, lastErr
+}
+
+func (m *Manager) obtainWithChallenge(ctx context.Context, client *acme.Client, domains []string, challengeType string) (*tls.Certificate, error) {
+	order, err := client.AuthorizeOrder(ctx, acme.DomainIDs(domains...))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, authzURL := range order.AuthzURLs {
+		authz, err := client.GetAuthorization(ctx, authzURL)
+		if err != nil {
+			return nil, err
+		}
+		if authz.Status == acme.StatusValid {
+			continue
+		}
+
+		var challenge *acme.Challenge
+		for _, c := range authz.Challenges {
+			if c.Type == challengeType {
+				challenge = c
+				break
+			}
+		}
+		if challenge == nil {
+			return nil, errors.New("challenge not offered by the CA for " + authz.Identifier.Value)
+		}
+
+		cleanup, err := m.prepareChallenge(client, authz.Identifier.Value, challenge)
+		if err != nil {
+			return nil, err
+		}
+		_, err = client.Accept(ctx, challenge)
+		if err == nil {
+			_, err = client.WaitAuthorization(ctx, authz.URI)
+		}
+		cleanup()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	order, err = client.WaitOrder(ctx, order.URI)
+	if err != nil {
+		return nil, err
+	}
+
+	//Create the certificate key and signing request
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: domains[0]},
+		DNSNames: domains,
+	}, key)
+	if err != nil {
+		return nil, err
+	}
+	chain, _, err := client.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+	if err != nil {
+		return nil, err
+	}
+	return m.saveCertificate(chain, key)
+}
+
+// Setup the response of the challenge, return a function to remove it after validation
+func (m *Manager) prepareChallenge(client *acme.Client, domain string, challenge *acme.Challenge) (func(), error) {
+	switch challenge.Type {
+	case ChallengeHTTP01:
+		response, err := client.HTTP01ChallengeResponse(challenge.Token)
+		if err != nil {
+			return nil, err
+		}
+		m.httpTokens.Store(challenge.Token, response)
+		return func() { m.httpTokens.Delete(challenge.Token) }, nil
+	case ChallengeTLSALPN01:
+		cert, err := client.TLSALPN01ChallengeCert(challenge.Token, domain)
+		if err != nil {
+			return nil, err
+		}
+		m.alpnCerts.Store(domain, &cert)
+		return func() { m.alpnCerts.Delete(domain) }, nil
+	}
+	return nil, errors.New("unsupported challenge type: " + challenge.Type)
+}
+
+// Write the certificate chain and key to the store folder
+func (m *Manager) saveCertificate(chain [][]byte, key *ecdsa.PrivateKey) (*tls.Certificate, error) {
+	certPEM := []byte{}
+	for _, der := range chain {
+		certPEM = append(certPEM, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, err
+	}
+	err = os.WriteFile(m.keyPath(), keyPEM, 0600)
+	if err != nil {
+		return nil, err
+	}
+	err = os.WriteFile(m.certPath(), certPEM, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &cert, nil
+}
@@ -11,6 +11,7 @@ import (
 	"sync"
 	"time"
 
+	"imuslab.com/arozos/mod/database"
 	"imuslab.com/arozos/mod/network/dynamicproxy/dpcore"
 	"imuslab.com/arozos/mod/network/reverseproxy"
 )
@@ -25,49 +26,75 @@ type Router struct {
 	SubdomainEndpoint *sync.Map
 	Running           bool
 	Root              *ProxyEndpoint
+	Option            *RouterOption
 	mux               http.Handler
 	useTLS            bool
 	server            *http.Server
+	health            sync.Map //Rule key -> *HealthStatus
+	stopHealthCheck   chan bool
 }
 
 type RouterOption struct {
-	Port int
+	Port         int                        //Port of the standalone proxy server, see StartProxyService
+	Database     *database.Database         //Database for persisting proxy rules, rules are not saved if nil
+	CheckAuth    func(r *http.Request) bool //Check if the request is logged in, required by endpoints with RequireLogin
+	LoginPaths   []string                   //Path prefixes served by the next handler to users not logged in on login gated hosts
+	LocalPaths   []string                   //Path prefixes always served by the next handler on proxied hosts, e.g. ACME challenges
+	StripCookies []string                   //Cookies removed before forwarding to upstream, e.g. session cookies
+	IsReserved   func(path string) bool     //Check if a path prefix is used by the next handler and cannot be proxied
+}
+
+// Per endpoint options
+type EndpointOptions struct {
+	SkipTLSVerify bool //Accept self-signed certificate of the upstream
+	Websocket     bool //Allow websocket upgrade
+	RequireLogin  bool //Require login before proxying the request
 }
 
 type ProxyEndpoint struct {
 	Root       string
 	Domain     string
 	RequireTLS bool
-	Proxy      *dpcore.ReverseProxy `json:"-"`
+	EndpointOptions
+	Proxy *dpcore.ReverseProxy `json:"-"`
 }
 
 type SubdomainEndpoint struct {
 	MatchingDomain string
 	Domain         string
 	RequireTLS     bool
-	Proxy          *reverseproxy.ReverseProxy `json:"-"`
+	EndpointOptions
+	Proxy *reverseproxy.ReverseProxy `json:"-"`
 }
 
 type ProxyHandler struct {
 	Parent *Router
 }
 
-func NewDynamicProxy(port int) (*Router, error) {
+func NewDynamicProxy(option RouterOption) (*Router, error) {
 	proxyMap := sync.Map{}
 	domainMap := sync.Map{}
 	thisRouter := Router{
-		ListenPort:        port,
+		ListenPort:        option.Port,
 		ProxyEndpoints:    &proxyMap,
 		SubdomainEndpoint: &domainMap,
 		Running:           false,
+		Option:            &option,
 		useTLS:            false,
 		server:            nil,
+		stopHealthCheck:   make(chan bool),
 	}
 
 	thisRouter.mux = &ProxyHandler{
 		Parent: &thisRouter,
 	}
 
+	//Restore the saved rules
+	err := thisRouter.loadRules()
+	if err != nil {
+		return nil, err
+	}
+
 	return &thisRouter, nil
 }
 
@@ -112,7 +139,7 @@ func (router *Router) StopProxyService() error {
 /*
 	Add an URL into a custom proxy services
 */
-func (router *Router) AddProxyService(rootname string, domain string, requireTLS bool) error {
+func (router *Router) AddProxyService(rootname string, domain string, requireTLS bool, options *EndpointOptions) error {
 	if domain[len(domain)-1:] == "/" {
 		domain = domain[:len(domain)-1]
 	}
@@ -130,12 +157,17 @@ func (router *Router) AddProxyService(rootname string, domain string, requireTLS
 	}
 
 	proxy := dpcore.NewDynamicProxyCore(path, rootname)
+	if options == nil {
+		options = &EndpointOptions{Websocket: true}
+	}
+	proxy.Transport = upstreamTransport(options.SkipTLSVerify)
 
 	router.ProxyEndpoints.Store(rootname, &ProxyEndpoint{
-		Root:       rootname,
-		Domain:     domain,
-		RequireTLS: requireTLS,
-		Proxy:      proxy,
+		Root:            rootname,
+		Domain:          domain,
+		RequireTLS:      requireTLS,
+		EndpointOptions: *options,
+		Proxy:           proxy,
 	})
 
 	log.Println("Adding Proxy Rule: ", rootname+" to "+domain)
@@ -165,10 +197,11 @@ func (router *Router) SetRootProxy(proxyLocation string, requireTLS bool) error
 	proxy := dpcore.NewDynamicProxyCore(path, "")
 
 	rootEndpoint := ProxyEndpoint{
-		Root:       "/",
-		Domain:     proxyLocation,
-		RequireTLS: requireTLS,
-		Proxy:      proxy,
+		Root:            "/",
+		Domain:          proxyLocation,
+		RequireTLS:      requireTLS,
+		EndpointOptions: EndpointOptions{Websocket: true},
+		Proxy:           proxy,
 	}
 
 	router.Root = &rootEndpoint
@@ -186,7 +219,7 @@ func (h *ProxyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	targetProxyEndpoint := h.Parent.getTargetProxyEndpointFromRequestURI(r.RequestURI)
+	targetProxyEndpoint := h.Parent.getTargetProxyEndpointFromRequestURI(r.URL.Path)
 	if targetProxyEndpoint != nil {
 		h.proxyRequest(w, r, targetProxyEndpoint)
 	} else {
@@ -0,0 +1,138 @@
+package dynamicproxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"imuslab.com/arozos/mod/database"
+)
+
+func newTestRouter(t *testing.T, sysdb *database.Database) *Router {
+	router, err := NewDynamicProxy(RouterOption{
+		Database: sysdb,
+		CheckAuth: func(r *http.Request) bool {
+			_, err := r.Cookie("ao_auth")
+			return err == nil
+		},
+		LoginPaths:   []string{"/login.html", "/script/"},
+		LocalPaths:   []string{"/.well-known/acme-challenge/"},
+		StripCookies: []string{"ao_auth"},
+		IsReserved: func(path string) bool {
+			return hasPathPrefix(path, "/system")
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return router
+}
+
+func TestMiddleware(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := r.Cookie("ao_auth"); err == nil {
+			w.Write([]byte("leaked"))
+			return
+		}
+		w.Write([]byte("upstream " + r.URL.Path))
+	}))
+	defer upstream.Close()
+	upstreamHost := strings.TrimPrefix(upstream.URL, "http://")
+
+	sysdb, err := database.NewDatabase(filepath.Join(t.TempDir(), "test.db"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sysdb.Close()
+	router := newTestRouter(t, sysdb)
+	handler := router.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("local " + r.URL.Path))
+	}))
+
+	if err := router.AddRule(&ProxyRule{Type: RuleTypePath, Match: "/system/x", Upstream: upstreamHost}); err == nil {
+		t.Fatal("reserved path accepted")
+	}
+	if err := router.AddRule(&ProxyRule{Type: RuleTypePath, Match: "/", Upstream: upstreamHost}); err == nil {
+		t.Fatal("root path accepted")
+	}
+	rules := []*ProxyRule{
+		{Type: RuleTypeHost, Match: "App.Example.com", Upstream: upstreamHost, EndpointOptions: EndpointOptions{RequireLogin: true}},
+		{Type: RuleTypePath, Match: "app/", Upstream: upstreamHost},
+		{Type: RuleTypePath, Match: "/app/admin", Upstream: upstreamHost + "/secure", EndpointOptions: EndpointOptions{RequireLogin: true}},
+	}
+	for _, rule := range rules {
+		if err := router.AddRule(rule); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	get := func(host string, path string, loggedIn bool) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "http://"+host+path, nil)
+		if loggedIn {
+			r.AddCookie(&http.Cookie{Name: "ao_auth", Value: "session"})
+		}
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, r)
+		return recorder
+	}
+
+	tests := []struct {
+		host     string
+		path     string
+		loggedIn bool
+		expected string
+	}{
+		{"aroz.local", "/desktop.system", false, "local /desktop.system"},
+		{"aroz.local", "/apple", false, "local /apple"},
+		{"aroz.local", "/app/index.html", true, "upstream /index.html"},
+		{"aroz.local", "/app/admin/users", true, "upstream /secure/users"},
+		{"app.example.com:8080", "/login.html", false, "local /login.html"},
+		{"app.example.com", "/.well-known/acme-challenge/token", false, "local /.well-known/acme-challenge/token"},
+		{"app.example.com", "/dashboard", true, "upstream /dashboard"},
+	}
+	for _, test := range tests {
+		recorder := get(test.host, test.path, test.loggedIn)
+		if body, _ := io.ReadAll(recorder.Body); string(body) != test.expected {
+			t.Errorf("%s%s: expected %q, got %q", test.host, test.path, test.expected, string(body))
+		}
+	}
+
+	//Login gating
+	recorder := get("app.example.com", "/dashboard", false)
+	if recorder.Code != http.StatusTemporaryRedirect || recorder.Header().Get("Location") != "/login.html?redirect=%2Fdashboard" {
+		t.Fatalf("not redirected to login: %d %s", recorder.Code, recorder.Header().Get("Location"))
+	}
+	if recorder := get("aroz.local", "/app/admin", false); recorder.Code != http.StatusTemporaryRedirect {
+		t.Fatal("login gated path served without login")
+	}
+
+	//Websocket upgrade is rejected when disabled
+	r := httptest.NewRequest("GET", "http://aroz.local/app/ws", nil)
+	r.Header.Set("Upgrade", "websocket")
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, r)
+	if recorder.Code != http.StatusForbidden {
+		t.Fatal("websocket upgrade not rejected")
+	}
+
+	//Health check
+	router.CheckHealth()
+	for _, rule := range router.ListRules() {
+		if rule.Health == nil || !rule.Health.Up {
+			t.Fatalf("upstream of %s not up", rule.Match)
+		}
+	}
+
+	//Rules are restored from database
+	if err := router.RemoveRule(RuleTypePath, "/app"); err != nil {
+		t.Fatal(err)
+	}
+	restored := newTestRouter(t, sysdb)
+	listed := restored.ListRules()
+	if len(listed) != 2 || listed[0].Match != "app.example.com" || listed[1].Match != "/app/admin" || !listed[1].RequireLogin {
+		t.Fatalf("unexpected restored rules %+v", listed)
+	}
+}
@@ -0,0 +1,101 @@
+package dynamicproxy
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"strings"
+
+	"imuslab.com/arozos/mod/utils"
+)
+
+// List the proxy rules with their upstream health
+func (router *Router) HandleListRules(w http.ResponseWriter, r *http.Request) {
+	js, _ := json.Marshal(router.ListRules())
+	utils.SendJSONResponse(w, string(js))
+}
+
+// Add or update a proxy rule. Upstream can be given with http:// or https:// prefix
+func (router *Router) HandleAddRule(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		utils.SendErrorResponse(w, "invalid request method")
+		return
+	}
+	ruleType, err := utils.PostPara(r, "type")
+	if err != nil {
+		utils.SendErrorResponse(w, "invalid rule type")
+		return
+	}
+	match, err := utils.PostPara(r, "match")
+	if err != nil {
+		utils.SendErrorResponse(w, "invalid matching host or path")
+		return
+	}
+	upstream, err := utils.PostPara(r, "upstream")
+	if err != nil {
+		utils.SendErrorResponse(w, "invalid upstream")
+		return
+	}
+	requireTLS, _ := utils.PostBool(r, "tls")
+	skipTLSVerify, _ := utils.PostBool(r, "skipTLSVerify")
+	websocket, _ := utils.PostBool(r, "websocket")
+	requireLogin, _ := utils.PostBool(r, "requireLogin")
+
+	upstream = strings.TrimSpace(upstream)
+	if strings.HasPrefix(upstream, "https://") {
+		requireTLS = true
+		upstream = strings.TrimPrefix(upstream, "https://")
+	} else if strings.HasPrefix(upstream, "http://") {
+		requireTLS = false
+		upstream = strings.TrimPrefix(upstream, "http://")
+	}
+
+	if ruleType == RuleTypeHost {
+		//Do not lock the admin out of the current session
+		currentHost := r.Host
+		if host, _, err := net.SplitHostPort(r.Host); err == nil {
+			currentHost = host
+		}
+		if strings.EqualFold(strings.TrimSpace(match), currentHost) {
+			utils.SendErrorResponse(w, "cannot proxy the hostname used to access this system")
+			return
+		}
+	}
+
+	err = router.AddRule(&ProxyRule{
+		Type:       ruleType,
+		Match:      match,
+		Upstream:   upstream,
+		RequireTLS: requireTLS,
+		EndpointOptions: EndpointOptions{
+			SkipTLSVerify: skipTLSVerify,
+			Websocket:     websocket,
+			RequireLogin:  requireLogin,
+		},
+	})
+	if err != nil {
+		utils.SendErrorResponse(w, err.Error())
+		return
+	}
+	utils.SendOK(w)
+}
+
+// Remove a proxy rule
+func (router *Router) HandleRemoveRule(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		utils.SendErrorResponse(w, "invalid request method")
+		return
+	}
+	ruleType, _ := utils.PostPara(r, "type")
+	match, err := utils.PostPara(r, "match")
+	if err != nil {
+		utils.SendErrorResponse(w, "invalid matching host or path")
+		return
+	}
+	err = router.RemoveRule(ruleType, match)
+	if err != nil {
+		utils.SendErrorResponse(w, err.Error())
+		return
+	}
+	utils.SendOK(w)
+}
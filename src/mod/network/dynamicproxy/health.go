@@ -0,0 +1,114 @@
+package dynamicproxy
+
+import (
+	"crypto/tls"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+/*
+	Upstream Health Check
+
+	Upstreams are considered up if they answer
+	a GET request with status code below 500
+*/
+
+type HealthStatus struct {
+	Up        bool
+	LastCheck int64 //Unix time of the last check
+	Latency   int64 //Response time in milliseconds
+	Error     string
+}
+
+// Create the transport for connecting to upstream
+func upstreamTransport(skipTLSVerify bool) http.RoundTripper {
+	if !skipTLSVerify {
+		return http.DefaultTransport
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	return transport
+}
+
+// Create the dialer for connecting to websocket upstream
+func upstreamDialer(skipTLSVerify bool) *websocket.Dialer {
+	if !skipTLSVerify {
+		return websocket.DefaultDialer
+	}
+	dialer := *websocket.DefaultDialer
+	dialer.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	return &dialer
+}
+
+// Check the upstreams of all rules in the given interval until Close is called
+func (router *Router) StartHealthCheck(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			router.CheckHealth()
+			select {
+			case <-router.stopHealthCheck:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// Stop the health check
+func (router *Router) Close() {
+	close(router.stopHealthCheck)
+}
+
+// Check the upstreams of all rules now
+func (router *Router) CheckHealth() {
+	for _, rule := range router.getRules() {
+		router.checkRuleHealth(rule)
+	}
+}
+
+// Get the last health check result of the rule, nil if not checked yet
+func (router *Router) GetHealth(rule *ProxyRule) *HealthStatus {
+	status, ok := router.health.Load(rule.key())
+	if !ok {
+		return nil
+	}
+	return status.(*HealthStatus)
+}
+
+func (router *Router) checkRuleHealth(rule *ProxyRule) {
+	target := "http://" + rule.Upstream + "/"
+	if rule.RequireTLS {
+		target = "https://" + rule.Upstream + "/"
+	}
+	client := &http.Client{
+		Timeout:   5 * time.Second,
+		Transport: upstreamTransport(rule.SkipTLSVerify),
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			//Redirect to login page or https means the upstream is alive
+			return http.ErrUseLastResponse
+		},
+	}
+
+	start := time.Now()
+	status := &HealthStatus{LastCheck: start.Unix()}
+	resp, err := client.Get(target)
+	status.Latency = time.Since(start).Milliseconds()
+	if err != nil {
+		status.Error = err.Error()
+	} else {
+		resp.Body.Close()
+		status.Up = resp.StatusCode < 500
+		if !status.Up {
+			status.Error = resp.Status
+		}
+	}
+	if _, err := router.GetRule(rule.Type, rule.Match); err != nil {
+		//Rule removed during the check
+		return
+	}
+	router.health.Store(rule.key(), status)
+}
@@ -0,0 +1,113 @@
+package dynamicproxy
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+/*
+	Middleware
+
+	Serve the proxy rules on the same port as the wrapped handler.
+	Host rules take over the whole hostname, path rules are matched
+	on all other hostnames. Requests not matching any rule are
+	passed to the wrapped handler
+*/
+
+func (router *Router) Middleware(next http.Handler) http.Handler {
+	handler := &ProxyHandler{Parent: router}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ep := router.getSubdomainProxyEndpointFromHostname(r.Host); ep != nil {
+			if matchPathPrefixes(r.URL.Path, router.Option.LocalPaths) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if ep.RequireLogin && !router.isLoggedIn(r) {
+				if matchPathPrefixes(r.URL.Path, router.Option.LoginPaths) {
+					//Login page and its resources are served by the wrapped handler
+					next.ServeHTTP(w, r)
+					return
+				}
+				redirectToLogin(w, r)
+				return
+			}
+			if isWebsocketRequest(r) && !ep.Websocket {
+				http.Error(w, "403 - Websocket is not allowed on this host", http.StatusForbidden)
+				return
+			}
+			router.stripCookies(r)
+			handler.subdomainRequest(w, r, ep)
+			return
+		}
+
+		if ep := router.getTargetProxyEndpointFromRequestURI(r.URL.Path); ep != nil {
+			if ep.RequireLogin && !router.isLoggedIn(r) {
+				redirectToLogin(w, r)
+				return
+			}
+			if isWebsocketRequest(r) && !ep.Websocket {
+				http.Error(w, "403 - Websocket is not allowed on this path", http.StatusForbidden)
+				return
+			}
+			router.stripCookies(r)
+			handler.proxyRequest(w, r, ep)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (router *Router) isLoggedIn(r *http.Request) bool {
+	if router.Option.CheckAuth == nil {
+		return false
+	}
+	return router.Option.CheckAuth(r)
+}
+
+// Remove the session cookies so they are not leaked to the upstream
+func (router *Router) stripCookies(r *http.Request) {
+	if len(router.Option.StripCookies) == 0 {
+		return
+	}
+	cookies := r.Cookies()
+	r.Header.Del("Cookie")
+	for _, cookie := range cookies {
+		stripped := false
+		for _, name := range router.Option.StripCookies {
+			if cookie.Name == name {
+				stripped = true
+				break
+			}
+		}
+		if !stripped {
+			r.AddCookie(cookie)
+		}
+	}
+}
+
+func redirectToLogin(w http.ResponseWriter, r *http.Request) {
+	http.Redirect(w, r, "/login.html?redirect="+url.QueryEscape(r.URL.RequestURI()), http.StatusTemporaryRedirect)
+}
+
+func isWebsocketRequest(r *http.Request) bool {
+	return strings.EqualFold(r.Header.Get("Upgrade"), "websocket")
+}
+
+// Check if the path equals to the prefix or is under it
+func hasPathPrefix(path string, prefix string) bool {
+	if !strings.HasPrefix(path, prefix) {
+		return false
+	}
+	return len(path) == len(prefix) || strings.HasSuffix(prefix, "/") || path[len(prefix)] == '/'
+}
+
+func matchPathPrefixes(path string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if hasPathPrefix(path, prefix) {
+			return true
+		}
+	}
+	return false
+}
@@ -2,19 +2,24 @@ package dynamicproxy
 
 import (
 	"log"
+	"net"
 	"net/http"
 	"net/url"
+	"strings"
 
 	"imuslab.com/arozos/mod/network/websocketproxy"
 )
 
+// Get the endpoint with the longest matching root, e.g. /app matches /app and /app/x but not /apple
 func (router *Router) getTargetProxyEndpointFromRequestURI(requestURI string) *ProxyEndpoint {
 	var targetProxyEndpoint *ProxyEndpoint = nil
 	router.ProxyEndpoints.Range(func(key, value interface{}) bool {
 		rootname := key.(string)
-		if len(requestURI) >= len(rootname) && requestURI[:len(rootname)] == rootname {
-			thisProxyEndpoint := value.(*ProxyEndpoint)
-			targetProxyEndpoint = thisProxyEndpoint
+		if !hasPathPrefix(requestURI, rootname) {
+			return true
+		}
+		if targetProxyEndpoint == nil || len(rootname) > len(targetProxyEndpoint.Root) {
+			targetProxyEndpoint = value.(*ProxyEndpoint)
 		}
 		return true
 	})
@@ -24,7 +29,11 @@ func (router *Router) getTargetProxyEndpointFromRequestURI(requestURI string) *P
 
 func (router *Router) getSubdomainProxyEndpointFromHostname(hostname string) *SubdomainEndpoint {
 	var targetSubdomainEndpoint *SubdomainEndpoint = nil
-	ep, ok := router.SubdomainEndpoint.Load(hostname)
+	//Remove the port from the Host header
+	if host, _, err := net.SplitHostPort(hostname); err == nil {
+		hostname = host
+	}
+	ep, ok := router.SubdomainEndpoint.Load(strings.ToLower(hostname))
 	if ok {
 		targetSubdomainEndpoint = ep.(*SubdomainEndpoint)
 	}
@@ -59,6 +68,7 @@ func (h *ProxyHandler) subdomainRequest(w http.ResponseWriter, r *http.Request,
 			u, _ = url.Parse("wss://" + wsRedirectionEndpoint + requestURL)
 		}
 		wspHandler := websocketproxy.NewProxy(u)
+		wspHandler.Dialer = upstreamDialer(target.SkipTLSVerify)
 		wspHandler.ServeHTTP(w, r)
 		return
 	}
@@ -72,8 +82,13 @@ func (h *ProxyHandler) subdomainRequest(w http.ResponseWriter, r *http.Request,
 }
 
 func (h *ProxyHandler) proxyRequest(w http.ResponseWriter, r *http.Request, target *ProxyEndpoint) {
-	rewriteURL := h.Parent.rewriteURL(target.Root, r.RequestURI)
-	r.URL, _ = url.Parse(rewriteURL)
+	rewriteURL := h.Parent.rewriteURL(target.Root, r.URL.RequestURI())
+	u, err := url.Parse(rewriteURL)
+	if err != nil {
+		http.Error(w, "400 - Bad Request", http.StatusBadRequest)
+		return
+	}
+	r.URL = u
 	r.Header.Set("X-Forwarded-Host", r.Host)
 	if r.Header["Upgrade"] != nil && r.Header["Upgrade"][0] == "websocket" {
 		//Handle WebSocket request. Forward the custom Upgrade header and rewrite origin
@@ -87,12 +102,13 @@ func (h *ProxyHandler) proxyRequest(w http.ResponseWriter, r *http.Request, targ
 			u, _ = url.Parse("wss://" + wsRedirectionEndpoint + r.URL.String())
 		}
 		wspHandler := websocketproxy.NewProxy(u)
+		wspHandler.Dialer = upstreamDialer(target.SkipTLSVerify)
 		wspHandler.ServeHTTP(w, r)
 		return
 	}
 
 	r.Host = r.URL.Host
-	err := target.Proxy.ServeHTTP(w, r)
+	err = target.Proxy.ServeHTTP(w, r)
 	if err != nil {
 		log.Println(err.Error())
 	}
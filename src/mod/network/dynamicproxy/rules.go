@@ -0,0 +1,199 @@
+package dynamicproxy
+
+import (
+	"errors"
+	"net"
+	"path"
+	"sort"
+	"strings"
+)
+
+/*
+	Proxy Rules
+
+	Host and path based rules created by the admin.
+	Rules are saved in the database and restored on startup
+*/
+
+const (
+	proxyTable = "dynamicproxy"
+
+	RuleTypeHost = "host" //Proxy all requests to the matching hostname
+	RuleTypePath = "path" //Proxy requests under the matching path prefix
+)
+
+type ProxyRule struct {
+	Type       string //host or path
+	Match      string //Hostname for host rules, path prefix for path rules
+	Upstream   string //Upstream host, port and optional base path, e.g. 192.168.1.10:8080/app
+	RequireTLS bool   //Connect to upstream with HTTPS
+	EndpointOptions
+}
+
+type RuleStatus struct {
+	ProxyRule
+	Health *HealthStatus
+}
+
+func (rule *ProxyRule) key() string {
+	return "rule/" + rule.Type + "/" + rule.Match
+}
+
+// Normalize and validate the rule
+func (router *Router) validateRule(rule *ProxyRule) error {
+	rule.Upstream = strings.TrimSpace(rule.Upstream)
+	if rule.Upstream == "" || strings.Contains(rule.Upstream, "://") {
+		return errors.New("invalid upstream")
+	}
+	rule.Upstream = strings.TrimSuffix(rule.Upstream, "/")
+
+	switch rule.Type {
+	case RuleTypeHost:
+		rule.Match = strings.ToLower(strings.TrimSpace(rule.Match))
+		if rule.Match == "" || strings.ContainsAny(rule.Match, "/:* ") {
+			return errors.New("invalid hostname")
+		}
+		if net.ParseIP(rule.Match) != nil {
+			return errors.New("IP address cannot be used as proxy hostname")
+		}
+	case RuleTypePath:
+		match := path.Clean("/" + strings.TrimSpace(rule.Match))
+		if match == "/" {
+			return errors.New("root path cannot be proxied")
+		}
+		if router.Option.IsReserved != nil && router.Option.IsReserved(match) {
+			return errors.New("path " + match + " is used by the system")
+		}
+		rule.Match = match
+	default:
+		return errors.New("invalid rule type")
+	}
+	return nil
+}
+
+// Add or replace a proxy rule and save it to database
+func (router *Router) AddRule(rule *ProxyRule) error {
+	err := router.validateRule(rule)
+	if err != nil {
+		return err
+	}
+	err = router.applyRule(rule)
+	if err != nil {
+		return err
+	}
+	if router.Option.Database != nil {
+		err = router.Option.Database.Write(proxyTable, rule.key(), rule)
+		if err != nil {
+			return err
+		}
+	}
+
+	//Check the new upstream in background
+	go router.checkRuleHealth(rule)
+	return nil
+}
+
+func (router *Router) applyRule(rule *ProxyRule) error {
+	options := rule.EndpointOptions
+	if rule.Type == RuleTypeHost {
+		return router.AddSubdomainRoutingService(rule.Match, rule.Upstream, rule.RequireTLS, &options)
+	}
+	return router.AddProxyService(rule.Match, rule.Upstream, rule.RequireTLS, &options)
+}
+
+// Remove a proxy rule
+func (router *Router) RemoveRule(ruleType string, match string) error {
+	rule, err := router.GetRule(ruleType, match)
+	if err != nil {
+		return err
+	}
+	if rule.Type == RuleTypeHost {
+		router.SubdomainEndpoint.Delete(rule.Match)
+	} else {
+		router.ProxyEndpoints.Delete(rule.Match)
+	}
+	router.health.Delete(rule.key())
+	if router.Option.Database != nil {
+		return router.Option.Database.Delete(proxyTable, rule.key())
+	}
+	return nil
+}
+
+// Get the rule with the given type and match
+func (router *Router) GetRule(ruleType string, match string) (*ProxyRule, error) {
+	for _, rule := range router.getRules() {
+		if rule.Type == ruleType && rule.Match == match {
+			return rule, nil
+		}
+	}
+	return nil, errors.New("proxy rule not found")
+}
+
+// List all rules with their upstream health, host rules first
+func (router *Router) ListRules() []*RuleStatus {
+	results := []*RuleStatus{}
+	for _, rule := range router.getRules() {
+		results = append(results, &RuleStatus{
+			ProxyRule: *rule,
+			Health:    router.GetHealth(rule),
+		})
+	}
+	return results
+}
+
+func (router *Router) getRules() []*ProxyRule {
+	rules := []*ProxyRule{}
+	router.SubdomainEndpoint.Range(func(key, value interface{}) bool {
+		ep := value.(*SubdomainEndpoint)
+		rules = append(rules, &ProxyRule{
+			Type:            RuleTypeHost,
+			Match:           ep.MatchingDomain,
+			Upstream:        ep.Domain,
+			RequireTLS:      ep.RequireTLS,
+			EndpointOptions: ep.EndpointOptions,
+		})
+		return true
+	})
+	router.ProxyEndpoints.Range(func(key, value interface{}) bool {
+		ep := value.(*ProxyEndpoint)
+		rules = append(rules, &ProxyRule{
+			Type:            RuleTypePath,
+			Match:           ep.Root,
+			Upstream:        ep.Domain,
+			RequireTLS:      ep.RequireTLS,
+			EndpointOptions: ep.EndpointOptions,
+		})
+		return true
+	})
+	sort.Slice(rules, func(i, j int) bool {
+		if rules[i].Type != rules[j].Type {
+			return rules[i].Type == RuleTypeHost
+		}
+		return rules[i].Match < rules[j].Match
+	})
+	return rules
+}
+
+// Restore the rules saved in database
+func (router *Router) loadRules() error {
+	if router.Option.Database == nil {
+		return nil
+	}
+	err := router.Option.Database.NewTable(proxyTable)
+	if err != nil {
+		return err
+	}
+	entries, err := router.Option.Database.ListTable(proxyTable)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		rule := ProxyRule{}
+		err = router.Option.Database.Read(proxyTable, string(entry[0]), &rule)
+		if err != nil {
+			continue
+		}
+		router.applyRule(&rule)
+	}
+	return nil
+}
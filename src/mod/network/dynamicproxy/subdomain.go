@@ -12,7 +12,7 @@ import (
 
 */
 
-func (router *Router) AddSubdomainRoutingService(hostnameWithSubdomain string, domain string, requireTLS bool) error {
+func (router *Router) AddSubdomainRoutingService(hostnameWithSubdomain string, domain string, requireTLS bool, options *EndpointOptions) error {
 	if domain[len(domain)-1:] == "/" {
 		domain = domain[:len(domain)-1]
 	}
@@ -31,12 +31,17 @@ func (router *Router) AddSubdomainRoutingService(hostnameWithSubdomain string, d
 	}
 
 	proxy := reverseproxy.NewReverseProxy(path)
+	if options == nil {
+		options = &EndpointOptions{Websocket: true}
+	}
+	proxy.Transport = upstreamTransport(options.SkipTLSVerify)
 
 	router.SubdomainEndpoint.Store(hostnameWithSubdomain, &SubdomainEndpoint{
-		MatchingDomain: hostnameWithSubdomain,
-		Domain:         domain,
-		RequireTLS:     requireTLS,
-		Proxy:          proxy,
+		MatchingDomain:  hostnameWithSubdomain,
+		Domain:          domain,
+		RequireTLS:      requireTLS,
+		EndpointOptions: *options,
+		Proxy:           proxy,
 	})
 
 	log.Println("Adding Subdomain Rule: ", hostnameWithSubdomain+" to "+domain)
@@ -7,6 +7,7 @@ import (
 	"log"
 	"net"
 	"net/http"
+	"net/netip"
 	"strings"
 
 	"gitlab.com/NebulousLabs/go-upnp"
@@ -196,29 +197,97 @@ func GetPing(w http.ResponseWriter, r *http.Request) {
 	utils.SendJSONResponse(w, "pong")
 }
 
-func GetIpFromRequest(r *http.Request) (string, error) {
-	ip := r.Header.Get("X-REAL-IP")
-	netIP := net.ParseIP(ip)
-	if netIP != nil {
-		return ip, nil
-	}
-
-	ips := r.Header.Get("X-FORWARDED-FOR")
-	splitIps := strings.Split(ips, ",")
-	for _, ip := range splitIps {
-		netIP := net.ParseIP(ip)
-		if netIP != nil {
-			return ip, nil
+// Proxies that are trusted to report the client address, loopback by default
+var trustedProxies = []netip.Prefix{
+	netip.MustParsePrefix("127.0.0.0/8"),
+	netip.MustParsePrefix("::1/128"),
+}
+
+// Set the reverse proxies that are trusted to report the client address in the X-Forwarded-For
+// and X-Real-IP headers. Each entry is an IP or CIDR. Must be called before the server starts
+func SetTrustedProxies(proxies []string) error {
+	prefixes := []netip.Prefix{}
+	for _, proxy := range proxies {
+		proxy = strings.TrimSpace(proxy)
+		if proxy == "" {
+			continue
+		}
+		if !strings.Contains(proxy, "/") {
+			addr, err := netip.ParseAddr(proxy)
+			if err != nil {
+				return errors.New("invalid trusted proxy address: " + proxy)
+			}
+			addr = addr.Unmap()
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(proxy)
+		if err != nil {
+			return errors.New("invalid trusted proxy range: " + proxy)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	trustedProxies = prefixes
+	return nil
+}
+
+func isTrustedProxy(addr netip.Addr) bool {
+	for _, prefix := range trustedProxies {
+		if prefix.Contains(addr) {
+			return true
 		}
 	}
+	return false
+}
+
+func remoteAddr(r *http.Request) (netip.Addr, error) {
+	remoteIP := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		remoteIP = host
+	}
+	addr, err := netip.ParseAddr(remoteIP)
+	if err != nil {
+		return netip.Addr{}, errors.New("No IP information found")
+	}
+	return addr.Unmap(), nil
+}
 
-	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+// Check if the request comes directly from a trusted proxy, i.e. its forwarding headers
+// (X-Forwarded-For, X-Forwarded-Proto...) can be honored
+func IsFromTrustedProxy(r *http.Request) bool {
+	addr, err := remoteAddr(r)
+	return err == nil && isTrustedProxy(addr)
+}
+
+// Get the client IP of the request. The X-Forwarded-For and X-Real-IP headers are only
+// used if the request comes from a trusted proxy, so clients cannot spoof their address
+func GetIpFromRequest(r *http.Request) (string, error) {
+	addr, err := remoteAddr(r)
 	if err != nil {
 		return "", err
 	}
-	netIP = net.ParseIP(ip)
-	if netIP != nil {
-		return ip, nil
+	if !isTrustedProxy(addr) {
+		return addr.String(), nil
+	}
+
+	//Walk the forwarded chain from the nearest hop, the first untrusted address is the client
+	if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+		hops := strings.Split(forwarded, ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+			if err != nil {
+				break
+			}
+			addr = hop.Unmap()
+			if !isTrustedProxy(addr) {
+				break
+			}
+		}
+		return addr.String(), nil
+	}
+
+	if realIP, err := netip.ParseAddr(strings.TrimSpace(r.Header.Get("X-Real-IP"))); err == nil {
+		return realIP.Unmap().String(), nil
 	}
-	return "", errors.New("No IP information found")
+	return addr.String(), nil
 }
@@ -0,0 +1,42 @@
+package network
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestGetIpFromRequest(t *testing.T) {
+	if err := SetTrustedProxies([]string{"127.0.0.1/8", "10.0.0.5"}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		remoteAddr string
+		forwarded  string
+		realIP     string
+		expected   string
+	}{
+		//Headers from untrusted clients are ignored
+		{"203.0.113.7:5000", "198.51.100.1", "198.51.100.2", "203.0.113.7"},
+		//Client address reported by a trusted proxy
+		{"127.0.0.1:5000", "198.51.100.1", "", "198.51.100.1"},
+		{"127.0.0.1:5000", "", "198.51.100.2", "198.51.100.2"},
+		//Spoofed entries in front of the chain are ignored
+		{"127.0.0.1:5000", "192.0.2.9, 198.51.100.1, 10.0.0.5", "", "198.51.100.1"},
+		{"[::ffff:127.0.0.1]:5000", "", "", "127.0.0.1"},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = test.remoteAddr
+		if test.forwarded != "" {
+			r.Header.Set("X-Forwarded-For", test.forwarded)
+		}
+		if test.realIP != "" {
+			r.Header.Set("X-Real-IP", test.realIP)
+		}
+		ip, err := GetIpFromRequest(r)
+		if err != nil || ip != test.expected {
+			t.Errorf("%s (%s): expected %s, got %s (%v)", test.remoteAddr, test.forwarded, test.expected, ip, err)
+		}
+	}
+}
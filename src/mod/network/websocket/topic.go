@@ -0,0 +1,110 @@
+package websocket
+
+import (
+	"errors"
+	"strings"
+
+	"imuslab.com/arozos/mod/user"
+)
+
+/*
+	Event Topics
+
+	file:{vpath}		Changes of files under the given virtual path, e.g. file:user:/Desktop
+	fileop			Progress of the file operations started by the current user
+	notification		Notifications sent to the current user
+	storage			Storage mount / unmount / reconnect
+	scheduler		Execution results of the scheduled jobs created by the current user
+	iot			IoT device status updates, require access to the IoT Hub module
+	agi:{channel}		Messages published by the AGI scripts running as the current user
+
+	A subscription also receive the events of all its sub-topics, so
+	subscribing to file:user:/ receive changes of all files under user:/
+*/
+
+const (
+	TopicFile         = "file"
+	TopicFileOpr      = "fileop"
+	TopicNotification = "notification"
+	TopicStorage      = "storage"
+	TopicScheduler    = "scheduler"
+	TopicIoT          = "iot"
+	TopicAGI          = "agi"
+)
+
+// Split the topic into its type and argument, e.g. file:user:/Desktop -> file, user:/Desktop
+func splitTopic(topic string) (string, string) {
+	topicType, arg, _ := strings.Cut(topic, ":")
+	return topicType, arg
+}
+
+// Check if an event published on eventTopic should be delivered to the subscription
+func topicMatch(subscription string, eventTopic string) bool {
+	if subscription == eventTopic {
+		return true
+	}
+	if !strings.HasPrefix(eventTopic, subscription) {
+		return false
+	}
+	if strings.HasSuffix(subscription, "/") {
+		return true
+	}
+	return strings.HasPrefix(eventTopic[len(subscription):], "/")
+}
+
+// Check if the user can subscribe to the given topic
+func checkTopicPermission(u *user.User, topic string) error {
+	topicType, arg := splitTopic(topic)
+	switch topicType {
+	case TopicFile:
+		if arg == "" || !strings.Contains(arg, ":/") {
+			return errors.New("invalid virtual path")
+		}
+		if u == nil || !u.CanRead(arg) {
+			return errors.New("permission denied")
+		}
+		return nil
+	case TopicFileOpr, TopicNotification, TopicStorage, TopicScheduler:
+		if arg != "" {
+			return errors.New("invalid topic")
+		}
+		return nil
+	case TopicIoT:
+		if arg != "" {
+			return errors.New("invalid topic")
+		}
+		if u == nil || !u.GetModuleAccessPermission("IoT Hub") {
+			return errors.New("permission denied")
+		}
+		return nil
+	case TopicAGI:
+		if arg == "" {
+			return errors.New("missing channel name")
+		}
+		return nil
+	}
+	return errors.New("unknown topic")
+}
+
+// Build the topic for an AGI channel
+func AGITopic(channel string) string {
+	return TopicAGI + ":" + channel
+}
+
+// Build the topic for a file or folder virtual path
+func FileTopic(vpath string) string {
+	vpath = strings.ReplaceAll(vpath, "\\", "/")
+	if !strings.HasSuffix(vpath, ":/") {
+		vpath = strings.TrimSuffix(vpath, "/")
+	}
+	return TopicFile + ":" + vpath
+}
+
+// Normalize the topic given by the client
+func normalizeTopic(topic string) string {
+	topic = strings.TrimSpace(topic)
+	if topicType, arg := splitTopic(topic); topicType == TopicFile && arg != "" {
+		return FileTopic(arg)
+	}
+	return topic
+}
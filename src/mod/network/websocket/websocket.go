@@ -1,16 +1,370 @@
 package websocket
 
-import "net/http"
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"imuslab.com/arozos/mod/user"
+)
+
+/*
+	Server Event Bus
+
+	A single authenticated websocket at /system/ws that push server
+	events to the client by topic subscriptions.
+
+	Client -> Server
+	{"type":"subscribe", "topic":"file:user:/Desktop"}
+	{"type":"unsubscribe", "topic":"file:user:/Desktop"}
+	{"type":"ping"}
+
+	Server -> Client
+	{"type":"subscribed", "topic":"file:user:/Desktop"}
+	{"type":"unsubscribed", "topic":"file:user:/Desktop"}
+	{"type":"event", "topic":"file:user:/Desktop/a.txt", "event":"create", "data":{...}, "time":1690000000}
+	{"type":"error", "topic":"iot", "error":"permission denied"}
+	{"type":"pong"}
+
+	See topic.go for the list of topics
+*/
+
+const (
+	sendBufferSize = 64
+	writeTimeout   = 10 * time.Second
+	pongTimeout    = 60 * time.Second
+	pingInterval   = 30 * time.Second
+	maxMessageSize = 4096
+	maxTopics      = 64 //Maximum number of subscriptions per connection
+)
+
+type RouterOption struct {
+	UserHandler   *user.UserHandler
+	OnSubscribe   func(u *user.User, topic string) //Called when a client subscribe to a topic, can be nil
+	OnUnsubscribe func(u *user.User, topic string) //Called when a client unsubscribe or disconnect from a topic, can be nil
+}
 
 type Router struct {
+	option   RouterOption
+	upgrader websocket.Upgrader
+	clients  map[*client]bool
+	mutex    sync.RWMutex
+}
+
+// Message sent between the server and the client
+type Message struct {
+	Type  string      `json:"type"`
+	Topic string      `json:"topic,omitempty"`
+	Event string      `json:"event,omitempty"`
+	Data  interface{} `json:"data,omitempty"`
+	Time  int64       `json:"time,omitempty"`
+	Error string      `json:"error,omitempty"`
 }
 
-func NewRouter() *Router {
-	return &Router{}
+type client struct {
+	user          *user.User
+	username      string
+	subscriptions map[string]bool
+	mutex         sync.RWMutex
+	send          chan []byte
+	done          chan bool
+	closeOnce     sync.Once
+}
 
+func NewRouter(option RouterOption) *Router {
+	return &Router{
+		option: option,
+		//CheckOrigin is left empty so only same origin connections are accepted
+		upgrader: websocket.Upgrader{},
+		clients:  map[*client]bool{},
+	}
 }
 
+// Handle the websocket connection at /system/ws
 func (s *Router) HandleWebSocketRouting(w http.ResponseWriter, r *http.Request) {
-	//WIP
-	http.NotFound(w, r)
+	userinfo, err := s.option.UserHandler.GetUserInfoFromRequest(w, r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("401 - Unauthorized"))
+		return
+	}
+
+	s.serve(w, r, userinfo)
+}
+
+// Upgrade the connection and serve the given user until disconnected
+func (s *Router) serve(w http.ResponseWriter, r *http.Request, userinfo *user.User) {
+	conn, err := s.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Println("[WebSocket] Upgrade failed: " + err.Error())
+		return
+	}
+
+	c := newClient(userinfo)
+	s.addClient(c)
+	go c.writeLoop(conn)
+	s.readLoop(c, conn)
+}
+
+func newClient(u *user.User) *client {
+	username := ""
+	if u != nil {
+		username = u.Username
+	}
+	return &client{
+		user:          u,
+		username:      username,
+		subscriptions: map[string]bool{},
+		send:          make(chan []byte, sendBufferSize),
+		done:          make(chan bool),
+	}
+}
+
+func (s *Router) addClient(c *client) {
+	s.mutex.Lock()
+	s.clients[c] = true
+	s.mutex.Unlock()
+}
+
+// Remove the client and release all of its subscriptions
+func (s *Router) removeClient(c *client) {
+	s.mutex.Lock()
+	delete(s.clients, c)
+	s.mutex.Unlock()
+
+	c.mutex.Lock()
+	topics := []string{}
+	for topic := range c.subscriptions {
+		topics = append(topics, topic)
+	}
+	c.subscriptions = map[string]bool{}
+	c.mutex.Unlock()
+
+	if s.option.OnUnsubscribe != nil {
+		for _, topic := range topics {
+			s.option.OnUnsubscribe(c.user, topic)
+		}
+	}
+	c.close()
+}
+
+// Read the client requests until the connection is closed
+func (s *Router) readLoop(c *client, conn *websocket.Conn) {
+	defer func() {
+		s.removeClient(c)
+		conn.Close()
+	}()
+
+	conn.SetReadLimit(maxMessageSize)
+	conn.SetReadDeadline(time.Now().Add(pongTimeout))
+	conn.SetPongHandler(func(string) error {
+		conn.SetReadDeadline(time.Now().Add(pongTimeout))
+		return nil
+	})
+
+	for {
+		_, payload, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		conn.SetReadDeadline(time.Now().Add(pongTimeout))
+
+		request := Message{}
+		err = json.Unmarshal(payload, &request)
+		if err != nil {
+			c.push(Message{Type: "error", Error: "invalid request"})
+			continue
+		}
+		s.handleRequest(c, request)
+	}
+}
+
+// Handle a request from the client
+func (s *Router) handleRequest(c *client, request Message) {
+	switch request.Type {
+	case "subscribe":
+		topic := normalizeTopic(request.Topic)
+		err := s.subscribe(c, topic)
+		if err != nil {
+			c.push(Message{Type: "error", Topic: topic, Error: err.Error()})
+			return
+		}
+		c.push(Message{Type: "subscribed", Topic: topic})
+	case "unsubscribe":
+		topic := normalizeTopic(request.Topic)
+		s.unsubscribe(c, topic)
+		c.push(Message{Type: "unsubscribed", Topic: topic})
+	case "ping":
+		c.push(Message{Type: "pong"})
+	default:
+		c.push(Message{Type: "error", Error: "unknown request type"})
+	}
+}
+
+func (s *Router) subscribe(c *client, topic string) error {
+	err := checkTopicPermission(c.user, topic)
+	if err != nil {
+		return err
+	}
+
+	c.mutex.Lock()
+	alreadySubscribed := c.subscriptions[topic]
+	if !alreadySubscribed && len(c.subscriptions) >= maxTopics {
+		c.mutex.Unlock()
+		return errors.New("too many subscriptions")
+	}
+	c.subscriptions[topic] = true
+	c.mutex.Unlock()
+
+	if !alreadySubscribed && s.option.OnSubscribe != nil {
+		s.option.OnSubscribe(c.user, topic)
+	}
+	return nil
+}
+
+func (s *Router) unsubscribe(c *client, topic string) {
+	c.mutex.Lock()
+	subscribed := c.subscriptions[topic]
+	delete(c.subscriptions, topic)
+	c.mutex.Unlock()
+
+	if subscribed && s.option.OnUnsubscribe != nil {
+		s.option.OnUnsubscribe(c.user, topic)
+	}
+}
+
+// Write the queued messages and keepalive pings to the connection
+func (c *client) writeLoop(conn *websocket.Conn) {
+	ticker := time.NewTicker(pingInterval)
+	defer func() {
+		ticker.Stop()
+		conn.Close()
+	}()
+
+	for {
+		select {
+		case payload := <-c.send:
+			conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+			if err := conn.WriteMessage(websocket.TextMessage, payload); err != nil {
+				return
+			}
+		case <-ticker.C:
+			conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+			if err := conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// Queue a message to the client. Messages are dropped if the client cannot keep up
+func (c *client) push(m Message) {
+	payload, err := json.Marshal(m)
+	if err != nil {
+		return
+	}
+	select {
+	case <-c.done:
+	case c.send <- payload:
+	default:
+	}
+}
+
+func (c *client) close() {
+	c.closeOnce.Do(func() {
+		close(c.done)
+	})
+}
+
+// Check if the client subscribed to a topic that match the event topic
+func (c *client) subscribed(eventTopic string) bool {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	for subscription := range c.subscriptions {
+		if topicMatch(subscription, eventTopic) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Router) listClients() []*client {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	results := []*client{}
+	for c := range s.clients {
+		results = append(results, c)
+	}
+	return results
+}
+
+/*
+	Publishers
+*/
+
+func newEvent(topic string, event string, data interface{}) Message {
+	return Message{
+		Type:  "event",
+		Topic: topic,
+		Event: event,
+		Data:  data,
+		Time:  time.Now().Unix(),
+	}
+}
+
+// Publish an event to all clients subscribed to the topic
+func (s *Router) Publish(topic string, event string, data interface{}) {
+	m := newEvent(topic, event, data)
+	for _, c := range s.listClients() {
+		if c.subscribed(topic) {
+			c.push(m)
+		}
+	}
+}
+
+// Publish an event to the clients of the given user only
+func (s *Router) PublishToUser(username string, topic string, event string, data interface{}) {
+	m := newEvent(topic, event, data)
+	for _, c := range s.listClients() {
+		if c.username == username && c.subscribed(topic) {
+			c.push(m)
+		}
+	}
+}
+
+/*
+Publish a file change event. As the virtual path of a file depends on the user
+(e.g. user:/ of different users), resolve is called once per connected user to
+get the virtual path of the changed file. Return false if the user cannot see the file.
+*/
+func (s *Router) PublishFileEvent(event string, resolve func(u *user.User) (string, bool)) {
+	type resolvedPath struct {
+		vpath string
+		ok    bool
+	}
+	resolved := map[string]resolvedPath{}
+	for _, c := range s.listClients() {
+		if c.user == nil {
+			continue
+		}
+		r, ok := resolved[c.username]
+		if !ok {
+			vpath, visible := resolve(c.user)
+			r = resolvedPath{vpath: vpath, ok: visible}
+			resolved[c.username] = r
+		}
+		if !r.ok {
+			continue
+		}
+		topic := FileTopic(r.vpath)
+		if c.subscribed(topic) {
+			c.push(newEvent(topic, event, map[string]string{"vpath": r.vpath}))
+		}
+	}
 }
@@ -0,0 +1,93 @@
+package websocket
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestTopicMatch(t *testing.T) {
+	cases := []struct {
+		subscription string
+		event        string
+		expected     bool
+	}{
+		{"fileop", "fileop", true},
+		{"file:user:/Desktop", "file:user:/Desktop/a.txt", true},
+		{"file:user:/Desktop", "file:user:/Desktop", true},
+		{"file:user:/", "file:user:/Desktop/a.txt", true},
+		{"file:user:/Desktop", "file:user:/Desktop2/a.txt", false},
+		{"file:user:/Desktop/a", "file:user:/Desktop", false},
+		{"agi:chat", "agi:chatroom", false},
+	}
+	for _, c := range cases {
+		if topicMatch(c.subscription, c.event) != c.expected {
+			t.Errorf("topicMatch(%q, %q) expected %v", c.subscription, c.event, c.expected)
+		}
+	}
+
+	if FileTopic("user:/Desktop/") != "file:user:/Desktop" || FileTopic("user:/") != "file:user:/" {
+		t.Errorf("File topic not normalized")
+	}
+}
+
+func TestSubscribeAndPublish(t *testing.T) {
+	router := NewRouter(RouterOption{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		router.serve(w, r, nil)
+	}))
+	defer server.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	readMessage := func() Message {
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		m := Message{}
+		if err := conn.ReadJSON(&m); err != nil {
+			t.Fatal(err)
+		}
+		return m
+	}
+
+	//File and IoT topics require a user with access
+	conn.WriteJSON(Message{Type: "subscribe", Topic: "iot"})
+	if m := readMessage(); m.Type != "error" {
+		t.Fatalf("Expected iot subscription to be denied, got %+v", m)
+	}
+	conn.WriteJSON(Message{Type: "subscribe", Topic: "file:user:/Desktop"})
+	if m := readMessage(); m.Type != "error" {
+		t.Fatalf("Expected file subscription to be denied, got %+v", m)
+	}
+
+	conn.WriteJSON(Message{Type: "subscribe", Topic: "agi:chat"})
+	if m := readMessage(); m.Type != "subscribed" || m.Topic != "agi:chat" {
+		t.Fatalf("Expected subscribed reply, got %+v", m)
+	}
+
+	//Events on other topics are not delivered
+	router.Publish(TopicStorage, "mount", nil)
+	router.PublishToUser("", AGITopic("other"), "message", "ignored")
+	router.PublishToUser("", AGITopic("chat"), "message", "hello")
+	m := readMessage()
+	if m.Type != "event" || m.Topic != "agi:chat" || m.Data != "hello" {
+		t.Fatalf("Unexpected event %+v", m)
+	}
+
+	conn.WriteJSON(Message{Type: "unsubscribe", Topic: "agi:chat"})
+	if m := readMessage(); m.Type != "unsubscribed" {
+		t.Fatalf("Expected unsubscribed reply, got %+v", m)
+	}
+	router.PublishToUser("", AGITopic("chat"), "message", "hello")
+	conn.WriteJSON(Message{Type: "ping"})
+	if m := readMessage(); m.Type != "pong" {
+		t.Fatalf("Expected no more events after unsubscribe, got %+v", m)
+	}
+}
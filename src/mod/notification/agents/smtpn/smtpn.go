@@ -15,6 +15,7 @@ import (
 	"net/smtp"
 	"os"
 	"strconv"
+	"strings"
 	"time"
 
 	notification "imuslab.com/arozos/mod/notification"
@@ -115,15 +116,7 @@ func (a Agent) ConsumerNotification(incomingNotification *notification.Notificat
 			log.Println("[SMTP] Template load failed: " + err.Error())
 		}
 
-		msg := []byte("To: " + thisEmail + "\n" +
-			"From: " + a.SMTPSenderDisplayName + " <" + a.SMTPSender + ">\n" +
-			"Subject: " + incomingNotification.Title + "\n" +
-			"MIME-version: 1.0;\nContent-Type: text/html; charset=\"UTF-8\";\n\n" +
-			s + "\n\n")
-
-		//Login to the SMTP server
-		auth := smtp.PlainAuth("", a.SMTPSender, a.SMTPPassword, a.SMTPDomain)
-		err = smtp.SendMail(a.SMTPDomain+":"+strconv.Itoa(a.SMTPPort), auth, a.SMTPSender, []string{thisEmail}, msg)
+		err = a.SendMail(thisEmail, incomingNotification.Title, s)
 		if err != nil {
 			log.Println("[SMTPN] Email sent failed: ", err.Error())
 			return err
@@ -133,6 +126,29 @@ func (a Agent) ConsumerNotification(incomingNotification *notification.Notificat
 	return nil
 }
 
+// Send a html email to the given address
+func (a Agent) SendMail(receiver string, subject string, htmlContent string) error {
+	if a.SMTPDomain == "" || a.SMTPSender == "" {
+		return errors.New("SMTP server not configured")
+	}
+	if strings.ContainsAny(receiver+subject, "\r\n") {
+		return errors.New("invalid receiver or subject")
+	}
+
+	msg := []byte("To: " + receiver + "\n" +
+		"From: " + a.SMTPSenderDisplayName + " <" + a.SMTPSender + ">\n" +
+		"Subject: " + subject + "\n" +
+		"MIME-version: 1.0;\nContent-Type: text/html; charset=\"UTF-8\";\n\n" +
+		htmlContent + "\n\n")
+
+	//Login to the SMTP server, skip authentication for relays that do not require password
+	var auth smtp.Auth
+	if a.SMTPPassword != "" {
+		auth = smtp.PlainAuth("", a.SMTPSender, a.SMTPPassword, a.SMTPDomain)
+	}
+	return smtp.SendMail(a.SMTPDomain+":"+strconv.Itoa(a.SMTPPort), auth, a.SMTPSender, []string{receiver}, msg)
+}
+
 func (a Agent) ProduceNotification(producerListeningEndpoint *notification.AgentProducerFunction) {
 	return
 }
@@ -0,0 +1,51 @@
+package wsn
+
+/*
+
+	WebSocket Notification Agent
+
+	This agent push the notification to the user's browser sessions
+	via the notification topic of the system websocket (/system/ws)
+
+*/
+
+import (
+	notification "imuslab.com/arozos/mod/notification"
+)
+
+type Agent struct {
+	PublishToUser func(username string, payload *notification.NotificationPayload)
+}
+
+func NewWebSocketNotificationAgent(publishFunction func(string, *notification.NotificationPayload)) *Agent {
+	return &Agent{
+		PublishToUser: publishFunction,
+	}
+}
+
+func (a Agent) Name() string {
+	return "wsn"
+}
+
+func (a Agent) Desc() string {
+	return "Notify user in their opened browser sessions"
+}
+
+func (a Agent) IsConsumer() bool {
+	return true
+}
+
+func (a Agent) IsProducer() bool {
+	return false
+}
+
+func (a Agent) ConsumerNotification(incomingNotification *notification.NotificationPayload) error {
+	for _, username := range incomingNotification.Receiver {
+		a.PublishToUser(username, incomingNotification)
+	}
+	return nil
+}
+
+func (a Agent) ProduceNotification(producerListeningEndpoint *notification.AgentProducerFunction) {
+	return
+}
@@ -33,5 +33,6 @@ func (gp *PermissionGroup) Remove() {
 	db.Delete("permission", "isadmin/"+gp.Name)
 	db.Delete("permission", "quota/"+gp.Name)
 	db.Delete("permission", "interfaceModule/"+gp.Name)
+	db.Delete("permission", "roles/"+gp.Name)
 
 }
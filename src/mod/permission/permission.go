@@ -15,6 +15,7 @@ import (
 type PermissionGroup struct {
 	Name                   string
 	IsAdmin                bool
+	Roles                  []string
 	DefaultInterfaceModule string
 	DefaultStorageQuota    int64
 	AccessibleModules      []string
@@ -85,9 +86,16 @@ func (h *PermissionHandler) LoadPermissionGroupsFromDatabase() error {
 			interfaceModule := "Desktop"
 			h.database.Read("permission", "interfaceModule/"+groupname, &interfaceModule)
 
+			//Roles assigned to this group
+			roles := []string{}
+			if h.database.KeyExists("permission", "roles/"+groupname) {
+				h.database.Read("permission", "roles/"+groupname, &roles)
+			}
+
 			results = append(results, &PermissionGroup{
 				Name:                   groupname,
 				IsAdmin:                (isAdmin == "true"),
+				Roles:                  roles,
 				DefaultInterfaceModule: interfaceModule,
 				AccessibleModules:      groupPermission,
 				DefaultStorageQuota:    defaultStorageQuota,
@@ -169,6 +177,7 @@ func (h *PermissionHandler) NewPermissionGroup(name string, isadmin bool, storag
 	newGroup := PermissionGroup{
 		Name:                   name,
 		IsAdmin:                isadmin,
+		Roles:                  []string{},
 		AccessibleModules:      moduleNames,
 		DefaultInterfaceModule: interfaceModule,
 		DefaultStorageQuota:    storageQuota,
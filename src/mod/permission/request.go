@@ -8,10 +8,12 @@ package permission
 	group/{groupname} = module permissions
 	isadmin/{groupname} = isAdmin
 	quota/{groupname} = default quota in bytes
+	roles/{groupname} = roles assigned to the group
 */
 
 import (
 	"encoding/json"
+	"errors"
 	"log"
 	"net/http"
 	"strconv"
@@ -38,6 +40,7 @@ func (h *PermissionHandler) HandleListGroup(w http.ResponseWriter, r *http.Reque
 			thisGroupInfo = append(thisGroupInfo, gp.AccessibleModules)
 			thisGroupInfo = append(thisGroupInfo, gp.IsAdmin)
 			thisGroupInfo = append(thisGroupInfo, gp.DefaultStorageQuota)
+			thisGroupInfo = append(thisGroupInfo, gp.Roles)
 			results[gp.Name] = thisGroupInfo
 		}
 		jsonString, _ := json.Marshal(results)
@@ -105,7 +108,20 @@ func (h *PermissionHandler) HandleGroupEdit(w http.ResponseWriter, r *http.Reque
 			return
 		}
 
+		roles, err := parseRoles(r)
+		if err != nil {
+			utils.SendErrorResponse(w, err.Error())
+			return
+		}
+
 		h.UpdatePermissionGroup(groupname, isAdmin == "true", int64(quotaInt), permissionSlice, interfaceModule)
+		if roles != nil {
+			err = h.GetPermissionGroupByName(groupname).SetRoles(roles)
+			if err != nil {
+				utils.SendErrorResponse(w, err.Error())
+				return
+			}
+		}
 		utils.SendOK(w)
 	} else {
 		//Listing mode
@@ -182,8 +198,21 @@ func (h *PermissionHandler) HandleGroupCreate(w http.ResponseWriter, r *http.Req
 		return
 	}
 
+	roles, err := parseRoles(r)
+	if err != nil {
+		utils.SendErrorResponse(w, err.Error())
+		return
+	}
+
 	//Migrated the creation process to a seperated function
-	h.NewPermissionGroup(groupname, isAdmin == "true", int64(quotaInt), permissionSlice, interfaceModule)
+	newGroup := h.NewPermissionGroup(groupname, isAdmin == "true", int64(quotaInt), permissionSlice, interfaceModule)
+	if roles != nil {
+		err = newGroup.SetRoles(roles)
+		if err != nil {
+			utils.SendErrorResponse(w, err.Error())
+			return
+		}
+	}
 
 	/*
 		//OK. Write the results into database
@@ -240,3 +269,67 @@ func (h *PermissionHandler) HandleGroupRemove(w http.ResponseWriter, r *http.Req
 
 	utils.SendOK(w)
 }
+
+//Parse the optional roles paramter, return nil if not given
+func parseRoles(r *http.Request) ([]string, error) {
+	rolesJSON, err := utils.PostPara(r, "roles")
+	if err != nil {
+		return nil, nil
+	}
+	roles := []string{}
+	err = json.Unmarshal([]byte(rolesJSON), &roles)
+	if err != nil {
+		return nil, errors.New("Failed to parse role list")
+	}
+	return roles, nil
+}
+
+//List all roles and the capabilities that can be assigned to them
+func (h *PermissionHandler) HandleListRoles(w http.ResponseWriter, r *http.Request) {
+	js, _ := json.Marshal(map[string]interface{}{
+		"roles":        h.ListRoles(),
+		"capabilities": Capabilities,
+	})
+	utils.SendJSONResponse(w, string(js))
+}
+
+//Create or update a custom role
+func (h *PermissionHandler) HandleSetRole(w http.ResponseWriter, r *http.Request) {
+	name, err := utils.PostPara(r, "name")
+	if err != nil {
+		utils.SendErrorResponse(w, "Role name not defined")
+		return
+	}
+	capabilitiesJSON, err := utils.PostPara(r, "capabilities")
+	if err != nil {
+		utils.SendErrorResponse(w, "Capabilities not defined")
+		return
+	}
+	capabilities := []string{}
+	err = json.Unmarshal([]byte(capabilitiesJSON), &capabilities)
+	if err != nil {
+		utils.SendErrorResponse(w, "Failed to parse capability list")
+		return
+	}
+	err = h.SetRole(name, capabilities)
+	if err != nil {
+		utils.SendErrorResponse(w, err.Error())
+		return
+	}
+	utils.SendOK(w)
+}
+
+//Remove a custom role
+func (h *PermissionHandler) HandleRemoveRole(w http.ResponseWriter, r *http.Request) {
+	name, err := utils.PostPara(r, "name")
+	if err != nil {
+		utils.SendErrorResponse(w, "Role name not defined")
+		return
+	}
+	err = h.RemoveRole(name)
+	if err != nil {
+		utils.SendErrorResponse(w, err.Error())
+		return
+	}
+	utils.SendOK(w)
+}
@@ -0,0 +1,181 @@
+package permission
+
+/*
+	Roles
+
+	A role is a named set of admin capabilities. Permission groups can be
+	assigned several roles so that members only get the part of the
+	administrator privileges they need. Groups with IsAdmin set still
+	hold every capability.
+
+	Custom roles are stored in database as follows
+	role/{rolename} = list of capabilities
+	roles/{groupname} = list of role names assigned to the group
+*/
+
+import (
+	"errors"
+	"sort"
+	"strings"
+
+	"imuslab.com/arozos/mod/utils"
+)
+
+// Admin capabilities that can be granted through roles
+const (
+	CapUserManagement    = "user"     //Manage user accounts, sessions and public registry
+	CapStorageManagement = "storage"  //Manage disks, RAID, storage pools and quotas
+	CapNetworkSettings   = "network"  //Manage network, file servers, proxy and certificates
+	CapModuleInstall     = "module"   //Install, reload and configure modules
+	CapLogViewing        = "log"      //View system and login logs
+	CapSecuritySettings  = "security" //Manage login methods, IP access control and AGI policy
+	CapSystemManagement  = "system"   //Manage updates, backups, boot flags and power
+)
+
+// All capabilities, in display order
+var Capabilities = []string{
+	CapUserManagement,
+	CapStorageManagement,
+	CapNetworkSettings,
+	CapModuleInstall,
+	CapLogViewing,
+	CapSecuritySettings,
+	CapSystemManagement,
+}
+
+type Role struct {
+	Name         string
+	Capabilities []string
+	BuiltIn      bool
+}
+
+// Roles that always exist and cannot be edited
+var builtInRoles = []*Role{
+	{Name: "User Manager", Capabilities: []string{CapUserManagement}, BuiltIn: true},
+	{Name: "Storage Manager", Capabilities: []string{CapStorageManagement}, BuiltIn: true},
+	{Name: "Network Manager", Capabilities: []string{CapNetworkSettings}, BuiltIn: true},
+	{Name: "Module Manager", Capabilities: []string{CapModuleInstall}, BuiltIn: true},
+	{Name: "Log Viewer", Capabilities: []string{CapLogViewing}, BuiltIn: true},
+	{Name: "Security Manager", Capabilities: []string{CapSecuritySettings}, BuiltIn: true},
+	{Name: "System Manager", Capabilities: []string{CapSystemManagement, CapLogViewing}, BuiltIn: true},
+}
+
+// List all built-in and custom roles
+func (h *PermissionHandler) ListRoles() []*Role {
+	results := append([]*Role{}, builtInRoles...)
+	entries, err := h.database.ListTable("permission")
+	if err != nil {
+		return results
+	}
+	custom := []*Role{}
+	for _, keypairs := range entries {
+		key := string(keypairs[0])
+		if !strings.HasPrefix(key, "role/") {
+			continue
+		}
+		role := h.GetRole(strings.TrimPrefix(key, "role/"))
+		if role != nil {
+			custom = append(custom, role)
+		}
+	}
+	sort.Slice(custom, func(i, j int) bool {
+		return custom[i].Name < custom[j].Name
+	})
+	return append(results, custom...)
+}
+
+// Get a role by name, return nil if not found
+func (h *PermissionHandler) GetRole(name string) *Role {
+	for _, role := range builtInRoles {
+		if role.Name == name {
+			return role
+		}
+	}
+	capabilities := []string{}
+	if !h.database.KeyExists("permission", "role/"+name) {
+		return nil
+	}
+	if err := h.database.Read("permission", "role/"+name, &capabilities); err != nil {
+		return nil
+	}
+	return &Role{
+		Name:         name,
+		Capabilities: capabilities,
+	}
+}
+
+// Create or update a custom role
+func (h *PermissionHandler) SetRole(name string, capabilities []string) error {
+	name = strings.TrimSpace(name)
+	if name == "" || strings.Contains(name, "/") {
+		return errors.New("invalid role name")
+	}
+	if role := h.GetRole(name); role != nil && role.BuiltIn {
+		return errors.New("built-in roles cannot be modified")
+	}
+	if len(capabilities) == 0 {
+		return errors.New("role must contain at least one capability")
+	}
+	for _, capability := range capabilities {
+		if !utils.StringInArray(Capabilities, capability) {
+			return errors.New("unknown capability: " + capability)
+		}
+	}
+	return h.database.Write("permission", "role/"+name, capabilities)
+}
+
+// Remove a custom role and unassign it from all groups
+func (h *PermissionHandler) RemoveRole(name string) error {
+	role := h.GetRole(name)
+	if role == nil {
+		return errors.New("role not exists")
+	}
+	if role.BuiltIn {
+		return errors.New("built-in roles cannot be removed")
+	}
+	for _, gp := range h.PermissionGroups {
+		if utils.StringInArray(gp.Roles, name) {
+			remaining := []string{}
+			for _, r := range gp.Roles {
+				if r != name {
+					remaining = append(remaining, r)
+				}
+			}
+			gp.SetRoles(remaining)
+		}
+	}
+	return h.database.Delete("permission", "role/"+name)
+}
+
+// Assign roles to this permission group
+func (gp *PermissionGroup) SetRoles(roles []string) error {
+	for _, name := range roles {
+		if gp.parent.GetRole(name) == nil {
+			return errors.New("role not exists: " + name)
+		}
+	}
+	gp.Roles = roles
+	return gp.parent.database.Write("permission", "roles/"+gp.Name, roles)
+}
+
+// Check if members of this group hold the given admin capability
+func (gp *PermissionGroup) HasCapability(capability string) bool {
+	if gp.IsAdmin {
+		return true
+	}
+	if gp.parent == nil {
+		return false
+	}
+	for _, name := range gp.Roles {
+		role := gp.parent.GetRole(name)
+		if role != nil && utils.StringInArray(role.Capabilities, capability) {
+			return true
+		}
+	}
+	return false
+}
+
+// Check if this group grants any admin privilege
+func (gp *PermissionGroup) IsPrivileged() bool {
+	return gp.IsAdmin || len(gp.Roles) > 0
+}
@@ -0,0 +1,64 @@
+package permission
+
+import (
+	"path/filepath"
+	"testing"
+
+	"imuslab.com/arozos/mod/database"
+)
+
+func TestRoleCapabilities(t *testing.T) {
+	sysdb, err := database.NewDatabase(filepath.Join(t.TempDir(), "test.db"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sysdb.Close()
+	h, err := NewPermissionHandler(sysdb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.LoadPermissionGroupsFromDatabase()
+
+	admin := h.GetPermissionGroupByName("administrator")
+	if admin == nil || !admin.HasCapability(CapStorageManagement) {
+		t.Fatal("administrator group should hold all capabilities")
+	}
+
+	staff := h.NewPermissionGroup("staff", false, 0, []string{}, "Desktop")
+	if staff.HasCapability(CapUserManagement) || staff.IsPrivileged() {
+		t.Fatal("group without roles should not hold capabilities")
+	}
+	if err := staff.SetRoles([]string{"Missing Role"}); err == nil {
+		t.Fatal("unknown role assigned")
+	}
+	if err := h.SetRole("User Manager", []string{CapSystemManagement}); err == nil {
+		t.Fatal("built-in role modified")
+	}
+	if err := h.SetRole("Helpdesk", []string{"unknown"}); err == nil {
+		t.Fatal("unknown capability accepted")
+	}
+	if err := h.SetRole("Helpdesk", []string{CapUserManagement, CapLogViewing}); err != nil {
+		t.Fatal(err)
+	}
+	if err := staff.SetRoles([]string{"Helpdesk"}); err != nil {
+		t.Fatal(err)
+	}
+	if !staff.HasCapability(CapLogViewing) || staff.HasCapability(CapStorageManagement) {
+		t.Fatal("unexpected capabilities from custom role")
+	}
+
+	//Roles are restored from database
+	h.LoadPermissionGroupsFromDatabase()
+	staff = h.GetPermissionGroupByName("staff")
+	if !staff.HasCapability(CapUserManagement) {
+		t.Fatal("roles not restored from database")
+	}
+
+	//Removing a role unassigns it from groups
+	if err := h.RemoveRole("Helpdesk"); err != nil {
+		t.Fatal(err)
+	}
+	if staff.HasCapability(CapUserManagement) || len(staff.Roles) != 0 {
+		t.Fatal("removed role still assigned")
+	}
+}
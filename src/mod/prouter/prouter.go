@@ -22,6 +22,7 @@ import (
 type RouterOption struct {
 	ModuleName    string                                   //The name of module that permission is based on
 	AdminOnly     bool                                     //Require admin permission to use this API endpoint
+	Capability    string                                   //The admin capability required, leave empty to require full admin. Only used if AdminOnly is set
 	RequireLAN    bool                                     //Require LAN connection (aka no external access)
 	CSRFTManager  *csrf.TokenManager                       //The CSRF Token Manager, can be nil if CSRFT is false
 	RequireCSRFT  bool                                     //Require CSRF Token to be accessiable
@@ -32,6 +33,7 @@ type RouterOption struct {
 type RouterDef struct {
 	moduleUUID              string
 	adminOnly               bool
+	capability              string
 	requireLAN              bool
 	userHandler             *user.UserHandler
 	endpoints               map[string]func(http.ResponseWriter, *http.Request)
@@ -42,6 +44,7 @@ func NewModuleRouter(option RouterOption) *RouterDef {
 	return &RouterDef{
 		moduleUUID:              option.ModuleName,
 		adminOnly:               option.AdminOnly,
+		capability:              option.Capability,
 		userHandler:             option.UserHandler,
 		requireLAN:              option.RequireLAN,
 		endpoints:               map[string]func(http.ResponseWriter, *http.Request){},
@@ -75,6 +78,12 @@ func (router *RouterDef) HandleFunc(endpoint string, handler func(http.ResponseW
 				return
 			}
 
+			//Users granted the capability by their roles can access the endpoint without the module permission
+			if router.adminOnly && router.capability != "" && userinfo.HasCapability(router.capability) {
+				handler(w, r)
+				return
+			}
+
 			//Check if this is a universal accessable router
 			if router.moduleUUID == "" {
 				//That means this router can serve anyone as soon as its fit the admin setting
@@ -0,0 +1,82 @@
+package quota
+
+import (
+	"path/filepath"
+	"sort"
+	"strings"
+
+	fs "imuslab.com/arozos/mod/filesystem"
+	"imuslab.com/arozos/mod/filesystem/arozfs"
+)
+
+/*
+	Usage Breakdown
+
+	Summarize the space used under a folder by its sub-folders and by file types
+*/
+
+type BreakdownEntry struct {
+	Name      string //Folder name or file extension
+	Size      int64
+	FileCount int
+}
+
+type UsageBreakdown struct {
+	TotalSize int64
+	FileCount int
+	Folders   []*BreakdownEntry //Usage of each direct sub-folder, files directly inside the root are grouped as "."
+	Types     []*BreakdownEntry //Usage of each file extension
+}
+
+// Get the usage breakdown of the folder with the file system abstraction
+func GetUsageBreakdown(fsh *fs.FileSystemHandler, rootRpath string) *UsageBreakdown {
+	rootRpath = strings.TrimSuffix(arozfs.ToSlash(filepath.Clean(rootRpath)), "/")
+	folders := map[string]*BreakdownEntry{}
+	types := map[string]*BreakdownEntry{}
+	result := UsageBreakdown{}
+
+	walkSize(fsh, rootRpath, func(filename string, size int64) {
+		relPath := strings.TrimPrefix(strings.TrimPrefix(arozfs.ToSlash(filename), rootRpath), "/")
+		folderName := "."
+		if strings.Contains(relPath, "/") {
+			folderName = strings.SplitN(relPath, "/", 2)[0]
+		}
+		fileType := strings.ToLower(strings.TrimPrefix(filepath.Ext(filename), "."))
+		if fileType == "" {
+			fileType = "(none)"
+		}
+
+		addToBreakdown(folders, folderName, size)
+		addToBreakdown(types, fileType, size)
+		result.TotalSize += size
+		result.FileCount++
+	})
+
+	result.Folders = sortBreakdown(folders)
+	result.Types = sortBreakdown(types)
+	return &result
+}
+
+func addToBreakdown(entries map[string]*BreakdownEntry, name string, size int64) {
+	entry, ok := entries[name]
+	if !ok {
+		entry = &BreakdownEntry{Name: name}
+		entries[name] = entry
+	}
+	entry.Size += size
+	entry.FileCount++
+}
+
+func sortBreakdown(entries map[string]*BreakdownEntry) []*BreakdownEntry {
+	results := []*BreakdownEntry{}
+	for _, entry := range entries {
+		results = append(results, entry)
+	}
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Size == results[j].Size {
+			return results[i].Name < results[j].Name
+		}
+		return results[i].Size > results[j].Size
+	})
+	return results
+}
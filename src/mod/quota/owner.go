@@ -0,0 +1,207 @@
+package quota
+
+/*
+	File Ownership Registry
+
+	Files on file systems without "user" hierarchy (e.g. public drives or
+	network drives shared by all users) are attributed to the user who
+	created them. The ownership is stored in the quota_owner table as
+
+	path/{fsh UUID}/{real path} => FileOwnership
+	owner/{username}/{fsh UUID}/{real path} => file size
+
+	so the files under a folder and the files owned by a user can both be
+	found with a prefix scan.
+*/
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+
+	db "imuslab.com/arozos/mod/database"
+	fs "imuslab.com/arozos/mod/filesystem"
+	"imuslab.com/arozos/mod/filesystem/arozfs"
+)
+
+const (
+	ownerTable       = "quota_owner"
+	ownerPathPrefix  = "path/"
+	ownerIndexPrefix = "owner/"
+	ownerBatchSize   = 1000 //Maximum number of records written in one transaction
+)
+
+type FileOwnership struct {
+	Owner string //Username of the creator
+	Size  int64  //File size when the ownership is recorded
+}
+
+// Attribute the file or all files in the folder to the owner, return the size newly attributed to the owner
+func SetFileOwner(database *db.Database, fsh *fs.FileSystemHandler, rpath string, owner string) int64 {
+	database.NewTable(ownerTable)
+	previous := map[string]FileOwnership{}
+	scanOwnership(database, ownershipKey(fsh.UUID, rpath), func(fileKey string, ownership FileOwnership) {
+		previous[fileKey] = ownership
+	})
+
+	added := int64(0)
+	batch := map[string]interface{}{}
+	staleIndex := []string{}
+	walkSize(fsh, rpath, func(filename string, size int64) {
+		fileKey := ownershipKey(fsh.UUID, filename)
+		if ownership, ok := previous[fileKey]; ok {
+			if ownership.Owner == owner {
+				//Overwriting its own file. Only count the difference
+				added -= ownership.Size
+			} else {
+				staleIndex = append(staleIndex, ownerIndexKey(ownership.Owner, fileKey))
+			}
+		}
+		batch[ownerPathPrefix+fileKey] = FileOwnership{
+			Owner: owner,
+			Size:  size,
+		}
+		batch[ownerIndexKey(owner, fileKey)] = size
+		added += size
+		if len(batch) >= ownerBatchSize {
+			database.WriteBatch(ownerTable, batch)
+			batch = map[string]interface{}{}
+		}
+	})
+	if len(batch) > 0 {
+		database.WriteBatch(ownerTable, batch)
+	}
+	if len(staleIndex) > 0 {
+		database.DeleteBatch(ownerTable, staleIndex)
+	}
+	return added
+}
+
+// Get the owner of the file, return empty string if the file is not attributed to anyone
+func GetFileOwner(database *db.Database, fshUUID string, rpath string) string {
+	ownership := FileOwnership{}
+	err := database.Read(ownerTable, ownerPathPrefix+ownershipKey(fshUUID, rpath), &ownership)
+	if err != nil {
+		return ""
+	}
+	return ownership.Owner
+}
+
+// Remove the ownership of the file or all files in the folder, return the reclaimed size of each owner
+func RemoveFileOwner(database *db.Database, fshUUID string, rpath string) map[string]int64 {
+	reclaimed := map[string]int64{}
+	keys := []string{}
+	scanOwnership(database, ownershipKey(fshUUID, rpath), func(fileKey string, ownership FileOwnership) {
+		reclaimed[ownership.Owner] += ownership.Size
+		keys = append(keys, ownerPathPrefix+fileKey, ownerIndexKey(ownership.Owner, fileKey))
+	})
+	if len(keys) > 0 {
+		database.DeleteBatch(ownerTable, keys)
+	}
+	return reclaimed
+}
+
+// Remove all ownership records of the user, e.g. when the user is removed
+func RemoveAllFilesOwnedBy(database *db.Database, owner string) {
+	keys := []string{}
+	for fileKey := range listOwnedFiles(database, owner, "") {
+		keys = append(keys, ownerPathPrefix+fileKey, ownerIndexKey(owner, fileKey))
+	}
+	if len(keys) > 0 {
+		database.DeleteBatch(ownerTable, keys)
+	}
+}
+
+// Iterate the ownership records of the file or the files under the folder
+func scanOwnership(database *db.Database, fileKey string, handler func(fileKey string, ownership FileOwnership)) {
+	database.ScanPrefix(ownerTable, ownerPathPrefix+fileKey, false, func(key []byte, value []byte) bool {
+		thisKey := strings.TrimPrefix(string(key), ownerPathPrefix)
+		if thisKey != fileKey && !strings.HasPrefix(thisKey, fileKey+"/") {
+			//Sibling with the same name prefix, e.g. file.txt.bak of file.txt
+			return true
+		}
+		ownership := FileOwnership{}
+		if json.Unmarshal(value, &ownership) == nil {
+			handler(thisKey, ownership)
+		}
+		return true
+	})
+}
+
+// List the files owned by the user on the file system, or all file systems if fshUUID is empty.
+// Return file key => recorded size
+func listOwnedFiles(database *db.Database, owner string, fshUUID string) map[string]int64 {
+	results := map[string]int64{}
+	prefix := ownerIndexPrefix + owner + "/"
+	if fshUUID != "" {
+		prefix += fshUUID + "/"
+	}
+	database.ScanPrefix(ownerTable, prefix, false, func(key []byte, value []byte) bool {
+		size := int64(0)
+		if json.Unmarshal(value, &size) == nil {
+			results[strings.TrimPrefix(string(key), ownerIndexPrefix+owner+"/")] = size
+		}
+		return true
+	})
+	return results
+}
+
+// Update the size of the files owned by the user on this file system and drop the removed ones. Return the total size
+func reconcileOwnedFiles(database *db.Database, fsh *fs.FileSystemHandler, owner string) int64 {
+	total := int64(0)
+	fshAbs := fsh.FileSystemAbstraction
+	removed := []string{}
+	updated := map[string]interface{}{}
+	for fileKey, recordedSize := range listOwnedFiles(database, owner, fsh.UUID) {
+		rpath := strings.TrimPrefix(fileKey, fsh.UUID+"/")
+		if !fshAbs.FileExists(rpath) {
+			removed = append(removed, ownerPathPrefix+fileKey, ownerIndexKey(owner, fileKey))
+			continue
+		}
+		size := fshAbs.GetFileSize(rpath)
+		if size != recordedSize {
+			updated[ownerPathPrefix+fileKey] = FileOwnership{
+				Owner: owner,
+				Size:  size,
+			}
+			updated[ownerIndexKey(owner, fileKey)] = size
+		}
+		total += size
+	}
+	if len(removed) > 0 {
+		database.DeleteBatch(ownerTable, removed)
+	}
+	if len(updated) > 0 {
+		database.WriteBatch(ownerTable, updated)
+	}
+	return total
+}
+
+// Walk the file or folder with the file system abstraction and return the total size.
+// Files removed during the walk are ignored. fileHandler can be nil
+func walkSize(fsh *fs.FileSystemHandler, rpath string, fileHandler func(filename string, size int64)) int64 {
+	total := int64(0)
+	fsh.FileSystemAbstraction.Walk(rpath, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info == nil {
+			//This file gone when quota is calculating. Ignore this
+			return nil
+		}
+		if !info.IsDir() {
+			total += info.Size()
+			if fileHandler != nil {
+				fileHandler(path, info.Size())
+			}
+		}
+		return nil
+	})
+	return total
+}
+
+func ownershipKey(fshUUID string, rpath string) string {
+	return fshUUID + "/" + strings.TrimSuffix(arozfs.ToSlash(filepath.Clean(rpath)), "/")
+}
+
+func ownerIndexKey(owner string, fileKey string) string {
+	return ownerIndexPrefix + owner + "/" + fileKey
+}
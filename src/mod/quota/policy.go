@@ -0,0 +1,109 @@
+package quota
+
+/*
+	File System Quota Policy
+
+	Limit the space each user can use on a file system. Mainly used on
+	public drives where files are attributed to their creator.
+	Group limits override the file system wide limit, and the largest
+	limit among the user's groups is used.
+*/
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+)
+
+const policyTable = "quota_policy"
+
+type FshPolicy struct {
+	FshUUID     string           //UUID of the file system handler
+	Limit       int64            //Space each user can use on this file system, -1 for unlimited
+	SoftLimit   int64            //Usage that trigger warnings, -1 for no warnings
+	GroupLimits map[string]int64 //Permission group name -> limit of each group member, -1 for unlimited
+}
+
+// Create or replace the quota policy of a file system
+func (q *QuotaHandler) SetFshPolicy(policy FshPolicy) error {
+	if policy.FshUUID == "" {
+		return errors.New("invalid file system UUID")
+	}
+	if policy.GroupLimits == nil {
+		policy.GroupLimits = map[string]int64{}
+	}
+	return q.database.Write(policyTable, policy.FshUUID, policy)
+}
+
+// Get the quota policy of a file system
+func (q *QuotaHandler) GetFshPolicy(fshUUID string) (*FshPolicy, error) {
+	policy := FshPolicy{}
+	if fshUUID == "" || !q.database.KeyExists(policyTable, fshUUID) {
+		return nil, errors.New("policy not found")
+	}
+	err := q.database.Read(policyTable, fshUUID, &policy)
+	if err != nil {
+		return nil, err
+	}
+	return &policy, nil
+}
+
+// List all file system quota policies
+func (q *QuotaHandler) ListFshPolicies() []*FshPolicy {
+	results := []*FshPolicy{}
+	entries, err := q.database.ListTable(policyTable)
+	if err != nil {
+		return results
+	}
+	for _, keypairs := range entries {
+		policy := FshPolicy{}
+		if json.Unmarshal(keypairs[1], &policy) == nil {
+			results = append(results, &policy)
+		}
+	}
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].FshUUID < results[j].FshUUID
+	})
+	return results
+}
+
+// Remove the quota policy of a file system
+func (q *QuotaHandler) RemoveFshPolicy(fshUUID string) error {
+	if !q.database.KeyExists(policyTable, fshUUID) {
+		return errors.New("policy not found")
+	}
+	return q.database.Delete(policyTable, fshUUID)
+}
+
+// Get the hard and soft limit of this user on the file system, -1 if there is no limit
+func (q *QuotaHandler) GetFshLimit(fshUUID string) (int64, int64) {
+	policy, err := q.GetFshPolicy(fshUUID)
+	if err != nil {
+		return -1, -1
+	}
+
+	q.mutex.Lock()
+	groups := q.groups
+	q.mutex.Unlock()
+
+	limit := policy.Limit
+	groupLimitFound := false
+	for groupName, groupLimit := range policy.GroupLimits {
+		if _, ok := inSlice(groups, groupName); !ok {
+			continue
+		}
+		if !groupLimitFound || groupLimit < 0 || (limit >= 0 && groupLimit > limit) {
+			limit = groupLimit
+		}
+		groupLimitFound = true
+		if limit < 0 {
+			break
+		}
+	}
+
+	softLimit := policy.SoftLimit
+	if limit >= 0 && softLimit > limit {
+		softLimit = limit
+	}
+	return limit, softLimit
+}
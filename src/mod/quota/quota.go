@@ -5,13 +5,22 @@ package quota
 	author: tobychui
 
 	This system track and limit the quota of the users.
+
+	Usage is tracked incrementally per file system handler on every
+	file write / remove and persisted in the quota table as
+
+	quota/{username}/quota => total storage quota
+	quota/{username}/softquota => soft quota that trigger warnings
+	quota/{username}/usage => usageRecord
+
+	The usage is reconciled with the actual storage by CalculateQuotaUsage,
+	which scan the user folders of "user" hierarchy file systems and the
+	files attributed to the user on other hierarchies (see owner.go)
 */
 
 import (
-	//"log"
-
-	"os"
-	"path/filepath"
+	"sync"
+	"time"
 
 	db "imuslab.com/arozos/mod/database"
 	fs "imuslab.com/arozos/mod/filesystem"
@@ -21,9 +30,28 @@ import (
 type QuotaHandler struct {
 	database          *db.Database //System database for storing data
 	username          string       //The current username for this handler
+	groups            []string     //Permission groups of this user, for group quota on file systems
 	fspool            []*fs.FileSystemHandler
 	TotalStorageQuota int64
 	UsedStorageQuota  int64
+	SoftStorageQuota  int64 //Usage that trigger warnings, 0 for 90% of total quota
+
+	usage         map[string]int64 //File system handler UUID -> used space in bytes
+	lastReconcile int64
+	warned        map[string]bool //Soft limit warnings that have been sent
+	mutex         sync.Mutex
+}
+
+type usageRecord struct {
+	PerFsh        map[string]int64
+	LastReconcile int64
+}
+
+var warningHandler func(username string, warning string)
+
+//Set the handler to be called when a user exceed the soft limit
+func SetWarningHandler(handler func(username string, warning string)) {
+	warningHandler = handler
 }
 
 //Create a storage quotation handler for this user
@@ -39,15 +67,24 @@ func NewUserQuotaHandler(database *db.Database, username string, fsh []*fs.FileS
 			fspool:            fsh,
 			TotalStorageQuota: 0,
 			UsedStorageQuota:  0,
+			usage:             map[string]int64{},
+			warned:            map[string]bool{},
 		}
 	}
+	database.NewTable(ownerTable)
+	database.NewTable(policyTable)
 
 	//Get the user storage quota
 	if !database.KeyExists("quota", username+"/quota") {
 		//This user do not have a quota yet. Put in a default quota
 		database.Write("quota", username+"/quota", defaultQuota)
+	} else {
+		database.Read("quota", username+"/quota", &totalQuota)
 	}
 
+	softQuota := int64(0)
+	database.Read("quota", username+"/softquota", &softQuota)
+
 	//Load the user storage quota from database
 	thisUserQuotaManager := QuotaHandler{
 		database:          database,
@@ -55,16 +92,31 @@ func NewUserQuotaHandler(database *db.Database, username string, fsh []*fs.FileS
 		fspool:            fsh,
 		TotalStorageQuota: totalQuota,
 		UsedStorageQuota:  0,
+		SoftStorageQuota:  softQuota,
+		usage:             map[string]int64{},
+		warned:            map[string]bool{},
+	}
+
+	//Load the previous usage record, scan the storage if this is the first time
+	record := usageRecord{}
+	err = database.Read("quota", username+"/usage", &record)
+	if err == nil && record.PerFsh != nil {
+		thisUserQuotaManager.usage = record.PerFsh
+		thisUserQuotaManager.lastReconcile = record.LastReconcile
+		thisUserQuotaManager.UsedStorageQuota = sumUsage(record.PerFsh)
+	} else {
+		thisUserQuotaManager.CalculateQuotaUsage()
 	}
 
-	thisUserQuotaManager.CalculateQuotaUsage()
 	return &thisUserQuotaManager
 }
 
 //Set and Get the user storage quota
 func (q *QuotaHandler) SetUserStorageQuota(quota int64) {
 	q.database.Write("quota", q.username+"/quota", quota)
+	q.mutex.Lock()
 	q.TotalStorageQuota = quota
+	q.mutex.Unlock()
 }
 
 func (q *QuotaHandler) GetUserStorageQuota() int64 {
@@ -76,6 +128,25 @@ func (q *QuotaHandler) GetUserStorageQuota() int64 {
 	return quota
 }
 
+//Set the soft quota of the user, 0 to use 90% of the storage quota
+func (q *QuotaHandler) SetUserSoftStorageQuota(quota int64) {
+	q.database.Write("quota", q.username+"/softquota", quota)
+	q.mutex.Lock()
+	q.SoftStorageQuota = quota
+	q.mutex.Unlock()
+}
+
+//Get the effective soft quota of the user, return -1 if there is no limit
+func (q *QuotaHandler) GetUserSoftStorageQuota() int64 {
+	if q.TotalStorageQuota < 0 {
+		return -1
+	}
+	if q.SoftStorageQuota > 0 && q.SoftStorageQuota < q.TotalStorageQuota {
+		return q.SoftStorageQuota
+	}
+	return q.TotalStorageQuota / 10 * 9
+}
+
 //Check if the user's quota has been initialized
 func (q *QuotaHandler) IsQuotaInitialized() bool {
 	if q.GetUserStorageQuota() == int64(-2) {
@@ -87,6 +158,9 @@ func (q *QuotaHandler) IsQuotaInitialized() bool {
 
 func (q *QuotaHandler) RemoveUserQuota() {
 	q.database.Delete("quota", q.username+"/quota")
+	q.database.Delete("quota", q.username+"/softquota")
+	q.database.Delete("quota", q.username+"/usage")
+	RemoveAllFilesOwnedBy(q.database, q.username)
 }
 
 func (q *QuotaHandler) HaveSpace(size int64) bool {
@@ -101,51 +175,214 @@ func (q *QuotaHandler) HaveSpace(size int64) bool {
 	}
 }
 
+//Check if the user have space for the given size on the given file system, including the file system and group quota
+func (q *QuotaHandler) HaveSpaceOnFsh(fshUUID string, size int64) bool {
+	if !q.HaveSpace(size) {
+		return false
+	}
+	limit, _ := q.GetFshLimit(fshUUID)
+	if limit < 0 {
+		return true
+	}
+	return q.GetFshUsage(fshUUID)+size < limit
+}
+
 //Update the user's storage pool to new one
 func (q *QuotaHandler) UpdateUserStoragePool(fsh []*fs.FileSystemHandler) {
+	q.mutex.Lock()
 	q.fspool = fsh
+	q.mutex.Unlock()
+}
+
+//Update the user's permission groups for group quota
+func (q *QuotaHandler) UpdateUserGroups(groups []string) {
+	q.mutex.Lock()
+	q.groups = groups
+	q.mutex.Unlock()
 }
 
 //Claim a space for the given file and set the file ownership to this user
 func (q *QuotaHandler) AllocateSpace(filesize int64) error {
-	q.UsedStorageQuota += filesize
-	return nil
+	return q.AllocateSpaceOnFsh("", filesize)
 }
 
 //Reclaim file occupied space (Call this before removing it)
 func (q *QuotaHandler) ReclaimSpace(filesize int64) error {
-	q.UsedStorageQuota -= filesize
-	if q.UsedStorageQuota < 0 {
-		q.UsedStorageQuota = 0
+	return q.ReclaimSpaceOnFsh("", filesize)
+}
+
+//Claim a space on the given file system
+func (q *QuotaHandler) AllocateSpaceOnFsh(fshUUID string, filesize int64) error {
+	err := q.updateUsage(fshUUID, filesize)
+	q.checkSoftLimits(fshUUID)
+	return err
+}
+
+//Reclaim space on the given file system
+func (q *QuotaHandler) ReclaimSpaceOnFsh(fshUUID string, filesize int64) error {
+	err := q.updateUsage(fshUUID, -filesize)
+	q.checkSoftLimits(fshUUID)
+	return err
+}
+
+//Get the used space of this user on the given file system
+func (q *QuotaHandler) GetFshUsage(fshUUID string) int64 {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return q.usage[fshUUID]
+}
+
+//Get the used space of this user on each file system
+func (q *QuotaHandler) GetUsage() map[string]int64 {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	results := map[string]int64{}
+	for fshUUID, size := range q.usage {
+		if fshUUID == "" {
+			//Unattributed usage from legacy callers
+			continue
+		}
+		results[fshUUID] = size
 	}
-	return nil
+	return results
+}
+
+//Get the unix timestamp of the last reconcile with storage
+func (q *QuotaHandler) GetLastReconcileTime() int64 {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return q.lastReconcile
+}
+
+//Get the warnings of exceeded soft limits
+func (q *QuotaHandler) GetWarnings() []string {
+	warnings := []string{}
+	softQuota := q.GetUserSoftStorageQuota()
+	if softQuota >= 0 && q.UsedStorageQuota >= softQuota {
+		warnings = append(warnings, "Storage usage "+fs.GetFileDisplaySize(q.UsedStorageQuota, 2)+" exceeded the soft limit of "+fs.GetFileDisplaySize(softQuota, 2))
+	}
+	for fshUUID, used := range q.GetUsage() {
+		_, softLimit := q.GetFshLimit(fshUUID)
+		if softLimit >= 0 && used >= softLimit {
+			warnings = append(warnings, "Storage usage on "+fshUUID+":/ "+fs.GetFileDisplaySize(used, 2)+" exceeded the soft limit of "+fs.GetFileDisplaySize(softLimit, 2))
+		}
+	}
+	return warnings
 }
 
 //Recalculate the user storage quota. This takes a lot of time and CPUs
 func (q *QuotaHandler) CalculateQuotaUsage() {
-	totalUsedVolume := int64(0)
-	for _, thisfs := range q.fspool {
+	q.mutex.Lock()
+	fspool := q.fspool
+	q.mutex.Unlock()
+
+	perFsh := map[string]int64{}
+	for _, thisfs := range fspool {
+		if thisfs.Closed || thisfs.FileSystemAbstraction == nil {
+			continue
+		}
 		if thisfs.Hierarchy == "user" {
-			if !fs.FileExists(filepath.ToSlash(filepath.Clean(thisfs.Path)) + "/users/" + q.username) {
+			userRoot, err := thisfs.FileSystemAbstraction.VirtualPathToRealPath(thisfs.UUID+":/", q.username)
+			if err != nil || !thisfs.FileSystemAbstraction.FileExists(userRoot) {
 				//This folder not exists. Maybe not initialized
 				continue
 			}
-			err := filepath.Walk(filepath.ToSlash(filepath.Clean(thisfs.Path))+"/users/"+q.username, func(path string, info os.FileInfo, err error) error {
-				if info == nil || err != nil {
-					//This file gone when quota is calculating. Ignore this
-					return nil
-				}
-				if !info.IsDir() {
-					totalUsedVolume += fs.GetFileSize(path)
-				}
-				return nil
-			})
-			if err != nil {
-				continue
+			perFsh[thisfs.UUID] = walkSize(thisfs, userRoot, nil)
+		} else {
+			//Files on shared file systems are counted by their creator
+			ownedSize := reconcileOwnedFiles(q.database, thisfs, q.username)
+			if ownedSize > 0 {
+				perFsh[thisfs.UUID] = ownedSize
 			}
 		}
 	}
-	q.UsedStorageQuota = totalUsedVolume
+
+	q.mutex.Lock()
+	q.usage = perFsh
+	q.lastReconcile = time.Now().Unix()
+	q.UsedStorageQuota = sumUsage(perFsh)
+	q.saveUsage()
+	q.mutex.Unlock()
+
+	for fshUUID := range perFsh {
+		q.checkSoftLimits(fshUUID)
+	}
+}
+
+//Recalculate the user storage quota if the last reconcile is older than maxAge seconds
+func (q *QuotaHandler) ReconcileIfOutdated(maxAge int64) {
+	if time.Now().Unix()-q.GetLastReconcileTime() > maxAge {
+		q.CalculateQuotaUsage()
+	}
+}
+
+func (q *QuotaHandler) updateUsage(fshUUID string, delta int64) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.usage[fshUUID] += delta
+	if q.usage[fshUUID] < 0 {
+		q.usage[fshUUID] = 0
+	}
+	q.UsedStorageQuota = sumUsage(q.usage)
+	return q.saveUsage()
+}
+
+//Save the usage record to database. Must be called with mutex locked
+func (q *QuotaHandler) saveUsage() error {
+	return q.database.Write("quota", q.username+"/usage", usageRecord{
+		PerFsh:        q.usage,
+		LastReconcile: q.lastReconcile,
+	})
+}
+
+//Send warnings if the user newly exceed the soft limits
+func (q *QuotaHandler) checkSoftLimits(fshUUID string) {
+	//The fs policy is read from database, take a snapshot of the usage first
+	q.mutex.Lock()
+	totalQuota := q.TotalStorageQuota
+	softQuota := q.GetUserSoftStorageQuota()
+	usedQuota := q.UsedStorageQuota
+	used := q.usage[fshUUID]
+	q.mutex.Unlock()
+
+	warnings := map[string]string{}
+	exceeded := map[string]bool{
+		"": softQuota >= 0 && usedQuota >= softQuota,
+	}
+	if exceeded[""] {
+		warnings[""] = "Your storage usage exceeded " + fs.GetFileDisplaySize(softQuota, 2) + " of your " + fs.GetFileDisplaySize(totalQuota, 2) + " quota"
+	}
+	if fshUUID != "" {
+		_, softLimit := q.GetFshLimit(fshUUID)
+		exceeded[fshUUID] = softLimit >= 0 && used >= softLimit
+		if exceeded[fshUUID] {
+			warnings[fshUUID] = "Your storage usage on " + fshUUID + ":/ exceeded the soft limit of " + fs.GetFileDisplaySize(softLimit, 2) + " (" + fs.GetFileDisplaySize(used, 2) + " used)"
+		}
+	}
+
+	q.mutex.Lock()
+	newWarnings := []string{}
+	for key, isExceeded := range exceeded {
+		if isExceeded && !q.warned[key] {
+			newWarnings = append(newWarnings, warnings[key])
+		}
+		q.warned[key] = isExceeded
+	}
+	q.mutex.Unlock()
+
+	if warningHandler != nil {
+		for _, warning := range newWarnings {
+			warningHandler(q.username, warning)
+		}
+	}
+}
+
+func sumUsage(perFsh map[string]int64) int64 {
+	total := int64(0)
+	for _, size := range perFsh {
+		total += size
+	}
+	return total
 }
 
 func inSlice(slice []string, val string) (int, bool) {
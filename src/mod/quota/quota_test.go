@@ -0,0 +1,117 @@
+package quota
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"imuslab.com/arozos/mod/database"
+	fs "imuslab.com/arozos/mod/filesystem"
+	"imuslab.com/arozos/mod/filesystem/abstractions/localfs"
+)
+
+func newTestFsh(uuid string, root string, hierarchy string) *fs.FileSystemHandler {
+	return &fs.FileSystemHandler{
+		UUID:                  uuid,
+		Path:                  root,
+		Hierarchy:             hierarchy,
+		Filesystem:            "ext4",
+		FileSystemAbstraction: localfs.NewLocalFileSystemAbstraction(uuid, root, hierarchy, false),
+	}
+}
+
+func writeTestFile(t *testing.T, filename string, size int) {
+	os.MkdirAll(filepath.Dir(filename), 0755)
+	if err := os.WriteFile(filename, make([]byte, size), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUsageAccountingAcrossHierarchies(t *testing.T) {
+	tmp := t.TempDir()
+	sysdb, err := database.NewDatabase(filepath.Join(tmp, "test.db"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sysdb.Close()
+
+	userFsh := newTestFsh("user", filepath.Join(tmp, "user"), "user")
+	publicFsh := newTestFsh("public", filepath.Join(tmp, "public"), "public")
+	writeTestFile(t, filepath.Join(tmp, "user", "users", "alice", "Desktop", "a.txt"), 100)
+	writeTestFile(t, filepath.Join(tmp, "user", "users", "alice", ".trash", "b.txt"), 50)
+
+	q := NewUserQuotaHandler(sysdb, "alice", []*fs.FileSystemHandler{userFsh, publicFsh}, 10000)
+	if q.UsedStorageQuota != 150 || q.GetFshUsage("user") != 150 {
+		t.Fatalf("expected 150 bytes used including trash, got %d", q.UsedStorageQuota)
+	}
+
+	//Files on the public drive are attributed to their creator
+	writeTestFile(t, filepath.Join(tmp, "public", "shared", "c.bin"), 200)
+	writeTestFile(t, filepath.Join(tmp, "public", "shared", "d.bin"), 300)
+	q.AllocateSpaceOnFsh("public", SetFileOwner(sysdb, publicFsh, filepath.Join(tmp, "public", "shared"), "alice"))
+	if q.GetFshUsage("public") != 500 || GetFileOwner(sysdb, "public", filepath.Join(tmp, "public", "shared", "c.bin")) != "alice" {
+		t.Fatalf("public drive usage not attributed, got %d", q.GetFshUsage("public"))
+	}
+
+	//Usage is persisted and survives a restart without rescanning
+	os.Remove(filepath.Join(tmp, "public", "shared", "d.bin"))
+	reloaded := NewUserQuotaHandler(sysdb, "alice", []*fs.FileSystemHandler{userFsh, publicFsh}, 10000)
+	if reloaded.UsedStorageQuota != 650 {
+		t.Fatalf("usage not persisted, got %d", reloaded.UsedStorageQuota)
+	}
+
+	//Reconcile drops files that were removed outside of the tracked operations
+	reloaded.CalculateQuotaUsage()
+	if reloaded.UsedStorageQuota != 350 || reloaded.GetFshUsage("public") != 200 {
+		t.Fatalf("reconcile failed, got %d", reloaded.UsedStorageQuota)
+	}
+
+	reclaimed := RemoveFileOwner(sysdb, "public", filepath.Join(tmp, "public", "shared"))
+	if reclaimed["alice"] != 200 {
+		t.Fatalf("unexpected reclaimed size %v", reclaimed)
+	}
+
+	breakdown := GetUsageBreakdown(userFsh, filepath.Join(tmp, "user", "users", "alice"))
+	if breakdown.TotalSize != 150 || len(breakdown.Folders) != 2 || breakdown.Folders[0].Name != "Desktop" || breakdown.Types[0].Name != "txt" {
+		t.Fatalf("unexpected breakdown %+v", breakdown)
+	}
+}
+
+func TestFshAndGroupPolicy(t *testing.T) {
+	tmp := t.TempDir()
+	sysdb, err := database.NewDatabase(filepath.Join(tmp, "test.db"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sysdb.Close()
+
+	warnings := []string{}
+	SetWarningHandler(func(username string, warning string) {
+		warnings = append(warnings, warning)
+	})
+	defer SetWarningHandler(nil)
+
+	q := NewUserQuotaHandler(sysdb, "bob", []*fs.FileSystemHandler{}, -1)
+	q.UpdateUserGroups([]string{"default", "staff"})
+	q.SetFshPolicy(FshPolicy{
+		FshUUID:     "public",
+		Limit:       1000,
+		SoftLimit:   800,
+		GroupLimits: map[string]int64{"staff": 2000, "guest": 100},
+	})
+
+	limit, softLimit := q.GetFshLimit("public")
+	if limit != 2000 || softLimit != 800 {
+		t.Fatalf("group limit not applied, got %d / %d", limit, softLimit)
+	}
+	if !q.HaveSpaceOnFsh("public", 1500) || q.HaveSpaceOnFsh("public", 2500) || !q.HaveSpaceOnFsh("other", 2500) {
+		t.Fatal("unexpected file system quota check result")
+	}
+
+	//Soft limit warning is only sent once when the usage cross the limit
+	q.AllocateSpaceOnFsh("public", 900)
+	q.AllocateSpaceOnFsh("public", 10)
+	if len(warnings) != 1 || len(q.GetWarnings()) != 1 {
+		t.Fatalf("expected one soft limit warning, got %v", warnings)
+	}
+}
@@ -37,6 +37,7 @@ import (
 	"imuslab.com/arozos/mod/auth"
 	filesystem "imuslab.com/arozos/mod/filesystem"
 	"imuslab.com/arozos/mod/filesystem/arozfs"
+	"imuslab.com/arozos/mod/filesystem/fileaudit"
 	"imuslab.com/arozos/mod/filesystem/metadata"
 	"imuslab.com/arozos/mod/share/shareEntry"
 	"imuslab.com/arozos/mod/user"
@@ -49,6 +50,7 @@ type Options struct {
 	ShareEntryTable *shareEntry.ShareEntryTable
 	HostName        string
 	TmpFolder       string
+	AuditLogger     *fileaudit.Logger //Optional, record share creation and downloads via share links
 }
 
 type Manager struct {
@@ -524,6 +526,11 @@ func (s *Manager) HandleShareAccess(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
+		//Record the download in the file audit trail
+		if directDownload || directServe {
+			s.recordShareDownload(w, r, shareOption, relpath)
+		}
+
 		//Serve the download page
 		if targetFshAbs.IsDir(fileRuntimeAbsPath) {
 			//This share is a folder
@@ -970,6 +977,7 @@ func (s *Manager) HandleCreateNewShare(w http.ResponseWriter, r *http.Request) {
 		utils.SendErrorResponse(w, err.Error())
 		return
 	}
+	s.options.AuditLogger.NewRecorderFromRequest(r, userinfo.Username, fileaudit.ChannelWeb).Record(fileaudit.ActionShare, vpath, "")
 
 	js, _ := json.Marshal(share)
 	utils.SendJSONResponse(w, string(js))
@@ -1080,11 +1088,13 @@ func (s *Manager) HandleDeleteShare(w http.ResponseWriter, r *http.Request) {
 	}
 
 	//Delete the share setting
+	so := s.GetShareObjectFromUUID(uuid)
 	err = s.DeleteShareByUUID(userinfo, uuid)
 
 	if err != nil {
 		utils.SendErrorResponse(w, err.Error())
 	} else {
+		s.options.AuditLogger.NewRecorderFromRequest(r, userinfo.Username, fileaudit.ChannelWeb).Record(fileaudit.ActionUnshare, so.FileVirtualPath, "")
 		utils.SendOK(w)
 	}
 }
@@ -1195,6 +1205,22 @@ func (s *Manager) CreateNewShare(userinfo *user.User, srcFsh *filesystem.FileSys
 
 }
 
+// Record a download through share link. Guests are logged with empty username
+func (s *Manager) recordShareDownload(w http.ResponseWriter, r *http.Request, shareOption *shareEntry.ShareOption, relpath string) {
+	if s.options.AuditLogger == nil {
+		return
+	}
+	username := ""
+	if s.options.AuthAgent.CheckAuth(r) {
+		username, _ = s.options.AuthAgent.GetUserName(w, r)
+	}
+	src := shareOption.FileVirtualPath
+	if relpath != "" {
+		src = arozfs.ToSlash(filepath.Join(src, relpath))
+	}
+	s.options.AuditLogger.NewRecorderFromRequest(r, username, fileaudit.ChannelShare).Record(fileaudit.ActionDownload, src, "/share/"+shareOption.UUID)
+}
+
 func ServePermissionDeniedPage(w http.ResponseWriter) {
 	w.WriteHeader(http.StatusForbidden)
 	pageContent := []byte("Permissioned Denied")
@@ -12,6 +12,7 @@ import (
 
 	"github.com/spf13/afero"
 	"imuslab.com/arozos/mod/filesystem"
+	"imuslab.com/arozos/mod/filesystem/fileaudit"
 	"imuslab.com/arozos/mod/user"
 )
 
@@ -23,6 +24,19 @@ var (
 type aofs struct {
 	userinfo  *user.User
 	tmpFolder string
+	audit     *fileaudit.Recorder
+}
+
+//File opened for writing, the ownership is updated after the upload is closed
+type quotaTrackedFile struct {
+	afero.File
+	onClose func()
+}
+
+func (f *quotaTrackedFile) Close() error {
+	err := f.File.Close()
+	f.onClose()
+	return err
 }
 
 func (a aofs) Create(name string) (afero.File, error) {
@@ -33,7 +47,14 @@ func (a aofs) Create(name string) (afero.File, error) {
 	if !a.checkAllowAccess(fsh, rewritePath, aofsCanWrite) {
 		return nil, errors.New("Permission denied")
 	}
-	return fsh.FileSystemAbstraction.Create(rewritePath)
+	written := a.userinfo.TrackFileWrite(fsh, ftpPathToVpath(name))
+	f, err := fsh.FileSystemAbstraction.Create(rewritePath)
+	if err != nil {
+		written()
+		return nil, err
+	}
+	a.record(fileaudit.ActionUpload, name, "")
+	return &quotaTrackedFile{f, written}, nil
 }
 
 func (a aofs) Chown(name string, uid, gid int) error {
@@ -55,7 +76,7 @@ func (a aofs) Mkdir(name string, perm os.FileMode) error {
 	if !a.checkAllowAccess(fsh, rewritePath, aofsCanWrite) {
 		return errors.New("Permission denied")
 	}
-	return fsh.FileSystemAbstraction.Mkdir(rewritePath, perm)
+	return a.recordIfSucceed(fsh.FileSystemAbstraction.Mkdir(rewritePath, perm), fileaudit.ActionMkdir, name, "")
 }
 
 func (a aofs) MkdirAll(path string, perm os.FileMode) error {
@@ -66,7 +87,7 @@ func (a aofs) MkdirAll(path string, perm os.FileMode) error {
 	if !a.checkAllowAccess(fsh, rewritePath, aofsCanWrite) {
 		return errors.New("Permission denied")
 	}
-	return fsh.FileSystemAbstraction.MkdirAll(rewritePath, perm)
+	return a.recordIfSucceed(fsh.FileSystemAbstraction.MkdirAll(rewritePath, perm), fileaudit.ActionMkdir, path, "")
 }
 
 func (a aofs) Open(name string) (afero.File, error) {
@@ -103,7 +124,21 @@ func (a aofs) OpenFile(name string, flag int, perm os.FileMode) (afero.File, err
 	if !a.checkAllowAccess(fsh, rewritePath, aofsCanWrite) {
 		return nil, errors.New("Permission denied")
 	}
-	return fsh.FileSystemAbstraction.OpenFile(rewritePath, flag, perm)
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_APPEND) != 0 {
+		written := a.userinfo.TrackFileWrite(fsh, ftpPathToVpath(name))
+		f, err := fsh.FileSystemAbstraction.OpenFile(rewritePath, flag, perm)
+		if err != nil {
+			written()
+			return nil, err
+		}
+		a.record(fileaudit.ActionUpload, name, "")
+		return &quotaTrackedFile{f, written}, nil
+	}
+	f, err := fsh.FileSystemAbstraction.OpenFile(rewritePath, flag, perm)
+	if err == nil {
+		a.record(fileaudit.ActionDownload, name, "")
+	}
+	return f, err
 }
 
 func (a aofs) AllocateSpace(size int) error {
@@ -122,7 +157,10 @@ func (a aofs) Remove(name string) error {
 		return errors.New("Permission denied")
 	}
 
-	return fsh.FileSystemAbstraction.Remove(rewritePath)
+	err = a.userinfo.TrackFileRemove(fsh, ftpPathToVpath(name), func() error {
+		return fsh.FileSystemAbstraction.Remove(rewritePath)
+	})
+	return a.recordIfSucceed(err, fileaudit.ActionDelete, name, "")
 }
 
 func (a aofs) RemoveAll(path string) error {
@@ -133,7 +171,10 @@ func (a aofs) RemoveAll(path string) error {
 	if !a.checkAllowAccess(fsh, rewritePath, aofsCanWrite) {
 		return errors.New("Permission denied")
 	}
-	return fsh.FileSystemAbstraction.RemoveAll(rewritePath)
+	err = a.userinfo.TrackFileRemove(fsh, ftpPathToVpath(path), func() error {
+		return fsh.FileSystemAbstraction.RemoveAll(rewritePath)
+	})
+	return a.recordIfSucceed(err, fileaudit.ActionDelete, path, "")
 }
 
 func (a aofs) Rename(oldname, newname string) error {
@@ -159,7 +200,10 @@ func (a aofs) Rename(oldname, newname string) error {
 
 	if fshsrc.UUID == fshdest.UUID {
 		//Renaming in same fsh
-		return fshsrc.FileSystemAbstraction.Rename(rewritePathsrc, rewritePathdest)
+		err = a.userinfo.TrackFileMove(fshsrc, ftpPathToVpath(oldname), fshdest, ftpPathToVpath(newname), func() error {
+			return fshsrc.FileSystemAbstraction.Rename(rewritePathsrc, rewritePathdest)
+		})
+		return a.recordIfSucceed(err, fileaudit.ActionMove, oldname, newname)
 	} else {
 		//Cross fsh read write.
 		f, err := fshsrc.FileSystemAbstraction.ReadStream(rewritePathsrc)
@@ -172,15 +216,43 @@ func (a aofs) Rename(oldname, newname string) error {
 		if err != nil {
 			return err
 		}
+		a.userinfo.SetOwnerOfFile(fshdest, ftpPathToVpath(newname))
 
-		err = fshsrc.FileSystemAbstraction.RemoveAll(rewritePathsrc)
+		err = a.userinfo.TrackFileRemove(fshsrc, ftpPathToVpath(oldname), func() error {
+			return fshsrc.FileSystemAbstraction.RemoveAll(rewritePathsrc)
+		})
 		if err != nil {
 			return err
 		}
+		a.record(fileaudit.ActionMove, oldname, newname)
 	}
 	return nil
 }
 
+//Convert the FTP path in the format of /{fshID}/{subpath} to virtual path
+func ftpPathToVpath(name string) string {
+	if name == "" {
+		return ""
+	}
+	pathChunks := strings.SplitN(strings.TrimPrefix(filepath.ToSlash(filepath.Clean(name)), "/"), "/", 2)
+	if len(pathChunks) == 1 {
+		return pathChunks[0] + ":/"
+	}
+	return pathChunks[0] + ":/" + pathChunks[1]
+}
+
+//Record the file operation to the audit trail
+func (a aofs) record(action string, src string, dest string) {
+	a.audit.Record(action, ftpPathToVpath(src), ftpPathToVpath(dest))
+}
+
+func (a aofs) recordIfSucceed(err error, action string, src string, dest string) error {
+	if err == nil {
+		a.record(action, src, dest)
+	}
+	return err
+}
+
 func (a aofs) Name() string {
 	return "arozos virtualFS"
 }
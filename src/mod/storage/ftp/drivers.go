@@ -4,10 +4,12 @@ import (
 	"crypto/tls"
 	"errors"
 	"log"
+	"net"
 	"os"
 	"time"
 
 	ftp "github.com/fclairamb/ftpserverlib"
+	"imuslab.com/arozos/mod/filesystem/fileaudit"
 )
 
 func (m mainDriver) GetSettings() (*ftp.Settings, error) {
@@ -47,6 +49,13 @@ func (m mainDriver) ClientDisconnected(cc ftp.ClientContext) {
 //Authenicate user using arozos authAgent
 func (m mainDriver) AuthUser(cc ftp.ClientContext, user string, pass string) (ftp.ClientDriver, error) {
 	authAgent := m.userHandler.GetAuthAgent()
+
+	//Check if the request is from a blacklisted ip range
+	allowAccess, err := authAgent.ValidateLoginIpAccess(cc.RemoteAddr().String())
+	if !allowAccess {
+		return nil, err
+	}
+
 	if authAgent.ValidateUsernameAndPassword(user, pass) {
 		//OK
 		userinfo, _ := m.userHandler.GetUserInfoFromUsername(user)
@@ -60,14 +69,7 @@ func (m mainDriver) AuthUser(cc ftp.ClientContext, user string, pass string) (ft
 		}
 		accessOK := userinfo.UserIsInOneOfTheGroupOf(allowedPgs)
 
-		if accessOK {
-			//Check if the request is from a blacklisted ip range
-			allowAccess, err := m.userHandler.GetAuthAgent().ValidateLoginIpAccess(cc.RemoteAddr().String())
-			if !allowAccess {
-				accessOK = false
-				return nil, err
-			}
-		} else {
+		if !accessOK {
 			//log the signin request
 			m.userHandler.GetAuthAgent().Logger.LogAuthByRequestInfo(user, cc.RemoteAddr().String(), time.Now().Unix(), false, "ftp")
 			//Disconnect this user as he is not in the group that is allowed to access ftp
@@ -84,9 +86,14 @@ func (m mainDriver) AuthUser(cc ftp.ClientContext, user string, pass string) (ft
 		//log the signin request
 		m.userHandler.GetAuthAgent().Logger.LogAuthByRequestInfo(userinfo.Username, cc.RemoteAddr().String(), time.Now().Unix(), true, "ftp")
 		//Return the aofs object
+		remoteIP := cc.RemoteAddr().String()
+		if host, _, err := net.SplitHostPort(remoteIP); err == nil {
+			remoteIP = host
+		}
 		return aofs{
 			userinfo:  userinfo,
 			tmpFolder: tmpFolder,
+			audit:     m.option.AuditLogger.NewRecorder(userinfo.Username, remoteIP, fileaudit.ChannelFTP),
 		}, nil
 	} else {
 		//log the signin request
@@ -95,6 +102,20 @@ func (m mainDriver) AuthUser(cc ftp.ClientContext, user string, pass string) (ft
 	}
 }
 
+//Refuse plaintext login before the password is sent
+func (m mainDriver) PreAuthUser(cc ftp.ClientContext, user string) error {
+	if (m.option.RequireTLS || m.option.RefusePlaintext) && !cc.HasTLSForControl() {
+		return errors.New("TLS is required, use AUTH TLS before login")
+	}
+	return nil
+}
+
 func (m mainDriver) GetTLSConfig() (*tls.Config, error) {
-	return nil, errors.New("Not Supported")
+	if m.option.GetCertificate == nil {
+		return nil, errors.New("Not Supported")
+	}
+	return &tls.Config{
+		GetCertificate: m.option.GetCertificate,
+		MinVersion:     tls.VersionTLS12,
+	}, nil
 }
@@ -1,6 +1,7 @@
 package ftp
 
 import (
+	"crypto/tls"
 	"errors"
 	"log"
 	"strconv"
@@ -9,6 +10,7 @@ import (
 
 	ftp "github.com/fclairamb/ftpserverlib"
 	"imuslab.com/arozos/mod/database"
+	"imuslab.com/arozos/mod/filesystem/fileaudit"
 	"imuslab.com/arozos/mod/user"
 )
 
@@ -20,35 +22,66 @@ type Handler struct {
 	UPNPEnabled   bool
 	userHandler   *user.UserHandler
 	server        *ftp.FtpServer
+	driver        *mainDriver
+}
+
+//ServerOption is the optional settings for FTPS and passive mode
+type ServerOption struct {
+	GetCertificate   func(*tls.ClientHelloInfo) (*tls.Certificate, error) //Certificate for explicit FTPS (AUTH TLS), nil to disable FTPS
+	RequireTLS       bool                                                 //Require TLS on both control and data channels
+	RefusePlaintext  bool                                                 //Refuse login on plaintext control channel, data channel can be plaintext
+	PassivePortStart int                                                  //Passive mode data port range, default Port + 1 to Port + 2
+	PassivePortEnd   int
+	AuditLogger      *fileaudit.Logger //Optional, record file operations to the file audit trail
 }
 
 type mainDriver struct {
 	setting           ftp.Settings
+	option            *ServerOption
 	userHandler       *user.UserHandler
 	tmpFolder         string
 	connectedUserList *sync.Map
 }
 
 //NewFTPHandler creates a new handler for FTP Server as a wrapper to the ftpserverlib
-func NewFTPHandler(userHandler *user.UserHandler, ServerName string, Port int, tmpFolder string, PassiveModeIP string) (*Handler, error) {
+func NewFTPHandler(userHandler *user.UserHandler, ServerName string, Port int, tmpFolder string, PassiveModeIP string, option *ServerOption) (*Handler, error) {
 	//Create table for ftp if it doesn't exists
 	db := userHandler.GetDatabase()
 	db.NewTable("ftp")
 
+	if option == nil {
+		option = &ServerOption{}
+	}
+	if option.PassivePortStart <= 0 || option.PassivePortEnd < option.PassivePortStart {
+		option.PassivePortStart = Port + 1
+		option.PassivePortEnd = Port + 2
+	}
+	if (option.RequireTLS || option.RefusePlaintext) && option.GetCertificate == nil {
+		return nil, errors.New("FTPS certificate not available")
+	}
+
+	tlsRequirement := ftp.ClearOrEncrypted
+	if option.RequireTLS {
+		tlsRequirement = ftp.MandatoryEncryption
+	}
+
 	//Create a new FTP Server instance
-	server := ftp.NewFtpServer(&mainDriver{
+	driver := &mainDriver{
 		setting: ftp.Settings{
 			ListenAddr: ":" + strconv.Itoa(Port),
 			PublicHost: strings.TrimSpace(PassiveModeIP),
 			PassiveTransferPortRange: &ftp.PortRange{
-				Start: Port + 1,
-				End:   Port + 2,
+				Start: option.PassivePortStart,
+				End:   option.PassivePortEnd,
 			},
+			TLSRequired: tlsRequirement,
 		},
+		option:            option,
 		userHandler:       userHandler,
 		tmpFolder:         tmpFolder,
 		connectedUserList: &sync.Map{},
-	})
+	}
+	server := ftp.NewFtpServer(driver)
 	return &Handler{
 		ServerName:    ServerName,
 		Port:          Port,
@@ -56,6 +89,7 @@ func NewFTPHandler(userHandler *user.UserHandler, ServerName string, Port int, t
 		userHandler:   userHandler,
 		UPNPEnabled:   false,
 		server:        server,
+		driver:        driver,
 	}, nil
 }
 
@@ -88,3 +122,16 @@ func (f *Handler) Close() {
 		f.ServerRunning = false
 	}
 }
+
+//Get the number of clients currently connected to the FTP server
+func (f *Handler) ConnectedClientCount() int {
+	if !f.ServerRunning || f.driver == nil {
+		return 0
+	}
+	count := 0
+	f.driver.connectedUserList.Range(func(key, value interface{}) bool {
+		count++
+		return true
+	})
+	return count
+}
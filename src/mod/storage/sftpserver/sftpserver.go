@@ -7,10 +7,12 @@ import (
 	"net"
 	"os"
 	"sync"
+	"time"
 
 	"github.com/pkg/sftp"
 	uuid "github.com/satori/go.uuid"
 	"golang.org/x/crypto/ssh"
+	"imuslab.com/arozos/mod/filesystem/fileaudit"
 	user "imuslab.com/arozos/mod/user"
 )
 
@@ -18,6 +20,7 @@ type SFTPConfig struct {
 	ListeningIP string
 	KeyFile     string
 	UserManager *user.UserHandler
+	AuditLogger *fileaudit.Logger //Optional, record file operations to the file audit trail
 }
 
 type Instance struct {
@@ -37,7 +40,14 @@ func NewSFTPServer(sftpConfig *SFTPConfig) (*Instance, error) {
 			// a production setting.
 			//fmt.Printf("[SFTP] %s Logged in\n", c.User())
 
-			ok := sftpConfig.UserManager.GetAuthAgent().ValidateUsernameAndPassword(c.User(), string(pass))
+			authAgent := sftpConfig.UserManager.GetAuthAgent()
+			allowAccess, err := authAgent.ValidateLoginIpAccess(c.RemoteAddr().String())
+			if !allowAccess {
+				return nil, err
+			}
+
+			ok := authAgent.ValidateUsernameAndPassword(c.User(), string(pass))
+			authAgent.Logger.LogAuthByRequestInfo(c.User(), c.RemoteAddr().String(), time.Now().Unix(), ok, "sftp")
 			if !ok {
 				return nil, errors.New("[SFTP] Password rejected for " + c.User())
 			}
@@ -146,7 +156,12 @@ func NewSFTPServer(sftpConfig *SFTPConfig) (*Instance, error) {
 					}(requests)
 
 					//Create a virtual SSH Server that contains all this user's fsh
-					root := GetNewSFTPRoot(userinfo.Username, userinfo.GetAllFileSystemHandler())
+					remoteIP := nConn.RemoteAddr().String()
+					if host, _, err := net.SplitHostPort(remoteIP); err == nil {
+						remoteIP = host
+					}
+					audit := sftpConfig.AuditLogger.NewRecorder(userinfo.Username, remoteIP, fileaudit.ChannelSFTP)
+					root := GetNewSFTPRoot(userinfo, userinfo.GetAllFileSystemHandler(), audit)
 					server := sftp.NewRequestServer(channel, root)
 
 					//Create a channel for kicking the user off
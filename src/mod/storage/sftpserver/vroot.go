@@ -15,14 +15,18 @@ import (
 	"github.com/pkg/sftp"
 	"imuslab.com/arozos/mod/filesystem"
 	"imuslab.com/arozos/mod/filesystem/arozfs"
+	"imuslab.com/arozos/mod/filesystem/fileaudit"
+	"imuslab.com/arozos/mod/user"
 )
 
 //Root of the serving tree
 type root struct {
 	username       string
+	userinfo       *user.User
 	rootFile       *rootFolder
 	startDirectory string
 	fshs           []*filesystem.FileSystemHandler
+	audit          *fileaudit.Recorder
 }
 
 type rootFolder struct {
@@ -130,12 +134,26 @@ func (f *wrappedArozFile) WriteAt(b []byte, off int64) (int, error) {
 	return f.file.WriteAt(b, off)
 }
 
-func GetNewSFTPRoot(username string, accessibleFileSystemHandlers []*filesystem.FileSystemHandler) sftp.Handlers {
+//File opened for writing, the ownership is updated after the upload is closed
+type quotaTrackedFile struct {
+	arozfs.File
+	onClose func()
+}
+
+func (f *quotaTrackedFile) Close() error {
+	err := f.File.Close()
+	f.onClose()
+	return err
+}
+
+func GetNewSFTPRoot(userinfo *user.User, accessibleFileSystemHandlers []*filesystem.FileSystemHandler, audit *fileaudit.Recorder) sftp.Handlers {
 	root := &root{
-		username:       username,
+		username:       userinfo.Username,
+		userinfo:       userinfo,
 		rootFile:       &rootFolder{name: "/", modtime: time.Now(), isdir: true},
 		startDirectory: "/",
 		fshs:           accessibleFileSystemHandlers,
+		audit:          audit,
 	}
 	return sftp.Handlers{root, root, root, root}
 }
@@ -157,7 +175,11 @@ func (fs *root) Fileread(r *sftp.Request) (io.ReaderAt, error) {
 		return nil, os.ErrInvalid
 	}
 
-	return fs.OpenFile(r)
+	f, err := fs.OpenFile(r)
+	if err == nil {
+		fs.record(fileaudit.ActionDownload, r.Filepath, "")
+	}
+	return f, err
 }
 
 func (fs *root) Filewrite(r *sftp.Request) (io.WriterAt, error) {
@@ -166,17 +188,20 @@ func (fs *root) Filewrite(r *sftp.Request) (io.WriterAt, error) {
 		return nil, errors.New("ArozOS SFTP root is read only")
 	}
 
-	fsh, _, rpath, err := fs.getFshAndSubpathFromSFTPPathname(r.Filepath)
+	fsh, subpath, rpath, err := fs.getFshAndSubpathFromSFTPPathname(r.Filepath)
 	if err != nil {
 		return nil, err
 	}
 
+	written := fs.userinfo.TrackFileWrite(fsh, fsh.UUID+":/"+subpath)
 	f, err := fsh.FileSystemAbstraction.OpenFile(rpath, os.O_CREATE|os.O_WRONLY, 0775)
 	if err != nil {
+		written()
 		return nil, err
 	}
 
-	return f, nil
+	fs.record(fileaudit.ActionUpload, r.Filepath, "")
+	return &quotaTrackedFile{f, written}, nil
 }
 
 func (fs *root) OpenFile(r *sftp.Request) (sftp.WriterAtReaderAt, error) {
@@ -206,18 +231,18 @@ func (fs *root) Filecmd(r *sftp.Request) error {
 		//	return os.ErrExist
 		//}
 
-		return fs.rename(r.Filepath, r.Target)
+		return fs.recordIfSucceed(fs.rename(r.Filepath, r.Target), fileaudit.ActionMove, r.Filepath, r.Target)
 
 	case "Rmdir":
-		return fs.rmdir(r.Filepath)
+		return fs.recordIfSucceed(fs.rmdir(r.Filepath), fileaudit.ActionDelete, r.Filepath, "")
 
 	case "Remove":
 		// IEEE 1003.1 remove explicitly can unlink files and remove empty directories.
 		// We use instead here the semantics of unlink, which is allowed to be restricted against directories.
-		return fs.unlink(r.Filepath)
+		return fs.recordIfSucceed(fs.unlink(r.Filepath), fileaudit.ActionDelete, r.Filepath, "")
 
 	case "Mkdir":
-		return fs.mkdir(r.Filepath)
+		return fs.recordIfSucceed(fs.mkdir(r.Filepath), fileaudit.ActionMkdir, r.Filepath, "")
 
 	case "Link":
 		return fs.link(r.Filepath, r.Target)
@@ -231,18 +256,20 @@ func (fs *root) Filecmd(r *sftp.Request) error {
 }
 
 func (fs *root) rename(oldpath, newpath string) error {
-	oldFsh, _, realOldPath, err := fs.getFshAndSubpathFromSFTPPathname(oldpath)
+	oldFsh, oldSubpath, realOldPath, err := fs.getFshAndSubpathFromSFTPPathname(oldpath)
 	if err != nil {
 		return err
 	}
-	newFsh, _, realNewPath, err := fs.getFshAndSubpathFromSFTPPathname(newpath)
+	newFsh, newSubpath, realNewPath, err := fs.getFshAndSubpathFromSFTPPathname(newpath)
 	if err != nil {
 		return err
 	}
 
 	if oldFsh.UUID == newFsh.UUID {
 		//Use rename function
-		err = oldFsh.FileSystemAbstraction.Rename(realOldPath, realNewPath)
+		err = fs.userinfo.TrackFileMove(oldFsh, oldFsh.UUID+":/"+oldSubpath, newFsh, newFsh.UUID+":/"+newSubpath, func() error {
+			return oldFsh.FileSystemAbstraction.Rename(realOldPath, realNewPath)
+		})
 		if err != nil {
 			return err
 		}
@@ -258,6 +285,7 @@ func (fs *root) rename(oldpath, newpath string) error {
 		if err != nil {
 			return err
 		}
+		fs.userinfo.SetOwnerOfFile(newFsh, newFsh.UUID+":/"+newSubpath)
 
 		//Remove the src
 		//oldFsh.FileSystemAbstraction.RemoveAll(realOldPath)
@@ -267,7 +295,29 @@ func (fs *root) rename(oldpath, newpath string) error {
 }
 
 func (fs *root) PosixRename(r *sftp.Request) error {
-	return fs.rename(r.Filepath, r.Target)
+	return fs.recordIfSucceed(fs.rename(r.Filepath, r.Target), fileaudit.ActionMove, r.Filepath, r.Target)
+}
+
+// Record the file operation to the audit trail, SFTP paths are in the format of /{fshID}/{subpath}
+func (fs *root) record(action string, src string, dest string) {
+	toVpath := func(pathname string) string {
+		if pathname == "" {
+			return ""
+		}
+		pathChunks := strings.SplitN(strings.TrimPrefix(cleanPath(pathname), "/"), "/", 2)
+		if len(pathChunks) == 1 {
+			return pathChunks[0] + ":/"
+		}
+		return pathChunks[0] + ":/" + pathChunks[1]
+	}
+	fs.audit.Record(action, toVpath(src), toVpath(dest))
+}
+
+func (fs *root) recordIfSucceed(err error, action string, src string, dest string) error {
+	if err == nil {
+		fs.record(action, src, dest)
+	}
+	return err
 }
 
 func (fs *root) StatVFS(r *sftp.Request) (*sftp.StatVFS, error) {
@@ -284,11 +334,13 @@ func (fs *root) mkdir(pathname string) error {
 }
 
 func (fs *root) rmdir(pathname string) error {
-	fsh, _, rpath, err := fs.getFshAndSubpathFromSFTPPathname(pathname)
+	fsh, subpath, rpath, err := fs.getFshAndSubpathFromSFTPPathname(pathname)
 	if err != nil {
 		return err
 	}
-	return fsh.FileSystemAbstraction.RemoveAll(rpath)
+	return fs.userinfo.TrackFileRemove(fsh, fsh.UUID+":/"+subpath, func() error {
+		return fsh.FileSystemAbstraction.RemoveAll(rpath)
+	})
 }
 
 func (fs *root) link(oldpath, newpath string) error {
@@ -302,7 +354,7 @@ func (fs *root) symlink(target, linkpath string) error {
 }
 
 func (fs *root) unlink(pathname string) error {
-	fsh, _, rpath, err := fs.getFshAndSubpathFromSFTPPathname(pathname)
+	fsh, subpath, rpath, err := fs.getFshAndSubpathFromSFTPPathname(pathname)
 	if err != nil {
 		return err
 	}
@@ -313,7 +365,9 @@ func (fs *root) unlink(pathname string) error {
 		return os.ErrInvalid
 	}
 
-	return fsh.FileSystemAbstraction.Remove(rpath)
+	return fs.userinfo.TrackFileRemove(fsh, fsh.UUID+":/"+subpath, func() error {
+		return fsh.FileSystemAbstraction.Remove(rpath)
+	})
 }
 
 type listerat []os.FileInfo
@@ -11,13 +11,27 @@ import (
 	"imuslab.com/arozos/mod/filesystem"
 	"imuslab.com/arozos/mod/filesystem/arozfs"
 	"imuslab.com/arozos/mod/network/webdav"
+	"imuslab.com/arozos/mod/user"
 )
 
 type FshWebDAVAdapter struct {
 	fsh      *filesystem.FileSystemHandler
+	userinfo *user.User
 	username string
 }
 
+// File opened for writing, the ownership is updated after the file is closed
+type quotaTrackedFile struct {
+	webdav.File
+	onClose func()
+}
+
+func (f *quotaTrackedFile) Close() error {
+	err := f.File.Close()
+	f.onClose()
+	return err
+}
+
 type BufferFsIoHandler struct {
 	fsa       filesystem.FileSystemAbstraction
 	realpath  string
@@ -112,18 +126,23 @@ func (b BufferFsIoHandler) Write(p []byte) (n int, err error) {
 	return len(p), nil
 }
 
-func NewFshWebDAVAdapter(fsh *filesystem.FileSystemHandler, username string) *FshWebDAVAdapter {
+func NewFshWebDAVAdapter(fsh *filesystem.FileSystemHandler, userinfo *user.User) *FshWebDAVAdapter {
 	return &FshWebDAVAdapter{
 		fsh,
-		username,
+		userinfo,
+		userinfo.Username,
 	}
 }
 
-func (a *FshWebDAVAdapter) requestPathToRealPath(name string) (string, error) {
+func (a *FshWebDAVAdapter) requestPathToVpath(name string) string {
 	if len(name) == 0 || name[0:1] != "/" {
 		name = "/" + name
 	}
-	fullVpath := a.fsh.UUID + ":" + name
+	return a.fsh.UUID + ":" + name
+}
+
+func (a *FshWebDAVAdapter) requestPathToRealPath(name string) (string, error) {
+	fullVpath := a.requestPathToVpath(name)
 	realRequestPath, err := a.fsh.FileSystemAbstraction.VirtualPathToRealPath(fullVpath, a.username)
 	if err != nil {
 		return "", err
@@ -149,6 +168,20 @@ func (a *FshWebDAVAdapter) OpenFile(ctx context.Context, name string, flag int,
 		return nil, err
 	}
 
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_APPEND|os.O_TRUNC) != 0 {
+		//Opened for writing, update the quota after the content is written
+		written := a.userinfo.TrackFileWrite(a.fsh, a.requestPathToVpath(name))
+		f, err := a.openFile(realRequestPath, flag, perm)
+		if err != nil {
+			written()
+			return nil, err
+		}
+		return &quotaTrackedFile{f, written}, nil
+	}
+	return a.openFile(realRequestPath, flag, perm)
+}
+
+func (a *FshWebDAVAdapter) openFile(realRequestPath string, flag int, perm os.FileMode) (webdav.File, error) {
 	if a.fsh.RequireBuffer {
 		//Buffer the remote content to local for access
 		return newBufferFsIoHandler(a.fsh.FileSystemAbstraction, realRequestPath)
@@ -161,7 +194,9 @@ func (a *FshWebDAVAdapter) RemoveAll(ctx context.Context, name string) error {
 	if err != nil {
 		return err
 	}
-	return a.fsh.FileSystemAbstraction.RemoveAll(realRequestPath)
+	return a.userinfo.TrackFileRemove(a.fsh, a.requestPathToVpath(name), func() error {
+		return a.fsh.FileSystemAbstraction.RemoveAll(realRequestPath)
+	})
 }
 func (a *FshWebDAVAdapter) Rename(ctx context.Context, oldName, newName string) error {
 	realOldname, err := a.requestPathToRealPath(oldName)
@@ -174,7 +209,9 @@ func (a *FshWebDAVAdapter) Rename(ctx context.Context, oldName, newName string)
 		return err
 	}
 
-	return a.fsh.FileSystemAbstraction.Rename(realOldname, realNewname)
+	return a.userinfo.TrackFileMove(a.fsh, a.requestPathToVpath(oldName), a.fsh, a.requestPathToVpath(newName), func() error {
+		return a.fsh.FileSystemAbstraction.Rename(realOldname, realNewname)
+	})
 }
 func (a *FshWebDAVAdapter) Stat(ctx context.Context, name string) (os.FileInfo, error) {
 	realRequestPath, err := a.requestPathToRealPath(name)
@@ -11,7 +11,9 @@ package webdav
 import (
 	"encoding/json"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
 	"sort"
@@ -20,8 +22,10 @@ import (
 	"time"
 
 	"imuslab.com/arozos/mod/filesystem"
+	"imuslab.com/arozos/mod/filesystem/fileaudit"
 	"imuslab.com/arozos/mod/filesystem/hidden"
 	"imuslab.com/arozos/mod/filesystem/metadata"
+	"imuslab.com/arozos/mod/network"
 	"imuslab.com/arozos/mod/network/webdav"
 	"imuslab.com/arozos/mod/user"
 	"imuslab.com/arozos/mod/utils"
@@ -34,11 +38,14 @@ type Server struct {
 	prefix      string            //The prefix to strip away from filepath
 	tlsMode     bool              //Bypass tls windows mode if enabled
 	Enabled     bool              //If the server is enabled. Set this to false for disable this service
+	AuditLogger *fileaudit.Logger //Optional, record file operations to the file audit trail
 
 	//Windows related authentication using Web interface
 	readOnlyFileSystemHandler *webdav.Handler
 	windowsClientNotLoggedIn  sync.Map //Map to store not logged in windows WebDAV Client
 	windowsClientLoggedIn     sync.Map //Map to store logged in Windows WebDAV Client
+
+	activeClients sync.Map //Username and remote IP -> last request unix timestamp
 }
 
 type WindowClientInfo struct {
@@ -251,8 +258,9 @@ func (s *Server) HandleRequest(w http.ResponseWriter, r *http.Request) {
 	}
 	passwordValid, rejectionReason := authAgent.ValidateUsernameAndPasswordWithReason(username, password)
 	if !passwordValid {
-		authAgent.Logger.LogAuthByRequestInfo(username, r.RemoteAddr, time.Now().Unix(), false, "webdav")
-		log.Println("Someone from " + r.RemoteAddr + " try to log into " + username + " WebDAV endpoint but got rejected: " + rejectionReason)
+		clientIP, _ := network.GetIpFromRequest(r)
+		authAgent.Logger.LogAuthByRequestInfo(username, clientIP, time.Now().Unix(), false, "webdav")
+		log.Println("Someone from " + clientIP + " try to log into " + username + " WebDAV endpoint but got rejected: " + rejectionReason)
 		http.Error(w, rejectionReason, http.StatusUnauthorized)
 		return
 	}
@@ -282,14 +290,36 @@ func (s *Server) HandleRequest(w http.ResponseWriter, r *http.Request) {
 		}
 	*/
 
+	//Record the client for active client count
+	remoteIP := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		remoteIP = host
+	}
+	s.activeClients.Store(userinfo.Username+"@"+remoteIP, time.Now().Unix())
+
 	//Ok. Check if the file server of this root already exists
-	fs := s.getFsFromRealRoot(fsh, userinfo.Username, filepath.ToSlash(filepath.Join(s.prefix, reqRoot)))
+	fs := s.getFsFromRealRoot(fsh, userinfo, remoteIP, filepath.ToSlash(filepath.Join(s.prefix, reqRoot)))
 
 	//Serve the content
 	fs.ServeHTTP(w, r)
 
 }
 
+// Return the number of clients that sent an authenticated request within the given duration
+func (s *Server) ActiveClientCount(within time.Duration) int {
+	count := 0
+	since := time.Now().Add(-within).Unix()
+	s.activeClients.Range(func(key, value interface{}) bool {
+		if value.(int64) < since {
+			s.activeClients.Delete(key)
+		} else {
+			count++
+		}
+		return true
+	})
+	return count
+}
+
 /*
 Serve ReadOnly WebDAV Server
 
@@ -308,9 +338,10 @@ func (s *Server) serveReadOnlyWebDav(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func (s *Server) getFsFromRealRoot(fsh *filesystem.FileSystemHandler, username string, prefix string) *webdav.Handler {
+func (s *Server) getFsFromRealRoot(fsh *filesystem.FileSystemHandler, userinfo *user.User, remoteIP string, prefix string) *webdav.Handler {
 	//Create a webdav adapter from the fsh
-	fshadapter := NewFshWebDAVAdapter(fsh, username)
+	username := userinfo.Username
+	fshadapter := NewFshWebDAVAdapter(fsh, userinfo)
 	fs := &webdav.Handler{
 		Prefix:     prefix,
 		FileSystem: fshadapter,
@@ -330,5 +361,39 @@ func (s *Server) getFsFromRealRoot(fsh *filesystem.FileSystemHandler, username s
 		}()
 	}
 
+	//Record the succeeded file operations to the audit trail
+	recorder := s.AuditLogger.NewRecorder(username, remoteIP, fileaudit.ChannelWebDAV)
+	if recorder != nil {
+		fs.Logger = func(r *http.Request, err error) {
+			if err != nil {
+				return
+			}
+			toVpath := func(reqPath string) string {
+				return fsh.UUID + ":/" + strings.TrimPrefix(strings.TrimPrefix(reqPath, prefix), "/")
+			}
+			src := toVpath(r.URL.Path)
+			switch r.Method {
+			case "GET":
+				recorder.Record(fileaudit.ActionDownload, src, "")
+			case "PUT":
+				recorder.Record(fileaudit.ActionUpload, src, "")
+			case "MKCOL":
+				recorder.Record(fileaudit.ActionMkdir, src, "")
+			case "DELETE":
+				recorder.Record(fileaudit.ActionDelete, src, "")
+			case "COPY", "MOVE":
+				dest := ""
+				if u, err := url.Parse(r.Header.Get("Destination")); err == nil {
+					dest = toVpath(u.Path)
+				}
+				action := fileaudit.ActionCopy
+				if r.Method == "MOVE" {
+					action = fileaudit.ActionMove
+				}
+				recorder.Record(action, src, dest)
+			}
+		}
+	}
+
 	return fs
 }
@@ -129,7 +129,7 @@ func (s *Server) HandleWindowClientAccess(w http.ResponseWriter, r *http.Request
 			}
 
 			//Get and serve the file content
-			fs := s.getFsFromRealRoot(fsh, userinfo.Username, filepath.ToSlash(filepath.Join(s.prefix, vroot)))
+			fs := s.getFsFromRealRoot(fsh, userinfo, clientInfo.ClientIP, filepath.ToSlash(filepath.Join(s.prefix, vroot)))
 			fs.ServeHTTP(w, r)
 		}
 	}
@@ -19,6 +19,7 @@ import (
 	modules "imuslab.com/arozos/mod/modules"
 	"imuslab.com/arozos/mod/network/reverseproxy"
 	"imuslab.com/arozos/mod/network/websocketproxy"
+	permission "imuslab.com/arozos/mod/permission"
 	user "imuslab.com/arozos/mod/user"
 )
 
@@ -371,7 +372,7 @@ func (sr *SubServiceRouter) HandleListing(w http.ResponseWriter, r *http.Request
 func (sr *SubServiceRouter) HandleKillSubService(w http.ResponseWriter, r *http.Request) {
 	userinfo, _ := sr.userHandler.GetUserInfoFromRequest(w, r)
 	//Require admin permission
-	if !userinfo.IsAdmin() {
+	if !userinfo.HasCapability(permission.CapModuleInstall) {
 		sendErrorResponse(w, "Permission denied")
 		return
 	}
@@ -393,7 +394,7 @@ func (sr *SubServiceRouter) HandleStartSubService(w http.ResponseWriter, r *http
 	userinfo, _ := sr.userHandler.GetUserInfoFromRequest(w, r)
 
 	//Require admin permission
-	if !userinfo.IsAdmin() {
+	if !userinfo.HasCapability(permission.CapModuleInstall) {
 		sendErrorResponse(w, "Permission denied")
 		return
 	}
@@ -40,6 +40,8 @@ type ScheudlerOption struct {
 	Gateway     *agi.Gateway
 	Logger      *logger.Logger
 	CronFile    string //The location of the cronfile which store the jobs registry in file format
+
+	OnJobExecuted func(job Job, output string, err error) //Called after each job execution, can be nil
 }
 
 type Scheduler struct {
@@ -146,6 +148,10 @@ func (a *Scheduler) createTicker(duration time.Duration) chan bool {
 									a.cronlog(thisJob.Name + " executed: " + resp)
 									thisJob.lastExecutionOutput = resp
 								}
+
+								if a.options.OnJobExecuted != nil {
+									a.options.OnJobExecuted(thisJob, resp, err)
+								}
 							}(clonedJobStructure)
 
 						} else {
@@ -67,7 +67,8 @@ func HandleUpdateCheckSize(w http.ResponseWriter, r *http.Request) {
 	utils.SendJSONResponse(w, string(js))
 }
 
-func HandleUpdateDownloadRequest(w http.ResponseWriter, r *http.Request) {
+// Download, verify and stage the update. Progress is reported via websocket if ws=true
+func (u *Updater) HandleUpdateDownloadRequest(w http.ResponseWriter, r *http.Request) {
 	webpack, err := utils.GetPara(r, "webpack")
 	if err != nil {
 		utils.SendErrorResponse(w, "Invalid or empty webpack download URL")
@@ -80,10 +81,7 @@ func HandleUpdateDownloadRequest(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	checksum, err := utils.PostPara(r, "checksum")
-	if err != nil {
-		checksum = ""
-	}
+	version, _ := utils.GetPara(r, "version")
 
 	//Update the connection to websocket
 	requireWebsocket, _ := utils.GetPara(r, "ws")
@@ -102,7 +100,7 @@ func HandleUpdateDownloadRequest(w http.ResponseWriter, r *http.Request) {
 			Progress   float64
 			StatusText string
 		}
-		err = DownloadUpdatesFromURL(binary, webpack, checksum, func(stage int, progress float64, statusText string) {
+		_, err = u.Stage(binary, webpack, version, func(stage int, progress float64, statusText string) {
 			thisProgress := Progress{
 				Stage:      stage,
 				Progress:   progress,
@@ -113,7 +111,8 @@ func HandleUpdateDownloadRequest(w http.ResponseWriter, r *http.Request) {
 		})
 		if err != nil {
 			//Finish with error
-			c.WriteMessage(1, []byte("{\"error\":\""+err.Error()+"\"}"))
+			js, _ := json.Marshal(map[string]string{"error": err.Error()})
+			c.WriteMessage(1, js)
 		} else {
 			//Done without error
 			c.WriteMessage(1, []byte("OK"))
@@ -125,7 +124,7 @@ func HandleUpdateDownloadRequest(w http.ResponseWriter, r *http.Request) {
 
 	} else {
 		//Just download and return ok after finish
-		err = DownloadUpdatesFromURL(binary, webpack, checksum, func(stage int, progress float64, statusText string) {
+		_, err = u.Stage(binary, webpack, version, func(stage int, progress float64, statusText string) {
 			fmt.Println("Downloading Update, Stage: ", stage, " Progress: ", progress, " Status: ", statusText)
 		})
 		if err != nil {
@@ -137,6 +136,19 @@ func HandleUpdateDownloadRequest(w http.ResponseWriter, r *http.Request) {
 
 }
 
+// Return the update state and the versions kept for rollback
+func (u *Updater) HandleUpdateState(w http.ResponseWriter, r *http.Request) {
+	type StateInfo struct {
+		State    *UpdateState
+		Versions []*ReleaseInfo
+	}
+	js, _ := json.Marshal(StateInfo{
+		State:    u.GetState(),
+		Versions: u.ListVersions(),
+	})
+	utils.SendJSONResponse(w, string(js))
+}
+
 // Handle getting information for vendor update
 func HandleGetUpdatePlatformInfo(w http.ResponseWriter, r *http.Request) {
 	type UpdatePackageInfo struct {
@@ -171,9 +183,9 @@ func HandleGetUpdatePlatformInfo(w http.ResponseWriter, r *http.Request) {
 	utils.SendJSONResponse(w, string(js))
 }
 
-// Handle check if there is a pending update
-func HandlePendingCheck(w http.ResponseWriter, r *http.Request) {
-	if utils.FileExists("./updates/") && utils.FileExists("./updates/web/") && utils.FileExists("./updates/system/") {
+// Handle check if there is a staged update waiting for restart
+func (u *Updater) HandlePendingCheck(w http.ResponseWriter, r *http.Request) {
+	if u.GetState().Staged != "" {
 		//Update is pending
 		utils.SendJSONResponse(w, "true")
 	} else {
@@ -3,8 +3,6 @@ package updates
 import (
 	"archive/tar"
 	"compress/gzip"
-	"crypto/sha1"
-	"encoding/hex"
 	"errors"
 	"io"
 	"net/http"
@@ -14,15 +12,6 @@ import (
 	"strings"
 )
 
-func getFileSize(filename string) int64 {
-	fi, err := os.Stat(filename)
-	if err != nil {
-		return -1
-	}
-	// get the size
-	return fi.Size()
-}
-
 func getDownloadFileSize(url string) (int, error) {
 	headResp, err := http.Head(url)
 
@@ -33,36 +22,6 @@ func getDownloadFileSize(url string) (int, error) {
 	return strconv.Atoi(headResp.Header.Get("Content-Length"))
 }
 
-func downloadFile(url string, dest string) error {
-	out, err := os.Create(dest)
-
-	if err != nil {
-		return err
-	}
-
-	defer out.Close()
-
-	if err != nil {
-		return err
-	}
-
-	resp, err := http.Get(url)
-
-	if err != nil {
-		return err
-	}
-
-	defer resp.Body.Close()
-
-	_, err = io.Copy(out, resp.Body)
-
-	if err != nil {
-		return err
-	}
-
-	return nil
-}
-
 func extractTarGz(gzipStream io.Reader, unzipPath string, progressUpdateFunction func(int, float64, string)) error {
 	uncompressedStream, err := gzip.NewReader(gzipStream)
 	if err != nil {
@@ -82,14 +41,22 @@ func extractTarGz(gzipStream io.Reader, unzipPath string, progressUpdateFunction
 			return err
 		}
 
+		//Reject entries that escape the extraction folder
+		target := filepath.Join(unzipPath, header.Name)
+		relPath, err := filepath.Rel(unzipPath, target)
+		if err != nil || relPath == ".." || strings.HasPrefix(relPath, ".."+string(filepath.Separator)) {
+			return errors.New("Invalid path in webpack: " + header.Name)
+		}
+
 		switch header.Typeflag {
 		case tar.TypeDir:
-			if err := os.Mkdir(filepath.Join(unzipPath, header.Name), 0755); err != nil {
+			if err := os.MkdirAll(target, 0755); err != nil {
 				return err
 			}
 		case tar.TypeReg:
 			progressUpdateFunction(2, 100, "Extracting: "+header.Name)
-			outFile, err := os.Create(filepath.Join(unzipPath, header.Name))
+			os.MkdirAll(filepath.Dir(target), 0755)
+			outFile, err := os.Create(target)
 			if err != nil {
 				return err
 			}
@@ -104,28 +71,3 @@ func extractTarGz(gzipStream io.Reader, unzipPath string, progressUpdateFunction
 	}
 	return nil
 }
-
-func getSHA1Hash(filename string) (string, error) {
-	f, err := os.Open(filename)
-	if err != nil {
-		return "", err
-	}
-	defer f.Close()
-
-	h := sha1.New()
-	if _, err := io.Copy(h, f); err != nil {
-		return "", err
-	}
-	return hex.EncodeToString(h.Sum(nil)), nil
-}
-
-func readCheckSumFile(fileContent string, filename string, checksum string) bool {
-	checkSumFromFile := strings.Split(fileContent, "\r\n")
-	for _, line := range checkSumFromFile {
-		checkSumLine := strings.Split(line, " *")
-		if checkSumLine[1] == filename {
-			return checkSumLine[0] == checksum
-		}
-	}
-	return false
-}
@@ -0,0 +1,657 @@
+package updates
+
+/*
+	Verified Self Update
+
+	Each release is staged into {root}/versions/{version} and only switched
+	in after its signed manifest is verified with the release public key
+	of this build, and the binary and the webpack match the checksums in
+	the manifest.
+
+	The release public key is not part of the source tree. Maintainers
+	provide the base64 encoded ed25519 public key of their release signer
+	at build time, e.g.
+
+	make RELEASE_PUBLIC_KEY=<base64 public key>
+	go build -ldflags "-X imuslab.com/arozos/mod/updates.ReleasePublicKey=<base64 public key>"
+
+	Builds without a release public key refuse to stage any update.
+
+	Manifest: {binary URL}.manifest, JSON encoded ReleaseManifest
+	Signature: {binary URL}.manifest.sig, base64 encoded ed25519 signature
+	of the manifest file content.
+
+	The manifest binds the artifacts to a version and a platform, so a
+	signed build cannot be replayed on another platform, and versions
+	older than the running one are refused.
+
+	Switching a version renames the current web folder into the versions
+	folder of the running version and renames the staged web folder into
+	place, then replaces the binary. The new version is kept as pending
+	until it passes the health check after restart. If the health check
+	failed or the new build keeps failing to start, the previous version
+	is switched back.
+*/
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Base64 encoded ed25519 public key of the release signer, set at build time with -ldflags -X
+var ReleasePublicKey string
+
+type UpdaterOptions struct {
+	Root             string        //Install root that contains web/ and system/, e.g. ./
+	BinaryPath       string        //Path of the running binary, default to the current executable
+	CurrentVersion   string        //Version of the running build, used to name its folder in versions
+	PublicKey        string        //Base64 encoded ed25519 public key, default to ReleasePublicKey
+	KeepVersions     int           //Number of old versions kept for rollback, default 2
+	MaxStartAttempts int           //Start attempts of a pending version before rollback, default 3
+	HealthCheckDelay time.Duration //Wait time after startup before the health check, default 30 seconds
+	Client           *http.Client  //HTTP client for downloads, default to http.DefaultClient
+}
+
+type UpdateState struct {
+	Current       string //Version confirmed healthy
+	Previous      string //Version to rollback to
+	Pending       string //Version switched in but not yet confirmed healthy
+	PendingSince  int64
+	StartAttempts int    //Number of starts of the pending version
+	Staged        string //Version downloaded and verified, waiting to be switched in
+	LastError     string //Reason of the last failed update or rollback
+}
+
+// Signed description of a release build for one platform
+type ReleaseManifest struct {
+	Version       string
+	OS            string //runtime.GOOS of the binary
+	Arch          string //runtime.GOARCH of the binary
+	BinarySHA256  string
+	WebpackSHA256 string
+}
+
+type ReleaseInfo struct {
+	Version      string
+	StageTime    int64
+	BinarySHA256 string
+}
+
+type Updater struct {
+	options *UpdaterOptions
+	mutex   sync.Mutex
+}
+
+func NewUpdater(options *UpdaterOptions) (*Updater, error) {
+	if options.BinaryPath == "" {
+		executable, err := os.Executable()
+		if err != nil {
+			return nil, err
+		}
+		options.BinaryPath = executable
+	}
+	if options.PublicKey == "" {
+		options.PublicKey = ReleasePublicKey
+	}
+	if options.KeepVersions <= 0 {
+		options.KeepVersions = 2
+	}
+	if options.MaxStartAttempts <= 0 {
+		options.MaxStartAttempts = 3
+	}
+	if options.HealthCheckDelay <= 0 {
+		options.HealthCheckDelay = 30 * time.Second
+	}
+	if options.Client == nil {
+		options.Client = http.DefaultClient
+	}
+	err := os.MkdirAll(filepath.Join(options.Root, "versions"), 0755)
+	if err != nil {
+		return nil, err
+	}
+	return &Updater{
+		options: options,
+	}, nil
+}
+
+/*
+	Staging
+*/
+
+// Download and verify the release into the versions folder. The version is taken from
+// the signed manifest, if version is given it must match the manifest. Return the staged version
+func (u *Updater) Stage(binaryURL string, webpackURL string, version string, progressUpdateFunction func(int, float64, string)) (string, error) {
+	if progressUpdateFunction == nil {
+		progressUpdateFunction = func(int, float64, string) {}
+	}
+	publicKey, err := base64.StdEncoding.DecodeString(strings.TrimSpace(u.options.PublicKey))
+	if err != nil || len(publicKey) != ed25519.PublicKeySize {
+		return "", errors.New("no release public key set in this build, verified update is not available")
+	}
+	if !strings.HasSuffix(webpackURL, ".tar.gz") {
+		return "", errors.New("Webpack in invalid compression format")
+	}
+
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	stagingFolder := filepath.Join(u.options.Root, "versions", ".staging")
+	os.RemoveAll(stagingFolder)
+	os.MkdirAll(stagingFolder, 0755)
+	defer os.RemoveAll(stagingFolder)
+
+	//Verify the manifest before downloading the artifacts
+	manifest, err := u.downloadManifest(binaryURL, filepath.Join(stagingFolder, "manifest.json"), ed25519.PublicKey(publicKey))
+	if err != nil {
+		return "", err
+	}
+	if version != "" && version != manifest.Version {
+		return "", errors.New("requested version " + version + " does not match the release version " + manifest.Version)
+	}
+	version = manifest.Version
+	if err := u.checkManifest(manifest); err != nil {
+		return "", err
+	}
+
+	//Download the artifacts and check them against the manifest
+	binaryTarget := filepath.Join(stagingFolder, u.binaryName())
+	webpackTarget := filepath.Join(stagingFolder, "webpack.tar.gz")
+	progressUpdateFunction(0, 0, "Downloading binary")
+	if err := u.downloadWithChecksum(binaryURL, binaryTarget, manifest.BinarySHA256); err != nil {
+		return "", err
+	}
+	os.Chmod(binaryTarget, 0755)
+	progressUpdateFunction(0, 100, "Binary Download Completed")
+
+	progressUpdateFunction(1, 0, "Downloading webpack")
+	if err := u.downloadWithChecksum(webpackURL, webpackTarget, manifest.WebpackSHA256); err != nil {
+		return "", err
+	}
+	progressUpdateFunction(1, 100, "Webpack Download Completed")
+
+	//Extract the webpack next to the binary
+	progressUpdateFunction(2, 0, "Extracting webpack")
+	webpack, err := os.Open(webpackTarget)
+	if err != nil {
+		return "", err
+	}
+	err = extractTarGz(webpack, stagingFolder, progressUpdateFunction)
+	webpack.Close()
+	os.Remove(webpackTarget)
+	if err != nil {
+		return "", err
+	}
+	if !isDir(filepath.Join(stagingFolder, "web")) {
+		return "", errors.New("web folder not found in webpack")
+	}
+
+	js, _ := json.Marshal(ReleaseInfo{
+		Version:      version,
+		StageTime:    time.Now().Unix(),
+		BinarySHA256: strings.ToLower(manifest.BinarySHA256),
+	})
+	os.WriteFile(filepath.Join(stagingFolder, "release.json"), js, 0644)
+
+	//Move the verified release into the versions folder
+	versionFolder := u.versionFolder(version)
+	os.RemoveAll(versionFolder)
+	if err := os.Rename(stagingFolder, versionFolder); err != nil {
+		return "", err
+	}
+
+	state := u.GetState()
+	state.Staged = version
+	state.LastError = ""
+	u.saveState(state)
+	progressUpdateFunction(3, 100, "Updates Downloaded")
+	log.Println("[Updates] Release " + version + " staged and verified")
+	return version, nil
+}
+
+// Download the manifest of the binary and verify its detached signature
+func (u *Updater) downloadManifest(binaryURL string, target string, publicKey ed25519.PublicKey) (*ReleaseManifest, error) {
+	if err := u.download(binaryURL+".manifest", target); err != nil {
+		return nil, errors.New("Unable to download release manifest: " + err.Error())
+	}
+	signaturePath := target + ".sig"
+	if err := u.download(binaryURL+".manifest.sig", signaturePath); err != nil {
+		return nil, errors.New("Unable to download signature of release manifest")
+	}
+
+	manifestContent, err := os.ReadFile(target)
+	if err != nil {
+		return nil, err
+	}
+	signatureContent, err := os.ReadFile(signaturePath)
+	if err != nil {
+		return nil, err
+	}
+	signature, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(signatureContent)))
+	if err != nil || len(signature) != ed25519.SignatureSize {
+		return nil, errors.New("Invalid signature for release manifest")
+	}
+	if !ed25519.Verify(publicKey, manifestContent, signature) {
+		return nil, errors.New("Signature verification failed for release manifest")
+	}
+
+	manifest := ReleaseManifest{}
+	if err := json.Unmarshal(manifestContent, &manifest); err != nil {
+		return nil, errors.New("Invalid release manifest")
+	}
+	return &manifest, nil
+}
+
+// Check if the release described by the manifest can be installed on this system
+func (u *Updater) checkManifest(manifest *ReleaseManifest) error {
+	if manifest.Version == "" || manifest.Version != filepath.Base(manifest.Version) || strings.HasPrefix(manifest.Version, ".") {
+		return errors.New("invalid version in release manifest")
+	}
+	if manifest.OS != runtime.GOOS || manifest.Arch != runtime.GOARCH {
+		return errors.New("release is built for " + manifest.OS + "/" + manifest.Arch + ", this system is " + runtime.GOOS + "/" + runtime.GOARCH)
+	}
+	running := u.runningVersion(u.GetState())
+	switch compareVersions(manifest.Version, running) {
+	case 0:
+		return errors.New("version " + manifest.Version + " is already running")
+	case -1:
+		return errors.New("version " + manifest.Version + " is older than the running version " + running)
+	}
+	return nil
+}
+
+// Download the file and check its SHA-256 checksum
+func (u *Updater) downloadWithChecksum(url string, target string, expectedSHA256 string) error {
+	if err := u.download(url, target); err != nil {
+		return errors.New("Unable to download " + filepath.Base(url) + ": " + err.Error())
+	}
+	digest, err := getSHA256Digest(target)
+	if err != nil {
+		return err
+	}
+	if !strings.EqualFold(hex.EncodeToString(digest), expectedSHA256) {
+		os.Remove(target)
+		return errors.New("Checksum mismatch for " + filepath.Base(url))
+	}
+	return nil
+}
+
+func (u *Updater) download(url string, target string) error {
+	resp, err := u.options.Client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.New(resp.Status)
+	}
+	out, err := os.Create(target)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	_, err = io.Copy(out, resp.Body)
+	return err
+}
+
+/*
+	Switching and rollback
+*/
+
+// Switch in the staged version. The system should be restarted afterward
+func (u *Updater) Apply() error {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	state := u.GetState()
+	if state.Staged == "" {
+		return errors.New("no staged update")
+	}
+	running := u.runningVersion(state)
+	if err := u.switchVersion(running, state.Staged); err != nil {
+		state.LastError = err.Error()
+		u.saveState(state)
+		return err
+	}
+
+	state.Previous = running
+	state.Current = running
+	state.Pending = state.Staged
+	state.PendingSince = time.Now().Unix()
+	state.StartAttempts = 0
+	state.Staged = ""
+	log.Println("[Updates] Switched to " + state.Pending + ", waiting for restart")
+	return u.saveState(state)
+}
+
+// Check the pending update on startup. Return true if the update is rolled back
+// and the system should be restarted with the previous version
+func (u *Updater) CheckStartup() bool {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	state := u.GetState()
+	if state.Pending == "" {
+		return false
+	}
+	if !u.isRunning(state.Pending) {
+		//The previous build is running, e.g. the launcher fall back to it
+		u.rollback(state, "version "+state.Pending+" was not started")
+		return false
+	}
+
+	state.StartAttempts++
+	if state.StartAttempts > u.options.MaxStartAttempts {
+		u.rollback(state, "version "+state.Pending+" failed to start")
+		return true
+	}
+	u.saveState(state)
+	return false
+}
+
+// Wait for the health check delay and confirm the pending version with healthCheck.
+// Return error if the update is rolled back and the system should be restarted
+func (u *Updater) RunHealthCheck(healthCheck func() error) error {
+	state := u.GetState()
+	if state.Pending == "" || !u.isRunning(state.Pending) {
+		return nil
+	}
+	time.Sleep(u.options.HealthCheckDelay)
+
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	state = u.GetState()
+	if state.Pending == "" {
+		return nil
+	}
+
+	if err := healthCheck(); err != nil {
+		u.rollback(state, "health check failed: "+err.Error())
+		return errors.New("health check failed: " + err.Error())
+	}
+
+	state.Previous = state.Current
+	state.Current = state.Pending
+	state.Pending = ""
+	state.StartAttempts = 0
+	state.LastError = ""
+	u.saveState(state)
+	u.prune(state)
+	log.Println("[Updates] Version " + state.Current + " passed health check")
+	return nil
+}
+
+// Switch back to the previous version, caller must hold the mutex
+func (u *Updater) rollback(state *UpdateState, reason string) {
+	log.Println("[Updates] Rolling back to " + state.Previous + ": " + reason)
+	if err := u.switchVersion(state.Pending, state.Previous); err != nil {
+		log.Println("[Updates] Rollback failed: " + err.Error())
+		reason += ", rollback failed: " + err.Error()
+	}
+	state.Current = state.Previous
+	state.Pending = ""
+	state.StartAttempts = 0
+	state.LastError = reason
+	u.saveState(state)
+}
+
+// Move the web folder and the binary of the from version out and the target version in
+func (u *Updater) switchVersion(from string, target string) error {
+	fromFolder := u.versionFolder(from)
+	targetFolder := u.versionFolder(target)
+	if !isDir(filepath.Join(targetFolder, "web")) || !fileExists(filepath.Join(targetFolder, u.binaryName())) {
+		return errors.New("version " + target + " not found")
+	}
+	os.MkdirAll(fromFolder, 0755)
+
+	//Keep a copy of the running binary for rollback
+	fromBinary := filepath.Join(fromFolder, u.binaryName())
+	if !fileExists(fromBinary) {
+		if err := copyFile(u.options.BinaryPath, fromBinary); err != nil {
+			return err
+		}
+	}
+
+	//Swap the web folder
+	webRoot := filepath.Join(u.options.Root, "web")
+	os.RemoveAll(filepath.Join(fromFolder, "web"))
+	if err := os.Rename(webRoot, filepath.Join(fromFolder, "web")); err != nil {
+		return err
+	}
+	if err := os.Rename(filepath.Join(targetFolder, "web"), webRoot); err != nil {
+		os.Rename(filepath.Join(fromFolder, "web"), webRoot)
+		return err
+	}
+
+	//Replace the binary
+	if err := replaceBinary(filepath.Join(targetFolder, u.binaryName()), u.options.BinaryPath); err != nil {
+		os.Rename(webRoot, filepath.Join(targetFolder, "web"))
+		os.Rename(filepath.Join(fromFolder, "web"), webRoot)
+		return err
+	}
+
+	//New system files are added without overwriting the existing configurations
+	mergeFolder(filepath.Join(targetFolder, "system"), filepath.Join(u.options.Root, "system"))
+	return nil
+}
+
+// Remove old versions except the current, previous and the latest KeepVersions ones
+func (u *Updater) prune(state *UpdateState) {
+	releases := u.ListVersions()
+	kept := 0
+	for _, release := range releases {
+		if release.Version == state.Current || release.Version == state.Previous || release.Version == state.Staged {
+			continue
+		}
+		kept++
+		if kept > u.options.KeepVersions {
+			log.Println("[Updates] Removing old version " + release.Version)
+			os.RemoveAll(u.versionFolder(release.Version))
+		}
+	}
+}
+
+// List the versions in the versions folder, latest first
+func (u *Updater) ListVersions() []*ReleaseInfo {
+	results := []*ReleaseInfo{}
+	folders, _ := filepath.Glob(filepath.Join(u.options.Root, "versions", "*"))
+	for _, folder := range folders {
+		if !isDir(folder) || strings.HasPrefix(filepath.Base(folder), ".") {
+			continue
+		}
+		release := ReleaseInfo{Version: filepath.Base(folder)}
+		if content, err := os.ReadFile(filepath.Join(folder, "release.json")); err == nil {
+			json.Unmarshal(content, &release)
+		}
+		results = append(results, &release)
+	}
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].StageTime == results[j].StageTime {
+			return results[i].Version > results[j].Version
+		}
+		return results[i].StageTime > results[j].StageTime
+	})
+	return results
+}
+
+/*
+	State
+*/
+
+func (u *Updater) GetState() *UpdateState {
+	state := UpdateState{}
+	content, err := os.ReadFile(u.statePath())
+	if err == nil {
+		json.Unmarshal(content, &state)
+	}
+	if state.Current == "" {
+		state.Current = u.options.CurrentVersion
+	}
+	return &state
+}
+
+func (u *Updater) saveState(state *UpdateState) error {
+	js, err := json.MarshalIndent(state, "", " ")
+	if err != nil {
+		return err
+	}
+	tmpFile := u.statePath() + ".tmp"
+	if err := os.WriteFile(tmpFile, js, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile, u.statePath())
+}
+
+// The version currently in the web folder
+func (u *Updater) runningVersion(state *UpdateState) string {
+	if state.Pending != "" {
+		return state.Pending
+	}
+	return state.Current
+}
+
+// Check if the binary of this version is the one running, by comparing the checksum
+func (u *Updater) isRunning(version string) bool {
+	release := ReleaseInfo{}
+	content, err := os.ReadFile(filepath.Join(u.versionFolder(version), "release.json"))
+	if err != nil || json.Unmarshal(content, &release) != nil {
+		return false
+	}
+	digest, err := getSHA256Digest(u.options.BinaryPath)
+	return err == nil && hex.EncodeToString(digest) == release.BinarySHA256
+}
+
+// Compare two dotted version strings, e.g. 0.2.025. Numeric parts are compared by value.
+// Return -1 if a is older than b, 1 if a is newer and 0 if they are the same
+func compareVersions(a string, b string) int {
+	aParts := strings.Split(strings.TrimPrefix(a, "v"), ".")
+	bParts := strings.Split(strings.TrimPrefix(b, "v"), ".")
+	for i := 0; i < len(aParts) || i < len(bParts); i++ {
+		aPart, bPart := "0", "0"
+		if i < len(aParts) {
+			aPart = aParts[i]
+		}
+		if i < len(bParts) {
+			bPart = bParts[i]
+		}
+		aNum, aErr := strconv.Atoi(aPart)
+		bNum, bErr := strconv.Atoi(bPart)
+		if aErr == nil && bErr == nil {
+			if aNum != bNum {
+				if aNum < bNum {
+					return -1
+				}
+				return 1
+			}
+		} else if aPart != bPart {
+			return strings.Compare(aPart, bPart)
+		}
+	}
+	return 0
+}
+
+func (u *Updater) statePath() string {
+	return filepath.Join(u.options.Root, "versions", "state.json")
+}
+
+func (u *Updater) versionFolder(version string) string {
+	return filepath.Join(u.options.Root, "versions", version)
+}
+
+func (u *Updater) binaryName() string {
+	return filepath.Base(u.options.BinaryPath)
+}
+
+/*
+	File utilities
+*/
+
+func getSHA256Digest(filename string) ([]byte, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// Replace the binary with a rename so the running process is not affected
+func replaceBinary(src string, dest string) error {
+	tmpFile := dest + ".new"
+	if err := copyFile(src, tmpFile); err != nil {
+		return err
+	}
+	if runtime.GOOS == "windows" {
+		//Running executable cannot be overwritten on Windows, but can be renamed
+		os.Remove(dest + ".old")
+		if err := os.Rename(dest, dest+".old"); err != nil {
+			os.Remove(tmpFile)
+			return err
+		}
+	}
+	return os.Rename(tmpFile, dest)
+}
+
+func copyFile(src string, dest string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0755)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Copy the files in src that do not exists in dest
+func mergeFolder(src string, dest string) {
+	filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return nil
+		}
+		relPath, err := filepath.Rel(src, path)
+		if err != nil {
+			return nil
+		}
+		target := filepath.Join(dest, relPath)
+		if !fileExists(target) {
+			os.MkdirAll(filepath.Dir(target), 0755)
+			copyFile(path, target)
+		}
+		return nil
+	})
+}
+
+func fileExists(filename string) bool {
+	_, err := os.Stat(filename)
+	return err == nil
+}
+
+func isDir(filename string) bool {
+	info, err := os.Stat(filename)
+	return err == nil && info.IsDir()
+}
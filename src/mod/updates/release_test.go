@@ -0,0 +1,293 @@
+package updates
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+type testRelease struct {
+	files      map[string][]byte
+	privateKey ed25519.PrivateKey
+}
+
+// Publish the binary and webpack of a release for this platform to the stand-in server,
+// served as /arozos_{version} and /webpack_{version}.tar.gz
+func (r *testRelease) publish(version string, binary []byte, webpack []byte) {
+	r.publishManifest(version, binary, webpack, ReleaseManifest{Version: version, OS: runtime.GOOS, Arch: runtime.GOARCH})
+}
+
+func (r *testRelease) publishManifest(version string, binary []byte, webpack []byte, manifest ReleaseManifest) {
+	binaryDigest := sha256.Sum256(binary)
+	webpackDigest := sha256.Sum256(webpack)
+	manifest.BinarySHA256 = hex.EncodeToString(binaryDigest[:])
+	manifest.WebpackSHA256 = hex.EncodeToString(webpackDigest[:])
+	js, _ := json.Marshal(manifest)
+
+	r.files["/arozos_"+version] = binary
+	r.files["/webpack_"+version+".tar.gz"] = webpack
+	r.files["/arozos_"+version+".manifest"] = js
+	r.files["/arozos_"+version+".manifest.sig"] = []byte(base64.StdEncoding.EncodeToString(ed25519.Sign(r.privateKey, js)))
+}
+
+func stage(updater *Updater, server *httptest.Server, version string) (string, error) {
+	return updater.Stage(server.URL+"/arozos_"+version, server.URL+"/webpack_"+version+".tar.gz", "", nil)
+}
+
+func (r *testRelease) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	content, ok := r.files[req.URL.Path]
+	if !ok {
+		http.NotFound(w, req)
+		return
+	}
+	w.Write(content)
+}
+
+func buildWebpack(t *testing.T, files map[string]string) []byte {
+	buf := bytes.Buffer{}
+	gw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gw)
+	for name, content := range files {
+		tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg})
+		tw.Write([]byte(content))
+	}
+	tw.Close()
+	gw.Close()
+	return buf.Bytes()
+}
+
+func newTestUpdater(t *testing.T, publicKey ed25519.PublicKey) (*Updater, string) {
+	root := t.TempDir()
+	os.MkdirAll(filepath.Join(root, "web"), 0755)
+	os.MkdirAll(filepath.Join(root, "system"), 0755)
+	os.WriteFile(filepath.Join(root, "web", "index.html"), []byte("v1"), 0644)
+	os.WriteFile(filepath.Join(root, "system", "storage.json"), []byte("config"), 0644)
+	os.WriteFile(filepath.Join(root, "arozos"), []byte("binary-v1"), 0755)
+
+	updater, err := NewUpdater(&UpdaterOptions{
+		Root:             root,
+		BinaryPath:       filepath.Join(root, "arozos"),
+		CurrentVersion:   "1.0",
+		PublicKey:        base64.StdEncoding.EncodeToString(publicKey),
+		KeepVersions:     1,
+		HealthCheckDelay: 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return updater, root
+}
+
+func readFile(root string, name string) string {
+	content, _ := os.ReadFile(filepath.Join(root, name))
+	return string(content)
+}
+
+func TestStageApplyAndHealthCheck(t *testing.T) {
+	publicKey, privateKey, _ := ed25519.GenerateKey(nil)
+	release := &testRelease{files: map[string][]byte{}, privateKey: privateKey}
+	release.publish("2.0", []byte("binary-v2"), buildWebpack(t, map[string]string{
+		"web/index.html":      "v2",
+		"system/storage.json": "default",
+		"system/new.json":     "new",
+	}))
+	server := httptest.NewServer(release)
+	defer server.Close()
+
+	updater, root := newTestUpdater(t, publicKey)
+	version, err := stage(updater, server, "2.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != "2.0" || updater.GetState().Staged != "2.0" || readFile(root, "web/index.html") != "v1" {
+		t.Fatal("staging should not touch the running version")
+	}
+
+	if err := updater.Apply(); err != nil {
+		t.Fatal(err)
+	}
+	if readFile(root, "web/index.html") != "v2" || readFile(root, "arozos") != "binary-v2" {
+		t.Fatal("new version not switched in")
+	}
+	if readFile(root, "system/storage.json") != "config" || readFile(root, "system/new.json") != "new" {
+		t.Fatal("system folder not merged")
+	}
+
+	//The new build started and passed the health check
+	if updater.CheckStartup() {
+		t.Fatal("unexpected rollback")
+	}
+	if err := updater.RunHealthCheck(func() error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+	state := updater.GetState()
+	if state.Current != "2.0" || state.Previous != "1.0" || state.Pending != "" {
+		t.Fatalf("unexpected state %+v", state)
+	}
+}
+
+func TestRollbackOnFailedHealthCheck(t *testing.T) {
+	publicKey, privateKey, _ := ed25519.GenerateKey(nil)
+	release := &testRelease{files: map[string][]byte{}, privateKey: privateKey}
+	release.publish("2.0", []byte("binary-v2"), buildWebpack(t, map[string]string{"web/index.html": "v2"}))
+	server := httptest.NewServer(release)
+	defer server.Close()
+
+	updater, root := newTestUpdater(t, publicKey)
+	if _, err := stage(updater, server, "2.0"); err != nil {
+		t.Fatal(err)
+	}
+	updater.Apply()
+
+	if err := updater.RunHealthCheck(func() error { return errors.New("not responding") }); err == nil {
+		t.Fatal("failed health check should rollback")
+	}
+	if readFile(root, "web/index.html") != "v1" || readFile(root, "arozos") != "binary-v1" {
+		t.Fatal("previous version not restored")
+	}
+	state := updater.GetState()
+	if state.Current != "1.0" || state.Pending != "" || !strings.Contains(state.LastError, "not responding") {
+		t.Fatalf("unexpected state %+v", state)
+	}
+
+	//The failed version is kept and can be applied again after restaging
+	if _, err := os.Stat(filepath.Join(root, "versions", "2.0", "web", "index.html")); err != nil {
+		t.Fatal("rolled back version should be kept")
+	}
+}
+
+func TestRejectInvalidSignature(t *testing.T) {
+	publicKey, _, _ := ed25519.GenerateKey(nil)
+	_, otherKey, _ := ed25519.GenerateKey(nil)
+	release := &testRelease{files: map[string][]byte{}, privateKey: otherKey}
+	release.publish("2.0", []byte("binary-v2"), buildWebpack(t, map[string]string{"web/index.html": "v2"}))
+	server := httptest.NewServer(release)
+	defer server.Close()
+
+	updater, root := newTestUpdater(t, publicKey)
+	if _, err := stage(updater, server, "2.0"); err == nil {
+		t.Fatal("release signed by unknown key accepted")
+	}
+	if updater.GetState().Staged != "" || readFile(root, "web/index.html") != "v1" {
+		t.Fatal("rejected release should not be staged")
+	}
+
+	//Escaping paths in the webpack are rejected even if signed
+	trusted := &testRelease{files: map[string][]byte{}, privateKey: otherKey}
+	trusted.publish("2.0", []byte("binary-v2"), buildWebpack(t, map[string]string{"../evil.txt": "evil", "web/index.html": "v2"}))
+	otherUpdater, otherRoot := newTestUpdater(t, otherKey.Public().(ed25519.PublicKey))
+	server2 := httptest.NewServer(trusted)
+	defer server2.Close()
+	if _, err := stage(otherUpdater, server2, "2.0"); err == nil {
+		t.Fatal("escaping path accepted")
+	}
+	if _, err := os.Stat(filepath.Join(otherRoot, "versions", "evil.txt")); err == nil {
+		t.Fatal("file written outside of staging folder")
+	}
+}
+
+func TestPruneOldVersions(t *testing.T) {
+	publicKey, privateKey, _ := ed25519.GenerateKey(nil)
+	release := &testRelease{files: map[string][]byte{}, privateKey: privateKey}
+	server := httptest.NewServer(release)
+	defer server.Close()
+
+	updater, root := newTestUpdater(t, publicKey)
+	for _, version := range []string{"2.0", "3.0", "4.0"} {
+		release.publish(version, []byte("binary-"+version), buildWebpack(t, map[string]string{"web/index.html": version}))
+		if _, err := stage(updater, server, version); err != nil {
+			t.Fatal(err)
+		}
+		if err := updater.Apply(); err != nil {
+			t.Fatal(err)
+		}
+		if err := updater.RunHealthCheck(func() error { return nil }); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if readFile(root, "web/index.html") != "4.0" {
+		t.Fatal("latest version not running")
+	}
+	versions := []string{}
+	for _, release := range updater.ListVersions() {
+		versions = append(versions, release.Version)
+	}
+	//Current (4.0), previous (3.0) and one more old version are kept
+	if strings.Join(versions, ",") != "4.0,3.0,2.0" {
+		t.Fatalf("unexpected versions kept %v", versions)
+	}
+}
+
+func TestRejectReplayedRelease(t *testing.T) {
+	publicKey, privateKey, _ := ed25519.GenerateKey(nil)
+	release := &testRelease{files: map[string][]byte{}, privateKey: privateKey}
+	webpack := buildWebpack(t, map[string]string{"web/index.html": "old"})
+	release.publish("0.9", []byte("binary-0.9"), webpack)
+	release.publish("1.0", []byte("binary-1.0"), webpack)
+	release.publishManifest("2.0", []byte("binary-2.0"), webpack, ReleaseManifest{Version: "2.0", OS: runtime.GOOS, Arch: "other" + runtime.GOARCH})
+	release.publish("3.0", []byte("binary-3.0"), webpack)
+	server := httptest.NewServer(release)
+	defer server.Close()
+
+	updater, root := newTestUpdater(t, publicKey)
+	for _, version := range []string{"0.9", "1.0", "2.0"} {
+		if _, err := stage(updater, server, version); err == nil {
+			t.Fatalf("release %s should be refused", version)
+		}
+	}
+
+	//Requested version must match the signed manifest
+	if _, err := updater.Stage(server.URL+"/arozos_3.0", server.URL+"/webpack_3.0.tar.gz", "4.0", nil); err == nil {
+		t.Fatal("version not matching the manifest accepted")
+	}
+
+	//Artifacts must match the checksum in the manifest
+	release.files["/arozos_3.0"] = []byte("tampered")
+	if _, err := stage(updater, server, "3.0"); err == nil {
+		t.Fatal("tampered binary accepted")
+	}
+	if updater.GetState().Staged != "" || readFile(root, "web/index.html") != "v1" {
+		t.Fatal("refused release should not be staged")
+	}
+}
+
+func TestCompareVersions(t *testing.T) {
+	cases := []struct {
+		a, b   string
+		expect int
+	}{
+		{"0.2.025", "0.2.025", 0},
+		{"0.2.026", "0.2.025", 1},
+		{"0.2.9", "0.2.025", -1},
+		{"v1.10", "1.9", 1},
+		{"1.0", "1.0.0", 0},
+		{"1.0.1", "1.0", 1},
+	}
+	for _, c := range cases {
+		if result := compareVersions(c.a, c.b); result != c.expect {
+			t.Errorf("compareVersions(%s, %s) = %d, expect %d", c.a, c.b, result, c.expect)
+		}
+	}
+}
+
+func TestStageWithoutReleaseKey(t *testing.T) {
+	//Builds without a release key given at build time refuse to update
+	updater, _ := newTestUpdater(t, nil)
+	if _, err := updater.Stage("http://localhost/arozos", "http://localhost/webpack.tar.gz", "", nil); err == nil {
+		t.Fatal("update staged without release public key")
+	}
+}
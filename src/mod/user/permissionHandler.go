@@ -73,6 +73,26 @@ func (u *User) IsAdmin() bool {
 	return isAdmin
 }
 
+//Check if the user is granted the admin capability by any of its permission groups
+func (u *User) HasCapability(capability string) bool {
+	for _, pg := range u.PermissionGroup {
+		if pg.HasCapability(capability) {
+			return true
+		}
+	}
+	return false
+}
+
+//Check if the user holds any admin privilege, aka full admin or any role
+func (u *User) IsPrivileged() bool {
+	for _, pg := range u.PermissionGroup {
+		if pg.IsPrivileged() {
+			return true
+		}
+	}
+	return false
+}
+
 //Get the (or a list of ) Interface Module (aka booting module) for this user, returning module uuids
 func (u *User) GetInterfaceModules() []string {
 	results := []string{}
@@ -5,6 +5,7 @@ import (
 	//"log"
 
 	fs "imuslab.com/arozos/mod/filesystem"
+	"imuslab.com/arozos/mod/quota"
 )
 
 /*
@@ -28,6 +29,11 @@ func (u *User) HaveSpaceFor(fsh *fs.FileSystemHandler, vpath string) bool {
 	}
 }
 
+// Check if the user have space for the given size on the file system, including file system and group quota
+func (u *User) HaveSpaceOn(fsh *fs.FileSystemHandler, size int64) bool {
+	return u.StorageQuota.HaveSpaceOnFsh(fsh.UUID, size)
+}
+
 func (u *User) SetOwnerOfFile(fsh *fs.FileSystemHandler, vpath string) error {
 	rpath, err := fsh.FileSystemAbstraction.VirtualPathToRealPath(vpath, u.Username)
 	if err != nil {
@@ -36,7 +42,12 @@ func (u *User) SetOwnerOfFile(fsh *fs.FileSystemHandler, vpath string) error {
 	//Check if it is user structured. If yes, add the filesize to user's quota
 	if fsh.Hierarchy == "user" {
 		//log.Println("Setting user ownership on: " + realpath)
-		u.StorageQuota.AllocateSpace(fsh.FileSystemAbstraction.GetFileSize(rpath))
+		size, _ := fsh.GetDirctorySizeFromRealPath(rpath, true)
+		u.StorageQuota.AllocateSpaceOnFsh(fsh.UUID, size)
+	} else {
+		//Shared file system. Attribute the files to this user
+		size := quota.SetFileOwner(u.parent.database, fsh, rpath, u.Username)
+		u.StorageQuota.AllocateSpaceOnFsh(fsh.UUID, size)
 	}
 
 	return err
@@ -51,7 +62,17 @@ func (u *User) RemoveOwnershipFromFile(fsh *fs.FileSystemHandler, vpath string)
 	//Check if it is user structured. If yes, add the filesize to user's quota
 	if fsh.Hierarchy == "user" {
 		//log.Println("Removing user ownership on: " + realpath)
-		u.StorageQuota.ReclaimSpace(fsh.FileSystemAbstraction.GetFileSize(realpath))
+		size, _ := fsh.GetDirctorySizeFromRealPath(realpath, true)
+		u.StorageQuota.ReclaimSpaceOnFsh(fsh.UUID, size)
+	} else {
+		//Shared file system. Return the space to the creators of the files
+		for owner, size := range quota.RemoveFileOwner(u.parent.database, fsh.UUID, realpath) {
+			if owner == u.Username {
+				u.StorageQuota.ReclaimSpaceOnFsh(fsh.UUID, size)
+			} else if val, ok := quotaManagerBuffer.Load(owner); ok {
+				val.(*quota.QuotaHandler).ReclaimSpaceOnFsh(fsh.UUID, size)
+			}
+		}
 	}
 	return err
 }
@@ -72,5 +93,65 @@ func (u *User) GetFileOwner(fsh *fs.FileSystemHandler, vpath string) string {
 		return u.Username
 	}
 
-	return ""
+	//Check the creator of files on shared file systems
+	rpath, err := fsh.FileSystemAbstraction.VirtualPathToRealPath(vpath, u.Username)
+	if err != nil {
+		return ""
+	}
+	return quota.GetFileOwner(u.parent.database, fsh.UUID, rpath)
+}
+
+/*
+	Quota tracking for external file servers
+
+	WebDAV, SFTP and FTP write to the file systems directly instead of going
+	through the file manager APIs. These wrappers keep the storage quota and
+	file ownership in sync with those operations.
+*/
+
+// Reclaim the space of the existing file before it get overwritten. Call the returned
+// function after the written file is closed to attribute the new content to the user
+func (u *User) TrackFileWrite(fsh *fs.FileSystemHandler, vpath string) func() {
+	rpath, err := fsh.FileSystemAbstraction.VirtualPathToRealPath(vpath, u.Username)
+	if err == nil && fsh.FileSystemAbstraction.FileExists(rpath) {
+		u.RemoveOwnershipFromFile(fsh, vpath)
+	}
+	return func() {
+		u.SetOwnerOfFile(fsh, vpath)
+	}
+}
+
+// Remove the file or folder with the remove function and reclaim its space if succeeded
+func (u *User) TrackFileRemove(fsh *fs.FileSystemHandler, vpath string, remove func() error) error {
+	size := int64(0)
+	if fsh.Hierarchy == "user" {
+		//The size can only be measured before the files are gone
+		rpath, err := fsh.FileSystemAbstraction.VirtualPathToRealPath(vpath, u.Username)
+		if err == nil {
+			size, _ = fsh.GetDirctorySizeFromRealPath(rpath, true)
+		}
+	}
+
+	err := remove()
+	if err != nil {
+		return err
+	}
+
+	if fsh.Hierarchy == "user" {
+		return u.StorageQuota.ReclaimSpaceOnFsh(fsh.UUID, size)
+	}
+	//Ownership records of shared file systems outlive the files
+	return u.RemoveOwnershipFromFile(fsh, vpath)
+}
+
+// Move the file or folder with the move function and transfer its space to the destination if succeeded
+func (u *User) TrackFileMove(srcFsh *fs.FileSystemHandler, vsrc string, destFsh *fs.FileSystemHandler, vdest string, move func() error) error {
+	return u.TrackFileRemove(srcFsh, vsrc, func() error {
+		err := move()
+		if err != nil {
+			return err
+		}
+		u.SetOwnerOfFile(destFsh, vdest)
+		return nil
+	})
 }
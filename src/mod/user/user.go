@@ -112,6 +112,7 @@ func (u *UserHandler) GetUserInfoFromUsername(username string) (*User, error) {
 	if val, ok := quotaManagerBuffer.Load(username); ok {
 		//user quota manager exists
 		thisUserQuotaManager = val.(*quota.QuotaHandler)
+		thisUserQuotaManager.UpdateUserStoragePool(thisUser.GetAllFileSystemHandler())
 	} else {
 		//Get the largest quota from the user's group
 		maxQuota := int64(0)
@@ -139,6 +140,7 @@ func (u *UserHandler) GetUserInfoFromUsername(username string) (*User, error) {
 		quotaManagerBuffer.Store(username, thisUserQuotaManager)
 	}
 
+	thisUserQuotaManager.UpdateUserGroups(thisUser.GetUserPermissionGroupNames())
 	thisUser.StorageQuota = thisUserQuotaManager
 
 	//Return the user object
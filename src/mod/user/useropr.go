@@ -12,6 +12,7 @@ func (u *User) RemoveUser() {
 	//Remove the user storage quota settings
 	log.Println("Removing User Quota: ", u.Username)
 	u.StorageQuota.RemoveUserQuota()
+	quotaManagerBuffer.Delete(u.Username)
 
 	//Remove the user authentication register
 	u.parent.authAgent.UnregisterUser(u.Username)
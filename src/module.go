@@ -1,17 +1,22 @@
 package main
 
 import (
+	"encoding/json"
 	"log"
 	"net/http"
 	"os"
+	"path/filepath"
 
+	agi "imuslab.com/arozos/mod/agi"
 	module "imuslab.com/arozos/mod/modules"
+	permission "imuslab.com/arozos/mod/permission"
 	prout "imuslab.com/arozos/mod/prouter"
 	"imuslab.com/arozos/mod/utils"
 )
 
 var (
-	moduleHandler *module.ModuleHandler
+	moduleHandler          *module.ModuleHandler
+	modulePackageInstaller *module.PackageInstaller
 )
 
 func ModuleServiceInit() {
@@ -21,6 +26,7 @@ func ModuleServiceInit() {
 	//Register FTP Endpoints
 	adminRouter := prout.NewModuleRouter(prout.RouterOption{
 		AdminOnly:   true,
+		Capability:  permission.CapModuleInstall,
 		UserHandler: userHandler,
 		DeniedHandler: func(w http.ResponseWriter, r *http.Request) {
 			errorHandlePermissionDenied(w, r)
@@ -44,44 +50,23 @@ func ModuleServiceInit() {
 	})
 
 	//Handle module installer. Require admin
-	http.HandleFunc("/system/modules/installViaZip", func(w http.ResponseWriter, r *http.Request) {
-		//Check if the user is admin
-		userinfo, err := userHandler.GetUserInfoFromRequest(w, r)
+	adminRouter.HandleFunc("/system/modules/installViaZip", func(w http.ResponseWriter, r *http.Request) {
+		//Get the installation file path
+		rpath, err := moduleInstallerResolvePath(w, r)
 		if err != nil {
-			utils.SendErrorResponse(w, "User not logged in")
+			utils.SendErrorResponse(w, "Invalid installer path")
 			return
 		}
 
-		//Validate the user is admin
-		if userinfo.IsAdmin() {
-			//Get the installation file path
-			installerPath, err := utils.PostPara(r, "path")
-			if err != nil {
-				utils.SendErrorResponse(w, "Invalid installer path")
-				return
-			}
-
-			fsh, subpath, err := GetFSHandlerSubpathFromVpath(installerPath)
-			if err != nil {
-				utils.SendErrorResponse(w, "Invalid installer path")
-				return
-			}
-
-			//Translate it to realpath
-			rpath, err := fsh.FileSystemAbstraction.VirtualPathToRealPath(subpath, userinfo.Username)
-			if err != nil {
-				systemWideLogger.PrintAndLog("Module Installer", "Failed to install module: "+err.Error(), err)
-				utils.SendErrorResponse(w, "Invalid installer path")
-				return
-			}
-
-			//Install it
-			moduleHandler.InstallViaZip(rpath, AGIGateway)
-		} else {
-			//Permission denied
-			utils.SendErrorResponse(w, "Permission Denied")
+		//Install it
+		installed, err := modulePackageInstaller.InstallFromZip(rpath)
+		if err != nil {
+			systemWideLogger.PrintAndLog("Module Installer", "Failed to install module: "+err.Error(), err)
+			utils.SendErrorResponse(w, err.Error())
+			return
 		}
-
+		js, _ := json.Marshal(installed)
+		utils.SendJSONResponse(w, string(js))
 	})
 
 	//Register setting interface for module configuration
@@ -109,6 +94,7 @@ func ModuleServiceInit() {
 			Group:        "Module",
 			StartDir:     "SystemAO/modules/subservices.html",
 			RequireAdmin: true,
+			Capability:   permission.CapModuleInstall,
 		})
 	}
 
@@ -133,6 +119,7 @@ func ModuleInstallerInit() {
 		Group:        "Module",
 		StartDir:     "SystemAO/modules/addAndRemove.html",
 		RequireAdmin: true,
+		Capability:   permission.CapModuleInstall,
 	})
 
 	//Create new permission router
@@ -140,13 +127,62 @@ func ModuleInstallerInit() {
 		ModuleName:  "System Setting",
 		UserHandler: userHandler,
 		AdminOnly:   true,
+		Capability:  permission.CapModuleInstall,
 		DeniedHandler: func(w http.ResponseWriter, r *http.Request) {
 			errorHandlePermissionDenied(w, r)
 		},
 	})
 
+	//Signed module package installer
+	var err error
+	modulePackageInstaller, err = module.NewPackageInstaller(moduleHandler, &module.InstallerOptions{
+		Database:     sysdb,
+		WebRoot:      "./web",
+		TmpDirectory: filepath.Join(*tmp_directory, "tmp"),
+		AGIVersion:   agi.AgiVersion,
+		InstallSystemPackage: func(pkgname string) error {
+			return packageManager.InstallIfNotExists(pkgname, false)
+		},
+		ActivateModule: func(moduleFolder string) error {
+			return moduleHandler.ActivateModuleByRoot(moduleFolder, AGIGateway)
+		},
+	})
+	if err != nil {
+		systemWideLogger.PrintAndLog("Module Installer", "Unable to start module package installer", err)
+		return
+	}
+
 	router.HandleFunc("/system/module/install", HandleModuleInstall)
+	router.HandleFunc("/system/module/packages", modulePackageInstaller.HandleListInstalledPackages)
+
+	//Trusted keys decide which code can be installed, require system management
+	systemRouter := prout.NewModuleRouter(prout.RouterOption{
+		ModuleName:  "System Setting",
+		UserHandler: userHandler,
+		AdminOnly:   true,
+		Capability:  permission.CapSystemManagement,
+		DeniedHandler: func(w http.ResponseWriter, r *http.Request) {
+			errorHandlePermissionDenied(w, r)
+		},
+	})
+	systemRouter.HandleFunc("/system/module/trustedKeys", modulePackageInstaller.HandleTrustedKeys)
+}
 
+// Resolve the package path given by the admin to real path
+func moduleInstallerResolvePath(w http.ResponseWriter, r *http.Request) (string, error) {
+	userinfo, err := userHandler.GetUserInfoFromRequest(w, r)
+	if err != nil {
+		return "", err
+	}
+	installerPath, err := utils.PostPara(r, "path")
+	if err != nil {
+		return "", err
+	}
+	fsh, subpath, err := GetFSHandlerSubpathFromVpath(installerPath)
+	if err != nil {
+		return "", err
+	}
+	return fsh.FileSystemAbstraction.VirtualPathToRealPath(subpath, userinfo.Username)
 }
 
 //Handle module installation request
@@ -162,16 +198,45 @@ func HandleModuleInstall(w http.ResponseWriter, r *http.Request) {
 		}
 
 		//Install the module using git
-		err := moduleHandler.InstallModuleViaGit(url, AGIGateway)
+		installed, err := modulePackageInstaller.InstallFromGit(url)
 		if err != nil {
 			utils.SendErrorResponse(w, err.Error())
 			return
 		}
 
-		//Reply ok
-		utils.SendOK(w)
+		js, _ := json.Marshal(installed)
+		utils.SendJSONResponse(w, string(js))
 	} else if opr == "zipinstall" {
+		rpath, err := moduleInstallerResolvePath(w, r)
+		if err != nil {
+			utils.SendErrorResponse(w, "Invalid installer path")
+			return
+		}
+
+		installed, err := modulePackageInstaller.InstallFromZip(rpath)
+		if err != nil {
+			utils.SendErrorResponse(w, err.Error())
+			return
+		}
+
+		js, _ := json.Marshal(installed)
+		utils.SendJSONResponse(w, string(js))
+	} else if opr == "inspect" {
+		//Show the manifest and signature state before install
+		rpath, err := moduleInstallerResolvePath(w, r)
+		if err != nil {
+			utils.SendErrorResponse(w, "Invalid installer path")
+			return
+		}
+
+		info, err := modulePackageInstaller.InspectZip(rpath)
+		if err != nil {
+			utils.SendErrorResponse(w, err.Error())
+			return
+		}
 
+		js, _ := json.Marshal(info)
+		utils.SendJSONResponse(w, string(js))
 	} else if opr == "remove" {
 		//Get the module name from list
 		module, _ := utils.PostPara(r, "module")
@@ -180,8 +245,8 @@ func HandleModuleInstall(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		//Remove the module
-		err := moduleHandler.UninstallModule(module)
+		//Remove the module, with its database tables and appdata if installed as package
+		err := modulePackageInstaller.Uninstall(module)
 		if err != nil {
 			utils.SendErrorResponse(w, err.Error())
 			return
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"crypto/tls"
+	"html"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"imuslab.com/arozos/mod/network/acme"
+	permission "imuslab.com/arozos/mod/permission"
+	prout "imuslab.com/arozos/mod/prouter"
+	"imuslab.com/arozos/mod/utils"
+)
+
+/*
+	Network ACME
+
+	Automatic HTTPS certificates from Let's Encrypt or a
+	private ACME CA. The cert and key given in startup flags
+	are used for hostnames not managed by ACME
+*/
+
+var certManager *acme.Manager //nil if the ACME manager failed to start
+
+func NetworkACMEInit() {
+	var err error
+	certManager, err = acme.NewManager(&acme.Options{
+		Database:      sysdb,
+		StorePath:     "./system/acme/",
+		FallbackCert:  *tls_cert,
+		FallbackKey:   *tls_key,
+		TLSEnabled:    *use_tls,
+		OnRenewFailed: networkACMERenewFailed,
+	})
+	if err != nil {
+		systemWideLogger.PrintAndLog("ACME", "Unable to start ACME certificate manager", err)
+		return
+	}
+
+	//Answer HTTP-01 challenges without login
+	http.HandleFunc("/.well-known/acme-challenge/", certManager.HandleHTTPChallenge)
+
+	registerSetting(settingModule{
+		Name:         "Certificates",
+		Desc:         "Automatic HTTPS certificates via ACME",
+		IconPath:     "SystemAO/security/img/small_icon.png",
+		Group:        "Security",
+		StartDir:     "SystemAO/security/certificates.html",
+		RequireAdmin: true,
+		Capability:   permission.CapNetworkSettings,
+	})
+
+	adminRouter := prout.NewModuleRouter(prout.RouterOption{
+		ModuleName:  "System Setting",
+		AdminOnly:   true,
+		Capability:  permission.CapNetworkSettings,
+		UserHandler: userHandler,
+		DeniedHandler: func(w http.ResponseWriter, r *http.Request) {
+			utils.SendErrorResponse(w, "Permission Denied")
+		},
+	})
+
+	adminRouter.HandleFunc("/system/network/acme/status", certManager.HandleStatus)
+	adminRouter.HandleFunc("/system/network/acme/config", certManager.HandleSetConfig)
+	adminRouter.HandleFunc("/system/network/acme/renew", certManager.HandleRenew)
+}
+
+// Warn the admins when the certificate cannot be renewed
+func networkACMERenewFailed(status *acme.Status) error {
+	message := "Certificate renewal failed " + strconv.Itoa(status.Failures) + " times in a row.<br>Last error: " + html.EscapeString(status.LastError)
+	if status.NotAfter > 0 {
+		message += "<br>The current certificate expires at " + time.Unix(status.NotAfter, 0).Format("2006-01-02 15:04")
+	}
+	domains := strings.Join(certManager.GetConfig().Domains, ", ")
+	return notifyAdmins("Unable to renew HTTPS certificate for "+domains, message, "ACME Certificate Manager")
+}
+
+// Get the certificate of the web server, shared with other TLS services like FTPS
+func networkGetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if certManager != nil {
+		return certManager.GetCertificate(hello)
+	}
+	cert, err := tls.LoadX509KeyPair(*tls_cert, *tls_key)
+	if err != nil {
+		return nil, err
+	}
+	return &cert, nil
+}
@@ -20,6 +20,7 @@ import (
 	ssdp "imuslab.com/arozos/mod/network/ssdp"
 	upnp "imuslab.com/arozos/mod/network/upnp"
 	"imuslab.com/arozos/mod/network/websocket"
+	permission "imuslab.com/arozos/mod/permission"
 	prout "imuslab.com/arozos/mod/prouter"
 	"imuslab.com/arozos/mod/utils"
 	"imuslab.com/arozos/mod/www"
@@ -112,7 +113,8 @@ func NetworkServiceInit() {
 		},
 	})
 
-	WebSocketRouter = websocket.NewRouter()
+	//Server event bus, see eventbus.go
+	EventBusInit()
 	userRouter.HandleFunc("/system/ws", WebSocketRouter.HandleWebSocketRouting)
 
 }
@@ -265,6 +267,7 @@ func FileServerInit() {
 	adminRouter := prout.NewModuleRouter(prout.RouterOption{
 		ModuleName:  "System Setting",
 		AdminOnly:   true,
+		Capability:  permission.CapNetworkSettings,
 		UserHandler: userHandler,
 		DeniedHandler: func(w http.ResponseWriter, r *http.Request) {
 			errorHandlePermissionDenied(w, r)
@@ -293,6 +296,7 @@ func FileServerInit() {
 		Port:        webdavPort,
 		UseTls:      *use_tls,
 		UserHandler: userHandler,
+		AuditLogger: fileAuditLogger,
 	})
 
 	//FTP
@@ -305,6 +309,9 @@ func FileServerInit() {
 		Sysdb:       sysdb,
 		Upnp:        UPNP,
 		AllowUpnp:   *allow_upnp,
+
+		GetCertificate: networkGetCertificate,
+		AuditLogger:    fileAuditLogger,
 	})
 
 	//TFTP
@@ -325,6 +332,7 @@ func FileServerInit() {
 		KeyFile:     "system/auth/id_rsa.key",
 		Logger:      systemWideLogger,
 		Sysdb:       sysdb,
+		AuditLogger: fileAuditLogger,
 	})
 
 	listeningPort := *listen_port
@@ -366,6 +374,7 @@ func FileServerInit() {
 	adminRouter.HandleFunc("/system/storage/ftp/updateGroups", FTPManager.HandleFTPAccessUpdate)
 	adminRouter.HandleFunc("/system/storage/ftp/setPort", FTPManager.HandleFTPSetPort)
 	adminRouter.HandleFunc("/system/storage/ftp/passivemode", FTPManager.HandleFTPPassiveModeSettings)
+	adminRouter.HandleFunc("/system/storage/ftp/security", FTPManager.HandleFTPSecuritySettings)
 
 	//TFTP
 	adminRouter.HandleFunc("/system/storage/tftp/status", TFTPManager.HandleTFTPServerStatus)
@@ -376,7 +385,7 @@ func FileServerInit() {
 	if SambaShareManager != nil {
 		//Activate and Deactivate are functions all users can use if admin enabled smbd service
 		router.HandleFunc("/system/storage/samba/activate", func(w http.ResponseWriter, r *http.Request) {
-			if !AuthValidateSecureRequest(w, r, false) {
+			if !AuthValidateSecureRequest(w, r, "") {
 				return
 			}
 
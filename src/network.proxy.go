@@ -0,0 +1,95 @@
+package main
+
+import (
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+
+	fs "imuslab.com/arozos/mod/filesystem"
+	"imuslab.com/arozos/mod/network/dynamicproxy"
+	permission "imuslab.com/arozos/mod/permission"
+	prout "imuslab.com/arozos/mod/prouter"
+	"imuslab.com/arozos/mod/utils"
+)
+
+/*
+	Network Reverse Proxy
+
+	Admin managed host and path based proxy rules,
+	served on the same port as the web desktop
+*/
+
+var dynamicProxyRouter *dynamicproxy.Router //nil if the reverse proxy failed to start
+
+func NetworkProxyInit() {
+	var err error
+	dynamicProxyRouter, err = dynamicproxy.NewDynamicProxy(dynamicproxy.RouterOption{
+		Database:  sysdb,
+		CheckAuth: authAgent.CheckAuth,
+		LoginPaths: []string{
+			"/login.html",
+			"/favicon.ico",
+			"/manifest.webmanifest",
+			"/script/",
+			"/img/public/",
+			"/system/auth/",
+			"/system/info/getArOZInfo",
+			"/public/register/checkPublicRegister",
+		},
+		LocalPaths:   []string{"/.well-known/acme-challenge/"},
+		StripCookies: []string{authAgent.SessionName, "ao_acc"},
+		IsReserved:   networkProxyIsReservedPath,
+	})
+	if err != nil {
+		systemWideLogger.PrintAndLog("Proxy", "Unable to start reverse proxy", err)
+		return
+	}
+	dynamicProxyRouter.StartHealthCheck(30 * time.Second)
+
+	registerSetting(settingModule{
+		Name:         "Reverse Proxy",
+		Desc:         "Host and path based reverse proxy",
+		IconPath:     "SystemAO/network/img/ethernet.png",
+		Group:        "Network",
+		StartDir:     "SystemAO/network/proxy.html",
+		RequireAdmin: true,
+		Capability:   permission.CapNetworkSettings,
+	})
+
+	adminRouter := prout.NewModuleRouter(prout.RouterOption{
+		ModuleName:  "System Setting",
+		AdminOnly:   true,
+		Capability:  permission.CapNetworkSettings,
+		UserHandler: userHandler,
+		DeniedHandler: func(w http.ResponseWriter, r *http.Request) {
+			utils.SendErrorResponse(w, "Permission Denied")
+		},
+	})
+
+	adminRouter.HandleFunc("/system/network/proxy/list", dynamicProxyRouter.HandleListRules)
+	adminRouter.HandleFunc("/system/network/proxy/add", dynamicProxyRouter.HandleAddRule)
+	adminRouter.HandleFunc("/system/network/proxy/remove", dynamicProxyRouter.HandleRemoveRule)
+}
+
+// Wrap the root handler with the proxy rules
+func networkProxyMiddleware(next http.Handler) http.Handler {
+	if dynamicProxyRouter == nil {
+		return next
+	}
+	return dynamicProxyRouter.Middleware(next)
+}
+
+// Path rules cannot take over the web root folders or the registered API endpoints
+func networkProxyIsReservedPath(path string) bool {
+	firstSegment := strings.Split(strings.TrimPrefix(path, "/"), "/")[0]
+	if firstSegment == "" || fs.FileExists(filepath.Join("./web", firstSegment)) {
+		return true
+	}
+	r, err := http.NewRequest("GET", path, nil)
+	if err != nil {
+		return true
+	}
+	_, pattern := http.DefaultServeMux.Handler(r)
+	return pattern != "/"
+}
@@ -1,12 +1,14 @@
 package main
 
 import (
+	"errors"
 	"strconv"
 	"time"
 
 	fs "imuslab.com/arozos/mod/filesystem"
 	notification "imuslab.com/arozos/mod/notification"
 	"imuslab.com/arozos/mod/notification/agents/smtpn"
+	"imuslab.com/arozos/mod/notification/agents/wsn"
 )
 
 var notificationQueue *notification.NotificationQueue
@@ -49,6 +51,12 @@ func notificationInit() {
 		notificationQueue.RegisterNotificationAgent(smtpAgent)
 	}
 
+	/*
+		WebSocket Notification Agent
+		For pushing notification to the user's opened browser sessions
+	*/
+	notificationQueue.RegisterNotificationAgent(wsn.NewWebSocketNotificationAgent(publishNotificationEvent))
+
 	//Create and register other notification agents
 
 	go func() {
@@ -65,3 +73,26 @@ func notificationInit() {
 	}()
 
 }
+
+// Send a notification to all admin users, return error if the notification service is not ready
+func notifyAdmins(title string, message string, sender string) error {
+	if notificationQueue == nil {
+		return errors.New("notification service not started")
+	}
+	admins := []string{}
+	for _, username := range authAgent.ListUsers() {
+		userinfo, err := userHandler.GetUserInfoFromUsername(username)
+		if err == nil && userinfo.IsAdmin() {
+			admins = append(admins, username)
+		}
+	}
+
+	return notificationQueue.BroadcastNotification(&notification.NotificationPayload{
+		ID:            strconv.FormatInt(time.Now().UnixNano(), 10),
+		Title:         title,
+		Message:       message,
+		Receiver:      admins,
+		Sender:        sender,
+		ReciverAgents: []string{"wsn", "smtpn"},
+	})
+}
@@ -4,6 +4,7 @@ import (
 	"net/http"
 
 	oauth "imuslab.com/arozos/mod/auth/oauth2"
+	permission "imuslab.com/arozos/mod/permission"
 	prout "imuslab.com/arozos/mod/prouter"
 )
 
@@ -13,6 +14,7 @@ func OAuthInit() {
 	adminRouter := prout.NewModuleRouter(prout.RouterOption{
 		ModuleName:  "System Setting",
 		AdminOnly:   true,
+		Capability:  permission.CapSecuritySettings,
 		UserHandler: userHandler,
 		DeniedHandler: func(w http.ResponseWriter, r *http.Request) {
 			errorHandlePermissionDenied(w, r)
@@ -32,5 +34,6 @@ func OAuthInit() {
 		Group:        "Security",
 		StartDir:     "SystemAO/advance/oauth.html",
 		RequireAdmin: true,
+		Capability:   permission.CapSecuritySettings,
 	})
 }
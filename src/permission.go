@@ -6,6 +6,7 @@ import (
 
 	permission "imuslab.com/arozos/mod/permission"
 	prout "imuslab.com/arozos/mod/prouter"
+	user "imuslab.com/arozos/mod/user"
 	"imuslab.com/arozos/mod/utils"
 )
 
@@ -22,6 +23,7 @@ func permissionNewHandler() {
 
 func permissionInit() {
 	//Register the permission handler, require authentication except listgroup
+	//Groups and roles define the admin privileges, require full admin
 	adminRouter := prout.NewModuleRouter(prout.RouterOption{
 		ModuleName:  "System Setting",
 		AdminOnly:   true,
@@ -42,7 +44,7 @@ func permissionInit() {
 			//There are already users in the system. Only allow authorized users
 			if authAgent.CheckAuth(r) {
 				requestingUser, _ := userHandler.GetUserInfoFromRequest(w, r)
-				if requestingUser != nil && requestingUser.IsAdmin() {
+				if requestingUser != nil && requestingUser.HasCapability(permission.CapUserManagement) {
 					permissionHandler.HandleListGroup(w, r)
 				} else {
 					errorHandlePermissionDenied(w, r)
@@ -59,6 +61,11 @@ func permissionInit() {
 	adminRouter.HandleFunc("/system/permission/editgroup", permissionHandler.HandleGroupEdit)
 	adminRouter.HandleFunc("/system/permission/delgroup", permissionHandler.HandleGroupRemove)
 
+	//Roles that grant part of the admin capabilities to a group
+	adminRouter.HandleFunc("/system/permission/roles/list", permissionHandler.HandleListRoles)
+	adminRouter.HandleFunc("/system/permission/roles/set", permissionHandler.HandleSetRole)
+	adminRouter.HandleFunc("/system/permission/roles/remove", permissionHandler.HandleRemoveRole)
+
 	registerSetting(settingModule{
 		Name:         "Permission Groups",
 		Desc:         "Handle the permission of access in groups",
@@ -67,4 +74,32 @@ func permissionInit() {
 		StartDir:     "SystemAO/users/group.html",
 		RequireAdmin: true,
 	})
+
+	registerSetting(settingModule{
+		Name:         "Admin Roles",
+		Desc:         "Grant part of the admin privileges to groups",
+		IconPath:     "SystemAO/users/img/small_icon.png",
+		Group:        "Users",
+		StartDir:     "SystemAO/users/roles.html",
+		RequireAdmin: true,
+	})
+}
+
+// Check if the user can put other users into the given groups.
+// Only full admins can grant membership of groups that hold admin privileges
+func permissionCanAssignGroups(userinfo *user.User, groupnames []string) bool {
+	if userinfo.IsAdmin() {
+		return true
+	}
+	for _, pg := range permissionHandler.GetPermissionGroupByNameList(groupnames) {
+		if pg.IsPrivileged() {
+			return false
+		}
+	}
+	return true
+}
+
+// Check if the user can edit or remove the target user account
+func permissionCanManageUser(userinfo *user.User, target *user.User) bool {
+	return userinfo.IsAdmin() || !target.IsPrivileged()
 }
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net/http"
+
+	"imuslab.com/arozos/mod/media/photolib"
+	prout "imuslab.com/arozos/mod/prouter"
+	"imuslab.com/arozos/mod/utils"
+)
+
+/*
+	Photo Library
+	This script handle the startup of the photo library indexer
+
+	The indexer build a per-user photo index from the user selected folders
+	and serve the timeline, album, map and duplicates APIs to the Photo module
+*/
+
+var photoLibrary *photolib.Library
+
+func PhotoLibraryInit() {
+	var err error
+	photoLibrary, err = photolib.NewPhotoLibrary(&photolib.Options{
+		Database:      sysdb,
+		UserHandler:   userHandler,
+		RenderHandler: thumbRenderHandler,
+		Logger:        systemWideLogger,
+	})
+	if err != nil {
+		systemWideLogger.PrintAndLog("Photo", "Unable to start photo library", err)
+		return
+	}
+
+	router := prout.NewModuleRouter(prout.RouterOption{
+		ModuleName:  "Photo",
+		AdminOnly:   false,
+		UserHandler: userHandler,
+		DeniedHandler: func(w http.ResponseWriter, r *http.Request) {
+			utils.SendErrorResponse(w, "Permission Denied")
+		},
+	})
+
+	//Library management APIs
+	router.HandleFunc("/system/photo/library/folders", photoLibrary.HandleLibraryFolders)
+	router.HandleFunc("/system/photo/library/refresh", photoLibrary.HandleRefresh)
+	router.HandleFunc("/system/photo/library/status", photoLibrary.HandleIndexStatus)
+
+	//Library query APIs
+	router.HandleFunc("/system/photo/timeline", photoLibrary.HandleTimeline)
+	router.HandleFunc("/system/photo/info", photoLibrary.HandlePhotoInfo)
+	router.HandleFunc("/system/photo/map", photoLibrary.HandleMap)
+	router.HandleFunc("/system/photo/duplicates", photoLibrary.HandleDuplicates)
+	router.HandleFunc("/system/photo/thumbnail", photoLibrary.HandleThumbnail)
+	router.HandleFunc("/system/photo/albums", photoLibrary.HandleAlbums)
+
+	//Incrementally refresh all user libraries every night
+	nightlyManager.RegisterNightlyTask(photoLibrary.RefreshAllLibraries)
+}
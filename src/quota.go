@@ -4,12 +4,14 @@ import (
 	"encoding/json"
 	"net/http"
 	"os"
-	"path/filepath"
 	"sort"
 	"strconv"
 	"strings"
 
 	fs "imuslab.com/arozos/mod/filesystem"
+	permission "imuslab.com/arozos/mod/permission"
+	prout "imuslab.com/arozos/mod/prouter"
+	"imuslab.com/arozos/mod/quota"
 	"imuslab.com/arozos/mod/utils"
 	//user "imuslab.com/arozos/mod/user"
 )
@@ -29,6 +31,30 @@ func DiskQuotaInit() {
 		StartDir: "SystemAO/disk/quota/quota.html",
 	})
 
+	http.HandleFunc("/system/disk/quota/breakdown", system_disk_quota_handleUsageBreakdown)
+
+	//Admin APIs for quota policies
+	adminRouter := prout.NewModuleRouter(prout.RouterOption{
+		ModuleName:  "System Setting",
+		AdminOnly:   true,
+		Capability:  permission.CapStorageManagement,
+		UserHandler: userHandler,
+		DeniedHandler: func(w http.ResponseWriter, r *http.Request) {
+			utils.SendErrorResponse(w, "Permission Denied")
+		},
+	})
+	adminRouter.HandleFunc("/system/disk/quota/setSoftQuota", system_disk_quota_setSoftQuota)
+	adminRouter.HandleFunc("/system/disk/quota/policy/list", system_disk_quota_listPolicies)
+	adminRouter.HandleFunc("/system/disk/quota/policy/set", system_disk_quota_setPolicy)
+	adminRouter.HandleFunc("/system/disk/quota/policy/remove", system_disk_quota_removePolicy)
+	adminRouter.HandleFunc("/system/disk/quota/reconcile", system_disk_quota_handleReconcile)
+
+	//Warn the user when the usage exceed the soft limit
+	quota.SetWarningHandler(func(username string, warning string) {
+		systemWideLogger.PrintAndLog("Quota", username+": "+warning, nil)
+		publishQuotaWarningEvent(username, warning)
+	})
+
 	//Register the timer for running the global user quota recalculation
 	nightlyManager.RegisterNightlyTask(system_disk_quota_updateAllUserQuotaEstimation)
 }
@@ -52,7 +78,7 @@ func system_disk_quota_setQuota(w http.ResponseWriter, r *http.Request) {
 	}
 
 	//Check if admin
-	if !userinfo.IsAdmin() {
+	if !userinfo.HasCapability(permission.CapStorageManagement) {
 		utils.SendErrorResponse(w, "Permission Denied")
 		return
 	}
@@ -91,22 +117,30 @@ func system_disk_quota_handleQuotaInfo(w http.ResponseWriter, r *http.Request) {
 
 	//Get quota information
 	type quotaInformation struct {
-		Remaining int64
-		Used      int64
-		Total     int64
+		Remaining     int64
+		Used          int64
+		Total         int64
+		Soft          int64
+		PerFsh        map[string]int64
+		Warnings      []string
+		LastReconcile int64
 	}
 
 	jsonString, _ := json.Marshal(quotaInformation{
-		Remaining: userinfo.StorageQuota.TotalStorageQuota - userinfo.StorageQuota.UsedStorageQuota,
-		Used:      userinfo.StorageQuota.UsedStorageQuota,
-		Total:     userinfo.StorageQuota.TotalStorageQuota,
+		Remaining:     userinfo.StorageQuota.TotalStorageQuota - userinfo.StorageQuota.UsedStorageQuota,
+		Used:          userinfo.StorageQuota.UsedStorageQuota,
+		Total:         userinfo.StorageQuota.TotalStorageQuota,
+		Soft:          userinfo.StorageQuota.GetUserSoftStorageQuota(),
+		PerFsh:        userinfo.StorageQuota.GetUsage(),
+		Warnings:      userinfo.StorageQuota.GetWarnings(),
+		LastReconcile: userinfo.StorageQuota.GetLastReconcileTime(),
 	})
 
 	utils.SendJSONResponse(w, string(jsonString))
 
 	go func() {
-		//Update this user's quota estimation in go routine
-		userinfo.StorageQuota.CalculateQuotaUsage()
+		//Usage is tracked on file operations. Reconcile with the storage if it is outdated
+		userinfo.StorageQuota.ReconcileIfOutdated(300)
 	}()
 }
 
@@ -122,10 +156,13 @@ func system_disk_quota_handleFileDistributionView(w http.ResponseWriter, r *http
 	userFileSystemHandlers := userinfo.GetAllFileSystemHandler()
 	for _, thisHandler := range userFileSystemHandlers {
 		if thisHandler.Hierarchy == "user" {
-			thispath := filepath.ToSlash(filepath.Clean(thisHandler.Path)) + "/users/" + userinfo.Username + "/"
-			filepath.Walk(thispath, func(filepath string, info os.FileInfo, err error) error {
-				if err != nil {
-					return err
+			thispath, err := thisHandler.FileSystemAbstraction.VirtualPathToRealPath(thisHandler.UUID+":/", userinfo.Username)
+			if err != nil {
+				continue
+			}
+			thisHandler.FileSystemAbstraction.Walk(thispath, func(filepath string, info os.FileInfo, err error) error {
+				if err != nil || info == nil {
+					return nil
 				}
 				if !info.IsDir() {
 					mime, _, err := fs.GetMime(filepath)
@@ -160,3 +197,196 @@ func system_disk_quota_handleFileDistributionView(w http.ResponseWriter, r *http
 	jsonString, _ := json.Marshal(ss)
 	utils.SendJSONResponse(w, string(jsonString))
 }
+
+// Get the usage breakdown by folder and file type, GET vpath (default user:/)
+func system_disk_quota_handleUsageBreakdown(w http.ResponseWriter, r *http.Request) {
+	userinfo, err := userHandler.GetUserInfoFromRequest(w, r)
+	if err != nil {
+		utils.SendErrorResponse(w, "Unknown User")
+		return
+	}
+
+	vpath, err := utils.GetPara(r, "vpath")
+	if err != nil {
+		vpath = "user:/"
+	}
+	if !userinfo.CanRead(vpath) {
+		utils.SendErrorResponse(w, "Permission Denied")
+		return
+	}
+
+	fsh, err := userinfo.GetFileSystemHandlerFromVirtualPath(vpath)
+	if err != nil || fsh.Closed {
+		utils.SendErrorResponse(w, "Storage not found or not mounted")
+		return
+	}
+	rpath, err := fsh.FileSystemAbstraction.VirtualPathToRealPath(vpath, userinfo.Username)
+	if err != nil || !fsh.FileSystemAbstraction.IsDir(rpath) {
+		utils.SendErrorResponse(w, "Folder not exists")
+		return
+	}
+
+	js, _ := json.Marshal(quota.GetUsageBreakdown(fsh, rpath))
+	utils.SendJSONResponse(w, string(js))
+}
+
+// Set the soft quota of a user, require POST username and quota (in MB, 0 for 90% of the storage quota)
+func system_disk_quota_setSoftQuota(w http.ResponseWriter, r *http.Request) {
+	username, err := utils.PostPara(r, "username")
+	if err != nil {
+		utils.SendErrorResponse(w, "Invalid username given")
+		return
+	}
+	targetUser, err := userHandler.GetUserInfoFromUsername(username)
+	if err != nil {
+		utils.SendErrorResponse(w, "User not exists")
+		return
+	}
+
+	quotaSizeString, err := utils.PostPara(r, "quota")
+	if err != nil {
+		utils.SendErrorResponse(w, "Quota not defined")
+		return
+	}
+	quotaSize, err := utils.StringToInt64(quotaSizeString)
+	if err != nil || quotaSize < 0 {
+		utils.SendErrorResponse(w, "Invalid quota size given")
+		return
+	}
+
+	targetUser.StorageQuota.SetUserSoftStorageQuota(quotaSize << 20)
+	utils.SendOK(w)
+}
+
+// List the quota policies of all file systems
+func system_disk_quota_listPolicies(w http.ResponseWriter, r *http.Request) {
+	userinfo, err := userHandler.GetUserInfoFromRequest(w, r)
+	if err != nil {
+		utils.SendErrorResponse(w, "Unknown User")
+		return
+	}
+
+	js, _ := json.Marshal(userinfo.StorageQuota.ListFshPolicies())
+	utils.SendJSONResponse(w, string(js))
+}
+
+// Set the quota policy of a file system, require POST fsh, limit, soft (in MB, -1 for unlimited) and optional groups (JSON object of group name to limit in MB)
+func system_disk_quota_setPolicy(w http.ResponseWriter, r *http.Request) {
+	userinfo, err := userHandler.GetUserInfoFromRequest(w, r)
+	if err != nil {
+		utils.SendErrorResponse(w, "Unknown User")
+		return
+	}
+
+	fshUUID, err := utils.PostPara(r, "fsh")
+	if err != nil {
+		utils.SendErrorResponse(w, "Invalid file system given")
+		return
+	}
+	if _, err := userinfo.GetFileSystemHandlerFromVirtualPath(fshUUID + ":/"); err != nil {
+		utils.SendErrorResponse(w, "File system not found")
+		return
+	}
+
+	limitString, _ := utils.PostPara(r, "limit")
+	limit, err := system_disk_quota_parseMBLimit(limitString)
+	if err != nil {
+		utils.SendErrorResponse(w, "Invalid limit given")
+		return
+	}
+	softString, _ := utils.PostPara(r, "soft")
+	soft, err := system_disk_quota_parseMBLimit(softString)
+	if err != nil {
+		utils.SendErrorResponse(w, "Invalid soft limit given")
+		return
+	}
+
+	groupLimits := map[string]int64{}
+	groupsString, _ := utils.PostPara(r, "groups")
+	if groupsString != "" {
+		groupLimitsInMB := map[string]int64{}
+		err = json.Unmarshal([]byte(groupsString), &groupLimitsInMB)
+		if err != nil {
+			utils.SendErrorResponse(w, "Invalid group limits given")
+			return
+		}
+		for groupName, groupLimit := range groupLimitsInMB {
+			if !permissionHandler.GroupExists(groupName) {
+				utils.SendErrorResponse(w, "Permission group not exists: "+groupName)
+				return
+			}
+			if groupLimit < 0 {
+				groupLimits[groupName] = -1
+			} else {
+				groupLimits[groupName] = groupLimit << 20
+			}
+		}
+	}
+
+	err = userinfo.StorageQuota.SetFshPolicy(quota.FshPolicy{
+		FshUUID:     fshUUID,
+		Limit:       limit,
+		SoftLimit:   soft,
+		GroupLimits: groupLimits,
+	})
+	if err != nil {
+		utils.SendErrorResponse(w, err.Error())
+		return
+	}
+	utils.SendOK(w)
+}
+
+// Remove the quota policy of a file system, require POST fsh
+func system_disk_quota_removePolicy(w http.ResponseWriter, r *http.Request) {
+	userinfo, err := userHandler.GetUserInfoFromRequest(w, r)
+	if err != nil {
+		utils.SendErrorResponse(w, "Unknown User")
+		return
+	}
+
+	fshUUID, err := utils.PostPara(r, "fsh")
+	if err != nil {
+		utils.SendErrorResponse(w, "Invalid file system given")
+		return
+	}
+
+	err = userinfo.StorageQuota.RemoveFshPolicy(fshUUID)
+	if err != nil {
+		utils.SendErrorResponse(w, err.Error())
+		return
+	}
+	utils.SendOK(w)
+}
+
+// Reconcile the usage of a user or all users with the storage in background, optional POST username
+func system_disk_quota_handleReconcile(w http.ResponseWriter, r *http.Request) {
+	username, _ := utils.PostPara(r, "username")
+	if username == "" {
+		go system_disk_quota_updateAllUserQuotaEstimation()
+		utils.SendOK(w)
+		return
+	}
+
+	targetUser, err := userHandler.GetUserInfoFromUsername(username)
+	if err != nil {
+		utils.SendErrorResponse(w, "User not exists")
+		return
+	}
+	go targetUser.StorageQuota.CalculateQuotaUsage()
+	utils.SendOK(w)
+}
+
+// Parse a limit in MB into bytes, empty or negative values means unlimited
+func system_disk_quota_parseMBLimit(value string) (int64, error) {
+	if value == "" {
+		return -1, nil
+	}
+	limit, err := utils.StringToInt64(value)
+	if err != nil {
+		return -1, err
+	}
+	if limit < 0 {
+		return -1, nil
+	}
+	return limit << 20, nil
+}
@@ -8,6 +8,7 @@ import (
 
 	reg "imuslab.com/arozos/mod/auth/register"
 	fs "imuslab.com/arozos/mod/filesystem"
+	permission "imuslab.com/arozos/mod/permission"
 	prout "imuslab.com/arozos/mod/prouter"
 	"imuslab.com/arozos/mod/utils"
 )
@@ -60,6 +61,7 @@ func RegisterSystemInit() {
 		Group:        "Users",
 		StartDir:     "SystemAO/users/pubreg.html",
 		RequireAdmin: true,
+		Capability:   permission.CapUserManagement,
 	})
 
 	//Register Setting Interface for setting interfaces
@@ -67,6 +69,7 @@ func RegisterSystemInit() {
 	adminrouter := prout.NewModuleRouter(prout.RouterOption{
 		ModuleName:  "System Setting",
 		AdminOnly:   true,
+		Capability:  permission.CapUserManagement,
 		UserHandler: userHandler,
 		DeniedHandler: func(w http.ResponseWriter, r *http.Request) {
 			utils.SendErrorResponse(w, "Permission Denied")
@@ -135,6 +138,11 @@ func register_handleSetDefaultGroup(w http.ResponseWriter, r *http.Request) {
 		utils.SendErrorResponse(w, "defaultGroup not defined")
 		return
 	}
+	userinfo, err := userHandler.GetUserInfoFromRequest(w, r)
+	if err != nil || !permissionCanAssignGroups(userinfo, []string{newDefaultGroup}) {
+		utils.SendErrorResponse(w, "Permission Denied")
+		return
+	}
 	err = registerHandler.SetDefaultUserGroup(newDefaultGroup)
 	if err != nil {
 		utils.SendErrorResponse(w, err.Error())
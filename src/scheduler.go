@@ -71,6 +71,8 @@ func SchedulerInit() {
 		Gateway:     AGIGateway,
 		Logger:      systemWideLogger,
 		CronFile:    "system/cron.json",
+
+		OnJobExecuted: publishSchedulerEvent,
 	})
 	if err != nil {
 		systemWideLogger.PrintAndLog("Cron", "ArOZ Emulated Cron Startup Failed. Stopping all scheduled tasks.", err)
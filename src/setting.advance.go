@@ -4,6 +4,7 @@ import (
 	"net/http"
 
 	autologin "imuslab.com/arozos/mod/auth/autologin"
+	permission "imuslab.com/arozos/mod/permission"
 	prout "imuslab.com/arozos/mod/prouter"
 	"imuslab.com/arozos/mod/utils"
 )
@@ -20,6 +21,7 @@ func AdvanceSettingInit() {
 		Define common routers
 
 	*/
+	//Autologin tokens can be created for any user, require full admin
 	adminRouter := prout.NewModuleRouter(prout.RouterOption{
 		ModuleName:  "System Settings",
 		AdminOnly:   true,
@@ -63,6 +65,7 @@ func AdvanceSettingInit() {
 			Group:        "Advance",
 			StartDir:     "SystemAO/disk/diskmg.html",
 			RequireAdmin: true,
+			Capability:   permission.CapStorageManagement,
 		})
 	}
 }
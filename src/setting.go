@@ -16,6 +16,7 @@ type settingModule struct {
 	StartDir     string //Startup Directory / path
 	RequireAdmin bool   //If the setting require admin access.
 	//^ Enable this to hide this setting from non-admin users, but for API call, module has to handle admin check themselves.
+	Capability string //The admin capability that also grants access to this setting. Leave empty for full admin only
 
 }
 
@@ -134,7 +135,7 @@ func system_setting_handleListing(w http.ResponseWriter, r *http.Request) {
 		for _, setMod := range settingModules {
 			if setMod.Group == listGroup {
 				//Check if the module is admin only.
-				if setMod.RequireAdmin && userinfo.IsAdmin() {
+				if setMod.RequireAdmin && (userinfo.IsAdmin() || (setMod.Capability != "" && userinfo.HasCapability(setMod.Capability))) {
 					//Admin module and user is admin. Append to list
 					results = append(results, setMod)
 				} else if setMod.RequireAdmin == false {
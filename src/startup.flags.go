@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"net/http"
 
+	permission "imuslab.com/arozos/mod/permission"
 	prout "imuslab.com/arozos/mod/prouter"
 	"imuslab.com/arozos/mod/utils"
 )
@@ -26,10 +27,12 @@ func StartupFlagsInit() {
 		Group:        "Info",
 		StartDir:     "SystemAO/boot/bootflags.html",
 		RequireAdmin: true,
+		Capability:   permission.CapSystemManagement,
 	})
 
 	adminRouter := prout.NewModuleRouter(prout.RouterOption{
 		AdminOnly:   true,
+		Capability:  permission.CapSystemManagement,
 		UserHandler: userHandler,
 		DeniedHandler: func(w http.ResponseWriter, r *http.Request) {
 			utils.SendErrorResponse(w, "Permission Denied")
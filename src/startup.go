@@ -9,6 +9,7 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"time"
 
 	db "imuslab.com/arozos/mod/database"
 	"imuslab.com/arozos/mod/filesystem"
@@ -17,7 +18,15 @@ import (
 )
 
 func RunStartup() {
-	systemWideLogger, _ = logger.NewLogger("system", "system/logs/system/", true)
+	systemWideLogger, _ = logger.NewLoggerWithOptions(logger.Options{
+		Prefix:       "system",
+		LogFolder:    "system/logs/system/",
+		LogToFile:    true,
+		MaxFileSize:  int64(*log_max_size) << 20,
+		MaxAge:       time.Duration(*log_max_age) * 24 * time.Hour,
+		MaxTotalSize: int64(*log_max_total) << 20,
+	})
+	SystemUpdateInit() //Check pending update and rollback if needed, must run before anything else use the web folder
 	//1. Initiate the main system database
 
 	//Check if system or web both not exists and web.tar.gz exists. Unzip it for the user
@@ -77,6 +86,7 @@ func RunStartup() {
 
 	//7. Kickstart the File System and Desktop
 	NightlyTasksInit() //Start Nightly task scheduler
+	FileAuditInit()    //File activity audit trail, must start before FileSystem and file servers
 	FileSystemInit()   //Start FileSystem
 	DesktopInit()      //Start Desktop
 
@@ -95,14 +105,19 @@ func RunStartup() {
 	SystemInfoInit()          //System Information UI
 	SystemIDInit()            //System UUID Manager
 	AuthSettingsInit()        //Authentication Settings Handler, must be start after user Handler
+	AuthWebAuthnInit()        //Passkey login and second factor, must be start after user Handler
+	SystemBackupInit()        //System configuration backup and restore
+	SystemMetricsInit()       //Prometheus metrics exporter
 	AdvanceSettingInit()      //System Advance Settings
 	StartupFlagsInit()        //System BootFlag settibg
 	HardwarePowerInit()       //Start host power manager
 	RegisterStorageSettings() //Storage Settings
 
 	//10. Startup network services and schedule services
+	NetworkACMEInit()    //ACME certificate manager, must start before the HTTPS server and FTPS
 	NetworkServiceInit() //Initalize network serves (ssdp / mdns etc)
 	WiFiInit()           //Inialize WiFi management module
+	NetworkProxyInit()   //Admin managed reverse proxy rules
 
 	//ARSM Moved to scheduler, remote support is rewrite pending
 	//ArsmInit() //Inialize ArOZ Remote Support & Management Framework
@@ -116,6 +131,7 @@ func RunStartup() {
 	OAuthInit()        //Oauth system init
 	ldapInit()         //LDAP system init
 	notificationInit() //Notification system init
+	PhotoLibraryInit() //Photo library indexer, require FileSystemInit()
 
 	//Start High Level Services that requires full arozos architectures
 	FileServerInit()
@@ -8,6 +8,7 @@ import (
 	"path/filepath"
 	"runtime"
 	"strings"
+	"sync"
 	"time"
 
 	"imuslab.com/arozos/mod/filesystem"
@@ -25,6 +26,7 @@ var (
 	//storagePools    []*storage.StoragePool  //All Storage pool opened
 	bridgeManager              *bridge.Record //Manager to handle bridged FSH
 	storageHeartbeatTickerChan chan bool      //Channel to stop the storage heartbeat ticker
+	storageHeartbeatState      sync.Map       //fsh UUID -> if the last heartbeat succeeded
 )
 
 func StorageInit() {
@@ -147,6 +149,7 @@ func StoragePerformFileSystemAbstractionConnectionHeartbeat() {
 	allFsh := GetAllLoadedFsh()
 	for _, thisFsh := range allFsh {
 		err := thisFsh.FileSystemAbstraction.Heartbeat()
+		storageHeartbeatState.Store(thisFsh.UUID, err == nil)
 		if err != nil {
 			log.Println("[Storage] File System Abstraction from " + thisFsh.Name + " report an error: " + err.Error())
 			//Retreive the old startup config and close the pool
@@ -183,6 +186,8 @@ func StoragePerformFileSystemAbstractionConnectionHeartbeat() {
 					log.Println("[Storage] Attach fsh to pool failed: " + err.Error())
 				}
 			}
+			storageHeartbeatState.Store(newfsh.UUID, true)
+			publishStorageEvent(newfsh, "reconnect")
 		}
 	}
 }
@@ -354,6 +359,7 @@ func RegisterStorageSettings() {
 		Group:        "Disk",
 		StartDir:     "SystemAO/storage/poolList.html",
 		RequireAdmin: true,
+		Capability:   permission.CapStorageManagement,
 	})
 
 }
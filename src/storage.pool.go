@@ -32,6 +32,7 @@ func StoragePoolEditorInit() {
 	adminRouter := prout.NewModuleRouter(prout.RouterOption{
 		ModuleName:  "System Settings",
 		AdminOnly:   true,
+		Capability:  permission.CapStorageManagement,
 		UserHandler: userHandler,
 		DeniedHandler: func(w http.ResponseWriter, r *http.Request) {
 			utils.SendErrorResponse(w, "Permission Denied")
@@ -322,6 +323,11 @@ func HandleFSHToggle(w http.ResponseWriter, r *http.Request) {
 	}
 
 	targetFSH.Closed = !targetFSH.Closed
+	if targetFSH.Closed {
+		publishStorageEvent(targetFSH, "unmount")
+	} else {
+		publishStorageEvent(targetFSH, "mount")
+	}
 
 	//Return ok
 	utils.SendOK(w)
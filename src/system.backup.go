@@ -0,0 +1,48 @@
+package main
+
+import (
+	"net/http"
+
+	"imuslab.com/arozos/mod/backup"
+	prout "imuslab.com/arozos/mod/prouter"
+	"imuslab.com/arozos/mod/utils"
+)
+
+/*
+	System Configuration Backup
+
+	Export and restore the users, groups, shares, storage pools,
+	scheduler tasks, login records and other system settings
+*/
+
+var systemBackupManager *backup.Manager
+
+func SystemBackupInit() {
+	systemBackupManager = backup.NewManager(&backup.Options{
+		Database:   sysdb,
+		AuthLogger: authAgent.Logger,
+		FileSections: map[string][]string{
+			"storage":   {*storage_config_file, "./system/storage/*.json", "./system/bridge.json"},
+			"scheduler": {"./system/cron.json"},
+			"acme":      {"./system/acme/*.pem", "./system/acme/account.key"},
+		},
+		BuildVersion: internal_version,
+		Hostname:     *host_name,
+		BackupFolder: "./system/backups/",
+	})
+
+	//Restoring a backup replaces the user and permission database, require full admin
+	adminRouter := prout.NewModuleRouter(prout.RouterOption{
+		ModuleName:  "System Setting",
+		AdminOnly:   true,
+		UserHandler: userHandler,
+		DeniedHandler: func(w http.ResponseWriter, r *http.Request) {
+			utils.SendErrorResponse(w, "Permission Denied")
+		},
+	})
+
+	adminRouter.HandleFunc("/system/backup/sections", systemBackupManager.HandleListSections)
+	adminRouter.HandleFunc("/system/backup/export", systemBackupManager.HandleExport)
+	adminRouter.HandleFunc("/system/backup/preview", systemBackupManager.HandlePreview)
+	adminRouter.HandleFunc("/system/backup/restore", systemBackupManager.HandleRestore)
+}
@@ -11,6 +11,7 @@ import (
 	info "imuslab.com/arozos/mod/info/hardwareinfo"
 	"imuslab.com/arozos/mod/info/logviewer"
 	usage "imuslab.com/arozos/mod/info/usageinfo"
+	permission "imuslab.com/arozos/mod/permission"
 	prout "imuslab.com/arozos/mod/prouter"
 	"imuslab.com/arozos/mod/updates"
 	"imuslab.com/arozos/mod/utils"
@@ -43,6 +44,7 @@ func SystemInfoInit() {
 	adminRouter := prout.NewModuleRouter(prout.RouterOption{
 		ModuleName:  "System Setting",
 		AdminOnly:   true,
+		Capability:  permission.CapSystemManagement,
 		UserHandler: userHandler,
 		DeniedHandler: func(w http.ResponseWriter, r *http.Request) {
 			utils.SendErrorResponse(w, "Permission Denied")
@@ -141,7 +143,7 @@ func SystemInfoInit() {
 	})
 
 	go func() {
-		if updates.CheckLauncherPortResponsive() {
+		if updates.CheckLauncherPortResponsive() && systemUpdater != nil {
 			//Launcher port is responsive. Assume launcher exists
 			registerSetting(settingModule{
 				Name:         "Updates",
@@ -150,12 +152,14 @@ func SystemInfoInit() {
 				Group:        "Info",
 				StartDir:     "SystemAO/updates/index.html",
 				RequireAdmin: true,
+				Capability:   permission.CapSystemManagement,
 			})
 
 			//Register Update Functions
-			adminRouter.HandleFunc("/system/update/download", updates.HandleUpdateDownloadRequest)
+			adminRouter.HandleFunc("/system/update/download", systemUpdater.HandleUpdateDownloadRequest)
 			adminRouter.HandleFunc("/system/update/checksize", updates.HandleUpdateCheckSize)
-			adminRouter.HandleFunc("/system/update/checkpending", updates.HandlePendingCheck)
+			adminRouter.HandleFunc("/system/update/checkpending", systemUpdater.HandlePendingCheck)
+			adminRouter.HandleFunc("/system/update/state", systemUpdater.HandleUpdateState)
 			adminRouter.HandleFunc("/system/update/platform", updates.HandleGetUpdatePlatformInfo)
 
 			//Special function for handling launcher restart, must be in this scope
@@ -167,6 +171,15 @@ func SystemInfoInit() {
 				}
 				execute, _ := utils.PostPara(r, "exec")
 				if execute == "true" && r.Method == http.MethodPost {
+					//Switch in the staged update
+					if systemUpdater.GetState().Staged != "" {
+						err = systemUpdater.Apply()
+						if err != nil {
+							utils.SendErrorResponse(w, "Unable to apply update: "+err.Error())
+							return
+						}
+					}
+
 					//Do the update
 					systemWideLogger.PrintAndLog("System", "REQUESTING LAUNCHER FOR UPDATE RESTART", nil)
 					executeShutdownSequence()
@@ -190,8 +203,18 @@ func SystemInfoInit() {
 		Extension:  ".log",
 	})
 
-	adminRouter.HandleFunc("/system/log/list", logViewer.HandleListLog)
-	adminRouter.HandleFunc("/system/log/read", logViewer.HandleReadLog)
+	logRouter := prout.NewModuleRouter(prout.RouterOption{
+		ModuleName:  "System Setting",
+		AdminOnly:   true,
+		Capability:  permission.CapLogViewing,
+		UserHandler: userHandler,
+		DeniedHandler: func(w http.ResponseWriter, r *http.Request) {
+			utils.SendErrorResponse(w, "Permission Denied")
+		},
+	})
+	logRouter.HandleFunc("/system/log/list", logViewer.HandleListLog)
+	logRouter.HandleFunc("/system/log/read", logViewer.HandleReadLog)
+	logRouter.HandleFunc("/system/log/search", logViewer.HandleSearchLog)
 
 	registerSetting(settingModule{
 		Name:         "System Log",
@@ -200,6 +223,7 @@ func SystemInfoInit() {
 		Group:        "Advance",
 		StartDir:     "SystemAO/advance/logview.html",
 		RequireAdmin: true,
+		Capability:   permission.CapLogViewing,
 	})
 
 }
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"imuslab.com/arozos/mod/auth/authlogger"
+	"imuslab.com/arozos/mod/disk/diskcapacity/dftool"
+	"imuslab.com/arozos/mod/filesystem/arozfs"
+	"imuslab.com/arozos/mod/filesystem/jobqueue"
+	"imuslab.com/arozos/mod/info/metrics"
+	permission "imuslab.com/arozos/mod/permission"
+	prout "imuslab.com/arozos/mod/prouter"
+	"imuslab.com/arozos/mod/utils"
+)
+
+/*
+	System Metrics
+
+	Expose the host, storage and service metrics at /metrics
+	for Prometheus. Scrapers authenticate with the bearer token
+	generated in the admin endpoint, or with an admin session.
+*/
+
+var systemMetrics *metrics.Exporter
+
+func SystemMetricsInit() {
+	systemMetrics = metrics.NewExporter(&metrics.Options{
+		Database:    sysdb,
+		UserHandler: userHandler,
+		Storages:    systemMetricsStorages,
+		RAIDArrays:  systemMetricsRAIDArrays,
+		Disks:       systemMetricsDisks,
+		Subservices: systemMetricsSubservices,
+		FileServers: systemMetricsFileServers,
+		QueueDepth:  systemMetricsQueueDepth,
+	})
+
+	//Count the login attempts of all authentication methods
+	authAgent.Logger.AddListener(func(record authlogger.LoginRecord) {
+		systemMetrics.RecordLogin(record.AuthType, record.LoginSucceed)
+	})
+
+	adminRouter := prout.NewModuleRouter(prout.RouterOption{
+		ModuleName:  "System Setting",
+		AdminOnly:   true,
+		Capability:  permission.CapSystemManagement,
+		UserHandler: userHandler,
+		DeniedHandler: func(w http.ResponseWriter, r *http.Request) {
+			utils.SendErrorResponse(w, "Permission Denied")
+		},
+	})
+
+	http.HandleFunc("/metrics", systemMetrics.HandleMetrics)
+	adminRouter.HandleFunc("/system/metrics/token", systemMetrics.HandleToken)
+}
+
+func systemMetricsStorages() []*metrics.StorageStat {
+	results := []*metrics.StorageStat{}
+	for _, fsh := range GetAllLoadedFsh() {
+		online := !fsh.Closed
+		if state, ok := storageHeartbeatState.Load(fsh.UUID); ok {
+			online = online && state.(bool)
+		}
+
+		stat := metrics.StorageStat{
+			UUID:       fsh.UUID,
+			Name:       fsh.Name,
+			Filesystem: fsh.Filesystem,
+			Online:     online,
+			Used:       -1,
+			Total:      -1,
+		}
+
+		if !arozfs.IsNetworkDrive(fsh.Filesystem) && utils.FileExists(fsh.Path) {
+			capinfo, err := dftool.GetCapacityInfoFromPath(fsh.Path)
+			if err == nil {
+				stat.Used = capinfo.Used
+				stat.Total = capinfo.Total
+			}
+		}
+		results = append(results, &stat)
+	}
+	return results
+}
+
+func systemMetricsRAIDArrays() []*metrics.RAIDStat {
+	results := []*metrics.RAIDStat{}
+	if raidManager == nil {
+		return results
+	}
+	devices, err := raidManager.GetRAIDDevicesFromProcMDStat()
+	if err != nil {
+		return results
+	}
+
+	for _, device := range devices {
+		stat := metrics.RAIDStat{
+			Name:  device.Name,
+			Level: device.Level,
+			State: device.Status,
+		}
+
+		info, err := raidManager.GetRAIDInfo(filepath.Join("/dev", device.Name))
+		if err == nil {
+			stat.State = info.State
+			stat.ActiveDevices = info.ActiveDevices
+			stat.FailedDevices = info.FailedDevices
+		} else {
+			//Fallback to the member flags in /proc/mdstat
+			for _, member := range device.Members {
+				if member.Failed {
+					stat.FailedDevices++
+				} else {
+					stat.ActiveDevices++
+				}
+			}
+		}
+		stat.Healthy = stat.FailedDevices == 0 && !strings.Contains(stat.State, "degraded")
+		results = append(results, &stat)
+	}
+	return results
+}
+
+func systemMetricsDisks() []*metrics.DiskHealthStat {
+	results := []*metrics.DiskHealthStat{}
+	if smartListener == nil {
+		return results
+	}
+	for _, device := range smartListener.GetDriveList().Devices {
+		results = append(results, &metrics.DiskHealthStat{
+			Device:      device.Name,
+			Model:       device.Smart.ModelName,
+			Passed:      device.Smart.SmartStatus.Passed,
+			Temperature: device.Smart.Temperature.Current,
+		})
+	}
+	return results
+}
+
+func systemMetricsSubservices() []*metrics.ServiceStat {
+	results := []*metrics.ServiceStat{}
+	if ssRouter == nil {
+		return results
+	}
+	for _, ss := range ssRouter.RunningSubService {
+		results = append(results, &metrics.ServiceStat{
+			Name: ss.ServiceDir,
+			Up:   ss.Process != nil && ss.Process.Process != nil && ss.Process.ProcessState == nil,
+		})
+	}
+
+	//Disabled subservices are reported as down
+	disabled, _ := filepath.Glob("subservice/*/.disabled")
+	for _, flagFile := range disabled {
+		results = append(results, &metrics.ServiceStat{
+			Name: filepath.Base(filepath.Dir(flagFile)),
+			Up:   false,
+		})
+	}
+	return results
+}
+
+func systemMetricsFileServers() []*metrics.FileServerStat {
+	results := []*metrics.FileServerStat{}
+	if WebDAVManager != nil {
+		results = append(results, &metrics.FileServerStat{
+			Protocol: "webdav",
+			Enabled:  WebDAVManager.GetWebDavEnabled(),
+			Clients:  WebDAVManager.GetActiveClients(),
+		})
+	}
+	if SFTPManager != nil {
+		results = append(results, &metrics.FileServerStat{
+			Protocol: "sftp",
+			Enabled:  SFTPManager.IsEnabled(),
+			Clients:  SFTPManager.GetConnectedClients(),
+		})
+	}
+	if FTPManager != nil {
+		results = append(results, &metrics.FileServerStat{
+			Protocol: "ftp",
+			Enabled:  FTPManager.IsFtpServerEnabled(),
+			Clients:  FTPManager.GetConnectedClients(),
+		})
+	}
+	return results
+}
+
+func systemMetricsQueueDepth() map[string]int {
+	results := map[string]int{jobqueue.StatusQueued: 0, jobqueue.StatusRunning: 0, jobqueue.StatusPaused: 0}
+	if fileOperationQueue == nil {
+		return results
+	}
+	for _, job := range fileOperationQueue.ListJobs("") {
+		results[job.Status]++
+	}
+	return results
+}
+
+// Record the execution time of AGI scripts, passed to the AGI gateway
+func systemMetricsObserveAGI(entry string, module string, duration time.Duration) {
+	if systemMetrics != nil {
+		systemMetrics.ObserveAGIExecution(entry, module, duration)
+	}
+}
@@ -4,10 +4,15 @@ import (
 	"errors"
 	"log"
 	"net/http"
+	"net/url"
 	"path/filepath"
+	"strings"
+	"time"
 
 	auth "imuslab.com/arozos/mod/auth"
+	"imuslab.com/arozos/mod/auth/resetpw"
 	fs "imuslab.com/arozos/mod/filesystem"
+	"imuslab.com/arozos/mod/notification/agents/smtpn"
 	"imuslab.com/arozos/mod/utils"
 )
 
@@ -15,11 +20,55 @@ import (
 	Password Reset Module
 
 	This module exists to serve the password restart page with security check
+
+	Password can be reset with a reset key given by administrator or
+	a signed reset link sent to the user's registered e-mail address
 */
 
+var passwordResetManager *resetpw.Manager
+
 func system_resetpw_init() {
 	http.HandleFunc("/system/reset/validateResetKey", system_resetpw_validateResetKeyHandler)
 	http.HandleFunc("/system/reset/confirmPasswordReset", system_resetpw_confirmReset)
+
+	//Self-service reset via e-mail
+	var err error
+	passwordResetManager, err = resetpw.NewManager(&resetpw.Options{
+		Database:      sysdb,
+		Logger:        authAgent.Logger,
+		UserExists:    authAgent.UserExists,
+		GetUserEmail:  registerHandler.GetUserEmail,
+		SendResetLink: system_resetpw_sendResetLink,
+	})
+	if err != nil {
+		systemWideLogger.PrintAndLog("Auth", "Unable to start password reset via e-mail", err)
+		return
+	}
+	http.HandleFunc("/system/reset/requestResetLink", passwordResetManager.HandleRequestReset)
+}
+
+// Send the reset link to the user with the SMTP settings of the smtpn notification agent
+func system_resetpw_sendResetLink(username string, email string, token string) error {
+	if *public_url == "" {
+		return errors.New("public_url is not set, unable to generate reset link")
+	}
+	mailer, err := smtpn.NewSMTPNotificationAgent(*host_name, "./system/smtp_conf.json", registerHandler.GetUserEmail)
+	if err != nil {
+		return err
+	}
+
+	resetLink := strings.TrimSuffix(*public_url, "/") + "/reset.html?acc=" + url.QueryEscape(username) + "&rkey=" + url.QueryEscape(token)
+	content, err := utils.Templateload("./system/www/smtpn.html", map[string]string{
+		"receiver":  "Hello " + username + ",",
+		"message":   "A password reset was requested for your account. Use the link below to set a new password. The link can only be used once and expires in 30 minutes.<br><br><a href=\"" + resetLink + "\">" + resetLink + "</a><br><br>If you did not request a password reset, you can ignore this e-mail.",
+		"sender":    "Password Reset",
+		"hostname":  *host_name,
+		"timestamp": time.Now().Format("2006-01-02 3:4:5 PM"),
+	})
+	if err != nil {
+		return err
+	}
+	return mailer.SendMail(email, "Reset your password on "+*host_name, content)
 }
 
 // Validate if the ysername and rkey is valid
@@ -66,26 +115,39 @@ func system_resetpw_confirmReset(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	//Validate rkey
-	err := system_resetpw_validateResetKey(username, rkey)
-	if err != nil {
+	//Validate rkey, reset links sent by e-mail can only be used once
+	if passwordResetManager != nil && passwordResetManager.ValidateToken(username, rkey) == nil {
+		err := passwordResetManager.ConsumeToken(username, rkey, r)
+		if err != nil {
+			utils.SendErrorResponse(w, err.Error())
+			return
+		}
+	} else if err := system_resetpw_validateResetKey(username, rkey); err != nil {
 		utils.SendErrorResponse(w, err.Error())
 		return
 	}
 
 	//OK to procced
 	newHashedPassword := auth.Hash(newpw)
-	err = sysdb.Write("auth", "passhash/"+username, newHashedPassword)
+	err := sysdb.Write("auth", "passhash/"+username, newHashedPassword)
 	if err != nil {
 		utils.SendErrorResponse(w, err.Error())
 		return
 	}
 
+	//Logout the user from all devices
+	authAgent.RevokeUserSessions(username, "")
+
 	utils.SendOK(w)
 
 }
 
 func system_resetpw_validateResetKey(username string, key string) error {
+	//Signed reset link sent by e-mail
+	if passwordResetManager != nil && passwordResetManager.ValidateToken(username, key) == nil {
+		return nil
+	}
+
 	//Get current password from db
 	passwordInDB := ""
 	err := sysdb.Read("auth", "passhash/"+username, &passwordInDB)
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"imuslab.com/arozos/mod/updates"
+)
+
+/*
+	System Update
+
+	Verified self update with staged install and rollback.
+	A switched in version must pass the health check after
+	restart, otherwise the previous version is restored
+*/
+
+var systemUpdater *updates.Updater
+
+// Create the updater and check the pending update before anything else is started
+func SystemUpdateInit() {
+	var err error
+	systemUpdater, err = updates.NewUpdater(&updates.UpdaterOptions{
+		Root:           "./",
+		CurrentVersion: internal_version,
+	})
+	if err != nil {
+		systemWideLogger.PrintAndLog("Update", "Unable to start system updater", err)
+		return
+	}
+
+	if systemUpdater.CheckStartup() {
+		//The new version keep failing to start and has been rolled back. Restart with the previous version
+		systemWideLogger.PrintAndLog("Update", "Update rolled back, restarting with the previous version", nil)
+		os.Exit(1)
+	}
+}
+
+// Confirm the pending update once the system is up and serving
+func SystemUpdateHealthCheck() {
+	if systemUpdater == nil {
+		return
+	}
+	err := systemUpdater.RunHealthCheck(func() error {
+		if !sysdb.TableExists("auth") {
+			return errors.New("system database not accessible")
+		}
+
+		//Check if the web server is responding
+		client := http.Client{
+			Timeout: 10 * time.Second,
+			Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+			},
+		}
+		url := "http://127.0.0.1:" + strconv.Itoa(*listen_port) + "/login.html"
+		if *use_tls && *disable_http {
+			url = "https://127.0.0.1:" + strconv.Itoa(*tls_listen_port) + "/login.html"
+		}
+		resp, err := client.Get(url)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= http.StatusInternalServerError {
+			return errors.New("web server returned " + resp.Status)
+		}
+		return nil
+	})
+	if err != nil {
+		systemWideLogger.PrintAndLog("Update", "Update rolled back, restarting with the previous version", err)
+		executeShutdownSequence()
+	}
+}
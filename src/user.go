@@ -21,6 +21,7 @@ import (
 
 	auth "imuslab.com/arozos/mod/auth"
 	module "imuslab.com/arozos/mod/modules"
+	permission "imuslab.com/arozos/mod/permission"
 	prout "imuslab.com/arozos/mod/prouter"
 	user "imuslab.com/arozos/mod/user"
 	"imuslab.com/arozos/mod/utils"
@@ -80,12 +81,14 @@ func UserSystemInit() {
 		Group:        "Users",
 		StartDir:     "SystemAO/users/userList.html",
 		RequireAdmin: true,
+		Capability:   permission.CapUserManagement,
 	})
 
 	//Register auth management events that requires user handler
 	adminRouter := prout.NewModuleRouter(prout.RouterOption{
 		ModuleName:  "System Settings",
 		AdminOnly:   true,
+		Capability:  permission.CapUserManagement,
 		UserHandler: userHandler,
 		DeniedHandler: func(w http.ResponseWriter, r *http.Request) {
 			utils.SendErrorResponse(w, "Permission Denied")
@@ -93,11 +96,36 @@ func UserSystemInit() {
 	})
 
 	//Handle Authentication Unregister Handler
-	adminRouter.HandleFunc("/system/auth/unregister", authAgent.HandleUnregister)
+	adminRouter.HandleFunc("/system/auth/unregister", func(w http.ResponseWriter, r *http.Request) {
+		if !user_checkCanManageTarget(w, r) {
+			return
+		}
+		authAgent.HandleUnregister(w, r)
+	})
 	adminRouter.HandleFunc("/system/users/editUser", user_handleUserEdit)
 	adminRouter.HandleFunc("/system/users/removeUser", user_handleUserRemove)
 }
 
+// Check if the current user can manage the user given by the username paramter
+func user_checkCanManageTarget(w http.ResponseWriter, r *http.Request) bool {
+	currentUserinfo, err := userHandler.GetUserInfoFromRequest(w, r)
+	if err != nil {
+		utils.SendErrorResponse(w, "User not logged in")
+		return false
+	}
+	username, _ := utils.PostPara(r, "username")
+	targetUserinfo, err := userHandler.GetUserInfoFromUsername(username)
+	if err != nil {
+		utils.SendErrorResponse(w, "User not exists")
+		return false
+	}
+	if !permissionCanManageUser(currentUserinfo, targetUserinfo) {
+		utils.SendErrorResponse(w, "Only administrators can remove users with admin privileges")
+		return false
+	}
+	return true
+}
+
 // Remove a user from the system
 func user_handleUserRemove(w http.ResponseWriter, r *http.Request) {
 	username, err := utils.PostPara(r, "username")
@@ -130,11 +158,21 @@ func user_handleUserRemove(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !permissionCanManageUser(currentUserinfo, userinfo) {
+		utils.SendErrorResponse(w, "Only administrators can remove users with admin privileges")
+		return
+	}
+
 	//Clear Core User Data
 	userinfo.RemoveUser()
 
 	//Clearn Up FileSystem preferences
 	system_fs_removeUserPreferences(username)
+
+	//Clear the user's photo library index
+	if photoLibrary != nil {
+		photoLibrary.RemoveUserLibrary(username)
+	}
 	utils.SendOK(w)
 }
 
@@ -146,8 +184,8 @@ func user_handleUserEdit(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if userinfo.IsAdmin() == false {
-		//Require admin access
+	if !userinfo.HasCapability(permission.CapUserManagement) {
+		//Require user management access
 		utils.SendErrorResponse(w, "Permission Denied")
 		return
 	}
@@ -159,6 +197,18 @@ func user_handleUserEdit(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if opr != "" {
+		targetUserinfo, err := userHandler.GetUserInfoFromUsername(username)
+		if err != nil {
+			utils.SendErrorResponse(w, err.Error())
+			return
+		}
+		if !permissionCanManageUser(userinfo, targetUserinfo) {
+			utils.SendErrorResponse(w, "Only administrators can edit users with admin privileges")
+			return
+		}
+	}
+
 	if opr == "" {
 		//List this user information
 		type returnValue struct {
@@ -235,6 +285,11 @@ func user_handleUserEdit(w http.ResponseWriter, r *http.Request) {
 			}
 		}
 
+		if !permissionCanAssignGroups(userinfo, newGroupKeys) {
+			utils.SendErrorResponse(w, "Only administrators can assign groups with admin privileges")
+			return
+		}
+
 		//OK to proceed
 		userinfo, err := userHandler.GetUserInfoFromUsername(username)
 		if err != nil {
@@ -280,6 +335,9 @@ func user_handleUserEdit(w http.ResponseWriter, r *http.Request) {
 			utils.SendErrorResponse(w, err.Error())
 			return
 		}
+
+		//Logout the user from all devices
+		authAgent.RevokeUserSessions(username, "")
 		//Finish. Send back the reseted password
 		utils.SendJSONResponse(w, "\""+tmppassword+"\"")
 
@@ -423,6 +481,13 @@ func user_handleUserInfo(w http.ResponseWriter, r *http.Request) {
 		//OK! Change user password
 		newHashedPassword := auth.Hash(newpw)
 		sysdb.Write("auth", "passhash/"+username, newHashedPassword)
+
+		//Logout all other devices of this user, keep the current one
+		currentSessionID := ""
+		if currentSession, err := authAgent.GetSessionFromRequest(r); err == nil {
+			currentSessionID = currentSession.ID
+		}
+		authAgent.RevokeUserSessions(username, currentSessionID)
 		utils.SendOK(w)
 	} else if opr == "changeprofilepic" {
 		picdata, _ := utils.PostPara(r, "picdata")
@@ -6,6 +6,7 @@ import (
 	"strings"
 
 	wifi "imuslab.com/arozos/mod/network/wifi"
+	permission "imuslab.com/arozos/mod/permission"
 	prout "imuslab.com/arozos/mod/prouter"
 	"imuslab.com/arozos/mod/utils"
 )
@@ -29,6 +30,7 @@ func WiFiInit() {
 	router := prout.NewModuleRouter(prout.RouterOption{
 		ModuleName:  "System Setting",
 		AdminOnly:   true,
+		Capability:  permission.CapNetworkSettings,
 		UserHandler: userHandler,
 		DeniedHandler: func(w http.ResponseWriter, r *http.Request) {
 			utils.SendErrorResponse(w, "Permission Denied")
@@ -67,6 +69,7 @@ func WiFiInit() {
 				Group:        "Network",
 				StartDir:     "SystemAO/network/wifi.html",
 				RequireAdmin: true,
+				Capability:   permission.CapNetworkSettings,
 			})
 		}
 	}
@@ -81,7 +84,7 @@ func network_wifi_handleWiFiPower(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if !user.IsAdmin() {
+	if !user.HasCapability(permission.CapNetworkSettings) {
 		utils.SendErrorResponse(w, "Permission Denied")
 		return
 	}
@@ -149,7 +152,7 @@ func network_wifi_handleScan(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if !user.IsAdmin() {
+	if !user.HasCapability(permission.CapNetworkSettings) {
 		utils.SendErrorResponse(w, "Permission Denied")
 		return
 	}
@@ -184,7 +187,7 @@ func network_wifi_handleConnect(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	//Get information from client and create a new network config file
-	if !user.IsAdmin() {
+	if !user.HasCapability(permission.CapNetworkSettings) {
 		utils.SendErrorResponse(w, "Permission denied")
 		return
 	}
@@ -227,7 +230,7 @@ func network_wifi_handleWiFiRemove(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if !user.IsAdmin() {
+	if !user.HasCapability(permission.CapNetworkSettings) {
 		utils.SendErrorResponse(w, "Permission Denied")
 		return
 	}